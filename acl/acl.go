@@ -0,0 +1,238 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Package acl implements a broker.Authorizer from an access control list
+// in the format of the acl_file of mosquitto:
+//
+//	# Rules before the first user line apply to every client
+//	topic read $SYS/#
+//
+//	user alice
+//	topic readwrite alice/#
+//	topic read sensors/+/temp
+//	topic deny sensors/secret/#
+//
+//	# Patterns apply to every client, %c is replaced by the client
+//	# identifier and %u by the user name
+//	pattern write devices/%c/status
+//
+// The access is read, write, readwrite or deny; it defaults to readwrite.
+// A client may publish to the topics matched by a write rule and
+// subscribe to the topic filters covered by a read rule, unless a deny
+// rule matches. Everything else is denied.
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/topic"
+)
+
+type access int
+
+const (
+	accessRead access = 1 << iota
+	accessWrite
+	accessDeny
+)
+
+type rule struct {
+	access  access
+	filter  string
+	pattern bool // filter contains %c and %u
+}
+
+// ACL is an access control list. It is safe for concurrent use.
+type ACL struct {
+	global []rule // rules of every client, patterns included
+	users  map[string][]rule
+}
+
+// Load reads the access control list in the file at path
+func Load(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	return Parse(f)
+}
+
+// Parse reads an access control list
+func Parse(r io.Reader) (*ACL, error) {
+	a := &ACL{users: make(map[string][]rule)}
+	var user *string
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		keyword, rest := cut(line)
+		switch keyword {
+		case "user":
+			if rest == "" {
+				return nil, fmt.Errorf("acl: line %d: user without name", n)
+			}
+			name := rest
+			user = &name
+			if _, ok := a.users[name]; !ok {
+				a.users[name] = nil
+			}
+		case "topic", "pattern":
+			r, err := parseRule(rest)
+			if err != nil {
+				return nil, fmt.Errorf("acl: line %d: %v", n, err)
+			}
+			r.pattern = keyword == "pattern"
+			if user == nil || r.pattern {
+				a.global = append(a.global, r)
+			} else {
+				a.users[*user] = append(a.users[*user], r)
+			}
+		default:
+			return nil, fmt.Errorf("acl: line %d: unknown keyword %q", n, keyword)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// parseRule parses "[access] filter"
+func parseRule(s string) (rule, error) {
+	r := rule{access: accessRead | accessWrite}
+	first, rest := cut(s)
+	switch first {
+	case "read":
+		r.access = accessRead
+	case "write":
+		r.access = accessWrite
+	case "readwrite":
+	case "deny":
+		r.access = accessDeny
+	default:
+		rest = s
+	}
+	if rest == "" {
+		return r, fmt.Errorf("missing topic")
+	}
+	r.filter = rest
+	return r, nil
+}
+
+// cut splits s at the first run of white space
+func cut(s string) (string, string) {
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+// Authorize implements broker.Authorizer. Denials are reported as
+// broker.ErrNotAuthorized.
+func (a *ACL) Authorize(clientID, userName, name string, action broker.Action) error {
+	allowed := false
+	check := func(rules []rule) bool {
+		for _, r := range rules {
+			filter := r.filter
+			if r.pattern {
+				var ok bool
+				if filter, ok = expand(filter, clientID, userName); !ok {
+					continue
+				}
+			}
+			switch {
+			case r.access&accessDeny != 0:
+				if overlaps(filter, name, action) {
+					return false
+				}
+			case action == broker.ActionPublish && r.access&accessWrite != 0:
+				allowed = allowed || topic.Matches(filter, name)
+			case action == broker.ActionSubscribe && r.access&accessRead != 0:
+				allowed = allowed || topic.Covers(filter, name)
+			}
+		}
+		return true
+	}
+
+	if !check(a.global) {
+		return broker.ErrNotAuthorized
+	}
+	if userName != "" && !check(a.users[userName]) {
+		return broker.ErrNotAuthorized
+	}
+	if !allowed {
+		return broker.ErrNotAuthorized
+	}
+	return nil
+}
+
+// expand substitutes the client identifier and user name in a pattern.
+// It fails for values that would change the meaning of the filter, and
+// for an empty user name.
+func expand(pattern, clientID, userName string) (string, bool) {
+	if strings.Contains(pattern, "%c") {
+		if !literalLevel(clientID) {
+			return "", false
+		}
+		pattern = strings.ReplaceAll(pattern, "%c", clientID)
+	}
+	if strings.Contains(pattern, "%u") {
+		if !literalLevel(userName) {
+			return "", false
+		}
+		pattern = strings.ReplaceAll(pattern, "%u", userName)
+	}
+	return pattern, true
+}
+
+func literalLevel(s string) bool {
+	return s != "" && !strings.ContainsAny(s, "/+#")
+}
+
+// overlaps reports whether a deny rule for filter applies: for a PUBLISH
+// if filter matches the topic, for a SUBSCRIBE if a topic exists that
+// both filters match
+func overlaps(filter, name string, action broker.Action) bool {
+	if action == broker.ActionPublish {
+		return topic.Matches(filter, name)
+	}
+	a, b := strings.Split(filter, "/"), strings.Split(name, "/")
+	for i := 0; ; i++ {
+		switch {
+		case i == len(a) && i == len(b):
+			return true
+		case i == len(a):
+			return b[i] == "#"
+		case i == len(b):
+			return a[i] == "#"
+		case a[i] == "#" || b[i] == "#":
+			return true
+		case a[i] != b[i] && a[i] != "+" && b[i] != "+":
+			return false
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package acl
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/broker"
+)
+
+const testACL = `
+# Everyone
+topic read public/#
+topic deny public/secret/#
+
+user alice
+topic readwrite alice/#
+topic write sensors/+/temp
+
+user bob
+topic sensors/#
+
+pattern write devices/%c/status
+pattern read inbox/%u
+`
+
+func TestACL(t *testing.T) {
+	a, err := Parse(strings.NewReader(testACL))
+	require.NoError(t, err)
+
+	var testCases = []struct {
+		clientID, userName, topic string
+		action                    broker.Action
+		allowed                   bool
+	}{
+		{"c1", "", "public/news", broker.ActionSubscribe, true},
+		{"c1", "", "public/+/x", broker.ActionSubscribe, false}, // public/secret/x
+		{"c1", "", "public/news", broker.ActionPublish, false},
+		{"c1", "", "public/secret/x", broker.ActionSubscribe, false},
+		{"c1", "", "public/#", broker.ActionSubscribe, false},
+		{"c1", "", "#", broker.ActionSubscribe, false},
+		{"c1", "alice", "alice/a/b", broker.ActionPublish, true},
+		{"c1", "alice", "alice/#", broker.ActionSubscribe, true},
+		{"c1", "alice", "sensors/1/temp", broker.ActionPublish, true},
+		{"c1", "alice", "sensors/1/temp", broker.ActionSubscribe, false},
+		{"c1", "alice", "bob/x", broker.ActionPublish, false},
+		{"c1", "bob", "sensors/1/temp", broker.ActionSubscribe, true},
+		{"c1", "bob", "alice/x", broker.ActionPublish, false},
+		{"c1", "bob", "public/news", broker.ActionSubscribe, true},
+		{"dev1", "", "devices/dev1/status", broker.ActionPublish, true},
+		{"dev1", "", "devices/dev2/status", broker.ActionPublish, false},
+		{"dev/+", "", "devices/dev/+/status", broker.ActionPublish, false},
+		{"c1", "carol", "inbox/carol", broker.ActionSubscribe, true},
+		{"c1", "", "inbox/", broker.ActionSubscribe, false},
+	}
+
+	for _, tc := range testCases {
+		err := a.Authorize(tc.clientID, tc.userName, tc.topic, tc.action)
+		if tc.allowed {
+			assert.NoError(t, err, "%v %v %v", tc.userName, tc.action, tc.topic)
+		} else {
+			assert.Equal(t, broker.ErrNotAuthorized, err, "%v %v %v", tc.userName, tc.action, tc.topic)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, acl := range []string{"user", "topic", "topic read", "group admins"} {
+		_, err := Parse(strings.NewReader(acl))
+		assert.Error(t, err, acl)
+	}
+}
@@ -0,0 +1,160 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Package admin changes the settings of a running broker.Server, like its
+// limits and log levels, and keeps an audit log of the changes. It shows
+// the sessions of the server as well. Handler offers it over HTTP.
+package admin
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/session"
+)
+
+// API changes the settings of Server. The by argument of its methods
+// names who made the change, like the remote address of a request, for
+// the audit log.
+type API struct {
+	Server *broker.Server
+	// Levels are the log levels of the subsystems of Server. The log
+	// levels cannot be changed if nil.
+	Levels *logger.Levels
+	// Audit receives an entry for every setting changed. May be nil.
+	Audit logger.Logger
+
+	mu sync.Mutex // serializes changes, so that the audit log is in order
+}
+
+var (
+	errNoLevels  = errors.New("admin: log levels cannot be changed")
+	errNoSession = errors.New("admin: no such session")
+)
+
+// Tuning returns the limits Server currently applies
+func (a *API) Tuning() broker.Tuning {
+	return a.Server.Tuning()
+}
+
+// Tune changes the limits of Server, see broker.Server.Tune
+func (a *API) Tune(by string, t broker.Tuning) error {
+	return a.update(by, func(cur *broker.Tuning) error {
+		*cur = t
+		return nil
+	})
+}
+
+// update changes the limits of Server to what f makes of the current ones
+func (a *API) update(by string, f func(*broker.Tuning) error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	old := a.Server.Tuning()
+	t := old
+	if err := f(&t); err != nil {
+		return err
+	}
+	if err := a.Server.Tune(t); err != nil {
+		return err
+	}
+	for _, c := range changes(old, t) {
+		a.audit("admin: changed limit", by, logger.F("limit", c.name), logger.F("old", c.old), logger.F("new", c.new))
+	}
+	return nil
+}
+
+// SetLogLevel sets the log level of subsystem, or the default level if
+// subsystem is empty
+func (a *API) SetLogLevel(by, subsystem string, level logger.Level) error {
+	if a.Levels == nil {
+		return errNoLevels
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if subsystem == "" {
+		old := a.Levels.Default()
+		a.Levels.SetDefault(level)
+		a.audit("admin: changed default log level", by, logger.F("old", old), logger.F("new", level))
+		return nil
+	}
+	old, ok := a.Levels.Subsystems()[subsystem]
+	a.Levels.SetLevel(subsystem, level)
+	if ok {
+		a.audit("admin: changed log level", by, logger.F("subsystem", subsystem), logger.F("old", old), logger.F("new", level))
+	} else {
+		a.audit("admin: changed log level", by, logger.F("subsystem", subsystem), logger.F("new", level))
+	}
+	return nil
+}
+
+// ResetLogLevel makes subsystem log at the default level again
+func (a *API) ResetLogLevel(by, subsystem string) error {
+	if a.Levels == nil {
+		return errNoLevels
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	old, ok := a.Levels.Subsystems()[subsystem]
+	if !ok {
+		return nil
+	}
+	a.Levels.ResetLevel(subsystem)
+	a.audit("admin: reset log level", by, logger.F("subsystem", subsystem), logger.F("old", old))
+	return nil
+}
+
+// Sessions returns the sessions of Server with the messages in flight to
+// their clients, see broker.Server.SessionSnapshots
+func (a *API) Sessions() []session.Snapshot {
+	return a.Server.SessionSnapshots()
+}
+
+func (a *API) audit(msg, by string, fields ...logger.Field) {
+	if a.Audit != nil {
+		a.Audit.Log(logger.LevelInfo, msg, append(fields, logger.F("by", by))...)
+	}
+}
+
+type change struct {
+	name     string
+	old, new interface{}
+}
+
+// changes lists the limits that differ between old and new, under the
+// names of Handler
+func changes(old, new broker.Tuning) []change {
+	all := []change{
+		{"max_connections", old.MaxConnections, new.MaxConnections},
+		{"connection_rate", old.ConnectionRate, new.ConnectionRate},
+		{"connection_burst", old.ConnectionBurst, new.ConnectionBurst},
+		{"message_rate", old.MessageRate, new.MessageRate},
+		{"message_burst", old.MessageBurst, new.MessageBurst},
+		{"outbound_queue_size", old.OutboundQueueSize, new.OutboundQueueSize},
+		{"flush_strategy", old.Flush.Strategy, new.Flush.Strategy},
+		{"flush_interval", old.Flush.Interval, new.Flush.Interval},
+		{"flush_size", old.Flush.Size, new.Flush.Size},
+	}
+	var changed []change
+	for _, c := range all {
+		if c.old != c.new {
+			changed = append(changed, c)
+		}
+	}
+	return changed
+}
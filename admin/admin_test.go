@@ -0,0 +1,165 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+	"github.com/infinimesh/mqtt-go/transport"
+)
+
+func newAPI() (*API, *bytes.Buffer) {
+	var audit bytes.Buffer
+	return &API{
+		Server: &broker.Server{MaxConnections: 10, OutboundQueueSize: 100},
+		Levels: logger.NewLevels(logger.Nop, logger.LevelInfo),
+		Audit:  logger.Std(log.New(&audit, "", 0), logger.LevelDebug),
+	}, &audit
+}
+
+func TestAPITune(t *testing.T) {
+	a, audit := newAPI()
+	tuning := a.Tuning()
+	tuning.MaxConnections = 20
+	tuning.Flush.Strategy = transport.FlushTimed
+	require.NoError(t, a.Tune("alice", tuning))
+	assert.Equal(t, tuning, a.Server.Tuning())
+	assert.Contains(t, audit.String(), "admin: changed limit limit=max_connections old=10 new=20 by=alice")
+	assert.Contains(t, audit.String(), "limit=flush_strategy old=adaptive new=timed")
+	assert.NotContains(t, audit.String(), "outbound_queue_size")
+
+	audit.Reset()
+	tuning.MaxConnections = -1
+	assert.Error(t, a.Tune("alice", tuning))
+	assert.Equal(t, 20, a.Tuning().MaxConnections)
+	assert.Empty(t, audit.String())
+}
+
+func TestAPILogLevels(t *testing.T) {
+	a, audit := newAPI()
+	require.NoError(t, a.SetLogLevel("bob", "store", logger.LevelDebug))
+	require.NoError(t, a.SetLogLevel("bob", "", logger.LevelWarn))
+	assert.Equal(t, logger.LevelDebug, a.Levels.Level("store"))
+	assert.Equal(t, logger.LevelWarn, a.Levels.Level("broker"))
+	require.NoError(t, a.ResetLogLevel("bob", "store"))
+	require.NoError(t, a.ResetLogLevel("bob", "auth"), "no level of its own")
+	assert.Equal(t, logger.LevelWarn, a.Levels.Level("store"))
+	assert.Equal(t, []string{
+		"INFO admin: changed log level subsystem=store new=DEBUG by=bob",
+		"INFO admin: changed default log level old=INFO new=WARN by=bob",
+		"INFO admin: reset log level subsystem=store old=DEBUG by=bob",
+	}, strings.Split(strings.TrimSpace(audit.String()), "\n"))
+
+	a.Levels = nil
+	assert.Error(t, a.SetLogLevel("bob", "store", logger.LevelDebug))
+}
+
+func request(t *testing.T, h http.Handler, method, path, body string) (int, string) {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	b, err := io.ReadAll(w.Result().Body)
+	require.NoError(t, err)
+	return w.Code, string(b)
+}
+
+func TestHandlerTuning(t *testing.T) {
+	a, audit := newAPI()
+	h := a.Handler()
+
+	code, body := request(t, h, http.MethodGet, "/tuning", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"max_connections": 10, "connection_rate": 0, "connection_burst": 0,
+		"message_rate": 0, "message_burst": 0, "outbound_queue_size": 100,
+		"flush_strategy": "adaptive", "flush_interval": "0s", "flush_size": 0}`, body)
+
+	code, _ = request(t, h, http.MethodPut, "/tuning", `{"message_rate": 50, "flush_strategy": "sized", "flush_interval": "5ms"}`)
+	assert.Equal(t, http.StatusOK, code)
+	tuning := a.Tuning()
+	assert.Equal(t, 50.0, tuning.MessageRate)
+	assert.Equal(t, transport.FlushConfig{Strategy: transport.FlushSized, Interval: 5 * time.Millisecond}, tuning.Flush)
+	assert.Equal(t, 10, tuning.MaxConnections, "left alone")
+	assert.Contains(t, audit.String(), "limit=message_rate old=0 new=50 by=192.0.2.1:1234")
+
+	for _, body := range []string{
+		`{"max_connections": -1}`,
+		`{"flush_strategy": "never"}`,
+		`{"flush_interval": "soon"}`,
+		`{"max_connection": 1}`,
+		`{`,
+	} {
+		code, _ = request(t, h, http.MethodPut, "/tuning", body)
+		assert.Equal(t, http.StatusBadRequest, code, body)
+	}
+	assert.Equal(t, tuning, a.Tuning())
+
+	code, _ = request(t, h, http.MethodDelete, "/tuning", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+}
+
+func TestHandlerLogLevels(t *testing.T) {
+	a, _ := newAPI()
+	a.Levels.SetLevel("auth", logger.LevelDebug)
+	h := a.Handler()
+
+	code, body := request(t, h, http.MethodPut, "/log-levels", `{"default": "warn", "subsystems": {"store": "debug", "auth": ""}}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"default": "warn", "subsystems": {"store": "debug"}}`, body)
+
+	code, _ = request(t, h, http.MethodPut, "/log-levels", `{"default": "loud", "subsystems": {"auth": "debug"}}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	_, body = request(t, h, http.MethodGet, "/log-levels", "")
+	assert.JSONEq(t, `{"default": "warn", "subsystems": {"store": "debug"}}`, body, "nothing applied")
+
+	a.Levels = nil
+	code, _ = request(t, h, http.MethodGet, "/log-levels", "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestHandlerSessions(t *testing.T) {
+	a, _ := newAPI()
+	a.Server.Sessions = session.NewManager()
+	sess, _, err := a.Server.Sessions.Open("c", false)
+	require.NoError(t, err)
+	p := packet.NewPublish("t", 0, []byte("x"))
+	p.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+	_, err = sess.Outbound.Push(p)
+	require.NoError(t, err)
+	_, _, err = a.Server.Sessions.Open("b", true)
+	require.NoError(t, err)
+	h := a.Handler()
+
+	code, body := request(t, h, http.MethodGet, "/sessions", "")
+	assert.Equal(t, http.StatusOK, code)
+	var snaps []session.Snapshot
+	require.NoError(t, json.Unmarshal([]byte(body), &snaps))
+	require.Len(t, snaps, 2)
+	assert.Equal(t, "b", snaps[0].ClientID)
+	assert.Empty(t, snaps[0].Outbound)
+	assert.Equal(t, "c", snaps[1].ClientID)
+	require.Len(t, snaps[1].Outbound, 1)
+	assert.Equal(t, "t", snaps[1].Outbound[0].Topic)
+	assert.Equal(t, packet.QoSLevelAtLeastOnce, snaps[1].Outbound[0].QoS)
+
+	code, body = request(t, h, http.MethodGet, "/sessions/c", "")
+	assert.Equal(t, http.StatusOK, code)
+	var snap session.Snapshot
+	require.NoError(t, json.Unmarshal([]byte(body), &snap))
+	assert.Equal(t, snaps[1].Outbound[0].PacketID, snap.Outbound[0].PacketID)
+
+	code, _ = request(t, h, http.MethodGet, "/sessions/d", "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
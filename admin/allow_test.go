@@ -0,0 +1,47 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePrefix(t *testing.T) {
+	for s, want := range map[string]string{
+		"10.1.2.3/8":  "10.0.0.0/8",
+		"192.0.2.1":   "192.0.2.1/32",
+		"2001:db8::1": "2001:db8::1/128",
+	} {
+		p, err := ParsePrefix(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, p.String())
+	}
+	for _, s := range []string{"", "10.0.0.0/33", "localhost"} {
+		_, err := ParsePrefix(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestAllow(t *testing.T) {
+	h := Allow(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		append([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, Loopback...))
+	for addr, want := range map[string]int{
+		"127.0.0.1:1234":        http.StatusOK,
+		"[::1]:1234":            http.StatusOK,
+		"[::ffff:10.1.2.3]:123": http.StatusOK,
+		"10.1.2.3:1234":         http.StatusOK,
+		"192.0.2.1:1234":        http.StatusForbidden,
+		"[2001:db8::1]:1234":    http.StatusForbidden,
+		"pipe":                  http.StatusForbidden,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/tuning", nil)
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, want, w.Code, addr)
+	}
+}
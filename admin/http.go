@@ -0,0 +1,227 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/transport"
+)
+
+// tuning is broker.Tuning in JSON, under the names of the limits section
+// of the configuration of mqtt-broker
+type tuning struct {
+	MaxConnections    int                     `json:"max_connections"`
+	ConnectionRate    float64                 `json:"connection_rate"`
+	ConnectionBurst   int                     `json:"connection_burst"`
+	MessageRate       float64                 `json:"message_rate"`
+	MessageBurst      int                     `json:"message_burst"`
+	OutboundQueueSize int                     `json:"outbound_queue_size"`
+	FlushStrategy     transport.FlushStrategy `json:"flush_strategy"`
+	FlushInterval     duration                `json:"flush_interval"`
+	FlushSize         int                     `json:"flush_size"`
+}
+
+func tuningOf(t broker.Tuning) tuning {
+	return tuning{
+		MaxConnections:    t.MaxConnections,
+		ConnectionRate:    t.ConnectionRate,
+		ConnectionBurst:   t.ConnectionBurst,
+		MessageRate:       t.MessageRate,
+		MessageBurst:      t.MessageBurst,
+		OutboundQueueSize: t.OutboundQueueSize,
+		FlushStrategy:     t.Flush.Strategy,
+		FlushInterval:     duration(t.Flush.Interval),
+		FlushSize:         t.Flush.Size,
+	}
+}
+
+func (t tuning) broker() broker.Tuning {
+	return broker.Tuning{
+		MaxConnections:    t.MaxConnections,
+		ConnectionRate:    t.ConnectionRate,
+		ConnectionBurst:   t.ConnectionBurst,
+		MessageRate:       t.MessageRate,
+		MessageBurst:      t.MessageBurst,
+		OutboundQueueSize: t.OutboundQueueSize,
+		Flush: transport.FlushConfig{
+			Strategy: t.FlushStrategy,
+			Interval: time.Duration(t.FlushInterval),
+			Size:     t.FlushSize,
+		},
+	}
+}
+
+// duration is a time.Duration in JSON, like 5ms
+type duration time.Duration
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	*d = duration(v)
+	return err
+}
+
+// levels are the log levels in JSON. An empty level in a request makes
+// the subsystem log at the default level again.
+type levels struct {
+	Default    string            `json:"default"`
+	Subsystems map[string]string `json:"subsystems"`
+}
+
+// Handler serves the API as JSON:
+//
+//	GET  /tuning                the limits, like {"max_connections": 1000, "flush_interval": "1ms"}
+//	PUT  /tuning                changes the limits in the body, leaving the others alone
+//	GET  /log-levels            the log levels, like {"default": "info", "subsystems": {"store": "debug"}}
+//	PUT  /log-levels            changes the log levels in the body
+//	GET  /sessions              the sessions with the messages in flight to their clients, see session.Snapshot
+//	GET  /sessions/{client_id}  the session of one client
+//
+// The remote address of the request names who made a change in the audit
+// log. Handler authenticates no one, so it should only be reachable by
+// the operators of the broker.
+func (a *API) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tuning", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, tuningOf(a.Tuning()))
+	})
+	mux.HandleFunc("PUT /tuning", func(w http.ResponseWriter, r *http.Request) {
+		err := a.update(r.RemoteAddr, func(t *broker.Tuning) error {
+			body := tuningOf(*t)
+			if err := decodeJSON(r, &body); err != nil {
+				return err
+			}
+			*t = body.broker()
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, tuningOf(a.Tuning()))
+	})
+	mux.HandleFunc("GET /log-levels", func(w http.ResponseWriter, r *http.Request) {
+		if a.Levels == nil {
+			http.Error(w, errNoLevels.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, a.levels())
+	})
+	mux.HandleFunc("PUT /log-levels", func(w http.ResponseWriter, r *http.Request) {
+		if a.Levels == nil {
+			http.Error(w, errNoLevels.Error(), http.StatusNotFound)
+			return
+		}
+		var body levels
+		if err := decodeJSON(r, &body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := a.setLevels(r.RemoteAddr, body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, a.levels())
+	})
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.Sessions())
+	})
+	mux.HandleFunc("GET /sessions/{client_id}", func(w http.ResponseWriter, r *http.Request) {
+		for _, snap := range a.Sessions() {
+			if snap.ClientID == r.PathValue("client_id") {
+				writeJSON(w, snap)
+				return
+			}
+		}
+		http.Error(w, errNoSession.Error(), http.StatusNotFound)
+	})
+	return mux
+}
+
+func (a *API) levels() levels {
+	l := levels{
+		Default:    levelName(a.Levels.Default()),
+		Subsystems: map[string]string{},
+	}
+	for sub, level := range a.Levels.Subsystems() {
+		l.Subsystems[sub] = levelName(level)
+	}
+	return l
+}
+
+// setLevels applies body once all of its levels turned out valid
+func (a *API) setLevels(by string, body levels) error {
+	var def *logger.Level
+	if body.Default != "" {
+		level, err := logger.ParseLevel(body.Default)
+		if err != nil {
+			return err
+		}
+		def = &level
+	}
+	subs := map[string]*logger.Level{}
+	for sub, name := range body.Subsystems {
+		if sub == "" {
+			return errors.New("admin: empty subsystem")
+		}
+		subs[sub] = nil
+		if name != "" {
+			level, err := logger.ParseLevel(name)
+			if err != nil {
+				return err
+			}
+			subs[sub] = &level
+		}
+	}
+	if def != nil {
+		_ = a.SetLogLevel(by, "", *def)
+	}
+	for sub, level := range subs {
+		if level == nil {
+			_ = a.ResetLogLevel(by, sub)
+		} else {
+			_ = a.SetLogLevel(by, sub, *level)
+		}
+	}
+	return nil
+}
+
+func levelName(l logger.Level) string {
+	return strings.ToLower(l.String())
+}
+
+func decodeJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<16))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,309 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Package archive keeps the messages published to a broker in a
+// segmented, compressed append-only log on disk, for audits and to
+// replay them later.
+package archive
+
+import (
+	"cmp"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/topic"
+)
+
+const (
+	defaultSegmentSize = 64 << 20
+	segmentSuffix      = ".seg.gz"
+)
+
+// ErrClosed is returned by Append after Close
+var ErrClosed = errors.New("archive: closed")
+
+// Config selects the messages an Archive keeps and for how long
+type Config struct {
+	// Filters are the topic filters of the messages to archive, all
+	// messages if empty
+	Filters []string
+	// SegmentSize is the compressed size at which a segment is closed
+	// and the next one started. Defaults to 64 MiB.
+	SegmentSize int64
+	// MaxAge removes the segments whose last message is older. They are
+	// kept forever if 0.
+	MaxAge time.Duration
+	// MaxSize removes the oldest segments while all of them together
+	// are larger. 0 means no limit.
+	MaxSize int64
+	// Logger receives the errors of archiving messages. May be nil.
+	Logger logger.Logger
+}
+
+// Record is an archived message
+type Record struct {
+	Time    time.Time
+	Topic   string
+	QoS     packet.QosLevel
+	Payload []byte
+}
+
+// Archive is a broker hook writing the messages the clients publish to
+// an append-only log in a directory. The log is split into segments,
+// each a gzip stream of records, which are removed as a whole by the
+// retention of Config. Every Open starts a new segment, so a segment cut
+// short by a crash is never written to again. Add it last to the hooks
+// of the broker, so that it only sees messages no other hook dropped.
+type Archive struct {
+	broker.NopHook
+	dir string
+	cfg Config
+
+	mu   sync.Mutex
+	seq  uint64 // of the current segment
+	file *os.File
+	size countingWriter
+	zw   *gzip.Writer
+	buf  []byte
+}
+
+// countingWriter counts the bytes written to the current segment
+type countingWriter struct {
+	f *os.File
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.f.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// Open opens the archive in dir, creating the directory if needed, and
+// applies the retention of cfg to the segments already there
+func Open(dir string, cfg Config) (*Archive, error) {
+	for _, f := range cfg.Filters {
+		if err := packet.ValidateTopicFilter(f); err != nil {
+			return nil, fmt.Errorf("archive: filter %q: %w", f, err)
+		}
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	segs, err := segments(dir)
+	if err != nil {
+		return nil, err
+	}
+	a := &Archive{dir: dir, cfg: cfg}
+	if len(segs) > 0 {
+		a.seq = segs[len(segs)-1].seq
+	}
+	if err := a.rotate(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// OnPublish archives p if it matches the filters. The message is never
+// dropped, errors are logged.
+func (a *Archive) OnPublish(c *broker.Conn, p *packet.PublishControlPacket) error {
+	if !a.matches(p.VariableHeader.Topic) {
+		return nil
+	}
+	r := Record{Time: time.Now(), Topic: p.VariableHeader.Topic, QoS: p.FixedHeaderFlags.QoS, Payload: p.Payload}
+	if err := a.Append(r); err != nil && a.cfg.Logger != nil {
+		a.cfg.Logger.Log(logger.LevelError, "archive: failed to archive message",
+			logger.F("client_id", c.ClientID()), logger.F("topic", r.Topic), logger.F("error", err))
+	}
+	return nil
+}
+
+func (a *Archive) matches(name string) bool {
+	if len(a.cfg.Filters) == 0 {
+		return true
+	}
+	for _, f := range a.cfg.Filters {
+		if topic.Matches(f, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Append writes r to the current segment, regardless of the filters,
+// and starts the next one once the segment is full. Records are flushed
+// to the file at once, so that readers see them.
+func (a *Archive) Append(r Record) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.zw == nil {
+		return ErrClosed
+	}
+	a.buf = encode(a.buf[:0], r)
+	if _, err := a.zw.Write(a.buf); err != nil {
+		return err
+	}
+	if err := a.zw.Flush(); err != nil {
+		return err
+	}
+	if a.size.n >= a.segmentSize() {
+		return a.rotate()
+	}
+	return nil
+}
+
+// Close closes the current segment
+func (a *Archive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.zw == nil {
+		return nil
+	}
+	err := a.closeSegment()
+	a.zw = nil
+	return err
+}
+
+func (a *Archive) segmentSize() int64 {
+	if a.cfg.SegmentSize > 0 {
+		return a.cfg.SegmentSize
+	}
+	return defaultSegmentSize
+}
+
+// closeSegment ends the gzip stream of the current segment and closes
+// its file. a.mu must be held.
+func (a *Archive) closeSegment() error {
+	err := a.zw.Close()
+	if cerr := a.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// rotate closes the current segment, if any, starts the next one and
+// removes the segments beyond the retention. a.mu must be held, unless
+// called by Open.
+func (a *Archive) rotate() error {
+	if a.zw != nil {
+		if err := a.closeSegment(); err != nil {
+			return err
+		}
+	}
+	a.seq++
+	f, err := os.OpenFile(filepath.Join(a.dir, segmentName(a.seq)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		a.zw = nil
+		return err
+	}
+	a.file = f
+	a.size = countingWriter{f: f}
+	a.zw = gzip.NewWriter(&a.size)
+	return a.expire(time.Now())
+}
+
+// expire removes the segments before the current one that are older
+// than MaxAge or beyond MaxSize
+func (a *Archive) expire(now time.Time) error {
+	segs, err := segments(a.dir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for i := len(segs) - 1; i >= 0; i-- {
+		s := segs[i]
+		total += s.size
+		if s.seq == a.seq {
+			continue
+		}
+		expired := a.cfg.MaxAge > 0 && now.Sub(s.modTime) > a.cfg.MaxAge
+		if expired || a.cfg.MaxSize > 0 && total > a.cfg.MaxSize {
+			if err := os.Remove(s.path); err != nil {
+				return err
+			}
+			total -= s.size
+		}
+	}
+	return nil
+}
+
+// encode appends r to b: its length as a uvarint, then the time in Unix
+// nanoseconds as a varint, the QoS, the length of the topic as a
+// uvarint, the topic and the payload
+func encode(b []byte, r Record) []byte {
+	var body [2*binary.MaxVarintLen64 + 1]byte
+	n := binary.PutVarint(body[:], r.Time.UnixNano())
+	body[n] = byte(r.QoS)
+	n++
+	n += binary.PutUvarint(body[n:], uint64(len(r.Topic)))
+	b = binary.AppendUvarint(b, uint64(n+len(r.Topic)+len(r.Payload)))
+	b = append(b, body[:n]...)
+	b = append(b, r.Topic...)
+	return append(b, r.Payload...)
+}
+
+// segment is a file of the archive
+type segment struct {
+	seq     uint64
+	path    string
+	size    int64
+	modTime time.Time // of the last record
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, segmentSuffix)
+}
+
+// segments returns the segments in dir, oldest first
+func segments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []segment
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), segmentSuffix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		seq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		segs = append(segs, segment{seq: seq, path: filepath.Join(dir, e.Name()), size: info.Size(), modTime: info.ModTime()})
+	}
+	slices.SortFunc(segs, func(a, b segment) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+	return segs, nil
+}
@@ -0,0 +1,136 @@
+package archive
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func readAll(t *testing.T, r *Reader) []string {
+	var topics []string
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return topics
+		}
+		require.NoError(t, err)
+		topics = append(topics, rec.Topic+"="+string(rec.Payload))
+	}
+}
+
+func TestArchive(t *testing.T) {
+	dir := t.TempDir()
+	a, err := Open(dir, Config{Filters: []string{"a/#", "b"}, SegmentSize: 100})
+	require.NoError(t, err)
+	for _, name := range []string{"a/1", "c", "b", "a/2"} {
+		p := packet.NewPublish(name, 0, []byte("x"))
+		p.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+		require.NoError(t, a.OnPublish(nil, p))
+	}
+	start := time.Now().Add(-time.Minute)
+	for i := range 20 {
+		require.NoError(t, a.Append(Record{Time: start.Add(time.Duration(i) * time.Second), Topic: "d", Payload: make([]byte, 10)}))
+	}
+	require.NoError(t, a.Close())
+	segs, err := segments(dir)
+	require.NoError(t, err)
+	assert.Greater(t, len(segs), 1, "segments are rotated")
+
+	r, err := NewReader(dir, ReadOptions{})
+	require.NoError(t, err)
+	topics := readAll(t, r)
+	require.Len(t, topics, 23)
+	assert.Equal(t, []string{"a/1=x", "b=x", "a/2=x"}, topics[:3])
+
+	r, err = NewReader(dir, ReadOptions{Filter: "a/+"})
+	require.NoError(t, err)
+	rec, err := r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, packet.QoSLevelAtLeastOnce, rec.QoS)
+	assert.WithinDuration(t, time.Now(), rec.Time, time.Minute)
+	assert.Equal(t, []string{"a/2=x"}, readAll(t, r))
+
+	r, err = NewReader(dir, ReadOptions{Since: start.Add(5 * time.Second), Until: start.Add(8 * time.Second)})
+	require.NoError(t, err)
+	assert.Len(t, readAll(t, r), 3)
+
+	_, err = a.Append(Record{Topic: "a"}), nil
+	assert.ErrorIs(t, a.Append(Record{Topic: "a"}), ErrClosed)
+	_, err = Open(dir, Config{Filters: []string{"a/#/b"}})
+	assert.Error(t, err)
+}
+
+func TestReaderFollows(t *testing.T) {
+	dir := t.TempDir()
+	a, err := Open(dir, Config{})
+	require.NoError(t, err)
+	r, err := NewReader(dir, ReadOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, readAll(t, r), "nothing written yet")
+
+	require.NoError(t, a.Append(Record{Time: time.Now(), Topic: "1"}))
+	require.NoError(t, a.Append(Record{Time: time.Now(), Topic: "2"}))
+	assert.Equal(t, []string{"1=", "2="}, readAll(t, r))
+	require.NoError(t, a.Append(Record{Time: time.Now(), Topic: "3"}))
+	assert.Equal(t, []string{"3="}, readAll(t, r))
+
+	// The segment is completed by the next Open
+	require.NoError(t, a.Append(Record{Time: time.Now(), Topic: "4"}))
+	require.NoError(t, a.Close())
+	a, err = Open(dir, Config{})
+	require.NoError(t, err)
+	require.NoError(t, a.Append(Record{Time: time.Now(), Topic: "5"}))
+	assert.Equal(t, []string{"4=", "5="}, readAll(t, r))
+	require.NoError(t, a.Close())
+	require.NoError(t, r.Close())
+}
+
+func TestArchiveCrash(t *testing.T) {
+	dir := t.TempDir()
+	a, err := Open(dir, Config{})
+	require.NoError(t, err)
+	require.NoError(t, a.Append(Record{Time: time.Now(), Topic: "1"}))
+	// Not closed, the gzip stream has no end
+	b, err := Open(dir, Config{})
+	require.NoError(t, err)
+	require.NoError(t, b.Append(Record{Time: time.Now(), Topic: "2"}))
+	require.NoError(t, b.Close())
+
+	r, err := NewReader(dir, ReadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1=", "2="}, readAll(t, r))
+	require.NoError(t, a.Close())
+}
+
+func TestArchiveRetention(t *testing.T) {
+	dir := t.TempDir()
+	for range 4 {
+		a, err := Open(dir, Config{})
+		require.NoError(t, err)
+		require.NoError(t, a.Append(Record{Time: time.Now(), Topic: "t", Payload: make([]byte, 100)}))
+		require.NoError(t, a.Close())
+	}
+	segs, err := segments(dir)
+	require.NoError(t, err)
+	require.Len(t, segs, 4)
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(segs[0].path, old, old))
+
+	// The oldest segment expired, the next is beyond the size
+	a, err := Open(dir, Config{MaxAge: time.Hour, MaxSize: 2*segs[3].size + segs[3].size/2})
+	require.NoError(t, err)
+	defer a.Close() // nolint: errcheck
+	left, err := segments(dir)
+	require.NoError(t, err)
+	var seqs []uint64
+	for _, s := range left {
+		seqs = append(seqs, s.seq)
+	}
+	assert.Equal(t, []uint64{3, 4, 5}, seqs)
+}
@@ -0,0 +1,261 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/topic"
+)
+
+// ErrCorrupt is returned by Reader.Next for a record it cannot decode
+var ErrCorrupt = errors.New("archive: corrupt record")
+
+// ReadOptions select the records a Reader returns
+type ReadOptions struct {
+	// Since and Until limit the time of the records, unless zero. Since
+	// is inclusive, Until exclusive.
+	Since, Until time.Time
+	// Filter is the topic filter of the records, all of them if empty
+	Filter string
+}
+
+// Reader reads the records of an archive in the order they were
+// appended. It follows the segment an Archive is writing to: Next
+// returns io.EOF at the end of what was written so far, and the records
+// appended later on the next call. Segments the retention removes before
+// they are read are skipped. A Reader is not safe for concurrent use.
+type Reader struct {
+	dir  string
+	opts ReadOptions
+	segs []segment // waiting to be read
+	last uint64    // the sequence number of the last segment taken
+
+	cur  *segment // being read, or to be read on
+	read int      // records read from cur
+	// final is set once a segment after cur exists, so cur has been
+	// closed or was cut short by a crash
+	final bool
+
+	f  *os.File
+	br *bufio.Reader
+}
+
+// NewReader returns a Reader of the archive in dir
+func NewReader(dir string, opts ReadOptions) (*Reader, error) {
+	if opts.Filter != "" {
+		if err := packet.ValidateTopicFilter(opts.Filter); err != nil {
+			return nil, err
+		}
+	}
+	segs, err := segments(dir)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{dir: dir, opts: opts, segs: segs}
+	if len(segs) > 0 {
+		r.last = segs[len(segs)-1].seq
+	}
+	return r, nil
+}
+
+// Next returns the next record, or io.EOF after the last one
+func (r *Reader) Next() (Record, error) {
+	for {
+		if r.br == nil {
+			if err := r.open(); err != nil {
+				return Record{}, err
+			}
+		}
+		rec, err := decode(r.br)
+		switch {
+		case err == io.EOF:
+			// The segment was closed
+			r.closeSegment()
+			r.cur = nil
+			continue
+		case err == io.ErrUnexpectedEOF:
+			r.closeSegment()
+			if r.final {
+				r.cur = nil // cut short
+				continue
+			}
+			if r.final, err = r.newer(); err != nil {
+				return Record{}, err
+			}
+			if !r.final {
+				// The end of what was written so far
+				return Record{}, io.EOF
+			}
+			continue // read the rest of cur, written before the next one
+		case err != nil:
+			return Record{}, err
+		}
+		r.read++
+		if r.wanted(rec) {
+			return rec, nil
+		}
+	}
+}
+
+func (r *Reader) wanted(rec Record) bool {
+	if !r.opts.Since.IsZero() && rec.Time.Before(r.opts.Since) {
+		return false
+	}
+	if !r.opts.Until.IsZero() && !rec.Time.Before(r.opts.Until) {
+		return false
+	}
+	return r.opts.Filter == "" || topic.Matches(r.opts.Filter, rec.Topic)
+}
+
+// newer reports whether a segment after cur exists, adding the new ones
+// to r.segs
+func (r *Reader) newer() (bool, error) {
+	if len(r.segs) > 0 {
+		return true, nil
+	}
+	segs, err := segments(r.dir)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range segs {
+		if s.seq > r.last {
+			r.segs = append(r.segs, s)
+		}
+	}
+	return len(r.segs) > 0, nil
+}
+
+// open opens cur again, skipping the records already read, or else the
+// next segment
+func (r *Reader) open() error {
+	for {
+		if r.cur == nil {
+			ok, err := r.newer()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return io.EOF
+			}
+			s := r.segs[0]
+			r.segs = r.segs[1:]
+			r.last = s.seq
+			if !r.opts.Since.IsZero() && s.modTime.Before(r.opts.Since) {
+				continue // its last record is too old
+			}
+			r.cur, r.read, r.final = &s, 0, false
+		}
+		ok, err := r.openSegment()
+		if err != nil || ok {
+			return err
+		}
+		if r.final {
+			r.cur = nil // removed, or empty
+			continue
+		}
+		// Not written to yet
+		if r.final, err = r.newer(); err != nil || !r.final {
+			if err == nil {
+				err = io.EOF
+			}
+			return err
+		}
+	}
+}
+
+// openSegment opens cur and skips the records already read. It reports
+// false if cur was removed or has no complete header yet.
+func (r *Reader) openSegment() (bool, error) {
+	f, err := os.Open(r.cur.path)
+	if os.IsNotExist(err) {
+		r.final = true
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_ = f.Close()
+		return false, nil
+	}
+	if err != nil {
+		_ = f.Close()
+		return false, err
+	}
+	r.f, r.br = f, bufio.NewReader(zr)
+	for range r.read {
+		if _, err := decode(r.br); err != nil {
+			r.closeSegment()
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (r *Reader) closeSegment() {
+	if r.f != nil {
+		_ = r.f.Close()
+	}
+	r.f, r.br = nil, nil
+}
+
+// Close closes the segment being read
+func (r *Reader) Close() error {
+	r.closeSegment()
+	return nil
+}
+
+// decode reads a record written by encode
+func decode(br *bufio.Reader) (Record, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return Record{}, err
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(br, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Record{}, err
+	}
+	nanos, k := binary.Varint(body)
+	if k <= 0 || k >= len(body) {
+		return Record{}, ErrCorrupt
+	}
+	qos := packet.QosLevel(body[k])
+	body = body[k+1:]
+	l, k := binary.Uvarint(body)
+	if k <= 0 || l > uint64(len(body)-k) {
+		return Record{}, ErrCorrupt
+	}
+	return Record{
+		Time:    time.Unix(0, nanos),
+		Topic:   string(body[k : k+int(l)]),
+		QoS:     qos,
+		Payload: body[k+int(l):],
+	}, nil
+}
@@ -0,0 +1,23 @@
+module github.com/infinimesh/mqtt-go/benchmarks
+
+go 1.27.1
+
+require (
+	github.com/eclipse/paho.mqtt.golang v1.5.1
+	github.com/infinimesh/mqtt-go v0.0.0
+	github.com/mochi-mqtt/server/v2 v2.7.9
+	github.com/stretchr/testify v1.11.1
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/rs/xid v1.4.0 // indirect
+	golang.org/x/net v0.44.0 // indirect
+	golang.org/x/sync v0.17.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace github.com/infinimesh/mqtt-go => ../
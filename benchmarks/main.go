@@ -0,0 +1,128 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Command benchmarks runs the same load scenarios against this broker and
+// client and against mochi-mqtt and the Eclipse Paho client, on
+// localhost, and writes a comparison report in Markdown:
+//
+//	cd benchmarks && go run . -o report.md
+//
+// The scenarios are 1-to-1, fan-out from one publisher to -fan
+// subscribers and fan-in from -fan publishers to one subscriber. Each of
+// them delivers about -messages messages. Every client is a connection of
+// its own, so the default of 10000 needs a limit of open files of over
+// 20000, see ulimit -n.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("benchmarks: ")
+	err := runMain(os.Args[1:], os.Stdout, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runMain(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("benchmarks", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fan := fs.Int("fan", 10000, "clients on the wide side of the fan-out and fan-in scenarios")
+	messages := fs.Int("messages", 100000, "messages each scenario delivers")
+	qos := fs.Int("qos", 0, "QoS of the messages")
+	payload := fs.Int("payload", 64, "payload size in bytes, at least 8")
+	timeout := fs.Duration("timeout", time.Minute, "how long a scenario may take from the first message published")
+	parallel := fs.Int("parallel", 64, "clients connecting at the same time")
+	brokerNames := fs.String("brokers", "mqtt-go,mochi", "brokers to run, comma-separated")
+	clientNames := fs.String("clients", "mqtt-go,paho", "clients to run, comma-separated")
+	out := fs.String("o", "", "write the report to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *fan < 1 || *messages < 1 {
+		return errors.New("-fan and -messages must be positive")
+	}
+	if *qos < 0 || *qos > 2 {
+		return fmt.Errorf("invalid QoS %d", *qos)
+	}
+	if *payload < 8 {
+		return errors.New("-payload must be at least 8 bytes for the timestamp")
+	}
+	brokers, err := pick(*brokerNames, allBrokers)
+	if err != nil {
+		return err
+	}
+	clients, err := pick(*clientNames, allClients)
+	if err != nil {
+		return err
+	}
+
+	cfg := runConfig{QoS: byte(*qos), PayloadSize: *payload, Timeout: *timeout, Parallel: max(1, *parallel)}
+	var results []Result
+	for _, sc := range scenarios(*fan, *messages) {
+		for _, b := range brokers {
+			for _, c := range clients {
+				r := run(b(), c, sc, cfg)
+				fmt.Fprintf(stderr, "%s, %s broker, %s client: %s\n", sc.Name, r.Broker, r.Client, r.summary())
+				results = append(results, r)
+			}
+		}
+	}
+
+	w := stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close() // nolint: errcheck
+		w = f
+	}
+	return writeReport(w, cfg, results)
+}
+
+// pick returns the entries of all named in the comma-separated list names
+func pick[T any](names string, all map[string]T) ([]T, error) {
+	var picked []T
+	for _, name := range strings.Split(names, ",") {
+		v, ok := all[strings.TrimSpace(name)]
+		if !ok {
+			known := make([]string, 0, len(all))
+			for k := range all {
+				known = append(known, k)
+			}
+			slices.Sort(known)
+			return nil, fmt.Errorf("unknown stack %q, choose from %s", name, strings.Join(known, ", "))
+		}
+		picked = append(picked, v)
+	}
+	return picked, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	cfg := runConfig{QoS: 1, PayloadSize: 16, Timeout: 10 * time.Second, Parallel: 8}
+	for _, sc := range scenarios(20, 200) {
+		for name, b := range allBrokers {
+			for _, c := range allClients {
+				r := run(b(), c, sc, cfg)
+				require.NoError(t, r.Err, "%s, %s broker, %s client", sc.Name, name, c.Name())
+				assert.Equal(t, sc.Deliveries(), r.Delivered)
+				assert.Positive(t, r.Throughput())
+				assert.Positive(t, r.Latency99)
+			}
+		}
+	}
+}
+
+func TestRunMain(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	require.NoError(t, runMain([]string{"-fan", "5", "-messages", "50", "-brokers", "mqtt-go", "-clients", "paho"}, &stdout, &stderr))
+	assert.Contains(t, stdout.String(), "| 1-to-1 | mqtt-go | paho | 50/50 |")
+	assert.Contains(t, stdout.String(), "| fan-out 1-to-5 | mqtt-go | paho | 50/50 |")
+	assert.Contains(t, stdout.String(), "| fan-in 5-to-1 | mqtt-go | paho | 50/50 |")
+	assert.Contains(t, stderr.String(), "fan-in 5-to-1, mqtt-go broker, paho client: 50/50 messages")
+
+	assert.Error(t, runMain([]string{"-brokers", "mosquitto"}, &stdout, &stderr))
+	assert.Error(t, runMain([]string{"-payload", "4"}, &stdout, &stderr))
+}
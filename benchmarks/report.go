@@ -0,0 +1,53 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+)
+
+// writeReport writes the results as a Markdown table, with the settings
+// they were measured with
+func writeReport(w io.Writer, cfg runConfig, results []Result) error {
+	_, err := fmt.Fprintf(w, "# MQTT benchmarks\n\n%s %s/%s, GOMAXPROCS %d, %d CPUs. QoS %d, %d byte payloads, over localhost.\n\n",
+		runtime.Version(), runtime.GOOS, runtime.GOARCH, runtime.GOMAXPROCS(0), runtime.NumCPU(), cfg.QoS, cfg.PayloadSize)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, "| Scenario | Broker | Client | Delivered | Elapsed | msg/s | p50 latency | p99 latency | Error |\n|---|---|---|---:|---:|---:|---:|---:|---|")
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		errText := ""
+		if r.Err != nil {
+			errText = r.Err.Error()
+		}
+		_, err := fmt.Fprintf(w, "| %s | %s | %s | %d/%d | %v | %.0f | %v | %v | %s |\n",
+			r.Scenario.Name, r.Broker, r.Client, r.Delivered, r.Scenario.Deliveries(),
+			r.Elapsed.Round(time.Millisecond), r.Throughput(),
+			r.Latency50.Round(time.Microsecond), r.Latency99.Round(time.Microsecond), errText)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	benchTopic = "bench/load"
+	// maxSamples limits how many latencies a run keeps, the first ones
+	maxSamples = 1 << 20
+	// idleTimeout is how long a run waits for the next message once all
+	// were published, before it considers the rest lost, e.g. dropped
+	// QoS 0 messages
+	idleTimeout = 2 * time.Second
+)
+
+var (
+	errTimeout = errors.New("benchmarks: timed out waiting for the messages")
+	errLost    = errors.New("benchmarks: messages were lost")
+)
+
+// Scenario is a load pattern that is run against every combination of
+// broker and client
+type Scenario struct {
+	Name        string
+	Publishers  int
+	Subscribers int
+	// Messages is how many messages every publisher sends
+	Messages int
+}
+
+// Deliveries is the number of messages all subscribers receive together
+// if none is lost
+func (sc Scenario) Deliveries() int {
+	return sc.Publishers * sc.Subscribers * sc.Messages
+}
+
+// scenarios returns the scenarios with fan clients on their wide side,
+// each delivering about deliveries messages
+func scenarios(fan, deliveries int) []Scenario {
+	perFan := max(1, deliveries/fan)
+	return []Scenario{
+		{Name: "1-to-1", Publishers: 1, Subscribers: 1, Messages: deliveries},
+		{Name: fmt.Sprintf("fan-out 1-to-%d", fan), Publishers: 1, Subscribers: fan, Messages: perFan},
+		{Name: fmt.Sprintf("fan-in %d-to-1", fan), Publishers: fan, Subscribers: 1, Messages: perFan},
+	}
+}
+
+// runConfig are the settings shared by all runs
+type runConfig struct {
+	QoS         byte
+	PayloadSize int
+	// Timeout limits how long a run may take from the first message
+	// published
+	Timeout time.Duration
+	// Parallel limits the clients connecting at the same time
+	Parallel int
+}
+
+// Result is the outcome of running a Scenario
+type Result struct {
+	Scenario       Scenario
+	Broker, Client string
+	// Elapsed is the time from the first message published until the
+	// last one was delivered
+	Elapsed   time.Duration
+	Delivered int
+	// Latency50 and Latency99 are percentiles of the time from publishing
+	// a message until it was delivered
+	Latency50, Latency99 time.Duration
+	// Err is why the run failed or did not deliver every message
+	Err error
+}
+
+// Throughput returns the delivered messages per second
+func (r Result) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Delivered) / r.Elapsed.Seconds()
+}
+
+func (r Result) summary() string {
+	s := fmt.Sprintf("%d/%d messages in %v, %.0f msg/s", r.Delivered, r.Scenario.Deliveries(), r.Elapsed.Round(time.Millisecond), r.Throughput())
+	if r.Err != nil {
+		s += ", " + r.Err.Error()
+	}
+	return s
+}
+
+// recorder counts the deliveries and keeps their latencies
+type recorder struct {
+	want     int64
+	received atomic.Int64
+	samples  []atomic.Int64 // nanoseconds, set once each
+	last     atomic.Int64
+	done     chan struct{}
+}
+
+func newRecorder(want int) *recorder {
+	return &recorder{
+		want:    int64(want),
+		samples: make([]atomic.Int64, min(want, maxSamples)),
+		done:    make(chan struct{}),
+	}
+}
+
+// deliver records a message whose payload starts with the time it was
+// published
+func (r *recorder) deliver(payload []byte) {
+	now := time.Now().UnixNano()
+	n := r.received.Add(1)
+	if n <= int64(len(r.samples)) && len(payload) >= 8 {
+		r.samples[n-1].Store(now - int64(binary.BigEndian.Uint64(payload)))
+	}
+	r.last.Store(now)
+	if n == r.want {
+		close(r.done)
+	}
+}
+
+// wait waits until all messages were delivered, no message arrived for
+// idleTimeout or the deadline passed
+func (r *recorder) wait(deadline time.Time) error {
+	ticker := time.NewTicker(idleTimeout / 10)
+	defer ticker.Stop()
+	received, progress := r.received.Load(), time.Now()
+	for {
+		select {
+		case <-r.done:
+			return nil
+		case now := <-ticker.C:
+			if now.After(deadline) {
+				return errTimeout
+			}
+			if n := r.received.Load(); n != received {
+				received, progress = n, now
+			} else if now.Sub(progress) > idleTimeout {
+				return errLost
+			}
+		}
+	}
+}
+
+// percentiles returns the 50th and 99th percentile of the latencies. Late
+// messages may still be delivered.
+func (r *recorder) percentiles() (time.Duration, time.Duration) {
+	samples := make([]int64, 0, min(int(r.received.Load()), len(r.samples)))
+	for i := range cap(samples) {
+		if v := r.samples[i].Load(); v != 0 {
+			samples = append(samples, v)
+		}
+	}
+	if len(samples) == 0 {
+		return 0, 0
+	}
+	slices.Sort(samples)
+	return time.Duration(samples[len(samples)/2]), time.Duration(samples[len(samples)*99/100])
+}
+
+// run runs sc with a new broker b and clients of c
+func run(b Broker, c Client, sc Scenario, cfg runConfig) Result {
+	result := Result{Scenario: sc, Broker: b.Name(), Client: c.Name()}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if err := b.Start(l); err != nil {
+		_ = l.Close()
+		result.Err = err
+		return result
+	}
+	defer b.Close() // nolint: errcheck
+	addr := l.Addr().String()
+
+	rec := newRecorder(sc.Deliveries())
+	subs, err := connectAll(c, addr, "sub", sc.Subscribers, cfg.Parallel, func(conn Conn) error {
+		return conn.Subscribe(benchTopic, cfg.QoS, rec.deliver)
+	})
+	defer disconnectAll(subs)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	pubs, err := connectAll(c, addr, "pub", sc.Publishers, cfg.Parallel, nil)
+	defer disconnectAll(pubs)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	var publishErr atomic.Value
+	for _, pub := range pubs {
+		wg.Add(1)
+		go func(pub Conn) {
+			defer wg.Done()
+			for i := 0; i < sc.Messages; i++ {
+				payload := make([]byte, cfg.PayloadSize)
+				binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+				if err := pub.Publish(benchTopic, cfg.QoS, payload); err != nil {
+					publishErr.CompareAndSwap(nil, err)
+					return
+				}
+			}
+		}(pub)
+	}
+	wg.Wait()
+
+	result.Err = rec.wait(start.Add(cfg.Timeout))
+	if err, _ := publishErr.Load().(error); err != nil {
+		result.Err = err
+	}
+	result.Delivered = int(min(rec.received.Load(), rec.want))
+	if last := rec.last.Load(); last > 0 {
+		result.Elapsed = time.Unix(0, last).Sub(start)
+	}
+	result.Latency50, result.Latency99 = rec.percentiles()
+	return result
+}
+
+// connectAll connects n clients named prefix-0 and so forth, at most
+// parallel at a time, and calls setup for each of them if not nil. It
+// returns the clients connected so far on errors.
+func connectAll(c Client, addr, prefix string, n, parallel int, setup func(Conn) error) ([]Conn, error) {
+	conns := make([]Conn, n)
+	errs := make([]error, n)
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			conn, err := c.Connect(addr, fmt.Sprintf("%s-%d", prefix, i))
+			if err == nil && setup != nil {
+				if err = setup(conn); err != nil {
+					_ = conn.Disconnect()
+				}
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("%s-%d: %w", prefix, i, err)
+				return
+			}
+			conns[i] = conn
+		}(i)
+	}
+	wg.Wait()
+	connected := slices.DeleteFunc(conns, func(conn Conn) bool { return conn == nil })
+	return connected, errors.Join(errs...)
+}
+
+// disconnectAll disconnects conns in parallel
+func disconnectAll(conns []Conn) {
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn Conn) {
+			defer wg.Done()
+			_ = conn.Disconnect()
+		}(conn)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,189 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/client"
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// Broker is a broker under test. Every run gets a new one.
+type Broker interface {
+	Name() string
+	// Start serves l in the background until Close
+	Start(l net.Listener) error
+	Close() error
+}
+
+// Client connects the clients of a scenario to a broker
+type Client interface {
+	Name() string
+	Connect(addr, clientID string) (Conn, error)
+}
+
+// Conn is a connected client. Subscribe and Publish return once the
+// broker acknowledged them, or the message was written with QoS 0.
+type Conn interface {
+	Subscribe(topic string, qos byte, handler func(payload []byte)) error
+	Publish(topic string, qos byte, payload []byte) error
+	Disconnect() error
+}
+
+// allBrokers and allClients are the stacks by the names of the -brokers
+// and -clients flags. Both run with their default settings.
+var (
+	allBrokers = map[string]func() Broker{
+		"mqtt-go": func() Broker { return &mqttgoBroker{} },
+		"mochi":   func() Broker { return &mochiBroker{} },
+	}
+	allClients = map[string]Client{
+		"mqtt-go": mqttgoClient{},
+		"paho":    pahoClient{},
+	}
+)
+
+type mqttgoBroker struct {
+	s *broker.Server
+}
+
+func (*mqttgoBroker) Name() string { return "mqtt-go" }
+
+func (b *mqttgoBroker) Start(l net.Listener) error {
+	b.s = &broker.Server{Logger: logger.Nop}
+	go b.s.Serve(l) // nolint: errcheck
+	return nil
+}
+
+func (b *mqttgoBroker) Close() error {
+	return b.s.Close()
+}
+
+type mochiBroker struct {
+	s *mochi.Server
+}
+
+func (*mochiBroker) Name() string { return "mochi" }
+
+func (b *mochiBroker) Start(l net.Listener) error {
+	b.s = mochi.New(&mochi.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err := b.s.AddHook(new(auth.AllowHook), nil); err != nil {
+		return err
+	}
+	if err := b.s.AddListener(listeners.NewNet("bench", l)); err != nil {
+		return err
+	}
+	return b.s.Serve()
+}
+
+func (b *mochiBroker) Close() error {
+	return b.s.Close()
+}
+
+type mqttgoClient struct{}
+
+func (mqttgoClient) Name() string { return "mqtt-go" }
+
+func (mqttgoClient) Connect(addr, clientID string) (Conn, error) {
+	c, err := client.Dial(addr, client.Options{ClientID: clientID, CleanSession: true})
+	if err != nil {
+		return nil, err
+	}
+	return mqttgoConn{c}, nil
+}
+
+type mqttgoConn struct {
+	c *client.Client
+}
+
+func (c mqttgoConn) Subscribe(topic string, qos byte, handler func(payload []byte)) error {
+	_, err := c.c.Subscribe(context.Background(), topic, packet.QosLevel(qos), func(_ *client.Client, m client.Message) {
+		handler(m.Payload)
+	})
+	return err
+}
+
+func (c mqttgoConn) Publish(topic string, qos byte, payload []byte) error {
+	return c.c.Publish(context.Background(), topic, packet.QosLevel(qos), false, payload)
+}
+
+func (c mqttgoConn) Disconnect() error {
+	return c.c.Disconnect()
+}
+
+type pahoClient struct{}
+
+func (pahoClient) Name() string { return "paho" }
+
+func (pahoClient) Connect(addr, clientID string) (Conn, error) {
+	opts := paho.NewClientOptions().
+		AddBroker("tcp://" + addr).
+		SetClientID(clientID).
+		SetCleanSession(true).
+		SetAutoReconnect(false).
+		SetOrderMatters(false)
+	c := paho.NewClient(opts)
+	if err := wait(c.Connect()); err != nil {
+		return nil, err
+	}
+	return pahoConn{c}, nil
+}
+
+type pahoConn struct {
+	c paho.Client
+}
+
+func (c pahoConn) Subscribe(topic string, qos byte, handler func(payload []byte)) error {
+	return wait(c.c.Subscribe(topic, qos, func(_ paho.Client, m paho.Message) {
+		handler(m.Payload())
+	}))
+}
+
+func (c pahoConn) Publish(topic string, qos byte, payload []byte) error {
+	return wait(c.c.Publish(topic, qos, false, payload))
+}
+
+func (c pahoConn) Disconnect() error {
+	c.c.Disconnect(100)
+	return nil
+}
+
+// pahoTimeout limits how long a Paho operation may take
+const pahoTimeout = 30 * time.Second
+
+var errPahoTimeout = errors.New("benchmarks: paho operation timed out")
+
+func wait(t paho.Token) error {
+	if !t.WaitTimeout(pahoTimeout) {
+		return errPahoTimeout
+	}
+	return t.Error()
+}
@@ -0,0 +1,298 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Package bridge connects a broker to a remote broker, like the bridges
+// of mosquitto: the bridge is a client of the remote broker and copies
+// messages between the two according to a list of topic mappings.
+package bridge
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/client"
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/topic"
+)
+
+var (
+	// ErrNotConnected is returned by Forward while the bridge has no
+	// connection to the remote broker
+	ErrNotConnected = errors.New("bridge: not connected")
+	// ErrBridgeClosed is returned by Run after Close
+	ErrBridgeClosed = errors.New("bridge: Bridge closed")
+)
+
+const defaultRetryInterval = 5 * time.Second
+
+// Direction is the way messages of a Topic travel
+type Direction int
+
+const (
+	// Out copies messages of local clients to the remote broker
+	Out Direction = 1 << iota
+	// In copies messages of the remote broker to local clients
+	In
+	// Both copies messages both ways. The remote subscription is made
+	// with the MQTT 5 No Local option, so that messages the bridge sent
+	// don't come back.
+	Both = In | Out
+)
+
+// Topic maps local to remote topics. A message on the local topic
+// LocalPrefix+T is copied to RemotePrefix+T and vice versa, for every T
+// matching Pattern.
+type Topic struct {
+	// Pattern is a topic filter, "#" for every topic below the prefixes
+	Pattern   string
+	Direction Direction
+	// QoS is the maximum QoS of the copied messages, messages with a
+	// higher one are downgraded to it
+	QoS          packet.QosLevel
+	LocalPrefix  string
+	RemotePrefix string
+}
+
+// Bridge is a connection to a remote broker. The local broker hands every
+// PUBLISH of its clients to Forward and delivers the messages passed to
+// Deliver. Set the fields before calling Run.
+type Bridge struct {
+	// Addr is the TCP address of the remote broker
+	Addr string
+	// Options are used to connect to the remote broker. The protocol
+	// version defaults to MQTT 5. Its Events receive Reconnecting as
+	// well.
+	Options client.Options
+	// Dial opens the connection to the remote broker, e.g. with TLS.
+	// Addr is dialled over TCP if nil.
+	Dial func() (net.Conn, error)
+	// Topics are the mappings of the copied topics
+	Topics []Topic
+	// Deliver is called with the messages copied from the remote broker.
+	// It must deliver them to the local subscribers only, handing them
+	// to Forward again would copy them back.
+	Deliver func(p *packet.PublishControlPacket)
+	// RetryInterval is the wait before reconnecting. Defaults to five
+	// seconds.
+	RetryInterval time.Duration
+	// Logger receives the log entries of the bridge. May be nil.
+	Logger logger.Logger
+
+	mu     sync.Mutex
+	client *client.Client
+	quit   chan struct{}
+	closed bool
+}
+
+func (b *Bridge) init() {
+	if b.quit == nil {
+		b.quit = make(chan struct{})
+	}
+}
+
+// Run connects to the remote broker and subscribes there to the topics
+// copied in, reconnecting whenever the connection is lost. It returns
+// ErrBridgeClosed after Close.
+func (b *Bridge) Run() error {
+	b.mu.Lock()
+	b.init()
+	quit := b.quit
+	b.mu.Unlock()
+
+	attempt := 0 // since the last connection that succeeded
+	for {
+		if attempt > 0 {
+			b.Options.Events.Emit(client.Reconnecting{ClientID: b.Options.ClientID, Attempt: attempt})
+		}
+		attempt++
+		c, err := b.connect()
+		if err == nil {
+			b.mu.Lock()
+			b.client = c
+			b.mu.Unlock()
+
+			if err = b.subscribe(c); err != nil {
+				_ = c.Disconnect()
+			} else {
+				b.log(logger.LevelInfo, "bridge: connected", logger.F("addr", b.Addr))
+				attempt = 1
+				select {
+				case <-c.Done():
+					err = c.Err()
+				case <-quit:
+					_ = c.Disconnect()
+				}
+			}
+
+			b.mu.Lock()
+			b.client = nil
+			b.mu.Unlock()
+		}
+		if b.isClosed() {
+			return ErrBridgeClosed
+		}
+		b.log(logger.LevelWarn, "bridge: connection failed", logger.F("addr", b.Addr), logger.F("error", err))
+
+		select {
+		case <-quit:
+			return ErrBridgeClosed
+		case <-time.After(b.retryInterval()):
+		}
+	}
+}
+
+// connect establishes the connection to the remote broker
+func (b *Bridge) connect() (*client.Client, error) {
+	dial := b.Dial
+	if dial == nil {
+		dial = func() (net.Conn, error) { return net.Dial("tcp", b.Addr) }
+	}
+	conn, err := dial()
+	if err != nil {
+		b.Options.Events.Emit(client.ConnectFailed{ClientID: b.Options.ClientID, Err: err})
+		return nil, err
+	}
+	opts := b.Options
+	if opts.ProtocolVersion == 0 {
+		opts.ProtocolVersion = packet.ProtocolVersion5
+	}
+	// Every message is delivered once, even if several mappings match
+	opts.OnMessage = b.deliver
+	c, err := client.Connect(conn, opts)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// subscribe subscribes at the remote broker to the topics copied in
+func (b *Bridge) subscribe(c *client.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, t := range b.Topics {
+		if t.Direction&In == 0 {
+			continue
+		}
+		sub := packet.Subscription{
+			Topic:   t.RemotePrefix + t.Pattern,
+			QoS:     t.QoS,
+			NoLocal: t.Direction&Out != 0,
+		}
+		if _, err := c.SubscribeWith(ctx, sub, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close disconnects from the remote broker and makes Run return
+func (b *Bridge) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.init()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	close(b.quit)
+	if b.client != nil {
+		return b.client.Disconnect()
+	}
+	return nil
+}
+
+// Forward copies p to the remote broker if a mapping copies its topic
+// out. It waits for the acknowledgement of QoS 1 and 2 messages, but at
+// most until ctx is done. Messages it fails to forward can be kept with
+// broker.Server.DeadLetter and broker.DropForwardFailed.
+func (b *Bridge) Forward(ctx context.Context, p *packet.PublishControlPacket) error {
+	t, rest, ok := b.match(p.VariableHeader.Topic, Out, func(t Topic) string { return t.LocalPrefix })
+	if !ok {
+		return nil
+	}
+
+	b.mu.Lock()
+	c := b.client
+	b.mu.Unlock()
+	if c == nil {
+		return ErrNotConnected
+	}
+	qos := p.FixedHeaderFlags.QoS
+	if qos > t.QoS {
+		qos = t.QoS
+	}
+	return c.Publish(ctx, t.RemotePrefix+rest, qos, p.FixedHeaderFlags.Retain, p.Payload)
+}
+
+// deliver hands a message from the remote broker to the local broker
+func (b *Bridge) deliver(_ *client.Client, m client.Message) {
+	t, rest, ok := b.match(m.Topic, In, func(t Topic) string { return t.RemotePrefix })
+	if !ok || b.Deliver == nil {
+		return
+	}
+	qos := m.QoS
+	if qos > t.QoS {
+		qos = t.QoS
+	}
+	p := packet.NewPublish(t.LocalPrefix+rest, 0, m.Payload)
+	p.FixedHeaderFlags.QoS = qos
+	p.FixedHeaderFlags.Retain = m.Retained
+	b.Deliver(p)
+}
+
+// match returns the first mapping in direction dir whose prefix, as
+// returned by prefix, and pattern match name, and name without the prefix
+func (b *Bridge) match(name string, dir Direction, prefix func(Topic) string) (Topic, string, bool) {
+	for _, t := range b.Topics {
+		if t.Direction&dir == 0 {
+			continue
+		}
+		rest := strings.TrimPrefix(name, prefix(t))
+		if len(rest) == len(name) && prefix(t) != "" {
+			continue
+		}
+		if topic.Matches(t.Pattern, rest) {
+			return t, rest, true
+		}
+	}
+	return Topic{}, "", false
+}
+
+func (b *Bridge) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+func (b *Bridge) retryInterval() time.Duration {
+	if b.RetryInterval > 0 {
+		return b.RetryInterval
+	}
+	return defaultRetryInterval
+}
+
+func (b *Bridge) log(level logger.Level, msg string, fields ...logger.Field) {
+	if b.Logger != nil {
+		b.Logger.Log(level, msg, fields...)
+	}
+}
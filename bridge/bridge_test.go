@@ -0,0 +1,150 @@
+package bridge
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/client"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// remote is a broker that reports the packets of the bridge. It has a
+// retained message for the bridge to receive when subscribing.
+type remote struct {
+	broker.NopHook
+	subscriptions chan packet.Subscription
+	publishes     chan *packet.PublishControlPacket
+}
+
+func (r *remote) OnSubscribe(c *broker.Conn, p *packet.SubscribeControlPacket) error {
+	r.subscriptions <- p.Payload.Subscriptions[0]
+	return nil
+}
+
+func newRemote(t *testing.T) (*remote, string) {
+	r := &remote{
+		subscriptions: make(chan packet.Subscription, 10),
+		publishes:     make(chan *packet.PublishControlPacket, 10),
+	}
+	retained := broker.NewMemoryRetainStore()
+	msg := packet.NewPublish("remote/in/a", 0, []byte("hello"))
+	msg.FixedHeaderFlags.QoS = packet.QoSLevelExactlyOnce
+	msg.FixedHeaderFlags.Retain = true
+	require.NoError(t, retained.Retain(msg))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &broker.Server{
+		Handler: broker.HandlerFunc(func(c *broker.Conn, p packet.ControlPacket) {
+			if p, ok := p.(*packet.PublishControlPacket); ok {
+				r.publishes <- p
+			}
+		}),
+		RetainStore: retained,
+		Hooks:       []broker.Hook{r},
+	}
+	go s.Serve(l) // nolint: errcheck
+	t.Cleanup(func() { assert.NoError(t, s.Close()) })
+	return r, l.Addr().String()
+}
+
+func TestBridge(t *testing.T) {
+	r, addr := newRemote(t)
+
+	delivered := make(chan *packet.PublishControlPacket, 10)
+	b := &Bridge{
+		Addr:    addr,
+		Options: client.Options{ClientID: "bridge", CleanSession: true},
+		Topics: []Topic{
+			{Pattern: "#", Direction: Both, QoS: packet.QoSLevelAtLeastOnce, LocalPrefix: "local/", RemotePrefix: "remote/in/"},
+			{Pattern: "+/temp", Direction: Out, QoS: packet.QoSLevelNone, LocalPrefix: "sensors/", RemotePrefix: "site1/"},
+		},
+		Deliver:       func(p *packet.PublishControlPacket) { delivered <- p },
+		RetryInterval: 10 * time.Millisecond,
+	}
+	done := make(chan error)
+	go func() { done <- b.Run() }()
+
+	select {
+	case sub := <-r.subscriptions:
+		assert.Equal(t, packet.Subscription{Topic: "remote/in/#", QoS: packet.QoSLevelAtLeastOnce, NoLocal: true}, sub)
+	case <-time.After(5 * time.Second):
+		t.Fatal("bridge did not subscribe")
+	}
+	select {
+	case p := <-delivered:
+		assert.Equal(t, "local/a", p.VariableHeader.Topic)
+		assert.Equal(t, packet.QoSLevelAtLeastOnce, p.FixedHeaderFlags.QoS)
+		assert.Equal(t, []byte("hello"), p.Payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not delivered")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p := packet.NewPublish("sensors/1/temp", 0, []byte("21"))
+	p.FixedHeaderFlags.QoS = packet.QoSLevelExactlyOnce
+	require.NoError(t, b.Forward(ctx, p))
+	require.NoError(t, b.Forward(ctx, packet.NewPublish("sensors/1/humidity", 0, nil)))
+	require.NoError(t, b.Forward(ctx, packet.NewPublish("local/x/y", 0, []byte("out"))))
+
+	fwd := <-r.publishes
+	assert.Equal(t, "site1/1/temp", fwd.VariableHeader.Topic)
+	assert.Equal(t, packet.QoSLevelNone, fwd.FixedHeaderFlags.QoS, "QoS is downgraded")
+	fwd = <-r.publishes
+	assert.Equal(t, "remote/in/x/y", fwd.VariableHeader.Topic)
+	select {
+	case fwd := <-r.publishes:
+		t.Fatalf("unexpected message on %v", fwd.VariableHeader.Topic)
+	default:
+	}
+
+	require.NoError(t, b.Close())
+	assert.Equal(t, ErrBridgeClosed, <-done)
+	assert.Equal(t, ErrNotConnected, b.Forward(ctx, p))
+}
+
+func TestBridgeReconnecting(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	events := &client.Events{}
+	ch, cancel := events.Channel(10)
+	defer cancel()
+	b := &Bridge{
+		Addr:          addr,
+		Options:       client.Options{ClientID: "bridge", Events: events},
+		RetryInterval: 10 * time.Millisecond,
+	}
+	done := make(chan error)
+	go func() { done <- b.Run() }()
+
+	var reconnecting []client.Reconnecting
+	for len(reconnecting) < 2 {
+		select {
+		case e := <-ch:
+			switch e := e.(type) {
+			case client.ConnectFailed:
+				assert.Equal(t, "bridge", e.ClientID)
+				assert.Error(t, e.Err)
+			case client.Reconnecting:
+				reconnecting = append(reconnecting, e)
+			default:
+				t.Fatalf("unexpected event %#v", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("bridge did not reconnect")
+		}
+	}
+	assert.Equal(t, []client.Reconnecting{{ClientID: "bridge", Attempt: 1}, {ClientID: "bridge", Attempt: 2}}, reconnecting)
+	require.NoError(t, b.Close())
+	assert.Equal(t, ErrBridgeClosed, <-done)
+}
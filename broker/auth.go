@@ -0,0 +1,116 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"errors"
+
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+var (
+	// ErrBadUserNameOrPassword rejects a client with CONNACK return code
+	// 0x04, or reason code 0x86 on MQTT 5
+	ErrBadUserNameOrPassword = errors.New("broker: bad user name or password")
+	// ErrNotAuthorized rejects a client with CONNACK return code 0x05, or
+	// reason code 0x87 on MQTT 5
+	ErrNotAuthorized = errors.New("broker: not authorized")
+)
+
+// Authenticator decides whether a client may connect. It is called after
+// CONNECT was read, before the session is opened; c.Connect() holds the
+// credentials.
+type Authenticator interface {
+	// Authenticate returns nil to accept the client, or a *Redirect to
+	// send it elsewhere. Other errors than ErrBadUserNameOrPassword, or
+	// ones wrapping it, are reported to the client as ErrNotAuthorized.
+	Authenticate(c *Conn) error
+}
+
+// AuthenticatorFunc adapts an ordinary function to the Authenticator
+// interface
+type AuthenticatorFunc func(c *Conn) error
+
+func (f AuthenticatorFunc) Authenticate(c *Conn) error {
+	return f(c)
+}
+
+// authReturnCode maps an Authenticate error to a CONNACK return code
+func authReturnCode(err error) byte {
+	if errors.Is(err, ErrBadUserNameOrPassword) {
+		return packet.ConnAckBadUserNameOrPassword
+	}
+	return packet.ConnAckNotAuthorized
+}
+
+// Action is what a client wants to do with a topic
+type Action int
+
+const (
+	// ActionPublish is checked for every PUBLISH of a client
+	ActionPublish Action = iota + 1
+	// ActionSubscribe is checked for every topic filter of a SUBSCRIBE
+	ActionSubscribe
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionPublish:
+		return "publish"
+	case ActionSubscribe:
+		return "subscribe"
+	}
+	return "unknown"
+}
+
+// Authorizer decides which topics a client may publish to and which
+// topic filters it may subscribe to. A denied PUBLISH is acknowledged but
+// not delivered, with reason code 0x87 on MQTT 5. A denied topic filter
+// gets the failure return code 0x80 in SUBACK, or 0x87 on MQTT 5.
+type Authorizer interface {
+	// Authorize returns nil to allow action on topic, which is a topic
+	// filter for ActionSubscribe. userName is empty if the client sent
+	// none.
+	Authorize(clientID, userName, topic string, action Action) error
+}
+
+// AuthorizerFunc adapts an ordinary function to the Authorizer interface
+type AuthorizerFunc func(clientID, userName, topic string, action Action) error
+
+func (f AuthorizerFunc) Authorize(clientID, userName, topic string, action Action) error {
+	return f(clientID, userName, topic, action)
+}
+
+// authorize asks the Authorizer of the server whether c may do action on
+// topic. Denials are logged.
+func (c *Conn) authorize(topic string, action Action) bool {
+	auth := c.server.Authorizer
+	if auth == nil {
+		return true
+	}
+	err := auth.Authorize(c.ClientID(), c.connect.ConnectPayload.UserName, topic, action)
+	if err != nil {
+		c.log(logger.LevelInfo, "auth: not authorized",
+			logger.F("action", action),
+			logger.F("topic", topic),
+			logger.F("error", err))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,176 @@
+package broker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func TestServerAuthenticator(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{Authenticator: AuthenticatorFunc(func(c *Conn) error {
+		payload := c.Connect().ConnectPayload
+		switch {
+		case c.ClientID() == "banned":
+			return ErrNotAuthorized
+		case payload.UserName != "user" || string(payload.Password) != "secret":
+			return ErrBadUserNameOrPassword
+		}
+		return nil
+	})}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	var testCases = []struct {
+		clientID, userName, password string
+		version                      packet.ProtocolVersion
+		expected                     byte
+	}{
+		{"c1", "user", "secret", packet.ProtocolVersion311, packet.ConnAckAccepted},
+		{"c2", "user", "wrong", packet.ProtocolVersion311, packet.ConnAckBadUserNameOrPassword},
+		{"banned", "user", "secret", packet.ProtocolVersion311, packet.ConnAckNotAuthorized},
+		{"c3", "user", "wrong", packet.ProtocolVersion5, packet.ReasonCodeBadUserNameOrPassword},
+		{"banned", "user", "secret", packet.ProtocolVersion5, packet.ReasonCodeNotAuthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.clientID, func(t *testing.T) {
+			c, err := net.Dial("tcp", l.Addr().String())
+			require.NoError(t, err)
+			defer c.Close() // nolint: errcheck
+
+			connect := &packet.ConnectControlPacket{
+				VariableHeader: packet.ConnectVariableHeader{
+					ProtocolName:  "MQTT",
+					ProtocolLevel: byte(tc.version),
+					ConnectFlags:  packet.ConnectFlags{UserName: true, Password: true},
+				},
+				ConnectPayload: packet.ConnectPayload{
+					ClientID: tc.clientID,
+					UserName: tc.userName,
+					Password: []byte(tc.password),
+				},
+			}
+			if tc.version == packet.ProtocolVersion5 {
+				connect.VariableHeader.Properties = &packet.Properties{}
+			}
+			require.NoError(t, packet.WritePacket(c, connect))
+
+			p, err := packet.ReadPacketVersion(c, tc.version)
+			require.NoError(t, err)
+			require.IsType(t, &packet.ConnAckControlPacket{}, p)
+			assert.Equal(t, tc.expected, p.(*packet.ConnAckControlPacket).VariableHeader.ReturnCode)
+
+			if tc.expected != packet.ConnAckAccepted {
+				_, err = packet.ReadPacket(c)
+				assert.Error(t, err, "refused connection must be closed")
+			}
+		})
+	}
+}
+
+func TestServerRefusesConnect(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	defer s.Close() // nolint: errcheck
+
+	var testCases = []struct {
+		level    packet.ProtocolVersion
+		clientID string
+		expected byte
+	}{
+		{6, "c1", packet.ConnAckUnacceptableProtocolVersion},
+		{packet.ProtocolVersion311, "", packet.ConnAckIdentifierRejected},
+		{packet.ProtocolVersion5, "", packet.ReasonCodeClientIdentifierNotValid},
+	}
+
+	for _, tc := range testCases {
+		c, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+
+		connect := &packet.ConnectControlPacket{
+			VariableHeader: packet.ConnectVariableHeader{
+				ProtocolName:  "MQTT",
+				ProtocolLevel: byte(tc.level),
+			},
+			ConnectPayload: packet.ConnectPayload{ClientID: tc.clientID},
+		}
+		version := packet.ProtocolVersion311
+		if tc.level == packet.ProtocolVersion5 {
+			connect.VariableHeader.Properties = &packet.Properties{}
+			version = packet.ProtocolVersion5
+		}
+		require.NoError(t, packet.WritePacket(c, connect))
+
+		p, err := packet.ReadPacketVersion(c, version)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, p.(*packet.ConnAckControlPacket).VariableHeader.ReturnCode)
+		_, err = packet.ReadPacket(c)
+		assert.Error(t, err, "refused connection must be closed")
+		require.NoError(t, c.Close())
+	}
+}
+
+func TestServerAuthorizer(t *testing.T) {
+	dispatched := make(chan packet.ControlPacket, 10)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{
+		Handler: HandlerFunc(func(c *Conn, p packet.ControlPacket) { dispatched <- p }),
+		Authorizer: AuthorizerFunc(func(clientID, userName, topic string, action Action) error {
+			if topic == "forbidden" {
+				return ErrNotAuthorized
+			}
+			return nil
+		}),
+	}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(c, &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(packet.ProtocolVersion5),
+			Properties:    &packet.Properties{},
+		},
+		ConnectPayload: packet.ConnectPayload{ClientID: "c1"},
+	}))
+	_, err = packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+
+	for _, name := range []string{"forbidden", "allowed"} {
+		p := packet.NewPublish(name, 1, []byte("x"))
+		p.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+		p.VariableHeader.Properties = &packet.Properties{}
+		require.NoError(t, packet.WritePacket(c, p))
+		resp, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+		require.NoError(t, err)
+		require.IsType(t, &packet.PubackControlPacket{}, resp)
+		if name == "forbidden" {
+			assert.Equal(t, packet.ReasonCodeNotAuthorized, resp.(*packet.PubackControlPacket).VariableHeader.ReasonCode)
+		}
+	}
+
+	require.NoError(t, packet.WritePacket(c, &packet.SubscribeControlPacket{
+		VariableHeader: packet.SubscribeVariableHeader{PacketID: 2, Properties: &packet.Properties{}},
+		Payload: packet.SubscribePayload{
+			Subscriptions: []packet.Subscription{{Topic: "allowed"}, {Topic: "forbidden"}},
+		},
+	}))
+	resp, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.SubAckControlPacket{}, resp)
+	assert.Equal(t, []byte{packet.ReasonCodeSuccess, packet.ReasonCodeNotAuthorized}, resp.(*packet.SubAckControlPacket).Payload.ReturnCodes)
+
+	// Only the allowed message reached the Handler
+	p := <-dispatched
+	assert.Equal(t, "allowed", p.(*packet.PublishControlPacket).VariableHeader.Topic)
+	assert.Empty(t, dispatched)
+}
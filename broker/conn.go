@@ -0,0 +1,728 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+)
+
+var (
+	errNotConnect             = errors.New("first packet is not CONNECT")
+	errEmptyClientID          = errors.New("empty client identifier requires a clean session")
+	errReceiveMaximumExceeded = errors.New("broker: client exceeded the receive maximum")
+)
+
+// Conn is a client connection whose CONNECT has been accepted. It is safe
+// to write packets to a Conn from multiple goroutines; they are written
+// to the network by a goroutine of their own, so a slow client does not
+// hold up the writers.
+type Conn struct {
+	server *Server
+	rwc    net.Conn
+	r      *packet.Reader
+	ctx    context.Context // cancelled by Close
+	cancel context.CancelFunc
+
+	msgRate *tokenBucket // nil without Server.MessageRate
+	// backlog holds the queues of subscribers the last message filled,
+	// see Server.PauseThreshold
+	backlog []<-chan struct{}
+
+	accepted time.Time
+	connect  *packet.ConnectControlPacket
+	clientID string
+	// sessionID keys the session, the subscriptions and the takeover of
+	// the client: the client identifier in the namespace of its tenant
+	sessionID   string
+	tenant      string
+	tenantStats *tenantStats // nil without tenant
+	version     packet.ProtocolVersion
+	session     *session.Session
+
+	qmu   sync.Mutex
+	qcond *sync.Cond
+	queue []packet.ControlPacket // waiting for writeLoop
+	// priorities holds the priority of every queued packet, with
+	// Server.Priority only
+	priorities []int
+	qclosed    bool
+	drained    chan struct{} // closed when the queue was taken, see saturated
+	overflow   OverflowPolicy
+	writerDone chan struct{}
+	// aliases picks the topic aliases of the messages to an MQTT 5
+	// client, used by writeLoop only
+	aliases *packet.TopicAliases
+	// reauth is the re-authentication in progress, used by serve only
+	reauth AuthExchange
+	// connAck is set while connecting, see SetConnAckProperties
+	connAck ConnAckProperties
+	// subLimits replaces Server.SubscriptionLimits if set, see
+	// SetSubscriptionLimits
+	subLimits *SubscriptionLimits
+
+	closeOnce sync.Once
+	done      chan struct{} // closed when serve returned
+}
+
+func newConn(s *Server, c net.Conn) *Conn {
+	r := packet.NewReader(countingConn{c, s})
+	r.MaxPacketSize = s.MaxPacketSize
+	r.MinBufferSize, r.MaxBufferSize = s.MinReadBuffer, s.MaxReadBuffer
+	r.Logger = s.Logger
+	ctx, cancel := context.WithCancel(s.baseContext())
+	conn := &Conn{
+		server:     s,
+		rwc:        c,
+		r:          r,
+		ctx:        ctx,
+		cancel:     cancel,
+		accepted:   time.Now(),
+		overflow:   s.OverflowPolicy,
+		writerDone: make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	conn.qcond = sync.NewCond(&conn.qmu)
+	if t := s.tuned(); t.MessageRate > 0 {
+		conn.msgRate = newTokenBucket(t.MessageRate, t.MessageBurst, conn.accepted)
+	}
+	return conn
+}
+
+// ClientID returns the client identifier from CONNECT, or the one the
+// server assigned if the client left it empty
+func (c *Conn) ClientID() string {
+	return c.clientID
+}
+
+// Connect returns the CONNECT packet the client opened the connection with
+func (c *Conn) Connect() *packet.ConnectControlPacket {
+	return c.connect
+}
+
+// Session returns the session the connection is bound to
+func (c *Conn) Session() *session.Session {
+	return c.session
+}
+
+// Version returns the protocol version negotiated in CONNECT
+func (c *Conn) Version() packet.ProtocolVersion {
+	return c.version
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.rwc.RemoteAddr()
+}
+
+// Publish sends an application message to the client. QoS 1 and 2
+// messages go through the outbound queue of the session and may be held
+// back until the in-flight window has room. p is not modified. Messages
+// rejected by an OnDeliver hook are dropped without error.
+func (c *Conn) Publish(p *packet.PublishControlPacket) error {
+	if c.outside(p.VariableHeader.Topic) {
+		return nil
+	}
+	cp := *p
+	cp.FixedHeaderFlags.Dup = false
+	from := packet.ProtocolVersion311
+	if p.VariableHeader.Properties != nil {
+		from = packet.ProtocolVersion5
+	}
+	c.server.Translation.translate(from, c.version, &cp)
+	if c.version == packet.ProtocolVersion5 && cp.VariableHeader.Properties == nil {
+		cp.VariableHeader.Properties = &packet.Properties{}
+	} else if c.version != packet.ProtocolVersion5 {
+		props := cp.VariableHeader.Properties
+		cp.VariableHeader.Properties = nil
+		if props != nil && props.MessageExpiryInterval != nil {
+			// Kept for the outbound queue, WritePacket drops it
+			cp.VariableHeader.Properties = &packet.Properties{MessageExpiryInterval: props.MessageExpiryInterval}
+		}
+	}
+	for _, h := range c.server.Hooks {
+		if err := h.OnDeliver(c, &cp); err != nil {
+			c.log(logger.LevelDebug, "broker: delivery rejected by hook", logger.F("topic", cp.VariableHeader.Topic), logger.F("error", err))
+			c.drop(p, DropRejected)
+			return nil
+		}
+	}
+
+	if cp.FixedHeaderFlags.QoS == packet.QoSLevelNone {
+		cp.VariableHeader.PacketID = 0
+		return c.WritePacket(&cp)
+	}
+	ready, err := c.session.Outbound.Push(&cp)
+	if m := c.server.Metrics; m != nil && err == nil {
+		m.Inflight(c.session.Outbound.InFlight() + c.session.Outbound.Queued())
+	}
+	if err != nil || ready == nil {
+		return err
+	}
+	return c.writePublish(ready)
+}
+
+// writePublish writes a QoS 1 or 2 message of the outbound queue and
+// records it as sent
+func (c *Conn) writePublish(p *packet.PublishControlPacket) error {
+	if err := c.WritePacket(p); err != nil {
+		return err
+	}
+	c.session.Outbound.Sent(uint16(p.VariableHeader.PacketID))
+	return nil
+}
+
+// SendRetained publishes the retained messages matching filter, as is
+// required after a new subscription [MQTT-3.3.1-6]. The QoS of each
+// message is limited to qos, the QoS granted for the subscription.
+func (c *Conn) SendRetained(filter string, qos packet.QosLevel) error {
+	retained, err := c.server.retainStore().Match(filter)
+	if err != nil {
+		return err
+	}
+	for _, p := range retained {
+		if masked(filter, p.VariableHeader.Topic) {
+			continue
+		}
+		cp := *p
+		cp.FixedHeaderFlags.Retain = true
+		if cp.FixedHeaderFlags.QoS > qos {
+			cp.FixedHeaderFlags.QoS = qos
+		}
+		if err := c.Publish(&cp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Done returns a channel that is closed once the connection has ended
+// and its session was released
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Context returns the context of the connection. It is cancelled when
+// the connection is closed, which includes the Server being closed.
+func (c *Conn) Context() context.Context {
+	return c.ctx
+}
+
+// Close closes the network connection, which also ends its read loop
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.cancel()
+		err = c.rwc.Close()
+	})
+	return err
+}
+
+// shutdown tells the client that the server is going away and closes the
+// connection once the packets queued for it were written
+func (c *Conn) shutdown() {
+	c.server.mu.Lock()
+	connected := c.session != nil
+	c.server.mu.Unlock()
+	if connected {
+		c.disconnect(packet.ReasonCodeServerShuttingDown)
+		c.flush()
+	}
+	_ = c.Close()
+}
+
+func (c *Conn) serve() {
+	defer close(c.done)
+	go c.writeLoop()
+	defer c.Close() // nolint: errcheck
+	defer c.flush()
+
+	if err := c.handshake(); err != nil {
+		level := logger.LevelWarn
+		if err == errDraining {
+			level = logger.LevelDebug
+		}
+		c.server.log(level, "broker: connection failed", logger.F("remote_addr", c.RemoteAddr()), logger.F("error", err))
+		return
+	}
+
+	graceful := false
+	defer func() {
+		will := c.session.TakeWill()
+		if will != nil && !graceful && !c.server.isStopping() {
+			if delay := c.willDelay(); delay > 0 && c.session.Expiry() > 0 {
+				c.server.delayWill(c, will, delay)
+			} else {
+				c.publishWill(will)
+			}
+		}
+		c.server.release(c)
+		for _, h := range c.server.Hooks {
+			h.OnDisconnect(c, graceful)
+		}
+	}()
+
+	keepAlive := c.keepAliveTimeout()
+	for {
+		ctx, cancel := c.ctx, context.CancelFunc(func() {})
+		if keepAlive > 0 {
+			ctx, cancel = context.WithTimeout(c.ctx, keepAlive)
+		}
+		p, err := c.readPacket(ctx)
+		cancel()
+		if err != nil {
+			switch {
+			case c.ctx.Err() != nil:
+				// The connection was closed, the read was merely interrupted
+			case errors.Is(err, context.DeadlineExceeded):
+				c.log(logger.LevelInfo, "broker: keepalive timeout, closing connection", logger.F("timeout", keepAlive))
+				c.disconnect(packet.ReasonCodeKeepAliveTimeout)
+			case err != io.EOF && !c.server.isStopping():
+				c.log(logger.LevelWarn, "broker: error while reading packet", logger.F("error", err))
+				var pe *packet.Error
+				if errors.As(err, &pe) {
+					c.disconnect(pe.ReasonCode)
+				}
+			}
+			return
+		}
+		c.scope(p)
+
+		switch p := p.(type) {
+		case *packet.PingReqControlPacket:
+			if err := c.WritePacket(packet.NewPingRespControlPacket()); err != nil {
+				c.log(logger.LevelWarn, "broker: failed to write PINGRESP", logger.F("error", err))
+				return
+			}
+		case *packet.DisconnectControlPacket:
+			if !c.updateExpiry(p) {
+				c.log(logger.LevelWarn, "broker: session expiry set on DISCONNECT after CONNECT asked for none")
+				c.disconnect(packet.ReasonCodeProtocolError)
+				return
+			}
+			// An MQTT 5 client can ask for its will to be published anyway
+			graceful = p.VariableHeader.ReasonCode != packet.ReasonCodeDisconnectWithWillMessage
+			return
+		case *packet.AuthControlPacket:
+			if !c.reauthenticate(p) {
+				return
+			}
+		case *packet.PublishControlPacket:
+			if !c.throttle() {
+				return
+			}
+			if err := c.handlePublish(p); err != nil {
+				c.log(logger.LevelWarn, "broker: failed to handle PUBLISH", logger.F("error", err))
+				return
+			}
+			if !c.pause() {
+				return
+			}
+		case *packet.SubscribeControlPacket:
+			if err := c.handleSubscribe(p); err != nil {
+				c.log(logger.LevelWarn, "broker: failed to handle SUBSCRIBE", logger.F("error", err))
+				return
+			}
+		case *packet.UnsubscribeControlPacket:
+			if err := c.handleUnsubscribe(p); err != nil {
+				c.log(logger.LevelWarn, "broker: failed to handle UNSUBSCRIBE", logger.F("error", err))
+				return
+			}
+		case *packet.PubrelControlPacket:
+			if err := c.session.Inbound.Release(p.VariableHeader.PacketID); err != nil {
+				c.log(logger.LevelWarn, "broker: failed to release message", logger.F("packet_id", p.VariableHeader.PacketID), logger.F("error", err))
+				return
+			}
+			if err := c.WritePacket(packet.NewPubCompControlPacket(p.VariableHeader.PacketID)); err != nil {
+				c.log(logger.LevelWarn, "broker: failed to write PUBCOMP", logger.F("error", err))
+				return
+			}
+		case *packet.PubackControlPacket:
+			ready, err := c.session.Outbound.Ack(p.VariableHeader.PacketID)
+			if !c.sendReady(ready, err) {
+				return
+			}
+		case *packet.PubrecControlPacket:
+			pubrel, err := c.session.Outbound.Received(p.VariableHeader.PacketID)
+			if err == nil {
+				err = c.WritePacket(pubrel)
+			}
+			if !c.sendReady(nil, err) {
+				return
+			}
+		case *packet.PubcompControlPacket:
+			ready, err := c.session.Outbound.Complete(p.VariableHeader.PacketID)
+			if !c.sendReady(ready, err) {
+				return
+			}
+		default:
+			c.dispatch(p)
+		}
+	}
+}
+
+// refuse sends a CONNACK with an MQTT 3.1.1 failure return code, which
+// WritePacket turns into the matching reason code on MQTT 5. The
+// connection is closed afterwards [MQTT-3.2.2-5].
+func (c *Conn) refuse(returnCode byte) {
+	_ = c.WritePacket(packet.NewConnAck(returnCode, false))
+}
+
+// disconnect tells an MQTT 5 client why the server is about to close the
+// connection. MQTT 3.1.1 has no way to do so.
+func (c *Conn) disconnect(reasonCode byte) {
+	if c.version != packet.ProtocolVersion5 {
+		return
+	}
+	disconnect := packet.NewDisconnectControlPacket()
+	disconnect.VariableHeader.ReasonCode = reasonCode
+	disconnect.VariableHeader.Properties = &packet.Properties{}
+	_ = c.WritePacket(disconnect)
+}
+
+// sendReady writes the messages an acknowledgement released from the
+// outbound queue and reports whether the connection can go on. Unknown
+// packet identifiers are logged but not fatal, they may belong to a flow
+// the server already gave up on.
+func (c *Conn) sendReady(ready []*packet.PublishControlPacket, err error) bool {
+	if err == session.ErrUnknownPacketID || err == session.ErrUnexpectedAck {
+		c.log(logger.LevelInfo, "broker: ignoring acknowledgement", logger.F("error", err))
+		return true
+	}
+	if err != nil {
+		c.log(logger.LevelWarn, "broker: failed to handle acknowledgement", logger.F("error", err))
+		return false
+	}
+	for _, p := range ready {
+		if err := c.writePublish(p); err != nil {
+			c.log(logger.LevelWarn, "broker: failed to write PUBLISH", logger.F("error", err))
+			return false
+		}
+	}
+	return true
+}
+
+// handlePublish passes p to the Handler and acknowledges it. A QoS 2
+// message is passed on only the first time its packet identifier is seen.
+// Messages rejected by the Authorizer or a hook are acknowledged and
+// dropped, as are those of MQTT 3.1.1 clients exceeding a SizeRule with
+// OversizeDrop.
+func (c *Conn) handlePublish(p *packet.PublishControlPacket) error {
+	atomic.AddInt64(&c.server.stats.messagesReceived, 1)
+	if c.tenantStats != nil {
+		atomic.AddInt64(&c.tenantStats.messagesReceived, 1)
+	}
+	id := uint16(p.VariableHeader.PacketID)
+
+	if (c.version == packet.ProtocolVersion5 || c.server.OversizeAction == OversizeDisconnect) && c.oversized(p) {
+		c.disconnect(packet.ReasonCodePacketTooLarge)
+		return errMessageTooLarge
+	}
+	if err := c.checkPublish(p); err != nil {
+		return err
+	}
+
+	switch p.FixedHeaderFlags.QoS {
+	case packet.QoSLevelNone:
+		c.accept(p)
+		return nil
+	case packet.QoSLevelAtLeastOnce:
+		reasonCode := c.accept(p)
+		puback := packet.NewPubAckControlPacket(id)
+		if c.version == packet.ProtocolVersion5 {
+			puback.VariableHeader.ReasonCode = reasonCode
+			puback.VariableHeader.Properties = &packet.Properties{}
+		}
+		return c.WritePacket(puback)
+	default:
+		if max := c.server.ReceiveMaximum; c.version == packet.ProtocolVersion5 && max > 0 &&
+			c.session.Inbound.Len() >= int(max) && !c.session.Inbound.Contains(id) {
+			c.disconnect(packet.ReasonCodeReceiveMaximumExceeded)
+			return errReceiveMaximumExceeded
+		}
+		first, err := c.session.Inbound.Receive(id)
+		if err != nil {
+			return err
+		}
+		reasonCode := packet.ReasonCodeSuccess
+		if first {
+			reasonCode = c.accept(p)
+		}
+		pubrec := packet.NewPubRecControlPacket(id)
+		if c.version == packet.ProtocolVersion5 {
+			pubrec.VariableHeader.ReasonCode = reasonCode
+			pubrec.VariableHeader.Properties = &packet.Properties{}
+			// A PUBREC with an error reason code ends the flow, there
+			// is no PUBREL to wait for
+			if reasonCode >= packet.ReasonCodeUnspecifiedError {
+				if err := c.session.Inbound.Release(id); err != nil {
+					return err
+				}
+			}
+		}
+		return c.WritePacket(pubrec)
+	}
+}
+
+// retain stores p in the RetainStore if its retain flag is set
+func (c *Conn) retain(p *packet.PublishControlPacket) {
+	if !p.FixedHeaderFlags.Retain {
+		return
+	}
+	cp := *c.server.intern(p)
+	cp.FixedHeaderFlags.Dup = false
+	cp.VariableHeader.PacketID = 0
+	if err := c.server.retainStore().Retain(&cp); err != nil {
+		c.log(logger.LevelError, "store: failed to retain message", logger.F("topic", p.VariableHeader.Topic), logger.F("error", err))
+	}
+}
+
+// readPacket reads the next packet from the client until ctx is done and
+// reports it to the Metrics
+func (c *Conn) readPacket(ctx context.Context) (packet.ControlPacket, error) {
+	p, err := c.r.ReadPacketContext(ctx)
+	if m := c.server.Metrics; m != nil {
+		if err == nil {
+			m.PacketDecoded(p)
+		} else if isDecodeError(err) {
+			m.DecodeError(err)
+		}
+	}
+	return p, err
+}
+
+// log adds the client identifier to the entry
+func (c *Conn) log(level logger.Level, msg string, fields ...logger.Field) {
+	c.server.log(level, msg, append([]logger.Field{logger.F("client_id", c.ClientID())}, fields...)...)
+}
+
+func (c *Conn) dispatch(p packet.ControlPacket) {
+	if c.server.Handler != nil {
+		c.server.Handler.ServeMQTT(c, p)
+	}
+}
+
+// handshake reads the CONNECT packet and accepts the connection
+func (c *Conn) handshake() error {
+	ctx, cancel := context.WithTimeout(c.ctx, c.server.connectTimeout())
+	p, err := c.readPacket(ctx)
+	cancel()
+	if err != nil {
+		var ce *packet.ConnectError
+		if errors.As(err, &ce) {
+			// The protocol version is unknown, so the refusal is sent as
+			// MQTT 3.1.1
+			c.refuse(ce.ReturnCode)
+		}
+		return err
+	}
+
+	connect, ok := p.(*packet.ConnectControlPacket)
+	if !ok {
+		return errNotConnect
+	}
+	c.connect = connect
+	c.clientID = connect.ConnectPayload.ClientID
+	c.version = connect.Version()
+	c.r.Version = c.version
+
+	assigned := c.clientID == ""
+	if assigned {
+		if !connect.VariableHeader.ConnectFlags.CleanSession {
+			// [MQTT-3.1.3-8]
+			c.refuse(packet.ConnAckIdentifierRejected)
+			return errEmptyClientID
+		}
+		// [MQTT-3.1.3-6]
+		id, err := newClientID()
+		if err != nil {
+			c.refuse(packet.ConnAckServerUnavailable)
+			return err
+		}
+		c.clientID = id
+	} else if validate := c.server.ClientIDValidator; validate != nil {
+		if err := validate(c.clientID); err != nil {
+			c.refuse(packet.ConnAckIdentifierRejected)
+			return err
+		}
+	}
+	c.sessionID = c.clientID
+	var authData []byte
+	if c.authMethod() != "" {
+		if authData, err = c.authenticate(); err != nil {
+			c.refuseAuth(err)
+			return err
+		}
+	} else if auth := c.server.Authenticator; auth != nil {
+		if err := auth.Authenticate(c); err != nil {
+			c.refuseWith(err)
+			return err
+		}
+	}
+	if err := c.bindTenant(); err != nil {
+		c.refuseWith(err)
+		return err
+	}
+	if flags := connect.VariableHeader.ConnectFlags; flags.WillFlag && !c.authorize(connect.ConnectPayload.WillTopic, ActionPublish) {
+		c.refuse(packet.ConnAckNotAuthorized)
+		return ErrNotAuthorized
+	}
+	for _, h := range c.server.Hooks {
+		if err := h.OnConnect(c); err != nil {
+			c.refuseWith(err)
+			return err
+		}
+	}
+	if err := c.checkWill(); err != nil {
+		return err
+	}
+
+	present, err := c.server.open(c)
+	if err == errDraining {
+		c.refuseDraining()
+		return err
+	}
+	if err != nil {
+		c.refuse(packet.ConnAckServerUnavailable)
+		return err
+	}
+	c.session.SetWill(willMessage(connect))
+	c.session.Outbound.SetWindow(c.window())
+
+	connack := packet.NewConnAck(packet.ConnAckAccepted, present)
+	if c.version == packet.ProtocolVersion5 {
+		connack.VariableHeader.Properties = &packet.Properties{}
+		if assigned {
+			connack.VariableHeader.Properties.AssignedClientIdentifier = c.clientID
+		}
+		if method := c.authMethod(); method != "" {
+			connack.VariableHeader.Properties.AuthenticationMethod = method
+			connack.VariableHeader.Properties.AuthenticationData = authData
+		}
+		if max := c.server.MaxPacketSize; max > 0 {
+			size := uint32(max)
+			connack.VariableHeader.Properties.MaximumPacketSize = &size
+		}
+		if max := c.server.ReceiveMaximum; max > 0 {
+			connack.VariableHeader.Properties.ReceiveMaximum = packet.Uint16(max)
+		}
+		if max := c.server.TopicAliasMaximum; max > 0 {
+			c.r.TopicAliasMaximum = max
+			connack.VariableHeader.Properties.TopicAliasMaximum = packet.Uint16(max)
+		}
+		if max := connect.VariableHeader.Properties.TopicAliasMaximum; max != nil {
+			c.aliases = &packet.TopicAliases{Maximum: *max}
+		}
+		if expiry := c.session.Expiry(); expiry != sessionExpiry(connect) {
+			// Tell the client about the limit of the Manager
+			connack.VariableHeader.Properties.SessionExpiryInterval = toExpiryInterval(expiry)
+		}
+		c.setConnAckProperties(connack.VariableHeader.Properties)
+	}
+	if err := c.WritePacket(connack); err != nil {
+		return err
+	}
+	if m := c.server.Metrics; m != nil {
+		m.Connected(time.Since(c.accepted))
+	}
+	c.log(logger.LevelInfo, "broker: client connected",
+		logger.F("remote_addr", c.RemoteAddr()),
+		logger.F("version", c.version),
+		logger.F("session_present", present))
+
+	return c.server.goOnline(c, c.resend)
+}
+
+// resend retransmits whatever was in flight when the session was left
+// [MQTT-4.4.0-1], except for the messages that expired meanwhile
+func (c *Conn) resend() error {
+	if err := c.session.Outbound.Expire(time.Now()); err != nil {
+		c.log(logger.LevelError, "broker: failed to expire messages", logger.F("error", err))
+	}
+	for _, p := range c.session.Outbound.Resend() {
+		var err error
+		if publish, ok := p.(*packet.PublishControlPacket); ok {
+			err = c.writePublish(publish)
+		} else {
+			err = c.WritePacket(p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// window returns how many QoS 1 and 2 messages may be in flight to the
+// client: the window of the session Manager, limited to the Receive
+// Maximum of an MQTT 5 client [MQTT-3.3.4-9]
+func (c *Conn) window() int {
+	window := c.server.sessions().Window
+	if window <= 0 {
+		window = 65535
+	}
+	if props := c.connect.VariableHeader.Properties; props != nil && props.ReceiveMaximum != nil && int(*props.ReceiveMaximum) < window {
+		window = int(*props.ReceiveMaximum)
+	}
+	return window
+}
+
+// willMessage builds the message published in place of a client that
+// disappeared without DISCONNECT, or returns nil if it has no will
+func willMessage(connect *packet.ConnectControlPacket) *packet.PublishControlPacket {
+	flags := connect.VariableHeader.ConnectFlags
+	if !flags.WillFlag {
+		return nil
+	}
+
+	will := packet.NewPublish(connect.ConnectPayload.WillTopic, 0, connect.ConnectPayload.WillMessage)
+	will.FixedHeaderFlags.QoS = packet.QosLevel(flags.WillQoS)
+	will.FixedHeaderFlags.Retain = flags.WillRetain
+	if props := connect.ConnectPayload.WillProperties; props != nil {
+		will.VariableHeader.Properties = &packet.Properties{
+			PayloadFormatIndicator: props.PayloadFormatIndicator,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			UserProperties:         props.UserProperties,
+		}
+	}
+	return will
+}
+
+// newClientID returns an identifier for a client that connected without
+// one. It is alphanumeric and 20 characters long, so clients may reuse it
+// with any server.
+func newClientID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "auto" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,152 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"errors"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+var (
+	errQoSNotSupported    = errors.New("broker: QoS beyond the maximum of the client")
+	errRetainNotSupported = errors.New("broker: retained message, unavailable to the client")
+)
+
+// ConnAckProperties are decisions of the policy of the server about a
+// client, which MQTT 5 clients are told in the CONNACK properties of the
+// same names. The Authenticator, Tenant and OnConnect hooks set them with
+// Conn.SetConnAckProperties. The server enforces them on MQTT 5 clients
+// only, MQTT 3.1.1 clients cannot be told.
+type ConnAckProperties struct {
+	// AssignedClientIdentifier replaces the client identifier the client
+	// connected with, for every client
+	AssignedClientIdentifier string
+	// MaximumQoS limits the QoS of the messages the client publishes,
+	// and is granted to its subscriptions at most. A PUBLISH or will
+	// beyond it is refused with reason code QoS not supported.
+	MaximumQoS *packet.QosLevel
+	// RetainUnavailable refuses the retained messages and wills of the
+	// client with reason code Retain not supported
+	RetainUnavailable bool
+	// TopicAliasMaximum replaces Server.TopicAliasMaximum
+	TopicAliasMaximum *uint16
+	// ServerKeepAlive replaces the keepalive the client asked for, in
+	// seconds; 0 disables keepalive
+	ServerKeepAlive *uint16
+	// UserProperties are sent along
+	UserProperties []packet.UserProperty
+}
+
+// SetConnAckProperties sets the CONNACK properties of c. It takes effect
+// while c is connecting only, from the Authenticator, Tenant or an
+// OnConnect hook; the last call wins. An AssignedClientIdentifier is
+// taken over at once, so later steps see it.
+func (c *Conn) SetConnAckProperties(props ConnAckProperties) {
+	c.connAck = props
+	if id := props.AssignedClientIdentifier; id != "" {
+		c.clientID = id
+		c.sessionID = c.namespace() + id
+	}
+}
+
+// maxQoS returns the maximum QoS of the messages of c
+func (c *Conn) maxQoS() packet.QosLevel {
+	if max := c.connAck.MaximumQoS; max != nil && c.version == packet.ProtocolVersion5 {
+		return *max
+	}
+	return packet.QoSLevelExactlyOnce
+}
+
+// retainAvailable reports whether c may publish retained messages
+func (c *Conn) retainAvailable() bool {
+	return !c.connAck.RetainUnavailable || c.version != packet.ProtocolVersion5
+}
+
+// checkWill refuses the CONNECT of c if its will is beyond its
+// ConnAckProperties [MQTT-3.2.2-12] [MQTT-3.2.2-13]
+func (c *Conn) checkWill() error {
+	flags := c.connect.VariableHeader.ConnectFlags
+	reasonCode, err := byte(0), error(nil)
+	switch {
+	case !flags.WillFlag:
+		return nil
+	case packet.QosLevel(flags.WillQoS) > c.maxQoS():
+		reasonCode, err = packet.ReasonCodeQoSNotSupported, errQoSNotSupported
+	case flags.WillRetain && !c.retainAvailable():
+		reasonCode, err = packet.ReasonCodeRetainNotSupported, errRetainNotSupported
+	default:
+		return nil
+	}
+	connack := packet.NewConnAck(reasonCode, false)
+	connack.VariableHeader.Properties = &packet.Properties{}
+	_ = c.WritePacket(connack)
+	return err
+}
+
+// checkPublish refuses a PUBLISH of c beyond its ConnAckProperties by
+// disconnecting it [MQTT-3.2.2-11] [MQTT-3.2.2-14]
+func (c *Conn) checkPublish(p *packet.PublishControlPacket) error {
+	switch {
+	case p.FixedHeaderFlags.QoS > c.maxQoS():
+		c.disconnect(packet.ReasonCodeQoSNotSupported)
+		return errQoSNotSupported
+	case p.FixedHeaderFlags.Retain && !c.retainAvailable():
+		c.disconnect(packet.ReasonCodeRetainNotSupported)
+		return errRetainNotSupported
+	}
+	return nil
+}
+
+// setConnAckProperties adds the ConnAckProperties of c to the
+// properties of its CONNACK
+func (c *Conn) setConnAckProperties(props *packet.Properties) {
+	ca := c.connAck
+	if ca.AssignedClientIdentifier != "" {
+		props.AssignedClientIdentifier = c.clientID
+	}
+	if ca.MaximumQoS != nil && *ca.MaximumQoS < packet.QoSLevelExactlyOnce {
+		props.MaximumQoS = packet.Byte(byte(*ca.MaximumQoS))
+	}
+	if ca.RetainUnavailable {
+		props.RetainAvailable = packet.Byte(0)
+	}
+	if max := ca.TopicAliasMaximum; max != nil {
+		c.r.TopicAliasMaximum = *max
+		props.TopicAliasMaximum = nil
+		if *max > 0 {
+			props.TopicAliasMaximum = packet.Uint16(*max)
+		}
+	}
+	if ka := ca.ServerKeepAlive; ka != nil {
+		props.ServerKeepAlive = packet.Uint16(*ka)
+	}
+	props.UserProperties = append(props.UserProperties, ca.UserProperties...)
+}
+
+// keepAliveTimeout returns how long the client may stay silent: one and a
+// half times its keepalive [MQTT-3.1.2-24], or the ServerKeepAlive, or 0
+// if keepalive is disabled
+func (c *Conn) keepAliveTimeout() time.Duration {
+	keepAlive := c.connect.VariableHeader.KeepAlive
+	if ka := c.connAck.ServerKeepAlive; ka != nil && c.version == packet.ProtocolVersion5 {
+		keepAlive = int(*ka)
+	}
+	return time.Duration(keepAlive) * time.Second * 3 / 2
+}
@@ -0,0 +1,103 @@
+package broker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func TestServerConnAckProperties(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	maxQoS := packet.QoSLevelAtLeastOnce
+	s := &Server{TopicAliasMaximum: 10, Authenticator: AuthenticatorFunc(func(c *Conn) error {
+		c.SetConnAckProperties(ConnAckProperties{
+			AssignedClientIdentifier: "device-" + c.ClientID(),
+			MaximumQoS:               &maxQoS,
+			RetainUnavailable:        true,
+			TopicAliasMaximum:        packet.Uint16(0),
+			ServerKeepAlive:          packet.Uint16(30),
+			UserProperties:           []packet.UserProperty{{Key: "plan", Value: "free"}},
+		})
+		return nil
+	})}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+	addr := l.Addr().String()
+
+	c, connack := connectV5(t, addr, "c1")
+	defer c.Close() // nolint: errcheck
+	assert.Equal(t, packet.ConnAckAccepted, connack.VariableHeader.ReturnCode)
+	props := connack.VariableHeader.Properties
+	assert.Equal(t, "device-c1", props.AssignedClientIdentifier)
+	assert.Equal(t, packet.Byte(1), props.MaximumQoS)
+	assert.Equal(t, packet.Byte(0), props.RetainAvailable)
+	assert.Nil(t, props.TopicAliasMaximum)
+	assert.Equal(t, packet.Uint16(30), props.ServerKeepAlive)
+	assert.Equal(t, []packet.UserProperty{{Key: "plan", Value: "free"}}, props.UserProperties)
+
+	// Subscriptions are granted the maximum QoS at most
+	require.NoError(t, packet.WritePacket(c, &packet.SubscribeControlPacket{
+		VariableHeader: packet.SubscribeVariableHeader{PacketID: 1, Properties: &packet.Properties{}},
+		Payload:        packet.SubscribePayload{Subscriptions: []packet.Subscription{{Topic: "a/#", QoS: packet.QoSLevelExactlyOnce}}},
+	}))
+	p, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.SubAckControlPacket{}, p)
+	assert.Equal(t, []byte{1}, p.(*packet.SubAckControlPacket).Payload.ReturnCodes)
+
+	for _, tc := range []struct {
+		clientID string
+		qos      packet.QosLevel
+		retain   bool
+		code     byte
+	}{
+		{"c1", packet.QoSLevelExactlyOnce, false, packet.ReasonCodeQoSNotSupported},
+		{"c2", packet.QoSLevelNone, true, packet.ReasonCodeRetainNotSupported},
+	} {
+		if tc.clientID != "c1" {
+			c, _ = connectV5(t, addr, tc.clientID)
+			defer c.Close() // nolint: errcheck
+		}
+		publish := packet.NewPublish("a/b", 1, []byte("x"))
+		publish.FixedHeaderFlags.QoS = tc.qos
+		publish.FixedHeaderFlags.Retain = tc.retain
+		publish.VariableHeader.Properties = &packet.Properties{}
+		require.NoError(t, packet.WritePacket(c, publish))
+		p, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+		require.NoError(t, err, tc.clientID)
+		require.IsType(t, &packet.DisconnectControlPacket{}, p, tc.clientID)
+		assert.Equal(t, tc.code, p.(*packet.DisconnectControlPacket).VariableHeader.ReasonCode, tc.clientID)
+	}
+
+	// A will beyond the maximum QoS is refused
+	c, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close() // nolint: errcheck
+	connect := &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(packet.ProtocolVersion5),
+			Properties:    &packet.Properties{},
+		},
+		ConnectPayload: packet.ConnectPayload{
+			ClientID:       "c3",
+			WillProperties: &packet.Properties{},
+			WillTopic:      "status/c3",
+			WillMessage:    []byte("offline"),
+		},
+	}
+	connect.VariableHeader.ConnectFlags.WillFlag = true
+	connect.VariableHeader.ConnectFlags.WillQoS = byte(packet.QoSLevelExactlyOnce)
+	require.NoError(t, packet.WritePacket(c, connect))
+	p, err = packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.ConnAckControlPacket{}, p)
+	assert.Equal(t, packet.ReasonCodeQoSNotSupported, p.(*packet.ConnAckControlPacket).VariableHeader.ReturnCode)
+	_, err = packet.ReadPacket(c)
+	assert.Error(t, err, "refused connection must be closed")
+}
@@ -0,0 +1,128 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// The reasons a message was dropped, in the dead-letter-reason user
+// property of dead letters, see Server.DeadLetterTopic
+const (
+	// DropOverflow is a QoS 0 message dropped from the full outbound
+	// queue of a subscriber, see OverflowPolicy
+	DropOverflow = "overflow"
+	// DropExpired is a message that expired before it was delivered to
+	// a subscriber
+	DropExpired = "expired"
+	// DropNotAuthorized is a message the Authorizer didn't allow the
+	// publisher to publish
+	DropNotAuthorized = "not-authorized"
+	// DropRejected is a message rejected by a Transformer or a hook
+	DropRejected = "rejected"
+	// DropTooLarge is a message beyond the SizeRules
+	DropTooLarge = "too-large"
+	// DropForwardFailed is a message that couldn't be forwarded to
+	// another broker, e.g. by a bridge.Bridge
+	DropForwardFailed = "forward-failed"
+)
+
+// maxDeadLetters limits how many dead letters wait for the next tick of
+// expiryLoop; those beyond are lost, so that a flood of drops can't
+// exhaust the memory
+const maxDeadLetters = 1024
+
+// deadLetters are the dead letters waiting to be published
+type deadLetters struct {
+	pending []*packet.PublishControlPacket
+	lost    int
+}
+
+// deadLetter wraps p, dropped for the client with the session clientID
+// for reason, into a dead letter to be published to the
+// DeadLetterTopic. It is safe to call with any lock held.
+func (s *Server) deadLetter(p *packet.PublishControlPacket, clientID, reason string) {
+	if s.DeadLetterTopic == "" || p.VariableHeader.Topic == s.DeadLetterTopic {
+		return
+	}
+	props := packet.Properties{}
+	if orig := p.VariableHeader.Properties; orig != nil {
+		props = packet.Properties{
+			PayloadFormatIndicator: orig.PayloadFormatIndicator,
+			ContentType:            orig.ContentType,
+			ResponseTopic:          orig.ResponseTopic,
+			CorrelationData:        orig.CorrelationData,
+		}
+		props.UserProperties = append(props.UserProperties, orig.UserProperties...)
+	}
+	props.UserProperties = append(props.UserProperties,
+		packet.UserProperty{Key: "dead-letter-reason", Value: reason},
+		packet.UserProperty{Key: "dead-letter-topic", Value: p.VariableHeader.Topic},
+		packet.UserProperty{Key: "dead-letter-client", Value: clientID})
+	letter := packet.NewPublish(s.DeadLetterTopic, 0, p.Payload)
+	letter.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+	letter.VariableHeader.Properties = &props
+
+	s.deadMu.Lock()
+	defer s.deadMu.Unlock()
+	if len(s.dead.pending) >= maxDeadLetters {
+		s.dead.lost++
+		return
+	}
+	s.dead.pending = append(s.dead.pending, letter)
+}
+
+// publishDeadLetters routes the dead letters waiting
+func (s *Server) publishDeadLetters() {
+	s.deadMu.Lock()
+	dead := s.dead
+	s.dead = deadLetters{}
+	s.deadMu.Unlock()
+	if dead.lost > 0 {
+		s.log(logger.LevelWarn, "broker: too many dead letters, some were lost", logger.F("lost", dead.lost))
+	}
+	for _, p := range dead.pending {
+		s.route(nil, p)
+	}
+}
+
+// drop reports p, a message of or for c, as dropped for reason
+func (c *Conn) drop(p *packet.PublishControlPacket, reason string) {
+	c.server.deadLetter(p, c.sessionID, reason)
+}
+
+// dropQueued reports q, a packet dropped from the outbound queue of c,
+// if it is a message. Its topic is back in the namespace of c.
+func (c *Conn) dropQueued(q packet.ControlPacket) {
+	p, ok := publishOf(q)
+	if !ok || c.server.DeadLetterTopic == "" {
+		return
+	}
+	cp := *p
+	cp.VariableHeader.Topic = c.namespace() + p.VariableHeader.Topic
+	c.drop(&cp, DropOverflow)
+}
+
+// DeadLetter publishes p to the DeadLetterTopic, if there is one, as
+// dropped for the client clientID for reason. It lets messages lost
+// outside the server be recovered as well, e.g. those a bridge.Bridge
+// failed to forward.
+func (s *Server) DeadLetter(p *packet.PublishControlPacket, clientID, reason string) {
+	s.deadLetter(p, clientID, reason)
+}
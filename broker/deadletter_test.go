@@ -0,0 +1,133 @@
+package broker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// letterProps returns the dead-letter user properties of p
+func letterProps(p *packet.PublishControlPacket) map[string]string {
+	props := make(map[string]string)
+	for _, up := range p.VariableHeader.Properties.UserProperties {
+		props[up.Key] = up.Value
+	}
+	return props
+}
+
+func TestConnDeadLetterOverflow(t *testing.T) {
+	qos := func(topic string, qos packet.QosLevel) packet.ControlPacket {
+		p := packet.NewPublish(topic, 1, []byte(topic))
+		p.FixedHeaderFlags.QoS = qos
+		return p
+	}
+	for _, tc := range []struct {
+		policy  OverflowPolicy
+		written []packet.ControlPacket
+		dropped []string
+	}{
+		{OverflowDropNew, []packet.ControlPacket{qos("a", 0), qos("b", 0), qos("c", 0)}, []string{"c"}},
+		{OverflowDropOldest, []packet.ControlPacket{qos("a", 0), qos("b", 0), qos("c", 0)}, []string{"a"}},
+		{OverflowDropLowestQoS, []packet.ControlPacket{qos("a", 2), qos("b", 0), qos("c", 1)}, []string{"b"}},
+		{OverflowDropLowestQoS, []packet.ControlPacket{qos("a", 2), qos("b", 1), qos("c", 0)}, []string{"c"}},
+	} {
+		server, client := net.Pipe()
+		s := &Server{OutboundQueueSize: 2, OverflowPolicy: tc.policy, DeadLetterTopic: "$dead"}
+		// No writeLoop runs, so everything stays in the queue
+		c := newConn(s, server)
+		c.sessionID = "c1"
+		for _, p := range tc.written {
+			require.NoError(t, c.WritePacket(p))
+		}
+		var dropped []string
+		for _, letter := range s.dead.pending {
+			assert.Equal(t, "$dead", letter.VariableHeader.Topic)
+			props := letterProps(letter)
+			assert.Equal(t, DropOverflow, props["dead-letter-reason"])
+			assert.Equal(t, "c1", props["dead-letter-client"])
+			assert.Equal(t, props["dead-letter-topic"], string(letter.Payload))
+			dropped = append(dropped, props["dead-letter-topic"])
+		}
+		assert.Equal(t, tc.dropped, dropped, "policy %d", tc.policy)
+		_ = client.Close()
+		_ = server.Close()
+	}
+}
+
+func TestServerDeadLetters(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{
+		DeadLetterTopic: "$dead",
+		Authorizer: AuthorizerFunc(func(clientID, userName, topic string, action Action) error {
+			if topic == "secret" {
+				return ErrNotAuthorized
+			}
+			return nil
+		}),
+	}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+	addr := l.Addr().String()
+
+	ops, _ := connectV5(t, addr, "ops")
+	defer ops.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(ops, &packet.SubscribeControlPacket{
+		VariableHeader: packet.SubscribeVariableHeader{PacketID: 1, Properties: &packet.Properties{}},
+		Payload:        packet.SubscribePayload{Subscriptions: []packet.Subscription{{Topic: "$dead", QoS: 1}}},
+	}))
+	_, err = packet.ReadPacketVersion(ops, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	next := func() map[string]string {
+		p, err := packet.ReadPacketVersion(ops, packet.ProtocolVersion5)
+		require.NoError(t, err)
+		require.IsType(t, &packet.PublishControlPacket{}, p)
+		letter := p.(*packet.PublishControlPacket)
+		require.NoError(t, packet.WritePacket(ops, packet.NewPubAckControlPacket(uint16(letter.VariableHeader.PacketID))))
+		props := letterProps(letter)
+		props["payload"] = string(letter.Payload)
+		return props
+	}
+
+	// A persistent session offline when its message expires
+	off, _ := connect5(t, addr, "off", 3600, nil)
+	require.NoError(t, packet.WritePacket(off, &packet.SubscribeControlPacket{
+		VariableHeader: packet.SubscribeVariableHeader{PacketID: 1, Properties: &packet.Properties{}},
+		Payload:        packet.SubscribePayload{Subscriptions: []packet.Subscription{{Topic: "t", QoS: 1}}},
+	}))
+	_, err = packet.ReadPacketVersion(off, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	offline := waitOffline(s, "off")
+	require.NoError(t, off.Close())
+	<-offline
+
+	pub, _ := connectV5(t, addr, "pub")
+	defer pub.Close() // nolint: errcheck
+	for i, name := range []string{"secret", "t"} {
+		p := packet.NewPublish(name, uint16(i+1), []byte("lost"))
+		p.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+		p.VariableHeader.Properties = &packet.Properties{
+			MessageExpiryInterval: packet.Uint32(1),
+			UserProperties:        []packet.UserProperty{{Key: "k", Value: "v"}},
+		}
+		require.NoError(t, packet.WritePacket(pub, p))
+		_, err := packet.ReadPacketVersion(pub, packet.ProtocolVersion5)
+		require.NoError(t, err)
+	}
+
+	s.expire(time.Now())
+	assert.Equal(t, map[string]string{
+		"k": "v", "payload": "lost",
+		"dead-letter-reason": DropNotAuthorized, "dead-letter-topic": "secret", "dead-letter-client": "pub",
+	}, next())
+	s.expire(time.Now().Add(2 * time.Second))
+	assert.Equal(t, map[string]string{
+		"k": "v", "payload": "lost",
+		"dead-letter-reason": DropExpired, "dead-letter-topic": "t", "dead-letter-client": "off",
+	}, next())
+}
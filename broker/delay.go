@@ -0,0 +1,198 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// DelayedPrefix starts the topics of delayed messages: a message
+// published to $delayed/{seconds}/{topic} is published to topic once
+// seconds passed, see Server.MaxDelay
+const DelayedPrefix = "$delayed/"
+
+// DelayedMessage is a message held back until it is due
+type DelayedMessage struct {
+	// ID identifies the message in the DelayStore
+	ID uint64
+	// At is when the message is due
+	At time.Time
+	// Message is published to its topic once it is due
+	Message *packet.PublishControlPacket
+}
+
+// DelayStore keeps the delayed messages, so that they survive a restart
+type DelayStore interface {
+	// StoreDelayed is called with every message held back
+	StoreDelayed(m DelayedMessage) error
+	// DeleteDelayed is called once the message id was published
+	DeleteDelayed(id uint64) error
+	// LoadDelayed returns every stored message
+	LoadDelayed() ([]DelayedMessage, error)
+}
+
+// delayWheel holds the delayed messages in slots of a second, the
+// resolution of expiryLoop, so that a tick only looks at the messages
+// due
+type delayWheel struct {
+	slots map[int64][]DelayedMessage
+	// next is the first slot not yet taken
+	next int64
+	len  int
+}
+
+// add holds m until the slot of the second it is due in was taken
+func (w *delayWheel) add(m DelayedMessage) {
+	slot := (m.At.UnixNano() + int64(time.Second) - 1) / int64(time.Second)
+	if w.slots == nil {
+		w.slots = make(map[int64][]DelayedMessage)
+	}
+	if w.len == 0 || slot < w.next {
+		w.next = slot
+	}
+	w.slots[slot] = append(w.slots[slot], m)
+	w.len++
+}
+
+// take removes the messages due at now and returns them
+func (w *delayWheel) take(now time.Time) []DelayedMessage {
+	if w.len == 0 {
+		return nil
+	}
+	end := now.Unix()
+	var due []DelayedMessage
+	if end-w.next > int64(len(w.slots)) {
+		// Far behind, as after a restore: look at the slots instead of
+		// at every second
+		for slot, ms := range w.slots {
+			if slot <= end {
+				due = append(due, ms...)
+				delete(w.slots, slot)
+			}
+		}
+		w.next = end + 1
+	}
+	for ; w.next <= end; w.next++ {
+		due = append(due, w.slots[w.next]...)
+		delete(w.slots, w.next)
+	}
+	w.len -= len(due)
+	return due
+}
+
+// delay moves a message of c published to a $delayed topic to the topic
+// it is due on and returns how long it is held back. It returns a reason
+// code other than success for malformed topics and delays beyond
+// MaxDelay.
+func (c *Conn) delay(p *packet.PublishControlPacket) (time.Duration, byte) {
+	max := c.server.MaxDelay
+	if max <= 0 {
+		return 0, packet.ReasonCodeSuccess
+	}
+	ns := c.namespace()
+	rest, ok := strings.CutPrefix(strings.TrimPrefix(p.VariableHeader.Topic, ns), DelayedPrefix)
+	if !ok {
+		return 0, packet.ReasonCodeSuccess
+	}
+	seconds, name, ok := strings.Cut(rest, "/")
+	n, err := strconv.ParseUint(seconds, 10, 32)
+	if !ok || err != nil || name == "" {
+		c.log(logger.LevelInfo, "broker: malformed delayed topic", logger.F("topic", p.VariableHeader.Topic))
+		return 0, packet.ReasonCodeTopicNameInvalid
+	}
+	d := time.Duration(n) * time.Second
+	if d > max {
+		c.log(logger.LevelInfo, "broker: delay too long", logger.F("topic", p.VariableHeader.Topic), logger.F("max", max))
+		return 0, packet.ReasonCodeQuotaExceeded
+	}
+	p.VariableHeader.Topic = ns + name
+	return d, packet.ReasonCodeSuccess
+}
+
+// hold keeps a copy of p to be published after d and returns the reason
+// code of the acknowledgement
+func (c *Conn) hold(p *packet.PublishControlPacket, d time.Duration) byte {
+	s := c.server
+	cp := *s.intern(p)
+	cp.FixedHeaderFlags.Dup = false
+	cp.VariableHeader.PacketID = 0
+	now := time.Now()
+	m := DelayedMessage{At: now.Add(d), Message: &cp}
+
+	s.mu.Lock()
+	// Unique across restarts and, in practice, across brokers sharing
+	// a DelayStore
+	s.delayID = max(s.delayID+1, uint64(now.UnixNano()))
+	m.ID = s.delayID
+	s.mu.Unlock()
+	if s.DelayStore != nil {
+		if err := s.DelayStore.StoreDelayed(m); err != nil {
+			c.log(logger.LevelError, "store: failed to store delayed message", logger.F("topic", p.VariableHeader.Topic), logger.F("error", err))
+			return packet.ReasonCodeUnspecifiedError
+		}
+	}
+	s.mu.Lock()
+	s.delayed.add(m)
+	s.mu.Unlock()
+	return packet.ReasonCodeSuccess
+}
+
+// publishDelayed retains and routes the delayed messages due at now
+func (s *Server) publishDelayed(now time.Time) {
+	s.mu.Lock()
+	due := s.delayed.take(now)
+	s.mu.Unlock()
+	for _, m := range due {
+		p := m.Message
+		if p.FixedHeaderFlags.Retain {
+			if err := s.retainStore().Retain(p); err != nil {
+				s.log(logger.LevelError, "store: failed to retain message", logger.F("topic", p.VariableHeader.Topic), logger.F("error", err))
+			}
+		}
+		s.route(nil, p)
+		if s.DelayStore != nil {
+			if err := s.DelayStore.DeleteDelayed(m.ID); err != nil {
+				s.log(logger.LevelError, "store: failed to delete delayed message", logger.F("topic", p.VariableHeader.Topic), logger.F("error", err))
+			}
+		}
+	}
+}
+
+// RestoreDelayed loads the messages kept by the DelayStore. Those that
+// fell due while the server was down are published right away.
+func (s *Server) RestoreDelayed() error {
+	if s.DelayStore == nil {
+		return nil
+	}
+	ms, err := s.DelayStore.LoadDelayed()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range ms {
+		s.delayed.add(m)
+		s.delayID = max(s.delayID, m.ID)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package broker
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func TestDelayWheel(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var w delayWheel
+	assert.Empty(t, w.take(now))
+	for i, d := range []time.Duration{2 * time.Second, time.Second, 1500 * time.Millisecond, time.Hour} {
+		w.add(DelayedMessage{ID: uint64(i), At: now.Add(d)})
+	}
+	assert.Empty(t, w.take(now))
+	assert.Len(t, w.take(now.Add(time.Second)), 1)
+	assert.Len(t, w.take(now.Add(1900*time.Millisecond)), 0, "not before it is due")
+	assert.Len(t, w.take(now.Add(2*time.Second)), 2)
+
+	// A message due long ago, as after a restore
+	w.add(DelayedMessage{ID: 4, At: now.Add(-24 * time.Hour)})
+	due := w.take(now.Add(3 * time.Second))
+	require.Len(t, due, 1)
+	assert.Equal(t, uint64(4), due[0].ID)
+	assert.Len(t, w.take(now.Add(2*time.Hour)), 1)
+	assert.Zero(t, w.len)
+	assert.Empty(t, w.slots)
+}
+
+// memoryDelayStore is a DelayStore in memory
+type memoryDelayStore struct {
+	mu       sync.Mutex
+	messages map[uint64]DelayedMessage
+}
+
+func (s *memoryDelayStore) StoreDelayed(m DelayedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages[m.ID] = m
+	return nil
+}
+
+func (s *memoryDelayStore) DeleteDelayed(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.messages, id)
+	return nil
+}
+
+func (s *memoryDelayStore) LoadDelayed() ([]DelayedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ms []DelayedMessage
+	for _, m := range s.messages {
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+func (s *memoryDelayStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages)
+}
+
+func TestServerDelayedPublish(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	store := &memoryDelayStore{messages: make(map[uint64]DelayedMessage)}
+	s := &Server{
+		MaxDelay:   time.Minute,
+		DelayStore: store,
+		Authorizer: AuthorizerFunc(func(clientID, userName, topic string, action Action) error {
+			if topic == "secret" {
+				return ErrNotAuthorized
+			}
+			return nil
+		}),
+	}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	sub, _ := dialAndConnect(t, l.Addr().String(), "sub")
+	defer sub.Close() // nolint: errcheck
+	assert.Equal(t, []byte{0}, subscribe(t, sub, 1, packet.Subscription{Topic: "#"}))
+
+	pub, _ := connectV5(t, l.Addr().String(), "pub")
+	defer pub.Close() // nolint: errcheck
+	for i, tc := range []struct {
+		topic string
+		code  byte
+	}{
+		{"$delayed/1/a/b", packet.ReasonCodeSuccess},
+		{"$delayed/0/now", packet.ReasonCodeSuccess},
+		{"$delayed/61/a", packet.ReasonCodeQuotaExceeded},
+		{"$delayed/x/a", packet.ReasonCodeTopicNameInvalid},
+		{"$delayed/1", packet.ReasonCodeTopicNameInvalid},
+		{"$delayed/1/secret", packet.ReasonCodeNotAuthorized},
+	} {
+		publish := packet.NewPublish(tc.topic, uint16(i+1), []byte("x"))
+		publish.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+		publish.FixedHeaderFlags.Retain = true
+		publish.VariableHeader.Properties = &packet.Properties{}
+		require.NoError(t, packet.WritePacket(pub, publish))
+		p, err := packet.ReadPacketVersion(pub, packet.ProtocolVersion5)
+		require.NoError(t, err)
+		require.IsType(t, &packet.PubackControlPacket{}, p)
+		assert.Equal(t, tc.code, p.(*packet.PubackControlPacket).VariableHeader.ReasonCode, tc.topic)
+	}
+
+	p := nextPublish(t, sub)
+	require.NotNil(t, p)
+	assert.Equal(t, "now", p.VariableHeader.Topic, "a delay of 0 publishes at once")
+	assert.Nil(t, nextPublish(t, sub), "held back")
+	assert.Equal(t, 1, store.len())
+
+	s.publishDelayed(time.Now().Add(2 * time.Second))
+	p = nextPublish(t, sub)
+	require.NotNil(t, p)
+	assert.Equal(t, "a/b", p.VariableHeader.Topic)
+	assert.Zero(t, store.len())
+	retained, err := s.retainStore().Match("a/b")
+	require.NoError(t, err)
+	assert.Len(t, retained, 1)
+
+	// Messages kept by the DelayStore are published once restored
+	require.NoError(t, store.StoreDelayed(DelayedMessage{ID: 1, At: time.Now().Add(-time.Hour), Message: packet.NewPublish("restored", 0, []byte("y"))}))
+	require.NoError(t, s.RestoreDelayed())
+	s.publishDelayed(time.Now())
+	p = nextPublish(t, sub)
+	require.NotNil(t, p)
+	assert.Equal(t, "restored", p.VariableHeader.Topic)
+}
@@ -0,0 +1,151 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// errDraining refuses the clients connecting while the server drains
+var errDraining = errors.New("broker: server draining")
+
+// DrainConfig tunes Server.Drain
+type DrainConfig struct {
+	// ServerReference is the server MQTT 5 clients should use instead,
+	// see the Server Reference property. Without it they are told the
+	// server is shutting down, or unavailable when they connect.
+	ServerReference string
+	// Moved tells the clients the ServerReference is permanent, with
+	// reason code Server moved instead of Use another server
+	Moved bool
+	// Period spreads disconnecting the clients evenly over this long,
+	// so that they don't all reconnect at once. All of them are
+	// disconnected right away if 0.
+	Period time.Duration
+}
+
+// reasonCode returns the reason code of the DISCONNECT, or of the
+// CONNACK if connack, telling MQTT 5 clients to go
+func (d *DrainConfig) reasonCode(connack bool) byte {
+	switch {
+	case d.ServerReference == "" && connack:
+		return packet.ReasonCodeServerUnavailable
+	case d.ServerReference == "":
+		return packet.ReasonCodeServerShuttingDown
+	case d.Moved:
+		return packet.ReasonCodeServerMoved
+	}
+	return packet.ReasonCodeUseAnotherServer
+}
+
+// Drain takes the server out of service, for maintenance behind a load
+// balancer: it keeps its listeners but refuses new clients, and
+// disconnects the connected ones one after another over cfg.Period. Like
+// Shutdown it waits for each client to acknowledge the QoS 1 and 2
+// messages in flight to it first, and publishes no wills. MQTT 5 clients
+// are told where to go in the CONNACK or DISCONNECT, MQTT 3.1.1 clients
+// are refused as the server being unavailable.
+//
+// Drain returns once every client was disconnected, or the error of ctx
+// once it is done; the clients left are disconnected at once then. The
+// server drains until it is closed.
+func (s *Server) Drain(ctx context.Context, cfg DrainConfig) error {
+	s.mu.Lock()
+	s.draining = &cfg
+	conns := make([]*Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	var interval time.Duration
+	if len(conns) > 1 {
+		interval = cfg.Period / time.Duration(len(conns)-1)
+	}
+	var wg sync.WaitGroup
+	for i, c := range conns {
+		if i > 0 && interval > 0 && ctx.Err() == nil {
+			t := time.NewTimer(interval)
+			select {
+			case <-ctx.Done():
+			case <-t.C:
+			}
+			t.Stop()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.drainConn(ctx, c, &cfg)
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// drainConn disconnects c for Drain once it has no messages in flight,
+// or ctx is done
+func (s *Server) drainConn(ctx context.Context, c *Conn, cfg *DrainConfig) {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for ctx.Err() == nil && s.inFlight(c) {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+
+	s.mu.Lock()
+	connected := c.session != nil
+	s.mu.Unlock()
+	if connected && c.version == packet.ProtocolVersion5 {
+		disconnect := packet.NewDisconnectControlPacket()
+		disconnect.VariableHeader.ReasonCode = cfg.reasonCode(false)
+		disconnect.VariableHeader.Properties = &packet.Properties{ServerReference: cfg.ServerReference}
+		_ = c.WritePacket(disconnect)
+		c.flush()
+	}
+	_ = c.Close()
+	<-c.done
+}
+
+// drainConfig returns the configuration of Drain, nil if the server does
+// not drain
+func (s *Server) drainConfig() *DrainConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// isStopping reports whether the server is closed or drains, when the
+// connections it closes are not the clients' fault
+func (s *Server) isStopping() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed || s.draining != nil
+}
+
+// refuseDraining refuses the CONNECT of c while the server drains
+func (c *Conn) refuseDraining() {
+	cfg := c.server.drainConfig()
+	c.redirect(cfg.reasonCode(true), cfg.ServerReference)
+}
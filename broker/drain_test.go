@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func connectV5(t *testing.T, addr, clientID string) (net.Conn, *packet.ConnAckControlPacket) {
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	require.NoError(t, packet.WritePacket(c, &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(packet.ProtocolVersion5),
+			Properties:    &packet.Properties{},
+		},
+		ConnectPayload: packet.ConnectPayload{ClientID: clientID},
+	}))
+	p, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.ConnAckControlPacket{}, p)
+	return c, p.(*packet.ConnAckControlPacket)
+}
+
+func TestServerDrain(t *testing.T) {
+	s, served, sub, p := serveInFlight(t)
+	defer s.Close()   // nolint: errcheck
+	defer sub.Close() // nolint: errcheck
+	var addr string
+	s.mu.Lock()
+	for l := range s.listeners {
+		addr = l.Addr().String()
+	}
+	s.mu.Unlock()
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- s.Drain(context.Background(), DrainConfig{ServerReference: "other:1883", Period: 50 * time.Millisecond})
+	}()
+	require.Eventually(t, func() bool { return s.drainConfig() != nil }, time.Second, time.Millisecond)
+
+	// New clients are refused, MQTT 5 ones pointed to the other server
+	c, connack := connectV5(t, addr, "new")
+	assert.Equal(t, packet.ReasonCodeUseAnotherServer, connack.VariableHeader.ReturnCode)
+	assert.Equal(t, "other:1883", connack.VariableHeader.Properties.ServerReference)
+	assert.NoError(t, c.Close())
+	c, connack = dialAndConnect(t, addr, "new")
+	assert.Equal(t, packet.ConnAckServerUnavailable, connack.VariableHeader.ReturnCode)
+	assert.NoError(t, c.Close())
+
+	select {
+	case <-drained:
+		t.Fatal("Drain returned before the message in flight was acknowledged")
+	case <-time.After(100 * time.Millisecond):
+	}
+	puback := packet.NewPubAckControlPacket(uint16(p.VariableHeader.PacketID))
+	puback.VariableHeader.Properties = &packet.Properties{}
+	require.NoError(t, packet.WritePacket(sub, puback))
+	d, err := packet.ReadPacketVersion(sub, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.DisconnectControlPacket{}, d)
+	assert.Equal(t, packet.ReasonCodeUseAnotherServer, d.(*packet.DisconnectControlPacket).VariableHeader.ReasonCode)
+	assert.Equal(t, "other:1883", d.(*packet.DisconnectControlPacket).VariableHeader.Properties.ServerReference)
+	assert.NoError(t, <-drained)
+
+	select {
+	case err := <-served:
+		t.Fatalf("Serve returned %v while draining", err)
+	default:
+	}
+}
+
+func TestServerDrainPeriod(t *testing.T) {
+	published := make(chan packet.ControlPacket, 1)
+	s, addr := newTestServer(t, HandlerFunc(func(c *Conn, p packet.ControlPacket) {
+		published <- p
+	}))
+	defer s.Close() // nolint: errcheck
+
+	var conns []net.Conn
+	for _, id := range []string{"a", "b", "c"} {
+		c, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer c.Close() // nolint: errcheck
+		require.NoError(t, packet.WritePacket(c, &packet.ConnectControlPacket{
+			VariableHeader: packet.ConnectVariableHeader{
+				ProtocolName:  "MQTT",
+				ProtocolLevel: byte(packet.ProtocolVersion311),
+				ConnectFlags:  packet.ConnectFlags{WillFlag: true},
+			},
+			ConnectPayload: packet.ConnectPayload{ClientID: id, WillTopic: "status/" + id},
+		}))
+		_, err = packet.ReadPacket(c)
+		require.NoError(t, err)
+		conns = append(conns, c)
+	}
+
+	start := time.Now()
+	require.NoError(t, s.Drain(context.Background(), DrainConfig{Period: 200 * time.Millisecond}))
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond, "spread over the period")
+	for _, c := range conns {
+		_, err := packet.ReadPacket(c)
+		assert.Error(t, err, "connection must be closed")
+	}
+	select {
+	case p := <-published:
+		t.Fatalf("%v was published while draining", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDrainReasonCode(t *testing.T) {
+	for _, test := range []struct {
+		cfg                 DrainConfig
+		disconnect, connack byte
+	}{
+		{DrainConfig{}, packet.ReasonCodeServerShuttingDown, packet.ReasonCodeServerUnavailable},
+		{DrainConfig{ServerReference: "b"}, packet.ReasonCodeUseAnotherServer, packet.ReasonCodeUseAnotherServer},
+		{DrainConfig{ServerReference: "b", Moved: true}, packet.ReasonCodeServerMoved, packet.ReasonCodeServerMoved},
+	} {
+		assert.Equal(t, test.disconnect, test.cfg.reasonCode(false), test.cfg)
+		assert.Equal(t, test.connack, test.cfg.reasonCode(true), test.cfg)
+	}
+}
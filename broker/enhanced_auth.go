@@ -0,0 +1,194 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+var (
+	// ErrBadAuthenticationMethod rejects a client with reason code 0x8C.
+	// It is returned for methods none of the EnhancedAuthenticators
+	// implements.
+	ErrBadAuthenticationMethod = errors.New("broker: bad authentication method")
+
+	errAuthProtocol = errors.New("broker: unexpected packet during authentication")
+)
+
+// EnhancedAuthenticator implements an MQTT 5 enhanced authentication
+// method, like a SASL mechanism. The exchange of CONNECT and AUTH packets
+// is run by the server; the EnhancedAuthenticator only looks at the
+// authentication data.
+type EnhancedAuthenticator interface {
+	// Method returns the name of the authentication method the client
+	// puts in CONNECT, like "SCRAM-SHA-256"
+	Method() string
+	// Start begins an exchange with c, either for CONNECT or when the
+	// client re-authenticates
+	Start(c *Conn) AuthExchange
+}
+
+// AuthExchange is a single run of an authentication method
+type AuthExchange interface {
+	// Step takes the authentication data of the client and returns the
+	// data to send back. The server sends it in CONNACK, or in AUTH when
+	// re-authenticating, once done is true; until then every step is
+	// answered with AUTH and continued by the next AUTH of the client.
+	// Errors refuse the client like the ones of Authenticator, with
+	// ErrBadUserNameOrPassword or ErrNotAuthorized.
+	Step(data []byte) (response []byte, done bool, err error)
+}
+
+// enhancedAuthenticator returns the EnhancedAuthenticator for method, or
+// nil if the server does not support it
+func (s *Server) enhancedAuthenticator(method string) EnhancedAuthenticator {
+	for _, auth := range s.EnhancedAuthenticators {
+		if auth.Method() == method {
+			return auth
+		}
+	}
+	return nil
+}
+
+// authMethod returns the authentication method of CONNECT, empty without
+// enhanced authentication
+func (c *Conn) authMethod() string {
+	if props := c.connect.VariableHeader.Properties; props != nil {
+		return props.AuthenticationMethod
+	}
+	return ""
+}
+
+// authReasonCode maps an error of enhanced authentication to an MQTT 5
+// reason code
+func authReasonCode(err error) byte {
+	switch {
+	case err == ErrBadAuthenticationMethod:
+		return packet.ReasonCodeBadAuthenticationMethod
+	case errors.Is(err, errAuthProtocol):
+		return packet.ReasonCodeProtocolError
+	}
+	return packet.ConnAckReasonCode(authReturnCode(err))
+}
+
+// authenticate runs the enhanced authentication the client asked for in
+// CONNECT and returns the authentication data for CONNACK. The whole
+// exchange has to complete within the connect timeout.
+func (c *Conn) authenticate() ([]byte, error) {
+	method := c.authMethod()
+	auth := c.server.enhancedAuthenticator(method)
+	if auth == nil {
+		return nil, ErrBadAuthenticationMethod
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, c.server.connectTimeout())
+	defer cancel()
+
+	ex := auth.Start(c)
+	data := c.connect.VariableHeader.Properties.AuthenticationData
+	for {
+		response, done, err := ex.Step(data)
+		if err != nil || done {
+			return response, err
+		}
+		if err := c.WritePacket(packet.NewAuth(packet.ReasonCodeContinueAuthentication, method, response)); err != nil {
+			return nil, err
+		}
+		p, err := c.readPacket(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// Only AUTH may follow CONNECT until CONNACK [MQTT-4.12.0-2]
+		auth, ok := p.(*packet.AuthControlPacket)
+		if !ok || auth.VariableHeader.ReasonCode != packet.ReasonCodeContinueAuthentication {
+			return nil, fmt.Errorf("%w: %T", errAuthProtocol, p)
+		}
+		if auth.VariableHeader.Properties.AuthenticationMethod != method {
+			return nil, fmt.Errorf("%w: method %q", errAuthProtocol, auth.VariableHeader.Properties.AuthenticationMethod)
+		}
+		data = auth.VariableHeader.Properties.AuthenticationData
+	}
+}
+
+// refuseAuth refuses a client whose enhanced authentication failed with
+// err
+func (c *Conn) refuseAuth(err error) {
+	var r *Redirect
+	if errors.As(err, &r) {
+		c.refuseWith(err)
+		return
+	}
+	connack := packet.NewConnAck(authReasonCode(err), false)
+	connack.VariableHeader.Properties = &packet.Properties{}
+	_ = c.WritePacket(connack)
+}
+
+// reauthenticate takes a step of the re-authentication a client started
+// with AUTH [MQTT-4.12.1]. It reports whether the connection can go on; a
+// failed re-authentication disconnects the client.
+func (c *Conn) reauthenticate(p *packet.AuthControlPacket) bool {
+	method := c.authMethod()
+	props := p.VariableHeader.Properties
+
+	var ex AuthExchange
+	var err error
+	switch {
+	case method == "" || props.AuthenticationMethod != method:
+		// Only the method of CONNECT can be used again [MQTT-4.12.0-5]
+		// [MQTT-4.12.1-1]
+		err = fmt.Errorf("%w: method %q", errAuthProtocol, props.AuthenticationMethod)
+	case p.VariableHeader.ReasonCode == packet.ReasonCodeReAuthenticate && c.reauth == nil:
+		if auth := c.server.enhancedAuthenticator(method); auth != nil {
+			ex = auth.Start(c)
+		} else {
+			err = ErrBadAuthenticationMethod
+		}
+	case p.VariableHeader.ReasonCode == packet.ReasonCodeContinueAuthentication && c.reauth != nil:
+		ex = c.reauth
+	default:
+		err = fmt.Errorf("%w: AUTH with reason code %#x", errAuthProtocol, p.VariableHeader.ReasonCode)
+	}
+
+	var response []byte
+	done := false
+	if err == nil {
+		response, done, err = ex.Step(props.AuthenticationData)
+	}
+	if err != nil {
+		c.log(logger.LevelInfo, "auth: re-authentication failed", logger.F("error", err))
+		c.disconnect(authReasonCode(err))
+		return false
+	}
+
+	reasonCode := packet.ReasonCodeContinueAuthentication
+	c.reauth = ex
+	if done {
+		reasonCode = packet.ReasonCodeSuccess
+		c.reauth = nil
+		c.log(logger.LevelInfo, "auth: client re-authenticated")
+	}
+	if err := c.WritePacket(packet.NewAuth(reasonCode, method, response)); err != nil {
+		c.log(logger.LevelWarn, "broker: failed to write AUTH", logger.F("error", err))
+		return false
+	}
+	return true
+}
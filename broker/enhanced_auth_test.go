@@ -0,0 +1,131 @@
+package broker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// challengeAuth asks for "answer" in a second step
+type challengeAuth struct{}
+
+func (challengeAuth) Method() string { return "challenge" }
+
+func (challengeAuth) Start(c *Conn) AuthExchange { return &challengeExchange{} }
+
+type challengeExchange struct{ step int }
+
+func (e *challengeExchange) Step(data []byte) ([]byte, bool, error) {
+	e.step++
+	switch {
+	case e.step == 1:
+		return []byte("question"), false, nil
+	case e.step == 2 && string(data) == "answer":
+		return []byte("welcome"), true, nil
+	}
+	return nil, false, ErrBadUserNameOrPassword
+}
+
+func TestServerEnhancedAuth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{
+		EnhancedAuthenticators: []EnhancedAuthenticator{challengeAuth{}},
+		// Not asked for clients using enhanced authentication
+		Authenticator: AuthenticatorFunc(func(c *Conn) error { return ErrNotAuthorized }),
+	}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	start := func(t *testing.T, method string) net.Conn {
+		c, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		require.NoError(t, packet.WritePacket(c, &packet.ConnectControlPacket{
+			VariableHeader: packet.ConnectVariableHeader{
+				ProtocolName:  "MQTT",
+				ProtocolLevel: byte(packet.ProtocolVersion5),
+				Properties:    &packet.Properties{AuthenticationMethod: method},
+			},
+			ConnectPayload: packet.ConnectPayload{ClientID: "c1"},
+		}))
+		return c
+	}
+	read := func(t *testing.T, c net.Conn) packet.ControlPacket {
+		p, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+		require.NoError(t, err)
+		return p
+	}
+	expectAuth := func(t *testing.T, c net.Conn, reasonCode byte, data string) {
+		p := read(t, c)
+		require.IsType(t, &packet.AuthControlPacket{}, p)
+		auth := p.(*packet.AuthControlPacket)
+		assert.Equal(t, reasonCode, auth.VariableHeader.ReasonCode)
+		assert.Equal(t, "challenge", auth.VariableHeader.Properties.AuthenticationMethod)
+		assert.Equal(t, data, string(auth.VariableHeader.Properties.AuthenticationData))
+	}
+	expectRefused := func(t *testing.T, c net.Conn, reasonCode byte) {
+		p := read(t, c)
+		require.IsType(t, &packet.ConnAckControlPacket{}, p)
+		assert.Equal(t, reasonCode, p.(*packet.ConnAckControlPacket).VariableHeader.ReturnCode)
+		_, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+		assert.Error(t, err, "refused connection must be closed")
+	}
+
+	t.Run("unknown method", func(t *testing.T) {
+		c := start(t, "unknown")
+		defer c.Close() // nolint: errcheck
+		expectRefused(t, c, packet.ReasonCodeBadAuthenticationMethod)
+	})
+
+	t.Run("wrong answer", func(t *testing.T) {
+		c := start(t, "challenge")
+		defer c.Close() // nolint: errcheck
+		expectAuth(t, c, packet.ReasonCodeContinueAuthentication, "question")
+		require.NoError(t, packet.WritePacket(c, packet.NewAuth(packet.ReasonCodeContinueAuthentication, "challenge", []byte("guess"))))
+		expectRefused(t, c, packet.ReasonCodeBadUserNameOrPassword)
+	})
+
+	t.Run("other packet", func(t *testing.T) {
+		c := start(t, "challenge")
+		defer c.Close() // nolint: errcheck
+		expectAuth(t, c, packet.ReasonCodeContinueAuthentication, "question")
+		require.NoError(t, packet.WritePacket(c, packet.NewPingReqControlPacket()))
+		expectRefused(t, c, packet.ReasonCodeProtocolError)
+	})
+
+	t.Run("success and re-authentication", func(t *testing.T) {
+		c := start(t, "challenge")
+		defer c.Close() // nolint: errcheck
+		expectAuth(t, c, packet.ReasonCodeContinueAuthentication, "question")
+		require.NoError(t, packet.WritePacket(c, packet.NewAuth(packet.ReasonCodeContinueAuthentication, "challenge", []byte("answer"))))
+		p := read(t, c)
+		require.IsType(t, &packet.ConnAckControlPacket{}, p)
+		connack := p.(*packet.ConnAckControlPacket)
+		assert.Equal(t, packet.ReasonCodeSuccess, connack.VariableHeader.ReturnCode)
+		assert.Equal(t, "challenge", connack.VariableHeader.Properties.AuthenticationMethod)
+		assert.Equal(t, "welcome", string(connack.VariableHeader.Properties.AuthenticationData))
+
+		require.NoError(t, packet.WritePacket(c, packet.NewAuth(packet.ReasonCodeReAuthenticate, "challenge", nil)))
+		expectAuth(t, c, packet.ReasonCodeContinueAuthentication, "question")
+		require.NoError(t, packet.WritePacket(c, packet.NewAuth(packet.ReasonCodeContinueAuthentication, "challenge", []byte("answer"))))
+		expectAuth(t, c, packet.ReasonCodeSuccess, "welcome")
+
+		// A failed re-authentication ends the connection
+		require.NoError(t, packet.WritePacket(c, packet.NewAuth(packet.ReasonCodeReAuthenticate, "challenge", nil)))
+		expectAuth(t, c, packet.ReasonCodeContinueAuthentication, "question")
+		require.NoError(t, packet.WritePacket(c, packet.NewAuth(packet.ReasonCodeContinueAuthentication, "challenge", []byte("guess"))))
+		p = read(t, c)
+		require.IsType(t, &packet.DisconnectControlPacket{}, p)
+		assert.Equal(t, packet.ReasonCodeBadUserNameOrPassword, p.(*packet.DisconnectControlPacket).VariableHeader.ReasonCode)
+	})
+
+	t.Run("without method", func(t *testing.T) {
+		c, connack := connect5(t, l.Addr().String(), "c2", 0, nil)
+		defer c.Close() // nolint: errcheck
+		assert.Equal(t, packet.ReasonCodeNotAuthorized, connack.VariableHeader.ReturnCode, "CONNECT without method goes to the Authenticator")
+	})
+}
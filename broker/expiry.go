@@ -0,0 +1,172 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"math"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+)
+
+// expiryInterval is how often expired sessions, messages and delayed
+// wills and messages are looked for
+const expiryInterval = time.Second
+
+// delayedWill is a will message waiting for its will delay interval to
+// pass [MQTT-3.1.3-9]
+type delayedWill struct {
+	conn *Conn
+	will *packet.PublishControlPacket
+	at   time.Time
+}
+
+// sessionExpiry returns how long the session of the client sending
+// connect is to be kept after the connection ended: the session expiry
+// interval of MQTT 5, or no time or forever depending on the CleanSession
+// flag of MQTT 3.1.1
+func sessionExpiry(connect *packet.ConnectControlPacket) time.Duration {
+	if connect.Version() != packet.ProtocolVersion5 {
+		if connect.VariableHeader.ConnectFlags.CleanSession {
+			return 0
+		}
+		return session.NeverExpires
+	}
+	return fromExpiryInterval(connect.VariableHeader.Properties.SessionExpiryInterval)
+}
+
+// fromExpiryInterval converts a session expiry interval property, in
+// which 0xFFFFFFFF means never
+func fromExpiryInterval(v *uint32) time.Duration {
+	switch {
+	case v == nil:
+		return 0
+	case *v == math.MaxUint32:
+		return session.NeverExpires
+	}
+	return time.Duration(*v) * time.Second
+}
+
+// toExpiryInterval is the reverse of fromExpiryInterval
+func toExpiryInterval(d time.Duration) *uint32 {
+	if d/time.Second >= math.MaxUint32 {
+		return packet.Uint32(math.MaxUint32)
+	}
+	return packet.Uint32(uint32(d / time.Second))
+}
+
+// willDelay returns the will delay interval of the client
+func (c *Conn) willDelay() time.Duration {
+	if props := c.connect.ConnectPayload.WillProperties; props != nil && props.WillDelayInterval != nil {
+		return time.Duration(*props.WillDelayInterval) * time.Second
+	}
+	return 0
+}
+
+// updateExpiry applies the session expiry interval of an MQTT 5
+// DISCONNECT. It reports false if the client asked for a session expiry
+// of 0 in CONNECT, after which setting one is a protocol error.
+func (c *Conn) updateExpiry(p *packet.DisconnectControlPacket) bool {
+	props := p.VariableHeader.Properties
+	if props == nil || props.SessionExpiryInterval == nil {
+		return true
+	}
+	expiry := fromExpiryInterval(props.SessionExpiryInterval)
+	if expiry > 0 && sessionExpiry(c.connect) == 0 {
+		return false
+	}
+	c.session.SetExpiry(expiry)
+	return true
+}
+
+// publishWill publishes the will message of c
+func (c *Conn) publishWill(will *packet.PublishControlPacket) {
+	c.retain(will)
+	c.dispatch(will)
+	c.server.route(c, will)
+}
+
+// delayWill publishes the will of c once delay passed, unless the client
+// resumes its session before
+func (s *Server) delayWill(c *Conn, will *packet.PublishControlPacket, delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wills == nil {
+		s.wills = make(map[*session.Session]delayedWill)
+	}
+	s.wills[c.session] = delayedWill{conn: c, will: will, at: time.Now().Add(delay)}
+}
+
+// takeWill removes the delayed will of sess and returns it, if there is
+// one
+func (s *Server) takeWill(sess *session.Session) (delayedWill, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, ok := s.wills[sess]
+	delete(s.wills, sess)
+	return w, ok
+}
+
+func (s *Server) expiryLoop(quit chan struct{}) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.expire(now)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// expire discards the sessions and messages that expired before now and
+// publishes the wills that are due, including those of expired sessions,
+// the delayed messages and the dead letters
+func (s *Server) expire(now time.Time) {
+	expired, err := s.sessions().Expire(now)
+	if err != nil {
+		s.log(logger.LevelError, "broker: failed to expire sessions", logger.F("error", err))
+	}
+	for _, sess := range expired {
+		s.unsubscribeAll(sess)
+		if w, ok := s.takeWill(sess); ok {
+			w.conn.publishWill(w.will)
+		}
+		s.sessionExpired(sess.ClientID)
+	}
+
+	var due []delayedWill
+	s.mu.Lock()
+	for sess, w := range s.wills {
+		if !now.Before(w.at) {
+			due = append(due, w)
+			delete(s.wills, sess)
+		}
+	}
+	s.mu.Unlock()
+	for _, w := range due {
+		w.conn.publishWill(w.will)
+	}
+	s.publishDelayed(now)
+	s.publishDeadLetters()
+}
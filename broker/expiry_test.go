@@ -0,0 +1,142 @@
+package broker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+)
+
+// connect5 connects an MQTT 5 client with the session expiry interval
+// expiry and, if willDelay is not nil, a will delayed by it
+func connect5(t *testing.T, addr, clientID string, expiry uint32, willDelay *uint32) (net.Conn, *packet.ConnAckControlPacket) {
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	connect := &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(packet.ProtocolVersion5),
+			Properties:    &packet.Properties{SessionExpiryInterval: packet.Uint32(expiry)},
+		},
+		ConnectPayload: packet.ConnectPayload{ClientID: clientID},
+	}
+	if willDelay != nil {
+		connect.VariableHeader.ConnectFlags.WillFlag = true
+		connect.ConnectPayload.WillProperties = &packet.Properties{WillDelayInterval: willDelay}
+		connect.ConnectPayload.WillTopic = "status/" + clientID
+		connect.ConnectPayload.WillMessage = []byte("offline")
+	}
+	require.NoError(t, packet.WritePacket(c, connect))
+	p, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.ConnAckControlPacket{}, p)
+	return c, p.(*packet.ConnAckControlPacket)
+}
+
+type expiryHook struct {
+	NopHook
+	expired chan string
+}
+
+func (h expiryHook) OnSessionExpired(clientID string) { h.expired <- clientID }
+
+func TestServerSessionExpiry(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	hook := expiryHook{expired: make(chan string, 1)}
+	s := &Server{Sessions: session.NewManager(), Hooks: []Hook{hook}}
+	s.Sessions.MaxExpiry = time.Hour
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+	addr := l.Addr().String()
+
+	c, connack := connect5(t, addr, "c1", 60, nil)
+	assert.Nil(t, connack.VariableHeader.Properties.SessionExpiryInterval, "granted expiry is not sent back")
+	require.NoError(t, c.Close())
+	<-waitOffline(s, "c1")
+
+	c, connack = connect5(t, addr, "c1", 0xFFFFFFFF, nil)
+	assert.True(t, connack.VariableHeader.SessionPresent)
+	assert.Equal(t, packet.Uint32(3600), connack.VariableHeader.Properties.SessionExpiryInterval)
+	require.NoError(t, c.Close())
+	<-waitOffline(s, "c1")
+
+	s.expire(time.Now().Add(30 * time.Minute))
+	_, ok := s.Sessions.Get("c1")
+	assert.True(t, ok)
+	s.expire(time.Now().Add(2 * time.Hour))
+	_, ok = s.Sessions.Get("c1")
+	assert.False(t, ok)
+	assert.Equal(t, "c1", <-hook.expired)
+
+	c, connack = connect5(t, addr, "c1", 60, nil)
+	defer c.Close() // nolint: errcheck
+	assert.False(t, connack.VariableHeader.SessionPresent)
+}
+
+func TestServerDisconnectExpiry(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	defer s.Close() // nolint: errcheck
+
+	// A session that was to be kept ends with the DISCONNECT asking for
+	// an expiry of 0
+	c, _ := connect5(t, addr, "c1", 60, nil)
+	disconnect := packet.NewDisconnectControlPacket()
+	disconnect.VariableHeader.Properties = &packet.Properties{SessionExpiryInterval: packet.Uint32(0)}
+	require.NoError(t, packet.WritePacket(c, disconnect))
+	require.NoError(t, c.Close())
+	<-waitOffline(s, "c1")
+	_, ok := s.Sessions.Get("c1")
+	assert.False(t, ok)
+
+	// Once CONNECT asked for 0, setting an expiry is a protocol error
+	c, _ = connect5(t, addr, "c2", 0, nil)
+	defer c.Close() // nolint: errcheck
+	disconnect.VariableHeader.Properties.SessionExpiryInterval = packet.Uint32(60)
+	require.NoError(t, packet.WritePacket(c, disconnect))
+	p, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.DisconnectControlPacket{}, p)
+	assert.Equal(t, packet.ReasonCodeProtocolError, p.(*packet.DisconnectControlPacket).VariableHeader.ReasonCode)
+}
+
+func TestServerWillDelay(t *testing.T) {
+	published := make(chan *packet.PublishControlPacket, 2)
+	s, addr := newTestServer(t, HandlerFunc(func(c *Conn, p packet.ControlPacket) {
+		if publish, ok := p.(*packet.PublishControlPacket); ok {
+			published <- publish
+		}
+	}))
+	defer s.Close() // nolint: errcheck
+
+	// Resuming the session in time cancels the will
+	c, _ := connect5(t, addr, "c1", 600, packet.Uint32(60))
+	require.NoError(t, c.Close())
+	<-waitOffline(s, "c1")
+	c, _ = connect5(t, addr, "c1", 600, nil)
+	defer c.Close() // nolint: errcheck
+	s.expire(time.Now().Add(2 * time.Minute))
+	assert.Empty(t, published)
+
+	// The will is published once its delay passed, or when the session
+	// expires before that
+	for _, clientID := range []string{"c2", "c3"} {
+		expiry := uint32(600)
+		if clientID == "c3" {
+			expiry = 30
+		}
+		c, _ := connect5(t, addr, clientID, expiry, packet.Uint32(60))
+		require.NoError(t, c.Close())
+		<-waitOffline(s, clientID)
+		s.expire(time.Now().Add(10 * time.Second))
+		assert.Empty(t, published)
+		s.expire(time.Now().Add(time.Minute + time.Second))
+		require.Len(t, published, 1)
+		assert.Equal(t, "status/"+clientID, (<-published).VariableHeader.Topic)
+	}
+}
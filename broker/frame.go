@@ -0,0 +1,153 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// maxFrameBuffer limits the encoding buffers kept by pooled frames
+const maxFrameBuffer = 64 << 10
+
+// frame is a QoS 0 message that is encoded once for all the subscribers
+// it is routed to, instead of once per subscriber. It is only used where
+// the message is the same for every one of them, see Server.route.
+//
+// Frames and their buffers are pooled. refs counts the route building
+// the frame and the writers it is queued with; the last one to release
+// it returns it to the pool. A frame that is dropped from a queue is
+// never released and left to the garbage collector.
+type frame struct {
+	packet.PublishControlPacket
+	props packet.Properties
+
+	refs atomic.Int32
+
+	mu      sync.Mutex
+	encoded bool
+	buf     []byte
+	err     error
+}
+
+var framePool = sync.Pool{New: func() any { return new(frame) }}
+
+// newFrame returns a frame of p as routed with QoS 0, for clients of
+// version v5 or MQTT 3.1.1, translated by t. It holds a reference for the
+// caller.
+func newFrame(p *packet.PublishControlPacket, v5 bool, t *Translation) *frame {
+	f := framePool.Get().(*frame)
+	f.PublishControlPacket = *p
+	f.FixedHeaderFlags = packet.PublishHeaderFlags{QoS: packet.QoSLevelNone}
+	f.VariableHeader.PacketID = 0
+	f.VariableHeader.Properties = nil
+	if v5 {
+		if props := p.VariableHeader.Properties; props != nil {
+			f.props = *props
+		} else {
+			t.synthesize(&f.props, p.Payload)
+		}
+		f.VariableHeader.Properties = &f.props
+	}
+	f.refs.Store(1)
+	return f
+}
+
+// Encode returns the encoding shared by the writers of all subscribers.
+// The bytes must not be modified, and not be used after releasing f.
+func (f *frame) Encode() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.encoded {
+		// AppendEncode updates the fixed header, the packet itself is
+		// shared
+		cp := f.PublishControlPacket
+		f.buf, f.err = cp.AppendEncode(f.buf[:0])
+		f.encoded = true
+	}
+	return f.buf, f.err
+}
+
+// retain adds a reference to f
+func (f *frame) retain() {
+	f.refs.Add(1)
+}
+
+// release drops a reference to f, returning it to the pool with the last
+// one
+func (f *frame) release() {
+	if f.refs.Add(-1) != 0 {
+		return
+	}
+	f.PublishControlPacket = packet.PublishControlPacket{}
+	f.props = packet.Properties{}
+	f.encoded, f.err = false, nil
+	if cap(f.buf) > maxFrameBuffer {
+		f.buf = nil
+	}
+	framePool.Put(f)
+}
+
+// frames builds the frames of a message as the subscribers need them, one
+// per protocol version
+type frames struct {
+	translation *Translation
+	v3, v5      *frame
+}
+
+// get returns the frame of p for clients of version v5 or MQTT 3.1.1
+func (fs *frames) get(p *packet.PublishControlPacket, v5 bool) *frame {
+	f := &fs.v3
+	if v5 {
+		f = &fs.v5
+	}
+	if *f == nil {
+		*f = newFrame(p, v5, fs.translation)
+	}
+	return *f
+}
+
+// release drops the references of the builder
+func (fs *frames) release() {
+	if fs.v3 != nil {
+		fs.v3.release()
+	}
+	if fs.v5 != nil {
+		fs.v5.release()
+	}
+}
+
+// sharesFrames reports whether the QoS 0 messages to c can be frames:
+// there is no OnDeliver hook or Translation.Intercept that may change
+// them, and no topic alias is picked for c alone
+func (c *Conn) sharesFrames() bool {
+	return len(c.server.Hooks) == 0 && c.server.Translation.Intercept == nil && c.aliases == nil && c.tenant == ""
+}
+
+// publishOf returns the message p stands for, if any
+func publishOf(p packet.ControlPacket) (*packet.PublishControlPacket, bool) {
+	switch p := p.(type) {
+	case *packet.PublishControlPacket:
+		return p, true
+	case *frame:
+		return &p.PublishControlPacket, true
+	}
+	return nil, false
+}
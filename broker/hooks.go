@@ -0,0 +1,124 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"time"
+
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// Hook is notified of the events of a Server and can change or reject
+// the packets of clients, e.g. to audit, rate limit or transform
+// messages. Hooks run on the goroutine of the connection, in the order
+// of Server.Hooks, and must not block.
+type Hook interface {
+	// OnConnect is called after the client was authenticated, before
+	// CONNACK is sent. An error refuses the client like Authenticate.
+	OnConnect(c *Conn) error
+	// OnDisconnect is called when the connection of an accepted client
+	// ended. graceful reports whether the client sent DISCONNECT.
+	OnDisconnect(c *Conn, graceful bool)
+	// OnPublish is called with every PUBLISH the client is authorized
+	// for, before it is retained and passed to the Handler. It may
+	// modify p. An error drops the message; it is still acknowledged,
+	// on MQTT 5 with reason code 0x87 for ErrNotAuthorized and 0x83
+	// otherwise.
+	OnPublish(c *Conn, p *packet.PublishControlPacket) error
+	// OnSubscribe is called with every SUBSCRIBE of the client, before
+	// the subscriptions are made. It may modify the subscriptions of p.
+	// An error refuses all of them.
+	OnSubscribe(c *Conn, p *packet.SubscribeControlPacket) error
+	// OnUnsubscribe is called with every UNSUBSCRIBE of the client,
+	// after the subscriptions were removed
+	OnUnsubscribe(c *Conn, p *packet.UnsubscribeControlPacket)
+	// OnDeliver is called with every message sent to the client through
+	// Conn.Publish. It may modify p, an error drops the message.
+	OnDeliver(c *Conn, p *packet.PublishControlPacket) error
+	// OnSessionExpired is called when the persistent session of
+	// clientID was discarded
+	OnSessionExpired(clientID string)
+	// OnPause is called when the broker stops reading from the client
+	// because the queues of its subscribers are saturated, see
+	// Server.PauseThreshold
+	OnPause(c *Conn)
+	// OnResume is called when the broker reads from the client again,
+	// with how long it was paused
+	OnResume(c *Conn, paused time.Duration)
+}
+
+// NopHook implements Hook without doing anything. Embed it to implement
+// only some of the methods.
+type NopHook struct{}
+
+func (NopHook) OnConnect(*Conn) error                                   { return nil }
+func (NopHook) OnDisconnect(*Conn, bool)                                {}
+func (NopHook) OnPublish(*Conn, *packet.PublishControlPacket) error     { return nil }
+func (NopHook) OnSubscribe(*Conn, *packet.SubscribeControlPacket) error { return nil }
+func (NopHook) OnUnsubscribe(*Conn, *packet.UnsubscribeControlPacket)   {}
+func (NopHook) OnDeliver(*Conn, *packet.PublishControlPacket) error     { return nil }
+func (NopHook) OnSessionExpired(string)                                 {}
+func (NopHook) OnPause(*Conn)                                           {}
+func (NopHook) OnResume(*Conn, time.Duration)                           {}
+
+// hookReasonCode returns the reason code reporting err of a hook or the
+// Authorizer to an MQTT 5 client
+func hookReasonCode(err error) byte {
+	if err == ErrNotAuthorized {
+		return packet.ReasonCodeNotAuthorized
+	}
+	return packet.ReasonCodeImplementationSpecificError
+}
+
+// accept runs the Authorizer, the Transformers and the OnPublish hooks
+// on a PUBLISH of the client. If they let it through, it is retained,
+// passed to the Handler and routed to the subscribers, or held back if
+// it was delayed. accept returns the reason code of the acknowledgement.
+func (c *Conn) accept(p *packet.PublishControlPacket) byte {
+	if c.version != packet.ProtocolVersion5 && c.oversized(p) {
+		c.drop(p, DropTooLarge)
+		return packet.ReasonCodePacketTooLarge
+	}
+	delay, reasonCode := c.delay(p)
+	if reasonCode != packet.ReasonCodeSuccess {
+		return reasonCode
+	}
+	if !c.authorize(p.VariableHeader.Topic, ActionPublish) {
+		c.drop(p, DropNotAuthorized)
+		return packet.ReasonCodeNotAuthorized
+	}
+	if reasonCode := c.transform(p); reasonCode != packet.ReasonCodeSuccess {
+		return reasonCode
+	}
+	for _, h := range c.server.Hooks {
+		if err := h.OnPublish(c, p); err != nil {
+			c.log(logger.LevelDebug, "broker: message rejected by hook", logger.F("topic", p.VariableHeader.Topic), logger.F("error", err))
+			c.drop(p, DropRejected)
+			return hookReasonCode(err)
+		}
+	}
+	if delay > 0 {
+		c.dispatch(p)
+		return c.hold(p, delay)
+	}
+	c.retain(p)
+	c.dispatch(p)
+	c.server.route(c, p)
+	return packet.ReasonCodeSuccess
+}
@@ -0,0 +1,117 @@
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+type testHook struct {
+	NopHook
+
+	mu           sync.Mutex
+	events       []string
+	disconnected chan bool
+}
+
+func (h *testHook) record(event string) {
+	h.mu.Lock()
+	h.events = append(h.events, event)
+	h.mu.Unlock()
+}
+
+func (h *testHook) OnConnect(c *Conn) error {
+	if c.ClientID() == "banned" {
+		return ErrNotAuthorized
+	}
+	h.record("connect " + c.ClientID())
+	return nil
+}
+
+func (h *testHook) OnDisconnect(c *Conn, graceful bool) {
+	h.disconnected <- graceful
+}
+
+func (h *testHook) OnPublish(c *Conn, p *packet.PublishControlPacket) error {
+	if p.VariableHeader.Topic == "drop" {
+		return errors.New("dropped")
+	}
+	p.Payload = bytes.ToUpper(p.Payload)
+	return nil
+}
+
+func (h *testHook) OnDeliver(c *Conn, p *packet.PublishControlPacket) error {
+	p.VariableHeader.Topic = "delivered/" + p.VariableHeader.Topic
+	return nil
+}
+
+func (h *testHook) OnSessionExpired(clientID string) {
+	h.record("expired " + clientID)
+}
+
+func (h *testHook) OnPause(c *Conn) {
+	h.record("pause")
+}
+
+func (h *testHook) OnResume(c *Conn, paused time.Duration) {
+	h.record("resume")
+}
+
+func TestServerHooks(t *testing.T) {
+	hook := &testHook{disconnected: make(chan bool, 1)}
+	s, addr := newTestServer(t, HandlerFunc(func(c *Conn, p packet.ControlPacket) {
+		if publish, ok := p.(*packet.PublishControlPacket); ok {
+			assert.NoError(t, c.Publish(publish))
+		}
+	}))
+	s.Hooks = []Hook{hook}
+	defer s.Close() // nolint: errcheck
+
+	_, connack := dialAndConnect(t, addr, "banned")
+	assert.Equal(t, packet.ConnAckNotAuthorized, connack.VariableHeader.ReturnCode)
+
+	c, _ := dialAndConnect(t, addr, "c1")
+	require.NoError(t, packet.WritePacket(c, packet.NewPublish("drop", 0, []byte("x"))))
+	require.NoError(t, packet.WritePacket(c, packet.NewPublish("t", 0, []byte("hello"))))
+	p, err := packet.ReadPacket(c)
+	require.NoError(t, err)
+	require.IsType(t, &packet.PublishControlPacket{}, p)
+	assert.Equal(t, "delivered/t", p.(*packet.PublishControlPacket).VariableHeader.Topic)
+	assert.Equal(t, []byte("HELLO"), p.(*packet.PublishControlPacket).Payload)
+
+	require.NoError(t, packet.WritePacket(c, packet.NewDisconnectControlPacket()))
+	select {
+	case graceful := <-hook.disconnected:
+		assert.True(t, graceful)
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnDisconnect was not called")
+	}
+	require.NoError(t, c.Close())
+
+	// A clean session discards the persistent one
+	clean, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer clean.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(clean, &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(packet.ProtocolVersion311),
+			ConnectFlags:  packet.ConnectFlags{CleanSession: true},
+		},
+		ConnectPayload: packet.ConnectPayload{ClientID: "c1"},
+	}))
+	_, err = packet.ReadPacket(clean)
+	require.NoError(t, err)
+
+	hook.mu.Lock()
+	assert.Equal(t, []string{"connect c1", "connect c1", "expired c1"}, hook.events)
+	hook.mu.Unlock()
+}
@@ -0,0 +1,108 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"bytes"
+	"hash/maphash"
+	"runtime"
+	"sync"
+	"unsafe"
+	"weak"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// minInterned is the size from which payloads are interned. Smaller ones
+// take about as much memory as their entry would.
+const minInterned = 32
+
+// interner makes identical payloads share their memory, see
+// Server.InternPayloads. It references the payloads weakly: a payload is
+// dropped once no message uses it anymore.
+type interner struct {
+	seed maphash.Seed
+
+	mu       sync.Mutex
+	payloads map[uint64]internedPayload
+}
+
+type internedPayload struct {
+	data weak.Pointer[byte]
+	len  int
+}
+
+// intern returns the payload identical to b that was interned before, or
+// interns b. b must not be modified afterwards.
+func (in *interner) intern(b []byte) []byte {
+	if len(b) < minInterned {
+		return b
+	}
+	h := maphash.Bytes(in.seed, b)
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if e, ok := in.payloads[h]; ok {
+		if data := e.data.Value(); data != nil {
+			if interned := unsafe.Slice(data, e.len); bytes.Equal(interned, b) {
+				return interned
+			}
+		}
+	}
+	// A collision replaces the payload interned before, it is still
+	// correct but no longer shared
+	e := internedPayload{data: weak.Make(&b[0]), len: len(b)}
+	in.payloads[h] = e
+	runtime.AddCleanup(&b[0], in.drop, internedKey{h, e.data})
+	return b
+}
+
+type internedKey struct {
+	hash uint64
+	data weak.Pointer[byte]
+}
+
+// drop removes the entry of a collected payload, unless the hash was
+// taken by another payload since
+func (in *interner) drop(k internedKey) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if e, ok := in.payloads[k.hash]; ok && e.data == k.data {
+		delete(in.payloads, k.hash)
+	}
+}
+
+func (in *interner) len() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return len(in.payloads)
+}
+
+// intern returns p with its payload interned if s.InternPayloads is set.
+// p is copied rather than changed.
+func (s *Server) intern(p *packet.PublishControlPacket) *packet.PublishControlPacket {
+	if !s.InternPayloads || len(p.Payload) < minInterned {
+		return p
+	}
+	s.internOnce.Do(func() {
+		s.interned = &interner{seed: maphash.MakeSeed(), payloads: make(map[uint64]internedPayload)}
+	})
+	cp := *p
+	cp.Payload = s.interned.intern(p.Payload)
+	return &cp
+}
@@ -0,0 +1,98 @@
+package broker
+
+import (
+	"bytes"
+	"hash/maphash"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func TestInterner(t *testing.T) {
+	in := &interner{seed: maphash.MakeSeed(), payloads: make(map[uint64]internedPayload)}
+	heartbeat := []byte(`{"status":"online","uptime":12345,"rssi":-61}`)
+
+	first := in.intern(bytes.Clone(heartbeat))
+	second := in.intern(bytes.Clone(heartbeat))
+	assert.Same(t, &first[0], &second[0], "identical payloads are shared")
+	other := in.intern(bytes.ToUpper(heartbeat))
+	assert.NotSame(t, &first[0], &other[0])
+	small := []byte("on")
+	assert.Same(t, &small[0], &in.intern(small)[0], "too small to be interned")
+	assert.Equal(t, 2, in.len())
+
+	// The entries go with the last message using them
+	runtime.KeepAlive(first)
+	runtime.KeepAlive(second)
+	runtime.KeepAlive(other)
+	first, second, other = nil, nil, nil
+	deadline := time.Now().Add(5 * time.Second)
+	for in.len() > 0 && time.Now().Before(deadline) {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	assert.Zero(t, in.len())
+}
+
+func TestServerInternPayloads(t *testing.T) {
+	heartbeat := []byte(`{"status":"online","uptime":12345,"rssi":-61}`)
+	for _, enabled := range []bool{false, true} {
+		s := &Server{InternPayloads: enabled}
+		require.NoError(t, s.ImportRetained([]*packet.PublishControlPacket{
+			packet.NewPublish("devices/1/status", 0, bytes.Clone(heartbeat)),
+			packet.NewPublish("devices/2/status", 0, bytes.Clone(heartbeat)),
+		}))
+		matches, err := s.retainStore().Match("devices/+/status")
+		require.NoError(t, err)
+		require.Len(t, matches, 2)
+		assert.Equal(t, enabled, &matches[0].Payload[0] == &matches[1].Payload[0])
+	}
+}
+
+func TestServerInternOffline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{InternPayloads: true}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+	addr := l.Addr().String()
+
+	for _, id := range []string{"a", "b"} {
+		c, _ := dialAndConnect(t, addr, id) // persistent sessions
+		require.NoError(t, packet.WritePacket(c, &packet.SubscribeControlPacket{
+			VariableHeader: packet.SubscribeVariableHeader{PacketID: 1},
+			Payload: packet.SubscribePayload{
+				Subscriptions: []packet.Subscription{{Topic: "status/+", QoS: packet.QoSLevelAtLeastOnce}},
+			},
+		}))
+		_, err := packet.ReadPacket(c)
+		require.NoError(t, err)
+		require.NoError(t, c.Close())
+	}
+	require.Eventually(t, func() bool { return len(s.online.all()) == 0 }, time.Second, time.Millisecond)
+
+	heartbeat := `{"status":"online","uptime":12345,"rssi":-61}`
+	for _, name := range []string{"status/1", "status/2"} {
+		p := packet.NewPublish(name, 1, []byte(heartbeat))
+		p.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+		s.route(nil, p)
+	}
+	var payloads [][]byte
+	for _, id := range []string{"a", "b"} {
+		sess, ok := s.sessions().Get(id)
+		require.True(t, ok)
+		for _, p := range sess.Outbound.Resend() {
+			payloads = append(payloads, p.(*packet.PublishControlPacket).Payload)
+		}
+	}
+	require.Len(t, payloads, 4)
+	for _, payload := range payloads[1:] {
+		assert.Same(t, &payloads[0][0], &payload[0])
+	}
+}
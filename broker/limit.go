@@ -0,0 +1,218 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/logger"
+)
+
+var (
+	errTooManyConnections = errors.New("broker: too many connections")
+	errConnectionRate     = errors.New("broker: connection rate of source address exceeded")
+)
+
+// ipLimiterSweep is how often the buckets of addresses that stayed within
+// their limit are forgotten
+const ipLimiterSweep = time.Minute
+
+// tokenBucket allows rate events per second on average, with bursts of up
+// to burst events. It is not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket. A burst <= 0 defaults to the rate
+// rounded up, but at least 1.
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := float64(burst)
+	if burst <= 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// allow takes a token if there is one
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reserve takes a token, borrowing it if there is none, and returns how
+// long to wait until the token would have been there
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// full reports whether the bucket refilled completely, so that it is no
+// different from a new one
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// ipLimiter keeps a tokenBucket per source address
+type ipLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func (l *ipLimiter) allow(addr string, rate float64, burst int) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) > ipLimiterSweep {
+		for a, b := range l.buckets {
+			if b.full(now) {
+				delete(l.buckets, a)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[addr]
+	if !ok {
+		if l.buckets == nil {
+			l.buckets = make(map[string]*tokenBucket)
+		}
+		b = newTokenBucket(rate, burst, now)
+		l.buckets[addr] = b
+	}
+	return b.allow(now)
+}
+
+// sourceIP returns the IP address of addr without port, or addr as a
+// whole for addresses that have none
+func sourceIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// admit checks a connection that was just accepted against
+// MaxConnections and ConnectionRate
+func (s *Server) admit(c net.Conn) error {
+	t := s.tuned()
+	if t.MaxConnections > 0 {
+		s.mu.Lock()
+		n := len(s.conns)
+		s.mu.Unlock()
+		if n >= t.MaxConnections {
+			return errTooManyConnections
+		}
+	}
+	if t.ConnectionRate > 0 && !s.connRate.allow(sourceIP(c.RemoteAddr()), t.ConnectionRate, t.ConnectionBurst) {
+		return errConnectionRate
+	}
+	return nil
+}
+
+// pause stops reading from the client until the writers of the
+// subscribers in its backlog took their queues, or for Server.MaxPause
+// at most. It returns false if the connection was closed in the
+// meantime.
+func (c *Conn) pause() bool {
+	if len(c.backlog) == 0 {
+		return true
+	}
+	start := time.Now()
+	c.log(logger.LevelDebug, "broker: subscribers are saturated, pausing client")
+	for _, h := range c.server.Hooks {
+		h.OnPause(c)
+	}
+	if m := c.server.Metrics; m != nil {
+		m.Paused()
+	}
+
+	timer := time.NewTimer(c.server.maxPause())
+	defer timer.Stop()
+	closed := false
+wait:
+	for _, drained := range c.backlog {
+		select {
+		case <-drained:
+		case <-timer.C:
+			break wait
+		case <-c.ctx.Done():
+			closed = true
+			break wait
+		}
+	}
+	clear(c.backlog)
+	c.backlog = c.backlog[:0]
+
+	paused := time.Since(start)
+	c.log(logger.LevelDebug, "broker: resuming client", logger.F("paused", paused))
+	for _, h := range c.server.Hooks {
+		h.OnResume(c, paused)
+	}
+	if m := c.server.Metrics; m != nil {
+		m.Resumed(paused)
+	}
+	return !closed
+}
+
+// throttle waits until the client is within MessageRate again. It returns
+// false if the connection was closed in the meantime.
+func (c *Conn) throttle() bool {
+	if c.msgRate == nil {
+		return true
+	}
+	d := c.msgRate.reserve(time.Now())
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
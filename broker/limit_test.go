@@ -0,0 +1,171 @@
+package broker
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/transport"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newTokenBucket(2, 3, now)
+	for i := 0; i < 3; i++ {
+		assert.True(t, b.allow(now), "burst")
+	}
+	assert.False(t, b.allow(now))
+	assert.False(t, b.full(now))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, b.allow(now), "refilled at the rate")
+	assert.False(t, b.allow(now))
+
+	assert.Equal(t, 500*time.Millisecond, b.reserve(now))
+	assert.Equal(t, time.Second, b.reserve(now), "tokens are borrowed in order")
+
+	assert.True(t, b.full(now.Add(3*time.Second)))
+	assert.Equal(t, 1.0, newTokenBucket(0.5, 0, now).burst)
+}
+
+// rejected reports whether the server closed c without answering its
+// CONNECT
+func rejected(t *testing.T, addr string) bool {
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(c, &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{ProtocolName: "MQTT", ProtocolLevel: byte(packet.ProtocolVersion311)},
+		ConnectPayload: packet.ConnectPayload{ClientID: "c"},
+	}))
+	_, err = packet.ReadPacket(c)
+	return err != nil
+}
+
+func TestServerMaxConnections(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{MaxConnections: 1}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	c, _ := dialAndConnect(t, l.Addr().String(), "first")
+	assert.True(t, rejected(t, l.Addr().String()))
+
+	require.NoError(t, c.Close())
+	assert.Eventually(t, func() bool {
+		return !rejected(t, l.Addr().String())
+	}, time.Second, 10*time.Millisecond, "room again once the first one left")
+}
+
+func TestServerConnectionRate(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{ConnectionRate: 0.01, ConnectionBurst: 2}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	assert.False(t, rejected(t, l.Addr().String()))
+	assert.False(t, rejected(t, l.Addr().String()))
+	assert.True(t, rejected(t, l.Addr().String()), "burst used up")
+}
+
+func TestServerMessageRate(t *testing.T) {
+	received := make(chan time.Time, 10)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{
+		MessageRate: 20,
+		Handler:     HandlerFunc(func(c *Conn, p packet.ControlPacket) { received <- time.Now() }),
+	}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	c, _ := dialAndConnect(t, l.Addr().String(), "c")
+	defer c.Close() // nolint: errcheck
+	start := time.Now()
+	for i := 0; i < 25; i++ {
+		require.NoError(t, packet.WritePacket(c, packet.NewPublish("a", 0, nil)))
+	}
+	var last time.Time
+	for i := 0; i < 25; i++ {
+		last = <-received
+	}
+	// 20 messages of burst, the other 5 at 20 per second
+	assert.True(t, last.Sub(start) >= 200*time.Millisecond, "messages were not throttled: %v", last.Sub(start))
+}
+
+func TestConnPause(t *testing.T) {
+	hook := &testHook{}
+	s := &Server{PauseThreshold: 2, MaxPause: 50 * time.Millisecond, Hooks: []Hook{hook}}
+	server, client := net.Pipe()
+	defer client.Close() // nolint: errcheck
+	sub := newConn(s, server)
+	pub := newConn(s, nil)
+
+	require.NoError(t, sub.WritePacket(packet.NewPublish("a", 0, nil)))
+	assert.Nil(t, sub.saturated(s.PauseThreshold))
+	require.NoError(t, sub.WritePacket(packet.NewPublish("a", 0, nil)))
+	drained := sub.saturated(s.PauseThreshold)
+	require.NotNil(t, drained)
+
+	// Nobody takes the queue, the pause ends after MaxPause
+	pub.backlog = append(pub.backlog, drained)
+	start := time.Now()
+	assert.True(t, pub.pause())
+	assert.GreaterOrEqual(t, time.Since(start), s.MaxPause)
+	assert.Empty(t, pub.backlog)
+
+	s.MaxPause = time.Minute
+	pub.backlog = append(pub.backlog, sub.saturated(s.PauseThreshold))
+	paused := make(chan bool)
+	go func() { paused <- pub.pause() }()
+	select {
+	case <-paused:
+		t.Fatal("pause ended before the queue was taken")
+	case <-time.After(20 * time.Millisecond):
+	}
+	go sub.writeLoop()
+	go io.Copy(io.Discard, client) // nolint: errcheck
+	select {
+	case ok := <-paused:
+		assert.True(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("pause did not end when the queue was taken")
+	}
+	assert.Equal(t, []string{"pause", "resume", "pause", "resume"}, hook.events)
+}
+
+func TestServerTune(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{MaxConnections: 1, OutboundQueueSize: 10}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	tuning := s.Tuning()
+	assert.Equal(t, 1, tuning.MaxConnections)
+	assert.Equal(t, 10, tuning.OutboundQueueSize)
+
+	c, _ := dialAndConnect(t, l.Addr().String(), "first")
+	defer c.Close() // nolint: errcheck
+	assert.True(t, rejected(t, l.Addr().String()))
+
+	tuning.MaxConnections = 2
+	require.NoError(t, s.Tune(tuning))
+	assert.False(t, rejected(t, l.Addr().String()), "raised right away")
+	assert.Equal(t, 1, s.MaxConnections, "the field keeps the configured value")
+	assert.Equal(t, 10, s.outboundQueueSize())
+
+	tuning.MessageBurst = -1
+	assert.Error(t, s.Tune(tuning))
+	tuning.MessageBurst = 0
+	tuning.Flush.Strategy = transport.FlushSized + 1
+	assert.Error(t, s.Tune(tuning))
+	assert.Equal(t, 2, s.Tuning().MaxConnections)
+}
@@ -0,0 +1,62 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"errors"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// Metrics receives measurements from a Server. It is called from the
+// goroutines of all connections and must be safe for concurrent use. The
+// metrics package implements it with Prometheus collectors.
+type Metrics interface {
+	// PacketDecoded is called for every packet read from a client
+	PacketDecoded(p packet.ControlPacket)
+	// DecodeError is called for a packet that violated the protocol
+	DecodeError(err error)
+	// Connected is called when a client was accepted, with the time it
+	// took from accepting the network connection until CONNACK
+	Connected(latency time.Duration)
+	// Inflight is called whenever a QoS 1 or 2 message was queued for a
+	// client, with the number of its messages that are in flight or
+	// waiting for the in-flight window
+	Inflight(depth int)
+	// BytesReceived and BytesSent are called for the traffic of every
+	// connection
+	BytesReceived(n int)
+	BytesSent(n int)
+	// Paused is called when the broker stops reading from a client for
+	// Server.PauseThreshold, Resumed when it reads from it again, with
+	// how long the client was paused
+	Paused()
+	Resumed(paused time.Duration)
+	// Runtime is called every Server.RuntimeStatsInterval with a sample
+	// of the Go runtime and the queues of the broker
+	Runtime(stats RuntimeStats)
+}
+
+// isDecodeError reports whether err is a protocol violation, as opposed
+// to a network error
+func isDecodeError(err error) bool {
+	var pe *packet.Error
+	var ce *packet.ConnectError
+	return errors.As(err, &pe) || errors.As(err, &ce)
+}
@@ -0,0 +1,96 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"hash/maphash"
+	"runtime"
+	"sync"
+)
+
+// onlineConns are the clients messages can be routed to, by session
+// identifier. The table is split into shards by identifier, each with a
+// lock of its own, so that publishers routing to different subscribers
+// don't contend on the lock of the server.
+type onlineConns struct {
+	once   sync.Once
+	seed   maphash.Seed
+	shards []onlineShard
+}
+
+// onlineShard is a part of the table, guarded by mu. mu is held as well
+// while a message is queued for an offline session of the shard, and
+// while a client of the shard retransmits before going online, so that
+// the message is neither retransmitted twice nor lost in between.
+type onlineShard struct {
+	mu    sync.Mutex
+	conns map[string]*Conn
+}
+
+// shard returns the shard of the session id
+func (o *onlineConns) shard(id string) *onlineShard {
+	o.once.Do(func() {
+		o.seed = maphash.MakeSeed()
+		o.shards = make([]onlineShard, runtime.GOMAXPROCS(0))
+		for i := range o.shards {
+			o.shards[i].conns = make(map[string]*Conn)
+		}
+	})
+	return &o.shards[maphash.String(o.seed, id)%uint64(len(o.shards))]
+}
+
+// get returns the client of the session id, or nil if it is offline
+func (o *onlineConns) get(id string) *Conn {
+	sh := o.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.conns[id]
+}
+
+// add makes c the client of its session
+func (o *onlineConns) add(c *Conn) {
+	sh := o.shard(c.sessionID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.conns[c.sessionID] = c
+}
+
+// remove removes c, unless another client of its session replaced it
+func (o *onlineConns) remove(c *Conn) {
+	sh := o.shard(c.sessionID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.conns[c.sessionID] == c {
+		delete(sh.conns, c.sessionID)
+	}
+}
+
+// all returns the clients of every session
+func (o *onlineConns) all() []*Conn {
+	o.shard("")
+	var conns []*Conn
+	for i := range o.shards {
+		sh := &o.shards[i]
+		sh.mu.Lock()
+		for _, c := range sh.conns {
+			conns = append(conns, c)
+		}
+		sh.mu.Unlock()
+	}
+	return conns
+}
@@ -0,0 +1,68 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"strconv"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/topic"
+)
+
+// PriorityFunc returns the priority of a message sent to the client of
+// c, see Server.Priority. It must not block.
+type PriorityFunc func(c *Conn, p *packet.PublishControlPacket) int
+
+// UserPropertyPriority returns a PriorityFunc reading the priority from
+// the MQTT 5 user property name, an integer. Messages without it or with
+// an invalid value get priority 0.
+func UserPropertyPriority(name string) PriorityFunc {
+	return func(c *Conn, p *packet.PublishControlPacket) int {
+		props := p.VariableHeader.Properties
+		if props == nil {
+			return 0
+		}
+		for _, up := range props.UserProperties {
+			if up.Key == name {
+				priority, _ := strconv.Atoi(up.Value)
+				return priority
+			}
+		}
+		return 0
+	}
+}
+
+// TopicPriority assigns Priority to the messages whose topic matches
+// Filter
+type TopicPriority struct {
+	Filter   string
+	Priority int
+}
+
+// TopicPriorities returns a PriorityFunc that assigns the priority of the
+// first rule matching the topic of a message, or 0 if none does
+func TopicPriorities(rules ...TopicPriority) PriorityFunc {
+	return func(c *Conn, p *packet.PublishControlPacket) int {
+		for _, r := range rules {
+			if topic.Matches(r.Filter, p.VariableHeader.Topic) {
+				return r.Priority
+			}
+		}
+		return 0
+	}
+}
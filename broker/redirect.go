@@ -0,0 +1,71 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"errors"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// Redirect refuses a client to send it to another server, e.g. the one
+// its tenant is served by. Returned by the Authenticator, Tenant or an
+// OnConnect hook, it refuses MQTT 5 clients with reason code Use another
+// server, or Server moved if Moved, and the Server Reference property.
+// MQTT 3.1.1 clients cannot be told and are refused as the server being
+// unavailable.
+type Redirect struct {
+	// ServerReference is the server to use instead, e.g.
+	// "mqtt-2.example.com:1883"
+	ServerReference string
+	// Moved tells the client to use ServerReference from now on
+	Moved bool
+}
+
+func (r *Redirect) Error() string {
+	if r.Moved {
+		return "broker: server moved to " + r.ServerReference
+	}
+	return "broker: use another server, " + r.ServerReference
+}
+
+// refuseWith refuses the CONNECT of c for an error of the Authenticator,
+// Tenant or a hook
+func (c *Conn) refuseWith(err error) {
+	var r *Redirect
+	if !errors.As(err, &r) {
+		c.refuse(authReturnCode(err))
+		return
+	}
+	code := packet.ReasonCodeUseAnotherServer
+	if r.Moved {
+		code = packet.ReasonCodeServerMoved
+	}
+	c.redirect(code, r.ServerReference)
+}
+
+// redirect refuses the CONNECT of c, telling MQTT 5 clients to go to
+// reference with reasonCode
+func (c *Conn) redirect(reasonCode byte, reference string) {
+	connack := packet.NewConnAck(packet.ConnAckServerUnavailable, false)
+	if c.version == packet.ProtocolVersion5 {
+		connack.VariableHeader.ReturnCode = reasonCode
+		connack.VariableHeader.Properties = &packet.Properties{ServerReference: reference}
+	}
+	_ = c.WritePacket(connack)
+}
@@ -0,0 +1,57 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func TestServerRedirect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{Authenticator: AuthenticatorFunc(func(c *Conn) error {
+		r := &Redirect{ServerReference: "mqtt-2:1883", Moved: c.ClientID() == "moved"}
+		return fmt.Errorf("tenant elsewhere: %w", r)
+	})}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	for _, tc := range []struct {
+		clientID  string
+		version   packet.ProtocolVersion
+		code      byte
+		reference string
+	}{
+		{"c", packet.ProtocolVersion5, packet.ReasonCodeUseAnotherServer, "mqtt-2:1883"},
+		{"moved", packet.ProtocolVersion5, packet.ReasonCodeServerMoved, "mqtt-2:1883"},
+		{"c", packet.ProtocolVersion311, packet.ConnAckServerUnavailable, ""},
+	} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		connect := &packet.ConnectControlPacket{
+			VariableHeader: packet.ConnectVariableHeader{ProtocolName: "MQTT", ProtocolLevel: byte(tc.version)},
+			ConnectPayload: packet.ConnectPayload{ClientID: tc.clientID},
+		}
+		if tc.version == packet.ProtocolVersion5 {
+			connect.VariableHeader.Properties = &packet.Properties{}
+		}
+		require.NoError(t, packet.WritePacket(c, connect))
+
+		p, err := packet.ReadPacketVersion(c, tc.version)
+		require.NoError(t, err)
+		require.IsType(t, &packet.ConnAckControlPacket{}, p)
+		connack := p.(*packet.ConnAckControlPacket)
+		assert.Equal(t, tc.code, connack.VariableHeader.ReturnCode, tc.clientID)
+		if tc.reference != "" {
+			assert.Equal(t, tc.reference, connack.VariableHeader.Properties.ServerReference)
+		}
+		_, err = packet.ReadPacket(c)
+		assert.Error(t, err, "refused connection must be closed")
+		_ = c.Close()
+	}
+}
@@ -0,0 +1,172 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/topic"
+)
+
+// RetainStore keeps the last retained message of every topic. Backends
+// must be safe for concurrent use.
+type RetainStore interface {
+	// Retain stores p as the retained message of its topic. A message
+	// with an empty payload deletes the retained message instead
+	// [MQTT-3.3.1-10].
+	Retain(p *packet.PublishControlPacket) error
+	// Match returns the retained messages whose topic matches filter
+	Match(filter string) ([]*packet.PublishControlPacket, error)
+}
+
+// BulkRetainStore is a RetainStore that stores many messages at once,
+// with a single write or transaction
+type BulkRetainStore interface {
+	RetainStore
+	// RetainAll is Retain for every message of ps, in order
+	RetainAll(ps []*packet.PublishControlPacket) error
+}
+
+// RetainStats are the size of a store's retained messages. Like the
+// matches of #, they leave out the topics starting with $.
+type RetainStats struct {
+	Messages int
+	// Bytes are the lengths of the topics and payloads
+	Bytes int64
+}
+
+// CountingRetainStore is a RetainStore that keeps count of its messages,
+// so that they need not be matched to report their number
+type CountingRetainStore interface {
+	RetainStore
+	Stats() RetainStats
+}
+
+// MemoryRetainStore is a RetainStore that keeps the messages in memory
+type MemoryRetainStore struct {
+	mu       sync.RWMutex
+	messages map[string]*packet.PublishControlPacket
+	stats    RetainStats
+}
+
+// NewMemoryRetainStore returns an empty MemoryRetainStore
+func NewMemoryRetainStore() *MemoryRetainStore {
+	return &MemoryRetainStore{messages: make(map[string]*packet.PublishControlPacket)}
+}
+
+func (s *MemoryRetainStore) Retain(p *packet.PublishControlPacket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retain(p)
+	return nil
+}
+
+// RetainAll stores ps holding the lock once
+func (s *MemoryRetainStore) RetainAll(ps []*packet.PublishControlPacket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range ps {
+		s.retain(p)
+	}
+	return nil
+}
+
+func (s *MemoryRetainStore) retain(p *packet.PublishControlPacket) {
+	name := p.VariableHeader.Topic
+	if old, ok := s.messages[name]; ok {
+		s.count(old, -1)
+	}
+	if len(p.Payload) == 0 {
+		delete(s.messages, name)
+		return
+	}
+	s.messages[name] = p
+	s.count(p, 1)
+}
+
+func (s *MemoryRetainStore) count(p *packet.PublishControlPacket, sign int) {
+	name := p.VariableHeader.Topic
+	if strings.HasPrefix(name, "$") {
+		return
+	}
+	s.stats.Messages += sign
+	s.stats.Bytes += int64(sign * (len(name) + len(p.Payload)))
+}
+
+// Stats returns the number and size of the messages
+func (s *MemoryRetainStore) Stats() RetainStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.stats
+}
+
+// Match returns the matching messages sorted by topic
+func (s *MemoryRetainStore) Match(filter string) ([]*packet.PublishControlPacket, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !strings.ContainsAny(filter, "+#") {
+		if p, ok := s.messages[filter]; ok {
+			return []*packet.PublishControlPacket{p}, nil
+		}
+		return nil, nil
+	}
+	var matches []*packet.PublishControlPacket
+	for name, p := range s.messages {
+		if topic.Matches(filter, name) {
+			matches = append(matches, p)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].VariableHeader.Topic < matches[j].VariableHeader.Topic
+	})
+	return matches, nil
+}
+
+// ImportRetained loads ps into the RetainStore as retained messages,
+// replacing those of the same topics, for example to seed a new broker.
+// The messages are not delivered to the current subscribers. Stores that
+// implement BulkRetainStore store them at once.
+func (s *Server) ImportRetained(ps []*packet.PublishControlPacket) error {
+	retained := make([]*packet.PublishControlPacket, len(ps))
+	for i, p := range ps {
+		if err := packet.ValidateTopicName(p.VariableHeader.Topic); err != nil {
+			return fmt.Errorf("broker: cannot import retained message: %w", err)
+		}
+		cp := *s.intern(p)
+		cp.FixedHeaderFlags.Retain = true
+		cp.FixedHeaderFlags.Dup = false
+		cp.VariableHeader.PacketID = 0
+		retained[i] = &cp
+	}
+
+	store := s.retainStore()
+	if bulk, ok := store.(BulkRetainStore); ok {
+		return bulk.RetainAll(retained)
+	}
+	for _, p := range retained {
+		if err := store.Retain(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
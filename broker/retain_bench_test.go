@@ -0,0 +1,79 @@
+package broker
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// At the default scale the benchmarks take a while and about 1 GiB of
+// memory, -retained makes them smaller
+var retainedScale = flag.Int("retained", 1_000_000, "number of retained topics of the benchmarks")
+
+// retainedTopics returns n retained messages spread like the state of
+// devices: home/<home>/<room>/<device>
+func retainedTopics(n int) []*packet.PublishControlPacket {
+	ps := make([]*packet.PublishControlPacket, n)
+	payload := []byte(`{"state":"on","brightness":80}`)
+	for i := range ps {
+		ps[i] = retained(fmt.Sprintf("home/%d/room%d/device%d", i/100, i/10%10, i%10), "")
+		ps[i].Payload = payload
+	}
+	return ps
+}
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapInuse
+}
+
+// BenchmarkRetainedImport loads the retained topics into an empty store
+// and reports the memory they take
+func BenchmarkRetainedImport(b *testing.B) {
+	ps := retainedTopics(*retainedScale)
+	s := &Server{}
+	var perMessage float64
+	for b.Loop() {
+		b.StopTimer()
+		s.RetainStore = nil
+		before := heapInUse()
+		b.StartTimer()
+
+		if err := s.ImportRetained(ps); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		perMessage = float64(heapInUse()-before) / float64(len(ps))
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(ps)), "ns/message")
+	b.ReportMetric(perMessage, "heap-B/message")
+}
+
+// BenchmarkRetainedMatch matches filters of a subscribing device, a room,
+// a home and everything against the retained topics
+func BenchmarkRetainedMatch(b *testing.B) {
+	store := NewMemoryRetainStore()
+	if err := store.RetainAll(retainedTopics(*retainedScale)); err != nil {
+		b.Fatal(err)
+	}
+	for _, filter := range []string{"home/0/room1/device2", "home/0/room1/+", "home/0/#", "home/+/room1/device2", "#"} {
+		b.Run(filter, func(b *testing.B) {
+			matches := 0
+			for b.Loop() {
+				m, err := store.Match(filter)
+				if err != nil {
+					b.Fatal(err)
+				}
+				matches = len(m)
+			}
+			b.ReportMetric(float64(matches), "matches")
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func retained(topic, payload string) *packet.PublishControlPacket {
+	p := packet.NewPublish(topic, 0, []byte(payload))
+	p.FixedHeaderFlags.Retain = true
+	return p
+}
+
+func TestMemoryRetainStore(t *testing.T) {
+	s := NewMemoryRetainStore()
+	require.NoError(t, s.Retain(retained("a/b", "1")))
+	require.NoError(t, s.Retain(retained("a/c", "2")))
+	require.NoError(t, s.Retain(retained("a/b", "3")))
+	require.NoError(t, s.Retain(retained("$SYS/x", "4")))
+
+	matches, err := s.Match("a/+")
+	require.NoError(t, err)
+	require.Len(t, matches, 2)
+	assert.Equal(t, []byte("3"), matches[0].Payload, "last message per topic wins")
+	assert.Equal(t, []byte("2"), matches[1].Payload)
+
+	matches, err = s.Match("#")
+	require.NoError(t, err)
+	assert.Len(t, matches, 2)
+
+	require.NoError(t, s.Retain(retained("a/b", "")))
+	matches, err = s.Match("a/b")
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+	assert.Equal(t, RetainStats{Messages: 1, Bytes: 4}, s.Stats(), "only a/c, $SYS/x is left out")
+
+	require.NoError(t, s.RetainAll([]*packet.PublishControlPacket{
+		retained("b", "12"), retained("a/c", "345"), retained("b", ""), retained("c", "6"),
+	}))
+	matches, err = s.Match("#")
+	require.NoError(t, err)
+	require.Len(t, matches, 2)
+	assert.Equal(t, []byte("345"), matches[0].Payload)
+	assert.Equal(t, "c", matches[1].VariableHeader.Topic)
+	assert.Equal(t, RetainStats{Messages: 2, Bytes: 8}, s.Stats())
+}
+
+func TestServerImportRetained(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	defer s.Close() // nolint: errcheck
+
+	assert.ErrorIs(t, s.ImportRetained([]*packet.PublishControlPacket{
+		packet.NewPublish("a/#", 0, []byte("1")),
+	}), packet.ErrInvalidTopicName)
+
+	p := packet.NewPublish("sensors/1", 7, []byte("21"))
+	p.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+	require.NoError(t, s.ImportRetained([]*packet.PublishControlPacket{p, packet.NewPublish("sensors/2", 0, []byte("22"))}))
+	assert.False(t, p.FixedHeaderFlags.Retain, "the messages are copied")
+
+	subscriber, _ := dialAndConnect(t, addr, "subscriber")
+	defer subscriber.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(subscriber, &packet.SubscribeControlPacket{
+		VariableHeader: packet.SubscribeVariableHeader{PacketID: 1},
+		Payload: packet.SubscribePayload{
+			Subscriptions: []packet.Subscription{{Topic: "sensors/+", QoS: packet.QoSLevelNone}},
+		},
+	}))
+	resp, err := packet.ReadPacket(subscriber)
+	require.NoError(t, err)
+	require.IsType(t, &packet.SubAckControlPacket{}, resp)
+	for _, payload := range []string{"21", "22"} {
+		resp, err = packet.ReadPacket(subscriber)
+		require.NoError(t, err)
+		require.IsType(t, &packet.PublishControlPacket{}, resp)
+		msg := resp.(*packet.PublishControlPacket)
+		assert.True(t, msg.FixedHeaderFlags.Retain)
+		assert.Equal(t, []byte(payload), msg.Payload)
+	}
+}
+
+func TestServerRetained(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	defer s.Close() // nolint: errcheck
+
+	publisher, _ := dialAndConnect(t, addr, "publisher")
+	defer publisher.Close() // nolint: errcheck
+	p := retained("sensors/1", "21")
+	p.FixedHeaderFlags.QoS = packet.QoSLevelExactlyOnce
+	p.VariableHeader.PacketID = 1
+	require.NoError(t, packet.WritePacket(publisher, p))
+	_, err := packet.ReadPacket(publisher) // PUBREC, the message is stored by now
+	require.NoError(t, err)
+
+	subscriber, _ := dialAndConnect(t, addr, "subscriber")
+	defer subscriber.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(subscriber, &packet.SubscribeControlPacket{
+		VariableHeader: packet.SubscribeVariableHeader{PacketID: 1},
+		Payload: packet.SubscribePayload{
+			Subscriptions: []packet.Subscription{{Topic: "sensors/+", QoS: packet.QoSLevelAtLeastOnce}},
+		},
+	}))
+
+	resp, err := packet.ReadPacket(subscriber)
+	require.NoError(t, err)
+	require.IsType(t, &packet.SubAckControlPacket{}, resp)
+	resp, err = packet.ReadPacket(subscriber)
+	require.NoError(t, err)
+	require.IsType(t, &packet.PublishControlPacket{}, resp)
+	msg := resp.(*packet.PublishControlPacket)
+	assert.True(t, msg.FixedHeaderFlags.Retain)
+	assert.Equal(t, packet.QoSLevelAtLeastOnce, msg.FixedHeaderFlags.QoS, "QoS is limited to the granted one")
+	assert.Equal(t, []byte("21"), msg.Payload)
+}
@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+	"github.com/infinimesh/mqtt-go/transport"
+)
+
+// BenchmarkRouteParallel routes the messages of parallel publishers to
+// devices subscribed to topics of their own, like commands sent to a
+// fleet. Run it with -cpu 1,2,4,8 to see how routing scales.
+func BenchmarkRouteParallel(b *testing.B) {
+	const devices = 1024
+	s := &Server{Sessions: session.NewManager()}
+	conns := make([]*Conn, devices)
+	ps := make([]*packet.PublishControlPacket, devices)
+	for i := range conns {
+		id := fmt.Sprintf("device%d", i)
+		c := newConn(s, nil)
+		c.clientID, c.sessionID, c.version = id, id, packet.ProtocolVersion311
+		var err error
+		if c.session, _, err = s.Sessions.Open(id, true); err != nil {
+			b.Fatal(err)
+		}
+		s.online.add(c)
+		s.tree().Subscribe(id, "devices/"+id+"/commands", packet.QoSLevelNone)
+		conns[i] = c
+		ps[i] = packet.NewPublish("devices/"+id+"/commands", 0, []byte(`{"command":"reboot"}`))
+	}
+
+	var publishers atomic.Uint64
+	b.RunParallel(func(pb *testing.PB) {
+		w := transport.NewFlushWriter(io.Discard, transport.FlushConfig{})
+		var scratch []byte
+		// Publishers start apart, so that they mostly route to different
+		// devices
+		i := publishers.Add(1) * 97
+		for pb.Next() {
+			i++
+			s.route(nil, ps[i%devices])
+			// Written like the writeLoop of the device would
+			c := conns[i%devices]
+			c.qmu.Lock()
+			for _, queued := range c.queue {
+				var err error
+				if scratch, err = c.write(w, queued, scratch); err != nil {
+					b.Error(err)
+				}
+			}
+			clear(c.queue)
+			c.queue = c.queue[:0]
+			c.qmu.Unlock()
+		}
+	})
+}
@@ -0,0 +1,100 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"runtime"
+	"time"
+)
+
+// Queues that RuntimeStats reports the depth of
+const (
+	// QueueOutbound counts the packets waiting in the outbound queues of
+	// all connected clients
+	QueueOutbound = "outbound"
+	// QueueInflight counts the QoS 1 and 2 messages of all sessions whose
+	// flow has not completed
+	QueueInflight = "inflight"
+	// QueueSession counts the messages of all sessions held back by their
+	// in-flight window
+	QueueSession = "session"
+)
+
+// maxGCPauses is how many GC pauses the runtime remembers
+const maxGCPauses = len(runtime.MemStats{}.PauseNs)
+
+// RuntimeStats is a sample of the Go runtime and the queues of a Server,
+// see Server.RuntimeStatsInterval
+type RuntimeStats struct {
+	Goroutines int
+	// HeapAlloc is the number of bytes of allocated heap objects
+	HeapAlloc   uint64
+	HeapObjects uint64
+	// GCPauses are the pauses of the collections since the previous
+	// sample, or the start of the process, at most the last 256
+	GCPauses []time.Duration
+	// Queues are the depths of the queues of the broker, by the Queue
+	// constants
+	Queues map[string]int
+}
+
+func (s *Server) runtimeLoop(quit chan struct{}) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.RuntimeStatsInterval)
+	defer ticker.Stop()
+
+	var numGC uint32
+	for {
+		select {
+		case <-ticker.C:
+			var stats RuntimeStats
+			stats, numGC = s.runtimeStats(numGC)
+			s.Metrics.Runtime(stats)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// runtimeStats samples the runtime and the queues. numGC is the number
+// of collections at the previous sample, it returns the current one.
+func (s *Server) runtimeStats(numGC uint32) (RuntimeStats, uint32) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	stats := RuntimeStats{
+		Goroutines:  runtime.NumGoroutine(),
+		HeapAlloc:   ms.HeapAlloc,
+		HeapObjects: ms.HeapObjects,
+	}
+	for n := max(numGC, ms.NumGC-min(ms.NumGC, uint32(maxGCPauses))); n < ms.NumGC; n++ {
+		stats.GCPauses = append(stats.GCPauses, time.Duration(ms.PauseNs[n%uint32(maxGCPauses)]))
+	}
+
+	conns := s.online.all()
+	stats.Queues = map[string]int{QueueOutbound: 0, QueueInflight: 0, QueueSession: 0}
+	for _, c := range conns {
+		c.qmu.Lock()
+		stats.Queues[QueueOutbound] += len(c.queue)
+		c.qmu.Unlock()
+	}
+	for _, sess := range s.sessions().All() {
+		stats.Queues[QueueInflight] += sess.Outbound.InFlight()
+		stats.Queues[QueueSession] += sess.Outbound.Queued()
+	}
+	return stats, ms.NumGC
+}
@@ -0,0 +1,662 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+	"github.com/infinimesh/mqtt-go/topic"
+	"github.com/infinimesh/mqtt-go/transport"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close
+var ErrServerClosed = errors.New("broker: Server closed")
+
+const (
+	defaultConnectTimeout = 10 * time.Second
+	defaultMaxPause       = 5 * time.Second
+)
+
+// Handler processes the packets a client sends after its CONNECT was
+// accepted. PINGREQ, DISCONNECT, SUBSCRIBE, UNSUBSCRIBE and the
+// acknowledgements of the QoS 1 and 2 flows are handled by the Server
+// itself, which also routes every PUBLISH to the subscribers and
+// acknowledges it after ServeMQTT returned.
+// A retransmitted QoS 2 PUBLISH is acknowledged without calling ServeMQTT
+// again.
+type Handler interface {
+	ServeMQTT(c *Conn, p packet.ControlPacket)
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface
+type HandlerFunc func(c *Conn, p packet.ControlPacket)
+
+func (f HandlerFunc) ServeMQTT(c *Conn, p packet.ControlPacket) {
+	f(c, p)
+}
+
+// Server accepts MQTT connections and runs one read loop per client. The
+// zero value is usable; set the fields before calling Serve.
+type Server struct {
+	// Addr is the TCP address ListenAndServe listens on, ":1883" if empty
+	Addr string
+	// Handler receives the packets of all connections. May be nil.
+	Handler Handler
+	// ConnectTimeout limits how long a new connection may take to send
+	// its CONNECT packet. Defaults to 10 seconds.
+	ConnectTimeout time.Duration
+	// Logger receives the log entries of the server and its connections.
+	// If nil, entries of level Warn and above are written to ErrorLog, or
+	// to the standard logger if that is nil as well.
+	Logger logger.Logger
+	// ErrorLog is used if Logger is nil
+	ErrorLog *log.Logger
+	// Authenticator checks the credentials of new connections. Every
+	// client is accepted if nil.
+	Authenticator Authenticator
+	// EnhancedAuthenticators carry out the MQTT 5 enhanced
+	// authentication methods the server supports. A client that names
+	// one of them in CONNECT is authenticated by it instead of the
+	// Authenticator.
+	EnhancedAuthenticators []EnhancedAuthenticator
+	// Authorizer checks every PUBLISH and SUBSCRIBE of the clients. All
+	// of them are allowed if nil.
+	Authorizer Authorizer
+	// Sessions keeps the client sessions. A new Manager is used if nil.
+	// Give it a Store to keep persistent sessions across restarts, see
+	// package store.
+	Sessions *session.Manager
+	// RetainStore keeps the retained messages. A MemoryRetainStore is
+	// used if nil.
+	RetainStore RetainStore
+	// InternPayloads makes identical payloads of retained messages and
+	// of messages queued for offline sessions share their memory, found
+	// by a hash of their content. It pays off for payloads published
+	// over and over, like status heartbeats.
+	InternPayloads bool
+	// MaxPacketSize is the largest packet accepted from clients, fixed
+	// header included. Clients sending larger packets are disconnected;
+	// MQTT 5 clients are told the limit in CONNACK. 0 means no limit.
+	MaxPacketSize int
+	// ReceiveMaximum limits the number of QoS 2 messages an MQTT 5 client
+	// may have sent without the flow having completed, told to the client
+	// in CONNACK. Clients exceeding it are disconnected. 0 means the
+	// protocol maximum of 65535. The messages sent to a client are
+	// limited to the Receive Maximum of the client in turn.
+	ReceiveMaximum uint16
+	// TopicAliasMaximum is the number of topic aliases an MQTT 5 client
+	// may use in the PUBLISH packets it sends, told to the client in
+	// CONNACK. 0 allows none. Aliases for the messages sent to the client
+	// are picked as the client allows.
+	TopicAliasMaximum uint16
+	// ClientIDValidator checks the client identifier of new connections,
+	// clients it returns an error for are refused. Set it to
+	// packet.ValidateClientID to only accept the identifiers the spec
+	// guarantees. Every identifier is accepted if nil.
+	ClientIDValidator func(clientID string) error
+	// MinReadBuffer and MaxReadBuffer bound the read buffer of every
+	// connection. It adapts to the packets the client sends, so that
+	// clients of small messages pin little memory, see packet.Reader.
+	// They default to 256 bytes and 64 KiB.
+	MinReadBuffer int
+	MaxReadBuffer int
+	// OutboundQueueSize limits the number of packets waiting to be
+	// written to a client. Defaults to 1024.
+	OutboundQueueSize int
+	// OverflowPolicy decides what to drop when the outbound queue of a
+	// client is full. Conn.SetOverflowPolicy overrides it per client.
+	OverflowPolicy OverflowPolicy
+	// Priority, if set, orders the messages waiting in the outbound queue
+	// of a client by priority, highest first, instead of first in first
+	// out. Messages of the same priority keep their order, as do all
+	// other packets; messages never overtake them.
+	Priority PriorityFunc
+	// Flush decides when the packets written to a client go out to the
+	// network. By default they do once the outbound queue of the client
+	// is empty.
+	Flush transport.FlushConfig
+	// PauseThreshold, if > 0, makes the broker stop reading from a client
+	// that published a message to a client with at least PauseThreshold
+	// packets waiting in its outbound queue, until the writer took them,
+	// so that TCP pushes back on the publisher instead of the queues
+	// filling up. The subscriptions of a client never pause it.
+	PauseThreshold int
+	// MaxPause limits how long a client is paused for PauseThreshold.
+	// Defaults to 5 seconds.
+	MaxPause time.Duration
+	// SizeRules limit the payload size of the messages clients publish,
+	// in addition to MaxPacketSize. A message must be within every rule
+	// that applies to it.
+	SizeRules []SizeRule
+	// OversizeAction is what happens to MQTT 3.1.1 clients publishing
+	// messages beyond SizeRules. MQTT 5 clients are disconnected.
+	OversizeAction OversizeAction
+	// SubscriptionLimits bound the subscriptions of the clients, unless
+	// Conn.SetSubscriptionLimits replaced them
+	SubscriptionLimits SubscriptionLimits
+	// SysInterval is how often the broker statistics are published as
+	// retained messages to the $SYS/broker topics. They are not
+	// published if 0.
+	SysInterval time.Duration
+	// Metrics receives measurements of the connections. May be nil.
+	Metrics Metrics
+	// RuntimeStatsInterval is how often Metrics receives a sample of the
+	// Go runtime and the queues of the broker. Sampling stops the world
+	// briefly, see runtime.ReadMemStats. Not sampled if 0.
+	RuntimeStatsInterval time.Duration
+	// Hooks are notified of the events of the server, in order
+	Hooks []Hook
+	// Transformers rewrite the messages of the clients before the hooks
+	// see them, in order
+	Transformers []Transformer
+	// Translation carries messages between MQTT 3.1.1 and MQTT 5 clients
+	Translation Translation
+	// Tenant, if set, binds every client to the tenant it returns once
+	// the client was authenticated; an error refuses the client like
+	// Authenticate. The topics of the clients of a tenant are moved to
+	// its namespace, TenantPrefix+tenant+"/", as they are read and back
+	// as they are written, so their messages, subscriptions, retained
+	// messages and wills never meet those of other tenants. The
+	// Authorizer, the Handler, the hooks and the stores see the topics
+	// in the namespace, as well as the sessions, which are keyed by
+	// the client identifier in it. The statistics of a tenant are
+	// published to the $SYS topics of its namespace. Clients for which
+	// it returns "" are in no namespace and may reach them all through
+	// $tenants/.
+	Tenant func(c *Conn) (string, error)
+	// ShareFilter, if set, reports whether the local members of the
+	// shared subscription share get p. It lets shared subscriptions be
+	// balanced beyond the server, see cluster.Node.Share; PublishShared
+	// delivers the messages chosen for the server elsewhere.
+	ShareFilter func(share string, p *packet.PublishControlPacket) bool
+	// MaxConnections limits the number of concurrent connections,
+	// including those still waiting for their CONNECT. Connections beyond
+	// it are closed right after they were accepted. 0 means no limit.
+	MaxConnections int
+	// ConnectionRate limits how many connections per second a single
+	// source IP address may open, with bursts of up to ConnectionBurst.
+	// Connections over the limit are closed right after they were
+	// accepted. 0 means no limit.
+	ConnectionRate  float64
+	ConnectionBurst int
+	// MessageRate limits how many PUBLISH packets per second a single
+	// client may send, with bursts of up to MessageBurst. Reading from a
+	// client over the limit is paused until it is back within it, which
+	// slows the client down through TCP flow control. 0 means no limit.
+	MessageRate  float64
+	MessageBurst int
+	// MaxDelay enables delayed publishing: messages published to
+	// DelayedPrefix+"{seconds}/{topic}" are held back for up to MaxDelay
+	// and published to topic then, retained if they were. The
+	// Authorizer, the hooks and the Handler see them when they arrive,
+	// with that topic already. Longer delays are refused with reason code
+	// 0x97, quota exceeded. $delayed topics are ordinary topics if 0.
+	MaxDelay time.Duration
+	// DelayStore keeps the delayed messages, see RestoreDelayed. They
+	// are kept in memory only if nil.
+	DelayStore DelayStore
+	// DeadLetterTopic, if set, receives the messages the server drops,
+	// e.g. from full queues or once they expired, so that operators can
+	// notice and recover them. Each dead letter is published with QoS 1
+	// and the payload of the dropped message, which is named by the user
+	// properties dead-letter-reason, one of the Drop constants,
+	// dead-letter-topic and dead-letter-client, the client it was
+	// dropped for. Secure the topic with the Authorizer, it carries the
+	// messages of every client and tenant. Dead letters are published
+	// within a second.
+	DeadLetterTopic string
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[*Conn]struct{}
+	clients    map[string]*Conn
+	online     onlineConns // clients that messages can be routed to
+	topics     atomic.Pointer[topic.Tree]
+	manager    atomic.Pointer[session.Manager] // Sessions once set up, see sessions
+	interned   *interner
+	internOnce sync.Once
+	wills      map[*session.Session]delayedWill
+	delayed    delayWheel
+	delayID    uint64
+	deadMu     sync.Mutex // guards dead, may be taken with any lock held
+	dead       deadLetters
+	tenants    map[string]*tenantStats
+	closed     bool
+	draining   *DrainConfig // set by Drain
+	started    time.Time
+	quit       chan struct{}   // closed by Close
+	ctx        context.Context // cancelled by Close
+	cancel     context.CancelFunc
+	stats      stats
+	connRate   ipLimiter
+	tuning     atomic.Pointer[Tuning] // set by Tune, or from the fields on first use
+	wg         sync.WaitGroup
+}
+
+// ListenAndServe listens on s.Addr and serves connections until Close
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":1883"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and handles each in its own goroutine. It
+// always returns a non-nil error and closes l.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		_ = l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+	s.startSys()
+
+	var backoff time.Duration
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// Transient errors like running out of file descriptors
+				// shouldn't take the server down
+				backoff = nextBackoff(backoff)
+				s.log(logger.LevelError, "broker: accept error", logger.F("error", err), logger.F("retry_in", backoff))
+				time.Sleep(backoff)
+				continue
+			}
+			_ = l.Close()
+			return err
+		}
+		backoff = 0
+
+		if err := s.admit(c); err != nil {
+			s.log(logger.LevelDebug, "broker: connection rejected", logger.F("remote_addr", c.RemoteAddr()), logger.F("error", err))
+			_ = c.Close()
+			continue
+		}
+		conn := newConn(s, c)
+		if !s.trackConn(conn, true) {
+			_ = c.Close()
+			return ErrServerClosed
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.trackConn(conn, false)
+			conn.serve()
+		}()
+	}
+}
+
+// Close stops all listeners and closes every connection immediately
+func (s *Server) Close() error {
+	s.mu.Lock()
+	err := s.stopLocked()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// shutdownPollInterval is how often Shutdown checks whether the messages
+// in flight to the clients were acknowledged
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown stops the server gracefully: it stops accepting connections,
+// waits for the clients to acknowledge the QoS 1 and 2 messages in flight
+// to them, then sends MQTT 5 clients a DISCONNECT with reason code Server
+// shutting down and closes every connection once its queued packets were
+// written. Wills are not published. Finally the subscriptions of the
+// persistent sessions are saved to the session Store.
+//
+// If ctx is done first, the remaining connections are closed immediately
+// and ctx.Err() is returned; the sessions are saved nonetheless. Serve
+// returns ErrServerClosed as soon as Shutdown was called.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	err := s.stopLocked()
+	conns := make([]*Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for len(conns) > 0 {
+		pending := conns[:0]
+		for _, c := range conns {
+			if ctx.Err() == nil && s.inFlight(c) {
+				pending = append(pending, c)
+			} else {
+				go c.shutdown()
+			}
+		}
+		conns = pending
+		if len(conns) > 0 {
+			select {
+			case <-ctx.Done():
+			case <-ticker.C:
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	// Closes the connections that are left, if any
+	_ = s.Close()
+
+	if serr := s.sessions().SaveAll(); err == nil {
+		err = serr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// stopLocked marks s closed, stops publishing the statistics and closes
+// the listeners. It is called with s.mu held.
+func (s *Server) stopLocked() error {
+	if !s.closed {
+		s.closed = true
+		if s.quit != nil {
+			close(s.quit)
+		}
+	}
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.listeners, l)
+	}
+	return err
+}
+
+// inFlight reports whether c still has QoS 1 or 2 messages to deliver.
+// Connections still in their handshake have none.
+func (s *Server) inFlight(c *Conn) bool {
+	s.mu.Lock()
+	sess := c.session
+	s.mu.Unlock()
+	return sess != nil && sess.Outbound.InFlight()+sess.Outbound.Queued() > 0
+}
+
+// baseContext returns the context the contexts of the connections are
+// derived from
+func (s *Server) baseContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+		if s.closed {
+			s.cancel()
+		}
+	}
+	return s.ctx
+}
+
+func (s *Server) outboundQueueSize() int {
+	if n := s.tuned().OutboundQueueSize; n > 0 {
+		return n
+	}
+	return defaultOutboundQueueSize
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.closed {
+			return false
+		}
+		if s.listeners == nil {
+			s.listeners = make(map[net.Listener]struct{})
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *Server) trackConn(c *Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.closed {
+			return false
+		}
+		if s.conns == nil {
+			s.conns = make(map[*Conn]struct{})
+		}
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+	}
+	return true
+}
+
+// open binds c to the session of its client identifier. An older
+// connection of the same client is closed [MQTT-3.1.4-2] and has finished
+// with the session, including its will, before open returns.
+func (s *Server) open(c *Conn) (present bool, err error) {
+	clientID := c.sessionID
+
+	s.mu.Lock()
+	if s.draining != nil {
+		s.mu.Unlock()
+		return false, errDraining
+	}
+	sessions := s.sessionsLocked()
+	var old *Conn
+	if clientID != "" {
+		if s.clients == nil {
+			s.clients = make(map[string]*Conn)
+		}
+		old = s.clients[clientID]
+		s.clients[clientID] = c
+	}
+	s.mu.Unlock()
+
+	if old != nil {
+		_ = old.Close()
+		<-old.done
+	}
+	prev, _ := sessions.Get(clientID)
+	cleanStart := c.connect.VariableHeader.ConnectFlags.CleanSession
+	sess, present, err := sessions.OpenExpiry(clientID, cleanStart, s.Translation.sessionExpiry(c.connect))
+	if err != nil {
+		s.mu.Lock()
+		if s.clients[clientID] == c {
+			delete(s.clients, clientID)
+		}
+		s.mu.Unlock()
+		return false, err
+	}
+	if prev != nil {
+		// A resumed session cancels its delayed will, the end of the old
+		// one publishes it right away
+		if w, ok := s.takeWill(prev); ok && prev != sess {
+			w.conn.publishWill(w.will)
+		}
+	}
+	if prev != nil && !prev.Clean && prev != sess {
+		s.unsubscribeAll(prev)
+		s.sessionExpired(clientID)
+	}
+	s.mu.Lock()
+	c.session = sess
+	s.mu.Unlock()
+	return present, nil
+}
+
+// goOnline makes messages be routed to c. It is called once CONNACK was
+// sent, so that no PUBLISH can overtake it. resend runs first, under the
+// same lock as the routing of messages to the offline session, see
+// onlineShard, so that retransmissions are neither duplicated nor
+// overtaken by live messages.
+func (s *Server) goOnline(c *Conn, resend func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clients[c.sessionID] != c {
+		return nil
+	}
+	sh := s.online.shard(c.sessionID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if err := resend(); err != nil {
+		return err
+	}
+	sh.conns[c.sessionID] = c
+	return nil
+}
+
+// release is called when the connection of c ended
+func (s *Server) release(c *Conn) {
+	s.mu.Lock()
+	if s.clients[c.sessionID] == c {
+		delete(s.clients, c.sessionID)
+	}
+	s.online.remove(c)
+	sessions := s.Sessions
+	s.mu.Unlock()
+
+	if err := sessions.Close(c.session); err != nil {
+		c.log(logger.LevelError, "store: failed to discard session", logger.F("error", err))
+	}
+	if c.session.Expiry() == 0 {
+		s.unsubscribeAll(c.session)
+		if !c.session.Clean {
+			s.sessionExpired(c.sessionID)
+		}
+	}
+}
+
+// sessions returns the session Manager, creating it if needed. Once it
+// was set up, it is returned without taking s.mu, for route.
+func (s *Server) sessions() *session.Manager {
+	if m := s.manager.Load(); m != nil {
+		return m
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessionsLocked()
+}
+
+// sessionsLocked is sessions with s.mu held
+func (s *Server) sessionsLocked() *session.Manager {
+	if s.Sessions == nil {
+		s.Sessions = session.NewManager()
+	}
+	if s.DeadLetterTopic != "" && s.Sessions.Expired == nil {
+		s.Sessions.Expired = func(clientID string, p *packet.PublishControlPacket) {
+			s.deadLetter(p, clientID, DropExpired)
+		}
+	}
+	s.manager.Store(s.Sessions)
+	return s.Sessions
+}
+
+// sessionExpired tells the hooks that the persistent session of clientID
+// was discarded
+func (s *Server) sessionExpired(clientID string) {
+	for _, h := range s.Hooks {
+		h.OnSessionExpired(clientID)
+	}
+}
+
+func (s *Server) retainStore() RetainStore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.RetainStore == nil {
+		s.RetainStore = NewMemoryRetainStore()
+	}
+	return s.RetainStore
+}
+
+func (s *Server) maxPause() time.Duration {
+	if s.MaxPause > 0 {
+		return s.MaxPause
+	}
+	return defaultMaxPause
+}
+
+func (s *Server) connectTimeout() time.Duration {
+	if s.ConnectTimeout > 0 {
+		return s.ConnectTimeout
+	}
+	return defaultConnectTimeout
+}
+
+func (s *Server) logger() logger.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return logger.Std(s.ErrorLog, logger.LevelWarn)
+}
+
+func (s *Server) log(level logger.Level, msg string, fields ...logger.Field) {
+	s.logger().Log(level, msg, fields...)
+}
+
+func nextBackoff(d time.Duration) time.Duration {
+	if d == 0 {
+		return 5 * time.Millisecond
+	}
+	if d *= 2; d > time.Second {
+		d = time.Second
+	}
+	return d
+}
@@ -0,0 +1,467 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T, h Handler) (*Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &Server{Handler: h, Sessions: session.NewManager()}
+	go s.Serve(l) // nolint: errcheck
+	return s, l.Addr().String()
+}
+
+func dialAndConnect(t *testing.T, addr string, clientID string) (net.Conn, *packet.ConnAckControlPacket) {
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	connect := &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(packet.ProtocolVersion311),
+			KeepAlive:     60,
+		},
+		ConnectPayload: packet.ConnectPayload{ClientID: clientID},
+	}
+	require.NoError(t, packet.WritePacket(c, connect))
+
+	p, err := packet.ReadPacket(c)
+	require.NoError(t, err)
+	require.IsType(t, &packet.ConnAckControlPacket{}, p)
+	return c, p.(*packet.ConnAckControlPacket)
+}
+
+func TestServerDispatch(t *testing.T) {
+	received := make(chan packet.ControlPacket, 1)
+	s, addr := newTestServer(t, HandlerFunc(func(c *Conn, p packet.ControlPacket) {
+		assert.Equal(t, "client-1", c.ClientID())
+		received <- p
+	}))
+	defer s.Close() // nolint: errcheck
+
+	c, _ := dialAndConnect(t, addr, "client-1")
+	defer c.Close() // nolint: errcheck
+
+	require.NoError(t, packet.WritePacket(c, packet.NewPingReqControlPacket()))
+	p, err := packet.ReadPacket(c)
+	require.NoError(t, err)
+	assert.IsType(t, &packet.PingRespControlPacket{}, p)
+
+	require.NoError(t, packet.WritePacket(c, packet.NewPublish("a/b", 0, []byte("hello"))))
+	p = <-received
+	require.IsType(t, &packet.PublishControlPacket{}, p)
+	assert.Equal(t, []byte("hello"), p.(*packet.PublishControlPacket).Payload)
+}
+
+func TestServerQoS2(t *testing.T) {
+	received := make(chan packet.ControlPacket, 2)
+	s, addr := newTestServer(t, HandlerFunc(func(c *Conn, p packet.ControlPacket) {
+		received <- p
+	}))
+	defer s.Close() // nolint: errcheck
+
+	c, _ := dialAndConnect(t, addr, "client-1")
+	defer c.Close() // nolint: errcheck
+
+	publish := packet.NewPublish("a/b", 5, []byte("once"))
+	publish.FixedHeaderFlags.QoS = packet.QoSLevelExactlyOnce
+	for i := 0; i < 2; i++ {
+		require.NoError(t, packet.WritePacket(c, publish))
+		p, err := packet.ReadPacket(c)
+		require.NoError(t, err)
+		require.IsType(t, &packet.PubrecControlPacket{}, p)
+		assert.Equal(t, uint16(5), p.(*packet.PubrecControlPacket).VariableHeader.PacketID)
+		publish.FixedHeaderFlags.Dup = true
+	}
+
+	require.NoError(t, packet.WritePacket(c, packet.NewPubRelControlPacket(5)))
+	p, err := packet.ReadPacket(c)
+	require.NoError(t, err)
+	require.IsType(t, &packet.PubcompControlPacket{}, p)
+
+	assert.Len(t, received, 1, "retransmission must not be dispatched again")
+}
+
+func TestServerPersistentSession(t *testing.T) {
+	s, addr := newTestServer(t, HandlerFunc(func(c *Conn, p packet.ControlPacket) {
+		if publish, ok := p.(*packet.PublishControlPacket); ok {
+			reply := packet.NewPublish("reply", 0, publish.Payload)
+			reply.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+			assert.NoError(t, c.Publish(reply))
+		}
+	}))
+	defer s.Close() // nolint: errcheck
+	sessions := s.Sessions
+
+	c, connack := dialAndConnect(t, addr, "client-1")
+	assert.False(t, connack.VariableHeader.SessionPresent)
+
+	require.NoError(t, packet.WritePacket(c, packet.NewPublish("a/b", 0, []byte("hello"))))
+	p, err := packet.ReadPacket(c)
+	require.NoError(t, err)
+	require.IsType(t, &packet.PublishControlPacket{}, p)
+	first := p.(*packet.PublishControlPacket)
+	assert.False(t, first.FixedHeaderFlags.Dup)
+
+	// Taking over the session closes the first connection, which never
+	// acknowledged the reply
+	c2, connack := dialAndConnect(t, addr, "client-1")
+	defer c2.Close() // nolint: errcheck
+	assert.True(t, connack.VariableHeader.SessionPresent)
+	_, err = packet.ReadPacket(c)
+	assert.Error(t, err, "old connection must be closed")
+
+	p, err = packet.ReadPacket(c2)
+	require.NoError(t, err)
+	require.IsType(t, &packet.PublishControlPacket{}, p)
+	resent := p.(*packet.PublishControlPacket)
+	assert.True(t, resent.FixedHeaderFlags.Dup)
+	assert.Equal(t, first.VariableHeader.PacketID, resent.VariableHeader.PacketID)
+	assert.Equal(t, []byte("hello"), resent.Payload)
+
+	require.NoError(t, packet.WritePacket(c2, packet.NewPubAckControlPacket(uint16(resent.VariableHeader.PacketID))))
+	sess, ok := sessions.Get("client-1")
+	require.True(t, ok)
+	for i := 0; sess.Outbound.InFlight() > 0; i++ {
+		require.True(t, i < 100, "PUBACK was not processed")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerWill(t *testing.T) {
+	published := make(chan *packet.PublishControlPacket, 2)
+	s, addr := newTestServer(t, HandlerFunc(func(c *Conn, p packet.ControlPacket) {
+		if publish, ok := p.(*packet.PublishControlPacket); ok {
+			published <- publish
+		}
+	}))
+	defer s.Close() // nolint: errcheck
+
+	connectWithWill := func(clientID string) net.Conn {
+		c, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		require.NoError(t, packet.WritePacket(c, &packet.ConnectControlPacket{
+			VariableHeader: packet.ConnectVariableHeader{
+				ProtocolName:  "MQTT",
+				ProtocolLevel: byte(packet.ProtocolVersion311),
+				ConnectFlags:  packet.ConnectFlags{WillFlag: true, WillQoS: 1},
+			},
+			ConnectPayload: packet.ConnectPayload{
+				ClientID:    clientID,
+				WillTopic:   "status/" + clientID,
+				WillMessage: []byte("offline"),
+			},
+		}))
+		_, err = packet.ReadPacket(c)
+		require.NoError(t, err)
+		return c
+	}
+
+	graceful := connectWithWill("graceful")
+	require.NoError(t, packet.WritePacket(graceful, packet.NewDisconnectControlPacket()))
+	require.NoError(t, graceful.Close())
+
+	require.NoError(t, connectWithWill("dropped").Close())
+	select {
+	case will := <-published:
+		assert.Equal(t, "status/dropped", will.VariableHeader.Topic)
+		assert.Equal(t, []byte("offline"), will.Payload)
+		assert.Equal(t, packet.QoSLevelAtLeastOnce, will.FixedHeaderFlags.QoS)
+	case <-time.After(time.Second):
+		t.Fatal("will was not published")
+	}
+	assert.Empty(t, published, "no will after DISCONNECT")
+}
+
+func TestServerKeepAlive(t *testing.T) {
+	published := make(chan *packet.PublishControlPacket, 1)
+	s, addr := newTestServer(t, HandlerFunc(func(c *Conn, p packet.ControlPacket) {
+		if publish, ok := p.(*packet.PublishControlPacket); ok {
+			published <- publish
+		}
+	}))
+	defer s.Close() // nolint: errcheck
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(c, &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(packet.ProtocolVersion5),
+			ConnectFlags:  packet.ConnectFlags{WillFlag: true},
+			KeepAlive:     1,
+			Properties:    &packet.Properties{},
+		},
+		ConnectPayload: packet.ConnectPayload{
+			ClientID:       "silent",
+			WillProperties: &packet.Properties{},
+			WillTopic:      "status/silent",
+		},
+	}))
+	_, err = packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+
+	start := time.Now()
+	p, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.DisconnectControlPacket{}, p)
+	assert.Equal(t, packet.ReasonCodeKeepAliveTimeout, p.(*packet.DisconnectControlPacket).VariableHeader.ReasonCode)
+	assert.True(t, time.Since(start) >= 1400*time.Millisecond, "closed before 1.5 times the keepalive")
+
+	_, err = packet.ReadPacket(c)
+	assert.Error(t, err, "connection must be closed")
+	select {
+	case will := <-published:
+		assert.Equal(t, "status/silent", will.VariableHeader.Topic)
+	case <-time.After(time.Second):
+		t.Fatal("will was not published")
+	}
+}
+
+func TestServerRejectsNonConnect(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	defer s.Close() // nolint: errcheck
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close() // nolint: errcheck
+
+	require.NoError(t, packet.WritePacket(c, packet.NewPingReqControlPacket()))
+	_, err = packet.ReadPacket(c)
+	assert.Error(t, err)
+}
+
+func TestServerClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &Server{}
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(l)
+	}()
+
+	c, _ := dialAndConnect(t, l.Addr().String(), "client")
+	defer c.Close() // nolint: errcheck
+
+	require.NoError(t, s.Close())
+	assert.Equal(t, ErrServerClosed, <-done)
+
+	_, err = packet.ReadPacket(c)
+	assert.Error(t, err, "connection must be closed with the server")
+}
+
+// serveInFlight starts a server with an MQTT 5 client that received a
+// QoS 1 message it has not acknowledged yet
+func serveInFlight(t *testing.T) (*Server, <-chan error, net.Conn, *packet.PublishControlPacket) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{}
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(l)
+	}()
+
+	sub, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, packet.WritePacket(sub, &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(packet.ProtocolVersion5),
+			Properties:    &packet.Properties{},
+		},
+		ConnectPayload: packet.ConnectPayload{ClientID: "sub"},
+	}))
+	_, err = packet.ReadPacketVersion(sub, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.NoError(t, packet.WritePacket(sub, &packet.SubscribeControlPacket{
+		VariableHeader: packet.SubscribeVariableHeader{PacketID: 1, Properties: &packet.Properties{}},
+		Payload:        packet.SubscribePayload{Subscriptions: []packet.Subscription{{Topic: "t", QoS: packet.QoSLevelAtLeastOnce}}},
+	}))
+	_, err = packet.ReadPacketVersion(sub, packet.ProtocolVersion5)
+	require.NoError(t, err)
+
+	pub, _ := dialAndConnect(t, l.Addr().String(), "pub")
+	defer pub.Close() // nolint: errcheck
+	publish := packet.NewPublish("t", 1, []byte("x"))
+	publish.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+	require.NoError(t, packet.WritePacket(pub, publish))
+	_, err = packet.ReadPacket(pub)
+	require.NoError(t, err)
+
+	p, err := packet.ReadPacketVersion(sub, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.PublishControlPacket{}, p)
+	return s, served, sub, p.(*packet.PublishControlPacket)
+}
+
+func TestServerShutdown(t *testing.T) {
+	s, served, sub, p := serveInFlight(t)
+	defer sub.Close() // nolint: errcheck
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	assert.Equal(t, ErrServerClosed, <-served)
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned before the message in flight was acknowledged")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	puback := packet.NewPubAckControlPacket(uint16(p.VariableHeader.PacketID))
+	puback.VariableHeader.Properties = &packet.Properties{}
+	require.NoError(t, packet.WritePacket(sub, puback))
+	d, err := packet.ReadPacketVersion(sub, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.DisconnectControlPacket{}, d)
+	assert.Equal(t, packet.ReasonCodeServerShuttingDown, d.(*packet.DisconnectControlPacket).VariableHeader.ReasonCode)
+	_, err = packet.ReadPacket(sub)
+	assert.Error(t, err, "connection must be closed")
+	assert.NoError(t, <-shutdown)
+}
+
+func TestServerShutdownDeadline(t *testing.T) {
+	s, served, sub, _ := serveInFlight(t)
+	defer sub.Close() // nolint: errcheck
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx))
+	assert.Equal(t, ErrServerClosed, <-served)
+
+	// The client never acknowledged, so it is told after the deadline
+	d, err := packet.ReadPacketVersion(sub, packet.ProtocolVersion5)
+	if err == nil {
+		assert.IsType(t, &packet.DisconnectControlPacket{}, d)
+		_, err = packet.ReadPacket(sub)
+	}
+	assert.Error(t, err, "connection must be closed")
+	assert.NoError(t, s.Close())
+}
+
+func TestServerConnectTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{ConnectTimeout: 50 * time.Millisecond}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close() // nolint: errcheck
+
+	// A CONNECT that announces more than is ever sent
+	_, err = c.Write([]byte{packet.CONNECT << 4, 20, 0, 4, 'M'})
+	require.NoError(t, err)
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = c.Read(make([]byte, 1))
+	assert.Error(t, err)
+	if ne, ok := err.(net.Error); ok {
+		assert.False(t, ne.Timeout(), "connection must be closed after ConnectTimeout")
+	}
+}
+
+func TestConnContext(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	s, addr := newTestServer(t, HandlerFunc(func(c *Conn, p packet.ControlPacket) {
+		conns <- c
+	}))
+
+	c, _ := dialAndConnect(t, addr, "client")
+	defer c.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(c, packet.NewPublish("a", 0, nil)))
+	conn := <-conns
+	assert.NoError(t, conn.Context().Err())
+
+	require.NoError(t, s.Close())
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("context was not cancelled by Close")
+	}
+}
+
+func TestServerMalformedPacket(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	defer s.Close() // nolint: errcheck
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(c, &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(packet.ProtocolVersion5),
+			ConnectFlags:  packet.ConnectFlags{CleanSession: true},
+			Properties:    &packet.Properties{},
+		},
+		ConnectPayload: packet.ConnectPayload{ClientID: "malformed"},
+	}))
+	_, err = packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+
+	// PUBLISH with both QoS bits set
+	_, err = c.Write([]byte{packet.PUBLISH<<4 | 6, 5, 0, 1, 'a', 0, 1})
+	require.NoError(t, err)
+
+	p, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.DisconnectControlPacket{}, p)
+	assert.Equal(t, packet.ReasonCodeMalformedPacket, p.(*packet.DisconnectControlPacket).VariableHeader.ReasonCode)
+}
+
+func TestServerClientID(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ids := make(chan string, 1)
+	s := &Server{
+		Handler: HandlerFunc(func(c *Conn, p packet.ControlPacket) {
+			ids <- c.ClientID()
+		}),
+		ClientIDValidator: packet.ValidateClientID,
+	}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	// A clean MQTT 5 client without identifier is told the one it got
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(c, &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(packet.ProtocolVersion5),
+			ConnectFlags:  packet.ConnectFlags{CleanSession: true},
+			Properties:    &packet.Properties{},
+		},
+	}))
+	p, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	connack := p.(*packet.ConnAckControlPacket)
+	assert.Equal(t, packet.ConnAckAccepted, connack.VariableHeader.ReturnCode)
+	assigned := connack.VariableHeader.Properties.AssignedClientIdentifier
+	assert.NoError(t, packet.ValidateClientID(assigned))
+
+	publish := packet.NewPublish("a", 0, nil)
+	publish.VariableHeader.Properties = &packet.Properties{}
+	require.NoError(t, packet.WritePacket(c, publish))
+	assert.Equal(t, assigned, <-ids)
+
+	// Identifiers the validator rejects are refused
+	c2, connack := dialAndConnect(t, l.Addr().String(), "not-alphanumeric")
+	defer c2.Close() // nolint: errcheck
+	assert.Equal(t, packet.ConnAckIdentifierRejected, connack.VariableHeader.ReturnCode)
+}
@@ -0,0 +1,67 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"errors"
+
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/topic"
+)
+
+var errMessageTooLarge = errors.New("broker: message exceeds the size limit")
+
+// SizeRule limits the payload size of the messages that the clients
+// Clients accepts publish to topics matching Filter
+type SizeRule struct {
+	// Filter is a topic filter, all topics if empty
+	Filter string
+	// Clients selects the clients the rule applies to, all if nil
+	Clients func(c *Conn) bool
+	// MaxPayload is the largest payload allowed, in bytes
+	MaxPayload int
+}
+
+// OversizeAction is what happens when an MQTT 3.1.1 client publishes a
+// message exceeding a SizeRule. MQTT 5 clients are always disconnected
+// with reason code 0x95 (Packet too large).
+type OversizeAction int
+
+const (
+	// OversizeDrop acknowledges the message and drops it
+	OversizeDrop OversizeAction = iota
+	// OversizeDisconnect closes the connection
+	OversizeDisconnect
+)
+
+// oversized reports whether p exceeds one of the Server.SizeRules
+// applying to the client
+func (c *Conn) oversized(p *packet.PublishControlPacket) bool {
+	for _, r := range c.server.SizeRules {
+		if len(p.Payload) <= r.MaxPayload {
+			continue
+		}
+		if (r.Filter == "" || topic.Matches(r.Filter, p.VariableHeader.Topic)) && (r.Clients == nil || r.Clients(c)) {
+			c.log(logger.LevelInfo, "broker: message too large", logger.F("topic", p.VariableHeader.Topic),
+				logger.F("size", len(p.Payload)), logger.F("max", r.MaxPayload))
+			return true
+		}
+	}
+	return false
+}
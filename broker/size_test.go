@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func TestServerSizeRules(t *testing.T) {
+	received := make(chan string, 4)
+	s, addr := newTestServer(t, HandlerFunc(func(c *Conn, p packet.ControlPacket) {
+		if publish, ok := p.(*packet.PublishControlPacket); ok {
+			received <- publish.VariableHeader.Topic
+		}
+	}))
+	s.SizeRules = []SizeRule{
+		{Filter: "small/#", MaxPayload: 2},
+		{Clients: func(c *Conn) bool { return c.ClientID() == "limited" }, MaxPayload: 4},
+	}
+	defer s.Close() // nolint: errcheck
+
+	c, _ := dialAndConnect(t, addr, "c1")
+	defer c.Close() // nolint: errcheck
+	for _, topic := range []string{"small/a", "large/a"} {
+		p := packet.NewPublish(topic, 1, []byte("12345"))
+		p.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+		require.NoError(t, packet.WritePacket(c, p))
+		ack, err := packet.ReadPacket(c)
+		require.NoError(t, err)
+		assert.IsType(t, &packet.PubackControlPacket{}, ack, "dropped messages are acknowledged")
+	}
+	assert.Equal(t, "large/a", <-received)
+
+	c2, _ := dialAndConnect(t, addr, "limited")
+	defer c2.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(c2, packet.NewPublish("large/b", 0, []byte("12345"))))
+	require.NoError(t, packet.WritePacket(c2, packet.NewPublish("large/c", 0, []byte("1234"))))
+	assert.Equal(t, "large/c", <-received)
+
+}
+
+func TestServerOversizeDisconnect(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	s.SizeRules = []SizeRule{{MaxPayload: 2}}
+	s.OversizeAction = OversizeDisconnect
+	defer s.Close() // nolint: errcheck
+
+	c, _ := dialAndConnect(t, addr, "c1")
+	defer c.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(c, packet.NewPublish("a", 0, []byte("123"))))
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err := packet.ReadPacket(c)
+	assert.Error(t, err, "connection must be closed")
+}
+
+func TestServerSizeRulesV5(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{SizeRules: []SizeRule{{MaxPayload: 2}}}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(c, &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(packet.ProtocolVersion5),
+			Properties:    &packet.Properties{},
+		},
+		ConnectPayload: packet.ConnectPayload{ClientID: "c1"},
+	}))
+	_, err = packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+
+	p := packet.NewPublish("a", 1, []byte("123"))
+	p.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+	p.VariableHeader.Properties = &packet.Properties{}
+	require.NoError(t, packet.WritePacket(c, p))
+	d, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.DisconnectControlPacket{}, d)
+	assert.Equal(t, packet.ReasonCodePacketTooLarge, d.(*packet.DisconnectControlPacket).VariableHeader.ReasonCode)
+}
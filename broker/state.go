@@ -0,0 +1,91 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+)
+
+// ClientState is a snapshot of a connected client, see Server.Clients
+type ClientState struct {
+	ClientID string
+	// Tenant is empty for clients without tenant, see Server.Tenant
+	Tenant     string
+	UserName   string
+	RemoteAddr string
+	Version    packet.ProtocolVersion
+	// Accepted is when the connection was accepted
+	Accepted time.Time
+	// Subscriptions counts the topic filters of the session
+	Subscriptions int
+	// Outbound counts the packets waiting in the outbound queue
+	Outbound int
+	// InFlight counts the QoS 1 and 2 messages to the client whose flow
+	// has not completed, Queued those held back by the in-flight window
+	InFlight int
+	Queued   int
+}
+
+// Clients returns a snapshot of the clients messages are routed to,
+// sorted by client identifier and tenant
+func (s *Server) Clients() []ClientState {
+	conns := s.online.all()
+	states := make([]ClientState, len(conns))
+	for i, c := range conns {
+		c.qmu.Lock()
+		outbound := len(c.queue)
+		c.qmu.Unlock()
+		states[i] = ClientState{
+			ClientID:      c.ClientID(),
+			Tenant:        c.tenant,
+			UserName:      c.connect.ConnectPayload.UserName,
+			RemoteAddr:    c.RemoteAddr().String(),
+			Version:       c.version,
+			Accepted:      c.accepted,
+			Subscriptions: len(c.session.Subscriptions()),
+			Outbound:      outbound,
+			InFlight:      c.session.Outbound.InFlight(),
+			Queued:        c.session.Outbound.Queued(),
+		}
+	}
+	slices.SortFunc(states, func(a, b ClientState) int {
+		return cmp.Or(strings.Compare(a.ClientID, b.ClientID), strings.Compare(a.Tenant, b.Tenant))
+	})
+	return states
+}
+
+// SessionSnapshots returns a snapshot of every session, whether its
+// client is online or not, with the messages in flight to the client,
+// sorted by session identifier. It helps to troubleshoot stuck QoS 1 and
+// 2 flows.
+func (s *Server) SessionSnapshots() []session.Snapshot {
+	now := time.Now()
+	sessions := s.sessions().All()
+	snaps := make([]session.Snapshot, len(sessions))
+	for i, sess := range sessions {
+		snaps[i] = sess.Snapshot(now)
+	}
+	slices.SortFunc(snaps, func(a, b session.Snapshot) int { return strings.Compare(a.ClientID, b.ClientID) })
+	return snaps
+}
@@ -0,0 +1,59 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+)
+
+func TestServerClients(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	defer s.Close() // nolint: errcheck
+
+	b, _ := dialAndConnect(t, addr, "b")
+	defer b.Close() // nolint: errcheck
+	a, _ := dialAndConnect(t, addr, "a")
+	defer a.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(a, &packet.SubscribeControlPacket{
+		VariableHeader: packet.SubscribeVariableHeader{PacketID: 1},
+		Payload:        packet.SubscribePayload{Subscriptions: []packet.Subscription{{Topic: "t/#"}, {Topic: "u"}}},
+	}))
+	_, err := packet.ReadPacket(a)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return len(s.Clients()) == 2 }, time.Second, time.Millisecond)
+	clients := s.Clients()
+	assert.Equal(t, "a", clients[0].ClientID)
+	assert.Equal(t, a.LocalAddr().String(), clients[0].RemoteAddr)
+	assert.Equal(t, packet.ProtocolVersion311, clients[0].Version)
+	assert.Equal(t, 2, clients[0].Subscriptions)
+	assert.WithinDuration(t, time.Now(), clients[0].Accepted, time.Minute)
+	assert.Equal(t, "b", clients[1].ClientID)
+	assert.Zero(t, clients[1].Subscriptions)
+}
+
+func TestServerSessionSnapshots(t *testing.T) {
+	s := &Server{Sessions: session.NewManager()}
+	sess, _, err := s.Sessions.Open("b", false)
+	require.NoError(t, err)
+	p := packet.NewPublish("t", 0, []byte("x"))
+	p.FixedHeaderFlags.QoS = packet.QoSLevelExactlyOnce
+	_, err = sess.Outbound.Push(p)
+	require.NoError(t, err)
+	_, _, err = s.Sessions.Open("a", true)
+	require.NoError(t, err)
+
+	snaps := s.SessionSnapshots()
+	require.Len(t, snaps, 2)
+	assert.Equal(t, "a", snaps[0].ClientID)
+	assert.Empty(t, snaps[0].Outbound)
+	assert.Equal(t, "b", snaps[1].ClientID)
+	require.Len(t, snaps[1].Outbound, 1)
+	assert.Equal(t, "t", snaps[1].Outbound[0].Topic)
+	assert.Equal(t, packet.QoSLevelExactlyOnce, snaps[1].Outbound[0].QoS)
+}
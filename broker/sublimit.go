@@ -0,0 +1,89 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"strings"
+
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/topic"
+)
+
+// SubscriptionLimits bound the subscriptions of a client. The zero value
+// imposes no limits.
+type SubscriptionLimits struct {
+	// MaxSubscriptions limits the number of subscriptions of the session
+	// of a client. New subscriptions beyond it are refused with reason
+	// code 0x97, quota exceeded; replacing one is not. 0 means no limit.
+	MaxSubscriptions int
+	// MinFilterLevels is the number of levels a topic filter must have
+	// before its first wildcard: 1 refuses # and +/status, but not
+	// devices/#. Broader filters are refused with reason code 0x87, not
+	// authorized. The share name of a shared subscription and the
+	// namespace of a tenant don't count.
+	MinFilterLevels int
+}
+
+// SetSubscriptionLimits replaces the SubscriptionLimits of the server for
+// c, e.g. to hold untrusted clients to narrower filters. Call it from
+// the Authenticator, Tenant or an OnConnect hook.
+func (c *Conn) SetSubscriptionLimits(limits SubscriptionLimits) {
+	c.subLimits = &limits
+}
+
+// subscriptionLimits returns the SubscriptionLimits of c
+func (c *Conn) subscriptionLimits() SubscriptionLimits {
+	if c.subLimits != nil {
+		return *c.subLimits
+	}
+	return c.server.SubscriptionLimits
+}
+
+// tooBroad reports whether filter has fewer levels before its first
+// wildcard than c is allowed
+func (c *Conn) tooBroad(filter string) bool {
+	min := c.subscriptionLimits().MinFilterLevels
+	if min <= 0 {
+		return false
+	}
+	if _, f, shared := topic.ParseShared(filter); shared {
+		filter = f
+	}
+	levels := strings.Split(strings.TrimPrefix(filter, c.namespace()), "/")
+	for i, level := range levels {
+		if level == "+" || level == "#" {
+			if i < min {
+				c.log(logger.LevelInfo, "broker: topic filter too broad", logger.F("filter", filter), logger.F("min_levels", min))
+				return true
+			}
+			return false
+		}
+	}
+	return false
+}
+
+// overQuota reports whether a subscription to filter would exceed the
+// number of subscriptions c may have
+func (c *Conn) overQuota(filter string) bool {
+	max := c.subscriptionLimits().MaxSubscriptions
+	if max <= 0 || c.session.SubscriptionCount() < max || c.session.Subscribed(filter) {
+		return false
+	}
+	c.log(logger.LevelInfo, "broker: too many subscriptions", logger.F("filter", filter), logger.F("max", max))
+	return true
+}
@@ -0,0 +1,69 @@
+package broker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func TestServerSubscriptionLimits(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{
+		SubscriptionLimits: SubscriptionLimits{MaxSubscriptions: 2, MinFilterLevels: 1},
+		Tenant: func(c *Conn) (string, error) {
+			if c.ClientID() == "tenant" {
+				return "t1", nil
+			}
+			return "", nil
+		},
+		Authenticator: AuthenticatorFunc(func(c *Conn) error {
+			if c.ClientID() == "trusted" {
+				c.SetSubscriptionLimits(SubscriptionLimits{})
+			}
+			return nil
+		}),
+	}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	c, _ := dialAndConnect(t, l.Addr().String(), "c")
+	defer c.Close() // nolint: errcheck
+	assert.Equal(t, []byte{packet.ReturncodeFailure, packet.ReturncodeFailure, 0, 0, 0x80},
+		subscribe(t, c, 1,
+			packet.Subscription{Topic: "#"},
+			packet.Subscription{Topic: "$share/g/+/status"},
+			packet.Subscription{Topic: "devices/#"},
+			packet.Subscription{Topic: "$share/g/devices/+/status"},
+			packet.Subscription{Topic: "a"}))
+	// Replacing a subscription is within the limit
+	assert.Equal(t, []byte{1}, subscribe(t, c, 2, packet.Subscription{Topic: "devices/#", QoS: 1}))
+
+	// MQTT 5 clients are told why
+	c5, _ := connectV5(t, l.Addr().String(), "c5")
+	defer c5.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(c5, &packet.SubscribeControlPacket{
+		VariableHeader: packet.SubscribeVariableHeader{PacketID: 1, Properties: &packet.Properties{}},
+		Payload:        packet.SubscribePayload{Subscriptions: []packet.Subscription{{Topic: "+"}, {Topic: "a"}, {Topic: "b"}, {Topic: "c"}}},
+	}))
+	p, err := packet.ReadPacketVersion(c5, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.SubAckControlPacket{}, p)
+	assert.Equal(t, []byte{packet.ReasonCodeNotAuthorized, 0, 0, packet.ReasonCodeQuotaExceeded},
+		p.(*packet.SubAckControlPacket).Payload.ReturnCodes)
+
+	// The namespace of a tenant doesn't count as a level
+	tenant, _ := dialAndConnect(t, l.Addr().String(), "tenant")
+	defer tenant.Close() // nolint: errcheck
+	assert.Equal(t, []byte{packet.ReturncodeFailure, 0}, subscribe(t, tenant, 1,
+		packet.Subscription{Topic: "#"}, packet.Subscription{Topic: "a/#"}))
+
+	trusted, _ := dialAndConnect(t, l.Addr().String(), "trusted")
+	defer trusted.Close() // nolint: errcheck
+	assert.Equal(t, []byte{0, 0, 0}, subscribe(t, trusted, 1,
+		packet.Subscription{Topic: "#"}, packet.Subscription{Topic: "a"}, packet.Subscription{Topic: "b"}))
+}
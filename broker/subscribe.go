@@ -0,0 +1,335 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"sync"
+
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+	"github.com/infinimesh/mqtt-go/topic"
+)
+
+// handleSubscribe adds the subscriptions of p to the session and the
+// subscription tree and answers with SUBACK. Every topic filter that is
+// invalid, denied by the Authorizer or beyond the SubscriptionLimits of
+// c gets a failure return code, all of them do if a hook rejects p.
+// Retained messages matching the new subscriptions are sent after SUBACK.
+func (c *Conn) handleSubscribe(p *packet.SubscribeControlPacket) error {
+	var hookErr error
+	for _, h := range c.server.Hooks {
+		if hookErr = h.OnSubscribe(c, p); hookErr != nil {
+			c.log(logger.LevelDebug, "broker: subscription rejected by hook", logger.F("error", hookErr))
+			break
+		}
+	}
+
+	tree := c.server.tree()
+	codes := make([]byte, len(p.Payload.Subscriptions))
+	var retained []packet.Subscription
+	for i, sub := range p.Payload.Subscriptions {
+		switch {
+		case hookErr != nil:
+			codes[i] = c.subscribeFailure(hookReasonCode(hookErr))
+		case !topic.ValidFilter(sub.Topic):
+			codes[i] = c.subscribeFailure(packet.ReasonCodeTopicFilterInvalid)
+		case !c.authorize(sub.Topic, ActionSubscribe), c.tooBroad(sub.Topic):
+			codes[i] = c.subscribeFailure(packet.ReasonCodeNotAuthorized)
+		case c.overQuota(sub.Topic):
+			codes[i] = c.subscribeFailure(packet.ReasonCodeQuotaExceeded)
+		default:
+			sub.QoS = min(sub.QoS, c.maxQoS())
+			existed := c.session.Subscribe(sub)
+			tree.Subscribe(c.sessionID, sub.Topic, sub.QoS)
+			codes[i] = byte(sub.QoS)
+			if wantsRetained(sub, existed) {
+				retained = append(retained, sub)
+			}
+		}
+	}
+	if err := c.server.sessions().SaveSubscriptions(c.session); err != nil {
+		c.log(logger.LevelError, "store: failed to store subscriptions", logger.F("error", err))
+	}
+
+	if err := c.WritePacket(packet.NewSubAck(uint16(p.VariableHeader.PacketID), codes)); err != nil {
+		return err
+	}
+	for _, sub := range retained {
+		if err := c.SendRetained(sub.Topic, sub.QoS); err != nil {
+			c.log(logger.LevelError, "store: failed to send retained messages", logger.F("filter", sub.Topic), logger.F("error", err))
+		}
+	}
+	return nil
+}
+
+// handleUnsubscribe removes the subscriptions to the topic filters of p
+// from the session and the subscription tree and answers with UNSUBACK.
+// MQTT 5 clients are told for each filter whether such a subscription
+// existed.
+func (c *Conn) handleUnsubscribe(p *packet.UnsubscribeControlPacket) error {
+	tree := c.server.tree()
+	codes := make([]byte, len(p.Payload.Topics))
+	for i, filter := range p.Payload.Topics {
+		switch {
+		case !topic.ValidFilter(filter):
+			codes[i] = packet.ReasonCodeTopicFilterInvalid
+		case c.session.Unsubscribe(filter):
+			tree.Unsubscribe(c.sessionID, filter)
+			codes[i] = packet.ReasonCodeSuccess
+		default:
+			codes[i] = packet.ReasonCodeNoSubscriptionExisted
+		}
+	}
+	if err := c.server.sessions().SaveSubscriptions(c.session); err != nil {
+		c.log(logger.LevelError, "store: failed to store subscriptions", logger.F("error", err))
+	}
+	for _, h := range c.server.Hooks {
+		h.OnUnsubscribe(c, p)
+	}
+
+	unsuback := packet.NewUnsubAck(uint16(p.VariableHeader.PacketID))
+	unsuback.Payload.ReasonCodes = codes // encoded on MQTT 5 only
+	return c.WritePacket(unsuback)
+}
+
+// subscribeFailure returns the SUBACK return code of a refused
+// subscription, reasonCode on MQTT 5
+func (c *Conn) subscribeFailure(reasonCode byte) byte {
+	if c.version == packet.ProtocolVersion5 {
+		return reasonCode
+	}
+	return packet.ReturncodeFailure
+}
+
+// wantsRetained reports whether the retained messages matching sub are
+// sent, according to its MQTT 5 Retain Handling option. Shared
+// subscriptions never get them.
+func wantsRetained(sub packet.Subscription, existed bool) bool {
+	if _, _, shared := topic.ParseShared(sub.Topic); shared {
+		return false
+	}
+	switch sub.RetainHandling {
+	case 1:
+		return !existed
+	case 2:
+		return false
+	}
+	return true
+}
+
+// noLocal reports whether every subscription of c matching name has the
+// MQTT 5 No Local option, so that c must not receive its own messages
+func (c *Conn) noLocal(name string) bool {
+	for _, sub := range c.session.Subscriptions() {
+		if _, _, shared := topic.ParseShared(sub.Topic); !shared && topic.Matches(sub.Topic, name) && !sub.NoLocal {
+			return false
+		}
+	}
+	return true
+}
+
+// route delivers p to the clients with matching subscriptions. from is
+// the client that published p, or nil for messages of the server. QoS 1
+// and 2 messages for persistent sessions whose client is offline are
+// queued in the session. QoS 0 messages are encoded once per protocol
+// version for all subscribers receiving them unchanged, see frame; that
+// path does not allocate.
+func (s *Server) route(from *Conn, p *packet.PublishControlPacket) {
+	buf := subscriberBufs.Get().(*[]topic.Subscriber)
+	defer func() {
+		clear(*buf)
+		*buf = (*buf)[:0]
+		subscriberBufs.Put(buf)
+	}()
+	*buf = s.tree().AppendMatch((*buf)[:0], p.VariableHeader.Topic)
+	if len(*buf) == 0 {
+		return
+	}
+	sessions := s.sessions()
+	// QoS 0 messages are the same for all subscribers of a version
+	shared := frames{translation: &s.Translation}
+	defer shared.release()
+	// The message queued for offline sessions, with its payload interned
+	var queued *packet.PublishControlPacket
+
+	for _, sub := range *buf {
+		if from != nil && sub.ClientID == from.sessionID && sub.Share == "" && from.noLocal(p.VariableHeader.Topic) {
+			continue
+		}
+		if hidden(sessions, sub.ClientID, p.VariableHeader.Topic) {
+			continue
+		}
+		if sub.Share != "" && s.ShareFilter != nil && !s.ShareFilter(sub.Share, p) {
+			continue
+		}
+		qos := min(p.FixedHeaderFlags.QoS, sub.QoS)
+		retain := p.FixedHeaderFlags.Retain && retainAsPublished(sessions, sub.ClientID, sub.Share, p.VariableHeader.Topic)
+
+		sh := s.online.shard(sub.ClientID)
+		sh.mu.Lock()
+		c := sh.conns[sub.ClientID]
+		if c == nil && qos != packet.QoSLevelNone {
+			// Queued with the lock of the shard held, so that goOnline
+			// retransmits it
+			if queued == nil {
+				queued = s.intern(p)
+			}
+			s.queueOffline(sessions, sub.ClientID, routed(queued, qos, retain))
+		}
+		sh.mu.Unlock()
+		if c != nil {
+			var err error
+			if qos == packet.QoSLevelNone && !retain && c.sharesFrames() {
+				f := shared.get(p, c.version == packet.ProtocolVersion5)
+				f.retain()
+				err = c.WritePacket(f)
+			} else {
+				err = c.Publish(routed(p, qos, retain))
+			}
+			if err != nil {
+				c.log(logger.LevelWarn, "broker: failed to deliver message", logger.F("topic", p.VariableHeader.Topic), logger.F("error", err))
+			}
+			if from != nil && from != c && s.PauseThreshold > 0 {
+				if drained := c.saturated(s.PauseThreshold); drained != nil {
+					from.backlog = append(from.backlog, drained)
+				}
+			}
+		}
+	}
+}
+
+// Publish delivers p to the subscribers of the server like a message of
+// the server itself: it is neither retained nor seen by the hooks and the
+// Handler. Use it for messages from elsewhere, e.g. a cluster peer.
+func (s *Server) Publish(p *packet.PublishControlPacket) {
+	s.route(nil, p)
+}
+
+// PublishShared delivers p to one member of the shared subscription
+// share only, bypassing ShareFilter, and reports whether the server has
+// one matching p
+func (s *Server) PublishShared(share string, p *packet.PublishControlPacket) bool {
+	sessions := s.sessions()
+	for _, sub := range s.tree().Match(p.VariableHeader.Topic) {
+		if sub.Share != share || hidden(sessions, sub.ClientID, p.VariableHeader.Topic) {
+			continue
+		}
+		qos := min(p.FixedHeaderFlags.QoS, sub.QoS)
+		retain := p.FixedHeaderFlags.Retain && retainAsPublished(sessions, sub.ClientID, share, p.VariableHeader.Topic)
+		sh := s.online.shard(sub.ClientID)
+		sh.mu.Lock()
+		c := sh.conns[sub.ClientID]
+		if c == nil {
+			s.queueOffline(sessions, sub.ClientID, routed(s.intern(p), qos, retain))
+		}
+		sh.mu.Unlock()
+		if c != nil {
+			if err := c.Publish(routed(p, qos, retain)); err != nil {
+				c.log(logger.LevelWarn, "broker: failed to deliver message", logger.F("topic", p.VariableHeader.Topic), logger.F("error", err))
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// subscriberBufs holds the buffers route matches subscribers into
+var subscriberBufs = sync.Pool{New: func() any { return new([]topic.Subscriber) }}
+
+// routed returns a copy of p as delivered with qos to a subscriber. Its
+// retain flag is cleared [MQTT-3.3.1-9] unless retain is set, see
+// retainAsPublished.
+func routed(p *packet.PublishControlPacket, qos packet.QosLevel, retain bool) *packet.PublishControlPacket {
+	cp := *p
+	cp.FixedHeaderFlags = packet.PublishHeaderFlags{QoS: qos, Retain: retain}
+	cp.VariableHeader.PacketID = 0
+	return &cp
+}
+
+// retainAsPublished reports whether the message on name reaches the
+// session of sessionID through a subscription with the MQTT 5 Retain As
+// Published option, the shared subscription share if not empty. Such a
+// subscription gets the retain flag the message was published with
+// [MQTT-3.3.1-13].
+func retainAsPublished(sessions *session.Manager, sessionID, share, name string) bool {
+	sess, ok := sessions.Get(sessionID)
+	if !ok {
+		return false
+	}
+	for _, sub := range sess.Subscriptions() {
+		if !sub.RetainAsPublished {
+			continue
+		}
+		if share != "" {
+			if sub.Topic == share {
+				return true
+			}
+			continue
+		}
+		if _, _, shared := topic.ParseShared(sub.Topic); !shared && topic.Matches(sub.Topic, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// queueOffline adds a QoS 1 or 2 message to the persistent session of
+// clientID while its client is offline. It is called with the lock of
+// the onlineShard of clientID held.
+func (s *Server) queueOffline(sessions *session.Manager, clientID string, p *packet.PublishControlPacket) {
+	if p.FixedHeaderFlags.QoS == packet.QoSLevelNone {
+		return
+	}
+	if sess, ok := sessions.Get(clientID); ok && !sess.Clean {
+		if _, err := sess.Outbound.Push(p); err != nil {
+			s.log(logger.LevelWarn, "broker: failed to queue message", logger.F("client_id", clientID), logger.F("error", err))
+		}
+	}
+}
+
+// tree returns the subscription tree. It is filled with the
+// subscriptions of the sessions the Manager already has, e.g. restored
+// from a Store.
+func (s *Server) tree() *topic.Tree {
+	if t := s.topics.Load(); t != nil {
+		return t
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t := s.topics.Load(); t != nil {
+		return t
+	}
+	t := topic.NewTree()
+	for _, sess := range s.sessionsLocked().All() {
+		for _, sub := range sess.Subscriptions() {
+			t.Subscribe(sess.ClientID, sub.Topic, sub.QoS)
+		}
+	}
+	s.topics.Store(t)
+	return t
+}
+
+// unsubscribeAll removes the subscriptions of a discarded session from
+// the subscription tree
+func (s *Server) unsubscribeAll(sess *session.Session) {
+	tree := s.tree()
+	for _, sub := range sess.Subscriptions() {
+		tree.Unsubscribe(sess.ClientID, sub.Topic)
+	}
+}
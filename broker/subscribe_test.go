@@ -0,0 +1,512 @@
+package broker
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+	"github.com/infinimesh/mqtt-go/transport"
+)
+
+func subscribe(t *testing.T, c net.Conn, id int, subs ...packet.Subscription) []byte {
+	require.NoError(t, packet.WritePacket(c, &packet.SubscribeControlPacket{
+		VariableHeader: packet.SubscribeVariableHeader{PacketID: id},
+		Payload:        packet.SubscribePayload{Subscriptions: subs},
+	}))
+	p, err := packet.ReadPacket(c)
+	require.NoError(t, err)
+	require.IsType(t, &packet.SubAckControlPacket{}, p)
+	suback := p.(*packet.SubAckControlPacket)
+	assert.Equal(t, id, int(suback.VariableHeader.PacketID))
+	return suback.Payload.ReturnCodes
+}
+
+func TestServerSubscribe(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	defer s.Close() // nolint: errcheck
+
+	subscriber, _ := dialAndConnect(t, addr, "subscriber")
+	defer subscriber.Close() // nolint: errcheck
+	codes := subscribe(t, subscriber, 1,
+		packet.Subscription{Topic: "sensors/+", QoS: packet.QoSLevelAtLeastOnce},
+		packet.Subscription{Topic: "$share/g", QoS: packet.QoSLevelAtLeastOnce},
+		packet.Subscription{Topic: "a/#/b", QoS: packet.QoSLevelAtLeastOnce},
+		packet.Subscription{Topic: "alerts", QoS: packet.QoSLevelExactlyOnce},
+	)
+	assert.Equal(t, []byte{1, packet.ReturncodeFailure, packet.ReturncodeFailure, 2}, codes)
+
+	publisher, _ := dialAndConnect(t, addr, "publisher")
+	defer publisher.Close() // nolint: errcheck
+	p := packet.NewPublish("sensors/1", 1, []byte("21"))
+	p.FixedHeaderFlags.QoS = packet.QoSLevelExactlyOnce
+	require.NoError(t, packet.WritePacket(publisher, p))
+	resp, err := packet.ReadPacket(publisher)
+	require.NoError(t, err)
+	require.IsType(t, &packet.PubrecControlPacket{}, resp)
+
+	resp, err = packet.ReadPacket(subscriber)
+	require.NoError(t, err)
+	require.IsType(t, &packet.PublishControlPacket{}, resp)
+	msg := resp.(*packet.PublishControlPacket)
+	assert.Equal(t, "sensors/1", msg.VariableHeader.Topic)
+	assert.Equal(t, packet.QoSLevelAtLeastOnce, msg.FixedHeaderFlags.QoS, "QoS is limited to the granted one")
+	assert.Equal(t, []byte("21"), msg.Payload)
+	require.NoError(t, packet.WritePacket(subscriber, packet.NewPubAckControlPacket(uint16(msg.VariableHeader.PacketID))))
+
+	// Messages for the offline persistent session are queued
+	require.NoError(t, subscriber.Close())
+	<-waitOffline(s, "subscriber")
+	p = packet.NewPublish("alerts", 2, []byte("fire"))
+	p.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+	require.NoError(t, packet.WritePacket(publisher, p))
+	_, err = packet.ReadPacket(publisher)
+	require.NoError(t, err)
+
+	subscriber, connack := dialAndConnect(t, addr, "subscriber")
+	defer subscriber.Close() // nolint: errcheck
+	assert.True(t, connack.VariableHeader.SessionPresent)
+	p = packet.NewPublish("alerts", 3, []byte("smoke"))
+	p.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+	require.NoError(t, packet.WritePacket(publisher, p))
+
+	// The queued message comes first and, never sent before, is no
+	// duplicate
+	for _, payload := range []string{"fire", "smoke"} {
+		resp, err = packet.ReadPacket(subscriber)
+		require.NoError(t, err)
+		require.IsType(t, &packet.PublishControlPacket{}, resp)
+		msg = resp.(*packet.PublishControlPacket)
+		assert.Equal(t, []byte(payload), msg.Payload)
+		assert.False(t, msg.FixedHeaderFlags.Dup)
+	}
+}
+
+func TestServerResumeOrder(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	defer s.Close() // nolint: errcheck
+	route := func(payload string, qos packet.QosLevel) {
+		p := packet.NewPublish("t", 0, []byte(payload))
+		p.FixedHeaderFlags.QoS = qos
+		s.route(nil, p)
+	}
+
+	subscriber, _ := dialAndConnect(t, addr, "subscriber")
+	defer subscriber.Close() // nolint: errcheck
+	subscribe(t, subscriber, 1, packet.Subscription{Topic: "t", QoS: packet.QoSLevelExactlyOnce})
+	route("1", packet.QoSLevelAtLeastOnce)
+	route("2", packet.QoSLevelExactlyOnce)
+	route("3", packet.QoSLevelAtLeastOnce)
+	route("4", packet.QoSLevelExactlyOnce)
+	ids := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		p, err := packet.ReadPacket(subscriber)
+		require.NoError(t, err)
+		require.IsType(t, &packet.PublishControlPacket{}, p)
+		msg := p.(*packet.PublishControlPacket)
+		ids[string(msg.Payload)] = msg.VariableHeader.PacketID
+	}
+	require.NoError(t, packet.WritePacket(subscriber, packet.NewPubRecControlPacket(uint16(ids["2"]))))
+	p, err := packet.ReadPacket(subscriber)
+	require.NoError(t, err)
+	require.IsType(t, &packet.PubrelControlPacket{}, p)
+
+	require.NoError(t, subscriber.Close())
+	<-waitOffline(s, "subscriber")
+	route("5", packet.QoSLevelExactlyOnce)
+	route("6", packet.QoSLevelAtLeastOnce)
+
+	// In-flight messages go out again in their original order, as
+	// duplicates, the queued ones follow as they were published
+	subscriber, _ = dialAndConnect(t, addr, "subscriber")
+	defer subscriber.Close() // nolint: errcheck
+	for _, want := range []string{"1", "PUBREL 2", "3", "4", "5", "6"} {
+		p, err := packet.ReadPacket(subscriber)
+		require.NoError(t, err)
+		switch p := p.(type) {
+		case *packet.PubrelControlPacket:
+			assert.Equal(t, want, "PUBREL 2")
+			assert.Equal(t, ids["2"], int(p.VariableHeader.PacketID))
+		case *packet.PublishControlPacket:
+			payload := string(p.Payload)
+			assert.Equal(t, want, payload)
+			assert.Equal(t, payload < "5", p.FixedHeaderFlags.Dup, "message %v", payload)
+			if id, ok := ids[payload]; ok {
+				assert.Equal(t, id, p.VariableHeader.PacketID)
+			}
+		default:
+			t.Fatalf("unexpected %T", p)
+		}
+	}
+}
+
+func TestServerRouteFrames(t *testing.T) {
+	s := &Server{Sessions: session.NewManager()}
+	conns := make(map[string]*Conn)
+	for _, id := range []string{"v3a", "v3b", "v5a", "v5b", "alias"} {
+		server, client := net.Pipe()
+		defer client.Close() // nolint: errcheck
+		c := newConn(s, server)
+		c.clientID, c.sessionID, c.version = id, id, packet.ProtocolVersion311
+		if id != "v3a" && id != "v3b" {
+			c.version = packet.ProtocolVersion5
+		}
+		if id == "alias" {
+			c.aliases = &packet.TopicAliases{Maximum: 1}
+		}
+		var err error
+		c.session, _, err = s.Sessions.Open(id, true)
+		require.NoError(t, err)
+		conns[id] = c
+		s.online.add(c)
+		s.tree().Subscribe(id, "t", packet.QoSLevelAtLeastOnce)
+	}
+
+	p := packet.NewPublish("t", 0, []byte("hello"))
+	p.VariableHeader.Properties = &packet.Properties{ContentType: "text/plain"}
+	s.route(nil, p)
+
+	// No writeLoop runs, so the messages stay in the queues
+	assert.Same(t, conns["v3a"].queue[0], conns["v3b"].queue[0])
+	assert.Same(t, conns["v5a"].queue[0], conns["v5b"].queue[0])
+	assert.NotSame(t, conns["v3a"].queue[0], conns["v5a"].queue[0])
+	assert.IsType(t, &packet.PublishControlPacket{}, conns["alias"].queue[0], "topic aliases differ per client")
+
+	for id, props := range map[string]*packet.Properties{"v3a": nil, "v5a": p.VariableHeader.Properties} {
+		want := packet.NewPublish("t", 0, []byte("hello"))
+		want.VariableHeader.Properties = props
+		wantBuf, err := want.Encode()
+		require.NoError(t, err)
+		buf, err := conns[id].queue[0].Encode()
+		require.NoError(t, err)
+		assert.Equal(t, wantBuf, buf, id)
+	}
+
+	// Subscribers with QoS 1 get their own packet
+	p.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+	s.route(nil, p)
+	assert.IsType(t, &packet.PublishControlPacket{}, conns["v3a"].queue[1])
+	assert.NotSame(t, conns["v3a"].queue[1], conns["v3b"].queue[1])
+}
+
+func TestServerShareFilter(t *testing.T) {
+	var filtered []string
+	s := &Server{Sessions: session.NewManager()}
+	s.ShareFilter = func(share string, p *packet.PublishControlPacket) bool {
+		filtered = append(filtered, share)
+		return false
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		c := newConn(s, nil)
+		c.clientID, c.sessionID, c.version = id, id, packet.ProtocolVersion311
+		var err error
+		c.session, _, err = s.Sessions.Open(id, true)
+		require.NoError(t, err)
+		s.online.add(c)
+		filter := "$share/g/t"
+		if id == "c" {
+			filter = "t"
+		}
+		s.tree().Subscribe(id, filter, packet.QoSLevelNone)
+	}
+
+	// Only the ordinary subscriber gets the message
+	s.Publish(packet.NewPublish("t", 0, []byte("x")))
+	assert.Equal(t, []string{"$share/g/t"}, filtered)
+	assert.Empty(t, s.online.get("a").queue)
+	assert.Empty(t, s.online.get("b").queue)
+	assert.Len(t, s.online.get("c").queue, 1)
+
+	// One member gets the message chosen for the server elsewhere
+	assert.True(t, s.PublishShared("$share/g/t", packet.NewPublish("t", 0, []byte("x"))))
+	assert.Equal(t, 1, len(s.online.get("a").queue)+len(s.online.get("b").queue))
+	assert.Len(t, s.online.get("c").queue, 1)
+	assert.False(t, s.PublishShared("$share/h/t", packet.NewPublish("t", 0, []byte("x"))))
+}
+
+func TestServerRouteAllocations(t *testing.T) {
+	if race {
+		t.Skip("allocations are unreliable with the race detector")
+	}
+	s := &Server{Sessions: session.NewManager()}
+	for _, id := range []string{"v3", "v5"} {
+		c := newConn(s, nil)
+		c.clientID, c.sessionID, c.version = id, id, packet.ProtocolVersion311
+		if id == "v5" {
+			c.version = packet.ProtocolVersion5
+		}
+		var err error
+		c.session, _, err = s.Sessions.Open(id, true)
+		require.NoError(t, err)
+		s.online.add(c)
+		s.tree().Subscribe(id, "a/+", packet.QoSLevelAtLeastOnce)
+	}
+	w := transport.NewFlushWriter(io.Discard, transport.FlushConfig{})
+
+	// Decoding the message allocates it, see TestReaderAllocations in
+	// package packet; routing it to online QoS 0 subscribers and encoding
+	// it for them does not
+	p := packet.NewPublish("a/b", 0, []byte("hello"))
+	conns := s.online.all()
+	var scratch []byte
+	allocs := testing.AllocsPerRun(100, func() {
+		s.route(nil, p)
+		for _, c := range conns {
+			for _, queued := range c.queue {
+				var err error
+				if scratch, err = c.write(w, queued, scratch); err != nil {
+					t.Fatal(err)
+				}
+			}
+			clear(c.queue)
+			c.queue = c.queue[:0]
+		}
+	})
+	assert.Equal(t, 0.0, allocs)
+	assert.Equal(t, int64(202), s.stats.messagesSent)
+}
+
+// waitOffline returns a channel that is closed once no connection of
+// clientID is left
+func waitOffline(s *Server, clientID string) <-chan struct{} {
+	s.mu.Lock()
+	c := s.clients[clientID]
+	s.mu.Unlock()
+	if c == nil {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return c.Done()
+}
+
+func TestServerUnsubscribe(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	defer s.Close() // nolint: errcheck
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(c, &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(packet.ProtocolVersion5),
+			Properties:    &packet.Properties{},
+		},
+		ConnectPayload: packet.ConnectPayload{ClientID: "c1"},
+	}))
+	_, err = packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+
+	require.NoError(t, packet.WritePacket(c, &packet.SubscribeControlPacket{
+		VariableHeader: packet.SubscribeVariableHeader{PacketID: 1, Properties: &packet.Properties{}},
+		Payload:        packet.SubscribePayload{Subscriptions: []packet.Subscription{{Topic: "a/+"}, {Topic: "b"}}},
+	}))
+	_, err = packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+
+	unsubscribe := packet.NewUnsubscribe(2, []string{"a/+", "c", "$share/g", "a+"})
+	unsubscribe.VariableHeader.Properties = &packet.Properties{}
+	require.NoError(t, packet.WritePacket(c, unsubscribe))
+	resp, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.UnsubAckControlPacket{}, resp)
+	unsuback := resp.(*packet.UnsubAckControlPacket)
+	assert.Equal(t, uint16(2), unsuback.VariableHeader.PacketID)
+	assert.Equal(t, []byte{
+		packet.ReasonCodeSuccess,
+		packet.ReasonCodeNoSubscriptionExisted,
+		packet.ReasonCodeTopicFilterInvalid,
+		packet.ReasonCodeTopicFilterInvalid,
+	}, unsuback.Payload.ReasonCodes)
+
+	// Only the remaining subscription receives messages
+	for _, name := range []string{"a/1", "b"} {
+		p := packet.NewPublish(name, 0, []byte(name))
+		p.VariableHeader.Properties = &packet.Properties{}
+		require.NoError(t, packet.WritePacket(c, p))
+	}
+	resp, err = packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.PublishControlPacket{}, resp)
+	assert.Equal(t, "b", resp.(*packet.PublishControlPacket).VariableHeader.Topic)
+
+	sess, ok := s.Sessions.Get("c1")
+	require.True(t, ok)
+	assert.Equal(t, []packet.Subscription{{Topic: "b"}}, sess.Subscriptions())
+}
+
+func TestServerTopicAliases(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{TopicAliasMaximum: 2}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(c, &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(packet.ProtocolVersion5),
+			Properties:    &packet.Properties{TopicAliasMaximum: packet.Uint16(1)},
+		},
+		ConnectPayload: packet.ConnectPayload{ClientID: "c1"},
+	}))
+	// Read without packet.Reader, which would resolve the aliases
+	p, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	assert.Equal(t, packet.Uint16(2), p.(*packet.ConnAckControlPacket).VariableHeader.Properties.TopicAliasMaximum)
+
+	require.NoError(t, packet.WritePacket(c, &packet.SubscribeControlPacket{
+		VariableHeader: packet.SubscribeVariableHeader{PacketID: 1, Properties: &packet.Properties{}},
+		Payload:        packet.SubscribePayload{Subscriptions: []packet.Subscription{{Topic: "a/#"}}},
+	}))
+	_, err = packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+
+	// The client sets alias 2 and uses it, the server uses its own alias
+	// 1 for the messages it sends back
+	for _, topic := range []string{"a/b", ""} {
+		p := packet.NewPublish(topic, 0, []byte("x"))
+		p.VariableHeader.Properties = &packet.Properties{TopicAlias: packet.Uint16(2)}
+		require.NoError(t, packet.WritePacket(c, p))
+	}
+	for _, topic := range []string{"a/b", ""} {
+		p, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+		require.NoError(t, err)
+		publish := p.(*packet.PublishControlPacket)
+		assert.Equal(t, topic, publish.VariableHeader.Topic)
+		assert.Equal(t, packet.Uint16(1), publish.VariableHeader.Properties.TopicAlias)
+	}
+
+	p = packet.NewPublish("a/b", 0, nil)
+	p.(*packet.PublishControlPacket).VariableHeader.Properties = &packet.Properties{TopicAlias: packet.Uint16(3)}
+	require.NoError(t, packet.WritePacket(c, p))
+	p, err = packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.DisconnectControlPacket{}, p)
+	assert.Equal(t, packet.ReasonCodeTopicAliasInvalid, p.(*packet.DisconnectControlPacket).VariableHeader.ReasonCode)
+}
+
+func TestServerRetainAsPublished(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+	addr := l.Addr().String()
+
+	subscribe5 := func(c net.Conn, subs ...packet.Subscription) {
+		require.NoError(t, packet.WritePacket(c, &packet.SubscribeControlPacket{
+			VariableHeader: packet.SubscribeVariableHeader{PacketID: 1, Properties: &packet.Properties{}},
+			Payload:        packet.SubscribePayload{Subscriptions: subs},
+		}))
+		p, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+		require.NoError(t, err)
+		require.IsType(t, &packet.SubAckControlPacket{}, p)
+	}
+	rap, _ := connectV5(t, addr, "rap")
+	defer rap.Close() // nolint: errcheck
+	subscribe5(rap,
+		packet.Subscription{Topic: "t", QoS: packet.QoSLevelAtLeastOnce, RetainAsPublished: true},
+		packet.Subscription{Topic: "$share/g/s", QoS: packet.QoSLevelAtLeastOnce, RetainAsPublished: true})
+	plain, _ := connectV5(t, addr, "plain")
+	defer plain.Close() // nolint: errcheck
+	subscribe5(plain, packet.Subscription{Topic: "t", QoS: packet.QoSLevelAtLeastOnce})
+
+	pub, _ := connectV5(t, addr, "pub")
+	defer pub.Close() // nolint: errcheck
+	for _, qos := range []packet.QosLevel{packet.QoSLevelNone, packet.QoSLevelAtLeastOnce} {
+		for _, name := range []string{"t", "s"} {
+			p := packet.NewPublish(name, 0, []byte("x"))
+			p.FixedHeaderFlags = packet.PublishHeaderFlags{QoS: qos, Retain: true}
+			if qos > 0 {
+				p.VariableHeader.PacketID = 1
+			}
+			p.VariableHeader.Properties = &packet.Properties{}
+			require.NoError(t, packet.WritePacket(pub, p))
+			if qos > 0 {
+				_, err := packet.ReadPacketVersion(pub, packet.ProtocolVersion5)
+				require.NoError(t, err)
+			}
+
+			got, err := packet.ReadPacketVersion(rap, packet.ProtocolVersion5)
+			require.NoError(t, err)
+			assert.Equal(t, name, got.(*packet.PublishControlPacket).VariableHeader.Topic)
+			assert.True(t, got.(*packet.PublishControlPacket).FixedHeaderFlags.Retain, "qos %d", qos)
+		}
+		got, err := packet.ReadPacketVersion(plain, packet.ProtocolVersion5)
+		require.NoError(t, err)
+		assert.False(t, got.(*packet.PublishControlPacket).FixedHeaderFlags.Retain, "qos %d", qos)
+	}
+}
+
+func TestServerReceiveMaximum(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{ReceiveMaximum: 1}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(c, &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(packet.ProtocolVersion5),
+			Properties:    &packet.Properties{ReceiveMaximum: packet.Uint16(1)},
+		},
+		ConnectPayload: packet.ConnectPayload{ClientID: "c1"},
+	}))
+	p, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	assert.Equal(t, packet.Uint16(1), p.(*packet.ConnAckControlPacket).VariableHeader.Properties.ReceiveMaximum)
+	require.NoError(t, packet.WritePacket(c, &packet.SubscribeControlPacket{
+		VariableHeader: packet.SubscribeVariableHeader{PacketID: 1, Properties: &packet.Properties{}},
+		Payload:        packet.SubscribePayload{Subscriptions: []packet.Subscription{{Topic: "a", QoS: packet.QoSLevelAtLeastOnce}}},
+	}))
+	_, err = packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+
+	// Only one message is in flight to the client at a time
+	for i := 0; i < 2; i++ {
+		p := packet.NewPublish("a", 0, nil)
+		p.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+		s.route(nil, p)
+	}
+	for i := 0; i < 2; i++ {
+		p, err := packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+		require.NoError(t, err)
+		require.IsType(t, &packet.PublishControlPacket{}, p)
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+		_, err = packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+		assert.Error(t, err, "message sent beyond the receive maximum")
+		require.NoError(t, c.SetReadDeadline(time.Time{}))
+		puback := packet.NewPubAckControlPacket(uint16(p.(*packet.PublishControlPacket).VariableHeader.PacketID))
+		puback.VariableHeader.Properties = &packet.Properties{}
+		require.NoError(t, packet.WritePacket(c, puback))
+	}
+
+	// The client may not have more than one QoS 2 message in flight
+	for id := uint16(1); id <= 2; id++ {
+		p := packet.NewPublish("b", id, nil)
+		p.FixedHeaderFlags.QoS = packet.QoSLevelExactlyOnce
+		p.VariableHeader.Properties = &packet.Properties{}
+		require.NoError(t, packet.WritePacket(c, p))
+	}
+	p, err = packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	assert.IsType(t, &packet.PubrecControlPacket{}, p)
+	p, err = packet.ReadPacketVersion(c, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.DisconnectControlPacket{}, p)
+	assert.Equal(t, packet.ReasonCodeReceiveMaximumExceeded, p.(*packet.DisconnectControlPacket).VariableHeader.ReasonCode)
+}
@@ -0,0 +1,167 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// Topics the broker statistics are published to, see Server.SysInterval
+const (
+	SysUptime           = "$SYS/broker/uptime"
+	SysClientsConnected = "$SYS/broker/clients/connected"
+	SysMessagesReceived = "$SYS/broker/messages/received"
+	SysMessagesSent     = "$SYS/broker/messages/sent"
+	SysBytesReceived    = "$SYS/broker/bytes/received"
+	SysBytesSent        = "$SYS/broker/bytes/sent"
+	SysRetainedCount    = "$SYS/broker/retained messages/count"
+	// SysRetainedBytes is only published for a CountingRetainStore
+	SysRetainedBytes = "$SYS/broker/retained messages/bytes"
+)
+
+// stats are the counters behind the $SYS topics. They are updated
+// atomically.
+type stats struct {
+	messagesReceived int64
+	messagesSent     int64
+	bytesReceived    int64
+	bytesSent        int64
+}
+
+// countingConn counts the bytes read from and written to a connection
+type countingConn struct {
+	net.Conn
+	s *Server
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.s.stats.bytesReceived, int64(n))
+	if m := c.s.Metrics; m != nil && n > 0 {
+		m.BytesReceived(n)
+	}
+	return n, err
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.s.stats.bytesSent, int64(n))
+	if m := c.s.Metrics; m != nil && n > 0 {
+		m.BytesSent(n)
+	}
+	return n, err
+}
+
+// startSys records the start of the server and starts expiring sessions,
+// publishing the statistics and sampling the runtime. It is a no-op after
+// the first call or once the server was closed.
+func (s *Server) startSys() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.quit != nil {
+		return
+	}
+	s.started = time.Now()
+	s.quit = make(chan struct{})
+	s.wg.Add(1)
+	go s.expiryLoop(s.quit)
+	if s.SysInterval > 0 {
+		s.wg.Add(1)
+		go s.sysLoop(s.quit)
+	}
+	if s.RuntimeStatsInterval > 0 && s.Metrics != nil {
+		s.wg.Add(1)
+		go s.runtimeLoop(s.quit)
+	}
+}
+
+func (s *Server) sysLoop(quit chan struct{}) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.SysInterval)
+	defer ticker.Stop()
+
+	s.publishSys()
+	for {
+		select {
+		case <-ticker.C:
+			s.publishSys()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// publishSys publishes the current statistics as retained messages, and
+// those of every tenant to its namespace
+func (s *Server) publishSys() {
+	s.mu.Lock()
+	uptime := int64(time.Since(s.started) / time.Second)
+	connected := int64(len(s.clients))
+	s.mu.Unlock()
+
+	var retained, retainedBytes int64 = -1, -1
+	// $SYS topics don't match #, so the statistics don't count themselves
+	if counting, ok := s.retainStore().(CountingRetainStore); ok {
+		stats := counting.Stats()
+		retained, retainedBytes = int64(stats.Messages), stats.Bytes
+	} else if messages, err := s.retainStore().Match("#"); err == nil {
+		retained = int64(len(messages))
+	} else {
+		s.log(logger.LevelError, "store: failed to count retained messages", logger.F("error", err))
+	}
+
+	s.publishStats("", []sysValue{
+		{SysUptime, uptime},
+		{SysClientsConnected, connected},
+		{SysMessagesReceived, atomic.LoadInt64(&s.stats.messagesReceived)},
+		{SysMessagesSent, atomic.LoadInt64(&s.stats.messagesSent)},
+		{SysBytesReceived, atomic.LoadInt64(&s.stats.bytesReceived)},
+		{SysBytesSent, atomic.LoadInt64(&s.stats.bytesSent)},
+		{SysRetainedCount, retained},
+		{SysRetainedBytes, retainedBytes},
+	})
+	s.publishTenantSys(uptime)
+}
+
+// sysValue is a statistic of a $SYS topic, not published if negative
+type sysValue struct {
+	topic string
+	value int64
+}
+
+// publishStats publishes values as retained messages, with prefix before
+// their topics
+func (s *Server) publishStats(prefix string, values []sysValue) {
+	for _, v := range values {
+		if v.value < 0 {
+			continue
+		}
+		p := packet.NewPublish(prefix+v.topic, 0, []byte(strconv.FormatInt(v.value, 10)))
+		p.FixedHeaderFlags.Retain = true
+		if err := s.retainStore().Retain(p); err != nil {
+			s.log(logger.LevelError, "broker: failed to publish statistics", logger.F("topic", p.VariableHeader.Topic), logger.F("error", err))
+		}
+		s.route(nil, p)
+	}
+}
@@ -0,0 +1,85 @@
+package broker
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerSys(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{SysInterval: 10 * time.Millisecond}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	c, _ := dialAndConnect(t, l.Addr().String(), "stats")
+	defer c.Close() // nolint: errcheck
+	retained := packet.NewPublish("a", 0, []byte("x"))
+	retained.FixedHeaderFlags.Retain = true
+	require.NoError(t, packet.WritePacket(c, retained))
+	require.NoError(t, packet.WritePacket(c, packet.NewPingReqControlPacket()))
+	_, err = packet.ReadPacket(c)
+	require.NoError(t, err)
+
+	values := func() map[string]string {
+		messages, err := s.retainStore().Match("$SYS/#")
+		require.NoError(t, err)
+		values := make(map[string]string)
+		for _, p := range messages {
+			values[p.VariableHeader.Topic] = string(p.Payload)
+		}
+		return values
+	}
+	deadline := time.Now().Add(time.Second)
+	for values()[SysMessagesReceived] != "1" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	v := values()
+	assert.Equal(t, "1", v[SysClientsConnected])
+	assert.Equal(t, "1", v[SysMessagesReceived])
+	assert.Equal(t, "0", v[SysMessagesSent])
+	assert.Equal(t, "1", v[SysRetainedCount])
+	assert.Equal(t, "2", v[SysRetainedBytes], "topic a and payload x")
+	assert.NotEqual(t, "0", v[SysBytesReceived])
+	assert.NotEqual(t, "0", v[SysBytesSent])
+	assert.Contains(t, v, SysUptime)
+}
+
+func TestServerRuntimeStats(t *testing.T) {
+	s := &Server{Sessions: session.NewManager()}
+	c := newConn(s, nil)
+	c.clientID, c.sessionID = "slow", "slow"
+	s.online.add(c)
+	require.NoError(t, c.WritePacket(packet.NewPingRespControlPacket()))
+	sess, _, err := s.Sessions.Open("offline", false)
+	require.NoError(t, err)
+	sess.Outbound.SetWindow(1)
+	for i := 0; i < 3; i++ {
+		p := packet.NewPublish("a", 0, nil)
+		p.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+		_, err := sess.Outbound.Push(p)
+		require.NoError(t, err)
+	}
+
+	runtime.GC()
+	stats, numGC := s.runtimeStats(0)
+	assert.Positive(t, stats.Goroutines)
+	assert.Positive(t, stats.HeapAlloc)
+	assert.NotEmpty(t, stats.GCPauses)
+	assert.Equal(t, map[string]int{QueueOutbound: 1, QueueInflight: 1, QueueSession: 2}, stats.Queues)
+
+	// Only the collections since the previous sample
+	stats, _ = s.runtimeStats(numGC)
+	assert.Empty(t, stats.GCPauses)
+	runtime.GC()
+	stats, _ = s.runtimeStats(numGC)
+	assert.Len(t, stats.GCPauses, 1)
+}
@@ -0,0 +1,258 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+	"github.com/infinimesh/mqtt-go/topic"
+)
+
+// TenantPrefix starts the namespace of every tenant: topic t of the
+// clients of tenant acme is $tenants/acme/t inside the broker, see
+// Server.Tenant
+const TenantPrefix = "$tenants/"
+
+var errTenantClientID = errors.New("broker: client identifier of a client without tenant in the namespace of tenants")
+
+// tenantStats are the counters behind the $SYS topics of a tenant. They
+// are updated atomically.
+type tenantStats struct {
+	messagesReceived int64
+	messagesSent     int64
+}
+
+// ValidateTenant checks that name can be the name of a tenant: a single
+// topic level
+func ValidateTenant(name string) error {
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("broker: invalid tenant %q: contains /", name)
+	}
+	if err := packet.ValidateTopicName(name); err != nil {
+		return fmt.Errorf("broker: invalid tenant %q: %w", name, err)
+	}
+	return nil
+}
+
+// Tenant returns the tenant the client is bound to, empty if it has none
+func (c *Conn) Tenant() string {
+	return c.tenant
+}
+
+// namespace returns the prefix of the topics of c, empty if it has no
+// tenant
+func (c *Conn) namespace() string {
+	if c.tenant == "" {
+		return ""
+	}
+	return TenantPrefix + c.tenant + "/"
+}
+
+// bindTenant binds an authenticated client to the tenant Server.Tenant
+// returns for it. The session and the will of the client move to the
+// namespace of the tenant.
+func (c *Conn) bindTenant() error {
+	if c.server.Tenant == nil {
+		return nil
+	}
+	tenant, err := c.server.Tenant(c)
+	if err != nil {
+		return err
+	}
+	if tenant == "" {
+		// It would take over the session of a client of a tenant
+		if strings.HasPrefix(c.clientID, TenantPrefix) {
+			return errTenantClientID
+		}
+		return nil
+	}
+	if err := ValidateTenant(tenant); err != nil {
+		return err
+	}
+	c.tenant = tenant
+	c.tenantStats = c.server.tenantStats(tenant)
+	c.sessionID = c.namespace() + c.clientID
+	if c.connect.VariableHeader.ConnectFlags.WillFlag {
+		c.connect.ConnectPayload.WillTopic = c.namespace() + c.connect.ConnectPayload.WillTopic
+	}
+	return nil
+}
+
+// scope moves the topics of a packet read from c to the namespace of its
+// tenant. Invalid topic filters are left alone to be refused.
+func (c *Conn) scope(p packet.ControlPacket) {
+	ns := c.namespace()
+	if ns == "" {
+		return
+	}
+	switch p := p.(type) {
+	case *packet.PublishControlPacket:
+		p.VariableHeader.Topic = ns + p.VariableHeader.Topic
+	case *packet.SubscribeControlPacket:
+		for i, sub := range p.Payload.Subscriptions {
+			p.Payload.Subscriptions[i].Topic = scopeFilter(ns, sub.Topic)
+		}
+	case *packet.UnsubscribeControlPacket:
+		for i, filter := range p.Payload.Topics {
+			p.Payload.Topics[i] = scopeFilter(ns, filter)
+		}
+	}
+}
+
+// scopeFilter moves filter to the namespace ns. Shared subscriptions
+// keep their share name, so that tenants can't join each other's.
+func scopeFilter(ns, filter string) string {
+	if !topic.ValidFilter(filter) {
+		return filter
+	}
+	if name, f, shared := topic.ParseShared(filter); shared {
+		return topic.SharePrefix + name + "/" + ns + f
+	}
+	return ns + filter
+}
+
+// unscope returns p with the namespace of the tenant of c removed from
+// its topic, for writing it to c
+func (c *Conn) unscope(p packet.ControlPacket) packet.ControlPacket {
+	ns := c.namespace()
+	if ns == "" {
+		return p
+	}
+	if publish, ok := p.(*packet.PublishControlPacket); ok && strings.HasPrefix(publish.VariableHeader.Topic, ns) {
+		cp := *publish
+		cp.VariableHeader.Topic = publish.VariableHeader.Topic[len(ns):]
+		return &cp
+	}
+	return p
+}
+
+// outside reports whether c has a tenant and name is not in its
+// namespace, so that the message must not reach c
+func (c *Conn) outside(name string) bool {
+	if ns := c.namespace(); ns != "" && !strings.HasPrefix(name, ns) {
+		c.log(logger.LevelDebug, "broker: message outside the namespace of the tenant dropped", logger.F("topic", name))
+		return true
+	}
+	return false
+}
+
+// tenantStats returns the counters of tenant
+func (s *Server) tenantStats(tenant string) *tenantStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tenants == nil {
+		s.tenants = make(map[string]*tenantStats)
+	}
+	stats := s.tenants[tenant]
+	if stats == nil {
+		stats = &tenantStats{}
+		s.tenants[tenant] = stats
+	}
+	return stats
+}
+
+// tenantLocal splits a topic or filter of the namespace of a tenant into
+// the tenant and the topic its clients use
+func tenantLocal(name string) (tenant, local string, ok bool) {
+	if _, f, shared := topic.ParseShared(name); shared {
+		name = f
+	}
+	rest, ok := strings.CutPrefix(name, TenantPrefix)
+	if !ok {
+		return "", "", false
+	}
+	tenant, local, ok = strings.Cut(rest, "/")
+	return tenant, local, ok
+}
+
+// masked reports whether filter matches name only through the namespace
+// of a tenant: wildcards don't match topics starting with $
+// [MQTT-4.7.2-1], like the $SYS topics of a tenant, but the namespace
+// hides the $ from the subscription tree and the RetainStore.
+func masked(filter, name string) bool {
+	_, local, ok := tenantLocal(name)
+	if !ok || !strings.HasPrefix(local, "$") {
+		return false
+	}
+	_, localFilter, ok := tenantLocal(filter)
+	return !ok || !topic.Matches(localFilter, local)
+}
+
+// hidden reports whether the message on name must not reach the session
+// of sessionID although its subscriptions matched, see masked
+func hidden(sessions *session.Manager, sessionID, name string) bool {
+	if _, local, ok := tenantLocal(name); !ok || !strings.HasPrefix(local, "$") {
+		return false
+	}
+	sess, ok := sessions.Get(sessionID)
+	if !ok {
+		return true
+	}
+	for _, sub := range sess.Subscriptions() {
+		if !masked(sub.Topic, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// publishTenantSys publishes the statistics of every tenant to the $SYS
+// topics of its namespace
+func (s *Server) publishTenantSys(uptime int64) {
+	s.mu.Lock()
+	tenants := make(map[string]*tenantStats, len(s.tenants))
+	connected := make(map[string]int64, len(s.tenants))
+	for name, stats := range s.tenants {
+		tenants[name] = stats
+	}
+	for _, c := range s.clients {
+		if c.tenant != "" {
+			connected[c.tenant]++
+		}
+	}
+	s.mu.Unlock()
+
+	for name, stats := range tenants {
+		ns := TenantPrefix + name + "/"
+		var retained int64 = -1
+		if messages, err := s.retainStore().Match(ns + "#"); err == nil {
+			retained = 0
+			for _, p := range messages {
+				// Not counting the statistics themselves
+				if !strings.HasPrefix(p.VariableHeader.Topic[len(ns):], "$") {
+					retained++
+				}
+			}
+		} else {
+			s.log(logger.LevelError, "store: failed to count retained messages", logger.F("tenant", name), logger.F("error", err))
+		}
+		s.publishStats(ns, []sysValue{
+			{SysUptime, uptime},
+			{SysClientsConnected, connected[name]},
+			{SysMessagesReceived, atomic.LoadInt64(&stats.messagesReceived)},
+			{SysMessagesSent, atomic.LoadInt64(&stats.messagesSent)},
+			{SysRetainedCount, retained},
+		})
+	}
+}
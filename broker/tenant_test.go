@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// connectAs connects clientID as userName, with a will on willTopic if
+// not empty, and returns the return code of CONNACK
+func connectAs(t *testing.T, addr, clientID, userName, willTopic string) (net.Conn, byte) {
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	connect := &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(packet.ProtocolVersion311),
+			ConnectFlags:  packet.ConnectFlags{UserName: true, WillFlag: willTopic != ""},
+		},
+		ConnectPayload: packet.ConnectPayload{ClientID: clientID, UserName: userName, WillTopic: willTopic},
+	}
+	require.NoError(t, packet.WritePacket(c, connect))
+	p, err := packet.ReadPacket(c)
+	require.NoError(t, err)
+	return c, p.(*packet.ConnAckControlPacket).VariableHeader.ReturnCode
+}
+
+// nextPublish returns the next message to c, nil if none arrives soon
+func nextPublish(t *testing.T, c net.Conn) *packet.PublishControlPacket {
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	defer c.SetReadDeadline(time.Time{}) // nolint: errcheck
+	p, err := packet.ReadPacket(c)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil
+	}
+	require.NoError(t, err)
+	return p.(*packet.PublishControlPacket)
+}
+
+func TestServerTenants(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	defer s.Close() // nolint: errcheck
+	s.Tenant = func(c *Conn) (string, error) {
+		return map[string]string{"alice": "acme", "bob": "globex", "eve": "a/b"}[c.Connect().ConnectPayload.UserName], nil
+	}
+
+	// The same client identifier in two tenants is two clients
+	acme, code := connectAs(t, addr, "dev", "alice", "status")
+	require.Zero(t, code)
+	defer acme.Close() // nolint: errcheck
+	globex, code := connectAs(t, addr, "dev", "bob", "")
+	require.Zero(t, code)
+	defer globex.Close() // nolint: errcheck
+	ops, code := connectAs(t, addr, "ops", "carol", "")
+	require.Zero(t, code)
+	defer ops.Close() // nolint: errcheck
+	_, code = connectAs(t, addr, TenantPrefix+"acme/dev", "carol", "")
+	assert.Equal(t, packet.ConnAckNotAuthorized, code, "taking over the session of a tenant")
+	_, code = connectAs(t, addr, "dev", "eve", "")
+	assert.Equal(t, packet.ConnAckNotAuthorized, code, "invalid tenant")
+
+	clients := s.Clients()
+	require.Len(t, clients, 3)
+	assert.Equal(t, []string{"acme", "globex", ""}, []string{clients[0].Tenant, clients[1].Tenant, clients[2].Tenant})
+
+	subscribe(t, acme, 1, packet.Subscription{Topic: "#"})
+	subscribe(t, globex, 1, packet.Subscription{Topic: "#"})
+	subscribe(t, ops, 1, packet.Subscription{Topic: TenantPrefix + "+/t"})
+
+	msg := packet.NewPublish("t", 0, []byte("from globex"))
+	msg.FixedHeaderFlags.Retain = true
+	require.NoError(t, packet.WritePacket(globex, msg))
+	p := nextPublish(t, globex)
+	require.NotNil(t, p)
+	assert.Equal(t, "t", p.VariableHeader.Topic)
+	p = nextPublish(t, ops)
+	require.NotNil(t, p)
+	assert.Equal(t, TenantPrefix+"globex/t", p.VariableHeader.Topic)
+	assert.Nil(t, nextPublish(t, acme), "crossed tenants")
+
+	// Retained messages and wills stay in their tenant as well
+	late, code := connectAs(t, addr, "late", "alice", "")
+	require.Zero(t, code)
+	defer late.Close() // nolint: errcheck
+	subscribe(t, late, 1, packet.Subscription{Topic: "#"})
+	assert.Nil(t, nextPublish(t, late), "retained message of another tenant")
+	require.NoError(t, acme.Close())
+	p = nextPublish(t, late)
+	require.NotNil(t, p)
+	assert.Equal(t, "status", p.VariableHeader.Topic)
+	assert.Nil(t, nextPublish(t, globex))
+
+	// Statistics go to the $SYS topics of the tenant, which # doesn't match
+	subscribe(t, late, 2, packet.Subscription{Topic: "$SYS/broker/clients/connected"})
+	require.Eventually(t, func() bool { return len(s.Clients()) == 3 }, 5*time.Second, 10*time.Millisecond)
+	s.publishSys()
+	p = nextPublish(t, late)
+	require.NotNil(t, p)
+	assert.Equal(t, SysClientsConnected, p.VariableHeader.Topic)
+	assert.Equal(t, "1", string(p.Payload))
+	assert.Nil(t, nextPublish(t, late))
+	assert.Nil(t, nextPublish(t, globex))
+	subscribe(t, late, 3, packet.Subscription{Topic: "#"})
+	assert.Nil(t, nextPublish(t, late), "retained statistics")
+}
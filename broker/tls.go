@@ -0,0 +1,57 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// ListenTLS listens on addr, ":8883" if empty, and serves TLS connections
+// until Close. Set cfg.ClientAuth to tls.RequireAndVerifyClientCert for
+// mutual TLS; the client certificate is then available to the
+// Authenticator through Conn.PeerCertificates.
+func (s *Server) ListenTLS(addr string, cfg *tls.Config) error {
+	if addr == "" {
+		addr = ":8883"
+	}
+	l, err := tls.Listen("tcp", addr, cfg)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// PeerCertificates returns the certificate chain the client presented,
+// leaf first. It is nil for connections without TLS or client
+// certificate.
+func (c *Conn) PeerCertificates() []*x509.Certificate {
+	if tc, ok := c.rwc.(*tls.Conn); ok {
+		return tc.ConnectionState().PeerCertificates
+	}
+	return nil
+}
+
+// CertificateCommonName returns the Common Name of the client
+// certificate, or "" if the client presented none
+func (c *Conn) CertificateCommonName() string {
+	if certs := c.PeerCertificates(); len(certs) > 0 {
+		return certs[0].Subject.CommonName
+	}
+	return ""
+}
@@ -0,0 +1,94 @@
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// issue creates a certificate for cn, signed by parent or self-signed if
+// parent is nil
+func issue(t *testing.T, cn string, parent *tls.Certificate, isCA bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestServerMutualTLS(t *testing.T) {
+	ca := issue(t, "ca", nil, true)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{issue(t, "server", &ca, false)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	require.NoError(t, err)
+
+	// The certificate decides which client identifier may be used
+	s := &Server{Authenticator: AuthenticatorFunc(func(c *Conn) error {
+		if c.CertificateCommonName() != c.ClientID() {
+			return ErrNotAuthorized
+		}
+		return nil
+	})}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	clientCert := issue(t, "device-1", &ca, false)
+	for clientID, expected := range map[string]byte{
+		"device-1": packet.ConnAckAccepted,
+		"device-2": packet.ConnAckNotAuthorized,
+	} {
+		c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+			RootCAs:      pool,
+		})
+		require.NoError(t, err)
+
+		require.NoError(t, packet.WritePacket(c, &packet.ConnectControlPacket{
+			VariableHeader: packet.ConnectVariableHeader{
+				ProtocolName:  "MQTT",
+				ProtocolLevel: byte(packet.ProtocolVersion311),
+			},
+			ConnectPayload: packet.ConnectPayload{ClientID: clientID},
+		}))
+		p, err := packet.ReadPacket(c)
+		require.NoError(t, err)
+		assert.Equal(t, expected, p.(*packet.ConnAckControlPacket).VariableHeader.ReturnCode, clientID)
+		require.NoError(t, c.Close())
+	}
+}
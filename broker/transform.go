@@ -0,0 +1,82 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"strings"
+
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// Transformer rewrites the messages clients publish before they are
+// routed, e.g. to convert units, upgrade the schema of payloads or scrub
+// personal data. Transformers run in the order of Server.Transformers
+// once the Authorizer allowed the topic the client published to, before
+// the OnPublish hooks; the hooks, the RetainStore, the Handler and the
+// subscribers see the transformed message only. A message moved to
+// another topic is authorized for it again and must stay in the
+// namespace of the tenant of the client.
+type Transformer interface {
+	// Transform may modify the topic, the payload and the properties of
+	// p. An error drops the message like OnPublish does.
+	Transform(c *Conn, p *packet.PublishControlPacket) error
+}
+
+// TransformerFunc adapts an ordinary function to the Transformer
+// interface
+type TransformerFunc func(c *Conn, p *packet.PublishControlPacket) error
+
+func (f TransformerFunc) Transform(c *Conn, p *packet.PublishControlPacket) error {
+	return f(c, p)
+}
+
+// transform runs the Transformers of the server on a PUBLISH of c and
+// returns the reason code of the acknowledgement
+func (c *Conn) transform(p *packet.PublishControlPacket) byte {
+	if len(c.server.Transformers) == 0 {
+		return packet.ReasonCodeSuccess
+	}
+	name := p.VariableHeader.Topic
+	for _, t := range c.server.Transformers {
+		if err := t.Transform(c, p); err != nil {
+			c.log(logger.LevelDebug, "broker: message rejected by transformer", logger.F("topic", name), logger.F("error", err))
+			c.drop(p, DropRejected)
+			return hookReasonCode(err)
+		}
+	}
+	moved := p.VariableHeader.Topic
+	if moved == name {
+		return packet.ReasonCodeSuccess
+	}
+	if err := packet.ValidateTopicName(moved); err != nil {
+		c.log(logger.LevelInfo, "broker: message moved to an invalid topic", logger.F("topic", name), logger.F("error", err))
+		c.drop(p, DropRejected)
+		return packet.ReasonCodeTopicNameInvalid
+	}
+	if ns := c.namespace(); ns != "" && !strings.HasPrefix(moved, ns) {
+		c.log(logger.LevelInfo, "broker: message moved outside the namespace of the tenant", logger.F("topic", name), logger.F("to", moved))
+		c.drop(p, DropNotAuthorized)
+		return packet.ReasonCodeNotAuthorized
+	}
+	if !c.authorize(moved, ActionPublish) {
+		c.drop(p, DropNotAuthorized)
+		return packet.ReasonCodeNotAuthorized
+	}
+	return packet.ReasonCodeSuccess
+}
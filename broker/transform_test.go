@@ -0,0 +1,120 @@
+package broker
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// topicHook reports the topics of the messages it sees
+type topicHook struct {
+	NopHook
+	topics chan string
+}
+
+func (h topicHook) OnPublish(c *Conn, p *packet.PublishControlPacket) error {
+	h.topics <- p.VariableHeader.Topic
+	return nil
+}
+
+func TestServerTransformers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	hook := topicHook{topics: make(chan string, 10)}
+	s := &Server{
+		Authorizer: AuthorizerFunc(func(clientID, userName, topic string, action Action) error {
+			if topic == "secret" {
+				return ErrNotAuthorized
+			}
+			return nil
+		}),
+		Transformers: []Transformer{
+			// Fahrenheit to Celsius
+			TransformerFunc(func(c *Conn, p *packet.PublishControlPacket) error {
+				if p.VariableHeader.Topic != "temp/f" {
+					return nil
+				}
+				f, err := strconv.Atoi(string(p.Payload))
+				if err != nil {
+					return err
+				}
+				p.VariableHeader.Topic = "temp/c"
+				p.Payload = []byte(strconv.Itoa((f - 32) * 5 / 9))
+				return nil
+			}),
+			TransformerFunc(func(c *Conn, p *packet.PublishControlPacket) error {
+				switch string(p.Payload) {
+				case "leak":
+					p.VariableHeader.Topic = "secret"
+				case "wild":
+					p.VariableHeader.Topic = "temp/+"
+				case "drop":
+					return errors.New("dropped")
+				}
+				return nil
+			}),
+		},
+		Hooks: []Hook{hook},
+	}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	sub, _ := dialAndConnect(t, l.Addr().String(), "sub")
+	defer sub.Close() // nolint: errcheck
+	assert.Equal(t, []byte{0}, subscribe(t, sub, 1, packet.Subscription{Topic: "#"}))
+
+	pub, _ := connectV5(t, l.Addr().String(), "pub")
+	defer pub.Close() // nolint: errcheck
+	for i, tc := range []struct {
+		topic, payload string
+		code           byte
+	}{
+		{"temp/f", "212", packet.ReasonCodeSuccess},
+		{"temp/f", "hot", packet.ReasonCodeImplementationSpecificError},
+		{"other", "leak", packet.ReasonCodeNotAuthorized},
+		{"other", "wild", packet.ReasonCodeTopicNameInvalid},
+		{"other", "drop", packet.ReasonCodeImplementationSpecificError},
+		{"other", "kept", packet.ReasonCodeSuccess},
+	} {
+		publish := packet.NewPublish(tc.topic, uint16(i+1), []byte(tc.payload))
+		publish.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+		publish.FixedHeaderFlags.Retain = true
+		publish.VariableHeader.Properties = &packet.Properties{}
+		require.NoError(t, packet.WritePacket(pub, publish))
+		p, err := packet.ReadPacketVersion(pub, packet.ProtocolVersion5)
+		require.NoError(t, err)
+		require.IsType(t, &packet.PubackControlPacket{}, p)
+		assert.Equal(t, tc.code, p.(*packet.PubackControlPacket).VariableHeader.ReasonCode, tc.payload)
+	}
+
+	// Only the messages let through reach the hooks and the subscribers,
+	// transformed
+	for _, want := range []struct{ topic, payload string }{{"temp/c", "100"}, {"other", "kept"}} {
+		p := nextPublish(t, sub)
+		require.NotNil(t, p)
+		assert.Equal(t, want.topic, p.VariableHeader.Topic)
+		assert.Equal(t, want.payload, string(p.Payload))
+	}
+	assert.Nil(t, nextPublish(t, sub))
+	close(hook.topics)
+	var hooked []string
+	for topic := range hook.topics {
+		hooked = append(hooked, topic)
+	}
+	assert.Equal(t, []string{"temp/c", "other"}, hooked)
+
+	// and are retained transformed
+	late, _ := dialAndConnect(t, l.Addr().String(), "late")
+	defer late.Close() // nolint: errcheck
+	assert.Equal(t, []byte{0}, subscribe(t, late, 1, packet.Subscription{Topic: "temp/#"}))
+	p := nextPublish(t, late)
+	require.NotNil(t, p)
+	assert.Equal(t, "temp/c", p.VariableHeader.Topic)
+	assert.Equal(t, "100", string(p.Payload))
+}
@@ -0,0 +1,96 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"time"
+	"unicode/utf8"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+)
+
+// Translation decides how what only MQTT 5 has is carried between MQTT
+// 3.1 and 3.1.1 clients on one side and MQTT 5 clients on the other. The
+// codec already drops the properties of the packets for the former and
+// translates the reason codes, see packet.Adapt; the messages of MQTT 3.1
+// and 3.1.1 publishers, and others without properties like those of
+// $SYS, reach MQTT 5 clients without properties. Features
+// without a counterpart, like the response topic of a request, are lost
+// on the way to MQTT 3.1.1 clients. The zero value adds nothing.
+type Translation struct {
+	// SessionExpiry is how long the persistent session of an MQTT 3.1 or
+	// 3.1.1 client, one that connected without CleanSession, is kept once
+	// its connection ended. Forever if 0, as MQTT 3.1.1 has it.
+	SessionExpiry time.Duration
+	// ContentType is given to the messages of MQTT 3.1 and 3.1.1
+	// publishers delivered to MQTT 5 clients, like application/json for
+	// devices that all send JSON
+	ContentType string
+	// PayloadFormat marks the messages of MQTT 3.1 and 3.1.1 publishers
+	// delivered to MQTT 5 clients as UTF-8 if their payload is valid
+	// UTF-8 (payload format indicator 1)
+	PayloadFormat bool
+	// Intercept is called with every message delivered across versions
+	// after the above, from the version of the publisher to that of the
+	// subscriber, and may modify p. The properties of p are its own, but
+	// not the slices they hold. Those left in p are dropped for MQTT
+	// 3.1.1 subscribers, but the message expiry interval still applies.
+	Intercept func(from, to packet.ProtocolVersion, p *packet.PublishControlPacket)
+}
+
+// translate adapts p, a copy of a message of a publisher of version from
+// for a subscriber of version to, if their versions differ
+func (t *Translation) translate(from, to packet.ProtocolVersion, p *packet.PublishControlPacket) {
+	if (from == packet.ProtocolVersion5) == (to == packet.ProtocolVersion5) {
+		return
+	}
+	props := packet.Properties{}
+	if p.VariableHeader.Properties != nil {
+		props = *p.VariableHeader.Properties
+	}
+	if to == packet.ProtocolVersion5 {
+		t.synthesize(&props, p.Payload)
+	}
+	p.VariableHeader.Properties = &props
+	if t.Intercept != nil {
+		t.Intercept(from, to, p)
+	}
+}
+
+// synthesize fills in the properties of a message of an MQTT 3.1 or 3.1.1
+// publisher for MQTT 5 clients
+func (t *Translation) synthesize(props *packet.Properties, payload []byte) {
+	if t.ContentType != "" {
+		props.ContentType = t.ContentType
+	}
+	if t.PayloadFormat && utf8.Valid(payload) {
+		props.PayloadFormatIndicator = packet.Byte(1)
+	}
+}
+
+// sessionExpiry is the sessionExpiry of connect but for the persistent
+// sessions of MQTT 3.1 and 3.1.1 clients, which expire after
+// SessionExpiry if set
+func (t *Translation) sessionExpiry(connect *packet.ConnectControlPacket) time.Duration {
+	expiry := sessionExpiry(connect)
+	if connect.Version() != packet.ProtocolVersion5 && expiry == session.NeverExpires && t.SessionExpiry > 0 {
+		return t.SessionExpiry
+	}
+	return expiry
+}
@@ -0,0 +1,85 @@
+package broker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func TestServerTranslation(t *testing.T) {
+	type crossing struct{ from, to packet.ProtocolVersion }
+	crossings := make(chan crossing, 2)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{Translation: Translation{
+		SessionExpiry: time.Hour,
+		ContentType:   "application/json",
+		PayloadFormat: true,
+		Intercept: func(from, to packet.ProtocolVersion, p *packet.PublishControlPacket) {
+			crossings <- crossing{from, to}
+			if rt := p.VariableHeader.Properties.ResponseTopic; rt != "" {
+				p.Payload = append(append(p.Payload, " reply to "...), rt...)
+			}
+		},
+	}}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+	addr := l.Addr().String()
+
+	v3, _ := dialAndConnect(t, addr, "v3")
+	defer v3.Close() // nolint: errcheck
+	sess, ok := s.sessions().Get("v3")
+	require.True(t, ok)
+	assert.Equal(t, time.Hour, sess.Expiry(), "instead of never")
+	v5, _ := connectV5(t, addr, "v5")
+	defer v5.Close() // nolint: errcheck
+	subscribe(t, v3, 1, packet.Subscription{Topic: "to/v3"})
+	require.NoError(t, packet.WritePacket(v5, &packet.SubscribeControlPacket{
+		VariableHeader: packet.SubscribeVariableHeader{PacketID: 1, Properties: &packet.Properties{}},
+		Payload:        packet.SubscribePayload{Subscriptions: []packet.Subscription{{Topic: "to/v5"}}},
+	}))
+	p, err := packet.ReadPacketVersion(v5, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.SubAckControlPacket{}, p)
+
+	require.NoError(t, packet.WritePacket(v3, packet.NewPublish("to/v5", 0, []byte(`{"t": 21}`))))
+	p, err = packet.ReadPacketVersion(v5, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	props := p.(*packet.PublishControlPacket).VariableHeader.Properties
+	assert.Equal(t, "application/json", props.ContentType)
+	assert.Equal(t, packet.Byte(1), props.PayloadFormatIndicator)
+	assert.Equal(t, crossing{packet.ProtocolVersion311, packet.ProtocolVersion5}, <-crossings)
+
+	publish := packet.NewPublish("to/v3", 0, []byte("request"))
+	publish.VariableHeader.Properties = &packet.Properties{ResponseTopic: "replies"}
+	require.NoError(t, packet.WritePacket(v5, publish))
+	p, err = packet.ReadPacket(v3)
+	require.NoError(t, err)
+	assert.Equal(t, "request reply to replies", string(p.(*packet.PublishControlPacket).Payload))
+	assert.Equal(t, crossing{packet.ProtocolVersion5, packet.ProtocolVersion311}, <-crossings)
+}
+
+func TestTranslationSameVersion(t *testing.T) {
+	tr := Translation{
+		ContentType: "text/plain",
+		Intercept:   func(from, to packet.ProtocolVersion, p *packet.PublishControlPacket) { t.Error("intercepted") },
+	}
+	p := packet.NewPublish("a", 0, nil)
+	tr.translate(packet.ProtocolVersion311, packet.ProtocolVersion31, p)
+	assert.Nil(t, p.VariableHeader.Properties)
+
+	props := &packet.Properties{}
+	p.VariableHeader.Properties = props
+	tr.translate(packet.ProtocolVersion5, packet.ProtocolVersion5, p)
+	assert.Same(t, props, p.VariableHeader.Properties)
+
+	// Shared by the subscribers of a version without Intercept
+	f := newFrame(packet.NewPublish("a", 0, nil), true, &Translation{ContentType: "text/plain"})
+	defer f.release()
+	assert.Equal(t, "text/plain", f.VariableHeader.Properties.ContentType)
+}
@@ -0,0 +1,83 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"errors"
+
+	"github.com/infinimesh/mqtt-go/transport"
+)
+
+// Tuning holds the limits of a Server that can be changed while it runs,
+// see Server.Tune. The fields mean what those of the same name in Server
+// do. MaxConnections, ConnectionRate, ConnectionBurst and
+// OutboundQueueSize apply right away, MessageRate, MessageBurst and Flush
+// to the connections accepted afterwards.
+type Tuning struct {
+	MaxConnections    int
+	ConnectionRate    float64
+	ConnectionBurst   int
+	MessageRate       float64
+	MessageBurst      int
+	OutboundQueueSize int
+	Flush             transport.FlushConfig
+}
+
+func (t Tuning) validate() error {
+	if t.MaxConnections < 0 || t.ConnectionRate < 0 || t.ConnectionBurst < 0 ||
+		t.MessageRate < 0 || t.MessageBurst < 0 || t.OutboundQueueSize < 0 ||
+		t.Flush.Interval < 0 || t.Flush.Size < 0 {
+		return errors.New("broker: negative limit")
+	}
+	if t.Flush.Strategy < transport.FlushAdaptive || t.Flush.Strategy > transport.FlushSized {
+		return errors.New("broker: unknown flush strategy")
+	}
+	return nil
+}
+
+// Tuning returns the limits the server currently applies, those of its
+// fields until Tune changed them
+func (s *Server) Tuning() Tuning {
+	return *s.tuned()
+}
+
+// Tune changes the limits of the server while it runs. The fields of the
+// Server keep the values it was configured with.
+func (s *Server) Tune(t Tuning) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	s.tuning.Store(&t)
+	return nil
+}
+
+func (s *Server) tuned() *Tuning {
+	if t := s.tuning.Load(); t != nil {
+		return t
+	}
+	s.tuning.CompareAndSwap(nil, &Tuning{
+		MaxConnections:    s.MaxConnections,
+		ConnectionRate:    s.ConnectionRate,
+		ConnectionBurst:   s.ConnectionBurst,
+		MessageRate:       s.MessageRate,
+		MessageBurst:      s.MessageBurst,
+		OutboundQueueSize: s.OutboundQueueSize,
+		Flush:             s.Flush,
+	})
+	return s.tuning.Load()
+}
@@ -0,0 +1,298 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package broker
+
+import (
+	"errors"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/transport"
+)
+
+// OverflowPolicy decides what happens to a packet written to a client
+// whose outbound queue is full. Only QoS 0 messages are ever dropped: the
+// session marked QoS 1 and 2 ones as sent, and would only retransmit them
+// once the client reconnects. If none can be dropped, the client is
+// disconnected whatever the policy.
+type OverflowPolicy int
+
+const (
+	// OverflowDropNew drops the QoS 0 message being written
+	OverflowDropNew OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest QoS 0 message in the queue to
+	// make room
+	OverflowDropOldest
+	// OverflowDisconnect closes the connection of the client
+	OverflowDisconnect
+	// OverflowDropLowestQoS drops the oldest QoS 0 message, the one being
+	// written included, so that QoS 1 and 2 messages only ever wait
+	OverflowDropLowestQoS
+)
+
+const (
+	defaultOutboundQueueSize = 1024
+	// flushTimeout limits how long a closing connection waits for its
+	// queue to be written, e.g. a refusing CONNACK or a DISCONNECT
+	flushTimeout = 5 * time.Second
+)
+
+var (
+	errConnClosed        = errors.New("broker: connection closed")
+	errOutboundQueueFull = errors.New("broker: outbound queue is full")
+)
+
+// WritePacket queues p to be sent to the client and returns without
+// waiting for the client to read it. p is adapted to the protocol version
+// of the client, see packet.Adapt. See Server.OverflowPolicy for what
+// happens if the client does not keep up.
+func (c *Conn) WritePacket(p packet.ControlPacket) error {
+	p = c.unscope(packet.Adapt(p, c.version))
+	priority := math.MaxInt
+	if publish, ok := publishOf(p); ok && c.server.Priority != nil {
+		priority = c.server.Priority(c, publish)
+	}
+
+	c.qmu.Lock()
+	defer c.qmu.Unlock()
+
+	if c.qclosed {
+		return errConnClosed
+	}
+	if len(c.queue) >= c.server.outboundQueueSize() {
+		switch c.overflow {
+		case OverflowDropNew:
+			if droppable(p) {
+				c.dropQueued(p)
+				return nil
+			}
+		case OverflowDropOldest:
+			for i, queued := range c.queue {
+				if droppable(queued) {
+					c.dropQueued(queued)
+					c.dequeue(i)
+					break
+				}
+			}
+		case OverflowDropLowestQoS:
+			switch i := oldestDroppable(c.queue, p); {
+			case i == len(c.queue):
+				c.dropQueued(p)
+				return nil
+			case i >= 0:
+				c.dropQueued(c.queue[i])
+				c.dequeue(i)
+			}
+		}
+		if len(c.queue) >= c.server.outboundQueueSize() {
+			c.log(logger.LevelWarn, "broker: outbound queue is full, closing connection")
+			c.qclosed = true
+			c.queue, c.priorities = nil, nil
+			c.drain()
+			_ = c.Close()
+			return errOutboundQueueFull
+		}
+	}
+
+	c.enqueue(p, priority)
+	c.qcond.Signal()
+	return nil
+}
+
+// enqueue adds p to the queue. With Server.Priority, a message goes
+// ahead of the queued messages of lower priority, but never ahead of
+// other packets, which get the highest priority.
+func (c *Conn) enqueue(p packet.ControlPacket, priority int) {
+	if c.server.Priority == nil {
+		c.queue = append(c.queue, p)
+		return
+	}
+	i := len(c.queue)
+	if _, ok := publishOf(p); ok {
+		for i > 0 && c.priorities[i-1] < priority {
+			i--
+		}
+	}
+	c.queue = append(c.queue, nil)
+	copy(c.queue[i+1:], c.queue[i:])
+	c.queue[i] = p
+	c.priorities = append(c.priorities, 0)
+	copy(c.priorities[i+1:], c.priorities[i:])
+	c.priorities[i] = priority
+}
+
+// dequeue removes the packet at index i of the queue
+func (c *Conn) dequeue(i int) {
+	c.queue = append(c.queue[:i], c.queue[i+1:]...)
+	if c.priorities != nil {
+		c.priorities = append(c.priorities[:i], c.priorities[i+1:]...)
+	}
+}
+
+// saturated returns a channel that is closed once the writer took the
+// queue, if at least threshold packets are waiting in it. It returns nil
+// otherwise.
+func (c *Conn) saturated(threshold int) <-chan struct{} {
+	c.qmu.Lock()
+	defer c.qmu.Unlock()
+	if c.qclosed || len(c.queue) < threshold {
+		return nil
+	}
+	if c.drained == nil {
+		c.drained = make(chan struct{})
+	}
+	return c.drained
+}
+
+// drain wakes the clients paused by saturated. It is called with c.qmu
+// held.
+func (c *Conn) drain() {
+	if c.drained != nil {
+		close(c.drained)
+		c.drained = nil
+	}
+}
+
+// SetOverflowPolicy overrides Server.OverflowPolicy for the client, e.g.
+// from an Authenticator or an OnConnect hook
+func (c *Conn) SetOverflowPolicy(policy OverflowPolicy) {
+	c.qmu.Lock()
+	c.overflow = policy
+	c.qmu.Unlock()
+}
+
+// oldestDroppable returns the index of the oldest droppable message in
+// queue followed by p, len(queue) standing for p, or -1 if there is none
+func oldestDroppable(queue []packet.ControlPacket, p packet.ControlPacket) int {
+	for i, queued := range queue {
+		if droppable(queued) {
+			return i
+		}
+	}
+	if droppable(p) {
+		return len(queue)
+	}
+	return -1
+}
+
+// droppable reports whether p may be discarded under load, which only
+// holds for QoS 0 messages
+func droppable(p packet.ControlPacket) bool {
+	publish, ok := publishOf(p)
+	return ok && publish.FixedHeaderFlags.QoS == packet.QoSLevelNone
+}
+
+// writeLoop writes the queued packets until the queue was closed and
+// drained, or writing failed. Packets that were queued together are
+// written with a single write to the network, as are those queued
+// shortly after each other if Server.Flush holds them back.
+func (c *Conn) writeLoop() {
+	defer close(c.writerDone)
+
+	w := transport.NewFlushWriter(countingConn{c.rwc, c.server}, c.server.tuned().Flush)
+	var batch []packet.ControlPacket
+	var scratch []byte
+	for {
+		c.qmu.Lock()
+		for len(c.queue) == 0 && !c.qclosed {
+			c.qcond.Wait()
+		}
+		if len(c.queue) == 0 {
+			c.qmu.Unlock()
+			if err := w.Flush(); err != nil {
+				c.writeFailed(err)
+			}
+			return
+		}
+		batch, c.queue = c.queue, batch[:0]
+		c.priorities = c.priorities[:0]
+		c.drain()
+		c.qmu.Unlock()
+
+		for i, p := range batch {
+			batch[i] = nil
+			var err error
+			if scratch, err = c.write(w, p, scratch); err != nil {
+				c.writeFailed(err)
+				return
+			}
+		}
+		if err := w.Idle(); err != nil {
+			c.writeFailed(err)
+			return
+		}
+	}
+}
+
+// write writes p to w. Messages are encoded into scratch, which is
+// returned for the next one unless it grew too large to keep.
+func (c *Conn) write(w *transport.FlushWriter, p packet.ControlPacket, scratch []byte) ([]byte, error) {
+	switch p := p.(type) {
+	case *packet.PublishControlPacket:
+		atomic.AddInt64(&c.server.stats.messagesSent, 1)
+		if c.tenantStats != nil {
+			atomic.AddInt64(&c.tenantStats.messagesSent, 1)
+		}
+		buf, err := c.aliases.Apply(p).AppendEncode(scratch[:0])
+		if err != nil {
+			return scratch, err
+		}
+		if _, err = w.Write(buf); cap(buf) > maxFrameBuffer {
+			buf = nil
+		}
+		return buf, err
+	case *frame:
+		atomic.AddInt64(&c.server.stats.messagesSent, 1)
+		err := packet.WritePacket(w, p)
+		p.release()
+		return scratch, err
+	}
+	return scratch, packet.WritePacket(w, p)
+}
+
+func (c *Conn) writeFailed(err error) {
+	c.qmu.Lock()
+	closed := c.qclosed
+	c.qclosed = true
+	c.queue, c.priorities = nil, nil
+	c.drain()
+	c.qmu.Unlock()
+	if !closed {
+		c.log(logger.LevelWarn, "broker: failed to write", logger.F("error", err))
+	}
+	_ = c.Close()
+}
+
+// flush stops accepting packets and waits until the queued ones are
+// written, at most flushTimeout
+func (c *Conn) flush() {
+	c.qmu.Lock()
+	c.qclosed = true
+	c.qcond.Signal()
+	c.qmu.Unlock()
+
+	timer := time.NewTimer(flushTimeout)
+	defer timer.Stop()
+	select {
+	case <-c.writerDone:
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,158 @@
+package broker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnOverflowPolicy(t *testing.T) {
+	qos0 := func(topic string) packet.ControlPacket {
+		return packet.NewPublish(topic, 0, nil)
+	}
+	qos := func(topic string, qos packet.QosLevel) packet.ControlPacket {
+		p := packet.NewPublish(topic, 1, nil)
+		p.FixedHeaderFlags.QoS = qos
+		return p
+	}
+	ack := packet.NewPubAckControlPacket(1)
+
+	var testCases = []struct {
+		policy   OverflowPolicy
+		written  []packet.ControlPacket
+		queued   []packet.ControlPacket
+		overflow bool
+	}{
+		{OverflowDropNew, []packet.ControlPacket{qos0("a"), qos0("b"), qos0("c")}, []packet.ControlPacket{qos0("a"), qos0("b")}, false},
+		{OverflowDropOldest, []packet.ControlPacket{qos0("a"), qos0("b"), qos0("c")}, []packet.ControlPacket{qos0("b"), qos0("c")}, false},
+		{OverflowDropOldest, []packet.ControlPacket{ack, qos0("b"), qos0("c")}, []packet.ControlPacket{ack, qos0("c")}, false},
+		{OverflowDropNew, []packet.ControlPacket{qos0("a"), qos0("b"), ack}, nil, true},
+		{OverflowDisconnect, []packet.ControlPacket{qos0("a"), qos0("b"), qos0("c")}, nil, true},
+		{OverflowDropLowestQoS, []packet.ControlPacket{qos("a", 2), qos("b", 1), qos0("c")}, []packet.ControlPacket{qos("a", 2), qos("b", 1)}, false},
+		{OverflowDropLowestQoS, []packet.ControlPacket{qos("a", 2), qos0("b"), qos("c", 1)}, []packet.ControlPacket{qos("a", 2), qos("c", 1)}, false},
+		{OverflowDropLowestQoS, []packet.ControlPacket{qos("a", 2), qos0("b"), qos0("c")}, []packet.ControlPacket{qos("a", 2), qos0("c")}, false},
+		// QoS 1 and 2 messages are never dropped
+		{OverflowDropLowestQoS, []packet.ControlPacket{qos("a", 2), qos("b", 1), qos("c", 2)}, nil, true},
+		{OverflowDropLowestQoS, []packet.ControlPacket{ack, ack, ack}, nil, true},
+	}
+
+	for _, tc := range testCases {
+		server, client := net.Pipe()
+		s := &Server{OutboundQueueSize: 2, OverflowPolicy: tc.policy}
+		// No writeLoop runs, so everything stays in the queue
+		c := newConn(s, server)
+
+		var err error
+		for _, p := range tc.written {
+			err = c.WritePacket(p)
+		}
+		if tc.overflow {
+			assert.Equal(t, errOutboundQueueFull, err)
+			_, err = client.Read(make([]byte, 1))
+			assert.Error(t, err, "connection must be closed")
+			assert.Equal(t, errConnClosed, c.WritePacket(ack))
+		} else {
+			require.NoError(t, err)
+			assert.Equal(t, tc.queued, c.queue)
+		}
+		_ = client.Close()
+		_ = server.Close()
+	}
+}
+
+func TestConnSetOverflowPolicy(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close() // nolint: errcheck
+	c := newConn(&Server{OutboundQueueSize: 1, OverflowPolicy: OverflowDropNew}, server)
+	c.SetOverflowPolicy(OverflowDisconnect)
+
+	require.NoError(t, c.WritePacket(packet.NewPublish("a", 0, nil)))
+	assert.Equal(t, errOutboundQueueFull, c.WritePacket(packet.NewPublish("b", 0, nil)))
+}
+
+func TestConnPriority(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close() // nolint: errcheck
+	s := &Server{Priority: TopicPriorities(
+		TopicPriority{Filter: "alarm/#", Priority: 10},
+		TopicPriority{Filter: "log/#", Priority: -1},
+	)}
+	// No writeLoop runs, so everything stays in the queue
+	c := newConn(s, server)
+
+	ack := packet.NewPubAckControlPacket(1)
+	written := []packet.ControlPacket{
+		packet.NewPublish("log/a", 0, nil),
+		packet.NewPublish("data/a", 0, nil),
+		ack,
+		packet.NewPublish("log/b", 0, nil),
+		packet.NewPublish("data/b", 0, nil),
+		packet.NewPublish("alarm/a", 0, nil),
+	}
+	for _, p := range written {
+		require.NoError(t, c.WritePacket(p))
+	}
+	assert.Equal(t, []packet.ControlPacket{
+		packet.NewPublish("data/a", 0, nil),
+		packet.NewPublish("log/a", 0, nil),
+		ack,
+		packet.NewPublish("alarm/a", 0, nil),
+		packet.NewPublish("data/b", 0, nil),
+		packet.NewPublish("log/b", 0, nil),
+	}, c.queue)
+	assert.Equal(t, len(c.queue), len(c.priorities))
+}
+
+func TestUserPropertyPriority(t *testing.T) {
+	priority := UserPropertyPriority("priority")
+	p := packet.NewPublish("a", 0, nil)
+	assert.Equal(t, 0, priority(nil, p))
+
+	p.VariableHeader.Properties = &packet.Properties{}
+	p.VariableHeader.Properties.UserProperties = []packet.UserProperty{{Key: "priority", Value: "7"}}
+	assert.Equal(t, 7, priority(nil, p))
+	p.VariableHeader.Properties.UserProperties[0].Value = "high"
+	assert.Equal(t, 0, priority(nil, p))
+}
+
+func TestConnFlush(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close() // nolint: errcheck
+	c := newConn(&Server{}, server)
+	go c.writeLoop()
+
+	require.NoError(t, c.WritePacket(packet.NewPingRespControlPacket()))
+	require.NoError(t, c.WritePacket(packet.NewDisconnectControlPacket()))
+	go c.flush()
+
+	// Queued packets are still written after the connection stopped
+	// accepting new ones
+	r := packet.NewReader(client)
+	p, err := r.ReadPacket()
+	require.NoError(t, err)
+	assert.IsType(t, &packet.PingRespControlPacket{}, p)
+	p, err = r.ReadPacket()
+	require.NoError(t, err)
+	assert.IsType(t, &packet.DisconnectControlPacket{}, p)
+	<-c.writerDone
+}
+
+func TestConnFlushTimed(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close() // nolint: errcheck
+	c := newConn(&Server{Flush: transport.FlushConfig{Strategy: transport.FlushTimed, Interval: 10 * time.Millisecond}}, server)
+	go c.writeLoop()
+	defer c.flush()
+
+	start := time.Now()
+	require.NoError(t, c.WritePacket(packet.NewPingRespControlPacket()))
+	p, err := packet.ReadPacket(client)
+	require.NoError(t, err)
+	assert.IsType(t, &packet.PingRespControlPacket{}, p)
+	assert.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+}
@@ -0,0 +1,981 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+	"github.com/infinimesh/mqtt-go/topic"
+	"github.com/infinimesh/mqtt-go/transport"
+)
+
+var (
+	ErrClosed                 = errors.New("client: connection closed")
+	ErrPingTimeout            = errors.New("client: no PINGRESP from server")
+	ErrReceiveMaximumExceeded = errors.New("client: server exceeded the receive maximum")
+)
+
+// ConnectError is returned by Connect when the server refuses the
+// connection
+type ConnectError struct {
+	ReturnCode byte
+	// ServerReference is the server an MQTT 5 server told the client to
+	// use instead, see Redirected
+	ServerReference string
+}
+
+func (e *ConnectError) Error() string {
+	if e.ServerReference != "" {
+		return fmt.Sprintf("client: connection refused with return code %#x, use %v", e.ReturnCode, e.ServerReference)
+	}
+	return fmt.Sprintf("client: connection refused with return code %#x", e.ReturnCode)
+}
+
+// Redirected reports whether the server told the client to use the
+// server at ServerReference instead
+func (e *ConnectError) Redirected() bool {
+	return strings.TrimSpace(e.ServerReference) != "" && (e.ReturnCode == packet.ReasonCodeUseAnotherServer || e.ReturnCode == packet.ReasonCodeServerMoved)
+}
+
+// DisconnectError ends the connection when an MQTT 5 server sent
+// DISCONNECT, see Err
+type DisconnectError struct {
+	ReasonCode byte
+	// ServerReference is the server to use instead, if the server named
+	// one, e.g. while it is drained
+	ServerReference string
+}
+
+func (e *DisconnectError) Error() string {
+	if e.ServerReference != "" {
+		return fmt.Sprintf("client: server disconnected with reason code %#x, use %v", e.ReasonCode, e.ServerReference)
+	}
+	return fmt.Sprintf("client: server disconnected with reason code %#x", e.ReasonCode)
+}
+
+// Message is an application message received from the server
+type Message struct {
+	Topic     string
+	Payload   []byte
+	QoS       packet.QosLevel
+	Retained  bool
+	Duplicate bool
+}
+
+// Will is the message the server publishes on behalf of the client if
+// the connection ends without DISCONNECT
+type Will struct {
+	Topic   string
+	Payload []byte
+	QoS     packet.QosLevel
+	Retain  bool
+}
+
+// Authenticator is the client side of an MQTT 5 enhanced authentication
+// method
+type Authenticator interface {
+	// Method returns the name of the authentication method
+	Method() string
+	// Start returns the authentication data of CONNECT
+	Start() ([]byte, error)
+	// Step returns the response to the authentication data of an AUTH
+	// packet of the server
+	Step(data []byte) ([]byte, error)
+	// Finish checks the authentication data of the CONNACK that
+	// completed the exchange
+	Finish(data []byte) error
+}
+
+// MessageHandler is called for every message matching a subscription.
+// Handlers run one at a time on a dedicated goroutine, in the order the
+// messages arrived.
+type MessageHandler func(c *Client, m Message)
+
+type Options struct {
+	ClientID     string
+	CleanSession bool
+	// SessionExpiry is how long an MQTT 5 server keeps the session once
+	// the connection ended, in whole seconds. An MQTT 5 session ends with
+	// the connection if it is 0, whatever CleanSession says.
+	SessionExpiry time.Duration
+	// ReceiveMaximum limits the number of QoS 2 messages an MQTT 5 server
+	// may send without their flow having completed. The connection is
+	// closed if the server exceeds it. 0 means the protocol maximum of
+	// 65535. The messages the client publishes are limited to the
+	// Receive Maximum of the server in turn.
+	ReceiveMaximum uint16
+	// TopicAliasMaximum is the number of topic aliases an MQTT 5 server
+	// may use for the messages it sends. 0 allows none. Aliases for the
+	// messages the client publishes are used as the server allows.
+	TopicAliasMaximum uint16
+	// Auth carries out MQTT 5 enhanced authentication, in addition to
+	// UserName and Password if those are set
+	Auth Authenticator
+	// UserName and Password are only sent if not empty
+	UserName string
+	Password []byte
+	// Will is sent in CONNECT if not nil
+	Will *Will
+	// KeepAlive is the maximum idle time negotiated with the server. The
+	// client sends PINGREQ after half of it without other traffic and
+	// gives up if the PINGRESP takes longer than KeepAlive. 0 disables
+	// keepalive.
+	KeepAlive time.Duration
+	// ProtocolVersion defaults to MQTT 3.1.1
+	ProtocolVersion packet.ProtocolVersion
+	// ConnectTimeout limits the wait for CONNACK. Defaults to 10 seconds.
+	ConnectTimeout time.Duration
+	// OnMessage receives messages that match no subscription handler, e.g.
+	// for subscriptions that survived in a persistent session, and those
+	// the Codec of a typed Subscribe cannot decode
+	OnMessage MessageHandler
+	// Inbound tracks the QoS 2 messages received but not yet released by
+	// the server. Pass the Inbound of the previous connection when
+	// reconnecting to a persistent session, so that messages the server
+	// retransmits are not delivered twice. A new one is used if nil.
+	Inbound *session.Inbound
+	// Outbound tracks the QoS 1 and 2 messages published but not yet
+	// acknowledged by the server. Pass the Outbound of the previous
+	// connection when reconnecting to a persistent session, so that their
+	// flows are resumed and the messages delivered exactly once. A new
+	// one is used if nil.
+	Outbound *Outbound
+	// Flush decides when the packets the client writes go out to the
+	// network. By default they do unless another one is about to be
+	// written.
+	Flush transport.FlushConfig
+	// Events receives the events of the connection, if not nil. Pass the
+	// same one when reconnecting.
+	Events *Events
+	// FollowRedirects is how many times Dial follows an MQTT 5 server
+	// refusing the connection with a Server Reference to another server,
+	// see ConnectError.Redirected. Redirects are not followed if 0.
+	FollowRedirects int
+}
+
+// Client is a connection to an MQTT server. All methods are safe for
+// concurrent use.
+type Client struct {
+	conn     net.Conn
+	r        *packet.Reader
+	opts     Options
+	version  packet.ProtocolVersion
+	inbound  *session.Inbound
+	outbound *Outbound
+
+	wmu       sync.Mutex
+	w         *transport.FlushWriter
+	writers   atomic.Int32 // writing or waiting for wmu
+	lastWrite time.Time
+	aliases   *packet.TopicAliases // guarded by wmu
+
+	// ids holds the packet identifiers of the flows in progress. An
+	// identifier stays in use until the flow completed, even if nobody
+	// waits for it anymore.
+	ids session.PacketIDs
+	// quota holds a token for every QoS 1 and 2 message in flight, so
+	// that there are never more than the Receive Maximum of the server.
+	// nil if the server set none.
+	quota chan struct{}
+	mu    sync.Mutex
+	// pending holds the channel the last acknowledgement of every flow
+	// in progress is delivered on
+	pending  map[uint16]chan packet.ControlPacket
+	handlers []subscriptionHandler
+	pingSent time.Time // zero while no PINGREQ is outstanding
+
+	deliveries  chan Message
+	done        chan struct{}
+	closeOnce   sync.Once
+	err         error
+	established atomic.Bool // set once Connect succeeded
+}
+
+type subscriptionHandler struct {
+	filter  string
+	handler MessageHandler
+}
+
+// Dial connects to the server at addr over TCP and performs the MQTT
+// handshake. It follows up to opts.FollowRedirects redirects to other
+// servers.
+func Dial(addr string, opts Options) (*Client, error) {
+	for redirects := 0; ; redirects++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			opts.Events.Emit(ConnectFailed{ClientID: opts.ClientID, Err: err})
+			return nil, err
+		}
+		c, err := Connect(conn, opts)
+		if err == nil {
+			return c, nil
+		}
+		_ = conn.Close()
+		var refused *ConnectError
+		if redirects == opts.FollowRedirects || !errors.As(err, &refused) || !refused.Redirected() {
+			return nil, err
+		}
+		addr = redirectAddr(refused.ServerReference, addr)
+	}
+}
+
+// redirectAddr returns the address of the first server of a Server
+// Reference, a space separated list of host names with optional ports,
+// with the port of addr if it has none
+func redirectAddr(reference, addr string) string {
+	ref := strings.Fields(reference)[0]
+	if _, _, err := net.SplitHostPort(ref); err == nil {
+		return ref
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ref
+	}
+	return net.JoinHostPort(strings.Trim(ref, "[]"), port)
+}
+
+// Connect performs the MQTT handshake over an established connection,
+// e.g. one using TLS. conn is owned by the Client afterwards.
+func Connect(conn net.Conn, opts Options) (*Client, error) {
+	c, sessionPresent, err := connect(conn, opts)
+	if err != nil {
+		failed := ConnectFailed{ClientID: opts.ClientID, Err: err}
+		var refused *ConnectError
+		if errors.As(err, &refused) {
+			failed.Code = refused.ReturnCode
+		}
+		opts.Events.Emit(failed)
+		return nil, err
+	}
+	opts.Events.Emit(ConnectSucceeded{ClientID: opts.ClientID, SessionPresent: sessionPresent})
+	c.established.Store(true)
+	return c, nil
+}
+
+// connect is Connect without the events. It also returns whether the
+// server had a session for the client.
+func connect(conn net.Conn, opts Options) (*Client, bool, error) {
+	version := opts.ProtocolVersion
+	if version == 0 {
+		version = packet.ProtocolVersion311
+	}
+	protocolName := "MQTT"
+	if version == packet.ProtocolVersion31 {
+		protocolName = "MQIsdp"
+	}
+
+	connect := &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  protocolName,
+			ProtocolLevel: byte(version),
+			ConnectFlags:  packet.ConnectFlags{CleanSession: opts.CleanSession},
+			KeepAlive:     int(opts.KeepAlive / time.Second),
+		},
+		ConnectPayload: packet.ConnectPayload{ClientID: opts.ClientID},
+	}
+	if opts.UserName != "" {
+		connect.VariableHeader.ConnectFlags.UserName = true
+		connect.ConnectPayload.UserName = opts.UserName
+	}
+	if len(opts.Password) > 0 {
+		connect.VariableHeader.ConnectFlags.Password = true
+		connect.ConnectPayload.Password = opts.Password
+	}
+	if will := opts.Will; will != nil {
+		if err := packet.ValidateTopicName(will.Topic); err != nil {
+			return nil, false, err
+		}
+		flags := &connect.VariableHeader.ConnectFlags
+		flags.WillFlag = true
+		flags.WillQoS = byte(will.QoS)
+		flags.WillRetain = will.Retain
+		connect.ConnectPayload.WillTopic = will.Topic
+		connect.ConnectPayload.WillMessage = will.Payload
+		if version == packet.ProtocolVersion5 {
+			connect.ConnectPayload.WillProperties = &packet.Properties{}
+		}
+	}
+	if version == packet.ProtocolVersion5 {
+		connect.VariableHeader.Properties = &packet.Properties{}
+		if opts.SessionExpiry > 0 {
+			seconds := uint32(math.MaxUint32)
+			if opts.SessionExpiry/time.Second < math.MaxUint32 {
+				seconds = uint32(opts.SessionExpiry / time.Second)
+			}
+			connect.VariableHeader.Properties.SessionExpiryInterval = &seconds
+		}
+		if opts.ReceiveMaximum > 0 {
+			connect.VariableHeader.Properties.ReceiveMaximum = packet.Uint16(opts.ReceiveMaximum)
+		}
+		if opts.TopicAliasMaximum > 0 {
+			connect.VariableHeader.Properties.TopicAliasMaximum = packet.Uint16(opts.TopicAliasMaximum)
+		}
+		if auth := opts.Auth; auth != nil {
+			data, err := auth.Start()
+			if err != nil {
+				return nil, false, err
+			}
+			connect.VariableHeader.Properties.AuthenticationMethod = auth.Method()
+			connect.VariableHeader.Properties.AuthenticationData = data
+		}
+	} else if opts.Auth != nil {
+		return nil, false, errors.New("client: enhanced authentication requires MQTT 5")
+	}
+
+	timeout := opts.ConnectTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, false, err
+	}
+	if err := packet.WritePacket(conn, connect); err != nil {
+		return nil, false, err
+	}
+	r := packet.NewReader(conn)
+	r.Version = version
+	r.TopicAliasMaximum = opts.TopicAliasMaximum
+	p, err := r.ReadPacket()
+	for err == nil && opts.Auth != nil {
+		auth, ok := p.(*packet.AuthControlPacket)
+		if !ok {
+			break
+		}
+		var data []byte
+		if data, err = opts.Auth.Step(auth.VariableHeader.Properties.AuthenticationData); err != nil {
+			break
+		}
+		if err = packet.WritePacket(conn, packet.NewAuth(packet.ReasonCodeContinueAuthentication, opts.Auth.Method(), data)); err != nil {
+			break
+		}
+		p, err = r.ReadPacket()
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, false, err
+	}
+
+	connack, ok := p.(*packet.ConnAckControlPacket)
+	if !ok {
+		return nil, false, errors.New("client: expected CONNACK from server")
+	}
+	if connack.VariableHeader.ReturnCode != 0 {
+		refused := &ConnectError{ReturnCode: connack.VariableHeader.ReturnCode}
+		if props := connack.VariableHeader.Properties; props != nil {
+			refused.ServerReference = props.ServerReference
+		}
+		return nil, false, refused
+	}
+	if auth := opts.Auth; auth != nil {
+		// The server has to prove itself as well, with some methods
+		if err := auth.Finish(connack.VariableHeader.Properties.AuthenticationData); err != nil {
+			return nil, false, err
+		}
+	}
+
+	var aliases *packet.TopicAliases
+	var quota chan struct{}
+	if props := connack.VariableHeader.Properties; props != nil {
+		if props.TopicAliasMaximum != nil {
+			aliases = &packet.TopicAliases{Maximum: *props.TopicAliasMaximum}
+		}
+		if props.ReceiveMaximum != nil {
+			quota = make(chan struct{}, *props.ReceiveMaximum)
+		}
+	}
+
+	inbound := opts.Inbound
+	if inbound == nil {
+		inbound = session.NewInbound()
+	}
+	outbound := opts.Outbound
+	if outbound == nil {
+		outbound = NewOutbound()
+	}
+
+	c := &Client{
+		conn:       conn,
+		w:          transport.NewFlushWriter(conn, opts.Flush),
+		r:          r,
+		opts:       opts,
+		version:    version,
+		inbound:    inbound,
+		outbound:   outbound,
+		aliases:    aliases,
+		quota:      quota,
+		lastWrite:  time.Now(),
+		pending:    make(map[uint16]chan packet.ControlPacket),
+		deliveries: make(chan Message, 64),
+		done:       make(chan struct{}),
+	}
+	go c.readLoop()
+	go c.deliverLoop()
+	if err := c.resume(); err != nil {
+		c.close(err)
+		return nil, false, err
+	}
+	if opts.KeepAlive > 0 {
+		go c.keepAlive()
+	}
+	return c, connack.VariableHeader.SessionPresent, nil
+}
+
+// resume retransmits the PUBLISH and PUBREL packets of the flows the
+// previous connection left unfinished, in their original order
+// [MQTT-4.4.0-1]
+func (c *Client) resume() error {
+	for _, p := range c.outbound.Packets() {
+		var id uint16
+		switch q := p.(type) {
+		case *packet.PublishControlPacket:
+			cp := *q
+			cp.FixedHeaderFlags.Dup = true
+			id, p = uint16(cp.VariableHeader.PacketID), &cp
+		case *packet.PubrelControlPacket:
+			id = q.VariableHeader.PacketID
+		}
+		c.ids.Reserve(id)
+		c.mu.Lock()
+		c.pending[id] = make(chan packet.ControlPacket, 1)
+		c.mu.Unlock()
+		if c.quota != nil {
+			select {
+			case c.quota <- struct{}{}:
+			default:
+			}
+		}
+		if err := c.writePacket(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Done is closed when the connection is lost or closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection was closed, or nil while it is open
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Publish sends a message. With QoS 1 and 2 it blocks until the server
+// acknowledged the message or ctx is done. A flow nobody waits for
+// anymore still completes in the background, and its packet identifier
+// stays in use until then. An invalid topic name is reported without
+// sending anything.
+func (c *Client) Publish(ctx context.Context, topic string, qos packet.QosLevel, retain bool, payload []byte) error {
+	if err := packet.ValidateTopicName(topic); err != nil {
+		return err
+	}
+	p := packet.NewPublish(topic, 0, payload)
+	p.FixedHeaderFlags.QoS = qos
+	p.FixedHeaderFlags.Retain = retain
+	if c.version == packet.ProtocolVersion5 {
+		p.VariableHeader.Properties = &packet.Properties{}
+	}
+
+	if qos == packet.QoSLevelNone {
+		return c.writePacket(p)
+	}
+
+	if c.quota != nil {
+		select {
+		case c.quota <- struct{}{}:
+		case <-c.done:
+			return c.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	id, ack, err := c.reserveID(ctx)
+	if err != nil {
+		c.releaseQuota()
+		return err
+	}
+
+	p.VariableHeader.PacketID = int(id)
+	if err := c.outbound.publish(p); err != nil {
+		c.releaseID(id)
+		c.releaseQuota()
+		return err
+	}
+	// The read loop sends PUBREL after PUBREC, so the flow ends with
+	// PUBACK, a PUBREC refusing the message or PUBCOMP
+	resp, err := c.roundTrip(ctx, p, ack)
+	if err != nil {
+		return err
+	}
+	switch resp := resp.(type) {
+	case *packet.PubackControlPacket:
+		return checkReasonCode("publish", resp.VariableHeader.ReasonCode)
+	case *packet.PubrecControlPacket:
+		return checkReasonCode("publish", resp.VariableHeader.ReasonCode)
+	case *packet.PubcompControlPacket:
+		return checkReasonCode("publish release", resp.VariableHeader.ReasonCode)
+	}
+	return fmt.Errorf("client: unexpected response to PUBLISH: %T", resp)
+}
+
+// Subscribe subscribes to filter and routes matching messages to handler.
+// It returns the QoS granted by the server.
+func (c *Client) Subscribe(ctx context.Context, filter string, qos packet.QosLevel, handler MessageHandler) (packet.QosLevel, error) {
+	return c.SubscribeWith(ctx, packet.Subscription{Topic: filter, QoS: qos}, handler)
+}
+
+// SubscribeWith is Subscribe with the MQTT 5 subscription options of
+// subscription, which are ignored by MQTT 3.1.1 servers
+func (c *Client) SubscribeWith(ctx context.Context, subscription packet.Subscription, handler MessageHandler) (packet.QosLevel, error) {
+	filter := subscription.Topic
+	if err := packet.ValidateTopicFilter(filter); err != nil {
+		return 0, err
+	}
+	id, ack, err := c.reserveID(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.version != packet.ProtocolVersion5 {
+		subscription = packet.Subscription{Topic: filter, QoS: subscription.QoS}
+	}
+	sub := &packet.SubscribeControlPacket{
+		VariableHeader: packet.SubscribeVariableHeader{PacketID: int(id)},
+		Payload: packet.SubscribePayload{
+			Subscriptions: []packet.Subscription{subscription},
+		},
+	}
+
+	// Register the handler first, retained messages may arrive before SUBACK
+	if handler != nil {
+		c.mu.Lock()
+		c.handlers = append(c.handlers, subscriptionHandler{filter: filter, handler: handler})
+		c.mu.Unlock()
+	}
+
+	resp, err := c.roundTrip(ctx, sub, ack)
+	if err == nil {
+		suback, ok := resp.(*packet.SubAckControlPacket)
+		switch {
+		case !ok || len(suback.Payload.ReturnCodes) != 1:
+			err = fmt.Errorf("client: unexpected response to SUBSCRIBE: %T", resp)
+		case suback.Payload.ReturnCodes[0] >= packet.ReturncodeFailure:
+			err = fmt.Errorf("client: subscription to %v refused with code %#x", filter, suback.Payload.ReturnCodes[0])
+		default:
+			return packet.QosLevel(suback.Payload.ReturnCodes[0]), nil
+		}
+	}
+
+	if handler != nil {
+		c.removeHandlers(filter)
+	}
+	return 0, err
+}
+
+// Unsubscribe removes the subscriptions and their handlers
+func (c *Client) Unsubscribe(ctx context.Context, filters ...string) error {
+	for _, filter := range filters {
+		if err := packet.ValidateTopicFilter(filter); err != nil {
+			return err
+		}
+	}
+	id, ack, err := c.reserveID(ctx)
+	if err != nil {
+		return err
+	}
+
+	unsub := packet.NewUnsubscribe(id, filters)
+
+	resp, err := c.roundTrip(ctx, unsub, ack)
+	if err != nil {
+		return err
+	}
+	if _, ok := resp.(*packet.UnsubAckControlPacket); !ok {
+		return fmt.Errorf("client: unexpected response to UNSUBSCRIBE: %T", resp)
+	}
+
+	for _, filter := range filters {
+		c.removeHandlers(filter)
+	}
+	return nil
+}
+
+// Disconnect sends DISCONNECT and closes the connection
+func (c *Client) Disconnect() error {
+	err := c.writePacket(packet.NewDisconnectControlPacket())
+	c.close(ErrClosed)
+	return err
+}
+
+func (c *Client) writePacket(p packet.ControlPacket) error {
+	c.writers.Add(1)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	waiting := c.writers.Add(-1)
+	c.lastWrite = time.Now()
+	p = packet.Adapt(p, c.version)
+	if publish, ok := p.(*packet.PublishControlPacket); ok {
+		p = c.aliases.Apply(publish)
+	}
+	if err := packet.WritePacket(c.w, p); err != nil {
+		return err
+	}
+	if _, ok := p.(*packet.DisconnectControlPacket); ok {
+		// The connection is closed right after
+		return c.w.Flush()
+	}
+	if waiting > 0 {
+		// Goes out with the packet written next
+		return nil
+	}
+	return c.w.Idle()
+}
+
+// reserveID allocates a packet identifier and the channel the last
+// acknowledgement of its flow is delivered on. If all identifiers are in
+// use, it waits for one to be released until ctx is done. The read loop
+// releases the identifier once the flow completed.
+func (c *Client) reserveID(ctx context.Context) (uint16, chan packet.ControlPacket, error) {
+	id, err := c.ids.Wait(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	ack := make(chan packet.ControlPacket, 1)
+	c.mu.Lock()
+	c.pending[id] = ack
+	c.mu.Unlock()
+	return id, ack, nil
+}
+
+func (c *Client) releaseID(id uint16) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+	c.ids.Free(id)
+}
+
+// releaseQuota returns the token of a QoS 1 or 2 message whose flow ended
+func (c *Client) releaseQuota() {
+	if c.quota != nil {
+		select {
+		case <-c.quota:
+		default:
+		}
+	}
+}
+
+func (c *Client) roundTrip(ctx context.Context, p packet.ControlPacket, ack chan packet.ControlPacket) (packet.ControlPacket, error) {
+	if err := c.writePacket(p); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-ack:
+		return resp, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) removeHandlers(filter string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	handlers := c.handlers[:0]
+	for _, h := range c.handlers {
+		if h.filter != filter {
+			handlers = append(handlers, h)
+		}
+	}
+	c.handlers = handlers
+}
+
+func (c *Client) close(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		_ = c.conn.Close()
+		close(c.done)
+		if err != ErrClosed && c.established.Load() {
+			c.opts.Events.Emit(ConnectionLost{ClientID: c.opts.ClientID, Err: err})
+		}
+	})
+}
+
+func (c *Client) readLoop() {
+	for {
+		p, err := c.r.ReadPacket()
+		if err != nil {
+			c.close(err)
+			return
+		}
+
+		switch p := p.(type) {
+		case *packet.PublishControlPacket:
+			if err := c.handlePublish(p); err != nil {
+				c.close(err)
+				return
+			}
+		case *packet.PubackControlPacket:
+			if err := c.finishPublish(p.VariableHeader.PacketID, packet.QoSLevelAtLeastOnce, p); err != nil {
+				c.close(err)
+				return
+			}
+		case *packet.PubrecControlPacket:
+			if err := c.handlePubrec(p); err != nil {
+				c.close(err)
+				return
+			}
+		case *packet.PubcompControlPacket:
+			if err := c.handlePubcomp(p); err != nil {
+				c.close(err)
+				return
+			}
+		case *packet.PubrelControlPacket:
+			if err := c.handlePubrel(p); err != nil {
+				c.close(err)
+				return
+			}
+		case *packet.SubAckControlPacket:
+			c.acknowledge(uint16(p.VariableHeader.PacketID), p)
+		case *packet.UnsubAckControlPacket:
+			c.acknowledge(uint16(p.VariableHeader.PacketID), p)
+		case *packet.PingRespControlPacket:
+			c.mu.Lock()
+			c.pingSent = time.Time{}
+			c.mu.Unlock()
+		case *packet.DisconnectControlPacket:
+			err := &DisconnectError{ReasonCode: p.VariableHeader.ReasonCode}
+			if props := p.VariableHeader.Properties; props != nil {
+				err.ServerReference = props.ServerReference
+			}
+			c.close(err)
+			return
+		default:
+			c.close(fmt.Errorf("client: unexpected packet from server: %T", p))
+			return
+		}
+	}
+}
+
+// acknowledge ends the SUBSCRIBE or UNSUBSCRIBE flow of id
+func (c *Client) acknowledge(id uint16, p packet.ControlPacket) {
+	if !c.outbound.contains(id) {
+		c.complete(id, p)
+	}
+}
+
+// complete releases the packet identifier of a flow that ended with p
+// and passes p to whoever waits for it
+func (c *Client) complete(id uint16, p packet.ControlPacket) {
+	c.mu.Lock()
+	ack, ok := c.pending[id]
+	delete(c.pending, id)
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	c.ids.Free(id)
+	ack <- p // buffered, and only the flow's last acknowledgement is sent
+}
+
+// finishPublish ends the flow of a PUBLISH with qos that was acknowledged
+// by p. Acknowledgements for unknown flows are ignored.
+func (c *Client) finishPublish(id uint16, qos packet.QosLevel, p packet.ControlPacket) error {
+	ok, err := c.outbound.acknowledge(id, qos)
+	if !ok || err != nil {
+		return err
+	}
+	c.releaseQuota()
+	c.complete(id, p)
+	return nil
+}
+
+// handlePubrec sends the PUBREL that continues a QoS 2 flow, or ends the
+// flow if the server refused the message
+func (c *Client) handlePubrec(p *packet.PubrecControlPacket) error {
+	id := p.VariableHeader.PacketID
+	if p.VariableHeader.ReasonCode >= packet.ReasonCodeUnspecifiedError {
+		return c.finishPublish(id, packet.QoSLevelExactlyOnce, p)
+	}
+	pubrel, err := c.outbound.received(id, c.version == packet.ProtocolVersion5)
+	if pubrel == nil || err != nil {
+		return err
+	}
+	return c.writePacket(pubrel)
+}
+
+// handlePubcomp ends a QoS 2 flow
+func (c *Client) handlePubcomp(p *packet.PubcompControlPacket) error {
+	id := p.VariableHeader.PacketID
+	ok, err := c.outbound.completed(id)
+	if !ok || err != nil {
+		return err
+	}
+	c.releaseQuota()
+	c.complete(id, p)
+	return nil
+}
+
+func (c *Client) handlePublish(p *packet.PublishControlPacket) error {
+	m := Message{
+		Topic:     p.VariableHeader.Topic,
+		Payload:   p.Payload,
+		QoS:       p.FixedHeaderFlags.QoS,
+		Retained:  p.FixedHeaderFlags.Retain,
+		Duplicate: p.FixedHeaderFlags.Dup,
+	}
+	id := uint16(p.VariableHeader.PacketID)
+
+	deliver := true
+	if m.QoS == packet.QoSLevelExactlyOnce {
+		if max := c.opts.ReceiveMaximum; c.version == packet.ProtocolVersion5 && max > 0 &&
+			c.inbound.Len() >= int(max) && !c.inbound.Contains(id) {
+			disconnect := packet.NewDisconnectControlPacket()
+			disconnect.VariableHeader.ReasonCode = packet.ReasonCodeReceiveMaximumExceeded
+			disconnect.VariableHeader.Properties = &packet.Properties{}
+			_ = c.writePacket(disconnect)
+			return ErrReceiveMaximumExceeded
+		}
+		first, err := c.inbound.Receive(id)
+		if err != nil {
+			return err
+		}
+		deliver = first
+	}
+	if deliver {
+		select {
+		case c.deliveries <- m:
+		case <-c.done:
+			return c.err
+		}
+	}
+
+	var ack packet.ControlPacket
+	switch m.QoS {
+	case packet.QoSLevelAtLeastOnce:
+		ack = packet.NewPubAckControlPacket(id)
+	case packet.QoSLevelExactlyOnce:
+		ack = packet.NewPubRecControlPacket(id)
+	default:
+		return nil
+	}
+	return c.writePacket(ack)
+}
+
+func (c *Client) handlePubrel(p *packet.PubrelControlPacket) error {
+	if err := c.inbound.Release(p.VariableHeader.PacketID); err != nil {
+		return err
+	}
+	return c.writePacket(packet.NewPubCompControlPacket(p.VariableHeader.PacketID))
+}
+
+// checkReasonCode turns an MQTT 5 failure reason code into an error
+func checkReasonCode(operation string, code byte) error {
+	if code >= packet.ReasonCodeUnspecifiedError {
+		return fmt.Errorf("client: %v rejected with reason code %#x", operation, code)
+	}
+	return nil
+}
+
+func (c *Client) deliverLoop() {
+	for {
+		select {
+		case m := <-c.deliveries:
+			c.dispatch(m)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Client) dispatch(m Message) {
+	c.mu.Lock()
+	var handlers []MessageHandler
+	for _, h := range c.handlers {
+		if topic.Matches(h.filter, m.Topic) {
+			handlers = append(handlers, h.handler)
+		}
+	}
+	c.mu.Unlock()
+
+	if len(handlers) == 0 {
+		if c.opts.OnMessage == nil {
+			c.opts.Events.Emit(MessageDropped{ClientID: c.opts.ClientID, Topic: m.Topic, Reason: DropNoHandler})
+			return
+		}
+		handlers = append(handlers, c.opts.OnMessage)
+	}
+	for _, h := range handlers {
+		h(c, m)
+	}
+}
+
+func (c *Client) keepAlive() {
+	interval := c.opts.KeepAlive
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+
+		c.wmu.Lock()
+		idle := time.Since(c.lastWrite)
+		c.wmu.Unlock()
+
+		c.mu.Lock()
+		pingSent := c.pingSent
+		if pingSent.IsZero() && idle >= interval/2 {
+			c.pingSent = time.Now()
+		}
+		c.mu.Unlock()
+
+		switch {
+		case !pingSent.IsZero() && time.Since(pingSent) >= interval:
+			c.opts.Events.Emit(PingTimeout{ClientID: c.opts.ClientID})
+			c.close(ErrPingTimeout)
+			return
+		case pingSent.IsZero() && idle >= interval/2:
+			if err := c.writePacket(packet.NewPingReqControlPacket()); err != nil {
+				c.close(err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,503 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer accepts the CONNECT on conn and then hands every packet to
+// handle, writing back whatever it returns
+func fakeServer(t *testing.T, conn net.Conn, handle func(p packet.ControlPacket) []packet.ControlPacket) {
+	p, err := packet.ReadPacket(conn)
+	require.NoError(t, err)
+	require.IsType(t, &packet.ConnectControlPacket{}, p)
+	require.NoError(t, packet.WritePacket(conn, &packet.ConnAckControlPacket{}))
+
+	for {
+		p, err := packet.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		for _, resp := range handle(p) {
+			if packet.WritePacket(conn, resp) != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestClientPubSub(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	go fakeServer(t, serverConn, func(p packet.ControlPacket) []packet.ControlPacket {
+		switch p := p.(type) {
+		case *packet.SubscribeControlPacket:
+			return []packet.ControlPacket{packet.NewSubAck(uint16(p.VariableHeader.PacketID), []byte{packet.ReturncodeSuccessQoS1})}
+		case *packet.PublishControlPacket:
+			// Echo back to the subscriber, then acknowledge
+			echo := packet.NewPublish(p.VariableHeader.Topic, 0, p.Payload)
+			return []packet.ControlPacket{echo, packet.NewPubAckControlPacket(uint16(p.VariableHeader.PacketID))}
+		case *packet.UnsubscribeControlPacket:
+			return []packet.ControlPacket{packet.NewUnsubAck(uint16(p.VariableHeader.PacketID))}
+		}
+		return nil
+	})
+
+	c, err := Connect(clientConn, Options{ClientID: "test"})
+	require.NoError(t, err)
+	defer c.Disconnect() // nolint: errcheck
+
+	messages := make(chan Message, 1)
+	ctx := context.Background()
+	granted, err := c.Subscribe(ctx, "sensors/+/temp", packet.QoSLevelAtLeastOnce, func(c *Client, m Message) {
+		messages <- m
+	})
+	require.NoError(t, err)
+	assert.Equal(t, packet.QoSLevelAtLeastOnce, granted)
+
+	require.NoError(t, c.Publish(ctx, "sensors/1/temp", packet.QoSLevelAtLeastOnce, false, []byte("21")))
+	select {
+	case m := <-messages:
+		assert.Equal(t, "sensors/1/temp", m.Topic)
+		assert.Equal(t, []byte("21"), m.Payload)
+	case <-time.After(time.Second):
+		t.Fatal("message was not delivered")
+	}
+
+	require.NoError(t, c.Unsubscribe(ctx, "sensors/+/temp"))
+
+	// Invalid topics are rejected before sending
+	assert.Error(t, c.Publish(ctx, "sensors/+/temp", packet.QoSLevelNone, false, nil))
+	_, err = c.Subscribe(ctx, "sensors/#/temp", packet.QoSLevelNone, nil)
+	assert.Error(t, err)
+	assert.Error(t, c.Unsubscribe(ctx, ""))
+}
+
+func TestClientQoS2(t *testing.T) {
+	// net.Pipe has no buffering, which would deadlock the fake server
+	// writing several packets while the client acknowledges the first
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+	clientConn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	defer serverConn.Close() // nolint: errcheck
+
+	serverDone := make(chan packet.ControlPacket, 1)
+	go fakeServer(t, serverConn, func(p packet.ControlPacket) []packet.ControlPacket {
+		switch p := p.(type) {
+		case *packet.PublishControlPacket:
+			// Send the message back twice as if the first PUBREC was lost
+			echo := packet.NewPublish(p.VariableHeader.Topic, 9, p.Payload)
+			echo.FixedHeaderFlags.QoS = packet.QoSLevelExactlyOnce
+			dup := *echo
+			dup.FixedHeaderFlags.Dup = true
+			return []packet.ControlPacket{packet.NewPubRecControlPacket(uint16(p.VariableHeader.PacketID)), echo, &dup}
+		case *packet.PubrelControlPacket:
+			return []packet.ControlPacket{packet.NewPubCompControlPacket(p.VariableHeader.PacketID), packet.NewPubRelControlPacket(9)}
+		case *packet.PubcompControlPacket:
+			serverDone <- p
+		}
+		return nil
+	})
+
+	messages := make(chan Message, 2)
+	c, err := Connect(clientConn, Options{
+		ClientID:  "test",
+		OnMessage: func(c *Client, m Message) { messages <- m },
+	})
+	require.NoError(t, err)
+	defer c.Disconnect() // nolint: errcheck
+
+	require.NoError(t, c.Publish(context.Background(), "a/b", packet.QoSLevelExactlyOnce, false, []byte("once")))
+
+	select {
+	case p := <-serverDone:
+		assert.Equal(t, uint16(9), p.(*packet.PubcompControlPacket).VariableHeader.PacketID)
+	case <-time.After(time.Second):
+		t.Fatal("no PUBCOMP from client")
+	}
+	select {
+	case m := <-messages:
+		assert.Equal(t, packet.QoSLevelExactlyOnce, m.QoS)
+	case <-time.After(time.Second):
+		t.Fatal("message was not delivered")
+	}
+	assert.Empty(t, messages, "duplicate QoS 2 message must be delivered once")
+}
+
+func TestClientPingTimeout(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	go fakeServer(t, serverConn, func(p packet.ControlPacket) []packet.ControlPacket {
+		return nil // never answers PINGREQ
+	})
+
+	c, err := Connect(clientConn, Options{ClientID: "test", KeepAlive: 40 * time.Millisecond})
+	require.NoError(t, err)
+
+	select {
+	case <-c.Done():
+		assert.Equal(t, ErrPingTimeout, c.Err())
+	case <-time.After(time.Second):
+		t.Fatal("client did not detect the dead server")
+	}
+}
+
+func TestClientWill(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	connects := make(chan *packet.ConnectControlPacket, 1)
+	go func() {
+		p, err := packet.ReadPacket(serverConn)
+		if err != nil {
+			return
+		}
+		connects <- p.(*packet.ConnectControlPacket)
+		_ = packet.WritePacket(serverConn, &packet.ConnAckControlPacket{})
+		_, _ = io.Copy(io.Discard, serverConn)
+	}()
+
+	_, err := Connect(clientConn, Options{Will: &Will{Topic: "status/#"}})
+	assert.Error(t, err, "invalid will topic")
+
+	c, err := Connect(clientConn, Options{
+		ClientID: "test",
+		Will:     &Will{Topic: "status/test", Payload: []byte("gone"), QoS: packet.QoSLevelAtLeastOnce, Retain: true},
+	})
+	require.NoError(t, err)
+	defer c.Disconnect() // nolint: errcheck
+
+	connect := <-connects
+	assert.Equal(t, packet.ConnectFlags{WillFlag: true, WillQoS: 1, WillRetain: true}, connect.VariableHeader.ConnectFlags)
+	assert.Equal(t, "status/test", connect.ConnectPayload.WillTopic)
+	assert.Equal(t, []byte("gone"), connect.ConnectPayload.WillMessage)
+}
+
+func TestClientReceiveMaximum(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	received := make(chan packet.ControlPacket, 4)
+	go func() {
+		_, err := packet.ReadPacket(serverConn)
+		require.NoError(t, err)
+		connack := packet.NewConnAck(packet.ConnAckAccepted, false)
+		connack.VariableHeader.Properties = &packet.Properties{ReceiveMaximum: packet.Uint16(1)}
+		require.NoError(t, packet.WritePacket(serverConn, connack))
+		for {
+			p, err := packet.ReadPacketVersion(serverConn, packet.ProtocolVersion5)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- p
+		}
+	}()
+
+	c, err := Connect(clientConn, Options{ClientID: "test", ProtocolVersion: packet.ProtocolVersion5, ReceiveMaximum: 1})
+	require.NoError(t, err)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- c.Publish(context.Background(), "a", packet.QoSLevelAtLeastOnce, false, nil)
+		}()
+	}
+
+	// The second message waits for the first to be acknowledged
+	for i := 0; i < 2; i++ {
+		p := <-received
+		require.IsType(t, &packet.PublishControlPacket{}, p)
+		select {
+		case p := <-received:
+			t.Fatalf("%T sent beyond the receive maximum", p)
+		case <-time.After(50 * time.Millisecond):
+		}
+		puback := packet.NewPubAckControlPacket(uint16(p.(*packet.PublishControlPacket).VariableHeader.PacketID))
+		puback.VariableHeader.Properties = &packet.Properties{}
+		require.NoError(t, packet.WritePacket(serverConn, puback))
+		require.NoError(t, <-errs)
+	}
+
+	// The server may not have more than one QoS 2 message in flight
+	for id := uint16(1); id <= 2; id++ {
+		p := packet.NewPublish("b", id, nil)
+		p.FixedHeaderFlags.QoS = packet.QoSLevelExactlyOnce
+		p.VariableHeader.Properties = &packet.Properties{}
+		require.NoError(t, packet.WritePacket(serverConn, p))
+	}
+	assert.IsType(t, &packet.PubrecControlPacket{}, <-received)
+	p := <-received
+	require.IsType(t, &packet.DisconnectControlPacket{}, p)
+	assert.Equal(t, packet.ReasonCodeReceiveMaximumExceeded, p.(*packet.DisconnectControlPacket).VariableHeader.ReasonCode)
+	<-c.Done()
+	assert.Equal(t, ErrReceiveMaximumExceeded, c.Err())
+}
+
+func TestClientResume(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	read := func() packet.ControlPacket {
+		p, err := packet.ReadPacket(serverConn)
+		require.NoError(t, err)
+		return p
+	}
+	serverDone := make(chan struct{})
+	var first, second *packet.PublishControlPacket
+	go func() {
+		defer close(serverDone)
+		read()
+		assert.NoError(t, packet.WritePacket(serverConn, &packet.ConnAckControlPacket{}))
+		first = read().(*packet.PublishControlPacket)
+		second = read().(*packet.PublishControlPacket)
+		assert.NoError(t, packet.WritePacket(serverConn, packet.NewPubRecControlPacket(uint16(second.VariableHeader.PacketID))))
+		assert.IsType(t, &packet.PubrelControlPacket{}, read())
+		assert.NoError(t, serverConn.Close())
+	}()
+
+	outbound := NewOutbound()
+	c, err := Connect(clientConn, Options{ClientID: "test", Outbound: outbound})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, c.Publish(ctx, "a", packet.QoSLevelAtLeastOnce, false, []byte("1")))
+	assert.Error(t, c.Publish(context.Background(), "b", packet.QoSLevelExactlyOnce, false, []byte("2")))
+	<-serverDone
+	<-c.Done()
+	assert.NotEqual(t, first.VariableHeader.PacketID, second.VariableHeader.PacketID,
+		"the identifier of the abandoned flow stays in use")
+
+	// The flows continue on the next connection
+	packets := outbound.Packets()
+	require.Len(t, packets, 2)
+	assert.Equal(t, first, packets[0])
+	require.IsType(t, &packet.PubrelControlPacket{}, packets[1])
+
+	clientConn, serverConn = net.Pipe()
+	go func() {
+		read()
+		assert.NoError(t, packet.WritePacket(serverConn, packet.NewConnAck(packet.ConnAckAccepted, true)))
+		resent := read().(*packet.PublishControlPacket)
+		assert.True(t, resent.FixedHeaderFlags.Dup)
+		assert.Equal(t, first.VariableHeader.PacketID, resent.VariableHeader.PacketID)
+		assert.Equal(t, []byte("1"), resent.Payload)
+		pubrel := read().(*packet.PubrelControlPacket)
+		assert.Equal(t, uint16(second.VariableHeader.PacketID), pubrel.VariableHeader.PacketID)
+		assert.NoError(t, packet.WritePacket(serverConn, packet.NewPubAckControlPacket(uint16(resent.VariableHeader.PacketID))))
+		assert.NoError(t, packet.WritePacket(serverConn, packet.NewPubCompControlPacket(pubrel.VariableHeader.PacketID)))
+		for {
+			if _, err := packet.ReadPacket(serverConn); err != nil {
+				return
+			}
+		}
+	}()
+	c, err = Connect(clientConn, Options{ClientID: "test", Outbound: outbound})
+	require.NoError(t, err)
+	defer c.Disconnect() // nolint: errcheck
+	for i := 0; outbound.Len() > 0; i++ {
+		require.True(t, i < 100, "flows did not complete")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientFlush(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	received := make(chan packet.ControlPacket, 4)
+	go fakeServer(t, serverConn, func(p packet.ControlPacket) []packet.ControlPacket {
+		received <- p
+		return nil
+	})
+
+	c, err := Connect(clientConn, Options{ClientID: "test", Flush: transport.FlushConfig{Strategy: transport.FlushSized, Interval: time.Hour}})
+	require.NoError(t, err)
+	ctx := context.Background()
+	require.NoError(t, c.Publish(ctx, "a", packet.QoSLevelNone, false, nil))
+	require.NoError(t, c.Publish(ctx, "b", packet.QoSLevelNone, false, nil))
+	select {
+	case p := <-received:
+		t.Fatalf("%T was not held back", p)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// DISCONNECT takes the buffered messages along
+	require.NoError(t, c.Disconnect())
+	for _, want := range []packet.ControlPacket{&packet.PublishControlPacket{}, &packet.PublishControlPacket{}, &packet.DisconnectControlPacket{}} {
+		select {
+		case p := <-received:
+			assert.IsType(t, want, p)
+		case <-time.After(time.Second):
+			t.Fatal("packet was not flushed")
+		}
+	}
+}
+
+func TestTypedPubSub(t *testing.T) {
+	type reading struct {
+		Sensor string  `json:"sensor"`
+		Value  float64 `json:"value"`
+	}
+	clientConn, serverConn := net.Pipe()
+	go fakeServer(t, serverConn, func(p packet.ControlPacket) []packet.ControlPacket {
+		switch p := p.(type) {
+		case *packet.SubscribeControlPacket:
+			return []packet.ControlPacket{packet.NewSubAck(uint16(p.VariableHeader.PacketID), []byte{packet.ReturncodeSuccessQoS0})}
+		case *packet.PublishControlPacket:
+			return []packet.ControlPacket{
+				packet.NewPublish(p.VariableHeader.Topic, 0, []byte("not json")),
+				packet.NewPublish(p.VariableHeader.Topic, 0, p.Payload),
+			}
+		}
+		return nil
+	})
+
+	undecoded := make(chan Message, 1)
+	c, err := Connect(clientConn, Options{ClientID: "test", OnMessage: func(c *Client, m Message) { undecoded <- m }})
+	require.NoError(t, err)
+	defer c.Disconnect() // nolint: errcheck
+
+	readings := make(chan reading, 1)
+	ctx := context.Background()
+	_, err = Subscribe(ctx, c, "sensors/#", packet.QoSLevelNone, JSON, func(topic string, r reading) {
+		assert.Equal(t, "sensors/1", topic)
+		readings <- r
+	})
+	require.NoError(t, err)
+	require.NoError(t, Publish(ctx, c, "sensors/1", packet.QoSLevelNone, false, JSON, reading{"t1", 21.5}))
+
+	select {
+	case m := <-undecoded:
+		assert.Equal(t, "not json", string(m.Payload))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the undecodable message did not reach OnMessage")
+	}
+	select {
+	case r := <-readings:
+		assert.Equal(t, reading{"t1", 21.5}, r)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reading")
+	}
+
+	assert.Error(t, Publish(ctx, c, "sensors/1", packet.QoSLevelNone, false, JSON, func() {}), "cannot be encoded")
+}
+
+func TestClientEvents(t *testing.T) {
+	events := &Events{}
+	ch, cancel := events.Channel(10)
+	next := func() Event {
+		select {
+		case e := <-ch:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+			return nil
+		}
+	}
+
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		if _, err := packet.ReadPacket(serverConn); err == nil {
+			_ = packet.WritePacket(serverConn, &packet.ConnAckControlPacket{VariableHeader: packet.ConnAckVariableHeader{ReturnCode: 5}})
+		}
+	}()
+	_, err := Connect(clientConn, Options{ClientID: "test", Events: events})
+	require.Error(t, err)
+	assert.Equal(t, ConnectFailed{ClientID: "test", Code: 5, Err: err}, next())
+
+	clientConn, serverConn = net.Pipe()
+	go fakeServer(t, serverConn, func(p packet.ControlPacket) []packet.ControlPacket {
+		switch p := p.(type) {
+		case *packet.SubscribeControlPacket:
+			return []packet.ControlPacket{packet.NewSubAck(uint16(p.VariableHeader.PacketID), []byte{packet.ReturncodeSuccessQoS0})}
+		case *packet.PublishControlPacket:
+			return []packet.ControlPacket{packet.NewPublish(p.VariableHeader.Topic, 0, p.Payload)}
+		}
+		return nil // never answers PINGREQ
+	})
+	c, err := Connect(clientConn, Options{ClientID: "test", KeepAlive: 100 * time.Millisecond, Events: events})
+	require.NoError(t, err)
+	assert.Equal(t, ConnectSucceeded{ClientID: "test"}, next())
+
+	ctx := context.Background()
+	_, err = c.Subscribe(ctx, "#", packet.QoSLevelNone, nil)
+	require.NoError(t, err)
+	require.NoError(t, c.Publish(ctx, "a/b", packet.QoSLevelNone, false, nil))
+	assert.Equal(t, MessageDropped{ClientID: "test", Topic: "a/b", Reason: DropNoHandler}, next())
+
+	assert.Equal(t, PingTimeout{ClientID: "test"}, next())
+	assert.Equal(t, ConnectionLost{ClientID: "test", Err: ErrPingTimeout}, next())
+
+	cancel()
+	events.Emit(PingTimeout{})
+	assert.Empty(t, ch)
+}
+
+func TestDialFollowsRedirects(t *testing.T) {
+	// serve accepts a connection on a new listener and answers CONNECT
+	// with connack
+	serve := func(connack *packet.ConnAckControlPacket, then ...packet.ControlPacket) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = l.Close() })
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close() // nolint: errcheck
+			r := packet.NewReader(conn)
+			r.Version = packet.ProtocolVersion5
+			if _, err := r.ReadPacket(); err != nil {
+				return
+			}
+			for _, p := range append([]packet.ControlPacket{connack}, then...) {
+				if packet.WritePacket(conn, p) != nil {
+					return
+				}
+			}
+			_, _ = r.ReadPacket() // until the client closes
+		}()
+		return l.Addr().String()
+	}
+	redirect := func(code byte, reference string) *packet.ConnAckControlPacket {
+		connack := packet.NewConnAck(code, false)
+		connack.VariableHeader.Properties = &packet.Properties{ServerReference: reference}
+		return connack
+	}
+
+	disconnect := packet.NewDisconnectControlPacket()
+	disconnect.VariableHeader.ReasonCode = packet.ReasonCodeUseAnotherServer
+	disconnect.VariableHeader.Properties = &packet.Properties{ServerReference: "other:1883"}
+	accepting := redirect(0, "")
+	target := serve(accepting, disconnect)
+	moved := serve(redirect(packet.ReasonCodeServerMoved, target+" backup:1883"))
+	first := serve(redirect(packet.ReasonCodeUseAnotherServer, moved))
+
+	c, err := Dial(first, Options{ClientID: "c", ProtocolVersion: packet.ProtocolVersion5, FollowRedirects: 2})
+	require.NoError(t, err)
+	<-c.Done()
+	assert.Equal(t, &DisconnectError{ReasonCode: packet.ReasonCodeUseAnotherServer, ServerReference: "other:1883"}, c.Err())
+
+	// Not followed beyond the limit
+	first = serve(redirect(packet.ReasonCodeUseAnotherServer, serve(accepting)))
+	_, err = Dial(first, Options{ClientID: "c", ProtocolVersion: packet.ProtocolVersion5})
+	var refused *ConnectError
+	require.ErrorAs(t, err, &refused)
+	assert.True(t, refused.Redirected())
+	assert.Contains(t, err.Error(), "use 127.0.0.1:")
+}
+
+func TestRedirectAddr(t *testing.T) {
+	for _, tc := range []struct{ reference, addr, want string }{
+		{"b:1884", "a:1883", "b:1884"},
+		{"b", "a:1883", "b:1883"},
+		{"b c:1885", "a:1883", "b:1883"},
+		{"::1", "a:1883", "[::1]:1883"},
+		{"[::1]", "a:1883", "[::1]:1883"},
+	} {
+		assert.Equal(t, tc.want, redirectAddr(tc.reference, tc.addr), tc.reference)
+	}
+}
@@ -0,0 +1,151 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package client
+
+import (
+	"slices"
+	"sync"
+)
+
+// Event is something that happened to a connection: ConnectSucceeded,
+// ConnectFailed, ConnectionLost, PingTimeout, Reconnecting or
+// MessageDropped
+type Event interface {
+	event()
+}
+
+// ConnectSucceeded is emitted when the server accepted the connection
+type ConnectSucceeded struct {
+	ClientID       string
+	SessionPresent bool
+}
+
+// ConnectFailed is emitted when the connection or the handshake failed.
+// Code is the return code of the CONNACK, the reason code on MQTT 5, if
+// the server refused the client, 0 otherwise.
+type ConnectFailed struct {
+	ClientID string
+	Code     byte
+	Err      error
+}
+
+// ConnectionLost is emitted when an established connection ended other
+// than by Disconnect
+type ConnectionLost struct {
+	ClientID string
+	Err      error
+}
+
+// PingTimeout is emitted when the server did not answer PINGREQ within
+// the keepalive, before the connection is closed
+type PingTimeout struct {
+	ClientID string
+}
+
+// Reconnecting is emitted by whoever reconnects a client, like a
+// bridge, before it tries again. Attempt counts from 1 since the last
+// connection that succeeded.
+type Reconnecting struct {
+	ClientID string
+	Attempt  int
+}
+
+// DropReason is why a message was dropped
+type DropReason string
+
+const (
+	// DropNoHandler is a message no subscription handler matched,
+	// without Options.OnMessage
+	DropNoHandler DropReason = "no handler"
+	// DropUndecodable is a message the Codec of a typed Subscribe could
+	// not decode, without Options.OnMessage
+	DropUndecodable DropReason = "undecodable"
+)
+
+// MessageDropped is emitted when a received message was delivered to
+// no one
+type MessageDropped struct {
+	ClientID string
+	Topic    string
+	Reason   DropReason
+}
+
+func (ConnectSucceeded) event() {}
+func (ConnectFailed) event()    {}
+func (ConnectionLost) event()   {}
+func (PingTimeout) event()      {}
+func (Reconnecting) event()     {}
+func (MessageDropped) event()   {}
+
+// Events passes the events of clients to the functions and channels
+// subscribed to it, e.g. to supervise them. Share one between the
+// clients of successive connections to follow them all. The zero value
+// is ready to use, and a nil *Events drops everything.
+type Events struct {
+	mu   sync.Mutex
+	subs []subscriber // in the order they subscribed
+	next uint64
+}
+
+type subscriber struct {
+	id uint64
+	f  func(Event)
+}
+
+// Subscribe calls f with every event until cancel is called. f runs on
+// the goroutine of the client and must not block.
+func (e *Events) Subscribe(f func(Event)) (cancel func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	id := e.next
+	e.next++
+	e.subs = append(e.subs, subscriber{id: id, f: f})
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		// A new slice, Emit may still range over the old one
+		e.subs = slices.DeleteFunc(slices.Clone(e.subs), func(s subscriber) bool { return s.id == id })
+	}
+}
+
+// Channel returns a channel receiving the events until cancel is
+// called. Events are dropped while size of them wait to be received.
+// The channel is never closed.
+func (e *Events) Channel(size int) (events <-chan Event, cancel func()) {
+	ch := make(chan Event, size)
+	cancel = e.Subscribe(func(ev Event) {
+		select {
+		case ch <- ev:
+		default:
+		}
+	})
+	return ch, cancel
+}
+
+// Emit passes ev to the subscribers, in the order they subscribed
+func (e *Events) Emit(ev Event) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	subs := e.subs
+	e.mu.Unlock()
+	for _, s := range subs {
+		s.f(ev)
+	}
+}
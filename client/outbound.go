@@ -0,0 +1,187 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package client
+
+import (
+	"sync"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+)
+
+// Outbound tracks the QoS 1 and 2 messages the client published whose
+// flow has not completed: a PUBLISH until its PUBACK or PUBREC, then the
+// PUBREL replacing it until PUBCOMP. It is safe for concurrent use.
+type Outbound struct {
+	// Persister, if set, is notified of every change. Set it before the
+	// Outbound is used. Only the outbound methods of the Persister are
+	// called.
+	Persister session.Persister
+
+	mu       sync.Mutex
+	inflight map[uint16]packet.ControlPacket
+	// order holds the packet identifiers in send order, so that the
+	// flows are resumed in their original ordering [MQTT-4.6.0-1]
+	order []uint16
+}
+
+// NewOutbound returns an Outbound tracking no messages
+func NewOutbound() *Outbound {
+	return &Outbound{inflight: make(map[uint16]packet.ControlPacket)}
+}
+
+// Restore adds in-flight PUBLISH and PUBREL packets loaded from storage,
+// in the order they were originally sent, without notifying the
+// Persister. Packets of other types are ignored.
+func (o *Outbound) Restore(packets []packet.ControlPacket) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, p := range packets {
+		var id uint16
+		switch p := p.(type) {
+		case *packet.PublishControlPacket:
+			id = uint16(p.VariableHeader.PacketID)
+		case *packet.PubrelControlPacket:
+			id = p.VariableHeader.PacketID
+		default:
+			continue
+		}
+		if _, ok := o.inflight[id]; !ok {
+			o.order = append(o.order, id)
+		}
+		o.inflight[id] = p
+	}
+}
+
+// Packets returns the in-flight PUBLISH and PUBREL packets in the order
+// the flows started
+func (o *Outbound) Packets() []packet.ControlPacket {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	packets := make([]packet.ControlPacket, 0, len(o.order))
+	for _, id := range o.order {
+		packets = append(packets, o.inflight[id])
+	}
+	return packets
+}
+
+// Len returns the number of messages whose flow has not completed
+func (o *Outbound) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.inflight)
+}
+
+// contains reports whether a flow with packetID is in progress
+func (o *Outbound) contains(packetID uint16) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, ok := o.inflight[packetID]
+	return ok
+}
+
+// publish starts the flow of a PUBLISH that was assigned a packet
+// identifier
+func (o *Outbound) publish(p *packet.PublishControlPacket) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	id := uint16(p.VariableHeader.PacketID)
+	if o.Persister != nil {
+		if err := o.Persister.StoreOutbound(p); err != nil {
+			return err
+		}
+	}
+	o.inflight[id] = p
+	o.order = append(o.order, id)
+	return nil
+}
+
+// acknowledge ends the flow of a PUBLISH with qos, after its PUBACK or a
+// PUBREC refusing it. It reports false if there is no such flow.
+func (o *Outbound) acknowledge(packetID uint16, qos packet.QosLevel) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, ok := o.inflight[packetID].(*packet.PublishControlPacket)
+	if !ok || p.FixedHeaderFlags.QoS != qos {
+		return false, nil
+	}
+	return true, o.remove(packetID)
+}
+
+// received replaces a QoS 2 PUBLISH by the PUBREL that is returned for
+// sending, after its PUBREC. A repeated PUBREC returns the same PUBREL
+// again, an unknown packetID nil.
+func (o *Outbound) received(packetID uint16, v5 bool) (*packet.PubrelControlPacket, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	switch p := o.inflight[packetID].(type) {
+	case *packet.PubrelControlPacket:
+		return p, nil
+	case *packet.PublishControlPacket:
+		if p.FixedHeaderFlags.QoS != packet.QoSLevelExactlyOnce {
+			return nil, nil
+		}
+		pubrel := packet.NewPubRelControlPacket(packetID)
+		if v5 {
+			pubrel.VariableHeader.Properties = &packet.Properties{}
+		}
+		if o.Persister != nil {
+			if err := o.Persister.StoreOutbound(pubrel); err != nil {
+				return nil, err
+			}
+		}
+		o.inflight[packetID] = pubrel
+		return pubrel, nil
+	}
+	return nil, nil
+}
+
+// completed ends the flow of a PUBREL after its PUBCOMP. It reports false
+// if there is no such flow.
+func (o *Outbound) completed(packetID uint16) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.inflight[packetID].(*packet.PubrelControlPacket); !ok {
+		return false, nil
+	}
+	return true, o.remove(packetID)
+}
+
+// discard drops the flow of a PUBLISH that could not be sent
+func (o *Outbound) discard(packetID uint16) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.remove(packetID)
+}
+
+// remove is called with o.mu held
+func (o *Outbound) remove(packetID uint16) error {
+	if o.Persister != nil {
+		if err := o.Persister.DeleteOutbound(packetID); err != nil {
+			return err
+		}
+	}
+	delete(o.inflight, packetID)
+	for i, id := range o.order {
+		if id == packetID {
+			o.order = append(o.order[:i], o.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// Codec turns values into message payloads and back for Publish and
+// Subscribe
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSON encodes values with encoding/json
+var JSON Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Publish publishes v encoded by codec, see Client.Publish
+func Publish[T any](ctx context.Context, c *Client, topic string, qos packet.QosLevel, retain bool, codec Codec, v T) error {
+	payload, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Publish(ctx, topic, qos, retain, payload)
+}
+
+// Subscribe subscribes to filter like Client.Subscribe and passes handler
+// the payloads of the messages decoded by codec. Messages codec cannot
+// decode go to Options.OnMessage, or are dropped with a MessageDropped
+// event if it is nil.
+func Subscribe[T any](ctx context.Context, c *Client, filter string, qos packet.QosLevel, codec Codec, handler func(topic string, v T)) (packet.QosLevel, error) {
+	return c.Subscribe(ctx, filter, qos, func(c *Client, m Message) {
+		var v T
+		if err := codec.Unmarshal(m.Payload, &v); err != nil {
+			if c.opts.OnMessage != nil {
+				c.opts.OnMessage(c, m)
+			} else {
+				c.opts.Events.Emit(MessageDropped{ClientID: c.opts.ClientID, Topic: m.Topic, Reason: DropUndecodable})
+			}
+			return
+		}
+		handler(m.Topic, v)
+	})
+}
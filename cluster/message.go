@@ -0,0 +1,71 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// messageTopic carries the messages forwarded to peers of version 3 and
+// later, see encodeMessage
+const messageTopic = "$cluster/message"
+
+var errInvalidMessage = errors.New("cluster: invalid forwarded message")
+
+// encodeMessage returns the payload of a message on messageTopic: the
+// protocol version of p, 5 if it has properties and 4 otherwise, then p
+// encoded as a PUBLISH of that version
+func encodeMessage(p *packet.PublishControlPacket) ([]byte, error) {
+	version := packet.ProtocolVersion311
+	if p.VariableHeader.Properties != nil {
+		version = packet.ProtocolVersion5
+	}
+	cp := *p
+	cp.FixedHeaderFlags.Dup = false
+	// Identifiers are per connection, but a PUBLISH with QoS above 0 needs one
+	cp.VariableHeader.PacketID = 0
+	if cp.FixedHeaderFlags.QoS > packet.QoSLevelNone {
+		cp.VariableHeader.PacketID = 1
+	}
+	return cp.AppendEncode([]byte{byte(version)})
+}
+
+// decodeMessage reverses encodeMessage
+func decodeMessage(b []byte) (*packet.PublishControlPacket, error) {
+	if len(b) == 0 {
+		return nil, errInvalidMessage
+	}
+	version := packet.ProtocolVersion(b[0])
+	if version != packet.ProtocolVersion311 && version != packet.ProtocolVersion5 {
+		return nil, errInvalidMessage
+	}
+	cp, err := packet.ReadPacketVersion(bytes.NewReader(b[1:]), version)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidMessage, err)
+	}
+	p, ok := cp.(*packet.PublishControlPacket)
+	if !ok {
+		return nil, errInvalidMessage
+	}
+	p.VariableHeader.PacketID = 0
+	return p, nil
+}
@@ -0,0 +1,121 @@
+package cluster
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/client"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func TestEncodeMessage(t *testing.T) {
+	v3 := packet.NewPublish("t/1", 7, []byte("x"))
+	v3.FixedHeaderFlags = packet.PublishHeaderFlags{QoS: packet.QoSLevelExactlyOnce, Retain: true, Dup: true}
+	v5 := packet.NewPublish("t/2", 0, []byte("y"))
+	v5.VariableHeader.Properties = &packet.Properties{ContentType: "text/plain"}
+
+	for _, p := range []*packet.PublishControlPacket{v3, v5} {
+		b, err := encodeMessage(p)
+		require.NoError(t, err)
+		decoded, err := decodeMessage(b)
+		require.NoError(t, err)
+		assert.Equal(t, p.VariableHeader.Topic, decoded.VariableHeader.Topic)
+		assert.Equal(t, p.Payload, decoded.Payload)
+		assert.Equal(t, p.FixedHeaderFlags.QoS, decoded.FixedHeaderFlags.QoS)
+		assert.Equal(t, p.FixedHeaderFlags.Retain, decoded.FixedHeaderFlags.Retain)
+		assert.False(t, decoded.FixedHeaderFlags.Dup)
+		assert.Zero(t, decoded.VariableHeader.PacketID)
+		assert.Equal(t, p.VariableHeader.Properties, decoded.VariableHeader.Properties)
+	}
+
+	for _, b := range [][]byte{nil, {9}, {4, 0x30}, {4, 0x82, 2, 0, 1}} {
+		_, err := decodeMessage(b)
+		assert.ErrorIs(t, err, errInvalidMessage, b)
+	}
+}
+
+func TestNodeForwardOldPeer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	n := &Node{Name: "new"}
+	go n.Serve(l) // nolint: errcheck
+	t.Cleanup(func() { _ = n.Close() })
+
+	// A node before versioning gets messages without QoS
+	received := make(chan client.Message, 1)
+	old, err := client.Dial(l.Addr().String(), client.Options{
+		ClientID:     "old",
+		CleanSession: true,
+		OnMessage:    func(_ *client.Client, m client.Message) { received <- m },
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = old.Disconnect() })
+	_, err = old.Subscribe(context.Background(), "t", packet.QoSLevelNone, nil)
+	require.NoError(t, err)
+	require.Eventually(t, subscribed(n, "old", "t"), 5*time.Second, 5*time.Millisecond)
+
+	p := packet.NewPublish("t", 1, []byte("x"))
+	p.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+	n.Forward(p)
+	select {
+	case m := <-received:
+		assert.Equal(t, client.Message{Topic: "t", Payload: []byte("x")}, m)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not forwarded")
+	}
+}
+
+func TestNodeForwardQueued(t *testing.T) {
+	srv := &broker.Server{}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(l) // nolint: errcheck
+	t.Cleanup(func() { _ = srv.Close() })
+	delivered := make(chan struct{}, 1)
+	a, b, _ := newPair(t, func(a, b *Node) {
+		a.Deliver = func(p *packet.PublishControlPacket) {
+			srv.Publish(p)
+			delivered <- struct{}{}
+		}
+	})
+
+	received := make(chan client.Message, 1)
+	options := client.Options{
+		ClientID:  "sub",
+		OnMessage: func(_ *client.Client, m client.Message) { received <- m },
+	}
+	c, err := client.Dial(l.Addr().String(), options)
+	require.NoError(t, err)
+	_, err = c.Subscribe(context.Background(), "t", packet.QoSLevelAtLeastOnce, nil)
+	require.NoError(t, err)
+	a.Subscribe("t")
+	require.Eventually(t, subscribed(b, "a", "t"), 5*time.Second, 5*time.Millisecond)
+	require.NoError(t, c.Disconnect())
+	require.Eventually(t, func() bool { return len(srv.Clients()) == 0 }, 5*time.Second, 5*time.Millisecond)
+
+	// The persistent session gets the message of the other node queued
+	p := packet.NewPublish("t", 1, []byte("x"))
+	p.FixedHeaderFlags.QoS = packet.QoSLevelExactlyOnce
+	b.Forward(p)
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not forwarded")
+	}
+	c, err = client.Dial(l.Addr().String(), options)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Disconnect() })
+	select {
+	case m := <-received:
+		assert.Equal(t, "t", m.Topic)
+		assert.Equal(t, packet.QoSLevelAtLeastOnce, m.QoS, "the QoS of the subscription")
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not queued")
+	}
+}
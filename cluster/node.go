@@ -0,0 +1,573 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Package cluster joins brokers into a cluster, so that clients connected
+// to different brokers receive each other's messages.
+//
+// Every node connects to each of its peers as an MQTT client and
+// subscribes there to the topic filters its own clients subscribed to.
+// A node thus knows the subscription table of every peer, and forwards a
+// PUBLISH from its clients only to the peers with matching subscribers.
+// Forwarded messages are delivered to local clients and never forwarded
+// again, so the nodes have to form a full mesh.
+//
+// Shared subscriptions are balanced by every node on its own, so that
+// each node with members of a group delivers every message to one of
+// them. Nodes with CapabilitySharedSubscriptions balance them across the
+// cluster instead, see Node.Share.
+//
+// The protocol is versioned, see ProtocolVersion, so that a cluster can
+// be upgraded node by node. A link introduces its node in CONNECT with
+// the versions it speaks and its capabilities; the peer refuses it if
+// they have no version in common, and uses the capabilities both
+// support.
+package cluster
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/client"
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/topic"
+)
+
+// ErrNodeClosed is returned by Serve after Close
+var ErrNodeClosed = errors.New("cluster: Node closed")
+
+const (
+	defaultRetryInterval = time.Second
+	peerKeepAlive        = 30 * time.Second
+	subscribeTimeout     = 10 * time.Second
+)
+
+// Node is the member of a cluster running next to a broker. The broker
+// reports the subscriptions of its clients with Subscribe and
+// Unsubscribe, and hands every PUBLISH of its clients to Forward.
+// Set the fields before calling Serve.
+type Node struct {
+	// Name identifies the node to its peers and has to be unique in the
+	// cluster
+	Name string
+	// Peers are the addresses of the other nodes
+	Peers []string
+	// Deliver is called with the messages forwarded by peers. It must
+	// deliver them to the local subscribers only before returning, see
+	// broker.Server.Publish.
+	Deliver func(p *packet.PublishControlPacket)
+	// DeliverShared is called with the messages for the shared
+	// subscription share this node was chosen for, with
+	// CapabilitySharedSubscriptions. It must deliver them to one local
+	// member of share, see broker.Server.PublishShared.
+	DeliverShared func(share string, p *packet.PublishControlPacket)
+	// RetryInterval is the wait before reconnecting to a peer. Defaults
+	// to one second.
+	RetryInterval time.Duration
+	// Logger receives the log entries of the node. May be nil.
+	Logger logger.Logger
+	// MinPeerVersion is the oldest version of the protocol the node
+	// accepts peers of. Defaults to 1; raise it once every node of the
+	// cluster was upgraded, to drop the compatibility.
+	MinPeerVersion int
+	// Capabilities name the optional features of the protocol the node
+	// supports. New features come as capabilities, so that a node only
+	// uses them with peers that were upgraded too, see Peer.
+	Capabilities []string
+
+	server broker.Server // connections of the peers
+	remote *topic.Tree   // subscriptions of the peers, by peer name
+	quit   chan struct{}
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	local   map[string]int // reference count of the local filters
+	turns   map[string]int // the next member of the local shared subscriptions
+	peers   map[string]*peer
+	links   []*link
+	started bool
+	closed  bool
+	// delivering holds the messages of peers being passed to Deliver
+	delivering map[*packet.PublishControlPacket]struct{}
+}
+
+// peer is the connection of a peer subscribing to this node
+type peer struct {
+	conn    *broker.Conn
+	info    PeerInfo
+	filters map[string]struct{}
+}
+
+// link is the connection of this node to a peer
+type link struct {
+	addr string
+	sync chan struct{} // signals a change of the local filters
+	// shared is set once the peer answered the hello with
+	// CapabilitySharedSubscriptions, guarded by Node.mu
+	shared bool
+}
+
+func (n *Node) init() {
+	if n.quit == nil {
+		n.quit = make(chan struct{})
+		n.remote = topic.NewTree()
+		n.local = make(map[string]int)
+		n.turns = make(map[string]int)
+		n.delivering = make(map[*packet.PublishControlPacket]struct{})
+		n.peers = make(map[string]*peer)
+		n.server.Hooks = []broker.Hook{peerHook{n: n}}
+		n.server.Logger = n.Logger
+	}
+}
+
+// Serve accepts the connections of the peers on l and connects to every
+// address in Peers. It always returns a non-nil error and closes l.
+func (n *Node) Serve(l net.Listener) error {
+	n.mu.Lock()
+	n.init()
+	if n.closed {
+		n.mu.Unlock()
+		_ = l.Close()
+		return ErrNodeClosed
+	}
+	if !n.started {
+		n.started = true
+		for _, addr := range n.Peers {
+			lk := &link{addr: addr, sync: make(chan struct{}, 1)}
+			n.links = append(n.links, lk)
+			n.wg.Add(1)
+			go n.runLink(lk)
+		}
+	}
+	n.mu.Unlock()
+
+	if err := n.server.Serve(l); err != broker.ErrServerClosed {
+		return err
+	}
+	return ErrNodeClosed
+}
+
+// Close disconnects from the peers and closes the connections of peers
+func (n *Node) Close() error {
+	n.mu.Lock()
+	n.init()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	close(n.quit)
+	n.mu.Unlock()
+
+	err := n.server.Close()
+	n.wg.Wait()
+	return err
+}
+
+// Subscribe is called when a local client subscribed to filter. Peers
+// are told about the first subscription to a filter.
+func (n *Node) Subscribe(filter string) {
+	n.mu.Lock()
+	n.init()
+	n.local[filter]++
+	first := n.local[filter] == 1
+	n.mu.Unlock()
+
+	if first {
+		n.syncLinks()
+	}
+}
+
+// Unsubscribe is called when a local client unsubscribed from filter, or
+// its session with the subscription ended. Peers are told once no local
+// client is subscribed to filter any more.
+func (n *Node) Unsubscribe(filter string) {
+	n.mu.Lock()
+	n.init()
+	count, ok := n.local[filter]
+	if !ok {
+		n.mu.Unlock()
+		return
+	}
+	if count > 1 {
+		n.local[filter] = count - 1
+		n.mu.Unlock()
+		return
+	}
+	delete(n.local, filter)
+	delete(n.turns, filter)
+	n.mu.Unlock()
+
+	n.syncLinks()
+}
+
+// Forward sends p to every peer with a matching subscription. Only
+// messages from local clients may be forwarded. Peers of version 3 and
+// later receive them with the QoS, retain flag and properties of the
+// publisher, and deliver them to their subscribers as they would a
+// message of a local client. Older peers receive them with QoS 0 and
+// without retain flag or properties. Forwarded messages are not
+// retained by peers; retained messages are shared by giving the brokers
+// a common RetainStore.
+//
+// Of the shared subscriptions peers are members of, Forward only serves
+// those without local members, sending p to one of the peers in turn;
+// Share chooses the member of the others.
+func (n *Node) Forward(p *packet.PublishControlPacket) {
+	type target struct {
+		conn    *broker.Conn
+		version int
+	}
+	n.mu.Lock()
+	n.init()
+	var targets []target
+	var shares []string
+	seen := make(map[string]struct{})
+	for _, sub := range n.remote.Match(p.VariableHeader.Topic) {
+		pr, ok := n.peers[sub.ClientID]
+		if !ok {
+			continue
+		}
+		if sub.Share != "" {
+			if n.local[sub.Share] == 0 && !slices.Contains(shares, sub.Share) {
+				shares = append(shares, sub.Share)
+			}
+			continue
+		}
+		// A peer subscribed to several matching filters receives p once
+		if _, ok := seen[sub.ClientID]; !ok {
+			seen[sub.ClientID] = struct{}{}
+			targets = append(targets, target{pr.conn, pr.info.Version})
+		}
+	}
+	n.mu.Unlock()
+
+	for _, share := range shares {
+		n.share(share, p, false)
+	}
+	for _, t := range targets {
+		if t.version >= 3 {
+			n.forwardMessage(t.conn, p)
+		} else {
+			n.forward(t.conn, forwarded(p))
+		}
+	}
+}
+
+// forwardMessage sends p to the peer c on messageTopic, with the QoS of
+// its publisher so that the link acknowledges it as well
+func (n *Node) forwardMessage(c *broker.Conn, p *packet.PublishControlPacket) {
+	b, err := encodeMessage(p)
+	if err != nil {
+		n.log(logger.LevelWarn, "cluster: failed to encode message", logger.F("topic", p.VariableHeader.Topic), logger.F("error", err))
+		return
+	}
+	fwd := packet.NewPublish(messageTopic, 0, b)
+	fwd.FixedHeaderFlags.QoS = p.FixedHeaderFlags.QoS
+	n.forward(c, fwd)
+}
+
+// forwarded returns a copy of p as forwarded to peers of version 2 and
+// earlier
+func forwarded(p *packet.PublishControlPacket) *packet.PublishControlPacket {
+	fwd := *p
+	fwd.FixedHeaderFlags = packet.PublishHeaderFlags{QoS: packet.QoSLevelNone}
+	fwd.VariableHeader.PacketID = 0
+	fwd.VariableHeader.Properties = nil
+	return &fwd
+}
+
+// forward writes p to the connection c of a peer
+func (n *Node) forward(c *broker.Conn, p *packet.PublishControlPacket) {
+	if err := c.Publish(p); err != nil {
+		n.log(logger.LevelWarn, "cluster: failed to forward message",
+			logger.F("peer", c.ClientID()),
+			logger.F("topic", p.VariableHeader.Topic),
+			logger.F("error", err))
+	}
+}
+
+// peerHook records the subscriptions of the peers, which the server of
+// the node answers itself
+type peerHook struct {
+	broker.NopHook
+	n *Node
+}
+
+// OnConnect refuses peers that speak no version of the protocol the node
+// does
+func (h peerHook) OnConnect(c *broker.Conn) error {
+	hl, err := parseHello(c.Connect())
+	if err == nil {
+		var info PeerInfo
+		if info, err = h.n.negotiate(hl); err == nil {
+			h.n.mu.Lock()
+			h.n.peer(c).info = info
+			h.n.mu.Unlock()
+			return nil
+		}
+	}
+	h.n.log(logger.LevelWarn, "cluster: refused peer", logger.F("peer", c.ClientID()), logger.F("error", err))
+	return err
+}
+
+func (h peerHook) OnSubscribe(c *broker.Conn, p *packet.SubscribeControlPacket) error {
+	h.n.mu.Lock()
+	pr := h.n.peer(c)
+	asked := false
+	for _, sub := range p.Payload.Subscriptions {
+		if sub.Topic == helloTopic {
+			asked = true
+			continue
+		}
+		pr.filters[sub.Topic] = struct{}{}
+		h.n.remote.Subscribe(c.ClientID(), sub.Topic, packet.QoSLevelNone)
+	}
+	h.n.mu.Unlock()
+	if asked {
+		h.n.answerHello(c)
+	}
+	return nil
+}
+
+func (h peerHook) OnUnsubscribe(c *broker.Conn, p *packet.UnsubscribeControlPacket) {
+	h.n.mu.Lock()
+	defer h.n.mu.Unlock()
+	pr := h.n.peer(c)
+	for _, filter := range p.Payload.Topics {
+		delete(pr.filters, filter)
+		h.n.remote.Unsubscribe(c.ClientID(), filter)
+	}
+}
+
+// peer returns the subscriptions of the peer connected through c. The
+// subscriptions of an earlier connection of the same peer are dropped,
+// the peer sends all of them again after reconnecting. n.mu must be held.
+func (n *Node) peer(c *broker.Conn) *peer {
+	name := c.ClientID()
+	if pr, ok := n.peers[name]; ok && pr.conn == c {
+		return pr
+	}
+	n.dropPeer(name)
+	pr := &peer{conn: c, filters: make(map[string]struct{})}
+	n.peers[name] = pr
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		<-c.Done()
+		n.mu.Lock()
+		if n.peers[name] == pr {
+			n.dropPeer(name)
+		}
+		n.mu.Unlock()
+	}()
+	return pr
+}
+
+// dropPeer removes the subscriptions of the peer name. n.mu must be held.
+func (n *Node) dropPeer(name string) {
+	pr, ok := n.peers[name]
+	if !ok {
+		return
+	}
+	for filter := range pr.filters {
+		n.remote.Unsubscribe(name, filter)
+	}
+	delete(n.peers, name)
+}
+
+// syncLinks makes every link bring the subscriptions at its peer up to
+// date
+func (n *Node) syncLinks() {
+	n.mu.Lock()
+	links := n.links
+	n.mu.Unlock()
+	for _, lk := range links {
+		select {
+		case lk.sync <- struct{}{}:
+		default: // a sync is pending already
+		}
+	}
+}
+
+// runLink keeps the connection to a peer, reconnecting whenever it is
+// lost, until the node is closed
+func (n *Node) runLink(lk *link) {
+	defer n.wg.Done()
+	for {
+		c, err := client.Dial(lk.addr, client.Options{
+			ClientID:     n.Name,
+			UserName:     helloUserName,
+			Password:     n.hello().encode(),
+			CleanSession: true,
+			KeepAlive:    peerKeepAlive,
+			// Not per subscription, messages matching several filters
+			// must be delivered once
+			OnMessage: func(_ *client.Client, m client.Message) { n.deliver(lk, m) },
+		})
+		var refused *client.ConnectError
+		if errors.As(err, &refused) && refused.ReturnCode == packet.ConnAckNotAuthorized {
+			n.log(logger.LevelWarn, "cluster: peer refused the connection, it may speak no version of the protocol in common", logger.F("addr", lk.addr), logger.F("version", ProtocolVersion))
+		} else if err != nil {
+			n.log(logger.LevelWarn, "cluster: failed to connect to peer", logger.F("addr", lk.addr), logger.F("error", err))
+		} else {
+			n.log(logger.LevelInfo, "cluster: connected to peer", logger.F("addr", lk.addr))
+			n.serveLink(lk, c)
+			if n.isClosed() {
+				return
+			}
+			n.log(logger.LevelWarn, "cluster: lost connection to peer", logger.F("addr", lk.addr), logger.F("error", c.Err()))
+		}
+
+		select {
+		case <-n.quit:
+			return
+		case <-time.After(n.retryInterval()):
+		}
+	}
+}
+
+// serveLink subscribes at the peer to the local filters until the
+// connection ends or the node is closed
+func (n *Node) serveLink(lk *link, c *client.Client) {
+	n.mu.Lock()
+	lk.shared = false
+	n.mu.Unlock()
+	if err := n.askHello(c); err != nil {
+		n.log(logger.LevelWarn, "cluster: failed to ask peer for its hello", logger.F("addr", lk.addr), logger.F("error", err))
+		_ = c.Disconnect()
+		return
+	}
+	subscribed := make(map[string]struct{})
+	for {
+		if err := n.syncLink(lk, c, subscribed); err != nil {
+			n.log(logger.LevelWarn, "cluster: failed to update subscriptions at peer", logger.F("addr", lk.addr), logger.F("error", err))
+			_ = c.Disconnect()
+			return
+		}
+		select {
+		case <-lk.sync:
+		case <-c.Done():
+			return
+		case <-n.quit:
+			_ = c.Disconnect()
+			return
+		}
+	}
+}
+
+// syncLink subscribes at the peer to the local filters missing from
+// subscribed, and unsubscribes from the ones no longer needed
+func (n *Node) syncLink(lk *link, c *client.Client, subscribed map[string]struct{}) error {
+	n.mu.Lock()
+	wanted := make(map[string]struct{}, len(n.local))
+	for filter := range n.local {
+		wanted[lk.filter(filter)] = struct{}{}
+	}
+	n.mu.Unlock()
+	var add, remove []string
+	for filter := range wanted {
+		if _, ok := subscribed[filter]; !ok {
+			add = append(add, filter)
+		}
+	}
+	for filter := range subscribed {
+		if _, ok := wanted[filter]; !ok {
+			remove = append(remove, filter)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), subscribeTimeout)
+	defer cancel()
+	for _, filter := range add {
+		if _, err := c.Subscribe(ctx, filter, packet.QoSLevelNone, nil); err != nil {
+			return err
+		}
+		subscribed[filter] = struct{}{}
+	}
+	if len(remove) > 0 {
+		if err := c.Unsubscribe(ctx, remove...); err != nil {
+			return err
+		}
+		for _, filter := range remove {
+			delete(subscribed, filter)
+		}
+	}
+	return nil
+}
+
+// deliver hands a message forwarded by the peer of lk to the broker
+func (n *Node) deliver(lk *link, m client.Message) {
+	var p *packet.PublishControlPacket
+	switch m.Topic {
+	case helloTopic:
+		n.receiveHello(lk, m.Payload)
+		return
+	case sharedTopic:
+		n.receiveShared(m.Payload, decodeShared)
+		return
+	case sharedMessageTopic:
+		n.receiveShared(m.Payload, decodeSharedMessage)
+		return
+	case messageTopic:
+		var err error
+		if p, err = decodeMessage(m.Payload); err != nil {
+			n.log(logger.LevelWarn, "cluster: dropped message of peer", logger.F("addr", lk.addr), logger.F("error", err))
+			return
+		}
+	default:
+		p = packet.NewPublish(m.Topic, 0, m.Payload)
+	}
+	n.mu.Lock()
+	n.delivering[p] = struct{}{}
+	shared := lk.shared
+	n.mu.Unlock()
+	if n.Deliver != nil {
+		n.Deliver(p)
+	}
+	n.mu.Lock()
+	delete(n.delivering, p)
+	n.mu.Unlock()
+	if !shared {
+		n.balanceLocally(p)
+	}
+}
+
+func (n *Node) isClosed() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.closed
+}
+
+func (n *Node) retryInterval() time.Duration {
+	if n.RetryInterval > 0 {
+		return n.RetryInterval
+	}
+	return defaultRetryInterval
+}
+
+func (n *Node) log(level logger.Level, msg string, fields ...logger.Field) {
+	if n.Logger != nil {
+		n.Logger.Log(level, msg, append([]logger.Field{logger.F("node", n.Name)}, fields...)...)
+	}
+}
@@ -0,0 +1,120 @@
+package cluster
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// newPair starts two nodes that are each other's peer, after configure
+func newPair(t *testing.T, configure ...func(a, b *Node)) (a, b *Node, delivered chan *packet.PublishControlPacket) {
+	la, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	lb, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	delivered = make(chan *packet.PublishControlPacket, 10)
+	a = &Node{
+		Name:          "a",
+		Peers:         []string{lb.Addr().String()},
+		Deliver:       func(p *packet.PublishControlPacket) { delivered <- p },
+		RetryInterval: 10 * time.Millisecond,
+	}
+	b = &Node{
+		Name:          "b",
+		Peers:         []string{la.Addr().String()},
+		RetryInterval: 10 * time.Millisecond,
+	}
+	for _, f := range configure {
+		f(a, b)
+	}
+	go a.Serve(la) // nolint: errcheck
+	go b.Serve(lb) // nolint: errcheck
+	t.Cleanup(func() {
+		assert.NoError(t, a.Close())
+		assert.NoError(t, b.Close())
+	})
+	return a, b, delivered
+}
+
+func subscribed(n *Node, peer, topic string) func() bool {
+	return func() bool {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.init()
+		for _, sub := range n.remote.Match(topic) {
+			if sub.ClientID == peer {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestNodeForward(t *testing.T) {
+	a, b, delivered := newPair(t)
+
+	a.Subscribe("sensors/+")
+	a.Subscribe("sensors/#")
+	a.Subscribe("$share/g/other")
+	require.Eventually(t, subscribed(b, "a", "sensors/1"), 5*time.Second, 5*time.Millisecond)
+	require.Eventually(t, subscribed(b, "a", "other"), 5*time.Second, 5*time.Millisecond)
+
+	p := packet.NewPublish("sensors/1", 7, []byte("21"))
+	p.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+	p.FixedHeaderFlags.Retain = true
+	p.VariableHeader.Properties = &packet.Properties{ContentType: "text/plain"}
+	b.Forward(p)
+	b.Forward(packet.NewPublish("unrelated", 0, []byte("x")))
+
+	select {
+	case fwd := <-delivered:
+		assert.Equal(t, "sensors/1", fwd.VariableHeader.Topic)
+		assert.Equal(t, []byte("21"), fwd.Payload)
+		assert.Equal(t, packet.QoSLevelAtLeastOnce, fwd.FixedHeaderFlags.QoS)
+		assert.True(t, fwd.FixedHeaderFlags.Retain)
+		require.NotNil(t, fwd.VariableHeader.Properties)
+		assert.Equal(t, "text/plain", fwd.VariableHeader.Properties.ContentType)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not forwarded")
+	}
+	select {
+	case fwd := <-delivered:
+		t.Fatalf("unexpected delivery of %v", fwd.VariableHeader.Topic)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The peer is only told once the last local subscription is gone
+	a.Subscribe("sensors/+")
+	a.Unsubscribe("sensors/+")
+	a.Unsubscribe("sensors/#")
+	a.Unsubscribe("sensors/+")
+	require.Eventually(t, func() bool { return !subscribed(b, "a", "sensors/1")() }, 5*time.Second, 5*time.Millisecond)
+	assert.True(t, subscribed(b, "a", "other")())
+}
+
+func TestNodeReconnect(t *testing.T) {
+	a, b, _ := newPair(t)
+
+	a.Subscribe("t")
+	require.Eventually(t, subscribed(b, "a", "t"), 5*time.Second, 5*time.Millisecond)
+
+	// Dropping the connection of a loses its subscriptions at b, until a
+	// has reconnected and sent them again
+	b.mu.Lock()
+	conn := b.peers["a"].conn
+	b.mu.Unlock()
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		pr, ok := b.peers["a"]
+		return ok && pr.conn != conn
+	}, 5*time.Second, 5*time.Millisecond)
+	require.Eventually(t, subscribed(b, "a", "t"), 5*time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,294 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package cluster
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/client"
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/topic"
+)
+
+// CapabilitySharedSubscriptions balances shared subscriptions across the
+// cluster. Nodes subscribe at their peers to their shared subscriptions
+// as such, becoming members of them, and every message goes to a single
+// member cluster-wide. Peers without it receive the filters the shared
+// subscriptions apply to and balance their members on their own.
+const CapabilitySharedSubscriptions = "shared-subscriptions"
+
+const (
+	// helloTopic is subscribed to by links; the node answers with its
+	// hello on it, so that a link learns the capabilities of its peer.
+	// Older nodes never answer.
+	helloTopic = "$cluster/hello"
+	// sharedTopic carries the messages for a shared subscription a peer
+	// of version 2 chose the receiving node for, see encodeShared
+	sharedTopic = "$cluster/shared"
+	// sharedMessageTopic carries them for peers of version 3 and later,
+	// with the QoS, retain flag and properties of the publisher, see
+	// encodeSharedMessage
+	sharedMessageTopic = "$cluster/shared-message"
+)
+
+var (
+	errInvalidShared = errors.New("cluster: invalid message for a shared subscription")
+	errPeerGone      = errors.New("cluster: peer is gone")
+)
+
+// sharing reports whether n balances shared subscriptions across the
+// cluster
+func (n *Node) sharing() bool {
+	return slices.Contains(n.Capabilities, CapabilitySharedSubscriptions)
+}
+
+// filter returns the filter lk subscribes to at its peer for a local
+// one. n.mu must be held.
+func (lk *link) filter(filter string) string {
+	if _, f, ok := topic.ParseShared(filter); ok && !lk.shared {
+		return f
+	}
+	return filter
+}
+
+// askHello subscribes to helloTopic at the peer
+func (n *Node) askHello(c *client.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), subscribeTimeout)
+	defer cancel()
+	_, err := c.Subscribe(ctx, helloTopic, packet.QoSLevelNone, nil)
+	return err
+}
+
+// answerHello sends the hello of n to the link of the peer c
+func (n *Node) answerHello(c *broker.Conn) {
+	if err := c.WritePacket(packet.NewPublish(helloTopic, 0, n.hello().encode())); err != nil {
+		n.log(logger.LevelWarn, "cluster: failed to answer hello", logger.F("peer", c.ClientID()), logger.F("error", err))
+	}
+}
+
+// receiveHello records the capabilities the peer of lk answered with and
+// brings the subscriptions there up to date
+func (n *Node) receiveHello(lk *link, b []byte) {
+	h, err := decodeHello(b)
+	if err != nil {
+		n.log(logger.LevelWarn, "cluster: invalid hello of peer", logger.F("addr", lk.addr), logger.F("error", err))
+		return
+	}
+	info, err := n.negotiate(h)
+	shared := err == nil && info.HasCapability(CapabilitySharedSubscriptions)
+
+	n.mu.Lock()
+	changed := lk.shared != shared
+	lk.shared = shared
+	n.mu.Unlock()
+	if changed {
+		select {
+		case lk.sync <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Share chooses the member of the shared subscription share that gets
+// p, for broker.Server.ShareFilter. The broker calls it for the shared
+// subscriptions it has members of, so the candidates are this node and
+// the peers that are members as well; they take turns. Share reports
+// whether this node was chosen and otherwise forwards p to the peer that
+// was. If the peer cannot be reached, the next member in turn gets p.
+// Messages forwarded by peers are left to DeliverShared.
+//
+// Without CapabilitySharedSubscriptions, every node balances on its own
+// and Share always reports true.
+func (n *Node) Share(share string, p *packet.PublishControlPacket) bool {
+	if !n.sharing() {
+		return true
+	}
+	n.mu.Lock()
+	n.init()
+	_, delivering := n.delivering[p]
+	n.mu.Unlock()
+	if delivering {
+		return false
+	}
+	return n.share(share, p, true)
+}
+
+// share hands p to the next member of share in turn, out of the peers
+// that are members and this node if local is set, and reports whether
+// this node was chosen. Members that fail to take p are skipped.
+func (n *Node) share(share string, p *packet.PublishControlPacket, local bool) bool {
+	type member struct {
+		name    string
+		conn    *broker.Conn
+		version int
+	}
+	n.mu.Lock()
+	var members []member
+	if local {
+		members = append(members, member{name: n.Name})
+	}
+	for name, pr := range n.peers {
+		if _, ok := pr.filters[share]; ok {
+			members = append(members, member{name, pr.conn, pr.info.Version})
+		}
+	}
+	if len(members) == 0 {
+		n.mu.Unlock()
+		return false
+	}
+	slices.SortFunc(members, func(a, b member) int { return strings.Compare(a.name, b.name) })
+	turn := n.turns[share] % len(members)
+	n.turns[share] = turn + 1
+	n.mu.Unlock()
+
+	for i := range members {
+		m := members[(turn+i)%len(members)]
+		if m.conn == nil {
+			return true
+		}
+		if err := n.forwardShared(m.conn, m.version, share, p); err != nil {
+			n.log(logger.LevelWarn, "cluster: failed to forward message, trying the next member",
+				logger.F("peer", m.name),
+				logger.F("share", share),
+				logger.F("error", err))
+			continue
+		}
+		return false
+	}
+	n.log(logger.LevelWarn, "cluster: dropped message, no member of the shared subscription is reachable",
+		logger.F("share", share),
+		logger.F("topic", p.VariableHeader.Topic))
+	return false
+}
+
+// forwardShared sends p to the peer c of the given protocol version,
+// chosen for the shared subscription share. It fails if the connection
+// of the peer is gone.
+func (n *Node) forwardShared(c *broker.Conn, version int, share string, p *packet.PublishControlPacket) error {
+	select {
+	case <-c.Done():
+		return errPeerGone
+	default:
+	}
+	var fwd *packet.PublishControlPacket
+	if version >= 3 {
+		b, err := encodeSharedMessage(share, p)
+		if err != nil {
+			return err
+		}
+		fwd = packet.NewPublish(sharedMessageTopic, 0, b)
+		fwd.FixedHeaderFlags.QoS = p.FixedHeaderFlags.QoS
+	} else {
+		fwd = forwarded(p)
+		fwd.VariableHeader.Topic = sharedTopic
+		fwd.Payload = encodeShared(share, p.VariableHeader.Topic, p.Payload)
+	}
+	return c.Publish(fwd)
+}
+
+// receiveShared hands a message for a shared subscription, encoded by
+// decode, to DeliverShared
+func (n *Node) receiveShared(b []byte, decode func([]byte) (string, *packet.PublishControlPacket, error)) {
+	share, p, err := decode(b)
+	if err != nil {
+		n.log(logger.LevelWarn, "cluster: dropped message of peer", logger.F("error", err))
+		return
+	}
+	if n.DeliverShared != nil {
+		n.DeliverShared(share, p)
+	}
+}
+
+// balanceLocally hands p, forwarded by a peer without
+// CapabilitySharedSubscriptions, to one local member of every matching
+// shared subscription. Such peers send their messages to every node
+// with members.
+func (n *Node) balanceLocally(p *packet.PublishControlPacket) {
+	if !n.sharing() || n.DeliverShared == nil {
+		return
+	}
+	var shares []string
+	n.mu.Lock()
+	for filter := range n.local {
+		if _, f, ok := topic.ParseShared(filter); ok && topic.Matches(f, p.VariableHeader.Topic) {
+			shares = append(shares, filter)
+		}
+	}
+	n.mu.Unlock()
+	slices.Sort(shares)
+	for _, share := range shares {
+		n.DeliverShared(share, p)
+	}
+}
+
+// encodeShared returns the payload of a message on sharedTopic: the
+// filter of the shared subscription and the topic of the message, each
+// preceded by its length as a uvarint, then the payload of the message
+func encodeShared(share, topic string, payload []byte) []byte {
+	b := make([]byte, 0, 2*binary.MaxVarintLen16+len(share)+len(topic)+len(payload))
+	b = binary.AppendUvarint(b, uint64(len(share)))
+	b = append(b, share...)
+	b = binary.AppendUvarint(b, uint64(len(topic)))
+	b = append(b, topic...)
+	return append(b, payload...)
+}
+
+// decodeShared reverses encodeShared
+func decodeShared(b []byte) (share string, p *packet.PublishControlPacket, err error) {
+	var fields [2]string
+	for i := range fields {
+		l, k := binary.Uvarint(b)
+		if k <= 0 || l > uint64(len(b)-k) {
+			return "", nil, errInvalidShared
+		}
+		fields[i] = string(b[k : k+int(l)])
+		b = b[k+int(l):]
+	}
+	return fields[0], packet.NewPublish(fields[1], 0, b), nil
+}
+
+// encodeSharedMessage returns the payload of a message on
+// sharedMessageTopic: the filter of the shared subscription preceded by
+// its length as a uvarint, then p as encoded by encodeMessage
+func encodeSharedMessage(share string, p *packet.PublishControlPacket) ([]byte, error) {
+	b, err := encodeMessage(p)
+	if err != nil {
+		return nil, err
+	}
+	prefix := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen16+len(share)+len(b)), uint64(len(share)))
+	return append(append(prefix, share...), b...), nil
+}
+
+// decodeSharedMessage reverses encodeSharedMessage
+func decodeSharedMessage(b []byte) (share string, p *packet.PublishControlPacket, err error) {
+	l, k := binary.Uvarint(b)
+	if k <= 0 || l > uint64(len(b)-k) {
+		return "", nil, errInvalidShared
+	}
+	if p, err = decodeMessage(b[k+int(l):]); err != nil {
+		return "", nil, fmt.Errorf("%w: %v", errInvalidShared, err)
+	}
+	return string(b[k : k+int(l)]), p, nil
+}
@@ -0,0 +1,154 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func member(n *Node, peer, share string) func() bool {
+	return func() bool {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		pr, ok := n.peers[peer]
+		if !ok {
+			return false
+		}
+		_, ok = pr.filters[share]
+		return ok
+	}
+}
+
+func TestEncodeShared(t *testing.T) {
+	share, p, err := decodeShared(encodeShared("$share/g/t/+", "t/1", []byte("x")))
+	require.NoError(t, err)
+	assert.Equal(t, "$share/g/t/+", share)
+	assert.Equal(t, "t/1", p.VariableHeader.Topic)
+	assert.Equal(t, []byte("x"), p.Payload)
+
+	for _, b := range [][]byte{nil, {5, 'a'}, {1, 'a', 9}} {
+		_, _, err := decodeShared(b)
+		assert.ErrorIs(t, err, errInvalidShared, b)
+	}
+}
+
+func TestEncodeSharedMessage(t *testing.T) {
+	p := packet.NewPublish("t/1", 0, []byte("x"))
+	p.FixedHeaderFlags = packet.PublishHeaderFlags{QoS: packet.QoSLevelAtLeastOnce, Retain: true}
+	p.VariableHeader.Properties = &packet.Properties{ContentType: "text/plain"}
+	b, err := encodeSharedMessage("$share/g/t/+", p)
+	require.NoError(t, err)
+	share, decoded, err := decodeSharedMessage(b)
+	require.NoError(t, err)
+	assert.Equal(t, "$share/g/t/+", share)
+	assert.Equal(t, "t/1", decoded.VariableHeader.Topic)
+	assert.Equal(t, []byte("x"), decoded.Payload)
+	assert.Equal(t, p.FixedHeaderFlags, decoded.FixedHeaderFlags)
+	assert.Equal(t, p.VariableHeader.Properties, decoded.VariableHeader.Properties)
+
+	for _, b := range [][]byte{nil, {5, 'a'}, {1, 'a'}, {1, 'a', 4, 0x30}} {
+		_, _, err := decodeSharedMessage(b)
+		assert.ErrorIs(t, err, errInvalidShared, b)
+	}
+}
+
+func TestNodeShared(t *testing.T) {
+	shared := make(chan string, 10)
+	a, b, delivered := newPair(t, func(a, b *Node) {
+		a.Capabilities = []string{CapabilitySharedSubscriptions}
+		b.Capabilities = []string{CapabilitySharedSubscriptions}
+		a.DeliverShared = func(share string, p *packet.PublishControlPacket) {
+			shared <- fmt.Sprintf("%s %s %d", share, p.VariableHeader.Topic, p.FixedHeaderFlags.QoS)
+		}
+	})
+
+	a.Subscribe("$share/g/t/+")
+	a.Subscribe("$share/h/t/+")
+	b.Subscribe("$share/g/t/+")
+	require.Eventually(t, member(b, "a", "$share/g/t/+"), 5*time.Second, 5*time.Millisecond)
+	require.Eventually(t, member(b, "a", "$share/h/t/+"), 5*time.Second, 5*time.Millisecond)
+	require.Eventually(t, member(a, "b", "$share/g/t/+"), 5*time.Second, 5*time.Millisecond)
+
+	// b has a member of g itself, a takes its turn
+	p := packet.NewPublish("t/1", 1, []byte("x"))
+	p.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+	assert.False(t, b.Share("$share/g/t/+", p))
+	assert.True(t, b.Share("$share/g/t/+", p))
+	assert.False(t, b.Share("$share/g/t/+", p))
+	// Forward leaves g to Share and sends h to its only member
+	b.Forward(p)
+	var got []string
+	for range 3 {
+		select {
+		case s := <-shared:
+			got = append(got, s)
+		case <-time.After(5 * time.Second):
+			t.Fatal("message was not forwarded")
+		}
+	}
+	assert.ElementsMatch(t, []string{"$share/g/t/+ t/1 1", "$share/g/t/+ t/1 1", "$share/h/t/+ t/1 1"}, got)
+	assert.Empty(t, delivered)
+
+	// Members leaving are rebalanced
+	a.Unsubscribe("$share/g/t/+")
+	require.Eventually(t, func() bool { return !member(b, "a", "$share/g/t/+")() }, 5*time.Second, 5*time.Millisecond)
+	assert.True(t, b.Share("$share/g/t/+", p))
+	assert.True(t, b.Share("$share/g/t/+", p))
+
+	// as well as failed nodes
+	b.Subscribe("$share/h/t/+")
+	b.mu.Lock()
+	failed := b.peers["a"]
+	b.mu.Unlock()
+	require.NoError(t, a.Close())
+	require.Eventually(t, func() bool {
+		_, ok := b.Peer("a")
+		return !ok
+	}, 5*time.Second, 5*time.Millisecond)
+	assert.True(t, b.Share("$share/h/t/+", p))
+	assert.True(t, b.Share("$share/h/t/+", p))
+
+	// and those whose connection is gone before they were dropped, in
+	// their turn
+	b.mu.Lock()
+	b.peers["a"] = failed
+	b.mu.Unlock()
+	assert.True(t, b.Share("$share/h/t/+", p))
+	assert.True(t, b.Share("$share/h/t/+", p))
+}
+
+func TestNodeSharedMixed(t *testing.T) {
+	shared := make(chan string, 10)
+	// Whether the broker of a would deliver the ordinary message to the
+	// shared subscription
+	ordinary := make(chan bool, 1)
+	a, b, _ := newPair(t, func(a, b *Node) {
+		a.Capabilities = []string{CapabilitySharedSubscriptions}
+		a.Deliver = func(p *packet.PublishControlPacket) {
+			ordinary <- a.Share("$share/g/t/+", p)
+		}
+		a.DeliverShared = func(share string, p *packet.PublishControlPacket) {
+			shared <- share + " " + p.VariableHeader.Topic
+		}
+	})
+
+	// b balances on its own, so it gets the filter of the shared
+	// subscription and a balances the messages of b locally
+	a.Subscribe("$share/g/t/+")
+	require.Eventually(t, subscribed(b, "a", "t/1"), 5*time.Second, 5*time.Millisecond)
+	assert.False(t, member(b, "a", "$share/g/t/+")())
+
+	b.Forward(packet.NewPublish("t/1", 0, []byte("x")))
+	select {
+	case s := <-shared:
+		assert.Equal(t, "$share/g/t/+ t/1", s)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not delivered")
+	}
+	assert.False(t, <-ordinary, "it was delivered to the shared subscription already")
+}
@@ -0,0 +1,149 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// ProtocolVersion is the version of the cluster protocol the nodes of
+// this package speak. Version 1 is that of the nodes before versioning,
+// whose links don't introduce themselves; version 2 adds the hello;
+// version 3 forwards messages with the QoS, retain flag and properties
+// of their publisher, see encodeMessage.
+const ProtocolVersion = 3
+
+// ErrIncompatiblePeer refuses the link of a peer that speaks no version
+// of the protocol this node does. The peer is refused with CONNACK return
+// code Not authorized and retries.
+var ErrIncompatiblePeer = errors.New("cluster: incompatible peer")
+
+// helloUserName is the user name of the CONNECT of a link that carries
+// the hello of its node as the password. Nodes of version 1 ignore both.
+const helloUserName = "$cluster"
+
+// hello introduces a node to a peer when its link connects
+type hello struct {
+	version    int // the highest version the node speaks
+	minVersion int // the lowest
+	// capabilities are the optional features the node supports
+	capabilities []string
+}
+
+// encode returns the password of the CONNECT, space separated key=value
+// fields; peers skip the keys they don't know
+func (h hello) encode() []byte {
+	return fmt.Appendf(nil, "version=%d min=%d capabilities=%s", h.version, h.minVersion, strings.Join(h.capabilities, ","))
+}
+
+// parseHello returns the hello in the CONNECT of a link, that of
+// version 1 if it carries none
+func parseHello(connect *packet.ConnectControlPacket) (hello, error) {
+	if !connect.VariableHeader.ConnectFlags.UserName || connect.ConnectPayload.UserName != helloUserName {
+		return hello{version: 1, minVersion: 1}, nil
+	}
+	return decodeHello(connect.ConnectPayload.Password)
+}
+
+// decodeHello parses a hello encoded by hello.encode
+func decodeHello(b []byte) (hello, error) {
+	var h hello
+	for _, field := range strings.Fields(string(b)) {
+		key, value, _ := strings.Cut(field, "=")
+		var err error
+		switch key {
+		case "version":
+			h.version, err = strconv.Atoi(value)
+		case "min":
+			h.minVersion, err = strconv.Atoi(value)
+		case "capabilities":
+			if value != "" {
+				h.capabilities = strings.Split(value, ",")
+			}
+		}
+		if err != nil {
+			return h, fmt.Errorf("invalid hello field %q", field)
+		}
+	}
+	if h.version < 1 || h.minVersion > h.version {
+		return h, fmt.Errorf("invalid hello versions %d to %d", h.minVersion, h.version)
+	}
+	return h, nil
+}
+
+// PeerInfo is what a node agreed on with a peer whose link connected
+type PeerInfo struct {
+	// Version is the highest version of the protocol both speak
+	Version int
+	// Capabilities are the optional features both support
+	Capabilities []string
+}
+
+// HasCapability reports whether both nodes support the feature name
+func (p PeerInfo) HasCapability(name string) bool {
+	return slices.Contains(p.Capabilities, name)
+}
+
+// hello returns the hello of n
+func (n *Node) hello() hello {
+	return hello{version: ProtocolVersion, minVersion: n.minPeerVersion(), capabilities: n.Capabilities}
+}
+
+func (n *Node) minPeerVersion() int {
+	if n.MinPeerVersion > 0 {
+		return n.MinPeerVersion
+	}
+	return 1
+}
+
+// negotiate returns what n agrees on with the peer that sent h, or an
+// error wrapping ErrIncompatiblePeer if they speak no common version
+func (n *Node) negotiate(h hello) (PeerInfo, error) {
+	if h.version < n.minPeerVersion() {
+		return PeerInfo{}, fmt.Errorf("%w: it speaks up to version %d, at least %d is required", ErrIncompatiblePeer, h.version, n.minPeerVersion())
+	}
+	if h.minVersion > ProtocolVersion {
+		return PeerInfo{}, fmt.Errorf("%w: it requires version %d, up to %d is spoken here", ErrIncompatiblePeer, h.minVersion, ProtocolVersion)
+	}
+	info := PeerInfo{Version: min(h.version, ProtocolVersion)}
+	for _, c := range n.Capabilities {
+		if slices.Contains(h.capabilities, c) {
+			info.Capabilities = append(info.Capabilities, c)
+		}
+	}
+	return info, nil
+}
+
+// Peer returns what n agreed on with the peer name, if its link is
+// connected
+func (n *Node) Peer(name string) (PeerInfo, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.init()
+	pr, ok := n.peers[name]
+	if !ok {
+		return PeerInfo{}, false
+	}
+	return pr.info, true
+}
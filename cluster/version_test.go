@@ -0,0 +1,109 @@
+package cluster
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/client"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func connectWith(userName string, password string) *packet.ConnectControlPacket {
+	connect := &packet.ConnectControlPacket{}
+	if userName != "" {
+		connect.VariableHeader.ConnectFlags.UserName = true
+		connect.ConnectPayload.UserName = userName
+		connect.ConnectPayload.Password = []byte(password)
+	}
+	return connect
+}
+
+func TestParseHello(t *testing.T) {
+	h := hello{version: 3, minVersion: 2, capabilities: []string{"a", "b"}}
+	parsed, err := parseHello(connectWith(helloUserName, string(h.encode())))
+	require.NoError(t, err)
+	assert.Equal(t, h, parsed)
+
+	parsed, err = parseHello(connectWith(helloUserName, "version=2 min=1 capabilities= future=yes"))
+	require.NoError(t, err)
+	assert.Equal(t, hello{version: 2, minVersion: 1}, parsed, "unknown fields are skipped")
+
+	parsed, err = parseHello(connectWith("", ""))
+	require.NoError(t, err)
+	assert.Equal(t, hello{version: 1, minVersion: 1}, parsed, "nodes before versioning")
+
+	for _, password := range []string{"", "version=x", "version=1 min=2", "min=1"} {
+		_, err = parseHello(connectWith(helloUserName, password))
+		assert.Error(t, err, password)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	n := &Node{Capabilities: []string{"a", "b", "c"}}
+	info, err := n.negotiate(hello{version: ProtocolVersion + 1, minVersion: 1, capabilities: []string{"c", "d", "a"}})
+	require.NoError(t, err)
+	assert.Equal(t, PeerInfo{Version: ProtocolVersion, Capabilities: []string{"a", "c"}}, info)
+	assert.True(t, info.HasCapability("c"))
+	assert.False(t, info.HasCapability("d"))
+
+	info, err = n.negotiate(hello{version: 1, minVersion: 1})
+	require.NoError(t, err)
+	assert.Equal(t, PeerInfo{Version: 1}, info)
+
+	_, err = n.negotiate(hello{version: ProtocolVersion + 2, minVersion: ProtocolVersion + 1})
+	assert.ErrorIs(t, err, ErrIncompatiblePeer, "the peer dropped this version")
+	n.MinPeerVersion = 2
+	_, err = n.negotiate(hello{version: 1, minVersion: 1})
+	assert.ErrorIs(t, err, ErrIncompatiblePeer, "the peer was not upgraded")
+}
+
+func TestNodeCapabilities(t *testing.T) {
+	a, b, _ := newPair(t, func(a, b *Node) {
+		a.Capabilities = []string{"x", "y"}
+		b.Capabilities = []string{"y", "z"}
+	})
+	for _, test := range []struct {
+		n    *Node
+		peer string
+	}{{a, "b"}, {b, "a"}} {
+		require.Eventually(t, func() bool {
+			_, ok := test.n.Peer(test.peer)
+			return ok
+		}, 5*time.Second, 5*time.Millisecond)
+		info, _ := test.n.Peer(test.peer)
+		assert.Equal(t, PeerInfo{Version: ProtocolVersion, Capabilities: []string{"y"}}, info)
+	}
+	_, ok := b.Peer("c")
+	assert.False(t, ok)
+}
+
+func TestNodeMixedVersions(t *testing.T) {
+	serve := func(n *Node) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		go n.Serve(l) // nolint: errcheck
+		t.Cleanup(func() { _ = n.Close() })
+		return l.Addr().String()
+	}
+
+	// A node before versioning introduces itself with nothing
+	n := &Node{Name: "new"}
+	addr := serve(n)
+	old, err := client.Dial(addr, client.Options{ClientID: "old", CleanSession: true})
+	require.NoError(t, err)
+	info, ok := n.Peer("old")
+	assert.True(t, ok)
+	assert.Equal(t, PeerInfo{Version: 1}, info)
+	require.NoError(t, old.Disconnect())
+
+	// Refused once the cluster was upgraded
+	addr = serve(&Node{Name: "upgraded", MinPeerVersion: 2})
+	_, err = client.Dial(addr, client.Options{ClientID: "old", CleanSession: true})
+	var refused *client.ConnectError
+	require.ErrorAs(t, err, &refused)
+	assert.Equal(t, packet.ConnAckNotAuthorized, refused.ReturnCode)
+}
@@ -18,70 +18,26 @@
 package main
 
 import (
-	"fmt"
-	"net"
+	"log/slog"
 
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/logger"
 	"github.com/infinimesh/mqtt-go/packet"
 )
 
 //openssl req  -nodes -new -x509  -keyout server.key -out server.cert
 func main() {
-	listener, err := net.Listen("tcp", "localhost:8080")
-	if err != nil {
-		panic(err)
-	}
-
-	for {
-		conn, _ := listener.Accept() // nolint: gosec
-		go handleConn(conn)
+	server := &broker.Server{
+		Addr:    "localhost:8080",
+		Handler: broker.HandlerFunc(handlePacket),
+		Logger:  logger.Slog(slog.Default()),
 	}
+	panic(server.ListenAndServe())
 }
 
-func handleConn(c net.Conn) {
-	defer fmt.Println("Exited loop of connection")
-	p, err := packet.ReadPacket(c)
-	if err != nil {
-		fmt.Printf("Error while reading connect packet: %v\n", err)
-		return
-	}
-
-	connectPacket, ok := p.(*packet.ConnectControlPacket)
-	if !ok {
-		fmt.Println("Got wrong packet as first packjet..need connect!")
-		return
-	}
-
-	id := connectPacket.ConnectPayload.ClientID
-	fmt.Printf("Client with ID %v connected!\n", id)
-
-	resp := packet.ConnAckControlPacket{
-		FixedHeader: packet.FixedHeader{
-			ControlPacketType: packet.CONNACK,
-		},
-		VariableHeader: packet.ConnAckVariableHeader{},
-	}
-
-	_, err = resp.WriteTo(c)
-	if err != nil {
-		fmt.Println("Failed to write ConnAck. Closing connection.")
-		return
-	}
-
-	for {
-		p, err := packet.ReadPacket(c)
-		if err != nil {
-			fmt.Printf("Error while reading packet in client loop: %v. Disconnecting client.\n", err)
-			err := c.Close()
-			if err != nil {
-				fmt.Printf("Error when closing connection: %v\n", err)
-			}
-			break
-		}
-
-		switch p := p.(type) {
-		case packet.ConnectControlPacket:
-		case *packet.PublishControlPacket:
-			println("Received Publish with payload:", string(p.Payload))
-		}
+func handlePacket(c *broker.Conn, p packet.ControlPacket) {
+	switch p := p.(type) {
+	case *packet.PublishControlPacket:
+		slog.Info("received PUBLISH", "client_id", c.ClientID(), "topic", p.VariableHeader.Topic, "payload", string(p.Payload))
 	}
 }
@@ -0,0 +1,235 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Package cli holds what the command line tools share: the flags of the
+// connection and how they are turned into a client
+package cli
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/client"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// ConnFlags are the flags describing how to connect to the broker
+type ConnFlags struct {
+	Host            string
+	Port            int
+	ClientID        string
+	UserName        string
+	Password        string
+	KeepAlive       int
+	ProtocolVersion string
+	NoCleanSession  bool
+	SessionExpiry   int
+
+	WillTopic   string
+	WillPayload string
+	WillQoS     int
+	WillRetain  bool
+
+	TLS      bool
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	Insecure bool
+}
+
+// Register defines the flags on fs, named like the ones of mosquitto_pub
+// and mosquitto_sub
+func (f *ConnFlags) Register(fs *flag.FlagSet) {
+	fs.StringVar(&f.Host, "h", "localhost", "broker host")
+	fs.IntVar(&f.Port, "p", 0, "broker port, 1883 or 8883 with TLS if 0")
+	fs.StringVar(&f.ClientID, "i", "", "client identifier, assigned by the broker if empty")
+	fs.StringVar(&f.UserName, "u", "", "user name")
+	fs.StringVar(&f.Password, "P", "", "password")
+	fs.IntVar(&f.KeepAlive, "k", 60, "keepalive in seconds, 0 disables it")
+	fs.StringVar(&f.ProtocolVersion, "V", "3.1.1", "protocol version: 3.1, 3.1.1 or 5")
+	fs.BoolVar(&f.NoCleanSession, "c", false, "resume the persistent session of the client identifier")
+	fs.IntVar(&f.SessionExpiry, "x", 0, "MQTT 5 session expiry interval in seconds, the session of -c never expires if 0")
+
+	fs.StringVar(&f.WillTopic, "will-topic", "", "topic of the will, no will is sent if empty")
+	fs.StringVar(&f.WillPayload, "will-payload", "", "payload of the will")
+	fs.IntVar(&f.WillQoS, "will-qos", 0, "QoS of the will")
+	fs.BoolVar(&f.WillRetain, "will-retain", false, "retain the will")
+
+	fs.BoolVar(&f.TLS, "tls", false, "connect with TLS, verifying the broker against the system roots")
+	fs.StringVar(&f.CAFile, "cafile", "", "PEM file of the certificate authorities to verify the broker with, implies -tls")
+	fs.StringVar(&f.CertFile, "cert", "", "PEM file of the client certificate, implies -tls")
+	fs.StringVar(&f.KeyFile, "key", "", "PEM file of the key of the client certificate")
+	fs.BoolVar(&f.Insecure, "insecure", false, "do not verify the certificate of the broker")
+}
+
+// ParseVersion returns the protocol version named by s
+func ParseVersion(s string) (packet.ProtocolVersion, error) {
+	switch strings.TrimPrefix(strings.ToLower(s), "mqttv") {
+	case "3.1", "31":
+		return packet.ProtocolVersion31, nil
+	case "3.1.1", "311":
+		return packet.ProtocolVersion311, nil
+	case "5":
+		return packet.ProtocolVersion5, nil
+	}
+	return 0, fmt.Errorf("cli: unknown protocol version %q", s)
+}
+
+// ParseQoS checks that qos is 0, 1 or 2
+func ParseQoS(qos int) (packet.QosLevel, error) {
+	if qos < 0 || qos > 2 {
+		return 0, fmt.Errorf("cli: invalid QoS %v", qos)
+	}
+	return packet.QosLevel(qos), nil
+}
+
+// Options returns the client options the flags describe
+func (f *ConnFlags) Options() (client.Options, error) {
+	version, err := ParseVersion(f.ProtocolVersion)
+	if err != nil {
+		return client.Options{}, err
+	}
+	if f.KeepAlive < 0 || f.KeepAlive > 65535 {
+		return client.Options{}, fmt.Errorf("cli: invalid keepalive %v", f.KeepAlive)
+	}
+	if f.NoCleanSession && f.ClientID == "" {
+		return client.Options{}, errors.New("cli: -c requires a client identifier")
+	}
+	if f.SessionExpiry < 0 || int64(f.SessionExpiry) > math.MaxUint32 {
+		return client.Options{}, fmt.Errorf("cli: invalid session expiry interval %v", f.SessionExpiry)
+	}
+	sessionExpiry := time.Duration(f.SessionExpiry) * time.Second
+	if f.NoCleanSession && sessionExpiry == 0 {
+		// Like the persistent sessions of MQTT 3.1.1
+		sessionExpiry = math.MaxUint32 * time.Second
+	}
+	opts := client.Options{
+		ClientID:        f.ClientID,
+		CleanSession:    !f.NoCleanSession,
+		SessionExpiry:   sessionExpiry,
+		UserName:        f.UserName,
+		Password:        []byte(f.Password),
+		KeepAlive:       time.Duration(f.KeepAlive) * time.Second,
+		ProtocolVersion: version,
+	}
+	if f.WillTopic != "" {
+		qos, err := ParseQoS(f.WillQoS)
+		if err != nil {
+			return client.Options{}, err
+		}
+		opts.Will = &client.Will{
+			Topic:   f.WillTopic,
+			Payload: []byte(f.WillPayload),
+			QoS:     qos,
+			Retain:  f.WillRetain,
+		}
+	}
+	return opts, nil
+}
+
+func (f *ConnFlags) useTLS() bool {
+	return f.TLS || f.CAFile != "" || f.CertFile != ""
+}
+
+// TLSConfig returns the TLS configuration the flags describe, or nil if
+// TLS is not used
+func (f *ConnFlags) TLSConfig() (*tls.Config, error) {
+	if !f.useTLS() {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		ServerName:         f.Host,
+		InsecureSkipVerify: f.Insecure, // nolint: gosec
+	}
+	if f.CAFile != "" {
+		pem, err := os.ReadFile(f.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("cli: no certificates in %v", f.CAFile)
+		}
+	}
+	if f.CertFile != "" {
+		keyFile := f.KeyFile
+		if keyFile == "" {
+			keyFile = f.CertFile
+		}
+		cert, err := tls.LoadX509KeyPair(f.CertFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// Addr returns the address of the broker
+func (f *ConnFlags) Addr() string {
+	port := f.Port
+	if port == 0 {
+		port = 1883
+		if f.useTLS() {
+			port = 8883
+		}
+	}
+	return net.JoinHostPort(f.Host, strconv.Itoa(port))
+}
+
+// Dial connects to the broker with opts, which usually come from Options
+// and were completed by the command
+func (f *ConnFlags) Dial(opts client.Options) (*client.Client, error) {
+	cfg, err := f.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return client.Dial(f.Addr(), opts)
+	}
+	conn, err := tls.Dial("tcp", f.Addr(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.Connect(conn, opts)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// StringList is a flag that can be given more than once
+type StringList []string
+
+func (l *StringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *StringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
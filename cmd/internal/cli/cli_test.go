@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"flag"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/client"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func parse(t *testing.T, args ...string) *ConnFlags {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var f ConnFlags
+	f.Register(fs)
+	require.NoError(t, fs.Parse(args))
+	return &f
+}
+
+func TestOptions(t *testing.T) {
+	f := parse(t, "-i", "c1", "-c", "-u", "user", "-P", "secret", "-k", "30", "-V", "5",
+		"-will-topic", "status/c1", "-will-payload", "gone", "-will-qos", "1", "-will-retain")
+	opts, err := f.Options()
+	require.NoError(t, err)
+	assert.Equal(t, client.Options{
+		ClientID:        "c1",
+		SessionExpiry:   math.MaxUint32 * time.Second,
+		UserName:        "user",
+		Password:        []byte("secret"),
+		KeepAlive:       30 * time.Second,
+		ProtocolVersion: packet.ProtocolVersion5,
+		Will:            &client.Will{Topic: "status/c1", Payload: []byte("gone"), QoS: 1, Retain: true},
+	}, opts)
+	assert.Equal(t, "localhost:1883", f.Addr())
+
+	for _, args := range [][]string{
+		{"-V", "4"},
+		{"-k", "-1"},
+		{"-x", "-1"},
+		{"-c"},
+		{"-will-topic", "a", "-will-qos", "3"},
+	} {
+		_, err := parse(t, args...).Options()
+		assert.Error(t, err, "%v", args)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	cfg, err := parse(t).TLSConfig()
+	require.NoError(t, err)
+	assert.Nil(t, cfg)
+
+	f := parse(t, "-h", "broker", "-tls", "-insecure")
+	cfg, err = f.TLSConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "broker", cfg.ServerName)
+	assert.True(t, cfg.InsecureSkipVerify)
+	assert.Equal(t, "broker:8883", f.Addr())
+
+	_, err = parse(t, "-cafile", "does-not-exist.pem").TLSConfig()
+	assert.Error(t, err)
+}
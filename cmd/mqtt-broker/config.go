@@ -0,0 +1,414 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+
+	"github.com/infinimesh/mqtt-go/admin"
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/topic"
+)
+
+// Config is the configuration file of the broker, see mqtt-broker.yaml
+// for an example
+type Config struct {
+	Listeners   []ListenerConfig  `yaml:"listeners"`
+	Auth        AuthConfig        `yaml:"auth"`
+	Persistence PersistenceConfig `yaml:"persistence"`
+	Limits      LimitsConfig      `yaml:"limits"`
+	// InternPayloads shares the memory of identical payloads of retained
+	// and queued messages
+	InternPayloads bool `yaml:"intern_payloads"`
+	// SysInterval is how often the $SYS topics are published, never if 0
+	SysInterval time.Duration `yaml:"sys_interval"`
+	// MetricsAddress is where Prometheus metrics are served on /metrics,
+	// nowhere if empty
+	MetricsAddress string `yaml:"metrics_address"`
+	// HealthAddress is where /healthz is served for liveness and
+	// readiness probes, nowhere if empty
+	HealthAddress string `yaml:"health_address"`
+	// AdminAddress is where the limits and log levels can be changed
+	// while the broker runs, see admin.API.Handler, nowhere if empty. It
+	// authenticates no one.
+	AdminAddress string `yaml:"admin_address"`
+	// AdminAllow lists the networks, like 10.0.0.0/8, and the addresses
+	// AdminAddress answers. Only the loopback addresses if empty.
+	AdminAllow []string `yaml:"admin_allow"`
+	// AdminDebug serves the runtime profiles on /debug/pprof/ and the
+	// expvar variables on /debug/vars of AdminAddress
+	AdminDebug bool `yaml:"admin_debug"`
+	// Pprof serves the runtime profiles on /debug/pprof/ of
+	// MetricsAddress
+	Pprof bool `yaml:"pprof"`
+	// RuntimeStatsInterval is how often the runtime and the queues of the
+	// broker are sampled into the metrics, never if 0
+	RuntimeStatsInterval time.Duration `yaml:"runtime_stats_interval"`
+	// ReplayLog is the file the connects, subscriptions and publishes of
+	// the clients are appended to, for "mqtt-broker replay", nowhere if
+	// empty
+	ReplayLog string `yaml:"replay_log"`
+	// LogLevel is debug, info, warn or error
+	LogLevel string `yaml:"log_level"`
+	// LogLevels override LogLevel for the subsystems of the broker:
+	// packet, broker, auth and store. Both are reloaded on SIGHUP.
+	LogLevels map[string]string `yaml:"log_levels"`
+	// ShutdownTimeout limits how long a graceful shutdown may take
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// Drain, if set, drains the broker when it shuts down
+	Drain *DrainConfig `yaml:"drain"`
+	// Translation decides what MQTT 5 clients see of the messages of
+	// MQTT 3.1.1 clients, see broker.Translation
+	Translation TranslationConfig `yaml:"translation"`
+	// Archive, if set, keeps the messages the clients publish on disk
+	Archive *ArchiveConfig `yaml:"archive"`
+	// MaxDelay enables publishing to $delayed/{seconds}/{topic} with
+	// delays of up to MaxDelay, see broker.Server.MaxDelay. The delayed
+	// messages are kept in the persistence backend.
+	MaxDelay time.Duration `yaml:"max_delay"`
+	// DeadLetterTopic, if set, receives the messages the broker drops,
+	// see broker.Server.DeadLetterTopic
+	DeadLetterTopic string `yaml:"dead_letter_topic"`
+}
+
+// ArchiveConfig is an append-only log of messages, see archive.Config
+type ArchiveConfig struct {
+	Dir         string        `yaml:"dir"`
+	Filters     []string      `yaml:"filters"`
+	SegmentSize int64         `yaml:"segment_size"`
+	MaxAge      time.Duration `yaml:"max_age"`
+	MaxSize     int64         `yaml:"max_size"`
+}
+
+// TranslationConfig carries messages between MQTT 3.1.1 and MQTT 5
+// clients
+type TranslationConfig struct {
+	// SessionExpiry limits how long the persistent sessions of MQTT 3.1.1
+	// clients are kept, forever if 0
+	SessionExpiry time.Duration `yaml:"session_expiry"`
+	ContentType   string        `yaml:"content_type"`
+	PayloadFormat bool          `yaml:"payload_format"`
+}
+
+// DrainConfig spreads disconnecting the clients over a period when the
+// broker shuts down, refusing new ones, see broker.Server.Drain
+type DrainConfig struct {
+	// ServerReference is the server MQTT 5 clients are told to use
+	// instead
+	ServerReference string `yaml:"server_reference"`
+	// Moved tells them the move is permanent
+	Moved  bool          `yaml:"moved"`
+	Period time.Duration `yaml:"period"`
+}
+
+// ListenerConfig is an address the broker accepts connections on
+type ListenerConfig struct {
+	// Address is a TCP address to bind, or systemd:NAME for the sockets
+	// systemd passes by socket activation under NAME, the
+	// FileDescriptorName= of the socket unit
+	Address string `yaml:"address"`
+	// WebSocket carries MQTT over WebSocket on every HTTP path
+	WebSocket bool `yaml:"websocket"`
+	// Compression offers permessage-deflate to WebSocket clients
+	Compression *CompressionConfig `yaml:"compression"`
+	// LongPoll tunnels MQTT over HTTP long-polling on every path, for
+	// the clients that can use neither TCP nor WebSocket, see
+	// transport.LongPollListener
+	LongPoll bool       `yaml:"long_poll"`
+	TLS      *TLSConfig `yaml:"tls"`
+	// URing moves the reads and writes of the connections to io_uring,
+	// experimental and Linux only
+	URing bool `yaml:"io_uring"`
+}
+
+const systemdPrefix = "systemd:"
+
+// systemd reports whether the listener takes its sockets from systemd
+func (l ListenerConfig) systemd() bool {
+	return strings.HasPrefix(l.Address, systemdPrefix)
+}
+
+// CompressionConfig is the permessage-deflate compression of a WebSocket
+// listener, see transport.WebSocketCompression
+type CompressionConfig struct {
+	Level          int   `yaml:"level"`
+	MinSize        int   `yaml:"min_size"`
+	MaxMessageSize int64 `yaml:"max_message_size"`
+}
+
+// TLSConfig are the certificates of a TLS listener. They are reloaded on
+// SIGHUP.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientCAFile, if set, makes clients present a certificate signed by
+	// one of the certificate authorities in it
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+// AuthConfig selects how clients are authenticated and authorized. The
+// files are reloaded on SIGHUP.
+type AuthConfig struct {
+	// PasswordFile is a mosquitto password file; every client is accepted
+	// if empty
+	PasswordFile string `yaml:"password_file"`
+	// AllowAnonymous accepts clients without user name despite
+	// PasswordFile
+	AllowAnonymous bool `yaml:"allow_anonymous"`
+	// SCRAMFile holds the SCRAM-SHA-256 credentials of MQTT 5 clients
+	// using enhanced authentication, see package scram. The method is
+	// not offered if empty.
+	SCRAMFile string `yaml:"scram_file"`
+	// ACLFile is a mosquitto ACL file; every topic is allowed if empty
+	ACLFile string `yaml:"acl_file"`
+	// Tenants binds users to tenants, whose topics are isolated from
+	// each other, see broker.Server.Tenant. Users not in it are in no
+	// tenant.
+	Tenants map[string]string `yaml:"tenants"`
+}
+
+// PersistenceConfig selects where sessions and retained messages are
+// kept
+type PersistenceConfig struct {
+	// Backend is memory, bolt, file or redis. Defaults to memory, which
+	// does not survive a restart.
+	Backend string `yaml:"backend"`
+	// Path is the file of the bolt and file backends
+	Path  string      `yaml:"path"`
+	Redis RedisConfig `yaml:"redis"`
+}
+
+// RedisConfig is the database of the redis backend
+type RedisConfig struct {
+	Address  string `yaml:"address"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	// Prefix starts every key, so that brokers can share a database
+	Prefix string `yaml:"prefix"`
+}
+
+// LimitsConfig are the limits of broker.Server of the same names
+type LimitsConfig struct {
+	MaxConnections    int           `yaml:"max_connections"`
+	ConnectionRate    float64       `yaml:"connection_rate"`
+	ConnectionBurst   int           `yaml:"connection_burst"`
+	MessageRate       float64       `yaml:"message_rate"`
+	MessageBurst      int           `yaml:"message_burst"`
+	MaxPacketSize     int           `yaml:"max_packet_size"`
+	OutboundQueueSize int           `yaml:"outbound_queue_size"`
+	MinReadBuffer     int           `yaml:"min_read_buffer"`
+	MaxReadBuffer     int           `yaml:"max_read_buffer"`
+	ConnectTimeout    time.Duration `yaml:"connect_timeout"`
+	ReceiveMaximum    uint16        `yaml:"receive_maximum"`
+	TopicAliasMaximum uint16        `yaml:"topic_alias_maximum"`
+	// OverflowPolicy is drop_new, drop_oldest, drop_lowest_qos or
+	// disconnect, drop_new if empty
+	OverflowPolicy string        `yaml:"overflow_policy"`
+	PauseThreshold int           `yaml:"pause_threshold"`
+	MaxPause       time.Duration `yaml:"max_pause"`
+	// FlushStrategy is adaptive, immediate, timed or sized, adaptive if
+	// empty. FlushInterval and FlushSize are the parameters of the
+	// latter two.
+	FlushStrategy string        `yaml:"flush_strategy"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	FlushSize     int           `yaml:"flush_size"`
+	// MaxInflight is the number of QoS 1 and 2 messages in flight to a
+	// client at once
+	MaxInflight int `yaml:"max_inflight"`
+	// SessionExpiry limits how long sessions are kept after their client
+	// disconnected, MessageExpiry how long messages wait for delivery to
+	// a session. 0 means no limit.
+	SessionExpiry time.Duration `yaml:"session_expiry"`
+	MessageExpiry time.Duration `yaml:"message_expiry"`
+	// SizeRules limit the payload size of messages by topic and user
+	SizeRules []SizeRuleConfig `yaml:"size_rules"`
+	// OversizeAction is drop or disconnect, drop if empty. It applies to
+	// MQTT 3.1.1 clients, MQTT 5 clients are always disconnected.
+	OversizeAction string `yaml:"oversize_action"`
+	// MaxSubscriptions and MinFilterLevels are the
+	// broker.SubscriptionLimits of every client
+	MaxSubscriptions int `yaml:"max_subscriptions"`
+	MinFilterLevels  int `yaml:"min_filter_levels"`
+}
+
+// SizeRuleConfig is a broker.SizeRule
+type SizeRuleConfig struct {
+	// Filter is a topic filter, all topics if empty
+	Filter string `yaml:"filter"`
+	// Users are the user names the rule applies to, all if empty
+	Users      []string `yaml:"users"`
+	MaxPayload int      `yaml:"max_payload"`
+}
+
+// subsystems are the subsystems of the broker with a log level of their
+// own, see logger.Subsystem
+var subsystems = []string{"packet", "broker", "auth", "store"}
+
+// LoadConfig reads the configuration file at path, YAML or, if its name
+// ends in .toml, TOML with the same keys. Unknown keys are rejected, so
+// that typos don't go unnoticed.
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(path, ".toml") {
+		if b, err = tomlToYAML(b); err != nil {
+			return nil, fmt.Errorf("config: %v: %w", path, err)
+		}
+	}
+
+	cfg := &Config{
+		LogLevel:        "info",
+		ShutdownTimeout: 30 * time.Second,
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("config: %v: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("config: %v: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// tomlToYAML converts a TOML document to YAML, so that both are decoded
+// with the same keys and checks. Durations are strings in either, like
+// "10s".
+func tomlToYAML(b []byte) ([]byte, error) {
+	var doc map[string]any
+	if err := toml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(doc)
+}
+
+func (cfg *Config) validate() error {
+	if len(cfg.Listeners) == 0 {
+		return errors.New("no listeners")
+	}
+	for _, l := range cfg.Listeners {
+		if l.Address == systemdPrefix {
+			return errors.New("listener systemd: needs the name of the sockets")
+		}
+		if t := l.TLS; t != nil && (t.CertFile == "" || t.KeyFile == "") {
+			return fmt.Errorf("listener %v: tls requires cert_file and key_file", l.Address)
+		}
+		if l.WebSocket && l.LongPoll {
+			return fmt.Errorf("listener %v: websocket and long_poll need listeners of their own", l.Address)
+		}
+		if cc := l.Compression; cc != nil {
+			if !l.WebSocket {
+				return fmt.Errorf("listener %v: compression requires websocket", l.Address)
+			}
+			if cc.Level != 0 && (cc.Level < 1 || cc.Level > 9) {
+				return fmt.Errorf("listener %v: compression level must be between 1 and 9", l.Address)
+			}
+		}
+	}
+	for user, tenant := range cfg.Auth.Tenants {
+		if err := broker.ValidateTenant(tenant); err != nil {
+			return fmt.Errorf("tenant of %v: %w", user, err)
+		}
+	}
+	switch p := cfg.Persistence; p.Backend {
+	case "", "memory":
+	case "bolt", "file":
+		if p.Path == "" {
+			return fmt.Errorf("persistence backend %v requires a path", p.Backend)
+		}
+	case "redis":
+		if p.Redis.Address == "" {
+			return errors.New("persistence backend redis requires an address")
+		}
+	default:
+		return fmt.Errorf("unknown persistence backend %q", p.Backend)
+	}
+	if cfg.Pprof && cfg.MetricsAddress == "" {
+		return errors.New("pprof requires a metrics_address")
+	}
+	if (cfg.AdminDebug || len(cfg.AdminAllow) > 0) && cfg.AdminAddress == "" {
+		return errors.New("admin_debug and admin_allow require an admin_address")
+	}
+	for _, s := range cfg.AdminAllow {
+		if _, err := admin.ParsePrefix(s); err != nil {
+			return fmt.Errorf("admin_allow: %w", err)
+		}
+	}
+	if _, err := parseLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+	for sub, level := range cfg.LogLevels {
+		if !slices.Contains(subsystems, sub) {
+			return fmt.Errorf("log_levels: unknown subsystem %q", sub)
+		}
+		if _, err := logger.ParseLevel(level); err != nil {
+			return fmt.Errorf("log_levels: %w", err)
+		}
+	}
+	if _, err := parseOverflowPolicy(cfg.Limits.OverflowPolicy); err != nil {
+		return err
+	}
+	for _, r := range cfg.Limits.SizeRules {
+		if r.Filter != "" && !topic.ValidFilter(r.Filter) {
+			return fmt.Errorf("size rule: invalid topic filter %q", r.Filter)
+		}
+		if r.MaxPayload <= 0 {
+			return fmt.Errorf("size rule %q: max_payload must be positive", r.Filter)
+		}
+	}
+	if _, err := parseOversizeAction(cfg.Limits.OversizeAction); err != nil {
+		return err
+	}
+	if _, err := parseFlushStrategy(cfg.Limits.FlushStrategy); err != nil {
+		return err
+	}
+	if l := cfg.Limits; l.MinReadBuffer > 0 && l.MaxReadBuffer > 0 && l.MinReadBuffer > l.MaxReadBuffer {
+		return errors.New("min_read_buffer exceeds max_read_buffer")
+	}
+	if a := cfg.Archive; a != nil {
+		if a.Dir == "" {
+			return errors.New("archive requires a dir")
+		}
+		for _, f := range a.Filters {
+			if !topic.ValidFilter(f) {
+				return fmt.Errorf("archive: invalid topic filter %q", f)
+			}
+		}
+	}
+	if d := cfg.Drain; d != nil {
+		if d.Moved && d.ServerReference == "" {
+			return errors.New("drain: moved requires a server_reference")
+		}
+		if d.Period >= cfg.ShutdownTimeout {
+			return errors.New("drain: period must be shorter than shutdown_timeout")
+		}
+	}
+	return nil
+}
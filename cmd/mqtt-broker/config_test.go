@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig("mqtt-broker.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, []ListenerConfig{{Address: ":1883"}, {Address: ":8080", WebSocket: true}}, cfg.Listeners)
+	assert.Equal(t, 10*time.Second, cfg.Limits.ConnectTimeout)
+	assert.Equal(t, 1000.0, cfg.Limits.MessageRate)
+	assert.Equal(t, "drop_lowest_qos", cfg.Limits.OverflowPolicy)
+	assert.Equal(t, 512, cfg.Limits.PauseThreshold)
+	assert.Equal(t, SizeRuleConfig{Users: []string{"camera"}, MaxPayload: 262144}, cfg.Limits.SizeRules[1])
+	assert.Equal(t, 30*time.Second, cfg.ShutdownTimeout)
+	assert.True(t, cfg.InternPayloads)
+
+	for name, content := range map[string]string{
+		"unknown key":     "listeners: [{address: ':1883'}]\nlistener: []\n",
+		"no listeners":    "log_level: info\n",
+		"tls without key": "listeners: [{address: ':8883', tls: {cert_file: a.pem}}]\n",
+		"backend":         "listeners: [{address: ':1883'}]\npersistence: {backend: mysql}\n",
+		"bolt path":       "listeners: [{address: ':1883'}]\npersistence: {backend: bolt}\n",
+		"log level":       "listeners: [{address: ':1883'}]\nlog_level: loud\n",
+		"overflow policy": "listeners: [{address: ':1883'}]\nlimits: {overflow_policy: drop_all}\n",
+		"size filter":     "listeners: [{address: ':1883'}]\nlimits: {size_rules: [{filter: 'a/#/b', max_payload: 1}]}\n",
+		"max payload":     "listeners: [{address: ':1883'}]\nlimits: {size_rules: [{filter: 'a'}]}\n",
+		"oversize action": "listeners: [{address: ':1883'}]\nlimits: {oversize_action: truncate}\n",
+		"flush strategy":  "listeners: [{address: ':1883'}]\nlimits: {flush_strategy: never}\n",
+		"pprof":           "listeners: [{address: ':1883'}]\npprof: true\n",
+		"compression":     "listeners: [{address: ':1883', compression: {}}]\n",
+		"deflate level":   "listeners: [{address: ':1883', websocket: true, compression: {level: 10}}]\n",
+		"long poll":       "listeners: [{address: ':8080', websocket: true, long_poll: true}]\n",
+		"admin debug":     "listeners: [{address: ':1883'}]\nadmin_debug: true\n",
+		"admin allow":     "listeners: [{address: ':1883'}]\nadmin_address: ':8082'\nadmin_allow: [10.0.0.0/33]\n",
+		"read buffer":     "listeners: [{address: ':1883'}]\nlimits: {min_read_buffer: 4096, max_read_buffer: 1024}\n",
+		"systemd name":    "listeners: [{address: 'systemd:'}]\n",
+		"log subsystem":   "listeners: [{address: ':1883'}]\nlog_levels: {broker: debug, bridge: debug}\n",
+		"log levels":      "listeners: [{address: ':1883'}]\nlog_levels: {auth: loud}\n",
+		"drain moved":     "listeners: [{address: ':1883'}]\ndrain: {moved: true}\n",
+		"tenant":          "listeners: [{address: ':1883'}]\nauth: {tenants: {alice: a/b}}\n",
+		"drain period":    "listeners: [{address: ':1883'}]\ndrain: {period: 1m}\n",
+		"archive dir":     "listeners: [{address: ':1883'}]\narchive: {filters: ['#']}\n",
+		"archive filter":  "listeners: [{address: ':1883'}]\narchive: {dir: a, filters: ['a/#/b']}\n",
+		"toml syntax":     "listeners = [\n",
+	} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if strings.HasPrefix(name, "toml") {
+			path = filepath.Join(t.TempDir(), "config.toml")
+		}
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		_, err := LoadConfig(path)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestLoadConfigTOML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt-broker.toml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+sys_interval = "10s"
+
+[[listeners]]
+address = ":1883"
+
+[[listeners]]
+address = ":8883"
+tls = { cert_file = "server.pem", key_file = "server.key" }
+
+[limits]
+message_rate = 1000.5
+max_inflight = 100
+session_expiry = "168h"
+
+[[limits.size_rules]]
+filter = "sensors/#"
+max_payload = 4096
+`), 0600))
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, []ListenerConfig{
+		{Address: ":1883"},
+		{Address: ":8883", TLS: &TLSConfig{CertFile: "server.pem", KeyFile: "server.key"}},
+	}, cfg.Listeners)
+	assert.Equal(t, 10*time.Second, cfg.SysInterval)
+	assert.Equal(t, 1000.5, cfg.Limits.MessageRate)
+	assert.Equal(t, 100, cfg.Limits.MaxInflight)
+	assert.Equal(t, 168*time.Hour, cfg.Limits.SessionExpiry)
+	assert.Equal(t, []SizeRuleConfig{{Filter: "sensors/#", MaxPayload: 4096}}, cfg.Limits.SizeRules)
+	assert.Equal(t, "info", cfg.LogLevel, "defaults apply")
+
+	require.NoError(t, os.WriteFile(path, []byte("[[listeners]]\naddress = \":1883\"\nwebsocket = \"yes\"\n[limit]\n"), 0600))
+	_, err = LoadConfig(path)
+	assert.Error(t, err, "unknown keys and wrong types are rejected")
+}
@@ -0,0 +1,74 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package main
+
+import (
+	"log/slog"
+	"runtime"
+)
+
+// dump logs the state of the broker whatever the log level: the totals
+// of the clients, sessions and queues, then a line per client, then a
+// line per message in flight to a client, online or not
+func (d *daemon) dump() {
+	log := slog.New(slog.NewTextHandler(d.out, nil))
+	clients := d.server.Clients()
+	sessions := d.server.SessionSnapshots()
+	outbound, inflight, queued := 0, 0, 0
+	for _, c := range clients {
+		outbound += c.Outbound
+	}
+	for _, s := range sessions {
+		inflight += len(s.Outbound)
+		queued += s.Queued
+	}
+	log.Info("state",
+		"clients", len(clients),
+		"sessions", len(sessions),
+		"outbound", outbound,
+		"inflight", inflight,
+		"queued", queued,
+		"goroutines", runtime.NumGoroutine())
+	for _, c := range clients {
+		log.Info("client",
+			"client_id", c.ClientID,
+			"tenant", c.Tenant,
+			"user_name", c.UserName,
+			"remote_addr", c.RemoteAddr,
+			"version", c.Version,
+			"accepted", c.Accepted,
+			"subscriptions", c.Subscriptions,
+			"outbound", c.Outbound,
+			"inflight", c.InFlight,
+			"queued", c.Queued)
+	}
+	for _, s := range sessions {
+		for _, m := range s.Outbound {
+			log.Info("inflight",
+				"client_id", s.ClientID,
+				"connected", s.Connected,
+				"packet_id", m.PacketID,
+				"state", m.State,
+				"topic", m.Topic,
+				"qos", m.QoS,
+				"sent", m.Sent,
+				"age", m.Age,
+				"retries", m.Retries)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/infinimesh/mqtt-go/transport"
+)
+
+// handoffEnv names the file descriptor of the socket over which the
+// process that started this one by an upgrade hands its listeners over
+const handoffEnv = "MQTT_BROKER_HANDOFF_FD"
+
+// handedOffListeners returns the listeners handed over by the process
+// upgrading to this one, keyed by the address of their configuration,
+// once it drained. It returns nil if the process was not started by an
+// upgrade. Replaced by the tests.
+var handedOffListeners = takeHandoff
+
+func takeHandoff() (map[string][]net.Listener, error) {
+	env := os.Getenv(handoffEnv)
+	if env == "" {
+		return nil, nil
+	}
+	_ = os.Unsetenv(handoffEnv)
+	fd, err := strconv.Atoi(env)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", handoffEnv, env)
+	}
+	f := os.NewFile(uintptr(fd), "handoff")
+	c, err := net.FileConn(f)
+	_ = f.Close()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close() // nolint: errcheck
+	conn, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("handoff is not over a Unix socket")
+	}
+
+	listeners, err := transport.ReceiveListeners(conn)
+	if err != nil {
+		return nil, err
+	}
+	// Tell the old process to drain, then wait until it closes the
+	// socket: it let go of the persistence backend then
+	if _, err = conn.Write([]byte{1}); err == nil {
+		_, err = io.Copy(io.Discard, conn)
+	}
+	if err != nil {
+		for _, ls := range listeners {
+			for _, l := range ls {
+				_ = l.Close()
+			}
+		}
+		return nil, err
+	}
+	return listeners, nil
+}
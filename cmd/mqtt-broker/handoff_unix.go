@@ -0,0 +1,94 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/transport"
+)
+
+// upgradeTimeout bounds how long the new process may take to load its
+// configuration and take the listeners
+const upgradeTimeout = time.Minute
+
+// upgrade starts the executable of the process again with args and hands
+// the listeners over to it. Once it returns nil the new process waits for
+// this one to shut down, and starts serving when d.close closes the
+// handoff socket; connections meanwhile wait in the backlog of the
+// listeners. Otherwise this process keeps serving.
+func (d *daemon) upgrade(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return err
+	}
+	theirs := os.NewFile(uintptr(fds[1]), "handoff")
+	ours := os.NewFile(uintptr(fds[0]), "handoff")
+	c, err := net.FileConn(ours)
+	_ = ours.Close()
+	if err != nil {
+		return err
+	}
+	conn := c.(*net.UnixConn)
+
+	cmd := exec.Command(exe, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{theirs}
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", handoffEnv, 3))
+	err = cmd.Start()
+	_ = theirs.Close() // for EOF if the new process exits
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	go cmd.Wait() // nolint: errcheck
+
+	// The new process answers once it took the listeners; it closes the
+	// socket instead if its configuration is broken
+	err = transport.SendListeners(conn, d.sockets)
+	if err == nil {
+		_ = conn.SetReadDeadline(time.Now().Add(upgradeTimeout))
+		_, err = io.ReadFull(conn, make([]byte, 1))
+	}
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = conn.Close()
+		return fmt.Errorf("process %d did not take the listeners: %w", cmd.Process.Pid, err)
+	}
+	d.log.Info("handed the listeners over, draining", "pid", cmd.Process.Pid)
+	d.handoff = conn
+	return nil
+}
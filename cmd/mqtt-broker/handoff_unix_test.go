@@ -0,0 +1,91 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/client"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// TestMain runs the broker instead of the tests in the processes
+// TestDaemonUpgrade upgrades to
+func TestMain(m *testing.M) {
+	if os.Getenv(handoffEnv) != "" {
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func TestDaemonUpgrade(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "mqtt-broker.yaml")
+	writeConfig := func(address string) {
+		require.NoError(t, os.WriteFile(configPath, []byte(`
+listeners:
+  - address: "`+address+`"
+persistence:
+  backend: bolt
+  path: `+filepath.Join(dir, "state.db")+`
+log_level: error
+`), 0600))
+	}
+	writeConfig("127.0.0.1:0")
+	cfg, err := LoadConfig(configPath)
+	require.NoError(t, err)
+	cfg.LogLevel = "info" // for the pid of the new process
+	var log syncBuffer
+	d, err := start(cfg, &log)
+	require.NoError(t, err)
+	addr := d.listeners[0].Addr().String()
+
+	pub, err := client.Dial(addr, client.Options{ClientID: "pub", CleanSession: true})
+	require.NoError(t, err)
+	require.NoError(t, pub.Publish(context.Background(), "a/b", packet.QoSLevelAtLeastOnce, true, []byte("before the upgrade")))
+	require.NoError(t, pub.Disconnect())
+
+	// A new process that cannot start leaves the old one serving
+	require.NoError(t, os.WriteFile(configPath, []byte("listeners: ["), 0600))
+	assert.Error(t, d.upgrade([]string{"-config", configPath}))
+	c, err := client.Dial(addr, client.Options{ClientID: "c", CleanSession: true})
+	require.NoError(t, err)
+	require.NoError(t, c.Disconnect())
+
+	writeConfig("127.0.0.1:0")
+	require.NoError(t, d.upgrade([]string{"-config", configPath}))
+	pid := regexp.MustCompile(`pid=(\d+)`).FindStringSubmatch(log.String())
+	require.NotNil(t, pid, log.String())
+	process, err := strconv.Atoi(pid[1])
+	require.NoError(t, err)
+	defer syscall.Kill(process, syscall.SIGTERM) // nolint: errcheck
+	require.NoError(t, d.shutdown(context.Background()))
+
+	// The new process serves on the same socket, with the retained
+	// message of the old one
+	sub, err := client.Dial(addr, client.Options{ClientID: "sub", CleanSession: true})
+	require.NoError(t, err)
+	defer sub.Disconnect() // nolint: errcheck
+	received := make(chan client.Message, 1)
+	_, err = sub.Subscribe(context.Background(), "a/#", packet.QoSLevelAtLeastOnce, func(_ *client.Client, m client.Message) {
+		received <- m
+	})
+	require.NoError(t, err)
+	select {
+	case m := <-received:
+		assert.Equal(t, []byte("before the upgrade"), m.Payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no retained message")
+	}
+}
@@ -0,0 +1,140 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// healthcheck connects to the MQTT listener at addr and pings the broker,
+// all within timeout. A broker that refuses the anonymous CONNECT for its
+// credentials answered and counts as healthy, unless it is unavailable.
+func healthcheck(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() // nolint: errcheck
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	if err := packet.WritePacket(conn, &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(packet.ProtocolVersion311),
+			ConnectFlags:  packet.ConnectFlags{CleanSession: true},
+			KeepAlive:     int(timeout / time.Second),
+		},
+		ConnectPayload: packet.ConnectPayload{ClientID: "healthcheck-" + hex.EncodeToString(id)},
+	}); err != nil {
+		return err
+	}
+	p, err := packet.ReadPacket(conn)
+	if err != nil {
+		return fmt.Errorf("no CONNACK: %w", err)
+	}
+	connack, ok := p.(*packet.ConnAckControlPacket)
+	if !ok {
+		return fmt.Errorf("%T instead of CONNACK", p)
+	}
+	switch connack.VariableHeader.ReturnCode {
+	case packet.ConnAckAccepted:
+	case packet.ConnAckBadUserNameOrPassword, packet.ConnAckNotAuthorized:
+		return nil
+	default:
+		return fmt.Errorf("CONNACK return code %#x", connack.VariableHeader.ReturnCode)
+	}
+
+	if err := packet.WritePacket(conn, packet.NewPingReqControlPacket()); err != nil {
+		return err
+	}
+	if p, err = packet.ReadPacket(conn); err != nil {
+		return fmt.Errorf("no PINGRESP: %w", err)
+	}
+	if _, ok := p.(*packet.PingRespControlPacket); !ok {
+		return fmt.Errorf("%T instead of PINGRESP", p)
+	}
+	return packet.WritePacket(conn, packet.NewDisconnectControlPacket())
+}
+
+// runHealthcheck is the healthcheck subcommand, for the HEALTHCHECK of
+// a container: it exits with 1 unless the broker answers
+func runHealthcheck(args []string) error {
+	flags := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	addr := flags.String("address", "127.0.0.1:1883", "MQTT listener to check, without TLS")
+	timeout := flags.Duration("timeout", 5*time.Second, "time the broker has to answer")
+	_ = flags.Parse(args)
+	return healthcheck(*addr, *timeout)
+}
+
+// probeAddress returns the address healthcheck reaches the listener l
+// bound to at from this host. Go listens on both IPv4 and IPv6 for
+// unspecified addresses, so those are reached on 127.0.0.1.
+func probeAddress(l net.Addr) string {
+	tcp, ok := l.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	ip := tcp.IP
+	if ip == nil || ip.IsUnspecified() {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	return net.JoinHostPort(ip.String(), fmt.Sprint(tcp.Port))
+}
+
+// serveHealth serves /healthz on addr for liveness and readiness probes.
+// It answers 200 once the broker answered healthcheck on its first
+// listener without TLS or WebSocket, or, if it has none, while the broker
+// is not shutting down; 503 otherwise.
+func (d *daemon) serveHealth(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		err := errors.New("shutting down")
+		if !d.stopping.Load() {
+			err = nil
+			if d.probe != "" {
+				err = healthcheck(d.probe, 2*time.Second)
+			}
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	hs := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go hs.Serve(l) // nolint: errcheck
+	d.closers = append(d.closers, hs)
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+	return l.Addr().String()
+}
+
+func TestHealthcheck(t *testing.T) {
+	d, err := start(&Config{Listeners: []ListenerConfig{{Address: "127.0.0.1:0"}}}, io.Discard)
+	require.NoError(t, err)
+	addr := d.listeners[0].Addr().String()
+	assert.NoError(t, runHealthcheck([]string{"-address", addr, "-timeout", "2s"}))
+	require.NoError(t, d.shutdown(context.Background()))
+	assert.Error(t, healthcheck(addr, time.Second), "closed")
+
+	passwordFile := filepath.Join(t.TempDir(), "passwd")
+	require.NoError(t, os.WriteFile(passwordFile, nil, 0600))
+	d, err = start(&Config{
+		Listeners: []ListenerConfig{{Address: "127.0.0.1:0"}},
+		Auth:      AuthConfig{PasswordFile: passwordFile},
+	}, io.Discard)
+	require.NoError(t, err)
+	defer d.shutdown(context.Background()) // nolint: errcheck
+	assert.NoError(t, healthcheck(d.listeners[0].Addr().String(), 2*time.Second), "refusing credentials is an answer")
+}
+
+func TestHealthEndpoint(t *testing.T) {
+	healthAddr := freeAddress(t)
+	d, err := start(&Config{
+		Listeners:     []ListenerConfig{{Address: "0.0.0.0:0"}},
+		HealthAddress: healthAddr,
+	}, io.Discard)
+	require.NoError(t, err)
+	assert.Contains(t, d.probe, "127.0.0.1:")
+
+	get := func() int {
+		res, err := http.Get("http://" + healthAddr + "/healthz")
+		require.NoError(t, err)
+		res.Body.Close() // nolint: errcheck
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, get())
+	d.stopping.Store(true)
+	assert.Equal(t, http.StatusServiceUnavailable, get())
+	d.stopping.Store(false)
+	require.NoError(t, d.listeners[0].Close())
+	assert.Equal(t, http.StatusServiceUnavailable, get(), "the listener no longer answers")
+	assert.NoError(t, d.shutdown(context.Background()))
+}
+
+func TestProbeAddress(t *testing.T) {
+	for addr, want := range map[string]string{
+		"0.0.0.0:1883":  "127.0.0.1:1883",
+		"[::]:1883":     "127.0.0.1:1883",
+		"[::1]:1883":    "[::1]:1883",
+		"10.0.0.1:1883": "10.0.0.1:1883",
+	} {
+		tcp, err := net.ResolveTCPAddr("tcp", addr)
+		require.NoError(t, err)
+		assert.Equal(t, want, probeAddress(tcp), addr)
+	}
+	assert.Empty(t, probeAddress(&net.UnixAddr{Name: "/run/mqtt.sock", Net: "unix"}))
+}
@@ -0,0 +1,628 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Command mqtt-broker runs a standalone MQTT broker configured by a YAML
+// file, see mqtt-broker.yaml:
+//
+//	mqtt-broker -config /etc/mqtt-broker.yaml
+//
+// SIGHUP reloads the password file, the ACL and the TLS certificates;
+// SIGINT and SIGTERM shut the broker down gracefully. SIGUSR1 logs the
+// state of the broker: its clients, their queues and the messages in
+// flight to them. SIGUSR2 upgrades
+// the broker to the executable now installed without refusing
+// connections: a new process takes over the listening sockets, the old
+// one shuts down gracefully and the new one serves once it did, restoring
+// the sessions from the persistence backend. A supervisor that waits for
+// the process, like systemd, would take the exit of the old process for
+// the end of the service; restart it there instead.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/infinimesh/mqtt-go/admin"
+	"github.com/infinimesh/mqtt-go/archive"
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/metrics"
+	"github.com/infinimesh/mqtt-go/replay"
+	"github.com/infinimesh/mqtt-go/session"
+	"github.com/infinimesh/mqtt-go/store"
+	"github.com/infinimesh/mqtt-go/transport"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		if err := runHealthcheck(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "mqtt-broker: unhealthy:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "mqtt-broker: replay:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	configPath := flag.String("config", "mqtt-broker.yaml", "configuration file, YAML or TOML if it ends in .toml")
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("mqtt-broker: ")
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	d, err := start(cfg, os.Stderr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	d.configPath = *configPath
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, slices.Concat([]os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM}, dumpSignals, upgradeSignals)...)
+	var failed error
+wait:
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				d.reload()
+				continue
+			}
+			if slices.Contains(dumpSignals, sig) {
+				d.dump()
+				continue
+			}
+			if slices.Contains(upgradeSignals, sig) {
+				if err := d.upgrade(os.Args[1:]); err != nil {
+					d.log.Error("upgrade failed, serving on", "error", err)
+					continue
+				}
+			}
+			d.log.Info("shutting down", "signal", sig)
+			break wait
+		case failed = <-d.errs:
+			break wait
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := d.shutdown(ctx); err != nil && failed == nil {
+		failed = err
+	}
+	if failed != nil {
+		log.Fatal(failed)
+	}
+}
+
+// daemon is a running broker with its listeners
+type daemon struct {
+	server   *broker.Server
+	log      *slog.Logger
+	logLevel slog.LevelVar
+	// configPath is the configuration file SIGHUP reloads the log levels
+	// from, if set
+	configPath string
+	out        io.Writer      // of the log
+	levels     *logger.Levels // of the subsystems of the broker
+	reloader   *reloader
+	store      store.Store // nil for the memory backend
+	listeners  []net.Listener
+	// sockets are the listeners before TLS and WebSocket, keyed by the
+	// address of their configuration, for the handoff of upgrade
+	sockets map[string][]net.Listener
+	handoff *net.UnixConn // to the process upgrading this one
+	drain   *broker.DrainConfig
+	closers []io.Closer // HTTP servers of the WebSocket, metrics and health listeners, the replay log and archive
+	errs    chan error  // errors of Serve other than ErrServerClosed
+	// probe is the address of the first listener without TLS or
+	// WebSocket, which /healthz checks
+	probe    string
+	stopping atomic.Bool // set by shutdown
+}
+
+// start opens the persistence backend and serves every listener of cfg
+func start(cfg *Config, logOutput io.Writer) (*daemon, error) {
+	d := &daemon{
+		// Filtered by levels instead of the handler
+		levels:  logger.NewLevels(logger.Slog(slog.New(slog.NewTextHandler(logOutput, &slog.HandlerOptions{Level: slog.LevelDebug}))), logger.LevelInfo),
+		out:     logOutput,
+		sockets: make(map[string][]net.Listener),
+	}
+	d.log = slog.New(slog.NewTextHandler(logOutput, &slog.HandlerOptions{Level: &d.logLevel}))
+	d.setLogLevels(cfg)
+	var err error
+	if d.reloader, err = newReloader(cfg); err != nil {
+		return nil, err
+	}
+
+	// The sockets passed by the process upgrading to this one, which
+	// drained, or by systemd, keyed by the address of the listener taking
+	// them
+	passed, err := handedOffListeners()
+	if err != nil {
+		return nil, fmt.Errorf("listener handoff: %w", err)
+	}
+	if passed == nil {
+		passed = make(map[string][]net.Listener)
+	}
+	defer func() {
+		for address, ls := range passed {
+			d.log.Warn("closing passed sockets that no listener uses", "address", address)
+			for _, l := range ls {
+				_ = l.Close()
+			}
+		}
+	}()
+
+	limits := cfg.Limits
+	overflow, _ := parseOverflowPolicy(limits.OverflowPolicy)
+	oversize, _ := parseOversizeAction(limits.OversizeAction)
+	flush, _ := parseFlushStrategy(limits.FlushStrategy)
+	sessions := session.NewManager()
+	sessions.Window = limits.MaxInflight
+	sessions.MaxExpiry = limits.SessionExpiry
+	sessions.MessageExpiry = limits.MessageExpiry
+	d.server = &broker.Server{
+		Logger:                 d.levels,
+		Authenticator:          d.reloader,
+		EnhancedAuthenticators: d.reloader.enhancedAuthenticators(),
+		Authorizer:             d.reloader,
+		Sessions:               sessions,
+		MaxPacketSize:          limits.MaxPacketSize,
+		OutboundQueueSize:      limits.OutboundQueueSize,
+		MinReadBuffer:          limits.MinReadBuffer,
+		MaxReadBuffer:          limits.MaxReadBuffer,
+		OverflowPolicy:         overflow,
+		PauseThreshold:         limits.PauseThreshold,
+		MaxPause:               limits.MaxPause,
+		Flush:                  transport.FlushConfig{Strategy: flush, Interval: limits.FlushInterval, Size: limits.FlushSize},
+		SizeRules:              sizeRules(limits.SizeRules),
+		OversizeAction:         oversize,
+		ConnectTimeout:         limits.ConnectTimeout,
+		MaxConnections:         limits.MaxConnections,
+		ConnectionRate:         limits.ConnectionRate,
+		ConnectionBurst:        limits.ConnectionBurst,
+		MessageRate:            limits.MessageRate,
+		MessageBurst:           limits.MessageBurst,
+		ReceiveMaximum:         limits.ReceiveMaximum,
+		TopicAliasMaximum:      limits.TopicAliasMaximum,
+		SysInterval:            cfg.SysInterval,
+		RuntimeStatsInterval:   cfg.RuntimeStatsInterval,
+		InternPayloads:         cfg.InternPayloads,
+		MaxDelay:               cfg.MaxDelay,
+		DeadLetterTopic:        cfg.DeadLetterTopic,
+		SubscriptionLimits: broker.SubscriptionLimits{
+			MaxSubscriptions: limits.MaxSubscriptions,
+			MinFilterLevels:  limits.MinFilterLevels,
+		},
+		Translation: broker.Translation{
+			SessionExpiry: cfg.Translation.SessionExpiry,
+			ContentType:   cfg.Translation.ContentType,
+			PayloadFormat: cfg.Translation.PayloadFormat,
+		},
+	}
+	if tenants := cfg.Auth.Tenants; len(tenants) > 0 {
+		d.server.Tenant = func(c *broker.Conn) (string, error) {
+			return tenants[c.Connect().ConnectPayload.UserName], nil
+		}
+	}
+	if dc := cfg.Drain; dc != nil {
+		d.drain = &broker.DrainConfig{ServerReference: dc.ServerReference, Moved: dc.Moved, Period: dc.Period}
+	}
+	if err := d.openStore(cfg.Persistence); err != nil {
+		return nil, err
+	}
+	if cfg.ReplayLog != "" {
+		f, err := os.OpenFile(cfg.ReplayLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			d.close()
+			return nil, fmt.Errorf("replay log: %w", err)
+		}
+		d.closers = append(d.closers, f)
+		d.server.Hooks = append(d.server.Hooks, replay.NewRecorder(f))
+	}
+	if ac := cfg.Archive; ac != nil {
+		a, err := archive.Open(ac.Dir, archive.Config{
+			Filters:     ac.Filters,
+			SegmentSize: ac.SegmentSize,
+			MaxAge:      ac.MaxAge,
+			MaxSize:     ac.MaxSize,
+			Logger:      d.levels,
+		})
+		if err != nil {
+			d.close()
+			return nil, err
+		}
+		d.closers = append(d.closers, a)
+		d.server.Hooks = append(d.server.Hooks, a)
+	}
+	if cfg.MetricsAddress != "" {
+		if err := d.serveMetrics(cfg.MetricsAddress, cfg.Pprof); err != nil {
+			d.close()
+			return nil, err
+		}
+	}
+
+	if slices.ContainsFunc(cfg.Listeners, ListenerConfig.systemd) {
+		systemd, err := systemdListeners()
+		if err != nil {
+			d.close()
+			return nil, fmt.Errorf("systemd socket activation: %w", err)
+		}
+		for name, ls := range systemd {
+			passed[systemdPrefix+name] = append(passed[systemdPrefix+name], ls...)
+		}
+	}
+
+	tlsIndex := 0
+	for _, lc := range cfg.Listeners {
+		var tlsConfig *tls.Config
+		if lc.TLS != nil {
+			tlsConfig = d.reloader.tlsConfig(tlsIndex)
+			tlsIndex++
+		}
+		if err := d.listen(lc, tlsConfig, passed); err != nil {
+			d.close()
+			return nil, err
+		}
+		if d.probe == "" && lc.TLS == nil && !lc.WebSocket && !lc.LongPoll {
+			d.probe = probeAddress(d.listeners[len(d.listeners)-1].Addr())
+		}
+	}
+	if cfg.HealthAddress != "" {
+		if err := d.serveHealth(cfg.HealthAddress); err != nil {
+			d.close()
+			return nil, err
+		}
+	}
+	if cfg.AdminAddress != "" {
+		if err := d.serveAdmin(cfg); err != nil {
+			d.close()
+			return nil, err
+		}
+	}
+	d.errs = make(chan error, len(d.listeners))
+	for _, l := range d.listeners {
+		go func(l net.Listener) {
+			if err := d.server.Serve(l); !errors.Is(err, broker.ErrServerClosed) {
+				d.errs <- err
+			}
+		}(l)
+	}
+	return d, nil
+}
+
+func (d *daemon) openStore(cfg PersistenceConfig) error {
+	var err error
+	switch cfg.Backend {
+	case "bolt":
+		d.store, err = store.OpenBolt(cfg.Path)
+	case "file":
+		d.store, err = store.OpenFile(cfg.Path)
+	case "redis":
+		d.store = store.NewRedis(redis.NewClient(&redis.Options{
+			Addr:     cfg.Redis.Address,
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+		}), cfg.Redis.Prefix)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	d.server.Sessions.Store = d.store
+	d.server.RetainStore = d.store
+	d.server.DelayStore = d.store
+	if err := d.server.Sessions.Restore(); err != nil {
+		_ = d.store.Close()
+		return err
+	}
+	if err := d.server.RestoreDelayed(); err != nil {
+		_ = d.store.Close()
+		return err
+	}
+	return nil
+}
+
+func (d *daemon) serveMetrics(addr string, profiles bool) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	m := metrics.NewPrometheus(nil)
+	d.server.Metrics = m
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	if profiles {
+		metrics.RegisterPprof(mux)
+	}
+	hs := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go hs.Serve(l) // nolint: errcheck
+	d.closers = append(d.closers, hs)
+	return nil
+}
+
+// serveAdmin serves the admin API, and the runtime profiles and expvar
+// variables if asked to, on admin_address. Its audit log is written
+// whatever the log level.
+func (d *daemon) serveAdmin(cfg *Config) error {
+	allowed := admin.Loopback
+	if len(cfg.AdminAllow) > 0 {
+		allowed = nil
+		for _, s := range cfg.AdminAllow {
+			p, _ := admin.ParsePrefix(s) // checked by validate
+			allowed = append(allowed, p)
+		}
+	}
+	l, err := net.Listen("tcp", cfg.AdminAddress)
+	if err != nil {
+		return err
+	}
+	api := &admin.API{
+		Server: d.server,
+		Levels: d.levels,
+		Audit:  logger.Slog(slog.New(slog.NewTextHandler(d.out, nil))),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", api.Handler())
+	if cfg.AdminDebug {
+		metrics.RegisterPprof(mux)
+		metrics.RegisterExpvar(mux)
+	}
+	hs := &http.Server{Handler: admin.Allow(mux, allowed), ReadHeaderTimeout: 10 * time.Second}
+	go hs.Serve(l) // nolint: errcheck
+	d.closers = append(d.closers, hs)
+	return nil
+}
+
+// systemdListeners returns the sockets passed by socket activation,
+// replaced by the tests
+var systemdListeners = transport.SystemdListeners
+
+// listen opens the listener lc describes and adds it to d.listeners. It
+// takes the sockets passed under the address of lc from passed instead if
+// there are any; there is a listener for each of them. The address
+// systemd:NAME stands for the sockets systemd passed under NAME.
+func (d *daemon) listen(lc ListenerConfig, tlsConfig *tls.Config, passed map[string][]net.Listener) error {
+	bound := passed[lc.Address]
+	delete(passed, lc.Address)
+	if len(bound) == 0 {
+		if lc.systemd() {
+			return fmt.Errorf("listener %v: systemd passed no socket named %q", lc.Address, strings.TrimPrefix(lc.Address, systemdPrefix))
+		}
+		l, err := net.Listen("tcp", lc.Address)
+		if err != nil {
+			return err
+		}
+		bound = []net.Listener{l}
+	}
+	d.sockets[lc.Address] = append(d.sockets[lc.Address], bound...)
+
+	for i, l := range bound {
+		l, err := d.wrap(l, lc, tlsConfig)
+		if err != nil {
+			for _, l := range bound[i+1:] {
+				_ = l.Close()
+			}
+			return err
+		}
+		d.listeners = append(d.listeners, l)
+		d.log.Info("listening", "address", l.Addr().String(), "systemd", lc.systemd(), "tls", tlsConfig != nil, "websocket", lc.WebSocket, "long_poll", lc.LongPoll, "io_uring", lc.URing)
+	}
+	return nil
+}
+
+// wrap adds the transports lc asks for to l. l is closed if that fails.
+func (d *daemon) wrap(l net.Listener, lc ListenerConfig, tlsConfig *tls.Config) (net.Listener, error) {
+	if lc.URing {
+		ul, err := transport.NewURingListener(l, transport.URingConfig{Rings: runtime.GOMAXPROCS(0)})
+		if err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+		l = ul
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	var hl interface {
+		net.Listener
+		http.Handler
+	}
+	switch {
+	case lc.WebSocket:
+		wl := transport.NewWebSocketListener(l.Addr())
+		if cc := lc.Compression; cc != nil {
+			wl.Compression = &transport.WebSocketCompression{Level: cc.Level, MinSize: cc.MinSize, MaxMessageSize: cc.MaxMessageSize}
+		}
+		hl = wl
+	case lc.LongPoll:
+		hl = transport.NewLongPollListener(l.Addr())
+	default:
+		return l, nil
+	}
+	hs := &http.Server{Handler: hl, ReadHeaderTimeout: 10 * time.Second}
+	go hs.Serve(l) // nolint: errcheck
+	d.closers = append(d.closers, hs)
+	return hl, nil
+}
+
+// reload applies SIGHUP: it reloads the log levels from the
+// configuration file, and the files of the configuration. A failed reload
+// is logged and keeps the configuration loaded before.
+func (d *daemon) reload() {
+	if d.configPath != "" {
+		cfg, err := LoadConfig(d.configPath)
+		if err != nil {
+			d.log.Error("reload failed, keeping the previous configuration", "error", err)
+			return
+		}
+		d.setLogLevels(cfg)
+	}
+	if err := d.reloader.reload(); err != nil {
+		d.log.Error("reload failed, keeping the previous configuration", "error", err)
+		return
+	}
+	d.log.Info("reloaded log levels, password file, ACL and certificates")
+}
+
+// setLogLevels applies log_level and log_levels of cfg
+func (d *daemon) setLogLevels(cfg *Config) {
+	level, _ := parseLevel(cfg.LogLevel)
+	d.logLevel.Set(level)
+	d.levels.SetDefault(loggerLevel(level))
+	for sub := range d.levels.Subsystems() {
+		if _, ok := cfg.LogLevels[sub]; !ok {
+			d.levels.ResetLevel(sub)
+		}
+	}
+	for sub, s := range cfg.LogLevels {
+		l, _ := logger.ParseLevel(s)
+		d.levels.SetLevel(sub, l)
+	}
+}
+
+// shutdown stops the server gracefully and releases everything start
+// opened. It drains the server first if configured, unless it handed
+// the listeners over by upgrade.
+func (d *daemon) shutdown(ctx context.Context) error {
+	d.stopping.Store(true)
+	if d.drain != nil && d.handoff == nil {
+		d.log.Info("draining", "period", d.drain.Period, "server_reference", d.drain.ServerReference)
+		if err := d.server.Drain(ctx, *d.drain); err != nil {
+			d.log.Warn("draining did not complete", "error", err)
+		}
+	}
+	err := d.server.Shutdown(ctx)
+	d.close()
+	return err
+}
+
+// close releases what start opened besides the server
+func (d *daemon) close() {
+	for _, l := range d.listeners {
+		_ = l.Close()
+	}
+	for _, c := range d.closers {
+		_ = c.Close()
+	}
+	if d.store != nil {
+		if err := d.store.Close(); err != nil {
+			d.log.Error("closing the store failed", "error", err)
+		}
+	}
+	if d.handoff != nil {
+		_ = d.handoff.Close()
+	}
+}
+
+func parseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// loggerLevel returns the level of package logger that passes the same
+// entries as l
+func loggerLevel(l slog.Level) logger.Level {
+	switch {
+	case l <= slog.LevelDebug:
+		return logger.LevelDebug
+	case l <= slog.LevelInfo:
+		return logger.LevelInfo
+	case l <= slog.LevelWarn:
+		return logger.LevelWarn
+	}
+	return logger.LevelError
+}
+
+func parseOverflowPolicy(s string) (broker.OverflowPolicy, error) {
+	switch s {
+	case "", "drop_new":
+		return broker.OverflowDropNew, nil
+	case "drop_oldest":
+		return broker.OverflowDropOldest, nil
+	case "drop_lowest_qos":
+		return broker.OverflowDropLowestQoS, nil
+	case "disconnect":
+		return broker.OverflowDisconnect, nil
+	}
+	return 0, fmt.Errorf("unknown overflow policy %q", s)
+}
+
+func parseFlushStrategy(s string) (transport.FlushStrategy, error) {
+	var strategy transport.FlushStrategy
+	if s == "" {
+		return transport.FlushAdaptive, nil
+	}
+	err := strategy.UnmarshalText([]byte(s))
+	return strategy, err
+}
+
+func parseOversizeAction(s string) (broker.OversizeAction, error) {
+	switch s {
+	case "", "drop":
+		return broker.OversizeDrop, nil
+	case "disconnect":
+		return broker.OversizeDisconnect, nil
+	}
+	return 0, fmt.Errorf("unknown oversize action %q", s)
+}
+
+// sizeRules converts the size rules of the configuration, selecting
+// clients by user name
+func sizeRules(rules []SizeRuleConfig) []broker.SizeRule {
+	var res []broker.SizeRule
+	for _, r := range rules {
+		rule := broker.SizeRule{Filter: r.Filter, MaxPayload: r.MaxPayload}
+		if len(r.Users) > 0 {
+			users := r.Users
+			rule.Clients = func(c *broker.Conn) bool {
+				return slices.Contains(users, c.Connect().ConnectPayload.UserName)
+			}
+		}
+		res = append(res, rule)
+	}
+	return res
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/archive"
+	"github.com/infinimesh/mqtt-go/client"
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/passwd"
+	"github.com/infinimesh/mqtt-go/scram"
+	"github.com/infinimesh/mqtt-go/transport"
+)
+
+// writeCert writes a certificate for 127.0.0.1 signed by a new CA to
+// certFile and keyFile and returns the pool with the CA
+func writeCert(t *testing.T, certFile, keyFile string) *x509.CertPool {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err = x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "broker"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return pool
+}
+
+// syncBuffer is a bytes.Buffer for the log of a daemon
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDaemon(t *testing.T) {
+	dir := t.TempDir()
+	hash, err := passwd.Hash("secret")
+	require.NoError(t, err)
+	passwordFile := filepath.Join(dir, "passwd")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("alice:"+hash+"\n"), 0600))
+	credentials, err := scram.NewCredentials("secret")
+	require.NoError(t, err)
+	scramFile := filepath.Join(dir, "scram")
+	require.NoError(t, os.WriteFile(scramFile, []byte("alice:"+credentials.String()+"\n"), 0600))
+	aclFile := filepath.Join(dir, "acl")
+	require.NoError(t, os.WriteFile(aclFile, []byte("user alice\ntopic alice/#\n"), 0600))
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	oldCA := writeCert(t, certFile, keyFile)
+
+	d, err := start(&Config{
+		Listeners: []ListenerConfig{
+			{Address: "127.0.0.1:0"},
+			{Address: "127.0.0.1:0", TLS: &TLSConfig{CertFile: certFile, KeyFile: keyFile}},
+		},
+		Auth:        AuthConfig{PasswordFile: passwordFile, SCRAMFile: scramFile, ACLFile: aclFile},
+		Persistence: PersistenceConfig{Backend: "bolt", Path: filepath.Join(dir, "state.db")},
+		LogLevel:    "info",
+	}, io.Discard)
+	require.NoError(t, err)
+	defer d.shutdown(context.Background()) // nolint: errcheck
+	plain, secure := d.listeners[0].Addr().String(), d.listeners[1].Addr().String()
+
+	opts := client.Options{ClientID: "c1", CleanSession: true, UserName: "alice", Password: []byte("secret")}
+	_, err = client.Dial(plain, client.Options{ClientID: "c1", UserName: "alice", Password: []byte("wrong")})
+	assert.Equal(t, &client.ConnectError{ReturnCode: packet.ConnAckBadUserNameOrPassword}, err)
+	c, err := client.Dial(plain, opts)
+	require.NoError(t, err)
+	defer c.Disconnect() // nolint: errcheck
+
+	// SCRAM instead of the password; the ACL still needs the user name
+	c5, err := client.Dial(plain, client.Options{
+		ClientID:        "c3",
+		CleanSession:    true,
+		ProtocolVersion: packet.ProtocolVersion5,
+		UserName:        "alice",
+		Auth:            scram.NewClient("alice", "secret"),
+	})
+	require.NoError(t, err)
+	assert.NoError(t, c5.Disconnect())
+
+	ctx := context.Background()
+	_, err = c.Subscribe(ctx, "alice/#", packet.QoSLevelNone, nil)
+	assert.NoError(t, err)
+	_, err = c.Subscribe(ctx, "bob/#", packet.QoSLevelNone, nil)
+	assert.Error(t, err, "denied by the ACL")
+
+	// A broken file keeps the previous configuration
+	require.NoError(t, os.WriteFile(aclFile, []byte("bogus\n"), 0600))
+	assert.Error(t, d.reloader.reload())
+	_, err = c.Subscribe(ctx, "alice/x", packet.QoSLevelNone, nil)
+	assert.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(aclFile, []byte("user alice\ntopic alice/#\ntopic read bob/#\n"), 0600))
+	newCA := writeCert(t, certFile, keyFile)
+	require.NoError(t, d.reloader.reload())
+	_, err = c.Subscribe(ctx, "bob/#", packet.QoSLevelNone, nil)
+	assert.NoError(t, err, "allowed after reloading the ACL")
+
+	_, err = tls.Dial("tcp", secure, &tls.Config{RootCAs: oldCA})
+	assert.Error(t, err, "the old certificate must be gone")
+	conn, err := tls.Dial("tcp", secure, &tls.Config{RootCAs: newCA})
+	require.NoError(t, err)
+	opts.ClientID = "c2"
+	c2, err := client.Connect(conn, opts)
+	require.NoError(t, err)
+	assert.NoError(t, c2.Disconnect())
+}
+
+func TestDaemonURing(t *testing.T) {
+	d, err := start(&Config{Listeners: []ListenerConfig{{Address: "127.0.0.1:0", URing: true}}}, io.Discard)
+	if errors.Is(err, transport.ErrURingUnsupported) {
+		t.Skip(err)
+	}
+	require.NoError(t, err)
+	defer d.shutdown(context.Background()) // nolint: errcheck
+	addr := d.listeners[0].Addr().String()
+
+	sub, err := client.Dial(addr, client.Options{ClientID: "sub", CleanSession: true})
+	require.NoError(t, err)
+	defer sub.Disconnect() // nolint: errcheck
+	received := make(chan client.Message, 1)
+	_, err = sub.Subscribe(context.Background(), "a/#", packet.QoSLevelAtLeastOnce, func(_ *client.Client, m client.Message) {
+		received <- m
+	})
+	require.NoError(t, err)
+
+	pub, err := client.Dial(addr, client.Options{ClientID: "pub", CleanSession: true})
+	require.NoError(t, err)
+	defer pub.Disconnect() // nolint: errcheck
+	require.NoError(t, pub.Publish(context.Background(), "a/b", packet.QoSLevelAtLeastOnce, false, []byte("over io_uring")))
+	select {
+	case m := <-received:
+		assert.Equal(t, []byte("over io_uring"), m.Payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message")
+	}
+}
+
+func TestDaemonSystemd(t *testing.T) {
+	passed := func() map[string][]net.Listener {
+		listeners := make(map[string][]net.Listener)
+		for _, name := range []string{"mqtt", "mqtt", "unused"} {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			listeners[name] = append(listeners[name], l)
+		}
+		return listeners
+	}
+	var sockets map[string][]net.Listener
+	systemdListeners = func() (map[string][]net.Listener, error) { return sockets, nil }
+	defer func() { systemdListeners = transport.SystemdListeners }()
+
+	sockets = passed()
+	unused := sockets["unused"][0].Addr().String()
+	d, err := start(&Config{Listeners: []ListenerConfig{{Address: "systemd:mqtt"}}}, io.Discard)
+	require.NoError(t, err)
+	defer d.shutdown(context.Background()) // nolint: errcheck
+	require.Len(t, d.listeners, 2, "one per socket of the name")
+	for _, l := range d.listeners {
+		c, err := client.Dial(l.Addr().String(), client.Options{ClientID: "c", CleanSession: true})
+		require.NoError(t, err)
+		assert.NoError(t, c.Disconnect())
+	}
+	_, err = net.Dial("tcp", unused)
+	assert.Error(t, err, "sockets no listener uses are closed")
+
+	sockets = passed()
+	_, err = start(&Config{Listeners: []ListenerConfig{{Address: "systemd:mqtt-tls"}}}, io.Discard)
+	assert.ErrorContains(t, err, `no socket named "mqtt-tls"`)
+	for _, ls := range sockets {
+		for _, l := range ls {
+			_, err = net.Dial("tcp", l.Addr().String())
+			assert.Error(t, err, "closed after the failed start")
+		}
+	}
+}
+
+func TestDaemonDrain(t *testing.T) {
+	d, err := start(&Config{
+		Listeners: []ListenerConfig{{Address: "127.0.0.1:0"}},
+		Drain:     &DrainConfig{ServerReference: "mqtt-2:1883", Moved: true},
+	}, io.Discard)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", d.listeners[0].Addr().String())
+	require.NoError(t, err)
+	defer conn.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(conn, &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(packet.ProtocolVersion5),
+			Properties:    &packet.Properties{},
+		},
+		ConnectPayload: packet.ConnectPayload{ClientID: "c"},
+	}))
+	_, err = packet.ReadPacketVersion(conn, packet.ProtocolVersion5)
+	require.NoError(t, err)
+
+	require.NoError(t, d.shutdown(context.Background()))
+	p, err := packet.ReadPacketVersion(conn, packet.ProtocolVersion5)
+	require.NoError(t, err)
+	require.IsType(t, &packet.DisconnectControlPacket{}, p)
+	disconnect := p.(*packet.DisconnectControlPacket)
+	assert.Equal(t, packet.ReasonCodeServerMoved, disconnect.VariableHeader.ReasonCode)
+	assert.Equal(t, "mqtt-2:1883", disconnect.VariableHeader.Properties.ServerReference)
+}
+
+func TestDaemonLogLevels(t *testing.T) {
+	var log syncBuffer
+	d, err := start(&Config{
+		Listeners: []ListenerConfig{{Address: "127.0.0.1:0"}},
+		LogLevel:  "warn",
+		LogLevels: map[string]string{"packet": "debug"},
+	}, &log)
+	require.NoError(t, err)
+	defer d.shutdown(context.Background()) // nolint: errcheck
+
+	c, err := client.Dial(d.listeners[0].Addr().String(), client.Options{ClientID: "c", CleanSession: true})
+	require.NoError(t, err)
+	require.NoError(t, c.Disconnect())
+	require.Eventually(t, func() bool { return strings.Contains(log.String(), "packet: read") }, 5*time.Second, time.Millisecond)
+	assert.NotContains(t, log.String(), "broker: client connected", "info of the broker")
+
+	d.levels.SetLevel("broker", logger.LevelInfo)
+	c, err = client.Dial(d.listeners[0].Addr().String(), client.Options{ClientID: "c", CleanSession: true})
+	require.NoError(t, err)
+	require.NoError(t, c.Disconnect())
+	require.Eventually(t, func() bool { return strings.Contains(log.String(), "broker: client connected") }, 5*time.Second, time.Millisecond)
+}
+
+func TestDaemonDump(t *testing.T) {
+	var log syncBuffer
+	d, err := start(&Config{Listeners: []ListenerConfig{{Address: "127.0.0.1:0"}}, LogLevel: "error"}, &log)
+	require.NoError(t, err)
+	defer d.shutdown(context.Background()) // nolint: errcheck
+	c, err := client.Dial(d.listeners[0].Addr().String(), client.Options{ClientID: "c", CleanSession: true})
+	require.NoError(t, err)
+	defer c.Disconnect() // nolint: errcheck
+	_, err = c.Subscribe(context.Background(), "a/#", packet.QoSLevelAtLeastOnce, nil)
+	require.NoError(t, err)
+
+	d.dump()
+	assert.Contains(t, log.String(), "msg=state clients=1 sessions=1 outbound=0 inflight=0 queued=0")
+	assert.Contains(t, log.String(), "msg=client client_id=c")
+	assert.Contains(t, log.String(), "subscriptions=1")
+	assert.NotContains(t, log.String(), "msg=inflight")
+
+	// The messages in flight to offline clients are listed as well
+	p, err := client.Dial(d.listeners[0].Addr().String(), client.Options{ClientID: "p"})
+	require.NoError(t, err)
+	_, err = p.Subscribe(context.Background(), "b/#", packet.QoSLevelAtLeastOnce, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Disconnect())
+	require.Eventually(t, func() bool { return len(d.server.Clients()) == 1 }, 5*time.Second, time.Millisecond)
+	require.NoError(t, c.Publish(context.Background(), "b/1", packet.QoSLevelAtLeastOnce, false, []byte("x")))
+
+	before := len(log.String())
+	d.dump()
+	dump := log.String()[before:]
+	assert.Contains(t, dump, "msg=state clients=1 sessions=2 outbound=0 inflight=1 queued=0")
+	assert.Contains(t, dump, "msg=inflight client_id=p connected=false packet_id=1 state=publish topic=b/1 qos=1 sent=false")
+}
+
+func TestDaemonReloadLogLevels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt-broker.yaml")
+	write := func(config string) {
+		require.NoError(t, os.WriteFile(path, []byte("listeners: [{address: '127.0.0.1:0'}]\n"+config), 0600))
+	}
+	write("log_levels: {auth: debug, store: error}\n")
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	d, err := start(cfg, io.Discard)
+	require.NoError(t, err)
+	defer d.shutdown(context.Background()) // nolint: errcheck
+	d.configPath = path
+	assert.Equal(t, logger.LevelDebug, d.levels.Level("auth"))
+
+	write("log_level: warn\nlog_levels: {store: debug}\n")
+	d.reload()
+	assert.Equal(t, map[string]logger.Level{"store": logger.LevelDebug}, d.levels.Subsystems())
+	assert.Equal(t, logger.LevelWarn, d.levels.Level("auth"))
+	assert.Equal(t, slog.LevelWarn, d.logLevel.Level())
+
+	write("log_level: loud\n")
+	d.reload()
+	assert.Equal(t, logger.LevelDebug, d.levels.Level("store"), "kept after a failed reload")
+}
+
+func TestDaemonAdmin(t *testing.T) {
+	var log syncBuffer
+	adminAddr := freeAddress(t)
+	d, err := start(&Config{
+		Listeners:    []ListenerConfig{{Address: "127.0.0.1:0"}},
+		Limits:       LimitsConfig{MaxConnections: 100},
+		LogLevel:     "error",
+		AdminAddress: adminAddr,
+	}, &log)
+	require.NoError(t, err)
+	defer d.shutdown(context.Background()) // nolint: errcheck
+
+	put := func(path, body string) int {
+		req, err := http.NewRequest(http.MethodPut, "http://"+adminAddr+path, strings.NewReader(body))
+		require.NoError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		res.Body.Close() // nolint: errcheck
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, put("/tuning", `{"max_connections": 200}`))
+	assert.Equal(t, 200, d.server.Tuning().MaxConnections)
+	assert.Equal(t, http.StatusOK, put("/log-levels", `{"subsystems": {"store": "debug"}}`))
+	assert.Equal(t, logger.LevelDebug, d.levels.Level("store"))
+	assert.Contains(t, log.String(), `msg="admin: changed limit" limit=max_connections old=100 new=200`)
+	assert.Contains(t, log.String(), `msg="admin: changed log level" subsystem=store new=DEBUG`)
+
+	res, err := http.Get("http://" + adminAddr + "/debug/vars")
+	require.NoError(t, err)
+	res.Body.Close() // nolint: errcheck
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "admin_debug off")
+}
+
+func TestDaemonAdminDebug(t *testing.T) {
+	adminAddr := freeAddress(t)
+	d, err := start(&Config{
+		Listeners:    []ListenerConfig{{Address: "127.0.0.1:0"}},
+		AdminAddress: adminAddr,
+		AdminDebug:   true,
+	}, io.Discard)
+	require.NoError(t, err)
+	get := func(path string) int {
+		res, err := http.Get("http://" + adminAddr + path)
+		require.NoError(t, err)
+		res.Body.Close() // nolint: errcheck
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, get("/debug/vars"))
+	assert.Equal(t, http.StatusOK, get("/debug/pprof/goroutine"))
+	assert.Equal(t, http.StatusOK, get("/tuning"))
+	require.NoError(t, d.shutdown(context.Background()))
+
+	d, err = start(&Config{
+		Listeners:    []ListenerConfig{{Address: "127.0.0.1:0"}},
+		AdminAddress: adminAddr,
+		AdminAllow:   []string{"192.0.2.0/24"},
+		AdminDebug:   true,
+	}, io.Discard)
+	require.NoError(t, err)
+	defer d.shutdown(context.Background()) // nolint: errcheck
+	assert.Equal(t, http.StatusForbidden, get("/debug/vars"))
+	assert.Equal(t, http.StatusForbidden, get("/tuning"))
+}
+
+func TestDaemonWebSocketCompression(t *testing.T) {
+	d, err := start(&Config{Listeners: []ListenerConfig{{
+		Address:     "127.0.0.1:0",
+		WebSocket:   true,
+		Compression: &CompressionConfig{MinSize: 16, MaxMessageSize: 1 << 20},
+	}}}, io.Discard)
+	require.NoError(t, err)
+	defer d.shutdown(context.Background()) // nolint: errcheck
+	require.NotNil(t, d.listeners[0].(*transport.WebSocketListener).Compression)
+
+	conn, err := transport.DialWebSocketWith("ws://"+d.listeners[0].Addr().String(), &transport.WebSocketCompression{})
+	require.NoError(t, err)
+	c, err := client.Connect(conn, client.Options{ClientID: "c", CleanSession: true})
+	require.NoError(t, err)
+	assert.NoError(t, c.Publish(context.Background(), "a", packet.QoSLevelAtLeastOnce, false, bytes.Repeat([]byte("x"), 1000)))
+	assert.NoError(t, c.Disconnect())
+}
+
+func TestDaemonLongPoll(t *testing.T) {
+	d, err := start(&Config{Listeners: []ListenerConfig{{Address: "127.0.0.1:0", LongPoll: true}}}, io.Discard)
+	require.NoError(t, err)
+	defer d.shutdown(context.Background()) // nolint: errcheck
+
+	conn, err := transport.DialLongPoll("http://" + d.listeners[0].Addr().String() + "/mqtt")
+	require.NoError(t, err)
+	c, err := client.Connect(conn, client.Options{ClientID: "c", CleanSession: true})
+	require.NoError(t, err)
+	received := make(chan string, 1)
+	_, err = c.Subscribe(context.Background(), "a", packet.QoSLevelAtLeastOnce, func(_ *client.Client, m client.Message) {
+		received <- string(m.Payload)
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.Publish(context.Background(), "a", packet.QoSLevelAtLeastOnce, false, []byte("polled")))
+	select {
+	case payload := <-received:
+		assert.Equal(t, "polled", payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message over long-polling")
+	}
+	assert.NoError(t, c.Disconnect())
+}
+
+func TestDaemonReplayLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay.log")
+	d, err := start(&Config{
+		Listeners: []ListenerConfig{{Address: "127.0.0.1:0"}},
+		ReplayLog: path,
+	}, io.Discard)
+	require.NoError(t, err)
+	c, err := client.Dial(d.listeners[0].Addr().String(), client.Options{ClientID: "c", CleanSession: true})
+	require.NoError(t, err)
+	require.NoError(t, c.Publish(context.Background(), "t", packet.QoSLevelAtLeastOnce, false, []byte("hello")))
+	require.NoError(t, c.Disconnect())
+	require.NoError(t, d.shutdown(context.Background()))
+
+	log, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+	require.Len(t, lines, 3)
+	assert.Contains(t, lines[1], `"kind":"publish"`)
+}
+
+func TestDaemonArchive(t *testing.T) {
+	dir := t.TempDir()
+	d, err := start(&Config{
+		Listeners: []ListenerConfig{{Address: "127.0.0.1:0"}},
+		Archive:   &ArchiveConfig{Dir: dir, Filters: []string{"a/#"}},
+	}, io.Discard)
+	require.NoError(t, err)
+	c, err := client.Dial(d.listeners[0].Addr().String(), client.Options{ClientID: "c", CleanSession: true})
+	require.NoError(t, err)
+	for _, name := range []string{"a/1", "b"} {
+		require.NoError(t, c.Publish(context.Background(), name, packet.QoSLevelAtLeastOnce, false, []byte("hello")))
+	}
+	require.NoError(t, c.Disconnect())
+	require.NoError(t, d.shutdown(context.Background()))
+
+	r, err := archive.NewReader(dir, archive.ReadOptions{})
+	require.NoError(t, err)
+	rec, err := r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "a/1", rec.Topic)
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDaemonDelayed(t *testing.T) {
+	cfg := &Config{
+		Listeners:   []ListenerConfig{{Address: "127.0.0.1:0"}},
+		Persistence: PersistenceConfig{Backend: "file", Path: filepath.Join(t.TempDir(), "state.json")},
+		MaxDelay:    time.Minute,
+	}
+	d, err := start(cfg, io.Discard)
+	require.NoError(t, err)
+	c, err := client.Dial(d.listeners[0].Addr().String(), client.Options{ClientID: "pub", CleanSession: true})
+	require.NoError(t, err)
+	require.NoError(t, c.Publish(context.Background(), "$delayed/1/a", packet.QoSLevelAtLeastOnce, true, []byte("later")))
+	require.NoError(t, c.Disconnect())
+	require.NoError(t, d.shutdown(context.Background()))
+
+	// The message survives the restart and is retained once due
+	d, err = start(cfg, io.Discard)
+	require.NoError(t, err)
+	defer d.shutdown(context.Background()) // nolint: errcheck
+	c, err = client.Dial(d.listeners[0].Addr().String(), client.Options{ClientID: "sub", CleanSession: true})
+	require.NoError(t, err)
+	defer c.Disconnect() // nolint: errcheck
+	messages := make(chan client.Message, 1)
+	_, err = c.Subscribe(context.Background(), "a", packet.QoSLevelAtLeastOnce, func(_ *client.Client, m client.Message) {
+		messages <- m
+	})
+	require.NoError(t, err)
+	select {
+	case m := <-messages:
+		assert.Equal(t, "later", string(m.Payload))
+	case <-time.After(5 * time.Second):
+		t.Fatal("delayed message not published after the restart")
+	}
+}
+
+func TestDaemonTenants(t *testing.T) {
+	d, err := start(&Config{
+		Listeners: []ListenerConfig{{Address: "127.0.0.1:0"}},
+		Auth:      AuthConfig{Tenants: map[string]string{"alice": "acme", "bob": "globex"}},
+	}, io.Discard)
+	require.NoError(t, err)
+	defer d.shutdown(context.Background()) // nolint: errcheck
+	addr := d.listeners[0].Addr().String()
+
+	received := make(chan string, 2) // the user receiving the message
+	ctx := context.Background()
+	for _, user := range []string{"alice", "bob"} {
+		c, err := client.Dial(addr, client.Options{ClientID: "dev", UserName: user, CleanSession: true})
+		require.NoError(t, err)
+		defer c.Disconnect() // nolint: errcheck
+		_, err = c.Subscribe(ctx, "t", packet.QoSLevelAtLeastOnce, func(*client.Client, client.Message) { received <- user })
+		require.NoError(t, err)
+		if user == "bob" {
+			require.NoError(t, c.Publish(ctx, "t", packet.QoSLevelAtLeastOnce, false, []byte("hi")))
+		}
+	}
+	select {
+	case user := <-received:
+		assert.Equal(t, "bob", user)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered")
+	}
+	select {
+	case user := <-received:
+		t.Fatalf("message crossed to %v", user)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,172 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/infinimesh/mqtt-go/acl"
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/passwd"
+	"github.com/infinimesh/mqtt-go/scram"
+)
+
+// reloader holds what SIGHUP reloads: the password file, the SCRAM
+// credentials, the ACL and the certificates of the TLS listeners. It is
+// the Authenticator and Authorizer of the server, and hands out the
+// enhanced authentication methods and TLS configurations.
+type reloader struct {
+	auth      AuthConfig
+	passwords atomic.Pointer[passwd.File]
+	scram     atomic.Pointer[scram.File]
+	acl       atomic.Pointer[acl.ACL]
+	certs     []*certificates
+}
+
+// certificates are the current certificates of a TLS listener
+type certificates struct {
+	cfg       TLSConfig
+	cert      atomic.Pointer[tls.Certificate]
+	clientCAs atomic.Pointer[x509.CertPool]
+}
+
+func newReloader(cfg *Config) (*reloader, error) {
+	r := &reloader{auth: cfg.Auth}
+	for _, l := range cfg.Listeners {
+		if l.TLS != nil {
+			r.certs = append(r.certs, &certificates{cfg: *l.TLS})
+		}
+	}
+	return r, r.reload()
+}
+
+// reload reads every file again. Nothing is replaced if one of them
+// fails to load, so that a broken file does not take effect halfway.
+func (r *reloader) reload() error {
+	var passwords *passwd.File
+	var credentials *scram.File
+	var list *acl.ACL
+	var err error
+	if path := r.auth.PasswordFile; path != "" {
+		if passwords, err = passwd.Load(path); err != nil {
+			return err
+		}
+	}
+	if path := r.auth.SCRAMFile; path != "" {
+		if credentials, err = scram.Load(path); err != nil {
+			return err
+		}
+	}
+	if path := r.auth.ACLFile; path != "" {
+		if list, err = acl.Load(path); err != nil {
+			return err
+		}
+	}
+	certs := make([]tls.Certificate, len(r.certs))
+	pools := make([]*x509.CertPool, len(r.certs))
+	for i, c := range r.certs {
+		if certs[i], err = tls.LoadX509KeyPair(c.cfg.CertFile, c.cfg.KeyFile); err != nil {
+			return err
+		}
+		if c.cfg.ClientCAFile != "" {
+			if pools[i], err = loadPool(c.cfg.ClientCAFile); err != nil {
+				return err
+			}
+		}
+	}
+
+	r.passwords.Store(passwords)
+	r.scram.Store(credentials)
+	r.acl.Store(list)
+	for i, c := range r.certs {
+		c.cert.Store(&certs[i])
+		c.clientCAs.Store(pools[i])
+	}
+	return nil
+}
+
+func loadPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %v", path)
+	}
+	return pool, nil
+}
+
+// Authenticate implements broker.Authenticator with the password file
+func (r *reloader) Authenticate(c *broker.Conn) error {
+	passwords := r.passwords.Load()
+	if passwords == nil {
+		return nil
+	}
+	if r.auth.AllowAnonymous && !c.Connect().VariableHeader.ConnectFlags.UserName {
+		return nil
+	}
+	return passwords.Authenticate(c)
+}
+
+// enhancedAuthenticators returns SCRAM-SHA-256 if there is a credentials
+// file
+func (r *reloader) enhancedAuthenticators() []broker.EnhancedAuthenticator {
+	if r.auth.SCRAMFile == "" {
+		return nil
+	}
+	return []broker.EnhancedAuthenticator{&scram.Authenticator{Credentials: r.credentials}}
+}
+
+// credentials looks up a user in the SCRAM credentials file loaded last
+func (r *reloader) credentials(userName string) (scram.Credentials, bool) {
+	return r.scram.Load().Credentials(userName)
+}
+
+// Authorize implements broker.Authorizer with the ACL
+func (r *reloader) Authorize(clientID, userName, topic string, action broker.Action) error {
+	list := r.acl.Load()
+	if list == nil {
+		return nil
+	}
+	return list.Authorize(clientID, userName, topic, action)
+}
+
+// tlsConfig returns the configuration of the i-th TLS listener, which
+// always uses the certificates loaded last
+func (r *reloader) tlsConfig(i int) *tls.Config {
+	c := r.certs[i]
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*c.cert.Load()},
+			}
+			if pool := c.clientCAs.Load(); pool != nil {
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				cfg.ClientCAs = pool
+			}
+			return cfg, nil
+		},
+	}
+}
@@ -0,0 +1,52 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/infinimesh/mqtt-go/replay"
+)
+
+// runReplay replays the replay_log of a broker against the broker at
+// -address
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	addr := flags.String("address", "127.0.0.1:1883", "MQTT listener to replay against, without TLS")
+	speed := flags.Float64("speed", 1, "how many times faster than recorded, 0 for as fast as possible")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: mqtt-broker replay [-address host:port] [-speed n] file")
+	}
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint: errcheck
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	stats, err := (&replay.Replayer{Addr: *addr, Speed: *speed}).Replay(ctx, f)
+	fmt.Printf("%d events replayed, %d skipped, %d messages received\n", stats.Events, stats.Skipped, stats.Received)
+	return err
+}
@@ -0,0 +1,137 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Command mqtt-pub publishes messages to an MQTT broker, like
+// mosquitto_pub:
+//
+//	mqtt-pub -h broker.example.com -t sensors/1/temp -q 1 -m 21.5
+//	tail -f app.log | mqtt-pub -t logs/app -l
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/infinimesh/mqtt-go/cmd/internal/cli"
+)
+
+// maxLineLength is the longest line -l publishes, longer ones end it with
+// an error
+const maxLineLength = 1 << 20
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("mqtt-pub: ")
+	err := run(os.Args[1:], os.Stdin)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(args []string, stdin io.Reader) error {
+	fs := flag.NewFlagSet("mqtt-pub", flag.ContinueOnError)
+	var conn cli.ConnFlags
+	conn.Register(fs)
+	topic := fs.String("t", "", "topic to publish to")
+	message := fs.String("m", "", "message to publish")
+	file := fs.String("f", "", "publish the content of a file as the message")
+	whole := fs.Bool("s", false, "publish all of stdin as the message")
+	lines := fs.Bool("l", false, "publish every line of stdin as a message")
+	null := fs.Bool("n", false, "publish an empty message")
+	qosFlag := fs.Int("q", 0, "QoS of the messages")
+	retain := fs.Bool("r", false, "retain the messages")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *topic == "" {
+		return errors.New("-t is required")
+	}
+	sources := 0
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "m", "f", "s", "l", "n":
+			sources++
+		}
+	})
+	if sources != 1 {
+		return errors.New("exactly one of -m, -f, -s, -l or -n is required")
+	}
+	qos, err := cli.ParseQoS(*qosFlag)
+	if err != nil {
+		return err
+	}
+	opts, err := conn.Options()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	c, err := conn.Dial(opts)
+	if err != nil {
+		return err
+	}
+	defer c.Disconnect() // nolint: errcheck
+
+	publish := func(payload []byte) error {
+		return c.Publish(ctx, *topic, qos, *retain, payload)
+	}
+	switch {
+	case *lines:
+		return publishLines(stdin, publish)
+	case *whole:
+		payload, err := io.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		return publish(payload)
+	case *file != "":
+		payload, err := os.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		return publish(payload)
+	case *null:
+		return publish(nil)
+	}
+	return publish([]byte(*message))
+}
+
+// publishLines publishes every line of r, without its line ending
+func publishLines(r io.Reader, publish func(payload []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineLength)
+	for scanner.Scan() {
+		if err := publish(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading stdin: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/client"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func TestRun(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &broker.Server{}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+
+	sub, err := client.Dial(l.Addr().String(), client.Options{ClientID: "sub", CleanSession: true})
+	require.NoError(t, err)
+	defer sub.Disconnect() // nolint: errcheck
+	messages := make(chan client.Message, 10)
+	_, err = sub.Subscribe(context.Background(), "logs/#", packet.QoSLevelExactlyOnce, func(c *client.Client, m client.Message) {
+		messages <- m
+	})
+	require.NoError(t, err)
+
+	args := []string{"-h", host, "-p", port, "-t", "logs/app", "-q", "2", "-l"}
+	require.NoError(t, run(args, strings.NewReader("first\nsecond\n")))
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case m := <-messages:
+			assert.Equal(t, "logs/app", m.Topic)
+			assert.Equal(t, expected, string(m.Payload))
+			assert.Equal(t, packet.QoSLevelExactlyOnce, m.QoS)
+		case <-time.After(time.Second):
+			t.Fatal("message was not published")
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-m", "x"},
+		{"-t", "logs/app"},
+		{"-t", "logs/app", "-m", "x", "-n"},
+		{"-t", "logs/app", "-m", "x", "-q", "3"},
+	} {
+		assert.Error(t, run(append([]string{"-h", host, "-p", port}, args...), nil), "%v", args)
+	}
+}
@@ -0,0 +1,120 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Command mqtt-sub subscribes to topics of an MQTT broker and prints the
+// messages it receives, like mosquitto_sub:
+//
+//	mqtt-sub -h broker.example.com -t 'sensors/+/temp' -t 'alerts/#' -v
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/infinimesh/mqtt-go/client"
+	"github.com/infinimesh/mqtt-go/cmd/internal/cli"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("mqtt-sub: ")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err := run(ctx, os.Args[1:], os.Stdout)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("mqtt-sub", flag.ContinueOnError)
+	var conn cli.ConnFlags
+	conn.Register(fs)
+	var topics cli.StringList
+	fs.Var(&topics, "t", "topic filter to subscribe to, may be given more than once")
+	qosFlag := fs.Int("q", 0, "maximum QoS of the subscriptions")
+	verbose := fs.Bool("v", false, "print the topic before the payload")
+	count := fs.Int("C", 0, "exit after this many messages, 0 means never")
+	noRetained := fs.Bool("R", false, "do not print retained messages")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if len(topics) == 0 {
+		return errors.New("-t is required")
+	}
+	qos, err := cli.ParseQoS(*qosFlag)
+	if err != nil {
+		return err
+	}
+	opts, err := conn.Options()
+	if err != nil {
+		return err
+	}
+
+	// Messages are handled one at a time, so received needs no lock
+	received := 0
+	enough := make(chan struct{})
+	handle := func(c *client.Client, m client.Message) {
+		if (*noRetained && m.Retained) || (*count > 0 && received >= *count) {
+			return
+		}
+		if *verbose {
+			fmt.Fprintf(out, "%s %s\n", m.Topic, m.Payload)
+		} else {
+			fmt.Fprintf(out, "%s\n", m.Payload)
+		}
+		received++
+		if received == *count {
+			close(enough)
+		}
+	}
+	// Messages of subscriptions kept in a persistent session
+	opts.OnMessage = handle
+
+	c, err := conn.Dial(opts)
+	if err != nil {
+		return err
+	}
+	defer c.Disconnect() // nolint: errcheck
+
+	for _, topic := range topics {
+		granted, err := c.Subscribe(ctx, topic, qos, handle)
+		if err != nil {
+			return fmt.Errorf("subscribing to %v: %w", topic, err)
+		}
+		if granted != qos {
+			log.Printf("%v granted with QoS %v", topic, granted)
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-enough:
+	case <-c.Done():
+		return c.Err()
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/client"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func TestRun(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &broker.Server{}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+
+	pub, err := client.Dial(l.Addr().String(), client.Options{ClientID: "pub", CleanSession: true})
+	require.NoError(t, err)
+	defer pub.Disconnect() // nolint: errcheck
+	ctx := context.Background()
+	require.NoError(t, pub.Publish(ctx, "sensors/1/temp", packet.QoSLevelAtLeastOnce, true, []byte("21")))
+	require.NoError(t, pub.Publish(ctx, "sensors/2/temp", packet.QoSLevelAtLeastOnce, true, []byte("22")))
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var out bytes.Buffer
+	require.NoError(t, run(ctx, []string{"-h", host, "-p", port, "-t", "sensors/+/temp", "-q", "1", "-v", "-C", "2"}, &out))
+	assert.NoError(t, ctx.Err(), "run must return after -C messages")
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	assert.ElementsMatch(t, [][]byte{[]byte("sensors/1/temp 21"), []byte("sensors/2/temp 22")}, lines)
+
+	assert.Error(t, run(ctx, []string{"-h", host, "-p", port}, &out), "-t is required")
+}
@@ -0,0 +1,309 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Package jwt authenticates clients with JSON Web Tokens (RFC 7519) and
+// authorizes them with the topics their token grants. The token is the
+// password of CONNECT, or the authentication data of the MQTT 5 enhanced
+// authentication method "JWT", which also lets a client hand in a fresh
+// token by re-authenticating.
+//
+// Tokens have to be signed with HS256, RS256, ES256 or EdDSA. Besides the
+// registered claims exp, nbf, iss and aud, the claims publish and
+// subscribe list the topic filters the client may publish to and
+// subscribe to:
+//
+//	{
+//	  "sub": "alice",
+//	  "exp": 1700000000,
+//	  "publish": ["devices/alice/#"],
+//	  "subscribe": ["devices/alice/#", "sensors/+/temp"]
+//	}
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/topic"
+)
+
+// Method is the name of the enhanced authentication method
+const Method = "JWT"
+
+// Claims are the claims of a token the Authenticator looks at
+type Claims struct {
+	Subject   string      `json:"sub"`
+	Issuer    string      `json:"iss"`
+	Audience  Audience    `json:"aud"`
+	ExpiresAt NumericDate `json:"exp"`
+	NotBefore NumericDate `json:"nbf"`
+	// Publish and Subscribe are the topic filters the client may
+	// publish to and subscribe to
+	Publish   []string `json:"publish"`
+	Subscribe []string `json:"subscribe"`
+}
+
+// Audience is a single string or an array of strings in JSON
+// [RFC 7519 4.1.3]
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = Audience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// NumericDate is seconds since the epoch, zero if absent
+type NumericDate float64
+
+// Time returns d as time, the zero time if absent
+func (d NumericDate) Time() time.Time {
+	if d == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(float64(d)*float64(time.Second)))
+}
+
+// Authenticator is a broker.Authenticator for tokens in the password, a
+// broker.EnhancedAuthenticator for tokens in the authentication data and
+// a broker.Authorizer for the topics of the tokens. Add it to
+// Server.Hooks as well, so that the grants of disconnected clients are
+// dropped. It is safe for concurrent use.
+type Authenticator struct {
+	broker.NopHook
+
+	// Key verifies the signatures: a []byte secret for HS256, an
+	// *rsa.PublicKey for RS256, an *ecdsa.PublicKey on P-256 for ES256
+	// or an ed25519.PublicKey for EdDSA. Tokens signed with any other
+	// algorithm are rejected.
+	Key crypto.PublicKey
+	// Issuer has to be the iss claim if not empty
+	Issuer string
+	// Audience has to be one of the aud claim if not empty
+	Audience string
+	// RequireExpiry rejects tokens without exp claim
+	RequireExpiry bool
+	// Leeway is the clock skew tolerated for exp and nbf
+	Leeway time.Duration
+
+	mu     sync.Mutex
+	grants map[string]*grant // by client identifier
+}
+
+// grant is what the token of a connected client allows
+type grant struct {
+	conn    *broker.Conn
+	expires time.Time // zero if the token does not expire
+	claims  *Claims
+}
+
+// Verify checks the signature and registered claims of token and returns
+// its claims. Errors wrap broker.ErrBadUserNameOrPassword.
+func (a *Authenticator) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalid("malformed token")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := decodePart(parts[0], &header); err != nil {
+		return nil, invalid("malformed header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalid("malformed signature")
+	}
+	if err := a.verifySignature(header.Algorithm, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	claims := &Claims{}
+	if err := decodePart(parts[1], claims); err != nil {
+		return nil, invalid("malformed claims")
+	}
+	now := time.Now()
+	switch {
+	case claims.ExpiresAt == 0 && a.RequireExpiry:
+		return nil, invalid("token without expiry")
+	case claims.ExpiresAt != 0 && !now.Before(claims.ExpiresAt.Time().Add(a.Leeway)):
+		return nil, invalid("token expired")
+	case claims.NotBefore != 0 && now.Add(a.Leeway).Before(claims.NotBefore.Time()):
+		return nil, invalid("token not yet valid")
+	case a.Issuer != "" && claims.Issuer != a.Issuer:
+		return nil, invalid(fmt.Sprintf("unexpected issuer %q", claims.Issuer))
+	case a.Audience != "" && !claims.Audience.contains(a.Audience):
+		return nil, invalid("token not meant for this audience")
+	}
+	return claims, nil
+}
+
+func (aud Audience) contains(s string) bool {
+	for _, a := range aud {
+		if a == s {
+			return true
+		}
+	}
+	return false
+}
+
+func invalid(reason string) error {
+	return fmt.Errorf("jwt: %s: %w", reason, broker.ErrBadUserNameOrPassword)
+}
+
+func decodePart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verifySignature checks signature of the signing input with Key. The
+// algorithm has to be the one of the type of Key, so that a public key
+// is never mistaken for an HMAC secret.
+func (a *Authenticator) verifySignature(alg, input string, signature []byte) error {
+	sum := sha256.Sum256([]byte(input))
+	ok := false
+	switch key := a.Key.(type) {
+	case []byte:
+		if alg == "HS256" {
+			h := hmac.New(sha256.New, key)
+			h.Write([]byte(input)) // nolint: errcheck
+			ok = hmac.Equal(h.Sum(nil), signature)
+		}
+	case *rsa.PublicKey:
+		if alg == "RS256" {
+			ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], signature) == nil
+		}
+	case *ecdsa.PublicKey:
+		if alg == "ES256" && key.Curve == elliptic.P256() && len(signature) == 64 {
+			r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+			ok = ecdsa.Verify(key, sum[:], r, s)
+		}
+	case ed25519.PublicKey:
+		if alg == "EdDSA" {
+			ok = ed25519.Verify(key, []byte(input), signature)
+		}
+	default:
+		return fmt.Errorf("jwt: unsupported key type %T", a.Key)
+	}
+	if !ok {
+		return invalid(fmt.Sprintf("invalid signature for algorithm %q", alg))
+	}
+	return nil
+}
+
+// Authenticate implements broker.Authenticator with the token in the
+// password. A user name, if given, has to be the subject of the token.
+func (a *Authenticator) Authenticate(c *broker.Conn) error {
+	connect := c.Connect()
+	if !connect.VariableHeader.ConnectFlags.Password {
+		return invalid("no token")
+	}
+	return a.admit(c, string(connect.ConnectPayload.Password))
+}
+
+// admit verifies token and grants its topics to c
+func (a *Authenticator) admit(c *broker.Conn, token string) error {
+	claims, err := a.Verify(token)
+	if err != nil {
+		return err
+	}
+	connect := c.Connect()
+	if connect.VariableHeader.ConnectFlags.UserName && connect.ConnectPayload.UserName != claims.Subject {
+		return invalid("user name is not the subject of the token")
+	}
+
+	g := &grant{conn: c, claims: claims}
+	if claims.ExpiresAt != 0 {
+		g.expires = claims.ExpiresAt.Time().Add(a.Leeway)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.grants == nil {
+		a.grants = make(map[string]*grant)
+	}
+	a.grants[c.ClientID()] = g
+	return nil
+}
+
+func (a *Authenticator) Method() string {
+	return Method
+}
+
+func (a *Authenticator) Start(c *broker.Conn) broker.AuthExchange {
+	return &exchange{auth: a, conn: c}
+}
+
+// exchange takes the token in a single step
+type exchange struct {
+	auth *Authenticator
+	conn *broker.Conn
+}
+
+func (e *exchange) Step(data []byte) ([]byte, bool, error) {
+	return nil, true, e.auth.admit(e.conn, string(data))
+}
+
+// Authorize implements broker.Authorizer with the topics of the token of
+// the client. Everything is denied once the token expired.
+func (a *Authenticator) Authorize(clientID, userName, name string, action broker.Action) error {
+	a.mu.Lock()
+	g := a.grants[clientID]
+	a.mu.Unlock()
+	if g == nil || (!g.expires.IsZero() && !time.Now().Before(g.expires)) {
+		return broker.ErrNotAuthorized
+	}
+
+	filters, allowed := g.claims.Publish, topic.Matches
+	if action == broker.ActionSubscribe {
+		filters, allowed = g.claims.Subscribe, topic.Covers
+	}
+	for _, filter := range filters {
+		if allowed(filter, name) {
+			return nil
+		}
+	}
+	return broker.ErrNotAuthorized
+}
+
+// OnDisconnect drops the grant of c, unless the client identifier was
+// taken over by a new connection meanwhile
+func (a *Authenticator) OnDisconnect(c *broker.Conn, graceful bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if g := a.grants[c.ClientID()]; g != nil && g.conn == c {
+		delete(a.grants, c.ClientID())
+	}
+}
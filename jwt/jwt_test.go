@@ -0,0 +1,155 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/client"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+var secret = []byte("0123456789abcdef0123456789abcdef")
+
+// sign returns a token for claims, signed by sign
+func sign(t *testing.T, alg string, claims map[string]interface{}, sign func(input []byte) []byte) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	enc := base64.RawURLEncoding
+	input := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	return input + "." + enc.EncodeToString(sign([]byte(input)))
+}
+
+func hs256(t *testing.T, claims map[string]interface{}) string {
+	return sign(t, "HS256", claims, func(input []byte) []byte {
+		h := hmac.New(sha256.New, secret)
+		h.Write(input) // nolint: errcheck
+		return h.Sum(nil)
+	})
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now().Unix()
+	a := &Authenticator{Key: secret, Issuer: "issuer", Audience: "mqtt", RequireExpiry: true}
+	valid := map[string]interface{}{"sub": "alice", "iss": "issuer", "aud": []string{"web", "mqtt"}, "exp": now + 60}
+	claims, err := a.Verify(hs256(t, valid))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", claims.Subject)
+
+	for name, c := range map[string]map[string]interface{}{
+		"expired":        {"iss": "issuer", "aud": "mqtt", "exp": now - 1},
+		"not yet valid":  {"iss": "issuer", "aud": "mqtt", "exp": now + 60, "nbf": now + 30},
+		"without expiry": {"iss": "issuer", "aud": "mqtt"},
+		"wrong issuer":   {"iss": "other", "aud": "mqtt", "exp": now + 60},
+		"wrong audience": {"iss": "issuer", "aud": "web", "exp": now + 60},
+	} {
+		_, err := a.Verify(hs256(t, c))
+		assert.True(t, errors.Is(err, broker.ErrBadUserNameOrPassword), "%v: %v", name, err)
+	}
+
+	// Signatures of other keys and algorithms
+	token := hs256(t, valid)
+	_, err = a.Verify(token[:len(token)-2] + "AA")
+	assert.Error(t, err)
+	_, err = a.Verify(sign(t, "none", valid, func([]byte) []byte { return nil }))
+	assert.Error(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, err = (&Authenticator{Key: &rsaKey.PublicKey}).Verify(token)
+	assert.Error(t, err, "HS256 must not be accepted with an RSA key")
+	_, err = a.Verify("not.a.token")
+	assert.Error(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	es256 := sign(t, "ES256", valid, func(input []byte) []byte {
+		sum := sha256.Sum256(input)
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, sum[:])
+		require.NoError(t, err)
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	})
+	_, err = (&Authenticator{Key: &ecKey.PublicKey}).Verify(es256)
+	assert.NoError(t, err)
+
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	eddsa := sign(t, "EdDSA", valid, func(input []byte) []byte { return ed25519.Sign(edPrivate, input) })
+	_, err = (&Authenticator{Key: edPublic}).Verify(eddsa)
+	assert.NoError(t, err)
+}
+
+func TestAuthenticator(t *testing.T) {
+	a := &Authenticator{Key: secret}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &broker.Server{
+		Authenticator:          a,
+		EnhancedAuthenticators: []broker.EnhancedAuthenticator{a},
+		Authorizer:             a,
+		Hooks:                  []broker.Hook{a},
+	}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	token := hs256(t, map[string]interface{}{
+		"sub":       "alice",
+		"exp":       time.Now().Unix() + 60,
+		"publish":   []string{"alice/#"},
+		"subscribe": []string{"alice/#", "sensors/+/temp"},
+	})
+	ctx := t.Context()
+
+	_, err = client.Dial(l.Addr().String(), client.Options{ClientID: "c1", UserName: "bob", Password: []byte(token)})
+	assert.Equal(t, &client.ConnectError{ReturnCode: packet.ConnAckBadUserNameOrPassword}, err, "user name must be the subject")
+	_, err = client.Dial(l.Addr().String(), client.Options{ClientID: "c1", UserName: "alice", Password: []byte("bogus")})
+	assert.Equal(t, &client.ConnectError{ReturnCode: packet.ConnAckBadUserNameOrPassword}, err)
+
+	c, err := client.Dial(l.Addr().String(), client.Options{ClientID: "c1", CleanSession: true, UserName: "alice", Password: []byte(token)})
+	require.NoError(t, err)
+	_, err = c.Subscribe(ctx, "sensors/kitchen/temp", packet.QoSLevelNone, nil)
+	assert.NoError(t, err)
+	_, err = c.Subscribe(ctx, "sensors/#", packet.QoSLevelNone, nil)
+	assert.Error(t, err, "not covered by the token")
+	require.NoError(t, c.Disconnect())
+
+	// The token as authentication data of MQTT 5
+	c, err = client.Dial(l.Addr().String(), client.Options{
+		ClientID:        "c2",
+		CleanSession:    true,
+		ProtocolVersion: packet.ProtocolVersion5,
+		Auth:            tokenAuth(token),
+	})
+	require.NoError(t, err)
+	_, err = c.Subscribe(ctx, "alice/x", packet.QoSLevelNone, nil)
+	assert.NoError(t, err)
+	require.NoError(t, c.Disconnect())
+
+	// Grants end with the connection
+	assert.Eventually(t, func() bool {
+		return a.Authorize("c2", "", "alice/x", broker.ActionPublish) != nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+// tokenAuth hands in a token for the "JWT" method
+type tokenAuth string
+
+func (a tokenAuth) Method() string                   { return Method }
+func (a tokenAuth) Start() ([]byte, error)           { return []byte(a), nil }
+func (a tokenAuth) Step(data []byte) ([]byte, error) { return nil, errors.New("unexpected AUTH") }
+func (a tokenAuth) Finish(data []byte) error         { return nil }
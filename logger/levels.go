@@ -0,0 +1,116 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package logger
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Subsystem returns the subsystem a log entry belongs to, the prefix of
+// its message before the colon: broker for "broker: client connected".
+// The broker logs under packet, broker, auth and store, package cluster
+// under cluster and package bridge under bridge.
+func Subsystem(msg string) string {
+	if i := strings.IndexByte(msg, ':'); i > 0 && !strings.ContainsRune(msg[:i], ' ') {
+		return msg[:i]
+	}
+	return ""
+}
+
+// ParseLevel returns the level named s, like debug or WARN
+func ParseLevel(s string) (Level, error) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Levels passes the entries of a level at least that of their Subsystem
+// on to another Logger, so that a single subsystem can log at debug
+// level without flooding the log. The levels can be changed while
+// logging.
+type Levels struct {
+	next Logger
+	def  atomic.Int32
+	mu   sync.Mutex                       // serializes changes
+	subs atomic.Pointer[map[string]Level] // copied on change
+}
+
+// NewLevels returns Levels passing entries on to next, of def and above
+// for the subsystems without a level of their own
+func NewLevels(next Logger, def Level) *Levels {
+	l := &Levels{next: next}
+	l.def.Store(int32(def))
+	l.subs.Store(&map[string]Level{})
+	return l
+}
+
+func (l *Levels) Log(level Level, msg string, fields ...Field) {
+	if level >= l.Level(Subsystem(msg)) {
+		l.next.Log(level, msg, fields...)
+	}
+}
+
+// Level returns the level of subsystem
+func (l *Levels) Level(subsystem string) Level {
+	if level, ok := (*l.subs.Load())[subsystem]; ok {
+		return level
+	}
+	return Level(l.def.Load())
+}
+
+// Default returns the level of the subsystems without a level of their
+// own
+func (l *Levels) Default() Level {
+	return Level(l.def.Load())
+}
+
+// SetDefault sets the level of the subsystems without a level of their
+// own
+func (l *Levels) SetDefault(level Level) {
+	l.def.Store(int32(level))
+}
+
+// SetLevel gives subsystem a level of its own
+func (l *Levels) SetLevel(subsystem string, level Level) {
+	l.update(func(subs map[string]Level) { subs[subsystem] = level })
+}
+
+// ResetLevel makes subsystem log at the default level again
+func (l *Levels) ResetLevel(subsystem string) {
+	l.update(func(subs map[string]Level) { delete(subs, subsystem) })
+}
+
+// Subsystems returns the subsystems with a level of their own
+func (l *Levels) Subsystems() map[string]Level {
+	return maps.Clone(*l.subs.Load())
+}
+
+func (l *Levels) update(f func(map[string]Level)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	subs := maps.Clone(*l.subs.Load())
+	f(subs)
+	l.subs.Store(&subs)
+}
@@ -0,0 +1,139 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Package logger defines the structured logging interface used by the
+// broker and the packet reader, with adapters for the standard library
+// loggers. Package zaplogger adapts zap.
+package logger
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+// Log levels, in increasing severity
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// Field is a key-value pair attached to a log entry
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns a Field
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger writes structured log entries. Implementations must be safe for
+// concurrent use.
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+// Nop discards every entry
+var Nop Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(Level, string, ...Field) {}
+
+// Std adapts a standard library logger. Entries below min are dropped,
+// the others are written as a line with the level, message and fields.
+func Std(l *log.Logger, min Level) Logger {
+	return stdLogger{l: l, min: min}
+}
+
+type stdLogger struct {
+	l   *log.Logger
+	min Level
+}
+
+func (s stdLogger) Log(level Level, msg string, fields ...Field) {
+	if level < s.min {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+	if s.l == nil {
+		log.Print(b.String())
+		return
+	}
+	s.l.Print(b.String())
+}
+
+// Slog adapts a log/slog logger
+func Slog(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s slogLogger) Log(level Level, msg string, fields ...Field) {
+	var slevel slog.Level
+	switch level {
+	case LevelDebug:
+		slevel = slog.LevelDebug
+	case LevelInfo:
+		slevel = slog.LevelInfo
+	case LevelWarn:
+		slevel = slog.LevelWarn
+	default:
+		slevel = slog.LevelError
+	}
+	ctx := context.Background()
+	if !s.l.Enabled(ctx, slevel) {
+		return
+	}
+	attrs := make([]slog.Attr, len(fields))
+	for i, f := range fields {
+		attrs[i] = slog.Any(f.Key, f.Value)
+	}
+	s.l.LogAttrs(ctx, slevel, msg, attrs...)
+}
@@ -0,0 +1,80 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStd(t *testing.T) {
+	var buf bytes.Buffer
+	l := Std(log.New(&buf, "", 0), LevelInfo)
+
+	l.Log(LevelDebug, "dropped")
+	l.Log(LevelWarn, "broker: failed", F("client_id", "c1"), F("error", errors.New("boom")))
+	assert.Equal(t, "WARN broker: failed client_id=c1 error=boom\n", buf.String())
+}
+
+func TestSlog(t *testing.T) {
+	var buf bytes.Buffer
+	l := Slog(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})))
+
+	l.Log(LevelDebug, "dropped")
+	l.Log(LevelError, "broker: failed", F("client_id", "c1"))
+	assert.Equal(t, "level=ERROR msg=\"broker: failed\" client_id=c1\n", buf.String())
+}
+
+func TestSubsystem(t *testing.T) {
+	for msg, want := range map[string]string{
+		"broker: client connected": "broker",
+		"packet: read":             "packet",
+		"no subsystem":             "",
+		"no subsystem: here":       "",
+		": empty":                  "",
+	} {
+		assert.Equal(t, want, Subsystem(msg), msg)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, l := range []Level{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		parsed, err := ParseLevel(strings.ToLower(l.String()))
+		assert.NoError(t, err)
+		assert.Equal(t, l, parsed)
+	}
+	_, err := ParseLevel("loud")
+	assert.Error(t, err)
+}
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLevels(Std(log.New(&buf, "", 0), LevelDebug), LevelWarn)
+	l.SetLevel("auth", LevelDebug)
+
+	l.Log(LevelInfo, "broker: client connected")
+	l.Log(LevelDebug, "auth: not authorized")
+	l.Log(LevelError, "store: failed")
+	assert.Equal(t, "DEBUG auth: not authorized\nERROR store: failed\n", buf.String())
+	assert.Equal(t, map[string]Level{"auth": LevelDebug}, l.Subsystems())
+
+	buf.Reset()
+	l.ResetLevel("auth")
+	l.SetDefault(LevelInfo)
+	l.Log(LevelDebug, "auth: not authorized")
+	l.Log(LevelInfo, "broker: client connected")
+	assert.Equal(t, "INFO broker: client connected\n", buf.String())
+	assert.Empty(t, l.Subsystems())
+}
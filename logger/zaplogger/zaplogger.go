@@ -0,0 +1,57 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Package zaplogger adapts a zap logger to logger.Logger
+package zaplogger
+
+import (
+	"github.com/infinimesh/mqtt-go/logger"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// New returns a logger.Logger writing to z
+func New(z *zap.Logger) logger.Logger {
+	return zapLogger{z}
+}
+
+type zapLogger struct {
+	z *zap.Logger
+}
+
+func (l zapLogger) Log(level logger.Level, msg string, fields ...logger.Field) {
+	var zlevel zapcore.Level
+	switch level {
+	case logger.LevelDebug:
+		zlevel = zapcore.DebugLevel
+	case logger.LevelInfo:
+		zlevel = zapcore.InfoLevel
+	case logger.LevelWarn:
+		zlevel = zapcore.WarnLevel
+	default:
+		zlevel = zapcore.ErrorLevel
+	}
+	ce := l.z.Check(zlevel, msg)
+	if ce == nil {
+		return
+	}
+	zfields := make([]zap.Field, len(fields))
+	for i, f := range fields {
+		zfields[i] = zap.Any(f.Key, f.Value)
+	}
+	ce.Write(zfields...)
+}
@@ -0,0 +1,25 @@
+package zaplogger
+
+import (
+	"testing"
+
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestZap(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	l := New(zap.New(core))
+
+	l.Log(logger.LevelDebug, "dropped")
+	l.Log(logger.LevelWarn, "broker: failed", logger.F("client_id", "c1"))
+
+	entries := logs.AllUntimed()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, zapcore.WarnLevel, entries[0].Level)
+	assert.Equal(t, "broker: failed", entries[0].Message)
+	assert.Equal(t, map[string]interface{}{"client_id": "c1"}, entries[0].ContextMap())
+}
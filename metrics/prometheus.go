@@ -0,0 +1,209 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Package metrics exports the measurements of a broker.Server to
+// Prometheus
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus implements broker.Metrics with Prometheus collectors
+type Prometheus struct {
+	registry *prometheus.Registry
+
+	packets        *prometheus.CounterVec
+	decodeErrors   *prometheus.CounterVec
+	connectLatency prometheus.Histogram
+	inflight       prometheus.Histogram
+	bytesReceived  prometheus.Counter
+	bytesSent      prometheus.Counter
+	paused         prometheus.Gauge
+	pauses         prometheus.Histogram
+	goroutines     prometheus.Gauge
+	heapAlloc      prometheus.Gauge
+	heapObjects    prometheus.Gauge
+	gcPauses       prometheus.Histogram
+	queueDepth     *prometheus.GaugeVec
+}
+
+var _ broker.Metrics = (*Prometheus)(nil)
+
+// NewPrometheus registers the collectors with reg, or with a registry of
+// their own if reg is nil
+func NewPrometheus(reg *prometheus.Registry) *Prometheus {
+	if reg == nil {
+		reg = prometheus.NewRegistry()
+	}
+	m := &Prometheus{
+		registry: reg,
+		packets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mqtt_packets_decoded_total",
+			Help: "Packets read from clients, by packet type.",
+		}, []string{"type"}),
+		decodeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mqtt_decode_errors_total",
+			Help: "Packets that violated the protocol, by MQTT 5 reason code.",
+		}, []string{"reason_code"}),
+		connectLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "mqtt_connect_latency_seconds",
+			Help:    "Time from accepting a connection until CONNACK.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}),
+		inflight: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "mqtt_inflight_depth",
+			Help:    "QoS 1 and 2 messages in flight or queued for a client when another one is added.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		}),
+		bytesReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mqtt_received_bytes_total",
+			Help: "Bytes read from clients.",
+		}),
+		bytesSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mqtt_sent_bytes_total",
+			Help: "Bytes written to clients.",
+		}),
+		paused: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "mqtt_paused_clients",
+			Help: "Clients not read from because the queues of their subscribers are saturated.",
+		}),
+		pauses: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "mqtt_pause_duration_seconds",
+			Help:    "How long clients were not read from because the queues of their subscribers were saturated.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}),
+		goroutines: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "mqtt_runtime_goroutines",
+			Help: "Goroutines of the broker process.",
+		}),
+		heapAlloc: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "mqtt_runtime_heap_alloc_bytes",
+			Help: "Bytes of allocated heap objects.",
+		}),
+		heapObjects: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "mqtt_runtime_heap_objects",
+			Help: "Allocated heap objects.",
+		}),
+		gcPauses: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "mqtt_runtime_gc_pause_seconds",
+			Help:    "Stop-the-world pauses of the garbage collector.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 2, 14),
+		}),
+		queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mqtt_queue_depth",
+			Help: "Packets waiting in the queues of the broker, by queue.",
+		}, []string{"queue"}),
+	}
+	reg.MustRegister(m.packets, m.decodeErrors, m.connectLatency, m.inflight, m.bytesReceived, m.bytesSent, m.paused, m.pauses,
+		m.goroutines, m.heapAlloc, m.heapObjects, m.gcPauses, m.queueDepth)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format, mount
+// it at /metrics of an http.Server
+func (m *Prometheus) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Prometheus) PacketDecoded(p packet.ControlPacket) {
+	m.packets.WithLabelValues(packetType(p)).Inc()
+}
+
+func (m *Prometheus) DecodeError(err error) {
+	m.decodeErrors.WithLabelValues(fmt.Sprintf("%#02x", packet.ReasonCodeOf(err))).Inc()
+}
+
+func (m *Prometheus) Connected(latency time.Duration) {
+	m.connectLatency.Observe(latency.Seconds())
+}
+
+func (m *Prometheus) Inflight(depth int) {
+	m.inflight.Observe(float64(depth))
+}
+
+func (m *Prometheus) BytesReceived(n int) {
+	m.bytesReceived.Add(float64(n))
+}
+
+func (m *Prometheus) BytesSent(n int) {
+	m.bytesSent.Add(float64(n))
+}
+
+func (m *Prometheus) Paused() {
+	m.paused.Inc()
+}
+
+func (m *Prometheus) Resumed(paused time.Duration) {
+	m.paused.Dec()
+	m.pauses.Observe(paused.Seconds())
+}
+
+func (m *Prometheus) Runtime(stats broker.RuntimeStats) {
+	m.goroutines.Set(float64(stats.Goroutines))
+	m.heapAlloc.Set(float64(stats.HeapAlloc))
+	m.heapObjects.Set(float64(stats.HeapObjects))
+	for _, pause := range stats.GCPauses {
+		m.gcPauses.Observe(pause.Seconds())
+	}
+	for queue, depth := range stats.Queues {
+		m.queueDepth.WithLabelValues(queue).Set(float64(depth))
+	}
+}
+
+func packetType(p packet.ControlPacket) string {
+	switch p.(type) {
+	case *packet.ConnectControlPacket:
+		return "CONNECT"
+	case *packet.ConnAckControlPacket:
+		return "CONNACK"
+	case *packet.PublishControlPacket:
+		return "PUBLISH"
+	case *packet.PubackControlPacket:
+		return "PUBACK"
+	case *packet.PubrecControlPacket:
+		return "PUBREC"
+	case *packet.PubrelControlPacket:
+		return "PUBREL"
+	case *packet.PubcompControlPacket:
+		return "PUBCOMP"
+	case *packet.SubscribeControlPacket:
+		return "SUBSCRIBE"
+	case *packet.SubAckControlPacket:
+		return "SUBACK"
+	case *packet.UnsubscribeControlPacket:
+		return "UNSUBSCRIBE"
+	case *packet.UnsubAckControlPacket:
+		return "UNSUBACK"
+	case *packet.PingReqControlPacket:
+		return "PINGREQ"
+	case *packet.PingRespControlPacket:
+		return "PINGRESP"
+	case *packet.DisconnectControlPacket:
+		return "DISCONNECT"
+	case *packet.AuthControlPacket:
+		return "AUTH"
+	}
+	return "unknown"
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus(t *testing.T) {
+	m := NewPrometheus(nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &broker.Server{Metrics: m}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close() // nolint: errcheck
+	require.NoError(t, packet.WritePacket(c, &packet.ConnectControlPacket{
+		VariableHeader: packet.ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(packet.ProtocolVersion311),
+			ConnectFlags:  packet.ConnectFlags{CleanSession: true},
+		},
+		ConnectPayload: packet.ConnectPayload{ClientID: "metrics"},
+	}))
+	_, err = packet.ReadPacket(c)
+	require.NoError(t, err)
+	require.NoError(t, packet.WritePacket(c, packet.NewPingReqControlPacket()))
+	_, err = packet.ReadPacket(c)
+	require.NoError(t, err)
+	// PUBLISH with both QoS bits set
+	_, err = c.Write([]byte{packet.PUBLISH<<4 | 6, 5, 0, 1, 'a', 0, 1})
+	require.NoError(t, err)
+	_, err = packet.ReadPacket(c)
+	require.Error(t, err)
+
+	var body string
+	assert.Eventually(t, func() bool {
+		rec := httptest.NewRecorder()
+		m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		b, _ := io.ReadAll(rec.Body)
+		body = string(b)
+		return strings.Contains(body, `mqtt_decode_errors_total{reason_code="0x81"} 1`)
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Contains(t, body, `mqtt_packets_decoded_total{type="CONNECT"} 1`)
+	assert.Contains(t, body, `mqtt_packets_decoded_total{type="PINGREQ"} 1`)
+	assert.Contains(t, body, "mqtt_connect_latency_seconds_count 1")
+	assert.Contains(t, body, "mqtt_received_bytes_total")
+	assert.Contains(t, body, "mqtt_sent_bytes_total")
+}
+
+func TestPrometheusRuntime(t *testing.T) {
+	m := NewPrometheus(nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &broker.Server{Metrics: m, RuntimeStatsInterval: 10 * time.Millisecond}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	var body string
+	assert.Eventually(t, func() bool {
+		rec := httptest.NewRecorder()
+		m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		b, _ := io.ReadAll(rec.Body)
+		body = string(b)
+		return strings.Contains(body, `mqtt_queue_depth{queue="outbound"} 0`)
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Contains(t, body, `mqtt_queue_depth{queue="session"} 0`)
+	assert.NotContains(t, body, "mqtt_runtime_goroutines 0")
+	assert.NotContains(t, body, "mqtt_runtime_heap_alloc_bytes 0")
+}
+
+func TestRegisterPprof(t *testing.T) {
+	mux := http.NewServeMux()
+	RegisterPprof(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/goroutine?debug=1", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "goroutine profile")
+}
+
+func TestRegisterExpvar(t *testing.T) {
+	mux := http.NewServeMux()
+	RegisterExpvar(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/vars", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"memstats"`)
+}
@@ -0,0 +1,52 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+// Versioned is a packet encoded as MQTT 5 if it has properties, and as
+// MQTT 3.1 or 3.1.1 otherwise
+type Versioned interface {
+	ControlPacket
+	// Properties returns the MQTT 5 properties, nil for MQTT 3.1.1
+	Properties() *Properties
+	// WithProperties returns a copy of the packet with props, translating
+	// the fields whose values differ between the versions. It is
+	// encoded as MQTT 5 if props is not nil.
+	WithProperties(props *Properties) ControlPacket
+}
+
+// Adapt returns p in the form the codec encodes for version, so that a
+// packet can be built once for clients of every version: it gives the
+// Versioned packets empty Properties on MQTT 5 and drops them on MQTT 3.1
+// and 3.1.1, translating the CONNACK return code and the SUBACK failure
+// codes. An UNSUBACK for MQTT 5 needs its reason codes already. p is not
+// modified; Adapt returns a copy if it has to change anything, and p
+// itself for other packets or an unknown version.
+func Adapt(p ControlPacket, version ProtocolVersion) ControlPacket {
+	vp, ok := p.(Versioned)
+	if !ok || version < ProtocolVersion31 || version > ProtocolVersion5 {
+		return p
+	}
+	v5 := version == ProtocolVersion5
+	if v5 == (vp.Properties() != nil) {
+		return p
+	}
+	if v5 {
+		return vp.WithProperties(&Properties{})
+	}
+	return vp.WithProperties(nil)
+}
@@ -0,0 +1,70 @@
+package packet
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdapt(t *testing.T) {
+	packets := []ControlPacket{
+		NewPublish("a/b", 0, []byte("x")),
+		NewPubAckControlPacket(1),
+		NewPubRecControlPacket(2),
+		NewPubRelControlPacket(3),
+		NewPubCompControlPacket(4),
+		&SubscribeControlPacket{
+			VariableHeader: SubscribeVariableHeader{PacketID: 5},
+			Payload:        SubscribePayload{Subscriptions: []Subscription{{Topic: "a/#", QoS: QoSLevelAtLeastOnce}}},
+		},
+		NewSubAck(6, []byte{ReturncodeSuccessQoS1}),
+		NewUnsubscribe(7, []string{"a/#"}),
+		NewDisconnectControlPacket(),
+	}
+	for _, v := range []ProtocolVersion{ProtocolVersion311, ProtocolVersion5} {
+		for _, p := range packets {
+			require.Implements(t, (*Versioned)(nil), p)
+			adapted := Adapt(p, v)
+			var buf bytes.Buffer
+			require.NoError(t, WritePacket(&buf, adapted))
+			read, err := ReadPacketVersion(&buf, v)
+			require.NoError(t, err, "%T on %v", p, v)
+			assert.IsType(t, p, read)
+			assert.Same(t, adapted, Adapt(adapted, v), "adapted already")
+		}
+	}
+
+	publish := NewPublish("a", 0, nil)
+	adapted := Adapt(publish, ProtocolVersion5).(*PublishControlPacket)
+	assert.NotNil(t, adapted.VariableHeader.Properties)
+	assert.Nil(t, publish.VariableHeader.Properties, "p is left alone")
+	assert.Nil(t, Adapt(adapted, ProtocolVersion31).(*PublishControlPacket).VariableHeader.Properties)
+	assert.Same(t, publish, Adapt(publish, 0), "unknown version")
+}
+
+func TestAdaptCodes(t *testing.T) {
+	connack := Adapt(NewConnAck(ConnAckNotAuthorized, false), ProtocolVersion5).(*ConnAckControlPacket)
+	assert.Equal(t, ReasonCodeNotAuthorized, connack.VariableHeader.ReturnCode)
+	connack.VariableHeader.ReturnCode = ReasonCodeServerBusy
+	assert.Equal(t, ConnAckServerUnavailable, Adapt(connack, ProtocolVersion311).(*ConnAckControlPacket).VariableHeader.ReturnCode)
+
+	suback := NewSubAck(1, []byte{ReasonCodeGrantedQoS2, ReasonCodeNotAuthorized})
+	suback.VariableHeader.Properties = &Properties{}
+	adapted := Adapt(suback, ProtocolVersion311).(*SubAckControlPacket)
+	assert.Equal(t, []byte{ReturncodeSuccessQoS2, ReturncodeFailure}, adapted.Payload.ReturnCodes)
+	assert.Equal(t, ReasonCodeNotAuthorized, suback.Payload.ReturnCodes[1], "p is left alone")
+
+	for code, reason := range map[byte]byte{
+		ConnAckAccepted:                    ReasonCodeSuccess,
+		ConnAckUnacceptableProtocolVersion: ReasonCodeUnsupportedProtocolVersion,
+		ConnAckIdentifierRejected:          ReasonCodeClientIdentifierNotValid,
+		ConnAckServerUnavailable:           ReasonCodeServerUnavailable,
+		ConnAckBadUserNameOrPassword:       ReasonCodeBadUserNameOrPassword,
+		ConnAckNotAuthorized:               ReasonCodeNotAuthorized,
+	} {
+		assert.Equal(t, code, ConnAckReturnCode(ConnAckReasonCode(code)))
+		assert.Equal(t, code, ConnAckReturnCode(reason))
+	}
+}
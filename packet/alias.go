@@ -0,0 +1,98 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import "fmt"
+
+// ErrTopicAliasInvalid is returned for a PUBLISH packet with a topic
+// alias of 0 or above the topic alias maximum [MQTT-3.3.2-8]
+// [MQTT-3.3.2-9] [MQTT-3.3.2-10]
+var ErrTopicAliasInvalid = &Error{ReasonCodeTopicAliasInvalid, "Topic alias invalid"}
+
+// resolveAlias fills in the topic of a PUBLISH packet that only carries a
+// topic alias and records the aliases that come with a topic. The alias
+// is removed from p, so that it can be passed on like any other message.
+func (r *Reader) resolveAlias(p *PublishControlPacket) error {
+	props := p.VariableHeader.Properties
+	if props == nil || props.TopicAlias == nil {
+		return nil
+	}
+	alias := *props.TopicAlias
+	if alias == 0 || alias > r.TopicAliasMaximum {
+		return fmt.Errorf("%w: %v, the maximum is %v", ErrTopicAliasInvalid, alias, r.TopicAliasMaximum)
+	}
+
+	if p.VariableHeader.Topic == "" {
+		topic, ok := r.aliases[alias]
+		if !ok {
+			return fmt.Errorf("%w: topic alias %v was not set", ErrProtocolViolation, alias)
+		}
+		p.VariableHeader.Topic = topic
+	} else {
+		if r.aliases == nil {
+			r.aliases = make(map[uint16]string)
+		}
+		r.aliases[alias] = p.VariableHeader.Topic
+	}
+	props.TopicAlias = nil
+	return nil
+}
+
+// TopicAliases replaces the topic names of the PUBLISH packets sent on an
+// MQTT 5 connection with topic aliases, as many as the topic alias
+// maximum the peer announced allows. The first Maximum topics get an
+// alias the first time they are sent; later messages to them carry the
+// alias only. Packets must be passed to Apply in the order they are
+// written. It is not safe for concurrent use.
+type TopicAliases struct {
+	Maximum uint16
+
+	aliases map[string]uint16
+}
+
+// Apply returns the packet to write in place of p, p itself if no alias
+// applies. p is not modified. MQTT 3.1.1 packets and packets that already
+// have an alias are left alone.
+func (a *TopicAliases) Apply(p *PublishControlPacket) *PublishControlPacket {
+	props := p.VariableHeader.Properties
+	topic := p.VariableHeader.Topic
+	if a == nil || a.Maximum == 0 || props == nil || props.TopicAlias != nil || topic == "" {
+		return p
+	}
+
+	alias, known := a.aliases[topic]
+	if !known {
+		if len(a.aliases) >= int(a.Maximum) {
+			return p
+		}
+		if a.aliases == nil {
+			a.aliases = make(map[string]uint16)
+		}
+		alias = uint16(len(a.aliases) + 1)
+		a.aliases[topic] = alias
+	}
+
+	cp := *p
+	cprops := *props
+	cprops.TopicAlias = Uint16(alias)
+	cp.VariableHeader.Properties = &cprops
+	if known {
+		cp.VariableHeader.Topic = ""
+	}
+	return &cp
+}
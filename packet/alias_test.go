@@ -0,0 +1,69 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopicAliases(t *testing.T) {
+	publish := func(topic string) *PublishControlPacket {
+		p := NewPublish(topic, 0, []byte(topic))
+		p.VariableHeader.Properties = &Properties{}
+		return p
+	}
+
+	aliases := &TopicAliases{Maximum: 2}
+	var buf bytes.Buffer
+	var sent []*PublishControlPacket
+	for _, topic := range []string{"a/long/topic", "a/long/topic", "b", "c", "b", "c"} {
+		p := publish(topic)
+		cp := aliases.Apply(p)
+		assert.Nil(t, p.VariableHeader.Properties.TopicAlias, "Apply must not modify p")
+		sent = append(sent, cp)
+		require.NoError(t, WritePacket(&buf, cp))
+	}
+	assert.Equal(t, "a/long/topic", sent[0].VariableHeader.Topic)
+	assert.Equal(t, Uint16(1), sent[0].VariableHeader.Properties.TopicAlias)
+	assert.Equal(t, "", sent[1].VariableHeader.Topic)
+	assert.Equal(t, "", sent[4].VariableHeader.Topic)
+	assert.Nil(t, sent[5].VariableHeader.Properties.TopicAlias, "no alias left for c")
+
+	r := NewReader(&buf)
+	r.Version = ProtocolVersion5
+	r.TopicAliasMaximum = 2
+	for _, topic := range []string{"a/long/topic", "a/long/topic", "b", "c", "b", "c"} {
+		p, err := r.ReadPacket()
+		require.NoError(t, err)
+		publish := p.(*PublishControlPacket)
+		assert.Equal(t, topic, publish.VariableHeader.Topic)
+		assert.Nil(t, publish.VariableHeader.Properties.TopicAlias)
+	}
+}
+
+func TestReaderTopicAliasInvalid(t *testing.T) {
+	var testCases = []struct {
+		topic    string
+		alias    uint16
+		expected error
+	}{
+		{"a", 0, ErrTopicAliasInvalid},
+		{"a", 3, ErrTopicAliasInvalid},
+		{"", 1, ErrProtocolViolation},
+	}
+	for _, tc := range testCases {
+		p := NewPublish(tc.topic, 0, nil)
+		p.VariableHeader.Properties = &Properties{TopicAlias: Uint16(tc.alias)}
+		b, err := p.Encode()
+		require.NoError(t, err)
+
+		r := NewReader(bytes.NewReader(b))
+		r.Version = ProtocolVersion5
+		r.TopicAliasMaximum = 2
+		_, err = r.ReadPacket()
+		assert.True(t, errors.Is(err, tc.expected), "%v", err)
+	}
+}
@@ -0,0 +1,111 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"fmt"
+	"io"
+)
+
+// AuthControlPacket carries a step of an MQTT 5 enhanced authentication
+// exchange. It has no MQTT 3.1.1 encoding.
+type AuthControlPacket struct {
+	FixedHeader    FixedHeader
+	VariableHeader AuthVariableHeader
+}
+
+type AuthVariableHeader struct {
+	// ReasonCode is ReasonCodeSuccess, ReasonCodeContinueAuthentication
+	// or ReasonCodeReAuthenticate
+	ReasonCode byte
+	Properties *Properties
+}
+
+func readAuth(r io.Reader, fh FixedHeader, version ProtocolVersion) (*AuthControlPacket, error) {
+	if version != ProtocolVersion5 {
+		return nil, fmt.Errorf("%w: AUTH requires MQTT 5", ErrUnknownPacketType)
+	}
+
+	p := &AuthControlPacket{FixedHeader: fh}
+	p.VariableHeader.Properties = &Properties{}
+	if fh.RemainingLength == 0 {
+		return p, nil
+	}
+
+	reason, err := readByte(r)
+	if err != nil {
+		return nil, err
+	}
+	switch reason {
+	case ReasonCodeSuccess, ReasonCodeContinueAuthentication, ReasonCodeReAuthenticate:
+	default:
+		return nil, fmt.Errorf("%w for AUTH: %#x", ErrInvalidReasonCode, reason)
+	}
+	p.VariableHeader.ReasonCode = reason
+	if fh.RemainingLength == 1 {
+		return p, nil
+	}
+
+	props, n, err := readProperties(r, AUTH)
+	if err != nil {
+		return nil, err
+	}
+	if 1+n != fh.RemainingLength {
+		return nil, fmt.Errorf("%w for AUTH", ErrInvalidRemainingLength)
+	}
+	p.VariableHeader.Properties = props
+	return p, nil
+}
+
+func (p *AuthControlPacket) Encode() ([]byte, error) {
+	var body []byte
+	props := p.VariableHeader.Properties
+	if props == nil {
+		props = &Properties{}
+	}
+	encodedProps, err := props.encode(nil, AUTH)
+	if err != nil {
+		return nil, err
+	}
+	if p.VariableHeader.ReasonCode != ReasonCodeSuccess || len(encodedProps) > 1 {
+		body = append(body, p.VariableHeader.ReasonCode)
+	}
+	if len(encodedProps) > 1 {
+		body = append(body, encodedProps...)
+	}
+
+	p.FixedHeader.ControlPacketType = AUTH
+	p.FixedHeader.Flags = 0
+	return p.FixedHeader.encode(body)
+}
+
+func (p *AuthControlPacket) WriteTo(w io.Writer) (n int64, err error) {
+	return writeEncoded(w, p)
+}
+
+// NewAuth returns an AUTH packet with reasonCode carrying the
+// authentication data of method
+func NewAuth(reasonCode byte, method string, data []byte) *AuthControlPacket {
+	return &AuthControlPacket{
+		FixedHeader: FixedHeader{ControlPacketType: AUTH},
+		VariableHeader: AuthVariableHeader{
+			ReasonCode: reasonCode,
+			Properties: &Properties{AuthenticationMethod: method, AuthenticationData: data},
+		},
+	}
+}
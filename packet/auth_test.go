@@ -0,0 +1,38 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuth(t *testing.T) {
+	for _, p := range []*AuthControlPacket{
+		NewAuth(ReasonCodeContinueAuthentication, "SCRAM-SHA-256", []byte("n,,n=user,r=abc")),
+		NewAuth(ReasonCodeReAuthenticate, "SCRAM-SHA-256", nil),
+		NewAuth(ReasonCodeSuccess, "", nil),
+	} {
+		var buf bytes.Buffer
+		require.NoError(t, WritePacket(&buf, p))
+		decoded, err := ReadPacketVersion(&buf, ProtocolVersion5)
+		require.NoError(t, err)
+		assert.Equal(t, p, decoded)
+	}
+
+	// Success without properties leaves out the reason code
+	encoded, err := NewAuth(ReasonCodeSuccess, "", nil).Encode()
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xf0, 0}, encoded)
+
+	_, err = ReadPacketVersion(bytes.NewReader([]byte{0xf0, 0}), ProtocolVersion311)
+	assert.True(t, errors.Is(err, ErrUnknownPacketType), "%v", err)
+	_, err = ReadPacketVersion(bytes.NewReader([]byte{0xf0, 1, ReasonCodeNotAuthorized}), ProtocolVersion5)
+	assert.True(t, errors.Is(err, ErrInvalidReasonCode), "%v", err)
+	_, err = ReadPacketVersion(bytes.NewReader([]byte{0xf1, 0}), ProtocolVersion5)
+	assert.True(t, errors.Is(err, ErrInvalidFixedHeaderFlags), "%v", err)
+	_, err = ReadPacketVersion(bytes.NewReader([]byte{0xf0, 3, ReasonCodeContinueAuthentication, 0, 0}), ProtocolVersion5)
+	assert.Error(t, err, "properties shorter than remaining length")
+}
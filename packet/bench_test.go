@@ -0,0 +1,196 @@
+package packet
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// benchPackets returns a typical packet of every type for version
+func benchPackets(version ProtocolVersion) map[string]ControlPacket {
+	v5 := version == ProtocolVersion5
+	props := func(p *Properties) *Properties {
+		if !v5 {
+			return nil
+		}
+		return p
+	}
+
+	connect := &ConnectControlPacket{
+		VariableHeader: ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(version),
+			ConnectFlags:  ConnectFlags{UserName: true, Password: true, WillFlag: true, WillQoS: 1, CleanSession: true},
+			KeepAlive:     60,
+			Properties:    props(&Properties{SessionExpiryInterval: Uint32(3600), ReceiveMaximum: Uint16(100)}),
+		},
+		ConnectPayload: ConnectPayload{
+			ClientID:       "sensor-0042",
+			WillProperties: props(&Properties{WillDelayInterval: Uint32(10)}),
+			WillTopic:      "devices/sensor-0042/status",
+			WillMessage:    []byte("offline"),
+			UserName:       "sensor",
+			Password:       []byte("secret"),
+		},
+	}
+
+	connack := NewConnAck(ConnAckAccepted, true)
+	connack.VariableHeader.Properties = props(&Properties{TopicAliasMaximum: Uint16(10)})
+
+	publish := NewPublish("devices/sensor-0042/temperature", 7, bytes.Repeat([]byte("x"), 256))
+	publish.FixedHeaderFlags.QoS = QoSLevelAtLeastOnce
+	publish.VariableHeader.Properties = props(&Properties{
+		PayloadFormatIndicator: Byte(1),
+		MessageExpiryInterval:  Uint32(60),
+		ContentType:            "application/json",
+	})
+
+	subscribe := &SubscribeControlPacket{
+		VariableHeader: SubscribeVariableHeader{PacketID: 8, Properties: props(&Properties{})},
+		Payload: SubscribePayload{Subscriptions: []Subscription{
+			{Topic: "devices/+/temperature", QoS: QoSLevelAtLeastOnce},
+			{Topic: "alerts/#", QoS: QoSLevelExactlyOnce},
+		}},
+	}
+	suback := NewSubAck(8, []byte{1, 2})
+	suback.VariableHeader.Properties = props(&Properties{})
+	unsubscribe := NewUnsubscribe(9, []string{"devices/+/temperature", "alerts/#"})
+	unsubscribe.VariableHeader.Properties = props(&Properties{})
+	unsuback := NewUnsubAck(9)
+	if v5 {
+		unsuback.VariableHeader.Properties = &Properties{}
+		unsuback.Payload.ReasonCodes = []byte{ReasonCodeSuccess, ReasonCodeSuccess}
+	}
+
+	puback := NewPubAckControlPacket(7)
+	puback.VariableHeader.Properties = props(&Properties{})
+	pubrec := NewPubRecControlPacket(7)
+	pubrec.VariableHeader.Properties = props(&Properties{})
+	pubrel := NewPubRelControlPacket(7)
+	pubrel.VariableHeader.Properties = props(&Properties{})
+	pubcomp := NewPubCompControlPacket(7)
+	pubcomp.VariableHeader.Properties = props(&Properties{})
+	disconnect := NewDisconnectControlPacket()
+	disconnect.VariableHeader.Properties = props(&Properties{})
+
+	packets := map[string]ControlPacket{
+		"CONNECT":     connect,
+		"CONNACK":     connack,
+		"PUBLISH":     publish,
+		"PUBACK":      puback,
+		"PUBREC":      pubrec,
+		"PUBREL":      pubrel,
+		"PUBCOMP":     pubcomp,
+		"SUBSCRIBE":   subscribe,
+		"SUBACK":      suback,
+		"UNSUBSCRIBE": unsubscribe,
+		"UNSUBACK":    unsuback,
+		"PINGREQ":     NewPingReqControlPacket(),
+		"PINGRESP":    NewPingRespControlPacket(),
+		"DISCONNECT":  disconnect,
+	}
+	if v5 {
+		packets["AUTH"] = NewAuth(ReasonCodeContinueAuthentication, "SCRAM-SHA-256", []byte("n,,n=user,r=rOprNGfwEbeRWgbNEkqO"))
+	}
+	return packets
+}
+
+// benchmarkPackets runs f for every packet type of both protocol
+// versions, with the encoded packet
+func benchmarkPackets(b *testing.B, f func(b *testing.B, version ProtocolVersion, p ControlPacket, encoded []byte)) {
+	for _, version := range []ProtocolVersion{ProtocolVersion311, ProtocolVersion5} {
+		for _, name := range []string{"CONNECT", "CONNACK", "PUBLISH", "PUBACK", "PUBREC", "PUBREL", "PUBCOMP",
+			"SUBSCRIBE", "SUBACK", "UNSUBSCRIBE", "UNSUBACK", "PINGREQ", "PINGRESP", "DISCONNECT", "AUTH"} {
+			p, ok := benchPackets(version)[name]
+			if !ok {
+				continue
+			}
+			encoded, err := p.Encode()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(fmt.Sprintf("v%d/%s", version, name), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(encoded)))
+				f(b, version, p, encoded)
+			})
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	benchmarkPackets(b, func(b *testing.B, version ProtocolVersion, p ControlPacket, encoded []byte) {
+		for b.Loop() {
+			if _, err := p.Encode(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkWritePacket(b *testing.B) {
+	benchmarkPackets(b, func(b *testing.B, version ProtocolVersion, p ControlPacket, encoded []byte) {
+		for b.Loop() {
+			if err := WritePacket(io.Discard, p); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDecode(b *testing.B) {
+	benchmarkPackets(b, func(b *testing.B, version ProtocolVersion, p ControlPacket, encoded []byte) {
+		r := bytes.NewReader(encoded)
+		for b.Loop() {
+			r.Reset(encoded)
+			if _, err := ReadPacketVersion(r, version); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkReader decodes a stream of packets with the buffering Reader
+// of connections
+func BenchmarkReader(b *testing.B) {
+	benchmarkPackets(b, func(b *testing.B, version ProtocolVersion, p ControlPacket, encoded []byte) {
+		r := NewReader(&repeatReader{b: encoded})
+		r.Version = version
+		for b.Loop() {
+			if _, err := r.ReadPacket(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+var remainingLengths = []int{0, 127, 16383, 2097151, MaxRemainingLength}
+
+func BenchmarkEncodeRemainingLength(b *testing.B) {
+	for _, length := range remainingLengths {
+		b.Run(fmt.Sprint(length), func(b *testing.B) {
+			b.ReportAllocs()
+			buf := make([]byte, 0, 4)
+			for b.Loop() {
+				buf = appendRemainingLength(buf[:0], length)
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeRemainingLength(b *testing.B) {
+	for _, length := range remainingLengths {
+		encoded := EncodeRemainingLength(length)
+		b.Run(fmt.Sprint(length), func(b *testing.B) {
+			b.ReportAllocs()
+			r := bytes.NewReader(encoded)
+			for b.Loop() {
+				r.Reset(encoded)
+				if _, err := getRemainingLength(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// initialDecodeBuffer fits the variable header and payload of most
+	// packets, so the buffer rarely has to grow
+	initialDecodeBuffer = 512
+	// maxRetainedDecodeBuffer is the largest buffer kept for reuse; the
+	// buffer of a larger packet is left to the GC instead of pinning its
+	// memory
+	maxRetainedDecodeBuffer = 64 * 1024
+)
+
+// decodeBuffer holds the remaining bytes of the packet being decoded.
+// Decoded packets never refer to buf, every field is copied out of it, so
+// a decodeBuffer can be reused as soon as decode returns.
+type decodeBuffer struct {
+	buf []byte
+	r   bytes.Reader
+}
+
+var decodeBufferPool = sync.Pool{
+	New: func() interface{} {
+		return newDecodeBuffer()
+	},
+}
+
+func newDecodeBuffer() *decodeBuffer {
+	return &decodeBuffer{buf: make([]byte, initialDecodeBuffer)}
+}
+
+func (d *decodeBuffer) decode(r io.Reader, fh FixedHeader, version ProtocolVersion) (ControlPacket, error) {
+	defer d.release()
+	buf, err := d.fill(r, fh.RemainingLength)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	d.r.Reset(buf)
+	return parseToConcretePacket(&d.r, fh, version)
+}
+
+// fill reads n bytes into the buffer. A buffer too small for them grows
+// with the data actually received, so a fixed header announcing a huge
+// packet does not allocate its memory up front.
+func (d *decodeBuffer) fill(r io.Reader, n int) ([]byte, error) {
+	if cap(d.buf) >= n {
+		buf := d.buf[:n]
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+
+	buf := d.buf[:0]
+	for len(buf) < n {
+		if len(buf) == cap(buf) {
+			size := 2 * cap(buf)
+			if size > n {
+				size = n
+			}
+			grown := make([]byte, len(buf), size)
+			copy(grown, buf)
+			buf = grown
+			d.buf = buf
+		}
+		read, err := io.ReadFull(r, buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+read]
+		if err == io.EOF && len(buf) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// release drops references to the packet just decoded and gives up
+// buffers that grew too large to keep around
+func (d *decodeBuffer) release() {
+	d.r.Reset(nil)
+	if cap(d.buf) > maxRetainedDecodeBuffer {
+		d.buf = make([]byte, initialDecodeBuffer)
+	}
+}
+
+// scratchPool holds buffers for fields that are read and then copied or
+// parsed, like strings and properties
+var scratchPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, initialDecodeBuffer)
+		return &b
+	},
+}
+
+// getScratch returns a pooled buffer of length n. It must be handed back
+// with putScratch once its content was copied.
+func getScratch(n int) *[]byte {
+	b := scratchPool.Get().(*[]byte)
+	if cap(*b) < n {
+		*b = make([]byte, n)
+	}
+	*b = (*b)[:n]
+	return b
+}
+
+func putScratch(b *[]byte) {
+	if cap(*b) <= maxRetainedDecodeBuffer {
+		scratchPool.Put(b)
+	}
+}
+
+// checkAvailable rejects a length field announcing more bytes than are
+// left of the packet before anything is allocated for them. Packets are
+// decoded from a bytes.Reader, which knows how much is left.
+func checkAvailable(r io.Reader, n int) error {
+	if l, ok := r.(interface{ Len() int }); ok && n > l.Len() {
+		return fmt.Errorf("%w: field of %d bytes exceeds the packet", ErrMalformedPacket, n)
+	}
+	return nil
+}
+
+// readString reads the n bytes of a UTF-8 encoded string whose length was
+// already read, allocating only the string itself
+func readString(r io.Reader, n int) (string, error) {
+	b := getScratch(n)
+	defer putScratch(b)
+	if _, err := io.ReadFull(r, *b); err != nil {
+		return "", err
+	}
+	if err := checkUTF8(*b); err != nil {
+		return "", err
+	}
+	return string(*b), nil
+}
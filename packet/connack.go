@@ -18,9 +18,72 @@
 package packet
 
 import (
+	"fmt"
 	"io"
 )
 
+// CONNACK return codes of MQTT 3.1.1. MQTT 5 uses the reason codes
+// instead.
+const (
+	ConnAckAccepted                    byte = 0x00
+	ConnAckUnacceptableProtocolVersion byte = 0x01
+	ConnAckIdentifierRejected          byte = 0x02
+	ConnAckServerUnavailable           byte = 0x03
+	ConnAckBadUserNameOrPassword       byte = 0x04
+	ConnAckNotAuthorized               byte = 0x05
+)
+
+// ConnAckReasonCode translates an MQTT 3.1.1 CONNACK return code into the
+// MQTT 5 reason code with the same meaning
+func ConnAckReasonCode(returnCode byte) byte {
+	switch returnCode {
+	case ConnAckAccepted:
+		return ReasonCodeSuccess
+	case ConnAckUnacceptableProtocolVersion:
+		return ReasonCodeUnsupportedProtocolVersion
+	case ConnAckIdentifierRejected:
+		return ReasonCodeClientIdentifierNotValid
+	case ConnAckServerUnavailable:
+		return ReasonCodeServerUnavailable
+	case ConnAckBadUserNameOrPassword:
+		return ReasonCodeBadUserNameOrPassword
+	case ConnAckNotAuthorized:
+		return ReasonCodeNotAuthorized
+	}
+	return ReasonCodeUnspecifiedError
+}
+
+// ConnAckReturnCode translates an MQTT 5 CONNACK reason code into the
+// closest MQTT 3.1.1 return code
+func ConnAckReturnCode(reasonCode byte) byte {
+	switch reasonCode {
+	case ReasonCodeSuccess:
+		return ConnAckAccepted
+	case ReasonCodeUnsupportedProtocolVersion:
+		return ConnAckUnacceptableProtocolVersion
+	case ReasonCodeClientIdentifierNotValid:
+		return ConnAckIdentifierRejected
+	case ReasonCodeBadUserNameOrPassword, ReasonCodeBadAuthenticationMethod:
+		return ConnAckBadUserNameOrPassword
+	case ReasonCodeNotAuthorized, ReasonCodeBanned:
+		return ConnAckNotAuthorized
+	}
+	return ConnAckServerUnavailable
+}
+
+// ConnectError is returned when reading a CONNECT that the server has to
+// refuse with a CONNACK return code before closing the connection, as
+// opposed to a malformed packet that ends the connection right away
+type ConnectError struct {
+	// ReturnCode is the MQTT 3.1.1 CONNACK return code
+	ReturnCode byte
+	Err        error
+}
+
+func (e *ConnectError) Error() string {
+	return e.Err.Error()
+}
+
 type ConnAckControlPacket struct {
 	FixedHeader    FixedHeader
 	VariableHeader ConnAckVariableHeader
@@ -28,31 +91,113 @@ type ConnAckControlPacket struct {
 
 type ConnAckVariableHeader struct {
 	SessionPresent bool
-	ReturnCode     byte
+	// ReturnCode holds the reason code on MQTT 5
+	ReturnCode byte
+	// MQTT 5 only, the packet is encoded as MQTT 3.1.1 if Properties is nil
+	Properties *Properties
 }
 
-func (p *ConnAckControlPacket) WriteTo(w io.Writer) (n int64, err error) {
-	p.FixedHeader.RemainingLength = 2
-	var nWritten int64
-	nWritten, err = p.FixedHeader.WriteTo(w)
-	n += nWritten
+func readConnAck(r io.Reader, fh FixedHeader, version ProtocolVersion) (*ConnAckControlPacket, error) {
+	if fh.RemainingLength != 2 && (version != ProtocolVersion5 || fh.RemainingLength < 3) {
+		return nil, fmt.Errorf("%w for CONNACK", ErrInvalidRemainingLength)
+	}
+	flags, err := readByte(r)
+	if err != nil {
+		return nil, err
+	}
+	returnCode, err := readByte(r)
 	if err != nil {
-		return n, err
+		return nil, err
+	}
+	if flags&254 > 0 {
+		return nil, fmt.Errorf("%w: reserved bits of CONNACK acknowledge flags are set", ErrMalformedPacket)
+	}
+
+	vh := ConnAckVariableHeader{
+		SessionPresent: flags&1 > 0,
+		ReturnCode:     returnCode,
+	}
+
+	if version == ProtocolVersion5 {
+		props, n, err := readProperties(r, CONNACK)
+		if err != nil {
+			return nil, err
+		}
+		if 2+n != fh.RemainingLength {
+			return nil, fmt.Errorf("%w for CONNACK", ErrInvalidRemainingLength)
+		}
+		vh.Properties = props
 	}
-	nWritten, err = p.VariableHeader.WriteTo(w)
-	n += nWritten
-	return n, err
+
+	return &ConnAckControlPacket{
+		FixedHeader:    fh,
+		VariableHeader: vh,
+	}, nil
 }
 
-func (c *ConnAckVariableHeader) WriteTo(w io.Writer) (n int64, err error) {
-	buf := make([]byte, 2)
+// NewConnAck returns a CONNACK with the given return code, encoded as
+// MQTT 3.1.1
+func NewConnAck(returnCode byte, sessionPresent bool) *ConnAckControlPacket {
+	return &ConnAckControlPacket{
+		FixedHeader: FixedHeader{ControlPacketType: CONNACK, RemainingLength: 2},
+		VariableHeader: ConnAckVariableHeader{
+			SessionPresent: sessionPresent,
+			ReturnCode:     returnCode,
+		},
+	}
+}
+
+func (p *ConnAckControlPacket) Encode() ([]byte, error) {
+	p.FixedHeader.ControlPacketType = CONNACK
+	p.FixedHeader.Flags = 0
+	body := p.VariableHeader.encode()
+	if p.VariableHeader.Properties != nil {
+		var err error
+		body, err = p.VariableHeader.Properties.encode(body, CONNACK)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p.FixedHeader.encode(body)
+}
+
+func (p *ConnAckControlPacket) WriteTo(w io.Writer) (n int64, err error) {
+	return writeEncoded(w, p)
+}
 
+func (c *ConnAckVariableHeader) encode() []byte {
+	buf := make([]byte, 2)
+	if c.SessionPresent {
+		buf[0] = 1
+	}
 	buf[1] = c.ReturnCode
+	return buf
+}
 
-	bytesWritten, err := w.Write(buf)
+func (c *ConnAckVariableHeader) WriteTo(w io.Writer) (n int64, err error) {
+	bytesWritten, err := w.Write(c.encode())
 	n += int64(bytesWritten)
 	if err != nil {
 		return
 	}
 	return
 }
+
+// Properties returns the MQTT 5 properties of p, nil for MQTT 3.1.1
+func (p *ConnAckControlPacket) Properties() *Properties {
+	return p.VariableHeader.Properties
+}
+
+// WithProperties returns a copy of p with props, see Versioned. The
+// return code is translated between the CONNACK return codes of MQTT
+// 3.1.1 and the reason codes of MQTT 5.
+func (p *ConnAckControlPacket) WithProperties(props *Properties) ControlPacket {
+	cp := *p
+	cp.VariableHeader.Properties = props
+	if props != nil {
+		cp.VariableHeader.ReturnCode = ConnAckReasonCode(p.VariableHeader.ReturnCode)
+	} else {
+		cp.VariableHeader.ReturnCode = ConnAckReturnCode(p.VariableHeader.ReturnCode)
+	}
+	return &cp
+}
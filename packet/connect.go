@@ -1,6 +1,6 @@
 //--------------------------------------------------------------------------
 // Copyright 2018 infinimesh, INC
-// www.infinimesh.io 
+// www.infinimesh.io
 //
 //   Licensed under the Apache License, Version 2.0 (the "License");
 //   you may not use this file except in compliance with the License.
@@ -18,8 +18,7 @@
 package packet
 
 import (
-	"encoding/binary"
-	"errors"
+	"bytes"
 	"fmt"
 	"io"
 )
@@ -28,7 +27,7 @@ type ConnectFlags struct {
 	UserName     bool
 	Password     bool
 	WillRetain   bool
-	WillQoS      byte // 2 bytes actually
+	WillQoS      byte // 2 bits actually
 	WillFlag     bool
 	CleanSession bool
 }
@@ -44,10 +43,125 @@ type ConnectVariableHeader struct {
 	ProtocolLevel byte
 	ConnectFlags  ConnectFlags
 	KeepAlive     int
+	Properties    *Properties // only present for ProtocolLevel 5
 }
 
 type ConnectPayload struct {
 	ClientID string
+	// Will fields are only present if ConnectFlags.WillFlag is set
+	WillProperties *Properties // MQTT 5 only
+	WillTopic      string
+	WillMessage    []byte
+	// Present if ConnectFlags.UserName and ConnectFlags.Password are set
+	UserName string
+	Password []byte
+}
+
+// ParseConnectFlags decodes the connect flags byte of CONNECT. It rejects
+// the reserved bit [MQTT-3.1.2-3], Will QoS 3 [MQTT-3.1.2-14] and will
+// settings without will flag [MQTT-3.1.2-13] [MQTT-3.1.2-15].
+func ParseConnectFlags(b byte) (ConnectFlags, error) {
+	f := ConnectFlags{
+		UserName:     b&128 > 0,
+		Password:     b&64 > 0,
+		WillRetain:   b&32 > 0,
+		WillQoS:      b >> 3 & 3,
+		WillFlag:     b&4 > 0,
+		CleanSession: b&2 > 0,
+	}
+
+	if b&1 > 0 {
+		return f, fmt.Errorf("%w: reserved flag is set", ErrInvalidConnectFlags)
+	}
+	if f.WillQoS > 2 {
+		return f, fmt.Errorf("%w: will QoS 3", ErrInvalidConnectFlags)
+	}
+	if !f.WillFlag && (f.WillQoS != 0 || f.WillRetain) {
+		return f, fmt.Errorf("%w: will QoS or will retain set without will flag", ErrInvalidConnectFlags)
+	}
+	return f, nil
+}
+
+func (f ConnectFlags) encode() (b byte) {
+	if f.UserName {
+		b |= 128
+	}
+	if f.Password {
+		b |= 64
+	}
+	if f.WillRetain {
+		b |= 32
+	}
+	b |= (f.WillQoS & 3) << 3
+	if f.WillFlag {
+		b |= 4
+	}
+	if f.CleanSession {
+		b |= 2
+	}
+	return b
+}
+
+func (p *ConnectControlPacket) Encode() ([]byte, error) {
+	vh := p.VariableHeader
+	if vh.KeepAlive < 0 || vh.KeepAlive > 65535 {
+		return nil, fmt.Errorf("Invalid keepalive: %v", vh.KeepAlive)
+	}
+
+	body, err := appendString(nil, vh.ProtocolName)
+	if err != nil {
+		return nil, err
+	}
+	body = append(body, vh.ProtocolLevel, vh.ConnectFlags.encode())
+	body = appendUint16(body, uint16(vh.KeepAlive))
+
+	if p.Version() == ProtocolVersion5 {
+		body, err = appendProperties(body, vh.Properties, CONNECT)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	body, err = appendString(body, p.ConnectPayload.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	if vh.ConnectFlags.WillFlag {
+		if p.Version() == ProtocolVersion5 {
+			body, err = appendProperties(body, p.ConnectPayload.WillProperties, willProperties)
+			if err != nil {
+				return nil, err
+			}
+		}
+		body, err = appendString(body, p.ConnectPayload.WillTopic)
+		if err != nil {
+			return nil, err
+		}
+		body, err = appendBinary(body, p.ConnectPayload.WillMessage)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if vh.ConnectFlags.UserName {
+		body, err = appendString(body, p.ConnectPayload.UserName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if vh.ConnectFlags.Password {
+		body, err = appendBinary(body, p.ConnectPayload.Password)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.FixedHeader.ControlPacketType = CONNECT
+	p.FixedHeader.Flags = 0
+	return p.FixedHeader.encode(body)
+}
+
+func (p *ConnectControlPacket) WriteTo(w io.Writer) (n int64, err error) {
+	return writeEncoded(w, p)
 }
 
 func getConnectVariableHeader(r io.Reader) (hdr ConnectVariableHeader, len int, err error) {
@@ -60,77 +174,145 @@ func getConnectVariableHeader(r io.Reader) (hdr ConnectVariableHeader, len int,
 	hdr.ProtocolName = protocolName
 
 	if hdr.ProtocolName != "MQTT" && hdr.ProtocolName != "MQIsdp" {
-		return hdr, 0, fmt.Errorf("Invalid protocol: %v", hdr.ProtocolName)
+		return hdr, 0, fmt.Errorf("%w: %v", ErrInvalidProtocolName, hdr.ProtocolName)
 	}
 
 	// Get Proto level
-	protocolLevelBytes := make([]byte, 1)
-	n, err = r.Read(protocolLevelBytes)
-	len += n
+	hdr.ProtocolLevel, err = readByte(r)
 	if err != nil {
 		return
 	}
-	hdr.ProtocolLevel = protocolLevelBytes[0]
+	len++
+	if !supportedProtocol(hdr.ProtocolName, ProtocolVersion(hdr.ProtocolLevel)) {
+		return hdr, len, &ConnectError{
+			ReturnCode: ConnAckUnacceptableProtocolVersion,
+			Err:        fmt.Errorf("Unsupported protocol level %v for %v", hdr.ProtocolLevel, hdr.ProtocolName),
+		}
+	}
 
 	// Get Flags
-	connectFlagsByte := make([]byte, 1)
-	n, err = r.Read(connectFlagsByte)
-	if n != 1 {
-		return hdr, len, errors.New("Failed to read flags byte")
+	connectFlagsByte, err := readByte(r)
+	if err != nil {
+		return hdr, len, fmt.Errorf("%w: failed to read flags byte", ErrMalformedPacket)
 	}
-	len += n
+	len++
+
+	hdr.ConnectFlags, err = ParseConnectFlags(connectFlagsByte)
 	if err != nil {
 		return
 	}
+	if hdr.ConnectFlags.Password && !hdr.ConnectFlags.UserName && ProtocolVersion(hdr.ProtocolLevel) != ProtocolVersion5 {
+		// [MQTT-3.1.2-22], MQTT 5 allows a password without user name
+		return hdr, len, fmt.Errorf("%w: password flag set without user name flag", ErrInvalidConnectFlags)
+	}
 
-	hdr.ConnectFlags.UserName = connectFlagsByte[0]&128 == 1
-	hdr.ConnectFlags.Password = connectFlagsByte[0]&64 == 1
-	hdr.ConnectFlags.WillRetain = connectFlagsByte[0]&32 == 1
-	hdr.ConnectFlags.WillFlag = connectFlagsByte[0]&4 == 1
-	hdr.ConnectFlags.CleanSession = connectFlagsByte[0]&2 == 1
-
-	keepAliveByte := make([]byte, 2)
-	n, err = r.Read(keepAliveByte)
-	len += n
+	keepAlive, err := readUint16(r)
 	if err != nil {
-		return hdr, len, errors.New("Could not read keepalive byte")
-	}
-	if n != 2 {
-		return hdr, len, errors.New("Could not read enough keepalive bytes")
+		return hdr, len, fmt.Errorf("%w: could not read keepalive bytes", ErrMalformedPacket)
 	}
+	len += 2
+
+	hdr.KeepAlive = keepAlive
 
-	hdr.KeepAlive = int(binary.BigEndian.Uint16(keepAliveByte))
-	// TODO Will QoS
+	if ProtocolVersion(hdr.ProtocolLevel) == ProtocolVersion5 {
+		hdr.Properties, n, err = readProperties(r, CONNECT)
+		len += n
+		if err != nil {
+			return
+		}
+	}
 
 	return
 }
 
-func readConnectPayload(r io.Reader, len int) (ConnectPayload, error) {
-	payloadBytes := make([]byte, len)
-	n, err := io.ReadFull(r, payloadBytes)
-	// TODO set upper limit for payload
-	// TODO only stream it
-	if err != nil {
-		return ConnectPayload{}, err
-	}
-	if n != len {
-		return ConnectPayload{}, errors.New("Payload length incorrect")
+func supportedProtocol(name string, version ProtocolVersion) bool {
+	if name == "MQIsdp" {
+		return version == ProtocolVersion31
 	}
+	return version == ProtocolVersion311 || version == ProtocolVersion5
+}
 
-	// CONNECT MUST have the client id
-	// REGEX 0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ
-	// MAY allow more than that, but this must be possible
+// Version returns the protocol version the client asked for
+func (p *ConnectControlPacket) Version() ProtocolVersion {
+	return ProtocolVersion(p.VariableHeader.ProtocolLevel)
+}
 
-	// Client Identifier, Will Topic, Will Message, User Name, Password
+var errShortConnectPayload = fmt.Errorf("%w: CONNECT payload is shorter than its fields", ErrMalformedPacket)
 
-	// TODO am besten so viel einlesen wie moeglich, und dann reslicen / reader zusammenstecken
+// ErrInvalidClientID is returned by ValidateClientID
+var ErrInvalidClientID = &Error{ReasonCodeClientIdentifierNotValid, "Invalid client identifier"}
 
-	clientIDLengthBytes := payloadBytes[:2]
-	clientIDLength := binary.BigEndian.Uint16(clientIDLengthBytes)
+// ValidateClientID checks that id consists of 1 to 23 of the characters
+// 0-9, a-z and A-Z, the identifiers every server must accept
+// [MQTT-3.1.3-5]. Servers may accept other identifiers as well.
+func ValidateClientID(id string) error {
+	if len(id) == 0 || len(id) > 23 {
+		return fmt.Errorf("%w: %q must be 1 to 23 characters long", ErrInvalidClientID, id)
+	}
+	for _, c := range id {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			return fmt.Errorf("%w: %q contains %q", ErrInvalidClientID, id, c)
+		}
+	}
+	return nil
+}
 
-	clientID := string(payloadBytes[2 : 2+clientIDLength])
-	return ConnectPayload{
-		ClientID: clientID,
-	}, nil
+// connectPayloadError reports a field running past the end of the
+// payload as such, and other errors unchanged
+func connectPayloadError(err error) error {
+	if err == errShortProperty {
+		return errShortConnectPayload
+	}
+	return err
+}
 
+func readConnectPayload(r io.Reader, len int, vh ConnectVariableHeader) (ConnectPayload, error) {
+	scratch := getScratch(len)
+	defer putScratch(scratch)
+	payloadBytes := *scratch
+	_, err := io.ReadFull(r, payloadBytes)
+	if err != nil {
+		return ConnectPayload{}, err
+	}
+
+	// Client Identifier, Will Properties, Will Topic, Will Message, User
+	// Name, Password
+	var cp ConnectPayload
+	var rest []byte
+	cp.ClientID, rest, err = takeString(payloadBytes)
+	if err != nil {
+		return cp, connectPayloadError(err)
+	}
+
+	if vh.ConnectFlags.WillFlag {
+		if ProtocolVersion(vh.ProtocolLevel) == ProtocolVersion5 {
+			var n int
+			cp.WillProperties, n, err = readProperties(bytes.NewReader(rest), willProperties)
+			if err != nil {
+				return cp, err
+			}
+			rest = rest[n:]
+		}
+		cp.WillTopic, rest, err = takeString(rest)
+		if err != nil {
+			return cp, connectPayloadError(err)
+		}
+		cp.WillMessage, rest, err = takeBinary(rest)
+		if err != nil {
+			return cp, errShortConnectPayload
+		}
+	}
+	if vh.ConnectFlags.UserName {
+		cp.UserName, rest, err = takeString(rest)
+		if err != nil {
+			return cp, connectPayloadError(err)
+		}
+	}
+	if vh.ConnectFlags.Password {
+		cp.Password, _, err = takeBinary(rest)
+		if err != nil {
+			return cp, errShortConnectPayload
+		}
+	}
+	return cp, nil
 }
@@ -0,0 +1,49 @@
+package packet
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConnectFlags(t *testing.T) {
+	var testCases = []struct {
+		input    byte
+		expected ConnectFlags
+		valid    bool
+	}{
+		{0x00, ConnectFlags{}, true},
+		{0x02, ConnectFlags{CleanSession: true}, true},
+		{0xC2, ConnectFlags{UserName: true, Password: true, CleanSession: true}, true},
+		{0x2C, ConnectFlags{WillRetain: true, WillQoS: 1, WillFlag: true}, true},
+		{0x14, ConnectFlags{WillQoS: 2, WillFlag: true}, true},
+		{0x01, ConnectFlags{}, false},                                // reserved bit
+		{0x1C, ConnectFlags{WillQoS: 3, WillFlag: true}, false},      // QoS 3
+		{0x08, ConnectFlags{WillQoS: 1}, false},                      // QoS without will
+		{0x20, ConnectFlags{WillRetain: true}, false},                // retain without will
+		{0xFE, ConnectFlags{true, true, true, 3, true, true}, false}, // QoS 3
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			flags, err := ParseConnectFlags(tc.input)
+			assert.Equal(t, tc.expected, flags)
+			if tc.valid {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.input, flags.encode(), "round trip")
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateClientID(t *testing.T) {
+	assert.NoError(t, ValidateClientID("a"))
+	assert.NoError(t, ValidateClientID("0123456789abcdefABCDEFG"))
+	for _, id := range []string{"", "0123456789abcdefABCDEFGH", "client-1", "héllo"} {
+		assert.True(t, errors.Is(ValidateClientID(id), ErrInvalidClientID), id)
+	}
+}
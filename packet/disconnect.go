@@ -0,0 +1,112 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"fmt"
+	"io"
+)
+
+type DisconnectControlPacket struct {
+	FixedHeader    FixedHeader
+	VariableHeader DisconnectVariableHeader // MQTT 5 only
+}
+
+type DisconnectVariableHeader struct {
+	ReasonCode byte
+	// The packet is encoded as MQTT 3.1.1 if Properties is nil
+	Properties *Properties
+}
+
+func readDisconnect(r io.Reader, fh FixedHeader, version ProtocolVersion) (*DisconnectControlPacket, error) {
+	p := &DisconnectControlPacket{FixedHeader: fh}
+	if version != ProtocolVersion5 {
+		if fh.RemainingLength != 0 {
+			return nil, fmt.Errorf("%w for DISCONNECT", ErrInvalidRemainingLength)
+		}
+		return p, nil
+	}
+
+	p.VariableHeader.Properties = &Properties{}
+	if fh.RemainingLength == 0 {
+		return p, nil
+	}
+
+	reason, err := readByte(r)
+	if err != nil {
+		return nil, err
+	}
+	p.VariableHeader.ReasonCode = reason
+	if fh.RemainingLength == 1 {
+		return p, nil
+	}
+
+	props, n, err := readProperties(r, DISCONNECT)
+	if err != nil {
+		return nil, err
+	}
+	if 1+n != fh.RemainingLength {
+		return nil, fmt.Errorf("%w for DISCONNECT", ErrInvalidRemainingLength)
+	}
+	p.VariableHeader.Properties = props
+	return p, nil
+}
+
+func (p *DisconnectControlPacket) Encode() ([]byte, error) {
+	var body []byte
+	if props := p.VariableHeader.Properties; props != nil {
+		encodedProps, err := props.encode(nil, DISCONNECT)
+		if err != nil {
+			return nil, err
+		}
+		if p.VariableHeader.ReasonCode != ReasonCodeNormalDisconnection || len(encodedProps) > 1 {
+			body = append(body, p.VariableHeader.ReasonCode)
+		}
+		if len(encodedProps) > 1 {
+			body = append(body, encodedProps...)
+		}
+	}
+
+	p.FixedHeader.ControlPacketType = DISCONNECT
+	p.FixedHeader.Flags = 0
+	return p.FixedHeader.encode(body)
+}
+
+func (p *DisconnectControlPacket) WriteTo(w io.Writer) (n int64, err error) {
+	return writeEncoded(w, p)
+}
+
+func NewDisconnectControlPacket() *DisconnectControlPacket {
+	return &DisconnectControlPacket{
+		FixedHeader: FixedHeader{
+			ControlPacketType: DISCONNECT,
+		},
+	}
+}
+
+// Properties returns the MQTT 5 properties of p, nil for MQTT 3.1.1
+func (p *DisconnectControlPacket) Properties() *Properties {
+	return p.VariableHeader.Properties
+}
+
+// WithProperties returns a copy of p with props, see Versioned
+func (p *DisconnectControlPacket) WithProperties(props *Properties) ControlPacket {
+	cp := *p
+	cp.VariableHeader.Properties = props
+	return &cp
+}
@@ -0,0 +1,72 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"errors"
+)
+
+// Error is a protocol violation found while decoding a packet. Errors
+// returned by the decoder wrap one of the Err values below, test for them
+// with errors.Is.
+type Error struct {
+	// ReasonCode is the MQTT 5 reason code the violation is reported
+	// with, in CONNACK if the CONNECT packet was at fault and in
+	// DISCONNECT otherwise
+	ReasonCode byte
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Protocol violations
+var (
+	ErrMalformedPacket              = &Error{ReasonCodeMalformedPacket, "Malformed packet"}
+	ErrMalformedRemainingLength     = &Error{ReasonCodeMalformedPacket, "Malformed remaining length"}
+	ErrMalformedVariableByteInteger = &Error{ReasonCodeMalformedPacket, "Malformed variable byte integer"}
+	ErrInvalidRemainingLength       = &Error{ReasonCodeMalformedPacket, "Invalid remaining length"}
+	ErrUnknownPacketType            = &Error{ReasonCodeMalformedPacket, "Unknown control packet type"}
+	ErrInvalidFixedHeaderFlags      = &Error{ReasonCodeMalformedPacket, "Invalid fixed header flags"}
+	ErrInvalidProtocolName          = &Error{ReasonCodeUnsupportedProtocolVersion, "Invalid protocol name"}
+	ErrInvalidConnectFlags          = &Error{ReasonCodeMalformedPacket, "Invalid connect flags"}
+	ErrInvalidQoS                   = &Error{ReasonCodeMalformedPacket, "Invalid QoS level"}
+	ErrInvalidSubscriptionOptions   = &Error{ReasonCodeMalformedPacket, "Invalid subscription options"}
+	ErrInvalidReasonCode            = &Error{ReasonCodeMalformedPacket, "Invalid reason code"}
+	ErrInvalidTopicName             = &Error{ReasonCodeTopicNameInvalid, "Invalid topic name"}
+	ErrInvalidTopicFilter           = &Error{ReasonCodeTopicFilterInvalid, "Invalid topic filter"}
+	ErrInvalidProperty              = &Error{ReasonCodeProtocolError, "Invalid property"}
+	ErrProtocolViolation            = &Error{ReasonCodeProtocolError, "Protocol error"}
+	ErrPayloadTooLarge              = &Error{ReasonCodePacketTooLarge, "Packet too large"}
+)
+
+// ReasonCodeOf returns the MQTT 5 reason code to report err with.
+// Errors that are no protocol violation, e.g. I/O errors, map to
+// ReasonCodeUnspecifiedError.
+func ReasonCodeOf(err error) byte {
+	var pe *Error
+	if errors.As(err, &pe) {
+		return pe.ReasonCode
+	}
+	var ce *ConnectError
+	if errors.As(err, &ce) {
+		return ConnAckReasonCode(ce.ReturnCode)
+	}
+	return ReasonCodeUnspecifiedError
+}
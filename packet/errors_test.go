@@ -0,0 +1,49 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProtocolErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		data       []byte
+		err        error
+		reasonCode byte
+	}{
+		{"RemainingLength", []byte{PINGREQ << 4, 0xff, 0xff, 0xff, 0xff}, ErrMalformedRemainingLength, ReasonCodeMalformedPacket},
+		{"PingReqLength", []byte{PINGREQ << 4, 1, 0}, ErrInvalidRemainingLength, ReasonCodeMalformedPacket},
+		{"PacketType", []byte{0, 0}, ErrUnknownPacketType, ReasonCodeMalformedPacket},
+		{"ProtocolName", []byte{CONNECT << 4, 10, 0, 4, 'M', 'Q', 'T', 'X', 4, 2, 0, 60}, ErrInvalidProtocolName, ReasonCodeUnsupportedProtocolVersion},
+		{"ConnectFlags", []byte{CONNECT << 4, 10, 0, 4, 'M', 'Q', 'T', 'T', 4, 3, 0, 60}, ErrInvalidConnectFlags, ReasonCodeMalformedPacket},
+		{"PublishQoS", []byte{PUBLISH<<4 | 6, 5, 0, 1, 'a', 0, 1}, ErrInvalidQoS, ReasonCodeMalformedPacket},
+		{"PublishPacketID", []byte{PUBLISH<<4 | 2, 5, 0, 1, 'a', 0, 0}, ErrMalformedPacket, ReasonCodeMalformedPacket},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ReadPacket(bytes.NewReader(tc.data))
+			assert.True(t, errors.Is(err, tc.err), "got %v", err)
+			assert.Equal(t, tc.reasonCode, ReasonCodeOf(err))
+		})
+	}
+
+	// Reason codes that do not belong to the packet type
+	for _, data := range [][]byte{
+		{SUBACK << 4, 4, 0, 1, 0, ReasonCodeNoSubscriptionExisted},
+		{UNSUBACK << 4, 4, 0, 1, 0, ReturncodeSuccessQoS2},
+		{UNSUBACK << 4, 5, 0, 1, 0, ReasonCodeSuccess, ReasonCodeQuotaExceeded},
+	} {
+		_, err := ReadPacketVersion(bytes.NewReader(data), ProtocolVersion5)
+		assert.True(t, errors.Is(err, ErrInvalidReasonCode), "%v: %v", data, err)
+	}
+	_, err := ReadPacketVersion(bytes.NewReader([]byte{UNSUBACK << 4, 4, 0, 1, 0, ReasonCodeNoSubscriptionExisted}), ProtocolVersion5)
+	assert.NoError(t, err)
+
+	_, err = ReadPacket(bytes.NewReader([]byte{CONNECT << 4, 10, 0, 4, 'M', 'Q', 'T', 'T', 9, 2, 0, 60}))
+	assert.Equal(t, ReasonCodeUnsupportedProtocolVersion, ReasonCodeOf(err))
+	assert.Equal(t, ReasonCodeUnspecifiedError, ReasonCodeOf(io.ErrUnexpectedEOF))
+}
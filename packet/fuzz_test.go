@@ -0,0 +1,142 @@
+package packet
+
+import (
+	"bytes"
+	"testing"
+)
+
+// fuzzSeeds are valid packets of every type, the fuzzer mutates them
+// into malformed ones. testdata/fuzz holds malformed packets that broke
+// the decoder before.
+func fuzzSeeds(f *testing.F) {
+	props := &Properties{UserProperties: []UserProperty{{Key: "k", Value: "v"}}}
+	for _, p := range []ControlPacket{
+		&ConnectControlPacket{
+			VariableHeader: ConnectVariableHeader{
+				ProtocolName:  "MQTT",
+				ProtocolLevel: byte(ProtocolVersion311),
+				ConnectFlags:  ConnectFlags{UserName: true, Password: true, WillFlag: true, WillQoS: 1},
+				KeepAlive:     60,
+			},
+			ConnectPayload: ConnectPayload{ClientID: "c1", WillTopic: "w", WillMessage: []byte("bye"), UserName: "u", Password: []byte("p")},
+		},
+		&ConnectControlPacket{
+			VariableHeader: ConnectVariableHeader{
+				ProtocolName:  "MQTT",
+				ProtocolLevel: byte(ProtocolVersion5),
+				ConnectFlags:  ConnectFlags{WillFlag: true, CleanSession: true},
+				Properties:    &Properties{SessionExpiryInterval: Uint32(10)},
+			},
+			ConnectPayload: ConnectPayload{ClientID: "c1", WillProperties: &Properties{}, WillTopic: "w"},
+		},
+		NewConnAck(ConnAckAccepted, true),
+		NewPublish("a/b", 1, []byte("payload")),
+		&PublishControlPacket{
+			FixedHeaderFlags: PublishHeaderFlags{QoS: QoSLevelExactlyOnce},
+			VariableHeader:   PublishVariableHeader{Topic: "a", PacketID: 2, Properties: props},
+		},
+		NewPubAckControlPacket(1),
+		NewPubRecControlPacket(2),
+		NewPubRelControlPacket(3),
+		NewPubCompControlPacket(4),
+		&SubscribeControlPacket{
+			VariableHeader: SubscribeVariableHeader{PacketID: 5},
+			Payload:        SubscribePayload{Subscriptions: []Subscription{{Topic: "a/+", QoS: QoSLevelAtLeastOnce}, {Topic: "#"}}},
+		},
+		NewSubAck(5, []byte{ReturncodeSuccessQoS0, ReturncodeFailure}),
+		NewUnsubscribe(6, []string{"a/+"}),
+		NewUnsubAck(7),
+		NewPingReqControlPacket(),
+		NewPingRespControlPacket(),
+		NewDisconnectControlPacket(),
+	} {
+		b, err := p.Encode()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+}
+
+func FuzzReadPacket(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, version := range []ProtocolVersion{ProtocolVersion311, ProtocolVersion5} {
+			p, err := ReadPacketVersion(bytes.NewReader(data), version)
+			if err != nil {
+				continue
+			}
+			// Whatever was decoded can be encoded again
+			if _, err := p.Encode(); err != nil {
+				t.Errorf("%T decoded from %x does not encode: %v", p, data, err)
+			}
+		}
+	})
+}
+
+func FuzzRemainingLength(f *testing.F) {
+	for _, b := range [][]byte{{0}, {127}, {128, 1}, {255, 255, 255, 127}, {255, 255, 255, 255, 1}, {128}} {
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		n, err := getRemainingLength(r)
+		if err != nil {
+			return
+		}
+		if n < 0 || n > MaxRemainingLength {
+			t.Fatalf("remaining length %d out of range", n)
+		}
+		if consumed := len(data) - r.Len(); consumed > 4 {
+			t.Fatalf("read %d bytes", consumed)
+		}
+		if m, err := getRemainingLength(bytes.NewReader(EncodeRemainingLength(n))); err != nil || m != n {
+			t.Fatalf("%d encodes to %d, %v", n, m, err)
+		}
+	})
+}
+
+// FuzzConnect mutates the rest of a CONNECT packet after its fixed
+// header, where most of the fields of the decoder are
+func FuzzConnect(f *testing.F) {
+	for _, level := range []ProtocolVersion{ProtocolVersion31, ProtocolVersion311, ProtocolVersion5} {
+		name := "MQTT"
+		if level == ProtocolVersion31 {
+			name = "MQIsdp"
+		}
+		connect := &ConnectControlPacket{
+			VariableHeader: ConnectVariableHeader{
+				ProtocolName:  name,
+				ProtocolLevel: byte(level),
+				ConnectFlags:  ConnectFlags{UserName: true, Password: true, WillFlag: true},
+			},
+			ConnectPayload: ConnectPayload{ClientID: "c1", WillTopic: "w", WillMessage: []byte("m"), UserName: "u", Password: []byte("p")},
+		}
+		if level == ProtocolVersion5 {
+			connect.VariableHeader.Properties = &Properties{}
+			connect.ConnectPayload.WillProperties = &Properties{}
+		}
+		b, err := connect.Encode()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b[2:])
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		if len(body) > MaxRemainingLength {
+			return
+		}
+		data := append([]byte{CONNECT << 4}, EncodeRemainingLength(len(body))...)
+		p, err := ReadPacket(bytes.NewReader(append(data, body...)))
+		if err != nil {
+			return
+		}
+		connect, ok := p.(*ConnectControlPacket)
+		if !ok {
+			t.Fatalf("decoded %T", p)
+		}
+		if _, err := connect.Encode(); err != nil {
+			t.Errorf("CONNECT decoded from %x does not encode: %v", body, err)
+		}
+	})
+}
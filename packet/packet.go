@@ -18,9 +18,6 @@
 package packet
 
 import (
-	"bytes"
-	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 )
@@ -52,6 +49,7 @@ const (
 	PINGREQ     = 12
 	PINGRESP    = 13
 	DISCONNECT  = 14
+	AUTH        = 15 // MQTT 5 only
 )
 
 // FixedHeader is contained in every packet (thus, fixed). It consists of the
@@ -62,47 +60,42 @@ type FixedHeader struct {
 	RemainingLength   int
 }
 
+// ControlPacket is implemented by every concrete packet type
 type ControlPacket interface {
+	// Encode serializes the packet, including its fixed header, into its
+	// wire representation. The FixedHeader of the packet is updated to
+	// match what was encoded.
+	Encode() ([]byte, error)
 }
 
+// MaxRemainingLength is the largest value the variable length encoding of
+// the fixed header can represent
+const MaxRemainingLength = 268435455
+
 func getProtocolName(r io.Reader) (protocolName string, len int, err error) {
-	protocolNameLengthBytes := make([]byte, 2)
-	n, err := r.Read(protocolNameLengthBytes)
-	len += n
+	protocolNameLength, err := readUint16(r)
 	if err != nil {
-		return "", len, errors.New("Failed to read length of protocolNameLengthBytes")
-	}
-	if n != 2 {
-
-		return "", len, errors.New("Failed to read length of protocolNameLengthBytes, not enough bytes")
+		return "", len, fmt.Errorf("%w: failed to read length of protocol name", ErrMalformedPacket)
 	}
+	len += 2
 
-	protocolNameLength := binary.BigEndian.Uint16(protocolNameLengthBytes)
-
-	protocolNameBuffer := make([]byte, protocolNameLength)
-	n, err = r.Read(protocolNameBuffer) // use ReadFull, its not guaranteed that we get enough out of a single read
-	len += n
+	protocolName, err = readString(r, protocolNameLength)
 	if err != nil {
 		return "", len, err
 	}
-	if n != int(protocolNameLength) {
-		return "", len, err
-	}
-
-	return string(protocolNameBuffer), len, nil
+	return protocolName, len + protocolNameLength, nil
 }
 
 func getFixedHeader(r io.Reader) (fh FixedHeader, err error) {
-	buf := make([]byte, 1)
-	n, err := io.ReadFull(r, buf)
+	b, err := readByte(r)
 	if err != nil {
 		return FixedHeader{}, err
 	}
-	if n != 1 {
-		return FixedHeader{}, errors.New("Failed to read MQTT Packet Control Type from Client Stream")
+	fh.ControlPacketType = ControlPacketType(b >> 4)
+	fh.Flags = b & 15
+	if err := fh.checkFlags(); err != nil {
+		return FixedHeader{}, err
 	}
-	fh.ControlPacketType = ControlPacketType(buf[0] >> 4)
-	fh.Flags = buf[0] & 15
 	remainingLength, err := getRemainingLength(r) // Length VariableHeader + Payload
 	if err != nil {
 		return FixedHeader{}, err
@@ -111,29 +104,79 @@ func getFixedHeader(r io.Reader) (fh FixedHeader, err error) {
 	return
 }
 
-func ReadPacket(r io.Reader) (ControlPacket, error) {
-	fh, err := getFixedHeader(r)
-	if err != nil {
-		return nil, err
+// checkFlags rejects flags other than the ones reserved for the packet
+// type [MQTT-2.2.2-1] [MQTT-2.2.2-2]. The flags of PUBLISH are checked by
+// interpretPublishHeaderFlags.
+func (fh FixedHeader) checkFlags() error {
+	var reserved byte
+	switch fh.ControlPacketType {
+	case PUBLISH:
+		return nil
+	case PUBREL, SUBSCRIBE, UNSUBSCRIBE:
+		reserved = 2
 	}
+	if fh.Flags != reserved {
+		return fmt.Errorf("%w: %#x for packet type %d", ErrInvalidFixedHeaderFlags, fh.Flags, fh.ControlPacketType)
+	}
+	return nil
+}
 
-	// Ensure that we always read the remaining bytes
-	bufRemaining := make([]byte, fh.RemainingLength)
-	n, err := io.ReadFull(r, bufRemaining)
-	if n != fh.RemainingLength {
-		return nil, errors.New("short read")
+// readByte reads a single byte, without allocating if r is an
+// io.ByteReader like the bufio.Reader used by Reader or the bytes.Reader
+// packets are decoded from
+func readByte(r io.Reader) (byte, error) {
+	if br, ok := r.(io.ByteReader); ok {
+		return br.ReadByte()
 	}
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
+
+// ReadPacket reads a single packet of an MQTT 3.1.1 connection. CONNECT
+// packets are decoded according to the protocol level they announce.
+func ReadPacket(r io.Reader) (ControlPacket, error) {
+	return ReadPacketVersion(r, ProtocolVersion311)
+}
+
+// ReadPacketVersion reads a single packet of a connection that negotiated
+// the given protocol version. Packets read with ProtocolVersion5 always
+// have non-nil Properties.
+func ReadPacketVersion(r io.Reader, version ProtocolVersion) (ControlPacket, error) {
+	fh, err := getFixedHeader(r)
 	if err != nil {
 		return nil, err
 	}
 
-	remainingReader := bytes.NewBuffer(bufRemaining)
+	return readRemaining(r, fh, version)
+}
+
+// readRemaining reads the variable header and payload announced by fh in
+// full before decoding them, so a packet is never parsed from a partial
+// read of the connection
+func readRemaining(r io.Reader, fh FixedHeader, version ProtocolVersion) (ControlPacket, error) {
+	d := decodeBufferPool.Get().(*decodeBuffer)
+	defer decodeBufferPool.Put(d)
+	return d.decode(r, fh, version)
+}
+
+// WritePacket encodes p and writes it to w in a single Write call
+func WritePacket(w io.Writer, p ControlPacket) error {
+	_, err := writeEncoded(w, p)
+	return err
+}
 
-	return parseToConcretePacket(remainingReader, fh)
+func writeEncoded(w io.Writer, p ControlPacket) (n int64, err error) {
+	buf, err := p.Encode()
+	if err != nil {
+		return 0, err
+	}
+	written, err := w.Write(buf)
+	return int64(written), err
 }
 
 // nolint: gocyclo
-func parseToConcretePacket(remainingReader io.Reader, fh FixedHeader) (ControlPacket, error) {
+func parseToConcretePacket(remainingReader io.Reader, fh FixedHeader, version ProtocolVersion) (ControlPacket, error) {
 	switch fh.ControlPacketType {
 	case CONNECT:
 		vh, variableHeaderSize, err := getConnectVariableHeader(remainingReader)
@@ -142,7 +185,7 @@ func parseToConcretePacket(remainingReader io.Reader, fh FixedHeader) (ControlPa
 		}
 		payloadLength := fh.RemainingLength - variableHeaderSize
 
-		cp, err := readConnectPayload(remainingReader, payloadLength)
+		cp, err := readConnectPayload(remainingReader, payloadLength, vh)
 		if err != nil {
 			return nil, err
 		}
@@ -160,7 +203,7 @@ func parseToConcretePacket(remainingReader io.Reader, fh FixedHeader) (ControlPa
 			return nil, err
 		}
 
-		vh, vhLength, err := readPublishVariableHeader(remainingReader, flags)
+		vh, vhLength, err := readPublishVariableHeader(remainingReader, flags, version)
 		if err != nil {
 			return nil, err
 		}
@@ -178,12 +221,12 @@ func parseToConcretePacket(remainingReader io.Reader, fh FixedHeader) (ControlPa
 		}
 		return packet, nil
 	case SUBSCRIBE:
-		vhLen, vh, err := readSubscribeVariableHeader(remainingReader)
+		vhLen, vh, err := readSubscribeVariableHeader(remainingReader, version)
 		if err != nil {
 			return nil, err
 		}
 
-		_, payload, err := readSubscribePayload(remainingReader, fh.RemainingLength-vhLen)
+		_, payload, err := readSubscribePayload(remainingReader, fh.RemainingLength-vhLen, version)
 		if err != nil {
 			return nil, err
 		}
@@ -194,13 +237,38 @@ func parseToConcretePacket(remainingReader io.Reader, fh FixedHeader) (ControlPa
 			Payload:        payload,
 		}
 		return packet, nil
+	case CONNACK:
+		return readConnAck(remainingReader, fh, version)
+	case PUBACK:
+		return readPubAck(remainingReader, fh, version)
+	case PUBREC:
+		return readPubRec(remainingReader, fh, version)
+	case PUBREL:
+		return readPubRel(remainingReader, fh, version)
+	case PUBCOMP:
+		return readPubComp(remainingReader, fh, version)
+	case SUBACK:
+		return readSubAck(remainingReader, fh, version)
+	case UNSUBSCRIBE:
+		return readUnsubscribe(remainingReader, fh, version)
+	case UNSUBACK:
+		return readUnsubAck(remainingReader, fh, version)
 	case PINGREQ:
+		if fh.RemainingLength != 0 {
+			return nil, fmt.Errorf("%w for PINGREQ", ErrInvalidRemainingLength)
+		}
 		return &PingReqControlPacket{FixedHeader: fh}, nil
+	case PINGRESP:
+		if fh.RemainingLength != 0 {
+			return nil, fmt.Errorf("%w for PINGRESP", ErrInvalidRemainingLength)
+		}
+		return &PingRespControlPacket{FixedHeader: fh}, nil
 	case DISCONNECT:
-		fmt.Println("Client disconnected")
-		return nil, errors.New("Client disconnected")
+		return readDisconnect(remainingReader, fh, version)
+	case AUTH:
+		return readAuth(remainingReader, fh, version)
 	default:
-		return nil, fmt.Errorf("Unknown control packet type: %v", fh.ControlPacketType)
+		return nil, fmt.Errorf("%w: %v", ErrUnknownPacketType, fh.ControlPacketType)
 	}
 
 }
@@ -209,31 +277,40 @@ func parseToConcretePacket(remainingReader io.Reader, fh FixedHeader) (ControlPa
 
 // http://docs.oasis-open.org/mqtt/mqtt/v3.1.1/os/mqtt-v3.1.1-os.html#_Toc398718023
 func getRemainingLength(r io.Reader) (remaining int, err error) {
-	// max 4 times / 4 rem. len.
+	// At most four bytes of seven bits each, least significant first
 	multiplier := 1
 	for i := 0; i < 4; i++ {
-		b := make([]byte, 1)
-		n, err := r.Read(b)
-		valueThisTime := int(b[0] & 127)
-		remaining += valueThisTime * multiplier
+		b, err := readByte(r)
 		if err != nil {
-			return remaining, err
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
 		}
-		if n != 1 {
-			return 0, errors.New("Failed to get rem len")
+		remaining += int(b&127) * multiplier
+		if b&128 == 0 {
+			return remaining, nil
 		}
-
 		multiplier *= 128
-		moreBytes := b[0] & 128 // get only most significant bit
-		if moreBytes == 0 {
-			break
-		}
 	}
-	return
+	return 0, ErrMalformedRemainingLength
+}
+
+// EncodeRemainingLength returns the variable length encoding of length
+// used in the fixed header. It returns nil if length is negative or
+// larger than MaxRemainingLength.
+func EncodeRemainingLength(length int) []byte {
+	if length < 0 || length > MaxRemainingLength {
+		return nil
+	}
+	return appendRemainingLength(make([]byte, 0, 4), length)
 }
 
 func serializeRemainingLength(w io.Writer, len int) (n int, err error) {
-	stuffToWrite := make([]byte, 0)
+	return w.Write(appendRemainingLength(make([]byte, 0, 4), len))
+}
+
+func appendRemainingLength(buf []byte, len int) []byte {
 	for {
 		encodedByte := byte(len % 128)
 		len = len / 128
@@ -241,13 +318,18 @@ func serializeRemainingLength(w io.Writer, len int) (n int, err error) {
 		if len > 0 {
 			encodedByte |= 128 //set topmost bit to true because we
 			//still have stuff to write
-			stuffToWrite = append(stuffToWrite, encodedByte)
+			buf = append(buf, encodedByte)
 		} else {
-			stuffToWrite = append(stuffToWrite, encodedByte)
+			buf = append(buf, encodedByte)
 			break
 		}
 	}
-	return w.Write(stuffToWrite)
+	return buf
+}
+
+// size returns the size of the whole packet fh belongs to
+func (fh FixedHeader) size() int {
+	return 1 + len(EncodeRemainingLength(fh.RemainingLength)) + fh.RemainingLength
 }
 
 func (fh *FixedHeader) WriteTo(w io.Writer) (n int64, err error) {
@@ -269,17 +351,111 @@ func (fh *FixedHeader) WriteTo(w io.Writer) (n int64, err error) {
 
 }
 
-// Allocating here everytime is super inefficient, better pass a byte
-// slice
-// TODO return number of bytes read
+// encode prepends the fixed header to the variable header and payload in
+// body. RemainingLength is taken from the length of body.
+func (fh *FixedHeader) encode(body []byte) ([]byte, error) {
+	if len(body) > MaxRemainingLength {
+		return nil, fmt.Errorf("%w to encode: %v bytes", ErrPayloadTooLarge, len(body))
+	}
+	if fh.Flags > 15 {
+		return nil, fmt.Errorf("Invalid fixed header flags: %v", fh.Flags)
+	}
+	fh.RemainingLength = len(body)
+
+	buf := make([]byte, 0, 5+len(body))
+	buf = append(buf, byte(fh.ControlPacketType)<<4|fh.Flags)
+	buf = appendRemainingLength(buf, len(body))
+	return append(buf, body...), nil
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+// appendString appends a length-prefixed UTF-8 string as used in all
+// string fields of MQTT
+func appendString(buf []byte, s string) ([]byte, error) {
+	if len(s) > 65535 {
+		return buf, fmt.Errorf("String too long to encode: %v bytes", len(s))
+	}
+	buf = appendUint16(buf, uint16(len(s)))
+	return append(buf, s...), nil
+}
+
+// readPacketID reads the variable header of packets that consist of
+// nothing but a packet identifier, like UNSUBACK on MQTT 3.1.1
+func readPacketID(r io.Reader, fh FixedHeader) (uint16, error) {
+	if fh.RemainingLength != 2 {
+		return 0, fmt.Errorf("%w %v for packet type %v", ErrInvalidRemainingLength, fh.RemainingLength, fh.ControlPacketType)
+	}
+	packetID, err := readUint16(r)
+	return uint16(packetID), err
+}
+
+// readAck reads the variable header shared by PUBACK, PUBREC, PUBREL and
+// PUBCOMP. On MQTT 5 the reason code and properties may be left out, in
+// which case they default to success and no properties.
+func readAck(r io.Reader, fh FixedHeader, version ProtocolVersion) (packetID uint16, reasonCode byte, props *Properties, err error) {
+	if version != ProtocolVersion5 {
+		packetID, err = readPacketID(r, fh)
+		return
+	}
+
+	if fh.RemainingLength < 2 {
+		return 0, 0, nil, fmt.Errorf("%w %v for packet type %v", ErrInvalidRemainingLength, fh.RemainingLength, fh.ControlPacketType)
+	}
+	id, err := readUint16(r)
+	if err != nil {
+		return
+	}
+	packetID = uint16(id)
+
+	props = &Properties{}
+	if fh.RemainingLength == 2 {
+		return
+	}
+	if reasonCode, err = readByte(r); err != nil {
+		return
+	}
+	if fh.RemainingLength == 3 {
+		return
+	}
+
+	props, n, err := readProperties(r, fh.ControlPacketType)
+	if err == nil && 3+n != fh.RemainingLength {
+		err = fmt.Errorf("%w %v for packet type %v", ErrInvalidRemainingLength, fh.RemainingLength, fh.ControlPacketType)
+	}
+	return
+}
+
+// encodeAck is the counterpart of readAck. props being nil selects the
+// MQTT 3.1.1 encoding, which has no reason code.
+func encodeAck(fh *FixedHeader, packetID uint16, reasonCode byte, props *Properties) ([]byte, error) {
+	body := appendUint16(nil, packetID)
+	if props != nil {
+		var err error
+		var encodedProps []byte
+		if encodedProps, err = props.encode(nil, fh.ControlPacketType); err != nil {
+			return nil, err
+		}
+		if reasonCode != ReasonCodeSuccess || len(encodedProps) > 1 {
+			body = append(body, reasonCode)
+		}
+		if len(encodedProps) > 1 {
+			body = append(body, encodedProps...)
+		}
+	}
+	return fh.encode(body)
+}
+
 func readUint16(r io.Reader) (result int, err error) {
-	buf := make([]byte, 2)
-	n, err := io.ReadFull(r, buf)
+	hi, err := readByte(r)
 	if err != nil {
 		return
 	}
-	if n != 2 {
-		return n, errors.New("Couldnt read required 2 bytes for string length")
+	lo, err := readByte(r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
 	}
-	return int(binary.BigEndian.Uint16(buf)), nil
+	return int(hi)<<8 | int(lo), err
 }
@@ -19,6 +19,9 @@ package packet
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"runtime"
 	"strconv"
 	"testing"
 
@@ -41,6 +44,10 @@ func TestGetRemainingLength(t *testing.T) {
 			input:    []byte{byte(193), byte(2)},
 			expected: 321,
 		},
+		{
+			input:    []byte{0xFF, 0xFF, 0xFF, 0x7F},
+			expected: MaxRemainingLength,
+		},
 	}
 
 	for i, tc := range testCases {
@@ -54,3 +61,105 @@ func TestGetRemainingLength(t *testing.T) {
 	}
 
 }
+
+func TestMalformedRemainingLength(t *testing.T) {
+	_, err := getRemainingLength(bytes.NewBuffer([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0x01}))
+	assert.Equal(t, ErrMalformedRemainingLength, err)
+
+	_, err = getRemainingLength(bytes.NewBuffer([]byte{0xFF, 0xFF}))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestEncodeRemainingLength(t *testing.T) {
+	for _, length := range []int{0, 127, 128, 16383, 16384, 2097151, 2097152, MaxRemainingLength} {
+		encoded := EncodeRemainingLength(length)
+		decoded, err := getRemainingLength(bytes.NewBuffer(encoded))
+		assert.NoError(t, err)
+		assert.Equal(t, length, decoded)
+	}
+	assert.Equal(t, []byte{0x80, 0x01}, EncodeRemainingLength(128))
+	assert.Nil(t, EncodeRemainingLength(MaxRemainingLength+1))
+	assert.Nil(t, EncodeRemainingLength(-1))
+}
+
+func TestReadPacketTypes(t *testing.T) {
+	var testCases = []ControlPacket{
+		&ConnAckControlPacket{VariableHeader: ConnAckVariableHeader{SessionPresent: true, ReturnCode: 0}},
+		NewPubAckControlPacket(1),
+		NewPubRecControlPacket(2),
+		NewPubRelControlPacket(3),
+		NewPubCompControlPacket(4),
+		NewSubAck(5, []byte{ReturncodeSuccessQoS0, ReturncodeFailure}),
+		NewUnsubscribe(6, []string{"a/+", "b/#"}),
+		NewUnsubAck(7),
+		NewPingReqControlPacket(),
+		NewPingRespControlPacket(),
+		NewDisconnectControlPacket(),
+	}
+
+	for i, expected := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var buf bytes.Buffer
+			assert.NoError(t, WritePacket(&buf, expected))
+
+			actual, err := ReadPacket(&buf)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, actual)
+		})
+	}
+}
+
+func TestReadPacketInvalidLength(t *testing.T) {
+	for _, input := range [][]byte{
+		{PUBACK << 4, 3, 0, 1, 0},
+		{PINGREQ << 4, 1, 0},
+		{DISCONNECT << 4, 1, 0},
+		{SUBACK << 4, 2, 0, 1},
+		{SUBSCRIBE<<4 | 2, 2, 0, 1},
+		{UNSUBSCRIBE<<4 | 2, 2, 0, 1},
+	} {
+		_, err := ReadPacket(bytes.NewBuffer(input))
+		assert.Error(t, err, "input %v", input)
+	}
+}
+
+func TestReadPacketInvalidFlags(t *testing.T) {
+	for _, input := range [][]byte{
+		{SUBSCRIBE << 4, 6, 0, 1, 0, 1, 'a', 0},
+		{UNSUBSCRIBE<<4 | 3, 5, 0, 1, 0, 1, 'a'},
+		{PUBREL << 4, 2, 0, 1},
+		{PUBACK<<4 | 1, 2, 0, 1},
+		{PINGREQ<<4 | 8, 0},
+		{CONNACK<<4 | 2, 2, 0, 0},
+	} {
+		_, err := ReadPacket(bytes.NewBuffer(input))
+		assert.True(t, errors.Is(err, ErrInvalidFixedHeaderFlags), "input %v: %v", input, err)
+	}
+
+	// The reserved flags are accepted
+	p, err := ReadPacket(bytes.NewBuffer([]byte{PUBREL<<4 | 2, 2, 0, 1}))
+	assert.NoError(t, err)
+	assert.IsType(t, &PubrelControlPacket{}, p)
+}
+
+func TestReadPacketAnnouncedLength(t *testing.T) {
+	var testCases = []struct {
+		name    string
+		input   []byte
+		version ProtocolVersion
+	}{
+		{"remaining length", []byte{PUBLISH << 4, 0xff, 0xff, 0xff, 0x7f, 0, 1, 'a'}, ProtocolVersion311},
+		{"property length", []byte{PUBACK << 4, 7, 0, 1, 0, 0xff, 0xff, 0xff, 0x7f}, ProtocolVersion5},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			_, err := ReadPacketVersion(bytes.NewReader(tc.input), tc.version)
+			runtime.ReadMemStats(&after)
+			assert.Error(t, err)
+			assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20), "memory is allocated for the data received only")
+		})
+	}
+}
@@ -1,5 +1,25 @@
 package packet
 
+import "io"
+
 type PingReqControlPacket struct {
 	FixedHeader FixedHeader
 }
+
+func (p *PingReqControlPacket) Encode() ([]byte, error) {
+	p.FixedHeader.ControlPacketType = PINGREQ
+	p.FixedHeader.Flags = 0
+	return p.FixedHeader.encode(nil)
+}
+
+func (p *PingReqControlPacket) WriteTo(w io.Writer) (n int64, err error) {
+	return writeEncoded(w, p)
+}
+
+func NewPingReqControlPacket() *PingReqControlPacket {
+	return &PingReqControlPacket{
+		FixedHeader: FixedHeader{
+			ControlPacketType: PINGREQ,
+		},
+	}
+}
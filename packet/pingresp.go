@@ -6,8 +6,14 @@ type PingRespControlPacket struct {
 	FixedHeader FixedHeader
 }
 
+func (p *PingRespControlPacket) Encode() ([]byte, error) {
+	p.FixedHeader.ControlPacketType = PINGRESP
+	p.FixedHeader.Flags = 0
+	return p.FixedHeader.encode(nil)
+}
+
 func (p *PingRespControlPacket) WriteTo(w io.Writer) (n int64, err error) {
-	return p.FixedHeader.WriteTo(w)
+	return writeEncoded(w, p)
 }
 
 func NewPingRespControlPacket() *PingRespControlPacket {
@@ -0,0 +1,473 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MQTT 5 property identifiers
+// http://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901029
+const (
+	PropPayloadFormatIndicator          byte = 0x01
+	PropMessageExpiryInterval           byte = 0x02
+	PropContentType                     byte = 0x03
+	PropResponseTopic                   byte = 0x08
+	PropCorrelationData                 byte = 0x09
+	PropSubscriptionIdentifier          byte = 0x0B
+	PropSessionExpiryInterval           byte = 0x11
+	PropAssignedClientIdentifier        byte = 0x12
+	PropServerKeepAlive                 byte = 0x13
+	PropAuthenticationMethod            byte = 0x15
+	PropAuthenticationData              byte = 0x16
+	PropRequestProblemInformation       byte = 0x17
+	PropWillDelayInterval               byte = 0x18
+	PropRequestResponseInformation      byte = 0x19
+	PropResponseInformation             byte = 0x1A
+	PropServerReference                 byte = 0x1C
+	PropReasonString                    byte = 0x1F
+	PropReceiveMaximum                  byte = 0x21
+	PropTopicAliasMaximum               byte = 0x22
+	PropTopicAlias                      byte = 0x23
+	PropMaximumQoS                      byte = 0x24
+	PropRetainAvailable                 byte = 0x25
+	PropUserProperty                    byte = 0x26
+	PropMaximumPacketSize               byte = 0x27
+	PropWildcardSubscriptionAvailable   byte = 0x28
+	PropSubscriptionIdentifierAvailable byte = 0x29
+	PropSharedSubscriptionAvailable     byte = 0x2A
+)
+
+// willProperties is a pseudo packet type for the property set in the
+// CONNECT payload that describes the will message
+const willProperties ControlPacketType = 16
+
+// propertyPacketTypes lists which packets may carry a property
+var propertyPacketTypes = map[byte][]ControlPacketType{
+	PropPayloadFormatIndicator:          {PUBLISH, willProperties},
+	PropMessageExpiryInterval:           {PUBLISH, willProperties},
+	PropContentType:                     {PUBLISH, willProperties},
+	PropResponseTopic:                   {PUBLISH, willProperties},
+	PropCorrelationData:                 {PUBLISH, willProperties},
+	PropSubscriptionIdentifier:          {PUBLISH, SUBSCRIBE},
+	PropSessionExpiryInterval:           {CONNECT, CONNACK, DISCONNECT},
+	PropAssignedClientIdentifier:        {CONNACK},
+	PropServerKeepAlive:                 {CONNACK},
+	PropAuthenticationMethod:            {CONNECT, CONNACK, AUTH},
+	PropAuthenticationData:              {CONNECT, CONNACK, AUTH},
+	PropRequestProblemInformation:       {CONNECT},
+	PropWillDelayInterval:               {willProperties},
+	PropRequestResponseInformation:      {CONNECT},
+	PropResponseInformation:             {CONNACK},
+	PropServerReference:                 {CONNACK, DISCONNECT},
+	PropReasonString:                    {CONNACK, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBACK, UNSUBACK, DISCONNECT, AUTH},
+	PropReceiveMaximum:                  {CONNECT, CONNACK},
+	PropTopicAliasMaximum:               {CONNECT, CONNACK},
+	PropTopicAlias:                      {PUBLISH},
+	PropMaximumQoS:                      {CONNACK},
+	PropRetainAvailable:                 {CONNACK},
+	PropUserProperty:                    {CONNECT, CONNACK, PUBLISH, willProperties, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBSCRIBE, SUBACK, UNSUBSCRIBE, UNSUBACK, DISCONNECT, AUTH},
+	PropMaximumPacketSize:               {CONNECT, CONNACK},
+	PropWildcardSubscriptionAvailable:   {CONNACK},
+	PropSubscriptionIdentifierAvailable: {CONNACK},
+	PropSharedSubscriptionAvailable:     {CONNACK},
+}
+
+// UserProperty is a name/value pair. Names may repeat and the order is
+// significant, so they are kept as a list.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties holds the MQTT 5 properties of a packet. Packets decoded from
+// an MQTT 3.1.1 stream have nil Properties. Optional numeric properties
+// are pointers so "absent" can be told apart from zero; string and binary
+// properties are absent when empty.
+type Properties struct {
+	PayloadFormatIndicator          *byte
+	MessageExpiryInterval           *uint32
+	ContentType                     string
+	ResponseTopic                   string
+	CorrelationData                 []byte
+	SubscriptionIdentifiers         []int
+	SessionExpiryInterval           *uint32
+	AssignedClientIdentifier        string
+	ServerKeepAlive                 *uint16
+	AuthenticationMethod            string
+	AuthenticationData              []byte
+	RequestProblemInformation       *byte
+	WillDelayInterval               *uint32
+	RequestResponseInformation      *byte
+	ResponseInformation             string
+	ServerReference                 string
+	ReasonString                    string
+	ReceiveMaximum                  *uint16
+	TopicAliasMaximum               *uint16
+	TopicAlias                      *uint16
+	MaximumQoS                      *byte
+	RetainAvailable                 *byte
+	UserProperties                  []UserProperty
+	MaximumPacketSize               *uint32
+	WildcardSubscriptionAvailable   *byte
+	SubscriptionIdentifierAvailable *byte
+	SharedSubscriptionAvailable     *byte
+}
+
+// Helpers to fill in the optional numeric properties
+func Byte(v byte) *byte       { return &v }
+func Uint16(v uint16) *uint16 { return &v }
+func Uint32(v uint32) *uint32 { return &v }
+
+func propertyAllowed(id byte, packetType ControlPacketType) bool {
+	for _, t := range propertyPacketTypes[id] {
+		if t == packetType {
+			return true
+		}
+	}
+	return false
+}
+
+// encode appends the property length and all present properties to buf
+// nolint: gocyclo
+func (p *Properties) encode(buf []byte, packetType ControlPacketType) ([]byte, error) {
+	// The properties go behind room for the largest property length and
+	// are moved up once their length is known
+	start := len(buf)
+	props := append(buf, 0, 0, 0, 0)
+	var err error
+
+	putByte := func(id byte, v *byte) {
+		if v != nil && err == nil {
+			err = checkPropertyAllowed(id, packetType)
+			props = append(props, id, *v)
+		}
+	}
+	putUint16 := func(id byte, v *uint16) {
+		if v != nil && err == nil {
+			err = checkPropertyAllowed(id, packetType)
+			props = appendUint16(append(props, id), *v)
+		}
+	}
+	putUint32 := func(id byte, v *uint32) {
+		if v != nil && err == nil {
+			err = checkPropertyAllowed(id, packetType)
+			props = append(props, id, byte(*v>>24), byte(*v>>16), byte(*v>>8), byte(*v))
+		}
+	}
+	putString := func(id byte, v string) {
+		if v != "" && err == nil {
+			if err = checkPropertyAllowed(id, packetType); err == nil {
+				props, err = appendString(append(props, id), v)
+			}
+		}
+	}
+	putBinary := func(id byte, v []byte) {
+		if v != nil && err == nil {
+			if err = checkPropertyAllowed(id, packetType); err == nil {
+				props, err = appendBinary(append(props, id), v)
+			}
+		}
+	}
+
+	putByte(PropPayloadFormatIndicator, p.PayloadFormatIndicator)
+	putUint32(PropMessageExpiryInterval, p.MessageExpiryInterval)
+	putString(PropContentType, p.ContentType)
+	putString(PropResponseTopic, p.ResponseTopic)
+	putBinary(PropCorrelationData, p.CorrelationData)
+	for _, id := range p.SubscriptionIdentifiers {
+		if err == nil {
+			err = checkPropertyAllowed(PropSubscriptionIdentifier, packetType)
+		}
+		if err == nil && (id < 1 || id > MaxRemainingLength) {
+			err = fmt.Errorf("%w: subscription identifier %v", ErrInvalidProperty, id)
+		}
+		props = appendRemainingLength(append(props, PropSubscriptionIdentifier), id)
+	}
+	putUint32(PropSessionExpiryInterval, p.SessionExpiryInterval)
+	putString(PropAssignedClientIdentifier, p.AssignedClientIdentifier)
+	putUint16(PropServerKeepAlive, p.ServerKeepAlive)
+	putString(PropAuthenticationMethod, p.AuthenticationMethod)
+	putBinary(PropAuthenticationData, p.AuthenticationData)
+	putByte(PropRequestProblemInformation, p.RequestProblemInformation)
+	putUint32(PropWillDelayInterval, p.WillDelayInterval)
+	putByte(PropRequestResponseInformation, p.RequestResponseInformation)
+	putString(PropResponseInformation, p.ResponseInformation)
+	putString(PropServerReference, p.ServerReference)
+	putString(PropReasonString, p.ReasonString)
+	putUint16(PropReceiveMaximum, p.ReceiveMaximum)
+	putUint16(PropTopicAliasMaximum, p.TopicAliasMaximum)
+	putUint16(PropTopicAlias, p.TopicAlias)
+	putByte(PropMaximumQoS, p.MaximumQoS)
+	putByte(PropRetainAvailable, p.RetainAvailable)
+	for _, up := range p.UserProperties {
+		if err == nil {
+			err = checkPropertyAllowed(PropUserProperty, packetType)
+		}
+		if err == nil {
+			props, err = appendString(append(props, PropUserProperty), up.Key)
+		}
+		if err == nil {
+			props, err = appendString(props, up.Value)
+		}
+	}
+	putUint32(PropMaximumPacketSize, p.MaximumPacketSize)
+	putByte(PropWildcardSubscriptionAvailable, p.WildcardSubscriptionAvailable)
+	putByte(PropSubscriptionIdentifierAvailable, p.SubscriptionIdentifierAvailable)
+	putByte(PropSharedSubscriptionAvailable, p.SharedSubscriptionAvailable)
+
+	if err != nil {
+		return buf, err
+	}
+	length := len(props) - start - 4
+	header := appendRemainingLength(props[start:start], length)
+	n := copy(props[start+len(header):], props[start+4:])
+	return props[:start+len(header)+n], nil
+}
+
+func checkPropertyAllowed(id byte, packetType ControlPacketType) error {
+	if !propertyAllowed(id, packetType) {
+		return fmt.Errorf("Property %#x is not allowed in packet type %v", id, packetType)
+	}
+	return nil
+}
+
+// appendProperties appends p, or an empty property set if p is nil
+func appendProperties(buf []byte, p *Properties, packetType ControlPacketType) ([]byte, error) {
+	if p == nil {
+		return append(buf, 0), nil
+	}
+	return p.encode(buf, packetType)
+}
+
+func appendBinary(buf []byte, b []byte) ([]byte, error) {
+	if len(b) > 65535 {
+		return buf, fmt.Errorf("Binary data too long to encode: %v bytes", len(b))
+	}
+	buf = appendUint16(buf, uint16(len(b)))
+	return append(buf, b...), nil
+}
+
+// readProperties reads a property length and the properties following it.
+// It returns the number of bytes consumed.
+func readProperties(r io.Reader, packetType ControlPacketType) (*Properties, int, error) {
+	length, n, err := readVariableByteInteger(r)
+	if err != nil {
+		return nil, n, err
+	}
+	if err := checkAvailable(r, length); err != nil {
+		return nil, n, err
+	}
+
+	buf := getScratch(length)
+	defer putScratch(buf)
+	read, err := io.ReadFull(r, *buf)
+	n += read
+	if err != nil {
+		return nil, n, err
+	}
+
+	p, err := parseProperties(*buf, packetType)
+	return p, n, err
+}
+
+// nolint: gocyclo
+func parseProperties(buf []byte, packetType ControlPacketType) (*Properties, error) {
+	p := &Properties{}
+	seen := map[byte]bool{}
+
+	for len(buf) > 0 {
+		id := buf[0]
+		buf = buf[1:]
+
+		if _, known := propertyPacketTypes[id]; !known {
+			return nil, fmt.Errorf("%w: unknown property %#x", ErrMalformedPacket, id)
+		}
+		if !propertyAllowed(id, packetType) {
+			return nil, fmt.Errorf("%w: property %#x is not allowed in packet type %v", ErrInvalidProperty, id, packetType)
+		}
+		if seen[id] && id != PropUserProperty && id != PropSubscriptionIdentifier {
+			return nil, fmt.Errorf("%w: property %#x included more than once", ErrInvalidProperty, id)
+		}
+		seen[id] = true
+
+		var err error
+		switch id {
+		case PropPayloadFormatIndicator:
+			p.PayloadFormatIndicator, buf, err = takeByte(buf)
+		case PropMessageExpiryInterval:
+			p.MessageExpiryInterval, buf, err = takeUint32(buf)
+		case PropContentType:
+			p.ContentType, buf, err = takeString(buf)
+		case PropResponseTopic:
+			p.ResponseTopic, buf, err = takeString(buf)
+		case PropCorrelationData:
+			p.CorrelationData, buf, err = takeBinary(buf)
+		case PropSubscriptionIdentifier:
+			var v int
+			v, buf, err = takeVariableByteInteger(buf)
+			if err == nil && v == 0 {
+				err = fmt.Errorf("%w: subscription identifier must not be 0", ErrInvalidProperty)
+			}
+			p.SubscriptionIdentifiers = append(p.SubscriptionIdentifiers, v)
+		case PropSessionExpiryInterval:
+			p.SessionExpiryInterval, buf, err = takeUint32(buf)
+		case PropAssignedClientIdentifier:
+			p.AssignedClientIdentifier, buf, err = takeString(buf)
+		case PropServerKeepAlive:
+			p.ServerKeepAlive, buf, err = takeUint16(buf)
+		case PropAuthenticationMethod:
+			p.AuthenticationMethod, buf, err = takeString(buf)
+		case PropAuthenticationData:
+			p.AuthenticationData, buf, err = takeBinary(buf)
+		case PropRequestProblemInformation:
+			p.RequestProblemInformation, buf, err = takeByte(buf)
+		case PropWillDelayInterval:
+			p.WillDelayInterval, buf, err = takeUint32(buf)
+		case PropRequestResponseInformation:
+			p.RequestResponseInformation, buf, err = takeByte(buf)
+		case PropResponseInformation:
+			p.ResponseInformation, buf, err = takeString(buf)
+		case PropServerReference:
+			p.ServerReference, buf, err = takeString(buf)
+		case PropReasonString:
+			p.ReasonString, buf, err = takeString(buf)
+		case PropReceiveMaximum:
+			p.ReceiveMaximum, buf, err = takeUint16(buf)
+			if err == nil && *p.ReceiveMaximum == 0 {
+				err = fmt.Errorf("%w: receive maximum must not be 0", ErrInvalidProperty)
+			}
+		case PropTopicAliasMaximum:
+			p.TopicAliasMaximum, buf, err = takeUint16(buf)
+		case PropTopicAlias:
+			p.TopicAlias, buf, err = takeUint16(buf)
+		case PropMaximumQoS:
+			p.MaximumQoS, buf, err = takeByte(buf)
+		case PropRetainAvailable:
+			p.RetainAvailable, buf, err = takeByte(buf)
+		case PropUserProperty:
+			var up UserProperty
+			up.Key, buf, err = takeString(buf)
+			if err == nil {
+				up.Value, buf, err = takeString(buf)
+			}
+			p.UserProperties = append(p.UserProperties, up)
+		case PropMaximumPacketSize:
+			p.MaximumPacketSize, buf, err = takeUint32(buf)
+			if err == nil && *p.MaximumPacketSize == 0 {
+				err = fmt.Errorf("%w: maximum packet size must not be 0", ErrInvalidProperty)
+			}
+		case PropWildcardSubscriptionAvailable:
+			p.WildcardSubscriptionAvailable, buf, err = takeByte(buf)
+		case PropSubscriptionIdentifierAvailable:
+			p.SubscriptionIdentifierAvailable, buf, err = takeByte(buf)
+		case PropSharedSubscriptionAvailable:
+			p.SharedSubscriptionAvailable, buf, err = takeByte(buf)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+var errShortProperty = fmt.Errorf("%w: property value exceeds property length", ErrMalformedPacket)
+
+func takeByte(buf []byte) (*byte, []byte, error) {
+	if len(buf) < 1 {
+		return nil, buf, errShortProperty
+	}
+	v := buf[0]
+	return &v, buf[1:], nil
+}
+
+func takeUint16(buf []byte) (*uint16, []byte, error) {
+	if len(buf) < 2 {
+		return nil, buf, errShortProperty
+	}
+	v := binary.BigEndian.Uint16(buf)
+	return &v, buf[2:], nil
+}
+
+func takeUint32(buf []byte) (*uint32, []byte, error) {
+	if len(buf) < 4 {
+		return nil, buf, errShortProperty
+	}
+	v := binary.BigEndian.Uint32(buf)
+	return &v, buf[4:], nil
+}
+
+func takeBinary(buf []byte) ([]byte, []byte, error) {
+	if len(buf) < 2 {
+		return nil, buf, errShortProperty
+	}
+	length := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+length {
+		return nil, buf, errShortProperty
+	}
+	v := make([]byte, length)
+	copy(v, buf[2:2+length])
+	return v, buf[2+length:], nil
+}
+
+func takeString(buf []byte) (string, []byte, error) {
+	if len(buf) < 2 {
+		return "", buf, errShortProperty
+	}
+	s, n, err := DecodeUTF8String(buf)
+	if err == errShortUTF8String {
+		err = errShortProperty
+	}
+	if err != nil {
+		return "", buf, err
+	}
+	return s, buf[n:], nil
+}
+
+func takeVariableByteInteger(buf []byte) (int, []byte, error) {
+	value, multiplier := 0, 1
+	for i := 0; i < 4 && i < len(buf); i++ {
+		value += int(buf[i]&127) * multiplier
+		if buf[i]&128 == 0 {
+			return value, buf[i+1:], nil
+		}
+		multiplier *= 128
+	}
+	return 0, buf, ErrMalformedVariableByteInteger
+}
+
+// readVariableByteInteger reads the same encoding as the remaining length
+// and returns the number of bytes consumed
+func readVariableByteInteger(r io.Reader) (value int, n int, err error) {
+	multiplier := 1
+	for n < 4 {
+		b, err := readByte(r)
+		if err != nil {
+			return 0, n, err
+		}
+		n++
+		value += int(b&127) * multiplier
+		if b&128 == 0 {
+			return value, n, nil
+		}
+		multiplier *= 128
+	}
+	return 0, n, ErrMalformedVariableByteInteger
+}
@@ -0,0 +1,127 @@
+package packet
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadPacketVersion5(t *testing.T) {
+	var testCases = []ControlPacket{
+		&ConnectControlPacket{
+			VariableHeader: ConnectVariableHeader{
+				ProtocolName:  "MQTT",
+				ProtocolLevel: byte(ProtocolVersion5),
+				ConnectFlags:  ConnectFlags{CleanSession: true},
+				KeepAlive:     30,
+				Properties: &Properties{
+					SessionExpiryInterval: Uint32(3600),
+					ReceiveMaximum:        Uint16(20),
+					UserProperties:        []UserProperty{{"a", "1"}, {"a", "2"}},
+				},
+			},
+			ConnectPayload: ConnectPayload{ClientID: "client"},
+		},
+		&ConnectControlPacket{
+			VariableHeader: ConnectVariableHeader{
+				ProtocolName:  "MQTT",
+				ProtocolLevel: byte(ProtocolVersion5),
+				ConnectFlags:  ConnectFlags{WillFlag: true, WillQoS: 1},
+				Properties:    &Properties{},
+			},
+			ConnectPayload: ConnectPayload{
+				ClientID:       "client",
+				WillProperties: &Properties{WillDelayInterval: Uint32(5), ContentType: "text/plain"},
+				WillTopic:      "clients/client/status",
+				WillMessage:    []byte("offline"),
+			},
+		},
+		&ConnAckControlPacket{VariableHeader: ConnAckVariableHeader{
+			ReturnCode: ReasonCodeNotAuthorized,
+			Properties: &Properties{ReasonString: "go away", ServerKeepAlive: Uint16(10)},
+		}},
+		&PublishControlPacket{
+			FixedHeaderFlags: PublishHeaderFlags{QoS: QoSLevelAtLeastOnce},
+			VariableHeader: PublishVariableHeader{
+				Topic:    "a/b",
+				PacketID: 1,
+				Properties: &Properties{
+					TopicAlias:              Uint16(3),
+					CorrelationData:         []byte{1, 2},
+					SubscriptionIdentifiers: []int{1, 300},
+				},
+			},
+			Payload: []byte("payload"),
+		},
+		&PubackControlPacket{VariableHeader: PubAckVariableHeader{PacketID: 1, Properties: &Properties{}}},
+		&PubrecControlPacket{VariableHeader: PubRecVariableHeader{PacketID: 2, ReasonCode: ReasonCodeNoMatchingSubscribers, Properties: &Properties{}}},
+		&PubrelControlPacket{VariableHeader: PubRelVariableHeader{PacketID: 3, ReasonCode: ReasonCodePacketIdentifierNotFound, Properties: &Properties{ReasonString: "?"}}},
+		&PubcompControlPacket{VariableHeader: PubCompVariableHeader{PacketID: 4, Properties: &Properties{}}},
+		&SubscribeControlPacket{
+			VariableHeader: SubscribeVariableHeader{PacketID: 5, Properties: &Properties{SubscriptionIdentifiers: []int{7}}},
+			Payload: SubscribePayload{Subscriptions: []Subscription{
+				{Topic: "a/#", QoS: QoSLevelAtLeastOnce, NoLocal: true, RetainHandling: 2},
+				{Topic: "b", QoS: QoSLevelExactlyOnce, RetainAsPublished: true},
+			}},
+		},
+		&SubAckControlPacket{
+			VariableHeader: SubAckVariableHeader{PacketID: 5, Properties: &Properties{}},
+			Payload:        SubAckPayload{ReturnCodes: []byte{ReasonCodeGrantedQoS1, ReasonCodeQuotaExceeded}},
+		},
+		&UnsubscribeControlPacket{
+			VariableHeader: UnsubscribeVariableHeader{PacketID: 6, Properties: &Properties{UserProperties: []UserProperty{{"k", "v"}}}},
+			Payload:        UnsubscribePayload{Topics: []string{"a/#"}},
+		},
+		&UnsubAckControlPacket{
+			VariableHeader: UnsubAckVariableHeader{PacketID: 6, Properties: &Properties{}},
+			Payload:        UnsubAckPayload{ReasonCodes: []byte{ReasonCodeNoSubscriptionExisted}},
+		},
+		&DisconnectControlPacket{VariableHeader: DisconnectVariableHeader{Properties: &Properties{}}},
+		&DisconnectControlPacket{VariableHeader: DisconnectVariableHeader{
+			ReasonCode: ReasonCodeServerMoved,
+			Properties: &Properties{ServerReference: "other:1883"},
+		}},
+	}
+
+	for i, expected := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, WritePacket(&buf, expected))
+
+			actual, err := ReadPacketVersion(&buf, ProtocolVersion5)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, actual)
+		})
+	}
+}
+
+func TestShortVersion5Acks(t *testing.T) {
+	p, err := NewPubAckControlPacket(9).Encode()
+	require.NoError(t, err)
+
+	actual, err := ReadPacketVersion(bytes.NewBuffer(p), ProtocolVersion5)
+	require.NoError(t, err)
+	assert.Equal(t, &Properties{}, actual.(*PubackControlPacket).VariableHeader.Properties)
+
+	actual, err = ReadPacketVersion(bytes.NewBuffer([]byte{DISCONNECT << 4, 1, ReasonCodeServerShuttingDown}), ProtocolVersion5)
+	require.NoError(t, err)
+	assert.Equal(t, ReasonCodeServerShuttingDown, actual.(*DisconnectControlPacket).VariableHeader.ReasonCode)
+}
+
+func TestPropertyNotAllowed(t *testing.T) {
+	// Topic alias is only valid in PUBLISH
+	_, err := ReadPacketVersion(bytes.NewBuffer([]byte{DISCONNECT << 4, 5, 0, 3, PropTopicAlias, 0, 1}), ProtocolVersion5)
+	assert.Error(t, err)
+
+	p := NewDisconnectControlPacket()
+	p.VariableHeader.Properties = &Properties{TopicAlias: Uint16(1)}
+	_, err = p.Encode()
+	assert.Error(t, err)
+
+	// Only user properties may be repeated
+	_, err = parseProperties([]byte{PropReasonString, 0, 0, PropReasonString, 0, 0}, DISCONNECT)
+	assert.Error(t, err)
+}
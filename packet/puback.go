@@ -29,6 +29,25 @@ type PubackControlPacket struct {
 
 type PubAckVariableHeader struct {
 	PacketID uint16
+
+	// MQTT 5 only, the packet is encoded as MQTT 3.1.1 if Properties is nil
+	ReasonCode byte
+	Properties *Properties
+}
+
+func readPubAck(r io.Reader, fh FixedHeader, version ProtocolVersion) (*PubackControlPacket, error) {
+	packetID, reasonCode, props, err := readAck(r, fh, version)
+	if err != nil {
+		return nil, err
+	}
+	return &PubackControlPacket{
+		FixedHeader: fh,
+		VariableHeader: PubAckVariableHeader{
+			PacketID:   packetID,
+			ReasonCode: reasonCode,
+			Properties: props,
+		},
+	}, nil
 }
 
 func (vh *PubAckVariableHeader) WriteTo(w io.Writer) (n int64, err error) {
@@ -43,8 +62,14 @@ func (vh *PubAckVariableHeader) WriteTo(w io.Writer) (n int64, err error) {
 	return
 }
 
+func (p *PubackControlPacket) Encode() ([]byte, error) {
+	p.FixedHeader.ControlPacketType = PUBACK
+	p.FixedHeader.Flags = 0
+	return encodeAck(&p.FixedHeader, p.VariableHeader.PacketID, p.VariableHeader.ReasonCode, p.VariableHeader.Properties)
+}
+
 func (p *PubackControlPacket) WriteTo(w io.Writer) (n int64, err error) {
-	return p.VariableHeader.WriteTo(w)
+	return writeEncoded(w, p)
 }
 
 func NewPubAckControlPacket(packetID uint16) *PubackControlPacket {
@@ -58,3 +83,15 @@ func NewPubAckControlPacket(packetID uint16) *PubackControlPacket {
 		},
 	}
 }
+
+// Properties returns the MQTT 5 properties of p, nil for MQTT 3.1.1
+func (p *PubackControlPacket) Properties() *Properties {
+	return p.VariableHeader.Properties
+}
+
+// WithProperties returns a copy of p with props, see Versioned
+func (p *PubackControlPacket) WithProperties(props *Properties) ControlPacket {
+	cp := *p
+	cp.VariableHeader.Properties = props
+	return &cp
+}
@@ -0,0 +1,84 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"io"
+)
+
+type PubcompControlPacket struct {
+	FixedHeader    FixedHeader
+	VariableHeader PubCompVariableHeader
+}
+
+type PubCompVariableHeader struct {
+	PacketID uint16
+
+	// MQTT 5 only, the packet is encoded as MQTT 3.1.1 if Properties is nil
+	ReasonCode byte
+	Properties *Properties
+}
+
+func readPubComp(r io.Reader, fh FixedHeader, version ProtocolVersion) (*PubcompControlPacket, error) {
+	packetID, reasonCode, props, err := readAck(r, fh, version)
+	if err != nil {
+		return nil, err
+	}
+	return &PubcompControlPacket{
+		FixedHeader: fh,
+		VariableHeader: PubCompVariableHeader{
+			PacketID:   packetID,
+			ReasonCode: reasonCode,
+			Properties: props,
+		},
+	}, nil
+}
+
+func (p *PubcompControlPacket) Encode() ([]byte, error) {
+	p.FixedHeader.ControlPacketType = PUBCOMP
+	p.FixedHeader.Flags = 0
+	return encodeAck(&p.FixedHeader, p.VariableHeader.PacketID, p.VariableHeader.ReasonCode, p.VariableHeader.Properties)
+}
+
+func (p *PubcompControlPacket) WriteTo(w io.Writer) (n int64, err error) {
+	return writeEncoded(w, p)
+}
+
+func NewPubCompControlPacket(packetID uint16) *PubcompControlPacket {
+	return &PubcompControlPacket{
+		FixedHeader: FixedHeader{
+			ControlPacketType: PUBCOMP,
+			RemainingLength:   2,
+		},
+		VariableHeader: PubCompVariableHeader{
+			PacketID: packetID,
+		},
+	}
+}
+
+// Properties returns the MQTT 5 properties of p, nil for MQTT 3.1.1
+func (p *PubcompControlPacket) Properties() *Properties {
+	return p.VariableHeader.Properties
+}
+
+// WithProperties returns a copy of p with props, see Versioned
+func (p *PubcompControlPacket) WithProperties(props *Properties) ControlPacket {
+	cp := *p
+	cp.VariableHeader.Properties = props
+	return &cp
+}
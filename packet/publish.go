@@ -18,9 +18,8 @@
 package packet
 
 import (
-	"bytes"
 	"encoding/binary"
-	"errors"
+	"fmt"
 	"io"
 )
 
@@ -40,6 +39,8 @@ type PublishHeaderFlags struct {
 type PublishVariableHeader struct {
 	Topic    string
 	PacketID int
+	// MQTT 5 only, the packet is encoded as MQTT 3.1.1 if Properties is nil
+	Properties *Properties
 }
 
 func interpretPublishHeaderFlags(header byte) (flags PublishHeaderFlags, err error) {
@@ -47,7 +48,7 @@ func interpretPublishHeaderFlags(header byte) (flags PublishHeaderFlags, err err
 	flags.Dup = header&8 > 0
 
 	if header&2 > 0 && header&4 > 0 {
-		err = errors.New("Both bits for QoS are set, this is invalid")
+		err = fmt.Errorf("%w: both bits for QoS are set", ErrInvalidQoS)
 	}
 
 	if header&2 > 0 {
@@ -60,20 +61,17 @@ func interpretPublishHeaderFlags(header byte) (flags PublishHeaderFlags, err err
 	return
 }
 
-func readPublishVariableHeader(r io.Reader, flags PublishHeaderFlags) (vh PublishVariableHeader, len int, err error) {
+func readPublishVariableHeader(r io.Reader, flags PublishHeaderFlags, version ProtocolVersion) (vh PublishVariableHeader, len int, err error) {
 	topicLength, err := readUint16(r)
 	len += 2
 	if err != nil {
 		return
 	}
-	bufTopic := make([]byte, topicLength)
-	n, err := io.ReadFull(r, bufTopic)
-	len += n
+	vh.Topic, err = readString(r, topicLength)
 	if err != nil {
 		return
 	}
-
-	vh.Topic = string(bufTopic)
+	len += topicLength
 
 	if flags.QoS == QoSLevelAtLeastOnce || flags.QoS == QoSLevelExactlyOnce {
 		vh.PacketID, err = readUint16(r)
@@ -81,42 +79,128 @@ func readPublishVariableHeader(r io.Reader, flags PublishHeaderFlags) (vh Publis
 			return
 		}
 		len += 2
+		if vh.PacketID == 0 {
+			// [MQTT-2.3.1-1]
+			err = fmt.Errorf("%w: PUBLISH with QoS %d and packet identifier 0", ErrMalformedPacket, flags.QoS)
+			return
+		}
 	}
 
+	if version == ProtocolVersion5 {
+		var n int
+		vh.Properties, n, err = readProperties(r, PUBLISH)
+		len += n
+		if err != nil {
+			return
+		}
+	}
+
+	// An MQTT 5 message may leave out the topic and give its alias instead
+	if vh.Topic != "" || vh.Properties == nil || vh.Properties.TopicAlias == nil {
+		err = ValidateTopicName(vh.Topic)
+	}
 	return
 }
 
+// readPublishPayload reads the application message, an empty one as nil
+// like NewPublish is given it
 func readPublishPayload(r io.Reader, len int) (buf []byte, err error) {
+	if len == 0 {
+		return nil, nil
+	}
 	buf = make([]byte, len)
 	_, err = io.ReadFull(r, buf)
 	return
 }
 
-func (p *PublishControlPacket) WriteTo(w io.Writer) (n int64, err error) {
-	var nWritten int64
-
-	// Calc Variable Header + Payload
-	p.FixedHeader.RemainingLength = 2 + len(p.VariableHeader.Topic) + len(p.Payload)
+func (flags PublishHeaderFlags) encode() (byte, error) {
+	if flags.QoS < QoSLevelNone || flags.QoS > QoSLevelExactlyOnce {
+		return 0, fmt.Errorf("Invalid QoS level: %v", flags.QoS)
+	}
 
-	if p.FixedHeaderFlags.QoS == QoSLevelAtLeastOnce || p.FixedHeaderFlags.QoS == QoSLevelExactlyOnce {
-		p.FixedHeader.RemainingLength += 2
+	b := byte(flags.QoS) << 1
+	if flags.Dup {
+		b |= 8
 	}
+	if flags.Retain {
+		b |= 1
+	}
+	return b, nil
+}
 
-	nWritten, err = p.FixedHeader.WriteTo(w)
-	n += nWritten
+func (p *PublishControlPacket) Encode() ([]byte, error) {
+	return p.AppendEncode(make([]byte, 0, 9+len(p.VariableHeader.Topic)+len(p.Payload)))
+}
+
+// AppendEncode appends the encoding of p to dst and returns the extended
+// buffer. Unlike Encode, it does not allocate once dst has grown large
+// enough, so that a buffer can be reused for many packets.
+func (p *PublishControlPacket) AppendEncode(dst []byte) ([]byte, error) {
+	flags, err := p.FixedHeaderFlags.encode()
 	if err != nil {
-		return n, err
+		return dst, err
 	}
 
-	nWritten, err = p.VariableHeader.WriteTo(w)
-	n += nWritten
+	// The body goes behind room for the largest fixed header and is moved
+	// up once its length is known
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0, 0)
+	body := len(dst)
+	dst, err = appendString(dst, p.VariableHeader.Topic)
 	if err != nil {
-		return n, err
+		return dst[:start], err
+	}
+	if p.FixedHeaderFlags.QoS == QoSLevelAtLeastOnce || p.FixedHeaderFlags.QoS == QoSLevelExactlyOnce {
+		dst = appendUint16(dst, uint16(p.VariableHeader.PacketID))
+	}
+	if p.VariableHeader.Properties != nil {
+		dst, err = p.VariableHeader.Properties.encode(dst, PUBLISH)
+		if err != nil {
+			return dst[:start], err
+		}
+	}
+	dst = append(dst, p.Payload...)
+
+	length := len(dst) - body
+	if length > MaxRemainingLength {
+		return dst[:start], fmt.Errorf("%w to encode: %v bytes", ErrPayloadTooLarge, length)
 	}
+	header := append(dst[start:start], byte(PUBLISH)<<4|flags)
+	header = appendRemainingLength(header, length)
+	n := copy(dst[start+len(header):], dst[body:])
+
+	p.FixedHeader = FixedHeader{ControlPacketType: PUBLISH, Flags: flags, RemainingLength: length}
+	return dst[:start+len(header)+n], nil
+}
+
+func (p *PublishControlPacket) WriteTo(w io.Writer) (n int64, err error) {
+	return writeEncoded(w, p)
+}
+
+// Topic returns the topic name the message is published to
+func (p *PublishControlPacket) Topic() string {
+	return p.VariableHeader.Topic
+}
 
-	nWritten, err = io.Copy(w, bytes.NewReader(p.Payload))
-	n += nWritten
-	return n, err
+// PacketID returns the packet identifier, which is 0 for QoS 0 messages
+func (p *PublishControlPacket) PacketID() uint16 {
+	return uint16(p.VariableHeader.PacketID)
+}
+
+// QoS returns the QoS level from the fixed header flags
+func (p *PublishControlPacket) QoS() QosLevel {
+	return p.FixedHeaderFlags.QoS
+}
+
+// Dup reports whether the message is a redelivery
+func (p *PublishControlPacket) Dup() bool {
+	return p.FixedHeaderFlags.Dup
+}
+
+// Retain reports whether the message is to be retained, or was sent
+// because it had been retained
+func (p *PublishControlPacket) Retain() bool {
+	return p.FixedHeaderFlags.Retain
 }
 
 func (c *PublishVariableHeader) WriteTo(w io.Writer) (n int64, err error) {
@@ -141,7 +225,7 @@ func (c *PublishVariableHeader) WriteTo(w io.Writer) (n int64, err error) {
 func NewPublish(topic string, packetID uint16, payload []byte) *PublishControlPacket {
 	fh := FixedHeader{
 		ControlPacketType: PUBLISH,
-		RemainingLength:   0, // will be populated by WriteTo for the moment
+		RemainingLength:   0, // will be populated by Encode
 	}
 
 	vh := PublishVariableHeader{
@@ -162,3 +246,15 @@ func NewPublish(topic string, packetID uint16, payload []byte) *PublishControlPa
 		Payload:          payload,
 	}
 }
+
+// Properties returns the MQTT 5 properties of p, nil for MQTT 3.1.1
+func (p *PublishControlPacket) Properties() *Properties {
+	return p.VariableHeader.Properties
+}
+
+// WithProperties returns a copy of p with props, see Versioned
+func (p *PublishControlPacket) WithProperties(props *Properties) ControlPacket {
+	cp := *p
+	cp.VariableHeader.Properties = props
+	return &cp
+}
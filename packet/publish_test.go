@@ -1,7 +1,13 @@
 package packet
 
-import "testing"
-import "github.com/stretchr/testify/assert"
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
 
 func TestInterpretHeaderFlags(t *testing.T) {
 	input := byte(11)
@@ -11,3 +17,56 @@ func TestInterpretHeaderFlags(t *testing.T) {
 	assert.True(t, hdr.Retain)
 	assert.Equal(t, QoSLevelAtLeastOnce, hdr.QoS, "Expected at least once")
 }
+
+func TestPublishAccessors(t *testing.T) {
+	p := NewPublish("a/b", 7, []byte("x"))
+	p.FixedHeaderFlags = PublishHeaderFlags{QoS: QoSLevelExactlyOnce, Dup: true, Retain: true}
+	b, err := p.Encode()
+	require.NoError(t, err)
+
+	decoded, err := ReadPacket(bytes.NewReader(b))
+	require.NoError(t, err)
+	pub := decoded.(*PublishControlPacket)
+	assert.Equal(t, "a/b", pub.Topic())
+	assert.Equal(t, uint16(7), pub.PacketID())
+	assert.Equal(t, QoSLevelExactlyOnce, pub.QoS())
+	assert.True(t, pub.Dup())
+	assert.True(t, pub.Retain())
+}
+
+func TestPublishWildcardTopic(t *testing.T) {
+	for _, topic := range []string{"a/+", "#", "a/b#", ""} {
+		b, err := NewPublish(topic, 0, nil).Encode()
+		require.NoError(t, err)
+		_, err = ReadPacket(bytes.NewReader(b))
+		assert.True(t, errors.Is(err, ErrInvalidTopicName), topic)
+		assert.Equal(t, ReasonCodeTopicNameInvalid, ReasonCodeOf(err))
+	}
+}
+
+func TestPublishAppendEncode(t *testing.T) {
+	for _, p := range []*PublishControlPacket{
+		NewPublish("a/b", 0, []byte("hello")),
+		NewPublish("a/b", 0, bytes.Repeat([]byte{1}, 200)),
+		{
+			FixedHeaderFlags: PublishHeaderFlags{QoS: QoSLevelAtLeastOnce, Retain: true},
+			VariableHeader:   PublishVariableHeader{Topic: "a", PacketID: 7, Properties: &Properties{ContentType: "text/plain"}},
+			Payload:          []byte("hello"),
+		},
+	} {
+		want, err := p.Encode()
+		require.NoError(t, err)
+		buf, err := p.AppendEncode([]byte("prefix"))
+		require.NoError(t, err)
+		assert.Equal(t, append([]byte("prefix"), want...), buf)
+		assert.Equal(t, len(want), p.FixedHeader.size())
+
+		buf = make([]byte, 0, len(want)+4)
+		allocs := testing.AllocsPerRun(100, func() {
+			if _, err := p.AppendEncode(buf); err != nil {
+				t.Fatal(err)
+			}
+		})
+		assert.Equal(t, 0.0, allocs)
+	}
+}
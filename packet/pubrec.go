@@ -0,0 +1,84 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"io"
+)
+
+type PubrecControlPacket struct {
+	FixedHeader    FixedHeader
+	VariableHeader PubRecVariableHeader
+}
+
+type PubRecVariableHeader struct {
+	PacketID uint16
+
+	// MQTT 5 only, the packet is encoded as MQTT 3.1.1 if Properties is nil
+	ReasonCode byte
+	Properties *Properties
+}
+
+func readPubRec(r io.Reader, fh FixedHeader, version ProtocolVersion) (*PubrecControlPacket, error) {
+	packetID, reasonCode, props, err := readAck(r, fh, version)
+	if err != nil {
+		return nil, err
+	}
+	return &PubrecControlPacket{
+		FixedHeader: fh,
+		VariableHeader: PubRecVariableHeader{
+			PacketID:   packetID,
+			ReasonCode: reasonCode,
+			Properties: props,
+		},
+	}, nil
+}
+
+func (p *PubrecControlPacket) Encode() ([]byte, error) {
+	p.FixedHeader.ControlPacketType = PUBREC
+	p.FixedHeader.Flags = 0
+	return encodeAck(&p.FixedHeader, p.VariableHeader.PacketID, p.VariableHeader.ReasonCode, p.VariableHeader.Properties)
+}
+
+func (p *PubrecControlPacket) WriteTo(w io.Writer) (n int64, err error) {
+	return writeEncoded(w, p)
+}
+
+func NewPubRecControlPacket(packetID uint16) *PubrecControlPacket {
+	return &PubrecControlPacket{
+		FixedHeader: FixedHeader{
+			ControlPacketType: PUBREC,
+			RemainingLength:   2,
+		},
+		VariableHeader: PubRecVariableHeader{
+			PacketID: packetID,
+		},
+	}
+}
+
+// Properties returns the MQTT 5 properties of p, nil for MQTT 3.1.1
+func (p *PubrecControlPacket) Properties() *Properties {
+	return p.VariableHeader.Properties
+}
+
+// WithProperties returns a copy of p with props, see Versioned
+func (p *PubrecControlPacket) WithProperties(props *Properties) ControlPacket {
+	cp := *p
+	cp.VariableHeader.Properties = props
+	return &cp
+}
@@ -0,0 +1,85 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"io"
+)
+
+type PubrelControlPacket struct {
+	FixedHeader    FixedHeader
+	VariableHeader PubRelVariableHeader
+}
+
+type PubRelVariableHeader struct {
+	PacketID uint16
+
+	// MQTT 5 only, the packet is encoded as MQTT 3.1.1 if Properties is nil
+	ReasonCode byte
+	Properties *Properties
+}
+
+func readPubRel(r io.Reader, fh FixedHeader, version ProtocolVersion) (*PubrelControlPacket, error) {
+	packetID, reasonCode, props, err := readAck(r, fh, version)
+	if err != nil {
+		return nil, err
+	}
+	return &PubrelControlPacket{
+		FixedHeader: fh,
+		VariableHeader: PubRelVariableHeader{
+			PacketID:   packetID,
+			ReasonCode: reasonCode,
+			Properties: props,
+		},
+	}, nil
+}
+
+func (p *PubrelControlPacket) Encode() ([]byte, error) {
+	p.FixedHeader.ControlPacketType = PUBREL
+	p.FixedHeader.Flags = 2 // reserved bits, see [MQTT-3.6.1-1]
+	return encodeAck(&p.FixedHeader, p.VariableHeader.PacketID, p.VariableHeader.ReasonCode, p.VariableHeader.Properties)
+}
+
+func (p *PubrelControlPacket) WriteTo(w io.Writer) (n int64, err error) {
+	return writeEncoded(w, p)
+}
+
+func NewPubRelControlPacket(packetID uint16) *PubrelControlPacket {
+	return &PubrelControlPacket{
+		FixedHeader: FixedHeader{
+			ControlPacketType: PUBREL,
+			Flags:             2,
+			RemainingLength:   2,
+		},
+		VariableHeader: PubRelVariableHeader{
+			PacketID: packetID,
+		},
+	}
+}
+
+// Properties returns the MQTT 5 properties of p, nil for MQTT 3.1.1
+func (p *PubrelControlPacket) Properties() *Properties {
+	return p.VariableHeader.Properties
+}
+
+// WithProperties returns a copy of p with props, see Versioned
+func (p *PubrelControlPacket) WithProperties(props *Properties) ControlPacket {
+	cp := *p
+	cp.VariableHeader.Properties = props
+	return &cp
+}
@@ -0,0 +1,95 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// deadlineReader is implemented by net.Conn and anything else that can
+// interrupt a blocked Read by moving its deadline.
+type deadlineReader interface {
+	io.Reader
+	SetReadDeadline(t time.Time) error
+}
+
+// ReadPacketContext reads a single packet like ReadPacket, but returns
+// early with ctx.Err() once ctx is done.
+//
+// r has to support read deadlines, like a net.Conn: the context deadline
+// is applied to the read and cancellation unblocks it by expiring the
+// deadline. The read deadline is cleared again before returning. Other
+// readers can only be used with contexts that are never done, like
+// context.Background(); ErrNoDeadline is returned for any other context,
+// since their reads could not be interrupted.
+func ReadPacketContext(ctx context.Context, r io.Reader) (ControlPacket, error) {
+	return readContext(ctx, r, func() (ControlPacket, error) {
+		return ReadPacket(r)
+	})
+}
+
+// readContext calls read, which reads a packet from r, and interrupts it
+// once ctx is done
+func readContext(ctx context.Context, r io.Reader, read func() (ControlPacket, error)) (ControlPacket, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if dr, ok := r.(deadlineReader); ok {
+		return readWithDeadline(ctx, dr, read)
+	}
+	if ctx.Done() != nil {
+		return nil, ErrNoDeadline
+	}
+	return read()
+}
+
+func readWithDeadline(ctx context.Context, r deadlineReader, read func() (ControlPacket, error)) (ControlPacket, error) {
+	deadline, hasDeadline := ctx.Deadline()
+	if err := r.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	expired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(expired)
+		// Any time in the past unblocks pending reads immediately
+		_ = r.SetReadDeadline(time.Unix(1, 0))
+	})
+
+	p, err := read()
+	if !stop() {
+		<-expired // the callback must not touch the deadline after we reset it
+	}
+
+	resetErr := r.SetReadDeadline(time.Time{})
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && hasDeadline && !time.Now().Before(deadline) {
+		// The read deadline can fire an instant before the context notices
+		return nil, context.DeadlineExceeded
+	}
+	if err == nil {
+		err = resetErr
+	}
+	return p, err
+}
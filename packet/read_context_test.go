@@ -0,0 +1,79 @@
+package packet
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadPacketContextCancel(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close() // nolint: errcheck
+	defer client.Close() // nolint: errcheck
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := ReadPacketContext(ctx, server)
+	assert.Equal(t, context.Canceled, err)
+
+	// The connection must still be usable after the cancelled read
+	go func() {
+		_, _ = client.Write([]byte{PINGREQ << 4, 0})
+	}()
+	p, err := ReadPacketContext(context.Background(), server)
+	assert.NoError(t, err)
+	assert.IsType(t, &PingReqControlPacket{}, p)
+}
+
+func TestReadPacketContextDeadline(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close() // nolint: errcheck
+	defer client.Close() // nolint: errcheck
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := ReadPacketContext(ctx, server)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestReadPacketContextPlainReader(t *testing.T) {
+	p, err := ReadPacketContext(context.Background(), bytes.NewBuffer([]byte{PINGREQ << 4, 0}))
+	assert.NoError(t, err)
+	assert.IsType(t, &PingReqControlPacket{}, p)
+
+	// A read that could not be interrupted is not even started
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	buf := bytes.NewBuffer([]byte{PINGREQ << 4, 0})
+	_, err = ReadPacketContext(ctx, buf)
+	assert.Equal(t, ErrNoDeadline, err)
+	assert.Equal(t, 2, buf.Len(), "nothing must be consumed")
+}
+
+func TestReaderReadPacketContext(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close() // nolint: errcheck
+	defer client.Close() // nolint: errcheck
+
+	r := NewReader(server)
+	go func() {
+		_, _ = client.Write([]byte{PINGREQ << 4, 0})
+	}()
+	p, err := r.ReadPacketContext(context.Background())
+	assert.NoError(t, err)
+	assert.IsType(t, &PingReqControlPacket{}, p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = r.ReadPacketContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
@@ -0,0 +1,165 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"io"
+	"math/bits"
+)
+
+const (
+	// defaultMinReadBuffer fits the typical telemetry message, so that a
+	// connection that only sends small packets pins little memory
+	defaultMinReadBuffer = 256
+	// defaultMaxReadBuffer is the largest buffer; larger packets are read
+	// in full through a pooled decodeBuffer instead
+	defaultMaxReadBuffer = 64 * 1024
+	// shrinkAfter is the number of packets in a row that fit in a quarter
+	// of the buffer after which it is halved
+	shrinkAfter = 32
+	// maxEmptyReads is how often in a row a read may return no data and
+	// no error before the connection is considered broken
+	maxEmptyReads = 100
+)
+
+// readBuffer buffers the reads of a Reader like a bufio.Reader, but adapts
+// its size to the packets read, see adapt. It is allocated by the first
+// read.
+type readBuffer struct {
+	rd       io.Reader
+	buf      []byte
+	r, w     int   // the buffered data is buf[r:w]
+	err      error // of the last read, returned once the data before it was
+	min, max int
+	small    int // packets in a row that fit in a quarter of buf
+}
+
+func (b *readBuffer) ReadByte() (byte, error) {
+	for b.r == b.w {
+		if b.err != nil {
+			return 0, b.readErr()
+		}
+		b.fill()
+	}
+	c := b.buf[b.r]
+	b.r++
+	return c, nil
+}
+
+func (b *readBuffer) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if b.r == b.w {
+		if b.err != nil {
+			return 0, b.readErr()
+		}
+		if len(p) >= max(len(b.buf), b.min) {
+			// Large reads go to p directly instead of through the buffer
+			return b.rd.Read(p)
+		}
+		b.fill()
+		if b.r == b.w {
+			return 0, b.readErr()
+		}
+	}
+	n := copy(p, b.buf[b.r:b.w])
+	b.r += n
+	return n, nil
+}
+
+// take consumes the next n bytes from the buffer, reading them first as
+// needed. It returns false if they don't fit in the buffer. The bytes are
+// only valid until the next read.
+func (b *readBuffer) take(n int) ([]byte, bool, error) {
+	if n > len(b.buf) {
+		return nil, false, nil
+	}
+	for b.w-b.r < n {
+		if b.err != nil {
+			err := b.readErr()
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, true, err
+		}
+		b.fill()
+	}
+	p := b.buf[b.r : b.r+n]
+	b.r += n
+	return p, true, nil
+}
+
+// fill moves the buffered data to the start of the buffer and reads more
+// after it
+func (b *readBuffer) fill() {
+	if b.buf == nil {
+		b.buf = make([]byte, b.min)
+	}
+	if b.r > 0 {
+		b.w = copy(b.buf, b.buf[b.r:b.w])
+		b.r = 0
+	}
+	for range maxEmptyReads {
+		n, err := b.rd.Read(b.buf[b.w:])
+		b.w += n
+		if err != nil {
+			b.err = err
+			return
+		}
+		if n > 0 {
+			return
+		}
+	}
+	b.err = io.ErrNoProgress
+}
+
+func (b *readBuffer) readErr() error {
+	err := b.err
+	b.err = nil
+	return err
+}
+
+// adapt sizes the buffer for the n bytes of a packet that follow its
+// fixed header. A packet larger than the buffer grows it to the next
+// power of two, up to max, so that the packet can be read at once. After shrinkAfter packets
+// in a row that would have fit in a quarter of it, the buffer is halved,
+// down to min.
+func (b *readBuffer) adapt(n int) {
+	size := len(b.buf)
+	switch {
+	case n > size && size < b.max:
+		b.resize(min(b.max, 1<<bits.Len(uint(n-1))))
+		b.small = 0
+	case n <= size/4 && size > b.min:
+		b.small++
+		if b.small >= shrinkAfter && b.w-b.r <= size/2 {
+			b.resize(max(b.min, size/2))
+			b.small = 0
+		}
+	default:
+		b.small = 0
+	}
+}
+
+func (b *readBuffer) resize(size int) {
+	buf := make([]byte, size)
+	b.w = copy(buf, b.buf[b.r:b.w])
+	b.r = 0
+	b.buf = buf
+}
@@ -0,0 +1,165 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/logger"
+)
+
+// ErrNoDeadline is returned by Reader.SetReadDeadline and by
+// ReadPacketContext with a cancelable context if the underlying reader
+// does not support deadlines
+var ErrNoDeadline = errors.New("Reader does not support read deadlines")
+
+// Reader reads the packets of a connection through a buffer, so the fixed
+// header and the rest of a small packet take a single read from the
+// connection. Packets are only decoded once they were read in full,
+// however the connection fragments them, and the buffer they are decoded
+// from is reused for the next packet.
+//
+// The buffer starts at MinBufferSize and adapts to the packets read:
+// larger packets grow it up to MaxBufferSize, a run of small ones shrinks
+// it again. A connection that only sends small packets thus pins little
+// memory.
+//
+// A Reader must be used for every read of a connection once it was
+// created, as it may have buffered data beyond the packet just returned.
+type Reader struct {
+	// Version is the protocol version packets are decoded with. CONNECT
+	// packets are decoded according to the protocol level they announce.
+	Version ProtocolVersion
+	// MaxPacketSize limits the size of a packet, fixed header included.
+	// Larger packets are rejected with ErrPayloadTooLarge before anything
+	// is allocated for them; the rest of the packet is left unread, so
+	// the connection should be closed. 0 means no limit.
+	MaxPacketSize int
+	// Logger receives a debug entry for every packet read. May be nil.
+	Logger logger.Logger
+	// TopicAliasMaximum is the highest topic alias the peer may use, as
+	// announced to it in CONNECT or CONNACK. PUBLISH packets are returned
+	// with the topic their alias stands for and without the alias. 0
+	// allows no aliases.
+	TopicAliasMaximum uint16
+	// MinBufferSize and MaxBufferSize bound the size of the read buffer.
+	// They default to 256 bytes and 64 KiB. Packets larger than
+	// MaxBufferSize are read into a pooled buffer of their own.
+	MinBufferSize int
+	MaxBufferSize int
+
+	rd      io.Reader
+	buf     readBuffer
+	pr      bytes.Reader // parses the packets read into buf
+	aliases map[uint16]string
+}
+
+// NewReader returns a Reader for an MQTT 3.1.1 connection
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		Version: ProtocolVersion311,
+		rd:      r,
+		buf:     readBuffer{rd: r},
+	}
+}
+
+// ReadPacket reads the next packet
+func (r *Reader) ReadPacket() (p ControlPacket, err error) {
+	r.buf.min, r.buf.max = r.MinBufferSize, r.MaxBufferSize
+	if r.buf.min <= 0 {
+		r.buf.min = defaultMinReadBuffer
+	}
+	if r.buf.max <= 0 {
+		r.buf.max = defaultMaxReadBuffer
+	}
+	r.buf.max = max(r.buf.max, r.buf.min)
+
+	fh, err := getFixedHeader(&r.buf)
+	if err != nil {
+		return nil, err
+	}
+	if size := fh.size(); r.MaxPacketSize > 0 && size > r.MaxPacketSize {
+		err = fmt.Errorf("%w: %v bytes, the limit is %v", ErrPayloadTooLarge, size, r.MaxPacketSize)
+	} else {
+		p, err = r.decode(fh)
+	}
+	if publish, ok := p.(*PublishControlPacket); ok && err == nil {
+		if err = r.resolveAlias(publish); err != nil {
+			p = nil
+		}
+	}
+
+	if r.Logger != nil {
+		fields := []logger.Field{
+			logger.F("type", fh.ControlPacketType),
+			logger.F("remaining_length", fh.RemainingLength),
+		}
+		if err != nil {
+			fields = append(fields, logger.F("error", err))
+		}
+		r.Logger.Log(logger.LevelDebug, "packet: read", fields...)
+	}
+	return p, err
+}
+
+// decode reads and decodes the rest of the packet fh starts. A packet that
+// fits in the buffer is decoded from it, larger ones are read into a
+// pooled decodeBuffer.
+func (r *Reader) decode(fh FixedHeader) (ControlPacket, error) {
+	r.buf.adapt(fh.RemainingLength)
+	rest, ok, err := r.buf.take(fh.RemainingLength)
+	if !ok {
+		return readRemaining(&r.buf, fh, r.Version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.pr.Reset(rest)
+	defer r.pr.Reset(nil)
+	return parseToConcretePacket(&r.pr, fh, r.Version)
+}
+
+// ReadPacketContext reads the next packet like ReadPacket, but returns
+// early with ctx.Err() once ctx is done, see the ReadPacketContext
+// function. Like a read that timed out, a cancelled read may have
+// consumed part of a packet, so the connection should be closed.
+func (r *Reader) ReadPacketContext(ctx context.Context) (ControlPacket, error) {
+	return readContext(ctx, r.rd, r.ReadPacket)
+}
+
+// SetReadDeadline sets the deadline for reads from the underlying
+// reader, e.g. a net.Conn. A zero t means reads will not time out. A read
+// that timed out returns a net.Error and leaves the connection in an
+// undefined state, so it should be closed.
+func (r *Reader) SetReadDeadline(t time.Time) error {
+	if dr, ok := r.rd.(deadlineReader); ok {
+		return dr.SetReadDeadline(t)
+	}
+	return ErrNoDeadline
+}
+
+// Buffered returns the number of bytes that were read from the connection
+// but not yet returned as part of a packet
+func (r *Reader) Buffered() int {
+	return r.buf.w - r.buf.r
+}
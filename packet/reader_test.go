@@ -0,0 +1,176 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReaderFragmented(t *testing.T) {
+	connect := &ConnectControlPacket{
+		VariableHeader: ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: 4,
+			ConnectFlags:  ConnectFlags{CleanSession: true},
+			KeepAlive:     30,
+		},
+		ConnectPayload: ConnectPayload{ClientID: "fragmented"},
+	}
+	publish := NewPublish("a/b", 0, []byte("payload"))
+
+	var stream []byte
+	for _, p := range []ControlPacket{connect, publish, NewPingReqControlPacket()} {
+		b, err := p.Encode()
+		assert.NoError(t, err)
+		stream = append(stream, b...)
+	}
+
+	// Every read returns a single byte, as a badly fragmented TCP stream may
+	r := NewReader(iotest.OneByteReader(bytes.NewReader(stream)))
+
+	p, err := r.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, connect, p)
+
+	p, err = r.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, publish, p)
+
+	p, err = r.ReadPacket()
+	assert.NoError(t, err)
+	assert.IsType(t, &PingReqControlPacket{}, p)
+
+	_, err = r.ReadPacket()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReaderTruncated(t *testing.T) {
+	b, err := NewPublish("a/b", 0, []byte("payload")).Encode()
+	assert.NoError(t, err)
+
+	r := NewReader(bytes.NewReader(b[:len(b)-1]))
+	_, err = r.ReadPacket()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestReaderDeadline(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close() // nolint: errcheck
+	defer client.Close() // nolint: errcheck
+
+	r := NewReader(server)
+	assert.NoError(t, r.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err := r.ReadPacket()
+	ne, ok := err.(net.Error)
+	assert.True(t, ok)
+	assert.True(t, ne.Timeout())
+
+	assert.Equal(t, ErrNoDeadline, NewReader(&bytes.Buffer{}).SetReadDeadline(time.Time{}))
+}
+
+// repeatReader returns b over and over again
+type repeatReader struct {
+	b   []byte
+	off int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.b[r.off:])
+	r.off = (r.off + n) % len(r.b)
+	return n, nil
+}
+
+func TestReaderAllocations(t *testing.T) {
+	publish := NewPublish("a/b", 1, []byte("payload"))
+	publish.FixedHeaderFlags.QoS = QoSLevelAtLeastOnce
+	b, err := publish.Encode()
+	assert.NoError(t, err)
+
+	r := NewReader(&repeatReader{b: b})
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := r.ReadPacket(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	// The packet, its topic and its payload
+	assert.Equal(t, 3.0, allocs)
+
+	b, err = NewPubAckControlPacket(1).Encode()
+	assert.NoError(t, err)
+	r = NewReader(&repeatReader{b: b})
+	allocs = testing.AllocsPerRun(100, func() {
+		if _, err := r.ReadPacket(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Equal(t, 1.0, allocs)
+}
+
+func TestReaderBufferSize(t *testing.T) {
+	encode := func(payload int) []byte {
+		b, err := NewPublish("a/b", 0, bytes.Repeat([]byte{'x'}, payload)).Encode()
+		assert.NoError(t, err)
+		return b
+	}
+	var stream bytes.Buffer
+	stream.Write(encode(10))
+	stream.Write(encode(3000))
+	for range 4 * shrinkAfter {
+		stream.Write(encode(10))
+	}
+	stream.Write(encode(100 << 10))
+	stream.Write(encode(10))
+
+	// A read per byte leaves no data in the buffer that prevents shrinking
+	r := NewReader(iotest.OneByteReader(&stream))
+	r.MaxBufferSize = 64 << 10
+	sizes := func(n int) []int {
+		var sizes []int
+		for range n {
+			p, err := r.ReadPacket()
+			assert.NoError(t, err)
+			assert.IsType(t, &PublishControlPacket{}, p)
+			sizes = append(sizes, len(r.buf.buf))
+		}
+		return sizes
+	}
+	assert.Equal(t, []int{256, 4096}, sizes(2), "grown to fit the packet")
+	shrunk := sizes(4 * shrinkAfter)
+	assert.Equal(t, 2048, shrunk[shrinkAfter-1], "halved after a run of small packets")
+	assert.Equal(t, 256, shrunk[len(shrunk)-1])
+
+	// Packets beyond the maximum are read past the buffer
+	p, err := r.ReadPacket()
+	assert.NoError(t, err)
+	assert.Len(t, p.(*PublishControlPacket).Payload, 100<<10)
+	assert.Equal(t, 64<<10, len(r.buf.buf))
+	assert.Equal(t, []int{64 << 10}, sizes(1))
+}
+
+func TestReaderMaxPacketSize(t *testing.T) {
+	b, err := NewPublish("a/b", 0, make([]byte, 100)).Encode()
+	assert.NoError(t, err)
+
+	r := NewReader(bytes.NewReader(b))
+	r.MaxPacketSize = len(b)
+	_, err = r.ReadPacket()
+	assert.NoError(t, err)
+
+	r = NewReader(bytes.NewReader(b))
+	r.MaxPacketSize = len(b) - 1
+	_, err = r.ReadPacket()
+	assert.True(t, errors.Is(err, ErrPayloadTooLarge))
+	assert.Equal(t, ReasonCodePacketTooLarge, ReasonCodeOf(err))
+
+	// A CONNECT claiming 256 MB is refused from its fixed header alone
+	r = NewReader(bytes.NewReader([]byte{CONNECT << 4, 0xff, 0xff, 0xff, 0x7f}))
+	r.MaxPacketSize = 1024
+	_, err = r.ReadPacket()
+	assert.True(t, errors.Is(err, ErrPayloadTooLarge))
+}
@@ -0,0 +1,342 @@
+package packet
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// generator builds random but valid packets for the round trip tests
+type generator struct {
+	*rand.Rand
+	version ProtocolVersion
+}
+
+func (g generator) v5() bool {
+	return g.version == ProtocolVersion5
+}
+
+func (g generator) chance() bool {
+	return g.Intn(3) == 0
+}
+
+// str returns a string of up to max characters, multi-byte ones included
+func (g generator) str(max int) string {
+	const alphabet = "abcxyz019 -_/$é€😀"
+	runes := []rune(alphabet)
+	var b strings.Builder
+	for n := g.Intn(max + 1); n > 0; n-- {
+		b.WriteRune(runes[g.Intn(len(runes))])
+	}
+	return b.String()
+}
+
+func (g generator) bin(max int) []byte {
+	b := make([]byte, g.Intn(max+1))
+	g.Read(b)
+	return b
+}
+
+func (g generator) level() string {
+	return strings.Trim(strings.NewReplacer("/", "", "+", "", "#", "").Replace(g.str(6)), " ") + "x"
+}
+
+func (g generator) topic() string {
+	levels := make([]string, 1+g.Intn(4))
+	for i := range levels {
+		levels[i] = g.level()
+	}
+	return strings.Join(levels, "/")
+}
+
+func (g generator) filter() string {
+	levels := make([]string, 1+g.Intn(4))
+	for i := range levels {
+		switch g.Intn(4) {
+		case 0:
+			levels[i] = "+"
+		default:
+			levels[i] = g.level()
+		}
+	}
+	if g.chance() {
+		levels = append(levels, "#")
+	}
+	return strings.Join(levels, "/")
+}
+
+func (g generator) packetID() uint16 {
+	return uint16(1 + g.Intn(65535))
+}
+
+func (g generator) qos() QosLevel {
+	return QosLevel(g.Intn(3))
+}
+
+// props returns random properties allowed in packets of type t, nil on
+// MQTT 3.1.1
+func (g generator) props(t ControlPacketType) *Properties {
+	if !g.v5() {
+		return nil
+	}
+	p := &Properties{}
+	// In order of the identifiers, so a seed always gives the same packets
+	for id := PropPayloadFormatIndicator; id <= PropSharedSubscriptionAvailable; id++ {
+		if !propertyAllowed(id, t) || !g.chance() {
+			continue
+		}
+		switch id {
+		case PropPayloadFormatIndicator:
+			p.PayloadFormatIndicator = Byte(byte(g.Intn(2)))
+		case PropMessageExpiryInterval:
+			p.MessageExpiryInterval = Uint32(g.Uint32())
+		case PropContentType:
+			p.ContentType = g.str(10) + "x"
+		case PropResponseTopic:
+			p.ResponseTopic = g.topic()
+		case PropCorrelationData:
+			p.CorrelationData = g.bin(10)
+		case PropSubscriptionIdentifier:
+			p.SubscriptionIdentifiers = []int{1 + g.Intn(MaxRemainingLength)}
+		case PropSessionExpiryInterval:
+			p.SessionExpiryInterval = Uint32(g.Uint32())
+		case PropAssignedClientIdentifier:
+			p.AssignedClientIdentifier = g.str(10) + "x"
+		case PropServerKeepAlive:
+			p.ServerKeepAlive = Uint16(uint16(g.Intn(65536)))
+		case PropAuthenticationMethod:
+			p.AuthenticationMethod = g.str(10) + "x"
+		case PropAuthenticationData:
+			p.AuthenticationData = g.bin(10)
+		case PropRequestProblemInformation:
+			p.RequestProblemInformation = Byte(byte(g.Intn(2)))
+		case PropWillDelayInterval:
+			p.WillDelayInterval = Uint32(g.Uint32())
+		case PropRequestResponseInformation:
+			p.RequestResponseInformation = Byte(byte(g.Intn(2)))
+		case PropResponseInformation:
+			p.ResponseInformation = g.str(10) + "x"
+		case PropServerReference:
+			p.ServerReference = g.str(10) + "x"
+		case PropReasonString:
+			p.ReasonString = g.str(10) + "x"
+		case PropReceiveMaximum:
+			p.ReceiveMaximum = Uint16(g.packetID())
+		case PropTopicAliasMaximum:
+			p.TopicAliasMaximum = Uint16(uint16(g.Intn(65536)))
+		case PropTopicAlias:
+			p.TopicAlias = Uint16(g.packetID())
+		case PropMaximumQoS:
+			p.MaximumQoS = Byte(byte(g.Intn(2)))
+		case PropRetainAvailable:
+			p.RetainAvailable = Byte(byte(g.Intn(2)))
+		case PropUserProperty:
+			for n := 1 + g.Intn(3); n > 0; n-- {
+				p.UserProperties = append(p.UserProperties, UserProperty{Key: g.str(5), Value: g.str(5)})
+			}
+		case PropMaximumPacketSize:
+			p.MaximumPacketSize = Uint32(1 + g.Uint32()%(1<<31))
+		case PropWildcardSubscriptionAvailable:
+			p.WildcardSubscriptionAvailable = Byte(byte(g.Intn(2)))
+		case PropSubscriptionIdentifierAvailable:
+			p.SubscriptionIdentifierAvailable = Byte(byte(g.Intn(2)))
+		case PropSharedSubscriptionAvailable:
+			p.SharedSubscriptionAvailable = Byte(byte(g.Intn(2)))
+		}
+	}
+	return p
+}
+
+// reasonCode returns a reason code on MQTT 5 and 0 otherwise
+func (g generator) reasonCode(codes ...byte) byte {
+	if !g.v5() {
+		return 0
+	}
+	return codes[g.Intn(len(codes))]
+}
+
+func (g generator) connect() ControlPacket {
+	p := &ConnectControlPacket{
+		VariableHeader: ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(g.version),
+			KeepAlive:     g.Intn(65536),
+			Properties:    g.props(CONNECT),
+		},
+		ConnectPayload: ConnectPayload{ClientID: g.str(23)},
+	}
+	if g.version == ProtocolVersion311 && g.chance() {
+		p.VariableHeader.ProtocolName = "MQIsdp"
+		p.VariableHeader.ProtocolLevel = byte(ProtocolVersion31)
+	}
+
+	flags := &p.VariableHeader.ConnectFlags
+	flags.CleanSession = g.Intn(2) == 0
+	if g.Intn(2) == 0 {
+		flags.WillFlag = true
+		flags.WillQoS = byte(g.qos())
+		flags.WillRetain = g.Intn(2) == 0
+		p.ConnectPayload.WillProperties = g.props(willProperties)
+		p.ConnectPayload.WillTopic = g.topic()
+		p.ConnectPayload.WillMessage = g.bin(20)
+	}
+	if g.Intn(2) == 0 {
+		flags.UserName = true
+		p.ConnectPayload.UserName = g.str(10)
+	}
+	if g.Intn(2) == 0 && (flags.UserName || g.v5()) {
+		flags.Password = true
+		p.ConnectPayload.Password = g.bin(10)
+	}
+	return p
+}
+
+func (g generator) connack() ControlPacket {
+	p := NewConnAck(g.reasonCode(ReasonCodeSuccess, ReasonCodeNotAuthorized, ReasonCodeServerBusy), g.Intn(2) == 0)
+	if !g.v5() {
+		p.VariableHeader.ReturnCode = byte(g.Intn(6))
+	}
+	p.VariableHeader.Properties = g.props(CONNACK)
+	return p
+}
+
+func (g generator) publish() ControlPacket {
+	payload := g.bin(100)
+	if len(payload) == 0 {
+		payload = nil // as decoded
+	}
+	p := NewPublish(g.topic(), 0, payload)
+	p.FixedHeaderFlags.QoS = g.qos()
+	if p.FixedHeaderFlags.QoS != QoSLevelNone {
+		p.VariableHeader.PacketID = int(g.packetID())
+		p.FixedHeaderFlags.Dup = g.Intn(2) == 0
+	}
+	p.FixedHeaderFlags.Retain = g.Intn(2) == 0
+	p.VariableHeader.Properties = g.props(PUBLISH)
+	return p
+}
+
+func (g generator) subscribe() ControlPacket {
+	p := &SubscribeControlPacket{
+		VariableHeader: SubscribeVariableHeader{PacketID: int(g.packetID()), Properties: g.props(SUBSCRIBE)},
+	}
+	for n := 1 + g.Intn(4); n > 0; n-- {
+		sub := Subscription{Topic: g.filter(), QoS: g.qos()}
+		if g.v5() {
+			sub.NoLocal = g.Intn(2) == 0
+			sub.RetainAsPublished = g.Intn(2) == 0
+			sub.RetainHandling = byte(g.Intn(3))
+		}
+		p.Payload.Subscriptions = append(p.Payload.Subscriptions, sub)
+	}
+	return p
+}
+
+func (g generator) suback() ControlPacket {
+	codes := []byte{ReturncodeSuccessQoS0, ReturncodeSuccessQoS1, ReturncodeSuccessQoS2, ReturncodeFailure}
+	if g.v5() {
+		codes = append(codes, ReasonCodeNotAuthorized, ReasonCodeTopicFilterInvalid, ReasonCodeQuotaExceeded)
+	}
+	returnCodes := make([]byte, 1+g.Intn(4))
+	for i := range returnCodes {
+		returnCodes[i] = codes[g.Intn(len(codes))]
+	}
+	p := NewSubAck(g.packetID(), returnCodes)
+	p.VariableHeader.Properties = g.props(SUBACK)
+	return p
+}
+
+func (g generator) unsubscribe() ControlPacket {
+	filters := make([]string, 1+g.Intn(4))
+	for i := range filters {
+		filters[i] = g.filter()
+	}
+	p := NewUnsubscribe(g.packetID(), filters)
+	p.VariableHeader.Properties = g.props(UNSUBSCRIBE)
+	return p
+}
+
+func (g generator) unsuback() ControlPacket {
+	p := NewUnsubAck(g.packetID())
+	p.VariableHeader.Properties = g.props(UNSUBACK)
+	if g.v5() {
+		for n := 1 + g.Intn(4); n > 0; n-- {
+			p.Payload.ReasonCodes = append(p.Payload.ReasonCodes, g.reasonCode(ReasonCodeSuccess, ReasonCodeNoSubscriptionExisted, ReasonCodeNotAuthorized))
+		}
+	}
+	return p
+}
+
+func (g generator) disconnect() ControlPacket {
+	p := NewDisconnectControlPacket()
+	p.VariableHeader.ReasonCode = g.reasonCode(ReasonCodeNormalDisconnection, ReasonCodeDisconnectWithWillMessage, ReasonCodeKeepAliveTimeout)
+	p.VariableHeader.Properties = g.props(DISCONNECT)
+	return p
+}
+
+func TestRoundTrip(t *testing.T) {
+	const iterations = 200
+	acks := []byte{ReasonCodeSuccess, ReasonCodeNoMatchingSubscribers, ReasonCodeUnspecifiedError, ReasonCodeNotAuthorized}
+
+	packets := map[string]func(g generator) ControlPacket{
+		"CONNECT":     generator.connect,
+		"CONNACK":     generator.connack,
+		"PUBLISH":     generator.publish,
+		"SUBSCRIBE":   generator.subscribe,
+		"SUBACK":      generator.suback,
+		"UNSUBSCRIBE": generator.unsubscribe,
+		"UNSUBACK":    generator.unsuback,
+		"DISCONNECT":  generator.disconnect,
+		"PUBACK": func(g generator) ControlPacket {
+			p := NewPubAckControlPacket(g.packetID())
+			p.VariableHeader.ReasonCode = g.reasonCode(acks...)
+			p.VariableHeader.Properties = g.props(PUBACK)
+			return p
+		},
+		"PUBREC": func(g generator) ControlPacket {
+			p := NewPubRecControlPacket(g.packetID())
+			p.VariableHeader.ReasonCode = g.reasonCode(acks...)
+			p.VariableHeader.Properties = g.props(PUBREC)
+			return p
+		},
+		"PUBREL": func(g generator) ControlPacket {
+			p := NewPubRelControlPacket(g.packetID())
+			p.VariableHeader.ReasonCode = g.reasonCode(ReasonCodeSuccess, ReasonCodePacketIdentifierNotFound)
+			p.VariableHeader.Properties = g.props(PUBREL)
+			return p
+		},
+		"PUBCOMP": func(g generator) ControlPacket {
+			p := NewPubCompControlPacket(g.packetID())
+			p.VariableHeader.ReasonCode = g.reasonCode(ReasonCodeSuccess, ReasonCodePacketIdentifierNotFound)
+			p.VariableHeader.Properties = g.props(PUBCOMP)
+			return p
+		},
+		"PINGREQ":  func(g generator) ControlPacket { return NewPingReqControlPacket() },
+		"PINGRESP": func(g generator) ControlPacket { return NewPingRespControlPacket() },
+	}
+
+	for _, version := range []ProtocolVersion{ProtocolVersion311, ProtocolVersion5} {
+		for name, generate := range packets {
+			t.Run(fmt.Sprintf("v%d/%s", version, name), func(t *testing.T) {
+				g := generator{Rand: rand.New(rand.NewSource(int64(version))), version: version}
+				for i := 0; i < iterations; i++ {
+					p := generate(g)
+					var buf bytes.Buffer
+					require.NoError(t, WritePacket(&buf, p), "%+v", p)
+					encoded := buf.Bytes()
+
+					decoded, err := ReadPacketVersion(bytes.NewReader(encoded), version)
+					require.NoError(t, err, "%x", encoded)
+					if !assert.Equal(t, p, decoded, "%x", encoded) {
+						return
+					}
+				}
+			})
+		}
+	}
+}
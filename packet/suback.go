@@ -3,6 +3,7 @@ package packet
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 )
 
@@ -14,9 +15,12 @@ type SubAckControlPacket struct {
 
 type SubAckVariableHeader struct {
 	PacketID uint16
+	// MQTT 5 only, the packet is encoded as MQTT 3.1.1 if Properties is nil
+	Properties *Properties
 }
 
 type SubAckPayload struct {
+	// ReturnCodes holds the reason codes on MQTT 5
 	ReturnCodes []byte
 }
 
@@ -48,7 +52,55 @@ func NewSubAck(packetID uint16, returnCodes []byte) *SubAckControlPacket {
 	}
 }
 
-// TODO deserializing
+func readSubAck(r io.Reader, fh FixedHeader, version ProtocolVersion) (*SubAckControlPacket, error) {
+	packetID, err := readUint16(r)
+	if err != nil {
+		return nil, err
+	}
+	vh := SubAckVariableHeader{PacketID: uint16(packetID)}
+	vhLength := 2
+
+	if version == ProtocolVersion5 {
+		var n int
+		vh.Properties, n, err = readProperties(r, SUBACK)
+		if err != nil {
+			return nil, err
+		}
+		vhLength += n
+	}
+
+	if fh.RemainingLength <= vhLength {
+		return nil, fmt.Errorf("%w for SUBACK, it must contain at least one return code", ErrInvalidRemainingLength)
+	}
+
+	returnCodes := make([]byte, fh.RemainingLength-vhLength)
+	if _, err = io.ReadFull(r, returnCodes); err != nil {
+		return nil, err
+	}
+	for _, code := range returnCodes {
+		if !validSubAckCode(code, version) {
+			return nil, fmt.Errorf("%w for SUBACK: %v", ErrInvalidReasonCode, code)
+		}
+	}
+
+	return &SubAckControlPacket{
+		FixedHeader:    fh,
+		VariableHeader: vh,
+		Payload:        SubAckPayload{ReturnCodes: returnCodes},
+	}, nil
+}
+
+func validSubAckCode(code byte, version ProtocolVersion) bool {
+	switch code {
+	case ReturncodeSuccessQoS0, ReturncodeSuccessQoS1, ReturncodeSuccessQoS2, ReturncodeFailure:
+		return true
+	case ReasonCodeImplementationSpecificError, ReasonCodeNotAuthorized, ReasonCodeTopicFilterInvalid,
+		ReasonCodePacketIdentifierInUse, ReasonCodeQuotaExceeded, ReasonCodeSharedSubscriptionsNotSupported,
+		ReasonCodeSubscriptionIdentifiersNotSupported, ReasonCodeWildcardSubscriptionsNotSupported:
+		return version == ProtocolVersion5
+	}
+	return false
+}
 
 func (vh *SubAckVariableHeader) WriteTo(w io.Writer) (n int64, err error) {
 	b := make([]byte, 2)
@@ -57,23 +109,46 @@ func (vh *SubAckVariableHeader) WriteTo(w io.Writer) (n int64, err error) {
 	return io.Copy(w, bytes.NewReader(b))
 }
 
-func (p *SubAckControlPacket) WriteTo(w io.Writer) (n int64, err error) {
-	written, err := p.FixedHeader.WriteTo(w)
-	n += written
-	if err != nil {
-		return
+func (p *SubAckControlPacket) Encode() ([]byte, error) {
+	body := make([]byte, 0, 2+len(p.Payload.ReturnCodes))
+	body = appendUint16(body, p.VariableHeader.PacketID)
+	if p.VariableHeader.Properties != nil {
+		var err error
+		body, err = p.VariableHeader.Properties.encode(body, SUBACK)
+		if err != nil {
+			return nil, err
+		}
 	}
+	body = append(body, p.Payload.ReturnCodes...)
 
-	written, err = p.VariableHeader.WriteTo(w)
-	n += written
-	if err != nil {
-		return
-	}
+	p.FixedHeader.ControlPacketType = SUBACK
+	p.FixedHeader.Flags = 0
+	return p.FixedHeader.encode(body)
+}
 
-	wr, err := w.Write(p.Payload.ReturnCodes)
-	n += int64(wr)
-	if err != nil {
-		return n, err
+func (p *SubAckControlPacket) WriteTo(w io.Writer) (n int64, err error) {
+	return writeEncoded(w, p)
+}
+
+// Properties returns the MQTT 5 properties of p, nil for MQTT 3.1.1
+func (p *SubAckControlPacket) Properties() *Properties {
+	return p.VariableHeader.Properties
+}
+
+// WithProperties returns a copy of p with props, see Versioned. Without
+// properties, the MQTT 5 failure reason codes become the single failure
+// return code of MQTT 3.1.1.
+func (p *SubAckControlPacket) WithProperties(props *Properties) ControlPacket {
+	cp := *p
+	cp.VariableHeader.Properties = props
+	if props == nil {
+		cp.Payload.ReturnCodes = make([]byte, len(p.Payload.ReturnCodes))
+		for i, code := range p.Payload.ReturnCodes {
+			if code >= ReasonCodeUnspecifiedError {
+				code = ReturncodeFailure
+			}
+			cp.Payload.ReturnCodes[i] = code
+		}
 	}
-	return
+	return &cp
 }
@@ -1,13 +1,12 @@
 package packet
 
 import (
-	"errors"
+	"fmt"
 	"io"
 )
 
 type SubscribeControlPacket struct {
 	// Bits 3,2,1 and 0 of the fixed header of the SUBSCRIBE Control Packet are reserved and MUST be set to 0,0,1 and 0 respectively. The Server MUST treat any other value as malformed and close the Network Connection [MQTT-3.8.1-1].
-	// TODO fail packet deserializing when this is not the case
 	FixedHeader    FixedHeader
 	VariableHeader SubscribeVariableHeader // 2 Bytes
 	Payload        SubscribePayload
@@ -15,6 +14,8 @@ type SubscribeControlPacket struct {
 
 type SubscribeVariableHeader struct {
 	PacketID int // int16
+	// MQTT 5 only, the packet is encoded as MQTT 3.1.1 if Properties is nil
+	Properties *Properties
 }
 
 type SubscribePayload struct {
@@ -24,18 +25,79 @@ type SubscribePayload struct {
 type Subscription struct {
 	Topic string
 	QoS   QosLevel
+
+	// MQTT 5 subscription options
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    byte
+}
+
+func (s Subscription) encodeOptions() byte {
+	b := byte(s.QoS)
+	if s.NoLocal {
+		b |= 4
+	}
+	if s.RetainAsPublished {
+		b |= 8
+	}
+	return b | (s.RetainHandling&3)<<4
+}
+
+func (p *SubscribeControlPacket) Encode() ([]byte, error) {
+	body := appendUint16(nil, uint16(p.VariableHeader.PacketID))
+	v5 := p.VariableHeader.Properties != nil
+	if v5 {
+		var err error
+		body, err = p.VariableHeader.Properties.encode(body, SUBSCRIBE)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, sub := range p.Payload.Subscriptions {
+		if sub.QoS < QoSLevelNone || sub.QoS > QoSLevelExactlyOnce {
+			return nil, fmt.Errorf("Invalid QoS level for %v: %v", sub.Topic, sub.QoS)
+		}
+
+		var err error
+		body, err = appendString(body, sub.Topic)
+		if err != nil {
+			return nil, err
+		}
+		if v5 {
+			body = append(body, sub.encodeOptions())
+		} else {
+			body = append(body, byte(sub.QoS))
+		}
+	}
+
+	p.FixedHeader.ControlPacketType = SUBSCRIBE
+	p.FixedHeader.Flags = 2 // reserved bits, see [MQTT-3.8.1-1]
+	return p.FixedHeader.encode(body)
+}
+
+func (p *SubscribeControlPacket) WriteTo(w io.Writer) (n int64, err error) {
+	return writeEncoded(w, p)
 }
 
-func readSubscribeVariableHeader(r io.Reader) (n int, vh SubscribeVariableHeader, err error) {
+func readSubscribeVariableHeader(r io.Reader, version ProtocolVersion) (n int, vh SubscribeVariableHeader, err error) {
 	packetID, err := readUint16(r)
 	if err != nil {
 		return 0, SubscribeVariableHeader{}, err
 	}
+	vh.PacketID = packetID
+
+	if version == ProtocolVersion5 {
+		vh.Properties, n, err = readProperties(r, SUBSCRIBE)
+		if err != nil {
+			return 0, SubscribeVariableHeader{}, err
+		}
+	}
 
-	return 2, SubscribeVariableHeader{PacketID: packetID}, nil
+	return 2 + n, vh, nil
 }
 
-func readSubscribePayload(r io.Reader, remainingLength int) (n int, payload SubscribePayload, err error) {
+func readSubscribePayload(r io.Reader, remainingLength int, version ProtocolVersion) (n int, payload SubscribePayload, err error) {
 	for n < remainingLength {
 		topicLength, err := readUint16(r)
 		n += 2 // TODO get this info from readUint16, in case of errors it's maybe not exactly 2
@@ -43,39 +105,66 @@ func readSubscribePayload(r io.Reader, remainingLength int) (n int, payload Subs
 			return n, SubscribePayload{}, err
 		}
 
-		topic := make([]byte, topicLength)
-		bytesRead, err := io.ReadFull(r, topic)
-		n += bytesRead
+		topic, err := readString(r, topicLength)
 		if err != nil {
 			return n, SubscribePayload{}, err
 		}
+		n += topicLength
 
-		qos := make([]byte, 1)
-		bytesRead, err = io.ReadFull(r, qos)
-		n += bytesRead
+		qos, err := readByte(r)
 		if err != nil {
 			return n, SubscribePayload{}, err
 		}
+		n++
 
 		sub := Subscription{}
-		sub.Topic = string(topic)
+		sub.Topic = topic
+
+		if version == ProtocolVersion5 {
+			if qos&192 > 0 {
+				return n, SubscribePayload{}, fmt.Errorf("%w: reserved bits are non-zero", ErrInvalidSubscriptionOptions)
+			}
+			sub.NoLocal = qos&4 > 0
+			sub.RetainAsPublished = qos&8 > 0
+			sub.RetainHandling = qos >> 4 & 3
+			if sub.RetainHandling == 3 {
+				return n, SubscribePayload{}, fmt.Errorf("%w: retain handling must not be 3", ErrInvalidSubscriptionOptions)
+			}
+			qos &= 3
+		}
 
-		if qos[0]&252 > 0 {
-			return n, SubscribePayload{}, errors.New("Invalid Subscribe payload. Reserved bits of QoS are non-zero")
+		if qos&252 > 0 {
+			return n, SubscribePayload{}, fmt.Errorf("%w: reserved bits are non-zero", ErrInvalidSubscriptionOptions)
 		}
 
-		if qos[0]&1 > 0 && qos[0]&2 > 0 {
-			return n, SubscribePayload{}, errors.New("Invalid QoS level in payload. It is not allowed to set both bits")
+		if qos&1 > 0 && qos&2 > 0 {
+			return n, SubscribePayload{}, fmt.Errorf("%w: both bits for QoS are set", ErrInvalidQoS)
 		}
 
-		if qos[0]&1 > 0 {
+		if qos&1 > 0 {
 			sub.QoS = QoSLevelAtLeastOnce
-		} else if qos[0]&2 > 0 {
+		} else if qos&2 > 0 {
 			sub.QoS = QoSLevelExactlyOnce
 		} else {
 			sub.QoS = QoSLevelNone
 		}
 		payload.Subscriptions = append(payload.Subscriptions, sub)
 	}
+	if len(payload.Subscriptions) == 0 {
+		// [MQTT-3.8.3-3]
+		return n, payload, fmt.Errorf("%w: SUBSCRIBE without topic filters", ErrProtocolViolation)
+	}
 	return
 }
+
+// Properties returns the MQTT 5 properties of p, nil for MQTT 3.1.1
+func (p *SubscribeControlPacket) Properties() *Properties {
+	return p.VariableHeader.Properties
+}
+
+// WithProperties returns a copy of p with props, see Versioned
+func (p *SubscribeControlPacket) WithProperties(props *Properties) ControlPacket {
+	cp := *p
+	cp.VariableHeader.Properties = props
+	return &cp
+}
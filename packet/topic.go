@@ -0,0 +1,72 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxTopicLength is the longest topic name or filter in bytes, the limit
+// of every UTF-8 string field [MQTT-4.7.3-3]
+const MaxTopicLength = 65535
+
+// ValidateTopicName checks that name can be published to: not empty,
+// without wildcards and at most MaxTopicLength bytes long
+// [MQTT-4.7.1-1] [MQTT-4.7.3-1] [MQTT-4.7.3-2].
+func ValidateTopicName(name string) error {
+	if err := validateTopic(name); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTopicName, err)
+	}
+	if strings.ContainsAny(name, "+#") {
+		return fmt.Errorf("%w: %q contains wildcards", ErrInvalidTopicName, name)
+	}
+	return nil
+}
+
+// ValidateTopicFilter checks that filter can be subscribed to: not
+// empty, at most MaxTopicLength bytes long, with # only as the last level
+// and + only as a whole level [MQTT-4.7.1-2] [MQTT-4.7.1-3].
+func ValidateTopicFilter(filter string) error {
+	if err := validateTopic(filter); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTopicFilter, err)
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return fmt.Errorf("%w: %q has # other than as the last level", ErrInvalidTopicFilter, filter)
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return fmt.Errorf("%w: %q has + within a level", ErrInvalidTopicFilter, filter)
+		}
+	}
+	return nil
+}
+
+// validateTopic applies the rules topic names and filters share
+func validateTopic(s string) error {
+	switch {
+	case s == "":
+		return fmt.Errorf("empty topic")
+	case len(s) > MaxTopicLength:
+		return fmt.Errorf("topic is %d bytes long", len(s))
+	case strings.IndexByte(s, 0) >= 0:
+		return fmt.Errorf("topic contains U+0000")
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateTopicName(t *testing.T) {
+	for _, name := range []string{"a", "a/b", "/", "a//b", "$SYS/broker", strings.Repeat("a", MaxTopicLength)} {
+		assert.NoError(t, ValidateTopicName(name), name)
+	}
+	for _, name := range []string{"", "a/+", "#", "a/b#", "a\x00b", strings.Repeat("a", MaxTopicLength+1)} {
+		err := ValidateTopicName(name)
+		assert.True(t, errors.Is(err, ErrInvalidTopicName), "%q: %v", name, err)
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	for _, filter := range []string{"a", "a/b", "+", "#", "a/+/b", "a/#", "/", "+/+", "$share/g/a/#"} {
+		assert.NoError(t, ValidateTopicFilter(filter), filter)
+	}
+	for _, filter := range []string{"", "a#", "a/#/b", "a+", "a/b+/c", "#/a", "a\x00", strings.Repeat("a", MaxTopicLength+1)} {
+		err := ValidateTopicFilter(filter)
+		assert.True(t, errors.Is(err, ErrInvalidTopicFilter), "%q: %v", filter, err)
+	}
+}
+
+func TestReadInvalidTopicFilter(t *testing.T) {
+	// Topic filters are validated by the broker, per filter
+	for _, p := range []ControlPacket{
+		&SubscribeControlPacket{
+			VariableHeader: SubscribeVariableHeader{PacketID: 1},
+			Payload:        SubscribePayload{Subscriptions: []Subscription{{Topic: "a/#"}, {Topic: "a/#/b"}}},
+		},
+		NewUnsubscribe(2, []string{"a+"}),
+	} {
+		var buf bytes.Buffer
+		require.NoError(t, WritePacket(&buf, p))
+		decoded, err := ReadPacket(&buf)
+		require.NoError(t, err, "%T", p)
+		assert.Equal(t, p, decoded)
+	}
+}
+
+func TestReadPublishTopicAlias(t *testing.T) {
+	p := NewPublish("", 0, []byte("x"))
+	p.VariableHeader.Properties = &Properties{TopicAlias: Uint16(1)}
+	var buf bytes.Buffer
+	require.NoError(t, WritePacket(&buf, p))
+	decoded, err := ReadPacketVersion(&buf, ProtocolVersion5)
+	require.NoError(t, err)
+	assert.Equal(t, "", decoded.(*PublishControlPacket).Topic())
+
+	p.VariableHeader.Properties = &Properties{}
+	buf.Reset()
+	require.NoError(t, WritePacket(&buf, p))
+	_, err = ReadPacketVersion(&buf, ProtocolVersion5)
+	assert.True(t, errors.Is(err, ErrInvalidTopicName), "empty topic without alias: %v", err)
+}
@@ -0,0 +1,137 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"fmt"
+	"io"
+)
+
+type UnsubAckControlPacket struct {
+	FixedHeader    FixedHeader
+	VariableHeader UnsubAckVariableHeader
+	Payload        UnsubAckPayload // MQTT 5 only
+}
+
+type UnsubAckVariableHeader struct {
+	PacketID uint16
+	// MQTT 5 only, the packet is encoded as MQTT 3.1.1 if Properties is nil
+	Properties *Properties
+}
+
+type UnsubAckPayload struct {
+	ReasonCodes []byte
+}
+
+func readUnsubAck(r io.Reader, fh FixedHeader, version ProtocolVersion) (*UnsubAckControlPacket, error) {
+	if version != ProtocolVersion5 {
+		packetID, err := readPacketID(r, fh)
+		if err != nil {
+			return nil, err
+		}
+		return &UnsubAckControlPacket{
+			FixedHeader:    fh,
+			VariableHeader: UnsubAckVariableHeader{PacketID: packetID},
+		}, nil
+	}
+
+	packetID, err := readUint16(r)
+	if err != nil {
+		return nil, err
+	}
+	props, n, err := readProperties(r, UNSUBACK)
+	if err != nil {
+		return nil, err
+	}
+	if fh.RemainingLength <= 2+n {
+		return nil, fmt.Errorf("%w for UNSUBACK, it must contain at least one reason code", ErrInvalidRemainingLength)
+	}
+
+	reasonCodes := make([]byte, fh.RemainingLength-2-n)
+	if _, err = io.ReadFull(r, reasonCodes); err != nil {
+		return nil, err
+	}
+	for _, code := range reasonCodes {
+		if !validUnsubAckCode(code) {
+			return nil, fmt.Errorf("%w for UNSUBACK: %v", ErrInvalidReasonCode, code)
+		}
+	}
+
+	return &UnsubAckControlPacket{
+		FixedHeader: fh,
+		VariableHeader: UnsubAckVariableHeader{
+			PacketID:   uint16(packetID),
+			Properties: props,
+		},
+		Payload: UnsubAckPayload{ReasonCodes: reasonCodes},
+	}, nil
+}
+
+func validUnsubAckCode(code byte) bool {
+	switch code {
+	case ReasonCodeSuccess, ReasonCodeNoSubscriptionExisted, ReasonCodeUnspecifiedError,
+		ReasonCodeImplementationSpecificError, ReasonCodeNotAuthorized, ReasonCodeTopicFilterInvalid,
+		ReasonCodePacketIdentifierInUse:
+		return true
+	}
+	return false
+}
+
+func (p *UnsubAckControlPacket) Encode() ([]byte, error) {
+	body := appendUint16(nil, p.VariableHeader.PacketID)
+	if p.VariableHeader.Properties != nil {
+		var err error
+		body, err = p.VariableHeader.Properties.encode(body, UNSUBACK)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, p.Payload.ReasonCodes...)
+	}
+
+	p.FixedHeader.ControlPacketType = UNSUBACK
+	p.FixedHeader.Flags = 0
+	return p.FixedHeader.encode(body)
+}
+
+func (p *UnsubAckControlPacket) WriteTo(w io.Writer) (n int64, err error) {
+	return writeEncoded(w, p)
+}
+
+func NewUnsubAck(packetID uint16) *UnsubAckControlPacket {
+	return &UnsubAckControlPacket{
+		FixedHeader: FixedHeader{
+			ControlPacketType: UNSUBACK,
+			RemainingLength:   2,
+		},
+		VariableHeader: UnsubAckVariableHeader{
+			PacketID: packetID,
+		},
+	}
+}
+
+// Properties returns the MQTT 5 properties of p, nil for MQTT 3.1.1
+func (p *UnsubAckControlPacket) Properties() *Properties {
+	return p.VariableHeader.Properties
+}
+
+// WithProperties returns a copy of p with props, see Versioned
+func (p *UnsubAckControlPacket) WithProperties(props *Properties) ControlPacket {
+	cp := *p
+	cp.VariableHeader.Properties = props
+	return &cp
+}
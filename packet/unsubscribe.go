@@ -0,0 +1,133 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"fmt"
+	"io"
+)
+
+type UnsubscribeControlPacket struct {
+	FixedHeader    FixedHeader
+	VariableHeader UnsubscribeVariableHeader
+	Payload        UnsubscribePayload
+}
+
+type UnsubscribeVariableHeader struct {
+	PacketID int
+	// MQTT 5 only, the packet is encoded as MQTT 3.1.1 if Properties is nil
+	Properties *Properties
+}
+
+type UnsubscribePayload struct {
+	Topics []string
+}
+
+func readUnsubscribe(r io.Reader, fh FixedHeader, version ProtocolVersion) (*UnsubscribeControlPacket, error) {
+	packetID, err := readUint16(r)
+	if err != nil {
+		return nil, err
+	}
+
+	packet := &UnsubscribeControlPacket{
+		FixedHeader:    fh,
+		VariableHeader: UnsubscribeVariableHeader{PacketID: packetID},
+	}
+
+	n := 2
+	if version == ProtocolVersion5 {
+		var propsLength int
+		packet.VariableHeader.Properties, propsLength, err = readProperties(r, UNSUBSCRIBE)
+		if err != nil {
+			return nil, err
+		}
+		n += propsLength
+	}
+
+	for n < fh.RemainingLength {
+		topicLength, err := readUint16(r)
+		if err != nil {
+			return nil, err
+		}
+		topic, err := readString(r, topicLength)
+		if err != nil {
+			return nil, err
+		}
+		n += 2 + topicLength
+		packet.Payload.Topics = append(packet.Payload.Topics, topic)
+	}
+
+	// The payload of an UNSUBSCRIBE packet MUST contain at least one Topic Filter [MQTT-3.10.3-2]
+	if len(packet.Payload.Topics) == 0 {
+		return nil, fmt.Errorf("%w: UNSUBSCRIBE without topic filters", ErrProtocolViolation)
+	}
+	return packet, nil
+}
+
+func (p *UnsubscribeControlPacket) Encode() ([]byte, error) {
+	body := appendUint16(nil, uint16(p.VariableHeader.PacketID))
+	var err error
+	if p.VariableHeader.Properties != nil {
+		body, err = p.VariableHeader.Properties.encode(body, UNSUBSCRIBE)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, topic := range p.Payload.Topics {
+		body, err = appendString(body, topic)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.FixedHeader.ControlPacketType = UNSUBSCRIBE
+	p.FixedHeader.Flags = 2 // reserved bits, see [MQTT-3.10.1-1]
+	return p.FixedHeader.encode(body)
+}
+
+func (p *UnsubscribeControlPacket) WriteTo(w io.Writer) (n int64, err error) {
+	return writeEncoded(w, p)
+}
+
+func NewUnsubscribe(packetID uint16, topics []string) *UnsubscribeControlPacket {
+	return &UnsubscribeControlPacket{
+		FixedHeader: FixedHeader{
+			ControlPacketType: UNSUBSCRIBE,
+			Flags:             2,
+		},
+		VariableHeader: UnsubscribeVariableHeader{
+			PacketID: int(packetID),
+		},
+		Payload: UnsubscribePayload{
+			Topics: topics,
+		},
+	}
+}
+
+// Properties returns the MQTT 5 properties of p, nil for MQTT 3.1.1
+func (p *UnsubscribeControlPacket) Properties() *Properties {
+	return p.VariableHeader.Properties
+}
+
+// WithProperties returns a copy of p with props, see Versioned
+func (p *UnsubscribeControlPacket) WithProperties(props *Properties) ControlPacket {
+	cp := *p
+	cp.VariableHeader.Properties = props
+	return &cp
+}
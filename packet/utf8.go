@@ -0,0 +1,64 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf8"
+)
+
+// ErrInvalidUTF8 is returned for a string field that is not well-formed
+// UTF-8 or contains U+0000
+var ErrInvalidUTF8 = &Error{ReasonCodeMalformedPacket, "Invalid UTF-8 string"}
+
+var errShortUTF8String = fmt.Errorf("%w: UTF-8 string exceeds the packet", ErrMalformedPacket)
+
+// DecodeUTF8String decodes a UTF-8 encoded string as found in every
+// string field of MQTT: a two byte length followed by that many bytes of
+// UTF-8. It returns the string and the number of bytes consumed.
+//
+// The string must be well-formed UTF-8, which excludes the UTF-16
+// surrogates U+D800 to U+DFFF, and must not contain U+0000
+// [MQTT-1.5.3-1] [MQTT-1.5.3-2]. A U+FEFF is kept as it is [MQTT-1.5.3-3].
+func DecodeUTF8String(b []byte) (string, int, error) {
+	if len(b) < 2 {
+		return "", 0, errShortUTF8String
+	}
+	n := 2 + int(binary.BigEndian.Uint16(b))
+	if len(b) < n {
+		return "", 0, errShortUTF8String
+	}
+	if err := checkUTF8(b[2:n]); err != nil {
+		return "", 0, err
+	}
+	return string(b[2:n]), n, nil
+}
+
+// checkUTF8 applies the rules of DecodeUTF8String to the bytes of a string
+func checkUTF8(b []byte) error {
+	// utf8.Valid rejects encoded surrogates as well
+	if !utf8.Valid(b) {
+		return ErrInvalidUTF8
+	}
+	if bytes.IndexByte(b, 0) >= 0 {
+		return fmt.Errorf("%w: string contains U+0000", ErrInvalidUTF8)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeUTF8String(t *testing.T) {
+	s, n, err := DecodeUTF8String([]byte{0, 5, 'h', 0xc3, 0xa9, 'l', 'o', 'x'})
+	assert.NoError(t, err)
+	assert.Equal(t, "hélo", s)
+	assert.Equal(t, 7, n)
+
+	// U+FEFF must not be skipped or stripped
+	s, _, err = DecodeUTF8String([]byte{0, 3, 0xef, 0xbb, 0xbf})
+	assert.NoError(t, err)
+	assert.Equal(t, "\uFEFF", s)
+
+	for name, b := range map[string][]byte{
+		"Null":      {0, 3, 'a', 0, 'b'},
+		"Surrogate": {0, 3, 0xed, 0xa0, 0x80},
+		"Invalid":   {0, 2, 0xc3, 0x28},
+		"Overlong":  {0, 2, 0xc0, 0xaf},
+	} {
+		_, _, err := DecodeUTF8String(b)
+		assert.True(t, errors.Is(err, ErrInvalidUTF8), name)
+	}
+
+	_, _, err = DecodeUTF8String([]byte{0, 4, 'a'})
+	assert.True(t, errors.Is(err, ErrMalformedPacket))
+}
+
+func TestInvalidUTF8Fields(t *testing.T) {
+	// PUBLISH topic with a surrogate
+	_, err := ReadPacket(bytes.NewReader([]byte{PUBLISH << 4, 5, 0, 3, 0xed, 0xa0, 0x80}))
+	assert.True(t, errors.Is(err, ErrInvalidUTF8))
+
+	// CONNECT client identifier with U+0000
+	_, err = ReadPacket(bytes.NewReader([]byte{CONNECT << 4, 15, 0, 4, 'M', 'Q', 'T', 'T', 4, 2, 0, 60, 0, 3, 'a', 0, 'b'}))
+	assert.True(t, errors.Is(err, ErrInvalidUTF8))
+	assert.Equal(t, ReasonCodeMalformedPacket, ReasonCodeOf(err))
+}
@@ -0,0 +1,79 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package packet
+
+// ProtocolVersion is the protocol level sent in CONNECT. It decides how
+// every later packet on the connection is encoded.
+type ProtocolVersion byte
+
+const (
+	ProtocolVersion31  ProtocolVersion = 3 // MQTT 3.1, protocol name "MQIsdp"
+	ProtocolVersion311 ProtocolVersion = 4
+	ProtocolVersion5   ProtocolVersion = 5
+)
+
+// MQTT 5 reason codes, used in CONNACK, PUBACK, PUBREC, PUBREL, PUBCOMP,
+// SUBACK, UNSUBACK, DISCONNECT and AUTH
+// http://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901031
+const (
+	ReasonCodeSuccess                             byte = 0x00
+	ReasonCodeNormalDisconnection                 byte = 0x00
+	ReasonCodeGrantedQoS0                         byte = 0x00
+	ReasonCodeGrantedQoS1                         byte = 0x01
+	ReasonCodeGrantedQoS2                         byte = 0x02
+	ReasonCodeDisconnectWithWillMessage           byte = 0x04
+	ReasonCodeNoMatchingSubscribers               byte = 0x10
+	ReasonCodeNoSubscriptionExisted               byte = 0x11
+	ReasonCodeContinueAuthentication              byte = 0x18
+	ReasonCodeReAuthenticate                      byte = 0x19
+	ReasonCodeUnspecifiedError                    byte = 0x80
+	ReasonCodeMalformedPacket                     byte = 0x81
+	ReasonCodeProtocolError                       byte = 0x82
+	ReasonCodeImplementationSpecificError         byte = 0x83
+	ReasonCodeUnsupportedProtocolVersion          byte = 0x84
+	ReasonCodeClientIdentifierNotValid            byte = 0x85
+	ReasonCodeBadUserNameOrPassword               byte = 0x86
+	ReasonCodeNotAuthorized                       byte = 0x87
+	ReasonCodeServerUnavailable                   byte = 0x88
+	ReasonCodeServerBusy                          byte = 0x89
+	ReasonCodeBanned                              byte = 0x8A
+	ReasonCodeServerShuttingDown                  byte = 0x8B
+	ReasonCodeBadAuthenticationMethod             byte = 0x8C
+	ReasonCodeKeepAliveTimeout                    byte = 0x8D
+	ReasonCodeSessionTakenOver                    byte = 0x8E
+	ReasonCodeTopicFilterInvalid                  byte = 0x8F
+	ReasonCodeTopicNameInvalid                    byte = 0x90
+	ReasonCodePacketIdentifierInUse               byte = 0x91
+	ReasonCodePacketIdentifierNotFound            byte = 0x92
+	ReasonCodeReceiveMaximumExceeded              byte = 0x93
+	ReasonCodeTopicAliasInvalid                   byte = 0x94
+	ReasonCodePacketTooLarge                      byte = 0x95
+	ReasonCodeMessageRateTooHigh                  byte = 0x96
+	ReasonCodeQuotaExceeded                       byte = 0x97
+	ReasonCodeAdministrativeAction                byte = 0x98
+	ReasonCodePayloadFormatInvalid                byte = 0x99
+	ReasonCodeRetainNotSupported                  byte = 0x9A
+	ReasonCodeQoSNotSupported                     byte = 0x9B
+	ReasonCodeUseAnotherServer                    byte = 0x9C
+	ReasonCodeServerMoved                         byte = 0x9D
+	ReasonCodeSharedSubscriptionsNotSupported     byte = 0x9E
+	ReasonCodeConnectionRateExceeded              byte = 0x9F
+	ReasonCodeMaximumConnectTime                  byte = 0xA0
+	ReasonCodeSubscriptionIdentifiersNotSupported byte = 0xA1
+	ReasonCodeWildcardSubscriptionsNotSupported   byte = 0xA2
+)
@@ -0,0 +1,157 @@
+package packet
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncode(t *testing.T) {
+	var testCases = []struct {
+		packet   ControlPacket
+		expected []byte
+	}{
+		{
+			packet: &ConnAckControlPacket{
+				VariableHeader: ConnAckVariableHeader{SessionPresent: true, ReturnCode: 5},
+			},
+			expected: []byte{0x20, 2, 1, 5},
+		},
+		{
+			packet:   NewPubAckControlPacket(258),
+			expected: []byte{0x40, 2, 1, 2},
+		},
+		{
+			packet:   NewSubAck(1, []byte{ReturncodeSuccessQoS1, ReturncodeFailure}),
+			expected: []byte{0x90, 4, 0, 1, 1, 0x80},
+		},
+		{
+			packet:   NewPingReqControlPacket(),
+			expected: []byte{0xc0, 0},
+		},
+		{
+			packet:   NewPingRespControlPacket(),
+			expected: []byte{0xd0, 0},
+		},
+		{
+			packet: &PublishControlPacket{
+				FixedHeaderFlags: PublishHeaderFlags{QoS: QoSLevelAtLeastOnce, Retain: true},
+				VariableHeader:   PublishVariableHeader{Topic: "a/b", PacketID: 10},
+				Payload:          []byte("hi"),
+			},
+			expected: []byte{0x33, 9, 0, 3, 'a', '/', 'b', 0, 10, 'h', 'i'},
+		},
+		{
+			packet: &SubscribeControlPacket{
+				VariableHeader: SubscribeVariableHeader{PacketID: 3},
+				Payload: SubscribePayload{Subscriptions: []Subscription{
+					{Topic: "a/#", QoS: QoSLevelExactlyOnce},
+				}},
+			},
+			expected: []byte{0x82, 8, 0, 3, 0, 3, 'a', '/', '#', 2},
+		},
+		{
+			packet: &ConnectControlPacket{
+				VariableHeader: ConnectVariableHeader{
+					ProtocolName:  "MQTT",
+					ProtocolLevel: 4,
+					ConnectFlags:  ConnectFlags{CleanSession: true},
+					KeepAlive:     60,
+				},
+				ConnectPayload: ConnectPayload{ClientID: "c1"},
+			},
+			expected: []byte{0x10, 14, 0, 4, 'M', 'Q', 'T', 'T', 4, 2, 0, 60, 0, 2, 'c', '1'},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var buf bytes.Buffer
+			err := WritePacket(&buf, tc.packet)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, buf.Bytes())
+		})
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	publish := NewPublish("some/topic", 0, []byte("payload"))
+	publish.FixedHeaderFlags.QoS = QoSLevelExactlyOnce
+	publish.VariableHeader.PacketID = 7
+
+	var buf bytes.Buffer
+	require.NoError(t, WritePacket(&buf, publish))
+
+	p, err := ReadPacket(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, publish, p)
+}
+
+func TestConnectPayloadRoundTrip(t *testing.T) {
+	connect := &ConnectControlPacket{
+		VariableHeader: ConnectVariableHeader{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: byte(ProtocolVersion311),
+			ConnectFlags:  ConnectFlags{WillFlag: true, WillQoS: 2, WillRetain: true, UserName: true, Password: true},
+			KeepAlive:     60,
+		},
+		ConnectPayload: ConnectPayload{
+			ClientID:    "c1",
+			WillTopic:   "clients/c1",
+			WillMessage: []byte("gone"),
+			UserName:    "user",
+			Password:    []byte{0, 1, 2},
+		},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, WritePacket(&buf, connect))
+	p, err := ReadPacket(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, connect, p)
+
+	// The password must be complete
+	encoded, err := connect.Encode()
+	require.NoError(t, err)
+	encoded[1]--
+	_, err = ReadPacket(bytes.NewReader(encoded[:len(encoded)-1]))
+	assert.Error(t, err)
+}
+
+func TestConnectUnsupportedProtocol(t *testing.T) {
+	var testCases = []struct {
+		name  string
+		level ProtocolVersion
+	}{
+		{"MQTT", 6},
+		{"MQTT", ProtocolVersion31},
+		{"MQIsdp", ProtocolVersion311},
+	}
+
+	for _, tc := range testCases {
+		connect := &ConnectControlPacket{
+			VariableHeader: ConnectVariableHeader{ProtocolName: tc.name, ProtocolLevel: byte(tc.level)},
+			ConnectPayload: ConnectPayload{ClientID: "c1"},
+		}
+		var buf bytes.Buffer
+		require.NoError(t, WritePacket(&buf, connect))
+
+		_, err := ReadPacket(&buf)
+		require.IsType(t, &ConnectError{}, err)
+		assert.Equal(t, ConnAckUnacceptableProtocolVersion, err.(*ConnectError).ReturnCode)
+	}
+	assert.Equal(t, ReasonCodeUnsupportedProtocolVersion, ConnAckReasonCode(ConnAckUnacceptableProtocolVersion))
+}
+
+func TestEncodeInvalid(t *testing.T) {
+	publish := NewPublish("topic", 0, nil)
+	publish.FixedHeaderFlags.QoS = 3
+	_, err := publish.Encode()
+	assert.Error(t, err)
+
+	_, err = NewPublish(string(make([]byte, 65536)), 0, nil).Encode()
+	assert.Error(t, err)
+}
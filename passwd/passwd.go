@@ -0,0 +1,182 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Package passwd implements a broker.Authenticator from a password file
+// in the format of the password_file of mosquitto:
+//
+//	# user:hash
+//	alice:$7$101$<salt>$<hash>
+//	bob:$6$<salt>$<hash>
+//
+// $7$ hashes are PBKDF2-SHA512 with the iteration count given, $6$ hashes
+// are a salted SHA-512, both with base64 encoded salt and hash. Files
+// written by mosquitto_passwd can be used as they are; Hash creates new
+// entries.
+package passwd
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/infinimesh/mqtt-go/broker"
+)
+
+// Iterations is the PBKDF2 iteration count of the hashes created by Hash,
+// the default of mosquitto_passwd
+const Iterations = 101
+
+const saltLength = 12
+
+// hash is a password hash of the file
+type hash struct {
+	iterations int // 0 for a $6$ hash
+	salt       []byte
+	sum        []byte
+}
+
+func parseHash(s string) (hash, error) {
+	var h hash
+	parts := strings.Split(s, "$")
+	var err error
+	switch {
+	case len(parts) == 4 && parts[0] == "" && parts[1] == "6":
+		parts = parts[2:]
+	case len(parts) == 5 && parts[0] == "" && parts[1] == "7":
+		h.iterations, err = strconv.Atoi(parts[2])
+		if err != nil || h.iterations <= 0 {
+			return h, fmt.Errorf("invalid iteration count %q", parts[2])
+		}
+		parts = parts[3:]
+	default:
+		return h, fmt.Errorf("unsupported hash")
+	}
+	if h.salt, err = base64.StdEncoding.DecodeString(parts[0]); err != nil {
+		return h, fmt.Errorf("invalid salt: %v", err)
+	}
+	if h.sum, err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+		return h, fmt.Errorf("invalid hash: %v", err)
+	}
+	return h, nil
+}
+
+func (h hash) compute(password string) []byte {
+	if h.iterations == 0 {
+		sum := sha512.Sum512(append([]byte(password), h.salt...))
+		return sum[:]
+	}
+	sum, err := pbkdf2.Key(sha512.New, password, h.salt, h.iterations, sha512.Size)
+	if err != nil {
+		return nil
+	}
+	return sum
+}
+
+func (h hash) matches(password string) bool {
+	return subtle.ConstantTimeCompare(h.compute(password), h.sum) == 1
+}
+
+func (h hash) String() string {
+	enc := base64.StdEncoding
+	if h.iterations == 0 {
+		return "$6$" + enc.EncodeToString(h.salt) + "$" + enc.EncodeToString(h.sum)
+	}
+	return fmt.Sprintf("$7$%d$%s$%s", h.iterations, enc.EncodeToString(h.salt), enc.EncodeToString(h.sum))
+}
+
+// Hash returns a $7$ hash of password with a random salt, to be written
+// after the user name and a colon
+func Hash(password string) (string, error) {
+	h := hash{iterations: Iterations, salt: make([]byte, saltLength)}
+	if _, err := rand.Read(h.salt); err != nil {
+		return "", err
+	}
+	h.sum = h.compute(password)
+	return h.String(), nil
+}
+
+// File holds the users of a password file. It is safe for concurrent use.
+type File struct {
+	users map[string]hash
+}
+
+// Load reads the password file at path
+func Load(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	return Parse(f)
+}
+
+// Parse reads a password file
+func Parse(r io.Reader) (*File, error) {
+	f := &File{users: make(map[string]hash)}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.LastIndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("passwd: line %d: missing user name", n)
+		}
+		h, err := parseHash(line[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("passwd: line %d: %v", n, err)
+		}
+		f.users[line[:i]] = h
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Check reports whether password is the one of userName
+func (f *File) Check(userName, password string) bool {
+	h, ok := f.users[userName]
+	if !ok {
+		// Spend the same time, so that the response does not tell
+		// whether the user exists
+		h = hash{iterations: Iterations}
+		h.matches(password)
+		return false
+	}
+	return h.matches(password)
+}
+
+// Authenticate implements broker.Authenticator. Clients without user
+// name or with a wrong password are refused with
+// broker.ErrBadUserNameOrPassword.
+func (f *File) Authenticate(c *broker.Conn) error {
+	payload := c.Connect().ConnectPayload
+	if !c.Connect().VariableHeader.ConnectFlags.UserName || !f.Check(payload.UserName, string(payload.Password)) {
+		return broker.ErrBadUserNameOrPassword
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package passwd
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFile(t *testing.T) {
+	alice, err := Hash("secret")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(alice, "$7$101$"))
+
+	// A $6$ hash as written by older versions of mosquitto_passwd
+	salt := []byte("0123456789ab")
+	sum := sha512.Sum512(append([]byte("hunter2"), salt...))
+	bob := "$6$" + base64.StdEncoding.EncodeToString(salt) + "$" + base64.StdEncoding.EncodeToString(sum[:])
+
+	f, err := Parse(strings.NewReader("# users\nalice:" + alice + "\n\nbob:" + bob + "\n"))
+	require.NoError(t, err)
+	assert.True(t, f.Check("alice", "secret"))
+	assert.False(t, f.Check("alice", "hunter2"))
+	assert.True(t, f.Check("bob", "hunter2"))
+	assert.False(t, f.Check("carol", "secret"))
+
+	for _, line := range []string{
+		"alice",
+		":" + alice,
+		"alice:plaintext",
+		"alice:$7$x$c2FsdA==$aGFzaA==",
+		"alice:$6$!!$aGFzaA==",
+	} {
+		_, err := Parse(strings.NewReader(line))
+		assert.Error(t, err, line)
+	}
+}
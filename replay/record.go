@@ -0,0 +1,205 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Package replay records the events of a broker to an append-only log
+// and replays them against another broker, at the original or a higher
+// speed, to reproduce problems or to test its capacity with recorded
+// traffic.
+package replay
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// Kind is the type of an Event
+type Kind string
+
+const (
+	Connect     Kind = "connect"
+	Disconnect  Kind = "disconnect"
+	Subscribe   Kind = "subscribe"
+	Unsubscribe Kind = "unsubscribe"
+	Publish     Kind = "publish"
+)
+
+// Event is a line of the log. Conn tells apart the connections of a
+// client ID, which is taken over by a new connection while the old one
+// is still closing.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Kind     Kind      `json:"kind"`
+	Conn     uint64    `json:"conn"`
+	ClientID string    `json:"client_id"`
+
+	// Connect
+	Version      packet.ProtocolVersion `json:"version,omitempty"`
+	CleanSession bool                   `json:"clean_session,omitempty"`
+	// SessionExpiry is in seconds, for MQTT 5
+	SessionExpiry uint32   `json:"session_expiry,omitempty"`
+	Will          *Message `json:"will,omitempty"`
+	// Disconnect
+	Graceful bool `json:"graceful,omitempty"`
+	// Subscribe
+	Subscriptions []Subscription `json:"subscriptions,omitempty"`
+	// Unsubscribe
+	Filters []string `json:"filters,omitempty"`
+	// Publish
+	Message *Message `json:"message,omitempty"`
+}
+
+// Message is a published message or a will
+type Message struct {
+	Topic   string          `json:"topic"`
+	Payload []byte          `json:"payload,omitempty"`
+	QoS     packet.QosLevel `json:"qos,omitempty"`
+	Retain  bool            `json:"retain,omitempty"`
+}
+
+// Subscription is a subscription of a Subscribe event
+type Subscription struct {
+	Filter            string          `json:"filter"`
+	QoS               packet.QosLevel `json:"qos,omitempty"`
+	NoLocal           bool            `json:"no_local,omitempty"`
+	RetainAsPublished bool            `json:"retain_as_published,omitempty"`
+	RetainHandling    byte            `json:"retain_handling,omitempty"`
+}
+
+// Recorder is a broker.Hook writing the connects, disconnects,
+// subscriptions and publishes of the clients to a log, one JSON Event
+// per line. Credentials and MQTT 5 properties other than the session
+// expiry are not recorded. Put it first in Server.Hooks to record the
+// packets as the clients sent them.
+type Recorder struct {
+	broker.NopHook
+
+	mu    sync.Mutex
+	enc   *json.Encoder
+	conns map[*broker.Conn]uint64
+	next  uint64
+	err   error
+}
+
+// NewRecorder returns a Recorder appending to w. Every event is written
+// with one call to w, so w should not buffer them if the log must
+// survive a crash.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{
+		enc:   json.NewEncoder(w),
+		conns: make(map[*broker.Conn]uint64),
+	}
+}
+
+// Err returns the first error writing the log. The events after it are
+// dropped.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) OnConnect(c *broker.Conn) error {
+	connect := c.Connect()
+	flags := connect.VariableHeader.ConnectFlags
+	e := Event{
+		Kind:         Connect,
+		Version:      c.Version(),
+		CleanSession: flags.CleanSession,
+	}
+	if props := connect.VariableHeader.Properties; props != nil && props.SessionExpiryInterval != nil {
+		e.SessionExpiry = *props.SessionExpiryInterval
+	}
+	if flags.WillFlag {
+		e.Will = &Message{
+			Topic:   connect.ConnectPayload.WillTopic,
+			Payload: connect.ConnectPayload.WillMessage,
+			QoS:     packet.QosLevel(flags.WillQoS),
+			Retain:  flags.WillRetain,
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next++
+	r.conns[c] = r.next
+	r.write(c, e)
+	return nil
+}
+
+func (r *Recorder) OnDisconnect(c *broker.Conn, graceful bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.write(c, Event{Kind: Disconnect, Graceful: graceful})
+	delete(r.conns, c)
+}
+
+func (r *Recorder) OnSubscribe(c *broker.Conn, p *packet.SubscribeControlPacket) error {
+	subs := make([]Subscription, len(p.Payload.Subscriptions))
+	for i, s := range p.Payload.Subscriptions {
+		subs[i] = Subscription{
+			Filter:            s.Topic,
+			QoS:               s.QoS,
+			NoLocal:           s.NoLocal,
+			RetainAsPublished: s.RetainAsPublished,
+			RetainHandling:    s.RetainHandling,
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.write(c, Event{Kind: Subscribe, Subscriptions: subs})
+	return nil
+}
+
+func (r *Recorder) OnUnsubscribe(c *broker.Conn, p *packet.UnsubscribeControlPacket) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.write(c, Event{Kind: Unsubscribe, Filters: p.Payload.Topics})
+}
+
+func (r *Recorder) OnPublish(c *broker.Conn, p *packet.PublishControlPacket) error {
+	m := &Message{
+		Topic:   p.VariableHeader.Topic,
+		Payload: p.Payload,
+		QoS:     p.FixedHeaderFlags.QoS,
+		Retain:  p.FixedHeaderFlags.Retain,
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.write(c, Event{Kind: Publish, Message: m})
+	return nil
+}
+
+// write completes e with the connection and time and appends it to the
+// log. r.mu must be held, so that the times of the log only go forward.
+func (r *Recorder) write(c *broker.Conn, e Event) {
+	if r.err != nil {
+		return
+	}
+	id, ok := r.conns[c]
+	if !ok {
+		// Not accepted when the Recorder was added
+		return
+	}
+	e.Time = time.Now()
+	e.Conn = id
+	e.ClientID = c.ClientID()
+	r.err = r.enc.Encode(e)
+}
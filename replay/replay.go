@@ -0,0 +1,236 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/client"
+	"github.com/infinimesh/mqtt-go/logger"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// Replayer connects the clients of a log to a broker and repeats their
+// events, in the order and at the pace they were recorded. Set the
+// fields before calling Replay.
+type Replayer struct {
+	// Addr is the TCP address of the broker
+	Addr string
+	// Dial opens the connections to the broker instead of Addr, e.g.
+	// with TLS
+	Dial func() (net.Conn, error)
+	// Speed divides the time between the events: 1 replays them as
+	// recorded, 10 ten times faster. 0 replays them without waiting.
+	Speed float64
+	// Options, if set, adjusts the options of every client, e.g. to add
+	// the credentials the log doesn't hold
+	Options func(e Event, opts *client.Options)
+	// Logger receives the log entries of the replay. May be nil.
+	Logger logger.Logger
+}
+
+// Stats counts what a replay did
+type Stats struct {
+	// Events is the number of events replayed
+	Events int
+	// Skipped is the number of events of connections the broker refused
+	// or that connected before the recording started
+	Skipped int
+	// Received is the number of messages the replayed clients received
+	Received int64
+}
+
+// replayed is a connection of the log
+type replayed struct {
+	conn net.Conn
+	c    *client.Client // nil if the broker refused it
+}
+
+// Replay replays the log read from r until its end. The clients still
+// connected at the end disconnect.
+func (p *Replayer) Replay(ctx context.Context, r io.Reader) (Stats, error) {
+	var (
+		stats    Stats
+		received atomic.Int64
+		start    time.Time
+		first    time.Time
+	)
+	conns := make(map[uint64]*replayed)
+	defer func() {
+		for _, rc := range conns {
+			rc.close(true)
+		}
+	}()
+	dec := json.NewDecoder(r)
+	for {
+		var e Event
+		if err := dec.Decode(&e); err != nil {
+			stats.Received = received.Load()
+			if err == io.EOF {
+				return stats, nil
+			}
+			return stats, fmt.Errorf("replay: reading the log: %w", err)
+		}
+		if start.IsZero() {
+			start, first = time.Now(), e.Time
+		}
+		if err := p.wait(ctx, start.Add(p.scale(e.Time.Sub(first)))); err != nil {
+			return stats, err
+		}
+
+		rc := conns[e.Conn]
+		if e.Kind == Connect {
+			rc, err := p.connect(e, &received)
+			if err != nil {
+				return stats, err
+			}
+			conns[e.Conn] = rc
+			if rc.c == nil {
+				stats.Skipped++
+			} else {
+				stats.Events++
+			}
+			continue
+		}
+		if rc == nil || rc.c == nil {
+			stats.Skipped++
+			continue
+		}
+		stats.Events++
+		var err error
+		switch e.Kind {
+		case Disconnect:
+			rc.close(e.Graceful)
+			delete(conns, e.Conn)
+		case Subscribe:
+			for _, s := range e.Subscriptions {
+				sub := packet.Subscription{
+					Topic:             s.Filter,
+					QoS:               s.QoS,
+					NoLocal:           s.NoLocal,
+					RetainAsPublished: s.RetainAsPublished,
+					RetainHandling:    s.RetainHandling,
+				}
+				if _, err = rc.c.SubscribeWith(ctx, sub, nil); err != nil {
+					break
+				}
+			}
+		case Unsubscribe:
+			err = rc.c.Unsubscribe(ctx, e.Filters...)
+		case Publish:
+			if m := e.Message; m != nil {
+				err = rc.c.Publish(ctx, m.Topic, m.QoS, m.Retain, m.Payload)
+			}
+		default:
+			p.log(logger.LevelWarn, "replay: unknown event", logger.F("kind", e.Kind))
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return stats, ctx.Err()
+			}
+			// The broker may close a connection, as it did when recording
+			p.log(logger.LevelWarn, "replay: event failed", logger.F("kind", e.Kind), logger.F("client_id", e.ClientID), logger.F("error", err))
+		}
+	}
+}
+
+// connect opens the connection of a Connect event. The returned client
+// is nil if the broker refused it.
+func (p *Replayer) connect(e Event, received *atomic.Int64) (*replayed, error) {
+	dial := p.Dial
+	if dial == nil {
+		dial = func() (net.Conn, error) { return net.Dial("tcp", p.Addr) }
+	}
+	conn, err := dial()
+	if err != nil {
+		return nil, fmt.Errorf("replay: %w", err)
+	}
+	opts := client.Options{
+		ClientID:        e.ClientID,
+		CleanSession:    e.CleanSession,
+		SessionExpiry:   time.Duration(e.SessionExpiry) * time.Second,
+		ProtocolVersion: e.Version,
+		OnMessage:       func(*client.Client, client.Message) { received.Add(1) },
+	}
+	if w := e.Will; w != nil {
+		opts.Will = &client.Will{Topic: w.Topic, Payload: w.Payload, QoS: w.QoS, Retain: w.Retain}
+	}
+	if p.Options != nil {
+		p.Options(e, &opts)
+	}
+	c, err := client.Connect(conn, opts)
+	if err != nil {
+		_ = conn.Close()
+		var refused *client.ConnectError
+		if !errors.As(err, &refused) {
+			return nil, fmt.Errorf("replay: %w", err)
+		}
+		p.log(logger.LevelWarn, "replay: connection refused", logger.F("client_id", e.ClientID), logger.F("error", err))
+		return &replayed{}, nil
+	}
+	return &replayed{conn: conn, c: c}, nil
+}
+
+// close ends the connection, without DISCONNECT unless graceful so that
+// the broker publishes the will
+func (rc *replayed) close(graceful bool) {
+	if rc.c == nil {
+		return
+	}
+	if graceful {
+		_ = rc.c.Disconnect()
+	}
+	_ = rc.conn.Close()
+}
+
+// scale returns the time to wait for d of the recording
+func (p *Replayer) scale(d time.Duration) time.Duration {
+	if p.Speed <= 0 {
+		return 0
+	}
+	return time.Duration(float64(d) / p.Speed)
+}
+
+// wait returns at t, or with the error of ctx if it ends earlier
+func (p *Replayer) wait(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Replayer) log(level logger.Level, msg string, fields ...logger.Field) {
+	if p.Logger != nil {
+		p.Logger.Log(level, msg, fields...)
+	}
+}
@@ -0,0 +1,154 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/client"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// syncBuffer is written by the connections and read by the test
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func serve(t *testing.T, s *broker.Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l) // nolint: errcheck
+	t.Cleanup(func() { assert.NoError(t, s.Close()) })
+	return l.Addr().String()
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	var log syncBuffer
+	recorder := NewRecorder(&log)
+	addr := serve(t, &broker.Server{Hooks: []broker.Hook{recorder}})
+	ctx := context.Background()
+
+	sub, err := client.Dial(addr, client.Options{ClientID: "sub", CleanSession: true})
+	require.NoError(t, err)
+	received := make(chan client.Message, 1)
+	_, err = sub.Subscribe(ctx, "a/#", packet.QoSLevelAtLeastOnce, func(_ *client.Client, m client.Message) { received <- m })
+	require.NoError(t, err)
+	pub, err := client.Dial(addr, client.Options{
+		ClientID:        "pub",
+		ProtocolVersion: packet.ProtocolVersion5,
+		SessionExpiry:   time.Minute,
+		Will:            &client.Will{Topic: "a/will", Payload: []byte("gone")},
+	})
+	require.NoError(t, err)
+	require.NoError(t, pub.Publish(ctx, "a/1", packet.QoSLevelAtLeastOnce, true, []byte("hello")))
+	<-received
+	require.NoError(t, sub.Unsubscribe(ctx, "a/#"))
+	require.NoError(t, pub.Disconnect())
+	require.NoError(t, sub.Disconnect())
+	require.Eventually(t, func() bool { return strings.Count(log.String(), `"kind":"disconnect"`) == 2 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, recorder.Err())
+
+	var events []Event
+	dec := json.NewDecoder(strings.NewReader(log.String()))
+	for dec.More() {
+		var e Event
+		require.NoError(t, dec.Decode(&e))
+		events = append(events, e)
+	}
+	require.Len(t, events, 7)
+	var kinds []Kind
+	for _, e := range events {
+		kinds = append(kinds, e.Kind)
+	}
+	assert.Equal(t, []Kind{Connect, Subscribe, Connect, Publish, Unsubscribe, Disconnect, Disconnect}, kinds)
+	assert.Equal(t, []Subscription{{Filter: "a/#", QoS: packet.QoSLevelAtLeastOnce}}, events[1].Subscriptions)
+	assert.Equal(t, Event{
+		Time: events[2].Time, Kind: Connect, Conn: 2, ClientID: "pub",
+		Version: packet.ProtocolVersion5, SessionExpiry: 60,
+		Will: &Message{Topic: "a/will", Payload: []byte("gone")},
+	}, events[2])
+	assert.Equal(t, &Message{Topic: "a/1", Payload: []byte("hello"), QoS: packet.QoSLevelAtLeastOnce, Retain: true}, events[3].Message)
+	assert.Equal(t, []string{"a/#"}, events[4].Filters)
+	assert.True(t, events[5].Graceful)
+
+	fresh := serve(t, &broker.Server{})
+	stats, err := (&Replayer{Addr: fresh}).Replay(ctx, strings.NewReader(log.String()))
+	require.NoError(t, err)
+	assert.Equal(t, 7, stats.Events)
+	assert.Zero(t, stats.Skipped)
+
+	// The replayed message was retained
+	check, err := client.Dial(fresh, client.Options{ClientID: "check", CleanSession: true})
+	require.NoError(t, err)
+	defer check.Disconnect() // nolint: errcheck
+	_, err = check.Subscribe(ctx, "a/#", packet.QoSLevelAtLeastOnce, func(_ *client.Client, m client.Message) { received <- m })
+	require.NoError(t, err)
+	select {
+	case m := <-received:
+		assert.Equal(t, "a/1", m.Topic)
+		assert.Equal(t, []byte("hello"), m.Payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("replayed message not retained")
+	}
+}
+
+func TestReplaySpeedAndRefusal(t *testing.T) {
+	start := time.Now()
+	events := []Event{
+		{Time: start, Kind: Connect, Conn: 1, ClientID: "bad", CleanSession: true},
+		{Time: start, Kind: Publish, Conn: 1, ClientID: "bad", Message: &Message{Topic: "t"}},
+		{Time: start.Add(100 * time.Millisecond), Kind: Connect, Conn: 2, ClientID: "good", CleanSession: true},
+		{Time: start.Add(200 * time.Millisecond), Kind: Publish, Conn: 2, ClientID: "good", Message: &Message{Topic: "t"}},
+		{Time: start.Add(300 * time.Millisecond), Kind: Publish, Conn: 3, ClientID: "unknown", Message: &Message{Topic: "t"}},
+	}
+	var log bytes.Buffer
+	enc := json.NewEncoder(&log)
+	for _, e := range events {
+		require.NoError(t, enc.Encode(e))
+	}
+
+	addr := serve(t, &broker.Server{
+		Authenticator: broker.AuthenticatorFunc(func(c *broker.Conn) error {
+			if c.ClientID() == "bad" {
+				return broker.ErrNotAuthorized
+			}
+			return nil
+		}),
+	})
+	began := time.Now()
+	stats, err := (&Replayer{Addr: addr, Speed: 2}).Replay(context.Background(), &log)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(began), 150*time.Millisecond)
+	assert.Equal(t, Stats{Events: 2, Skipped: 3}, stats)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	log.Reset()
+	for _, e := range events {
+		require.NoError(t, enc.Encode(e))
+	}
+	_, err = (&Replayer{Addr: addr, Speed: 1}).Replay(ctx, &log)
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,423 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Package scram implements the SCRAM-SHA-256 SASL mechanism of RFC 5802
+// and RFC 7677 as an MQTT 5 enhanced authentication method. Authenticator
+// is the server side for broker.Server, Client the one for client.Options.
+//
+// The server stores no passwords, only the salted keys derived from them
+// in the format of RFC 5803:
+//
+//	# user:credentials
+//	alice:SCRAM-SHA-256$4096:<salt>$<StoredKey>:<ServerKey>
+//
+// NewCredentials creates new entries. Channel binding is not supported.
+package scram
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/infinimesh/mqtt-go/broker"
+)
+
+// Method is the name of the authentication method in CONNECT
+const Method = "SCRAM-SHA-256"
+
+// Iterations is the PBKDF2 iteration count of the credentials created by
+// NewCredentials, the minimum RFC 7677 recommends
+const Iterations = 4096
+
+const (
+	saltLength  = 16
+	nonceLength = 18
+	// gs2Header announces that channel binding is not used
+	gs2Header = "n,,"
+)
+
+var errMalformed = errors.New("scram: malformed message")
+
+// Credentials are what the server keeps of a password
+type Credentials struct {
+	Iterations int
+	Salt       []byte
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewCredentials derives the credentials of password with a random salt
+func NewCredentials(password string) (Credentials, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return Credentials{}, err
+	}
+	salted, err := saltPassword(password, salt, Iterations)
+	if err != nil {
+		return Credentials{}, err
+	}
+	clientKey := mac(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return Credentials{
+		Iterations: Iterations,
+		Salt:       salt,
+		StoredKey:  storedKey[:],
+		ServerKey:  mac(salted, "Server Key"),
+	}, nil
+}
+
+// ParseCredentials reads credentials in the format of RFC 5803
+func ParseCredentials(s string) (Credentials, error) {
+	var c Credentials
+	rest, ok := strings.CutPrefix(s, Method+"$")
+	if !ok {
+		return c, fmt.Errorf("unsupported mechanism")
+	}
+	params, keys, ok := strings.Cut(rest, "$")
+	if !ok {
+		return c, fmt.Errorf("missing keys")
+	}
+	iterations, salt, ok1 := strings.Cut(params, ":")
+	storedKey, serverKey, ok2 := strings.Cut(keys, ":")
+	if !ok1 || !ok2 {
+		return c, fmt.Errorf("malformed credentials")
+	}
+	var err error
+	c.Iterations, err = strconv.Atoi(iterations)
+	if err != nil || c.Iterations <= 0 {
+		return c, fmt.Errorf("invalid iteration count %q", iterations)
+	}
+	enc := base64.StdEncoding
+	if c.Salt, err = enc.DecodeString(salt); err != nil {
+		return c, fmt.Errorf("invalid salt: %v", err)
+	}
+	if c.StoredKey, err = enc.DecodeString(storedKey); err != nil || len(c.StoredKey) != sha256.Size {
+		return c, fmt.Errorf("invalid stored key")
+	}
+	if c.ServerKey, err = enc.DecodeString(serverKey); err != nil || len(c.ServerKey) != sha256.Size {
+		return c, fmt.Errorf("invalid server key")
+	}
+	return c, nil
+}
+
+func (c Credentials) String() string {
+	enc := base64.StdEncoding
+	return fmt.Sprintf("%s$%d:%s$%s:%s", Method, c.Iterations, enc.EncodeToString(c.Salt),
+		enc.EncodeToString(c.StoredKey), enc.EncodeToString(c.ServerKey))
+}
+
+// File holds the users of a credentials file. It is safe for concurrent
+// use.
+type File struct {
+	users map[string]Credentials
+}
+
+// Load reads the credentials file at path
+func Load(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	return Parse(f)
+}
+
+// Parse reads a credentials file
+func Parse(r io.Reader) (*File, error) {
+	f := &File{users: make(map[string]Credentials)}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("scram: line %d: missing user name", n)
+		}
+		c, err := ParseCredentials(line[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("scram: line %d: %v", n, err)
+		}
+		f.users[line[:i]] = c
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Credentials returns the credentials of userName, for use as
+// Authenticator.Credentials
+func (f *File) Credentials(userName string) (Credentials, bool) {
+	c, ok := f.users[userName]
+	return c, ok
+}
+
+// Authenticator implements SCRAM-SHA-256 as a broker.EnhancedAuthenticator
+type Authenticator struct {
+	// Credentials looks up the credentials of a user
+	Credentials func(userName string) (Credentials, bool)
+}
+
+func (a *Authenticator) Method() string {
+	return Method
+}
+
+func (a *Authenticator) Start(c *broker.Conn) broker.AuthExchange {
+	e := &serverExchange{auth: a}
+	if flags := c.Connect().VariableHeader.ConnectFlags; flags.UserName {
+		e.userName = c.Connect().ConnectPayload.UserName
+	}
+	return e
+}
+
+// serverExchange is the server side of a single authentication
+type serverExchange struct {
+	auth *Authenticator
+	// userName is the one of CONNECT, which has to match the one of the
+	// exchange if given
+	userName string
+
+	step        int
+	gs2Header   string
+	known       bool // whether the user exists
+	credentials Credentials
+	nonce       string
+	authMessage string // the first two messages, so far
+}
+
+func (e *serverExchange) Step(data []byte) ([]byte, bool, error) {
+	e.step++
+	switch e.step {
+	case 1:
+		return e.clientFirst(string(data))
+	case 2:
+		return e.clientFinal(string(data))
+	}
+	return nil, false, fmt.Errorf("scram: exchange already complete")
+}
+
+// clientFirst answers client-first-message with server-first-message
+func (e *serverExchange) clientFirst(msg string) ([]byte, bool, error) {
+	// "y,," means the client thinks the server lacks channel binding,
+	// which is right
+	e.gs2Header = msg[:min(len(msg), len(gs2Header))]
+	if e.gs2Header != gs2Header && e.gs2Header != "y,," {
+		return nil, false, fmt.Errorf("%w: unsupported GS2 header", errMalformed)
+	}
+	bare := msg[len(e.gs2Header):]
+	attrs, err := attributes(bare, "nr")
+	if err != nil {
+		return nil, false, err
+	}
+	userName, err := unescape(attrs[0])
+	if err != nil {
+		return nil, false, err
+	}
+	if e.userName != "" && e.userName != userName {
+		return nil, false, broker.ErrBadUserNameOrPassword
+	}
+
+	e.credentials, e.known = e.auth.Credentials(userName)
+	if !e.known {
+		// Go on with made up credentials, so that the response does not
+		// tell whether the user exists
+		e.credentials = Credentials{Iterations: Iterations, Salt: make([]byte, saltLength)}
+		if _, err := rand.Read(e.credentials.Salt); err != nil {
+			return nil, false, err
+		}
+	}
+	serverNonce, err := newNonce()
+	if err != nil {
+		return nil, false, err
+	}
+	e.nonce = attrs[1] + serverNonce
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", e.nonce, base64.StdEncoding.EncodeToString(e.credentials.Salt), e.credentials.Iterations)
+	e.authMessage = bare + "," + serverFirst
+	return []byte(serverFirst), false, nil
+}
+
+// clientFinal verifies the proof of client-final-message and answers
+// with server-final-message
+func (e *serverExchange) clientFinal(msg string) ([]byte, bool, error) {
+	attrs, err := attributes(msg, "crp")
+	if err != nil {
+		return nil, false, err
+	}
+	if attrs[0] != base64.StdEncoding.EncodeToString([]byte(e.gs2Header)) {
+		return nil, false, fmt.Errorf("%w: unsupported channel binding", errMalformed)
+	}
+	if attrs[1] != e.nonce {
+		return nil, false, fmt.Errorf("scram: nonce mismatch")
+	}
+	proof, err := base64.StdEncoding.DecodeString(attrs[2])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, false, fmt.Errorf("%w: invalid proof", errMalformed)
+	}
+
+	authMessage := e.authMessage + "," + msg[:strings.LastIndex(msg, ",p=")]
+	clientSignature := mac(e.credentials.StoredKey, authMessage)
+	clientKey := make([]byte, sha256.Size)
+	subtle.XORBytes(clientKey, proof, clientSignature)
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], e.credentials.StoredKey) != 1 || !e.known {
+		return nil, false, broker.ErrBadUserNameOrPassword
+	}
+	serverSignature := mac(e.credentials.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), true, nil
+}
+
+// Client is the client side of SCRAM-SHA-256 for client.Options.Auth. A
+// Client is good for a single connection attempt.
+type Client struct {
+	userName, password string
+
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+// NewClient returns a Client that authenticates as userName
+func NewClient(userName, password string) *Client {
+	return &Client{userName: userName, password: password}
+}
+
+func (c *Client) Method() string {
+	return Method
+}
+
+// Start returns client-first-message
+func (c *Client) Start() ([]byte, error) {
+	var err error
+	if c.nonce, err = newNonce(); err != nil {
+		return nil, err
+	}
+	c.clientFirstBare = "n=" + escape(c.userName) + ",r=" + c.nonce
+	return []byte(gs2Header + c.clientFirstBare), nil
+}
+
+// Step answers server-first-message with client-final-message
+func (c *Client) Step(data []byte) ([]byte, error) {
+	if c.clientFirstBare == "" || c.serverSignature != nil {
+		return nil, fmt.Errorf("scram: unexpected message from server")
+	}
+	serverFirst := string(data)
+	attrs, err := attributes(serverFirst, "rsi")
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(attrs[0], c.nonce) || len(attrs[0]) == len(c.nonce) {
+		return nil, fmt.Errorf("scram: nonce mismatch")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid salt", errMalformed)
+	}
+	iterations, err := strconv.Atoi(attrs[2])
+	if err != nil || iterations <= 0 {
+		return nil, fmt.Errorf("%w: invalid iteration count", errMalformed)
+	}
+
+	salted, err := saltPassword(c.password, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	clientFinal := "c=" + base64.StdEncoding.EncodeToString([]byte(gs2Header)) + ",r=" + attrs[0]
+	authMessage := c.clientFirstBare + "," + serverFirst + "," + clientFinal
+	clientKey := mac(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	proof := make([]byte, sha256.Size)
+	subtle.XORBytes(proof, clientKey, mac(storedKey[:], authMessage))
+	c.serverSignature = mac(mac(salted, "Server Key"), authMessage)
+	return []byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// Finish verifies server-final-message, so that the server proved it
+// knows the credentials as well
+func (c *Client) Finish(data []byte) error {
+	if c.serverSignature == nil {
+		return fmt.Errorf("scram: exchange incomplete")
+	}
+	attrs, err := attributes(string(data), "v")
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs[0])
+	if err != nil || !hmac.Equal(signature, c.serverSignature) {
+		return fmt.Errorf("scram: invalid server signature")
+	}
+	return nil
+}
+
+// attributes splits msg into the values of the attributes named by keys,
+// which have to come in that order
+func attributes(msg, keys string) ([]string, error) {
+	parts := strings.Split(msg, ",")
+	if len(parts) != len(keys) {
+		return nil, fmt.Errorf("%w: expected attributes %q", errMalformed, keys)
+	}
+	values := make([]string, len(parts))
+	for i, part := range parts {
+		if len(part) < 2 || part[0] != keys[i] || part[1] != '=' {
+			return nil, fmt.Errorf("%w: expected attribute %q", errMalformed, keys[i])
+		}
+		values[i] = part[2:]
+	}
+	return values, nil
+}
+
+// escape encodes the characters of a user name that delimit attributes
+func escape(userName string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(userName)
+}
+
+func unescape(userName string) (string, error) {
+	s := strings.NewReplacer("=3D", "=", "=2C", ",").Replace(userName)
+	if strings.Count(userName, "=") != strings.Count(userName, "=3D")+strings.Count(userName, "=2C") {
+		return "", fmt.Errorf("%w: invalid user name", errMalformed)
+	}
+	return s, nil
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, nonceLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func saltPassword(password string, salt []byte, iterations int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+}
+
+func mac(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg)) // nolint: errcheck
+	return h.Sum(nil)
+}
@@ -0,0 +1,97 @@
+package scram
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/client"
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func TestCredentials(t *testing.T) {
+	c, err := NewCredentials("secret")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(c.String(), "SCRAM-SHA-256$4096:"))
+	parsed, err := ParseCredentials(c.String())
+	require.NoError(t, err)
+	assert.Equal(t, c, parsed)
+
+	f, err := Parse(strings.NewReader("# users\nalice:" + c.String() + "\n"))
+	require.NoError(t, err)
+	_, ok := f.Credentials("alice")
+	assert.True(t, ok)
+	_, ok = f.Credentials("bob")
+	assert.False(t, ok)
+
+	for _, line := range []string{
+		"alice",
+		":" + c.String(),
+		"alice:SCRAM-SHA-1$4096:c2FsdA==$a2V5:a2V5",
+		"alice:SCRAM-SHA-256$x:c2FsdA==$a2V5:a2V5",
+		"alice:SCRAM-SHA-256$4096:c2FsdA==$a2V5:a2V5",
+	} {
+		_, err := Parse(strings.NewReader(line))
+		assert.Error(t, err, line)
+	}
+}
+
+// RFC 7677 section 3 with the nonce of the client fixed
+func TestClientExample(t *testing.T) {
+	c := NewClient("user", "pencil")
+	_, err := c.Start()
+	require.NoError(t, err)
+	c.nonce = "rOprNGfwEbeRWgbNEkqO"
+	c.clientFirstBare = "n=user,r=rOprNGfwEbeRWgbNEkqO"
+
+	final, err := c.Step([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	require.NoError(t, err)
+	assert.Equal(t, "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", string(final))
+	assert.NoError(t, c.Finish([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")))
+	assert.Error(t, c.Finish([]byte("v=AAAA")))
+}
+
+func TestAuthenticator(t *testing.T) {
+	alice, err := NewCredentials("secret")
+	require.NoError(t, err)
+	users := map[string]Credentials{"alice": alice}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &broker.Server{EnhancedAuthenticators: []broker.EnhancedAuthenticator{
+		&Authenticator{Credentials: func(userName string) (Credentials, bool) {
+			c, ok := users[userName]
+			return c, ok
+		}},
+	}}
+	go s.Serve(l)   // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+
+	for _, tc := range []struct {
+		userName, password string
+		expected           byte
+	}{
+		{"alice", "secret", packet.ReasonCodeSuccess},
+		{"alice", "wrong", packet.ReasonCodeBadUserNameOrPassword},
+		{"bob", "secret", packet.ReasonCodeBadUserNameOrPassword},
+	} {
+		c, err := client.Dial(l.Addr().String(), client.Options{
+			ClientID:        "c1",
+			CleanSession:    true,
+			ProtocolVersion: packet.ProtocolVersion5,
+			Auth:            NewClient(tc.userName, tc.password),
+		})
+		if tc.expected == packet.ReasonCodeSuccess {
+			require.NoError(t, err)
+			require.NoError(t, c.Disconnect())
+			continue
+		}
+		var ce *client.ConnectError
+		require.True(t, errors.As(err, &ce), "%v", err)
+		assert.Equal(t, tc.expected, ce.ReturnCode, tc.userName)
+	}
+}
@@ -0,0 +1,116 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package session
+
+import (
+	"sort"
+	"sync"
+)
+
+// Inbound tracks the QoS 2 messages received from a peer whose PUBREL has
+// not arrived yet. A PUBLISH with a packet identifier that is still
+// tracked is a retransmission and must not be delivered again. It is safe
+// for concurrent use.
+type Inbound struct {
+	// Persister, if set, is notified of every change. Set it before the
+	// Inbound is used.
+	Persister Persister
+
+	mu  sync.Mutex
+	ids map[uint16]struct{}
+}
+
+// NewInbound returns an Inbound tracking no messages
+func NewInbound() *Inbound {
+	return &Inbound{ids: make(map[uint16]struct{})}
+}
+
+// Receive records a QoS 2 PUBLISH and reports whether it is the first
+// time packetID was seen, i.e. whether the message has to be delivered.
+// PUBREC must only be sent after Receive returned without error.
+func (in *Inbound) Receive(packetID uint16) (bool, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if _, ok := in.ids[packetID]; ok {
+		return false, nil
+	}
+	if in.Persister != nil {
+		if err := in.Persister.StoreInbound(packetID); err != nil {
+			return false, err
+		}
+	}
+	in.ids[packetID] = struct{}{}
+	return true, nil
+}
+
+// Release forgets packetID after its PUBREL arrived. PUBCOMP is sent
+// whether or not the identifier was known [MQTT-4.3.3-2].
+func (in *Inbound) Release(packetID uint16) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if _, ok := in.ids[packetID]; !ok {
+		return nil
+	}
+	if in.Persister != nil {
+		if err := in.Persister.DeleteInbound(packetID); err != nil {
+			return err
+		}
+	}
+	delete(in.ids, packetID)
+	return nil
+}
+
+// Contains reports whether packetID is waiting for its PUBREL
+func (in *Inbound) Contains(packetID uint16) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	_, ok := in.ids[packetID]
+	return ok
+}
+
+// Len returns the number of messages waiting for their PUBREL
+func (in *Inbound) Len() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return len(in.ids)
+}
+
+// Restore adds packet identifiers loaded from storage, without notifying
+// the Persister
+func (in *Inbound) Restore(packetIDs []uint16) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for _, id := range packetIDs {
+		in.ids[id] = struct{}{}
+	}
+}
+
+// PacketIDs returns the tracked packet identifiers in ascending order
+func (in *Inbound) PacketIDs() []uint16 {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	ids := make([]uint16, 0, len(in.ids))
+	for id := range in.ids {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
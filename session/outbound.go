@@ -0,0 +1,484 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package session
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+var (
+	ErrUnknownPacketID = errors.New("session: no message in flight with this packet identifier")
+	ErrUnexpectedAck   = errors.New("session: acknowledgement does not match the QoS flow of the message")
+	ErrQoS0            = errors.New("session: QoS 0 messages are not tracked")
+)
+
+// OutboundQueue tracks the QoS 1 and 2 messages sent to a peer until
+// their flow completed. At most Window messages are in flight at once, the
+// rest wait in the queue in the order they were pushed. It is safe for
+// concurrent use.
+//
+// A QoS 1 message is in flight until its PUBACK. A QoS 2 message is in
+// flight as a PUBLISH until PUBREC, then as a PUBREL until PUBCOMP.
+//
+// Messages expire once their MQTT 5 message expiry interval or the TTL of
+// the queue passed. Expired messages are dropped instead of being sent
+// or retransmitted, and are sent with the remaining expiry interval
+// otherwise [MQTT-3.3.2-5] [MQTT-3.3.2-6].
+type OutboundQueue struct {
+	// Persister, if set, is notified of every change. Set it before the
+	// queue is used.
+	Persister Persister
+	// TTL, if > 0, limits how long a message is kept for delivery. Set it
+	// before the queue is used.
+	TTL time.Duration
+	// Expired, if set, is called with every message dropped because it
+	// expired. It is called with the queue locked and must not use it.
+	// Set it before the queue is used.
+	Expired func(p *packet.PublishControlPacket)
+
+	mu     sync.Mutex
+	window int
+	ids    PacketIDs
+	// inflight holds a *packet.PublishControlPacket or, after PUBREC, a
+	// *packet.PubrelControlPacket
+	inflight map[uint16]packet.ControlPacket
+	// deadlines holds when the in-flight PUBLISH packets expire, for
+	// those that do
+	deadlines map[uint16]time.Time
+	// flows holds what is known about the delivery of the in-flight
+	// packets
+	flows map[uint16]*flow
+	// order holds the in-flight packet identifiers in send order, so that
+	// retransmission keeps the original ordering [MQTT-4.6.0-1]
+	order  []uint16
+	queued []queuedMessage
+}
+
+// flow is the delivery state of an in-flight packet
+type flow struct {
+	started time.Time
+	// sent is set once the PUBLISH was written to the peer, only those
+	// are retransmitted with the DUP flag
+	sent    bool
+	retries int
+}
+
+// InFlight describes a message whose flow has not completed, e.g. to
+// troubleshoot stuck flows
+type InFlight struct {
+	PacketID uint16 `json:"packet_id"`
+	// State is "publish" while waiting for PUBACK or PUBREC, "pubrel"
+	// while waiting for PUBCOMP
+	State string          `json:"state"`
+	Topic string          `json:"topic,omitempty"`
+	QoS   packet.QosLevel `json:"qos"`
+	// Sent reports whether the PUBLISH was written to the peer
+	Sent bool `json:"sent"`
+	// Age is how long ago the flow started
+	Age time.Duration `json:"age"`
+	// Retries is how often the packet was retransmitted
+	Retries int `json:"retries"`
+}
+
+// queuedMessage is a message held back by the window
+type queuedMessage struct {
+	p        *packet.PublishControlPacket
+	deadline time.Time // zero if the message doesn't expire
+}
+
+func (m queuedMessage) expired(now time.Time) bool {
+	return !m.deadline.IsZero() && !now.Before(m.deadline)
+}
+
+// NewOutboundQueue returns a queue allowing window messages in flight. A
+// window <= 0 allows as many messages as there are packet identifiers.
+func NewOutboundQueue(window int) *OutboundQueue {
+	if window <= 0 || window > 65535 {
+		window = 65535
+	}
+	return &OutboundQueue{
+		window:    window,
+		inflight:  make(map[uint16]packet.ControlPacket),
+		deadlines: make(map[uint16]time.Time),
+		flows:     make(map[uint16]*flow),
+	}
+}
+
+// SetWindow changes the number of messages allowed in flight, e.g. to the
+// Receive Maximum of a client reconnecting to the session. A window <= 0
+// allows as many messages as there are packet identifiers. Messages
+// already in flight beyond a smaller window stay there; queued ones move
+// into a larger window as acknowledgements arrive.
+func (q *OutboundQueue) SetWindow(window int) {
+	if window <= 0 || window > 65535 {
+		window = 65535
+	}
+	q.mu.Lock()
+	q.window = window
+	q.mu.Unlock()
+}
+
+// Push adds a QoS 1 or 2 message to the queue. If the window has room,
+// the message is assigned a packet identifier and returned for sending;
+// otherwise it is held back until an acknowledgement frees a slot and nil
+// is returned. p itself is not modified.
+func (q *OutboundQueue) Push(p *packet.PublishControlPacket) (*packet.PublishControlPacket, error) {
+	if p.FixedHeaderFlags.QoS == packet.QoSLevelNone {
+		return nil, ErrQoS0
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	m := queuedMessage{p: p, deadline: q.deadline(p, now)}
+	if len(q.inflight) >= q.window || len(q.queued) > 0 {
+		q.queued = append(q.queued, m)
+		return nil, nil
+	}
+	return q.send(m, now)
+}
+
+// Ack completes the QoS 1 flow acknowledged by a PUBACK with packetID. It
+// returns the queued messages that now fit into the window, in order.
+func (q *OutboundQueue) Ack(packetID uint16) ([]*packet.PublishControlPacket, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p, ok := q.inflight[packetID]
+	if !ok {
+		return nil, ErrUnknownPacketID
+	}
+	if publish, ok := p.(*packet.PublishControlPacket); !ok || publish.FixedHeaderFlags.QoS != packet.QoSLevelAtLeastOnce {
+		return nil, ErrUnexpectedAck
+	}
+	return q.complete(packetID)
+}
+
+// Received handles a PUBREC for packetID. The message is discarded and the
+// PUBREL replacing it is returned for sending. A repeated PUBREC returns
+// the same PUBREL again.
+func (q *OutboundQueue) Received(packetID uint16) (*packet.PubrelControlPacket, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	switch p := q.inflight[packetID].(type) {
+	case nil:
+		return nil, ErrUnknownPacketID
+	case *packet.PubrelControlPacket:
+		return p, nil
+	case *packet.PublishControlPacket:
+		if p.FixedHeaderFlags.QoS != packet.QoSLevelExactlyOnce {
+			return nil, ErrUnexpectedAck
+		}
+		pubrel := packet.NewPubRelControlPacket(packetID)
+		if p.VariableHeader.Properties != nil {
+			pubrel.VariableHeader.Properties = &packet.Properties{}
+		}
+		if q.Persister != nil {
+			if err := q.Persister.StoreOutbound(pubrel); err != nil {
+				return nil, err
+			}
+		}
+		q.inflight[packetID] = pubrel
+		delete(q.deadlines, packetID)
+		return pubrel, nil
+	default:
+		return nil, ErrUnexpectedAck
+	}
+}
+
+// Complete finishes the QoS 2 flow acknowledged by a PUBCOMP with
+// packetID. It returns the queued messages that now fit into the window,
+// in order.
+func (q *OutboundQueue) Complete(packetID uint16) ([]*packet.PublishControlPacket, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p, ok := q.inflight[packetID]
+	if !ok {
+		return nil, ErrUnknownPacketID
+	}
+	if _, ok := p.(*packet.PubrelControlPacket); !ok {
+		return nil, ErrUnexpectedAck
+	}
+	return q.complete(packetID)
+}
+
+// Sent records that the in-flight PUBLISH with packetID was written to
+// the peer, so that Resend sets its DUP flag [MQTT-3.3.1-1]
+func (q *OutboundQueue) Sent(packetID uint16) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.inflight[packetID].(*packet.PublishControlPacket); ok {
+		q.flows[packetID].sent = true
+	}
+}
+
+// Resend returns every in-flight packet in the order the flows started:
+// copies of the PUBLISH packets, with the DUP flag set on those that were
+// Sent before, and PUBREL packets unchanged. It is meant to be called
+// when the peer reconnects to a persistent session, after Expire dropped
+// the messages that expired in the meantime.
+func (q *OutboundQueue) Resend() []packet.ControlPacket {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	resend := make([]packet.ControlPacket, 0, len(q.order))
+	for _, id := range q.order {
+		p := q.inflight[id]
+		f := q.flows[id]
+		if publish, ok := p.(*packet.PublishControlPacket); ok {
+			cp := *withExpiry(publish, q.deadlines[id], now)
+			cp.FixedHeaderFlags.Dup = f.sent
+			p = &cp
+		}
+		if _, ok := p.(*packet.PubrelControlPacket); ok || f.sent {
+			f.retries++
+		}
+		resend = append(resend, p)
+	}
+	return resend
+}
+
+// Expire drops the messages that expired before now, the queued ones as
+// well as in-flight PUBLISH packets: a client that was offline can't
+// have received them. Queued messages move into the freed slots of the
+// window and go out with the next Resend.
+func (q *OutboundQueue) Expire(now time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	expired := false
+	for id, deadline := range q.deadlines {
+		if now.Before(deadline) {
+			continue
+		}
+		if q.Persister != nil {
+			if err := q.Persister.DeleteOutbound(id); err != nil {
+				return err
+			}
+		}
+		if p, ok := q.inflight[id].(*packet.PublishControlPacket); ok {
+			q.expire(p)
+		}
+		q.remove(id)
+		expired = true
+	}
+	queued := q.queued[:0]
+	for _, m := range q.queued {
+		if !m.expired(now) {
+			queued = append(queued, m)
+		} else {
+			q.expire(m.p)
+		}
+	}
+	for i := len(queued); i < len(q.queued); i++ {
+		q.queued[i] = queuedMessage{}
+	}
+	q.queued = queued
+	if !expired {
+		return nil
+	}
+	_, err := q.fill(now)
+	return err
+}
+
+// Restore adds in-flight PUBLISH and PUBREL packets loaded from storage,
+// in the order they were originally sent, without notifying the
+// Persister. Packets of other types are ignored. The expiry of restored
+// messages counts from the time of the call. Restored PUBLISH packets
+// count as Sent, as they may have reached the peer before.
+func (q *OutboundQueue) Restore(packets []packet.ControlPacket) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for _, p := range packets {
+		var id uint16
+		switch p := p.(type) {
+		case *packet.PublishControlPacket:
+			id = uint16(p.VariableHeader.PacketID)
+			if deadline := q.deadline(p, now); !deadline.IsZero() {
+				q.deadlines[id] = deadline
+			}
+		case *packet.PubrelControlPacket:
+			id = p.VariableHeader.PacketID
+		default:
+			continue
+		}
+		if q.ids.Reserve(id) {
+			q.order = append(q.order, id)
+		}
+		q.inflight[id] = p
+		q.flows[id] = &flow{started: now, sent: true}
+	}
+}
+
+// InFlight returns the number of messages whose flow has not completed
+func (q *OutboundQueue) InFlight() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.inflight)
+}
+
+// InFlightMessages describes the in-flight messages in the order their
+// flows started
+func (q *OutboundQueue) InFlightMessages(now time.Time) []InFlight {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	messages := make([]InFlight, 0, len(q.order))
+	for _, id := range q.order {
+		f := q.flows[id]
+		m := InFlight{PacketID: id, State: "pubrel", QoS: packet.QoSLevelExactlyOnce, Sent: true, Age: now.Sub(f.started), Retries: f.retries}
+		if p, ok := q.inflight[id].(*packet.PublishControlPacket); ok {
+			m.State, m.Topic, m.QoS, m.Sent = "publish", p.VariableHeader.Topic, p.FixedHeaderFlags.QoS, f.sent
+		}
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+// Queued returns the number of messages held back by the window
+func (q *OutboundQueue) Queued() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.queued)
+}
+
+// send assigns a free packet identifier to a copy of the message and
+// marks it in flight. The window guarantees that a free identifier exists.
+func (q *OutboundQueue) send(m queuedMessage, now time.Time) (*packet.PublishControlPacket, error) {
+	id, err := q.ids.Allocate()
+	if err != nil {
+		return nil, err
+	}
+
+	cp := *withExpiry(m.p, m.deadline, now)
+	cp.FixedHeaderFlags.Dup = false
+	cp.VariableHeader.PacketID = int(id)
+	if q.Persister != nil {
+		if err := q.Persister.StoreOutbound(&cp); err != nil {
+			q.ids.Free(id)
+			return nil, err
+		}
+	}
+	q.inflight[id] = &cp
+	q.flows[id] = &flow{started: now}
+	if !m.deadline.IsZero() {
+		q.deadlines[id] = m.deadline
+	}
+	q.order = append(q.order, id)
+	return &cp, nil
+}
+
+// complete removes packetID from flight and moves queued messages into
+// the freed slots
+func (q *OutboundQueue) complete(packetID uint16) ([]*packet.PublishControlPacket, error) {
+	if q.Persister != nil {
+		if err := q.Persister.DeleteOutbound(packetID); err != nil {
+			return nil, err
+		}
+	}
+	q.remove(packetID)
+	return q.fill(time.Now())
+}
+
+// remove takes packetID out of flight and frees it
+func (q *OutboundQueue) remove(packetID uint16) {
+	delete(q.inflight, packetID)
+	delete(q.deadlines, packetID)
+	delete(q.flows, packetID)
+	q.ids.Free(packetID)
+	for i, id := range q.order {
+		if id == packetID {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// fill moves queued messages into the window while it has room and
+// returns them for sending. Expired messages are dropped on the way.
+func (q *OutboundQueue) fill(now time.Time) ([]*packet.PublishControlPacket, error) {
+	var ready []*packet.PublishControlPacket
+	for len(q.queued) > 0 && len(q.inflight) < q.window {
+		if m := q.queued[0]; !m.expired(now) {
+			p, err := q.send(m, now)
+			if err != nil {
+				return ready, err
+			}
+			ready = append(ready, p)
+		} else {
+			q.expire(m.p)
+		}
+		q.queued[0] = queuedMessage{}
+		q.queued = q.queued[1:]
+	}
+	return ready, nil
+}
+
+// expire reports p, which expired, to Expired
+func (q *OutboundQueue) expire(p *packet.PublishControlPacket) {
+	if q.Expired != nil {
+		q.Expired(p)
+	}
+}
+
+// deadline returns when p expires, the earlier of its message expiry
+// interval and the TTL, or zero if it doesn't
+func (q *OutboundQueue) deadline(p *packet.PublishControlPacket, now time.Time) time.Time {
+	var deadline time.Time
+	if q.TTL > 0 {
+		deadline = now.Add(q.TTL)
+	}
+	if props := p.VariableHeader.Properties; props != nil && props.MessageExpiryInterval != nil {
+		d := now.Add(time.Duration(*props.MessageExpiryInterval) * time.Second)
+		if deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	return deadline
+}
+
+// withExpiry returns p with its message expiry interval reduced to the
+// time left until deadline, or p itself if it has none
+func withExpiry(p *packet.PublishControlPacket, deadline time.Time, now time.Time) *packet.PublishControlPacket {
+	props := p.VariableHeader.Properties
+	if props == nil || props.MessageExpiryInterval == nil || deadline.IsZero() {
+		return p
+	}
+	left := (deadline.Sub(now) + time.Second - 1) / time.Second
+	if left < 1 {
+		left = 1
+	}
+	if uint32(left) == *props.MessageExpiryInterval {
+		return p
+	}
+	cp := *p
+	cprops := *props
+	cprops.MessageExpiryInterval = packet.Uint32(uint32(left))
+	cp.VariableHeader.Properties = &cprops
+	return &cp
+}
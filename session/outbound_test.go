@@ -0,0 +1,300 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func qos1(topic string) *packet.PublishControlPacket {
+	p := packet.NewPublish(topic, 0, []byte(topic))
+	p.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+	return p
+}
+
+func TestOutboundQueueWindow(t *testing.T) {
+	q := NewOutboundQueue(2)
+
+	a, err := q.Push(qos1("a"))
+	require.NoError(t, err)
+	b, err := q.Push(qos1("b"))
+	require.NoError(t, err)
+	c, err := q.Push(qos1("c"))
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, a.VariableHeader.PacketID)
+	assert.Equal(t, 2, b.VariableHeader.PacketID)
+	assert.Nil(t, c, "window is full")
+	assert.Equal(t, 2, q.InFlight())
+	assert.Equal(t, 1, q.Queued())
+
+	_, err = q.Ack(3)
+	assert.Equal(t, ErrUnknownPacketID, err)
+
+	ready, err := q.Ack(2)
+	require.NoError(t, err)
+	require.Len(t, ready, 1)
+	assert.Equal(t, "c", ready[0].VariableHeader.Topic)
+	assert.Equal(t, 3, ready[0].VariableHeader.PacketID)
+	assert.Equal(t, 0, q.Queued())
+
+	_, err = q.Push(packet.NewPublish("qos0", 0, nil))
+	assert.Equal(t, ErrQoS0, err)
+
+	// A smaller window keeps the messages in flight but holds back new
+	// ones until enough were acknowledged
+	q.SetWindow(1)
+	d, err := q.Push(qos1("d"))
+	require.NoError(t, err)
+	assert.Nil(t, d)
+	ready, err = q.Ack(1)
+	require.NoError(t, err)
+	assert.Empty(t, ready)
+	ready, err = q.Ack(3)
+	require.NoError(t, err)
+	require.Len(t, ready, 1)
+	assert.Equal(t, "d", ready[0].VariableHeader.Topic)
+}
+
+func TestOutboundQueueResend(t *testing.T) {
+	q := NewOutboundQueue(0)
+	orig := qos1("a")
+	sent, err := q.Push(orig)
+	require.NoError(t, err)
+	q.Sent(uint16(sent.VariableHeader.PacketID))
+	for _, topic := range []string{"b", "c", "d"} {
+		_, err = q.Push(qos1(topic))
+		require.NoError(t, err)
+	}
+	q.Sent(2)
+	q.Sent(3)
+	_, err = q.Ack(2)
+	require.NoError(t, err)
+
+	resend := q.Resend()
+	require.Len(t, resend, 3)
+	for i, topic := range []string{"a", "c", "d"} {
+		p := resend[i].(*packet.PublishControlPacket)
+		assert.Equal(t, topic, p.VariableHeader.Topic)
+		assert.Equal(t, topic != "d", p.FixedHeaderFlags.Dup, "only packets sent before are duplicates")
+	}
+	assert.False(t, orig.FixedHeaderFlags.Dup, "pushed packet must not be modified")
+	assert.Equal(t, 0, orig.VariableHeader.PacketID)
+	assert.False(t, sent.FixedHeaderFlags.Dup, "sent packet must not be modified")
+}
+
+type recordingPersister struct {
+	outbound map[uint16]packet.ControlPacket
+	inbound  map[uint16]bool
+}
+
+func newRecordingPersister() *recordingPersister {
+	return &recordingPersister{
+		outbound: make(map[uint16]packet.ControlPacket),
+		inbound:  make(map[uint16]bool),
+	}
+}
+
+func (r *recordingPersister) StoreOutbound(p packet.ControlPacket) error {
+	switch p := p.(type) {
+	case *packet.PublishControlPacket:
+		r.outbound[uint16(p.VariableHeader.PacketID)] = p
+	case *packet.PubrelControlPacket:
+		r.outbound[p.VariableHeader.PacketID] = p
+	}
+	return nil
+}
+
+func (r *recordingPersister) DeleteOutbound(packetID uint16) error {
+	delete(r.outbound, packetID)
+	return nil
+}
+
+func (r *recordingPersister) StoreInbound(packetID uint16) error {
+	r.inbound[packetID] = true
+	return nil
+}
+
+func (r *recordingPersister) DeleteInbound(packetID uint16) error {
+	delete(r.inbound, packetID)
+	return nil
+}
+
+func TestOutboundQueueQoS2(t *testing.T) {
+	persister := newRecordingPersister()
+	q := NewOutboundQueue(1)
+	q.Persister = persister
+
+	p := qos1("a")
+	p.FixedHeaderFlags.QoS = packet.QoSLevelExactlyOnce
+	sent, err := q.Push(p)
+	require.NoError(t, err)
+	_, err = q.Push(qos1("b"))
+	require.NoError(t, err)
+	assert.IsType(t, &packet.PublishControlPacket{}, persister.outbound[1])
+
+	_, err = q.Ack(1)
+	assert.Equal(t, ErrUnexpectedAck, err)
+	_, err = q.Complete(1)
+	assert.Equal(t, ErrUnexpectedAck, err)
+
+	pubrel, err := q.Received(uint16(sent.VariableHeader.PacketID))
+	require.NoError(t, err)
+	assert.Equal(t, uint16(1), pubrel.VariableHeader.PacketID)
+	assert.Equal(t, pubrel, persister.outbound[1])
+
+	again, err := q.Received(1)
+	require.NoError(t, err)
+	assert.Equal(t, pubrel, again)
+
+	// After a reconnect only the PUBREL is sent again
+	assert.Equal(t, []packet.ControlPacket{pubrel}, q.Resend())
+
+	ready, err := q.Complete(1)
+	require.NoError(t, err)
+	require.Len(t, ready, 1)
+	assert.Equal(t, "b", ready[0].VariableHeader.Topic)
+	assert.NotContains(t, persister.outbound, uint16(1))
+	assert.Contains(t, persister.outbound, uint16(2))
+
+	// A restarted queue picks up where the old one left off
+	restored := NewOutboundQueue(1)
+	restored.Restore([]packet.ControlPacket{persister.outbound[2]})
+	assert.Equal(t, 1, restored.InFlight())
+	_, err = restored.Ack(2)
+	assert.NoError(t, err)
+}
+
+func TestOutboundQueueResendInterleaved(t *testing.T) {
+	qos2 := func(topic string) *packet.PublishControlPacket {
+		p := qos1(topic)
+		p.FixedHeaderFlags.QoS = packet.QoSLevelExactlyOnce
+		return p
+	}
+	q := NewOutboundQueue(3)
+	for _, p := range []*packet.PublishControlPacket{qos1("a"), qos2("b"), qos1("c"), qos2("d"), qos1("e")} {
+		_, err := q.Push(p)
+		require.NoError(t, err)
+	}
+	for id := uint16(1); id <= 3; id++ {
+		q.Sent(id)
+	}
+	_, err := q.Received(2)
+	require.NoError(t, err)
+	ready, err := q.Ack(1)
+	require.NoError(t, err)
+	require.Len(t, ready, 1)
+	d := ready[0].VariableHeader.PacketID
+
+	type sent struct {
+		packetID int
+		topic    string
+		dup      bool
+	}
+	resent := func(q *OutboundQueue) []sent {
+		var res []sent
+		for _, p := range q.Resend() {
+			switch p := p.(type) {
+			case *packet.PublishControlPacket:
+				res = append(res, sent{p.VariableHeader.PacketID, p.VariableHeader.Topic, p.FixedHeaderFlags.Dup})
+			case *packet.PubrelControlPacket:
+				res = append(res, sent{int(p.VariableHeader.PacketID), "PUBREL", false})
+			}
+		}
+		return res
+	}
+	// The PUBREL keeps the place of b, d comes after c whatever its
+	// packet identifier
+	assert.Equal(t, []sent{{2, "PUBREL", false}, {3, "c", true}, {d, "d", false}}, resent(q))
+
+	q.Sent(uint16(d))
+	ready, err = q.Ack(3)
+	require.NoError(t, err)
+	require.Len(t, ready, 1)
+	e := ready[0].VariableHeader.PacketID
+	assert.Equal(t, []sent{{2, "PUBREL", false}, {d, "d", true}, {e, "e", false}}, resent(q))
+
+	// A queue restored in the same order resends in the same order, every
+	// PUBLISH as a possible duplicate
+	restored := NewOutboundQueue(3)
+	restored.Restore(q.Resend())
+	assert.Equal(t, []sent{{2, "PUBREL", false}, {d, "d", true}, {e, "e", true}}, resent(restored))
+}
+
+func TestInbound(t *testing.T) {
+	persister := newRecordingPersister()
+	in := NewInbound()
+	in.Persister = persister
+
+	first, err := in.Receive(7)
+	require.NoError(t, err)
+	assert.True(t, first)
+	first, err = in.Receive(7)
+	require.NoError(t, err)
+	assert.False(t, first, "retransmitted PUBLISH must not be delivered twice")
+	assert.True(t, persister.inbound[7])
+
+	restored := NewInbound()
+	restored.Restore(in.PacketIDs())
+	first, err = restored.Receive(7)
+	require.NoError(t, err)
+	assert.False(t, first)
+
+	require.NoError(t, in.Release(7))
+	require.NoError(t, in.Release(7))
+	assert.Empty(t, persister.inbound)
+	first, err = in.Receive(7)
+	require.NoError(t, err)
+	assert.True(t, first, "packet identifier can be reused after PUBREL")
+}
+
+func TestOutboundQueueExpiry(t *testing.T) {
+	q := NewOutboundQueue(1)
+	q.TTL = time.Hour
+
+	first, err := q.Push(qos1("a"))
+	require.NoError(t, err)
+	require.NotNil(t, first)
+	short := qos1("b")
+	short.VariableHeader.Properties = &packet.Properties{MessageExpiryInterval: packet.Uint32(60)}
+	long := qos1("c")
+	long.VariableHeader.Properties = &packet.Properties{MessageExpiryInterval: packet.Uint32(7200)}
+	for _, p := range []*packet.PublishControlPacket{short, long} {
+		ready, err := q.Push(p)
+		require.NoError(t, err)
+		require.Nil(t, ready)
+	}
+
+	// After two minutes the first message is still in flight, only the
+	// queued one with an interval of 60 seconds expired
+	require.NoError(t, q.Expire(time.Now().Add(2*time.Minute)))
+	assert.Equal(t, 1, q.InFlight())
+	assert.Equal(t, 1, q.Queued())
+
+	// The TTL is shorter than the interval of the last message, so both
+	// expire
+	require.NoError(t, q.Expire(time.Now().Add(2*time.Hour)))
+	assert.Equal(t, 0, q.InFlight())
+	assert.Equal(t, 0, q.Queued())
+	assert.Empty(t, q.Resend())
+
+	// Messages that have waited are sent with the rest of their interval
+	d, err := q.Push(qos1("d"))
+	require.NoError(t, err)
+	require.NotNil(t, d)
+	ready, err := q.Push(long)
+	require.NoError(t, err)
+	require.Nil(t, ready)
+	q.mu.Lock()
+	q.queued[0].deadline = time.Now().Add(100 * time.Second)
+	q.mu.Unlock()
+	sent, err := q.Ack(uint16(d.VariableHeader.PacketID))
+	require.NoError(t, err)
+	require.Len(t, sent, 1)
+	assert.Equal(t, uint32(100), *sent[0].VariableHeader.Properties.MessageExpiryInterval)
+	assert.Equal(t, uint32(7200), *long.VariableHeader.Properties.MessageExpiryInterval, "pushed message must not be modified")
+}
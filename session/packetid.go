@@ -0,0 +1,139 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package session
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrNoPacketIDs is returned by PacketIDs.Allocate when all 65535 packet
+// identifiers are in use
+var ErrNoPacketIDs = errors.New("session: no free packet identifiers")
+
+// PacketIDs allocates the packet identifiers 1 to 65535 of the QoS 1 and
+// 2 flows of one side of a session. An identifier is in use from its
+// allocation until it is freed [MQTT-2.3.1-2]. Identifiers are handed
+// out in turn, so a freed one is reused only after the others. The zero
+// value is ready to use; it is safe for concurrent use.
+type PacketIDs struct {
+	mu    sync.Mutex
+	used  [65536 / 64]uint64 // bit set of the identifiers in use
+	count int
+	last  uint16
+	freed chan struct{} // closed on the next Free if someone waits
+}
+
+// Allocate returns a free packet identifier and marks it in use
+func (a *PacketIDs) Allocate() (uint16, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.allocate()
+}
+
+// Wait is Allocate, but waits for an identifier to be freed when all are
+// in use, until ctx is done
+func (a *PacketIDs) Wait(ctx context.Context) (uint16, error) {
+	for {
+		a.mu.Lock()
+		id, err := a.allocate()
+		if err == nil {
+			a.mu.Unlock()
+			return id, nil
+		}
+		if a.freed == nil {
+			a.freed = make(chan struct{})
+		}
+		freed := a.freed
+		a.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// Reserve marks id in use, e.g. for a flow restored from storage. It
+// reports false if id is 0 or in use already.
+func (a *PacketIDs) Reserve(id uint16) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if id == 0 || a.inUse(id) {
+		return false
+	}
+	a.used[id/64] |= 1 << (id % 64)
+	a.count++
+	a.last = id
+	return true
+}
+
+// Free releases id for reuse. Freeing an identifier that is not in use
+// does nothing.
+func (a *PacketIDs) Free(id uint16) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if id == 0 || !a.inUse(id) {
+		return
+	}
+	a.used[id/64] &^= 1 << (id % 64)
+	a.count--
+	if a.freed != nil {
+		close(a.freed)
+		a.freed = nil
+	}
+}
+
+// InUse returns the number of identifiers in use
+func (a *PacketIDs) InUse() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.count
+}
+
+// allocate is Allocate with a.mu held
+func (a *PacketIDs) allocate() (uint16, error) {
+	if a.count == 65535 {
+		return 0, ErrNoPacketIDs
+	}
+	id := a.last
+	for {
+		id++
+		if id == 0 {
+			id = 1
+		}
+		if a.used[id/64] == ^uint64(0) {
+			// Skip the rest of a full word
+			id |= 63
+			continue
+		}
+		if !a.inUse(id) {
+			break
+		}
+	}
+	a.used[id/64] |= 1 << (id % 64)
+	a.count++
+	a.last = id
+	return id, nil
+}
+
+func (a *PacketIDs) inUse(id uint16) bool {
+	return a.used[id/64]&(1<<(id%64)) != 0
+}
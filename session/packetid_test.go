@@ -0,0 +1,59 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacketIDs(t *testing.T) {
+	var ids PacketIDs
+	for want := 1; want <= 3; want++ {
+		id, err := ids.Allocate()
+		require.NoError(t, err)
+		assert.Equal(t, uint16(want), id)
+	}
+
+	// A freed identifier is reused after the others
+	ids.Free(2)
+	id, err := ids.Allocate()
+	require.NoError(t, err)
+	assert.Equal(t, uint16(4), id)
+
+	assert.False(t, ids.Reserve(3), "in use")
+	assert.False(t, ids.Reserve(0))
+	assert.True(t, ids.Reserve(2))
+	assert.Equal(t, 4, ids.InUse())
+
+	ids.Free(100) // not in use
+	assert.Equal(t, 4, ids.InUse())
+}
+
+func TestPacketIDsExhausted(t *testing.T) {
+	var ids PacketIDs
+	seen := make(map[uint16]bool)
+	for i := 0; i < 65535; i++ {
+		id, err := ids.Allocate()
+		require.NoError(t, err)
+		require.False(t, seen[id], "identifier %v allocated twice", id)
+		seen[id] = true
+	}
+	_, err := ids.Allocate()
+	assert.Equal(t, ErrNoPacketIDs, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = ids.Wait(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		ids.Free(1000)
+	}()
+	id, err := ids.Wait(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, uint16(1000), id)
+}
@@ -0,0 +1,63 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package session
+
+import "github.com/infinimesh/mqtt-go/packet"
+
+// Persister is notified of every change to the in-flight state of a
+// session so that it can be written to durable storage. A change is only
+// acknowledged to the peer after the Persister returned without error,
+// which is what keeps the QoS 2 guarantee across restarts.
+type Persister interface {
+	// StoreOutbound is called with a PUBLISH that was assigned a packet
+	// identifier, and again with the PUBREL replacing it after PUBREC
+	StoreOutbound(p packet.ControlPacket) error
+	// DeleteOutbound is called when the flow of packetID completed
+	DeleteOutbound(packetID uint16) error
+	// StoreInbound is called when a QoS 2 PUBLISH is first received
+	StoreInbound(packetID uint16) error
+	// DeleteInbound is called when its PUBREL was received
+	DeleteInbound(packetID uint16) error
+}
+
+// Store keeps the persistent sessions in durable storage, so that they
+// survive a restart of the server. Clean sessions are never stored.
+// Backends must be safe for concurrent use.
+type Store interface {
+	// Persister returns the Persister that writes the in-flight state
+	// of the session of clientID
+	Persister(clientID string) Persister
+	// SaveSubscriptions replaces the stored subscriptions of clientID
+	SaveSubscriptions(clientID string, subs []packet.Subscription) error
+	// DeleteSession removes everything stored for clientID
+	DeleteSession(clientID string) error
+	// LoadSessions returns every stored session
+	LoadSessions() ([]State, error)
+}
+
+// State is a session as it is kept by a Store
+type State struct {
+	ClientID      string
+	Subscriptions []packet.Subscription
+	// Outbound holds the in-flight PUBLISH and PUBREL packets in the
+	// order they were sent
+	Outbound []packet.ControlPacket
+	// Inbound holds the identifiers of the QoS 2 messages received but
+	// not yet released
+	Inbound []uint16
+}
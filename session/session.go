@@ -0,0 +1,449 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package session
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// NeverExpires is the expiry of a session that is kept until its client
+// starts a new one, like a persistent MQTT 3.1.1 session
+const NeverExpires = time.Duration(math.MaxInt64)
+
+// Session is the state the server keeps for a client. A persistent
+// session outlives the network connection, so that subscriptions and
+// unacknowledged QoS 1 and 2 messages are still there when the client
+// reconnects.
+type Session struct {
+	ClientID string
+	// Clean is set if the session was created with an expiry of 0, like
+	// for the CleanSession flag of MQTT 3.1.1. A clean session ends with
+	// the network connection and is never stored.
+	Clean bool
+
+	Outbound *OutboundQueue
+	Inbound  *Inbound
+
+	mu            sync.Mutex
+	subscriptions map[string]packet.Subscription
+	will          *packet.PublishControlPacket
+	expiry        time.Duration
+	// disconnected is when the connection of the session ended, zero
+	// while a client is connected
+	disconnected time.Time
+}
+
+func newSession(clientID string, expiry time.Duration, window int) *Session {
+	return &Session{
+		ClientID:      clientID,
+		Clean:         expiry == 0,
+		Outbound:      NewOutboundQueue(window),
+		Inbound:       NewInbound(),
+		subscriptions: make(map[string]packet.Subscription),
+		expiry:        expiry,
+	}
+}
+
+// Expiry returns how long the session is kept after its network
+// connection ended
+func (s *Session) Expiry() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expiry
+}
+
+// SetExpiry changes the expiry, as the DISCONNECT of an MQTT 5 client
+// may do. The Manager limits it to its MaxExpiry once the session is
+// closed.
+func (s *Session) SetExpiry(expiry time.Duration) {
+	s.mu.Lock()
+	s.expiry = expiry
+	s.mu.Unlock()
+}
+
+// offline reports whether the connection of the session ended
+func (s *Session) offline() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.disconnected.IsZero()
+}
+
+// expired reports whether the session ran out of time at now
+func (s *Session) expired(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.disconnected.IsZero() && s.expiry != NeverExpires && now.Sub(s.disconnected) >= s.expiry
+}
+
+// Subscribe adds or replaces the subscription to sub.Topic and reports
+// whether it replaced an existing one
+func (s *Session) Subscribe(sub packet.Subscription) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, existed := s.subscriptions[sub.Topic]
+	s.subscriptions[sub.Topic] = sub
+	return existed
+}
+
+// Subscribed reports whether the session has a subscription to filter
+func (s *Session) Subscribed(filter string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.subscriptions[filter]
+	return ok
+}
+
+// SubscriptionCount returns the number of subscriptions
+func (s *Session) SubscriptionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscriptions)
+}
+
+// Unsubscribe removes the subscription to filter and reports whether it
+// existed
+func (s *Session) Unsubscribe(filter string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, existed := s.subscriptions[filter]
+	delete(s.subscriptions, filter)
+	return existed
+}
+
+// Subscriptions returns the subscriptions sorted by topic filter
+func (s *Session) Subscriptions() []packet.Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subs := make([]packet.Subscription, 0, len(s.subscriptions))
+	for _, sub := range s.subscriptions {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Topic < subs[j].Topic })
+	return subs
+}
+
+// SetWill replaces the will message that is published if the connection
+// ends without DISCONNECT. A nil will removes it.
+func (s *Session) SetWill(will *packet.PublishControlPacket) {
+	s.mu.Lock()
+	s.will = will
+	s.mu.Unlock()
+}
+
+// TakeWill removes the will message and returns it, or nil if there is
+// none
+func (s *Session) TakeWill() *packet.PublishControlPacket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	will := s.will
+	s.will = nil
+	return will
+}
+
+// Snapshot is the state of a session at one point in time, e.g. to
+// troubleshoot stuck QoS 1 and 2 flows
+type Snapshot struct {
+	ClientID  string `json:"client_id"`
+	Connected bool   `json:"connected"`
+	// Subscriptions holds the topic filters subscribed to
+	Subscriptions []string `json:"subscriptions"`
+	// Outbound holds the messages in flight to the client, Queued the
+	// number of messages held back by the window
+	Outbound []InFlight `json:"outbound"`
+	Queued   int        `json:"queued"`
+	// Inbound holds the packet identifiers of the QoS 2 messages from the
+	// client waiting for their PUBREL
+	Inbound []uint16 `json:"inbound"`
+}
+
+// Snapshot returns the state of the session at now
+func (s *Session) Snapshot(now time.Time) Snapshot {
+	snap := Snapshot{
+		ClientID:      s.ClientID,
+		Connected:     !s.offline(),
+		Subscriptions: []string{},
+		Outbound:      s.Outbound.InFlightMessages(now),
+		Queued:        s.Outbound.Queued(),
+		Inbound:       s.Inbound.PacketIDs(),
+	}
+	for _, sub := range s.Subscriptions() {
+		snap.Subscriptions = append(snap.Subscriptions, sub.Topic)
+	}
+	return snap
+}
+
+// Manager keeps the sessions of all clients, keyed by client identifier.
+// It is safe for concurrent use.
+type Manager struct {
+	// Window is the in-flight window of the outbound queue of new
+	// sessions, see NewOutboundQueue. Set it before the Manager is used.
+	Window int
+	// Store, if set, keeps the persistent sessions in durable storage.
+	// Set it before the Manager is used and call Restore to load the
+	// sessions stored by an earlier run.
+	Store Store
+	// MaxExpiry limits how long a session is kept after its connection
+	// ended, whatever the client asked for. Persistent MQTT 3.1.1
+	// sessions and those restored from the Store are discarded after it
+	// as well. 0 means no limit.
+	MaxExpiry time.Duration
+	// MessageExpiry limits how long a QoS 1 or 2 message waits for
+	// delivery to a session, see OutboundQueue.TTL. 0 means no limit.
+	MessageExpiry time.Duration
+	// Expired, if set, is called with every message the outbound queue
+	// of the session of clientID dropped because it expired, see
+	// OutboundQueue.Expired. It must not use the Manager.
+	Expired func(clientID string, p *packet.PublishControlPacket)
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewManager returns a Manager without sessions
+func NewManager() *Manager {
+	return &Manager{sessions: make(map[string]*Session)}
+}
+
+// Open returns the session for an MQTT 3.1.1 client connecting with the
+// CleanSession flag clean. It is OpenExpiry with an expiry of 0 for clean
+// sessions and NeverExpires for persistent ones.
+func (m *Manager) Open(clientID string, clean bool) (s *Session, present bool, err error) {
+	expiry := NeverExpires
+	if clean {
+		expiry = 0
+	}
+	return m.OpenExpiry(clientID, clean, expiry)
+}
+
+// OpenExpiry returns the session for a client connecting with the Clean
+// Start flag cleanStart that is to be kept for expiry once its connection
+// ended. The old session is resumed unless cleanStart is set, it was
+// clean or it expired; in every other case it is discarded and a new
+// one started. expiry is limited to MaxExpiry, see Session.Expiry for the
+// value granted. present reports whether a session was resumed and is
+// what CONNACK reports as SessionPresent [MQTT-3.2.2-1] [MQTT-3.2.2-2].
+// An error is only returned if the Store failed.
+func (m *Manager) OpenExpiry(clientID string, cleanStart bool, expiry time.Duration) (s *Session, present bool, err error) {
+	expiry = m.limit(expiry)
+	// A client without identifier always gets a session of its own
+	if clientID == "" {
+		return m.newSession(clientID, expiry), false, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.sessions[clientID]
+	if ok && !cleanStart && !old.Clean && !old.expired(time.Now()) {
+		old.mu.Lock()
+		old.expiry = expiry
+		old.disconnected = time.Time{}
+		old.mu.Unlock()
+		return old, true, nil
+	}
+	if m.Store != nil && ok && !old.Clean {
+		if err := m.Store.DeleteSession(clientID); err != nil {
+			return nil, false, err
+		}
+	}
+	s = m.newSession(clientID, expiry)
+	if m.Store != nil && !s.Clean {
+		// Stored right away, so that the session is restored even if it
+		// never subscribes
+		if err := m.Store.SaveSubscriptions(clientID, nil); err != nil {
+			return nil, false, err
+		}
+		m.persist(s)
+	}
+	m.sessions[clientID] = s
+	return s, false, nil
+}
+
+// Restore loads the sessions kept by the Store, replacing the sessions
+// of the same clients. The Store doesn't keep the expiry of the
+// sessions, they are restored as persistent sessions limited to
+// MaxExpiry and without connection.
+func (m *Manager) Restore() error {
+	if m.Store == nil {
+		return nil
+	}
+	states, err := m.Store.LoadSessions()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, st := range states {
+		s := m.newSession(st.ClientID, m.limit(NeverExpires))
+		s.disconnected = now
+		for _, sub := range st.Subscriptions {
+			s.subscriptions[sub.Topic] = sub
+		}
+		s.Outbound.Restore(st.Outbound)
+		s.Inbound.Restore(st.Inbound)
+		m.persist(s)
+		m.sessions[st.ClientID] = s
+	}
+	return nil
+}
+
+// SaveSubscriptions writes the subscriptions of s to the Store. It does
+// nothing for clean sessions or without Store.
+func (m *Manager) SaveSubscriptions(s *Session) error {
+	if m.Store == nil || s.Clean || s.ClientID == "" {
+		return nil
+	}
+	return m.Store.SaveSubscriptions(s.ClientID, s.Subscriptions())
+}
+
+// SaveAll writes the subscriptions of every persistent session to the
+// Store, e.g. before the server shuts down. It returns the first error
+// but tries every session.
+func (m *Manager) SaveAll() error {
+	var err error
+	for _, s := range m.All() {
+		if serr := m.SaveSubscriptions(s); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// newSession returns a session using the settings of m
+func (m *Manager) newSession(clientID string, expiry time.Duration) *Session {
+	s := newSession(clientID, expiry, m.Window)
+	s.Outbound.TTL = m.MessageExpiry
+	s.Outbound.Expired = func(p *packet.PublishControlPacket) {
+		// Read late, so that sessions restored before Expired was set
+		// report their messages too
+		if expired := m.Expired; expired != nil {
+			expired(clientID, p)
+		}
+	}
+	return s
+}
+
+// limit applies MaxExpiry to expiry
+func (m *Manager) limit(expiry time.Duration) time.Duration {
+	if m.MaxExpiry > 0 && expiry > m.MaxExpiry {
+		return m.MaxExpiry
+	}
+	return expiry
+}
+
+// persist makes the in-flight state of s go to the Store
+func (m *Manager) persist(s *Session) {
+	p := m.Store.Persister(s.ClientID)
+	s.Outbound.Persister = p
+	s.Inbound.Persister = p
+}
+
+// Close is called when the connection of s ended. A session with an
+// expiry of 0 is discarded, from the Store as well; others are kept until
+// they expire. Sessions that have already been replaced by a newer
+// connection are left alone.
+func (m *Manager) Close(s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.sessions[s.ClientID] != s {
+		return nil
+	}
+	s.mu.Lock()
+	s.expiry = m.limit(s.expiry)
+	s.disconnected = time.Now()
+	expiry := s.expiry
+	s.mu.Unlock()
+	if expiry > 0 {
+		return nil
+	}
+	delete(m.sessions, s.ClientID)
+	if m.Store != nil && !s.Clean {
+		return m.Store.DeleteSession(s.ClientID)
+	}
+	return nil
+}
+
+// Expire discards the sessions that have been without connection for
+// longer than their expiry and returns them. The outbound queues of the
+// remaining sessions without connection drop their expired messages. It
+// returns the first error of the Store but goes through every session.
+func (m *Manager) Expire(now time.Time) ([]*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var expired []*Session
+	var err error
+	for clientID, s := range m.sessions {
+		if !s.offline() {
+			continue
+		}
+		if !s.expired(now) {
+			if qerr := s.Outbound.Expire(now); qerr != nil && err == nil {
+				err = qerr
+			}
+			continue
+		}
+		delete(m.sessions, clientID)
+		if m.Store != nil && !s.Clean {
+			if serr := m.Store.DeleteSession(clientID); serr != nil && err == nil {
+				err = serr
+			}
+		}
+		expired = append(expired, s)
+	}
+	return expired, err
+}
+
+// Get returns the session of clientID, if there is one
+func (m *Manager) Get(clientID string) (*Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[clientID]
+	return s, ok
+}
+
+// All returns every session, in no particular order
+func (m *Manager) All() []*Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// Remove discards the session of clientID, from the Store as well
+func (m *Manager) Remove(clientID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, clientID)
+	if m.Store != nil {
+		return m.Store.DeleteSession(clientID)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func TestManagerOpen(t *testing.T) {
+	m := NewManager()
+
+	s, present, err := m.Open("c1", false)
+	require.NoError(t, err)
+	assert.False(t, present)
+	s.Subscribe(packet.Subscription{Topic: "a/#", QoS: packet.QoSLevelAtLeastOnce})
+	m.Close(s)
+
+	resumed, present, err := m.Open("c1", false)
+	require.NoError(t, err)
+	assert.True(t, present)
+	assert.True(t, s == resumed)
+	assert.Equal(t, []packet.Subscription{{Topic: "a/#", QoS: packet.QoSLevelAtLeastOnce}}, resumed.Subscriptions())
+
+	// A clean session replaces the persistent one and ends with the
+	// connection
+	clean, present, err := m.Open("c1", true)
+	require.NoError(t, err)
+	assert.False(t, present)
+	assert.Empty(t, clean.Subscriptions())
+	m.Close(resumed)
+	_, ok := m.Get("c1")
+	assert.True(t, ok, "closing a replaced session must not discard the new one")
+	m.Close(clean)
+	_, ok = m.Get("c1")
+	assert.False(t, ok)
+
+	a, _, _ := m.Open("", true)
+	b, _, _ := m.Open("", true)
+	assert.False(t, a == b, "clients without identifier must not share a session")
+}
+
+func TestManagerExpiry(t *testing.T) {
+	m := NewManager()
+	m.MaxExpiry = time.Hour
+
+	s, _, err := m.OpenExpiry("c1", true, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, s.Clean)
+	require.NoError(t, m.Close(s))
+
+	expired, err := m.Expire(time.Now().Add(30 * time.Second))
+	require.NoError(t, err)
+	assert.Empty(t, expired)
+	resumed, present, err := m.OpenExpiry("c1", false, NeverExpires)
+	require.NoError(t, err)
+	assert.True(t, present)
+	assert.True(t, s == resumed)
+	assert.Equal(t, time.Hour, resumed.Expiry(), "expiry must be limited to MaxExpiry")
+
+	// A connected session never expires
+	expired, err = m.Expire(time.Now().Add(2 * time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, expired)
+
+	require.NoError(t, m.Close(resumed))
+	expired, err = m.Expire(time.Now().Add(2 * time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []*Session{s}, expired)
+	_, ok := m.Get("c1")
+	assert.False(t, ok)
+
+	// An expiry of 0 set before the connection ended discards the
+	// session right away
+	s, _, err = m.OpenExpiry("c2", false, time.Minute)
+	require.NoError(t, err)
+	s.SetExpiry(0)
+	require.NoError(t, m.Close(s))
+	_, ok = m.Get("c2")
+	assert.False(t, ok)
+}
+
+func TestSessionSubscriptions(t *testing.T) {
+	s := newSession("c1", NeverExpires, 0)
+	assert.False(t, s.Subscribe(packet.Subscription{Topic: "b", QoS: packet.QoSLevelNone}))
+	assert.True(t, s.Subscribe(packet.Subscription{Topic: "b", QoS: packet.QoSLevelExactlyOnce}))
+	s.Subscribe(packet.Subscription{Topic: "a"})
+
+	subs := s.Subscriptions()
+	assert.Len(t, subs, 2)
+	assert.Equal(t, "a", subs[0].Topic)
+	assert.Equal(t, packet.QoSLevelExactlyOnce, subs[1].QoS)
+	assert.Equal(t, 2, s.SubscriptionCount())
+	assert.True(t, s.Subscribed("a"))
+
+	assert.True(t, s.Unsubscribe("a"))
+	assert.False(t, s.Unsubscribe("a"))
+	assert.False(t, s.Subscribed("a"))
+	assert.Equal(t, 1, s.SubscriptionCount())
+}
+
+func TestSessionSnapshot(t *testing.T) {
+	m := NewManager()
+	s, _, err := m.Open("c1", false)
+	require.NoError(t, err)
+	s.Subscribe(packet.Subscription{Topic: "a/#", QoS: packet.QoSLevelExactlyOnce})
+
+	start := time.Now()
+	for _, topic := range []string{"a/1", "a/2"} {
+		p := packet.NewPublish(topic, 0, nil)
+		p.FixedHeaderFlags.QoS = packet.QoSLevelExactlyOnce
+		_, err := s.Outbound.Push(p)
+		require.NoError(t, err)
+	}
+	s.Outbound.Sent(1)
+	_, err = s.Outbound.Received(1)
+	require.NoError(t, err)
+	s.Outbound.Sent(2)
+	s.Outbound.Resend()
+	_, err = s.Inbound.Receive(7)
+	require.NoError(t, err)
+
+	snap := s.Snapshot(start.Add(time.Minute))
+	assert.Equal(t, "c1", snap.ClientID)
+	assert.True(t, snap.Connected)
+	assert.Equal(t, []string{"a/#"}, snap.Subscriptions)
+	require.Len(t, snap.Outbound, 2)
+	assert.Equal(t, "pubrel", snap.Outbound[0].State)
+	assert.Equal(t, InFlight{PacketID: 2, State: "publish", Topic: "a/2", QoS: packet.QoSLevelExactlyOnce, Sent: true, Age: snap.Outbound[1].Age, Retries: 1}, snap.Outbound[1])
+	assert.True(t, snap.Outbound[1].Age >= time.Minute-time.Second)
+	assert.Equal(t, []uint16{7}, snap.Inbound)
+}
@@ -0,0 +1,62 @@
+package store
+
+import (
+	"flag"
+	"fmt"
+	"testing"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+var retainedScale = flag.Int("retained", 1_000_000, "number of retained topics of the benchmarks")
+
+// BenchmarkStoreRetainAll bulk loads the retained topics into every
+// backend and matches a room and everything afterwards
+func BenchmarkStoreRetainAll(b *testing.B) {
+	ps := make([]*packet.PublishControlPacket, *retainedScale)
+	for i := range ps {
+		ps[i] = publish(fmt.Sprintf("home/%d/room%d/device%d", i/100, i/10%10, i%10), 0, `{"state":"on"}`)
+	}
+	for _, backend := range backends {
+		open := backend.store(b)
+		var s Store
+		b.Run(backend.name+"/retain all", func(b *testing.B) {
+			for b.Loop() {
+				b.StopTimer()
+				if s != nil {
+					_ = s.Close()
+				}
+				var err error
+				if s, err = open(); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				if err := s.RetainAll(ps); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(ps)), "ns/message")
+		})
+		for _, filter := range []string{"home/0/room1/+", "#"} {
+			b.Run(backend.name+"/match "+filter, func(b *testing.B) {
+				if s == nil {
+					var err error
+					if s, err = open(); err != nil {
+						b.Fatal(err)
+					}
+					if err := s.RetainAll(ps); err != nil {
+						b.Fatal(err)
+					}
+				}
+				for b.Loop() {
+					if _, err := s.Match(filter); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+		if s != nil {
+			_ = s.Close()
+		}
+	}
+}
@@ -0,0 +1,368 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"slices"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+	"github.com/infinimesh/mqtt-go/topic"
+)
+
+var (
+	bucketSessions = []byte("sessions")
+	bucketRetained = []byte("retained")
+	bucketDelayed  = []byte("delayed")
+	bucketOutbound = []byte("outbound")
+	bucketInbound  = []byte("inbound")
+	keySubs        = []byte("subscriptions")
+)
+
+// Bolt is a Store in a BoltDB file. Every change is written in its own
+// transaction.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens the BoltDB file at path, creating it if it doesn't exist
+func OpenBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketSessions, bucketRetained, bucketDelayed} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &Bolt{db: db}, nil
+}
+
+// Close closes the database file
+func (s *Bolt) Close() error {
+	return s.db.Close()
+}
+
+// Retain stores p as the retained message of its topic, or deletes the
+// retained message if p has an empty payload
+func (s *Bolt) Retain(p *packet.PublishControlPacket) error {
+	key := []byte(p.VariableHeader.Topic)
+	if len(p.Payload) == 0 {
+		return s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(bucketRetained).Delete(key)
+		})
+	}
+	b, err := encodeRetained(p)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRetained).Put(key, b)
+	})
+}
+
+// RetainAll stores ps in one transaction. They are written sorted by
+// topic, which Bolt appends much faster than random keys.
+func (s *Bolt) RetainAll(ps []*packet.PublishControlPacket) error {
+	type record struct {
+		key, value []byte
+	}
+	records := make([]record, len(ps))
+	for i, p := range ps {
+		records[i].key = []byte(p.VariableHeader.Topic)
+		if len(p.Payload) == 0 {
+			continue
+		}
+		var err error
+		if records[i].value, err = encodeRetained(p); err != nil {
+			return err
+		}
+	}
+	slices.SortStableFunc(records, func(a, b record) int {
+		return bytes.Compare(a.key, b.key)
+	})
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketRetained)
+		for _, r := range records {
+			var err error
+			if r.value == nil {
+				err = bucket.Delete(r.key)
+			} else {
+				err = bucket.Put(r.key, r.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Match returns the matching messages sorted by topic
+func (s *Bolt) Match(filter string) ([]*packet.PublishControlPacket, error) {
+	var matches []*packet.PublishControlPacket
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRetained).ForEach(func(k, v []byte) error {
+			if !topic.Matches(filter, string(k)) {
+				return nil
+			}
+			p, err := decodePublish(v)
+			if err != nil {
+				return err
+			}
+			matches = append(matches, p)
+			return nil
+		})
+	})
+	return matches, err
+}
+
+// SaveSubscriptions replaces the stored subscriptions of clientID
+func (s *Bolt) SaveSubscriptions(clientID string, subs []packet.Subscription) error {
+	b, err := json.Marshal(subs)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		sb, err := tx.Bucket(bucketSessions).CreateBucketIfNotExists([]byte(clientID))
+		if err != nil {
+			return err
+		}
+		return sb.Put(keySubs, b)
+	})
+}
+
+// DeleteSession removes the session of clientID with its in-flight
+// messages
+func (s *Bolt) DeleteSession(clientID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(bucketSessions).DeleteBucket([]byte(clientID))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// LoadSessions returns the stored sessions sorted by client identifier
+func (s *Bolt) LoadSessions() ([]session.State, error) {
+	var states []session.State
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSessions).ForEachBucket(func(k []byte) error {
+			st, err := loadBoltSession(tx.Bucket(bucketSessions).Bucket(k))
+			if err != nil {
+				return err
+			}
+			st.ClientID = string(k)
+			states = append(states, st)
+			return nil
+		})
+	})
+	return states, err
+}
+
+func loadBoltSession(sb *bolt.Bucket) (st session.State, err error) {
+	if b := sb.Get(keySubs); b != nil {
+		if err := json.Unmarshal(b, &st.Subscriptions); err != nil {
+			return st, err
+		}
+	}
+
+	if ob := sb.Bucket(bucketOutbound); ob != nil {
+		// Values are the sequence number the packet was first stored
+		// with, followed by the packet
+		var seqs []uint64
+		err := ob.ForEach(func(_, v []byte) error {
+			p, err := decodePacket(v[8:])
+			if err != nil {
+				return err
+			}
+			seqs = append(seqs, binary.BigEndian.Uint64(v))
+			st.Outbound = append(st.Outbound, p)
+			return nil
+		})
+		if err != nil {
+			return st, err
+		}
+		sort.Sort(bySeq{seqs, st.Outbound})
+	}
+
+	if ib := sb.Bucket(bucketInbound); ib != nil {
+		err := ib.ForEach(func(k, _ []byte) error {
+			st.Inbound = append(st.Inbound, binary.BigEndian.Uint16(k))
+			return nil
+		})
+		if err != nil {
+			return st, err
+		}
+	}
+	return st, nil
+}
+
+// StoreDelayed stores the delayed message m
+func (s *Bolt) StoreDelayed(m broker.DelayedMessage) error {
+	b, err := encodeDelayed(m)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketDelayed).Put(delayedKey(m.ID), b)
+	})
+}
+
+// DeleteDelayed removes the delayed message id
+func (s *Bolt) DeleteDelayed(id uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketDelayed).Delete(delayedKey(id))
+	})
+}
+
+// LoadDelayed returns the delayed messages sorted by when they are due
+func (s *Bolt) LoadDelayed() ([]broker.DelayedMessage, error) {
+	var ms []broker.DelayedMessage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketDelayed).ForEach(func(k, v []byte) error {
+			m, err := decodeDelayed(binary.BigEndian.Uint64(k), v)
+			if err != nil {
+				return err
+			}
+			ms = append(ms, m)
+			return nil
+		})
+	})
+	sortDelayed(ms)
+	return ms, err
+}
+
+func delayedKey(id uint64) []byte {
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], id)
+	return k[:]
+}
+
+type bySeq struct {
+	seqs    []uint64
+	packets []packet.ControlPacket
+}
+
+func (s bySeq) Len() int           { return len(s.seqs) }
+func (s bySeq) Less(i, j int) bool { return s.seqs[i] < s.seqs[j] }
+func (s bySeq) Swap(i, j int) {
+	s.seqs[i], s.seqs[j] = s.seqs[j], s.seqs[i]
+	s.packets[i], s.packets[j] = s.packets[j], s.packets[i]
+}
+
+// Persister returns the Persister of the in-flight messages of clientID
+func (s *Bolt) Persister(clientID string) session.Persister {
+	return &boltPersister{db: s.db, clientID: []byte(clientID)}
+}
+
+type boltPersister struct {
+	db       *bolt.DB
+	clientID []byte
+}
+
+// bucket returns the named bucket of the session, creating both if needed
+func (p *boltPersister) bucket(tx *bolt.Tx, name []byte) (*bolt.Bucket, error) {
+	sb, err := tx.Bucket(bucketSessions).CreateBucketIfNotExists(p.clientID)
+	if err != nil {
+		return nil, err
+	}
+	return sb.CreateBucketIfNotExists(name)
+}
+
+func (p *boltPersister) StoreOutbound(cp packet.ControlPacket) error {
+	id, err := outboundID(cp)
+	if err != nil {
+		return err
+	}
+	b, err := encodePacket(cp)
+	if err != nil {
+		return err
+	}
+	return p.db.Update(func(tx *bolt.Tx) error {
+		ob, err := p.bucket(tx, bucketOutbound)
+		if err != nil {
+			return err
+		}
+		key := packetIDKey(id)
+		// A PUBREL keeps the place of the PUBLISH it replaces
+		var seq uint64
+		if old := ob.Get(key); old != nil {
+			seq = binary.BigEndian.Uint64(old)
+		} else if seq, err = ob.NextSequence(); err != nil {
+			return err
+		}
+		v := make([]byte, 8, 8+len(b))
+		binary.BigEndian.PutUint64(v, seq)
+		return ob.Put(key, append(v, b...))
+	})
+}
+
+func (p *boltPersister) DeleteOutbound(packetID uint16) error {
+	return p.delete(bucketOutbound, packetID)
+}
+
+func (p *boltPersister) StoreInbound(packetID uint16) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		ib, err := p.bucket(tx, bucketInbound)
+		if err != nil {
+			return err
+		}
+		return ib.Put(packetIDKey(packetID), nil)
+	})
+}
+
+func (p *boltPersister) DeleteInbound(packetID uint16) error {
+	return p.delete(bucketInbound, packetID)
+}
+
+func (p *boltPersister) delete(name []byte, packetID uint16) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		sb := tx.Bucket(bucketSessions).Bucket(p.clientID)
+		if sb == nil {
+			return nil
+		}
+		if b := sb.Bucket(name); b != nil {
+			return b.Delete(packetIDKey(packetID))
+		}
+		return nil
+	})
+}
+
+func packetIDKey(id uint16) []byte {
+	var k [2]byte
+	binary.BigEndian.PutUint16(k[:], id)
+	return k[:]
+}
@@ -0,0 +1,367 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+	"github.com/infinimesh/mqtt-go/topic"
+)
+
+// File is a Store that keeps everything in memory and rewrites a single
+// JSON file on every change. It suits brokers with few persistent
+// sessions and retained messages; use Bolt for anything larger.
+type File struct {
+	path string
+
+	mu    sync.Mutex
+	state fileState
+}
+
+type fileState struct {
+	Sessions map[string]*fileSession `json:"sessions"`
+	// Retained maps topics to encoded PUBLISH packets
+	Retained map[string][]byte `json:"retained"`
+	// Delayed maps the identifiers of delayed messages to their records
+	Delayed map[uint64][]byte `json:"delayed,omitempty"`
+}
+
+type fileSession struct {
+	Subscriptions []packet.Subscription `json:"subscriptions,omitempty"`
+	Outbound      []fileOutbound        `json:"outbound,omitempty"`
+	Inbound       []uint16              `json:"inbound,omitempty"`
+}
+
+type fileOutbound struct {
+	PacketID uint16 `json:"packet_id"`
+	Packet   []byte `json:"packet"`
+}
+
+// OpenFile loads the state kept in the file at path. The file is created
+// with the first change if it doesn't exist.
+func OpenFile(path string) (*File, error) {
+	s := &File{path: path}
+	b, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(b, &s.state); err != nil {
+			return nil, err
+		}
+	}
+	if s.state.Sessions == nil {
+		s.state.Sessions = make(map[string]*fileSession)
+	}
+	if s.state.Retained == nil {
+		s.state.Retained = make(map[string][]byte)
+	}
+	if s.state.Delayed == nil {
+		s.state.Delayed = make(map[uint64][]byte)
+	}
+	return s, nil
+}
+
+// Close does nothing, every change has already been written
+func (s *File) Close() error {
+	return nil
+}
+
+// save writes the state to a temporary file and renames it over the old
+// one, so that a crash never leaves a partly written file behind. s.mu
+// must be held.
+func (s *File) save() error {
+	b, err := json.Marshal(&s.state)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // nolint: errcheck
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+// Retain stores p as the retained message of its topic, or deletes the
+// retained message if p has an empty payload
+func (s *File) Retain(p *packet.PublishControlPacket) error {
+	var b []byte
+	if len(p.Payload) > 0 {
+		var err error
+		if b, err = encodeRetained(p); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b == nil {
+		if _, ok := s.state.Retained[p.VariableHeader.Topic]; !ok {
+			return nil
+		}
+		delete(s.state.Retained, p.VariableHeader.Topic)
+	} else {
+		s.state.Retained[p.VariableHeader.Topic] = b
+	}
+	return s.save()
+}
+
+// RetainAll stores ps writing the file once
+func (s *File) RetainAll(ps []*packet.PublishControlPacket) error {
+	records := make([][]byte, len(ps))
+	for i, p := range ps {
+		if len(p.Payload) == 0 {
+			continue
+		}
+		var err error
+		if records[i], err = encodeRetained(p); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, p := range ps {
+		if records[i] == nil {
+			delete(s.state.Retained, p.VariableHeader.Topic)
+		} else {
+			s.state.Retained[p.VariableHeader.Topic] = records[i]
+		}
+	}
+	return s.save()
+}
+
+// Match returns the matching messages sorted by topic
+func (s *File) Match(filter string) ([]*packet.PublishControlPacket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matches []*packet.PublishControlPacket
+	for name, b := range s.state.Retained {
+		if !topic.Matches(filter, name) {
+			continue
+		}
+		p, err := decodePublish(b)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, p)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].VariableHeader.Topic < matches[j].VariableHeader.Topic
+	})
+	return matches, nil
+}
+
+// SaveSubscriptions replaces the stored subscriptions of clientID
+func (s *File) SaveSubscriptions(clientID string, subs []packet.Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(clientID).Subscriptions = subs
+	return s.save()
+}
+
+// DeleteSession removes the session of clientID with its in-flight
+// messages
+func (s *File) DeleteSession(clientID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.state.Sessions[clientID]; !ok {
+		return nil
+	}
+	delete(s.state.Sessions, clientID)
+	return s.save()
+}
+
+// LoadSessions returns the stored sessions sorted by client identifier
+func (s *File) LoadSessions() ([]session.State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	states := make([]session.State, 0, len(s.state.Sessions))
+	for id, fs := range s.state.Sessions {
+		st := session.State{
+			ClientID:      id,
+			Subscriptions: fs.Subscriptions,
+			Inbound:       fs.Inbound,
+		}
+		for _, o := range fs.Outbound {
+			p, err := decodePacket(o.Packet)
+			if err != nil {
+				return nil, err
+			}
+			st.Outbound = append(st.Outbound, p)
+		}
+		states = append(states, st)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].ClientID < states[j].ClientID })
+	return states, nil
+}
+
+// StoreDelayed stores the delayed message m
+func (s *File) StoreDelayed(m broker.DelayedMessage) error {
+	b, err := encodeDelayed(m)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Delayed[m.ID] = b
+	return s.save()
+}
+
+// DeleteDelayed removes the delayed message id
+func (s *File) DeleteDelayed(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.state.Delayed[id]; !ok {
+		return nil
+	}
+	delete(s.state.Delayed, id)
+	return s.save()
+}
+
+// LoadDelayed returns the delayed messages sorted by when they are due
+func (s *File) LoadDelayed() ([]broker.DelayedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms := make([]broker.DelayedMessage, 0, len(s.state.Delayed))
+	for id, b := range s.state.Delayed {
+		m, err := decodeDelayed(id, b)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	sortDelayed(ms)
+	return ms, nil
+}
+
+// session returns the stored session of clientID, adding it if needed.
+// s.mu must be held.
+func (s *File) session(clientID string) *fileSession {
+	fs, ok := s.state.Sessions[clientID]
+	if !ok {
+		fs = &fileSession{}
+		s.state.Sessions[clientID] = fs
+	}
+	return fs
+}
+
+// Persister returns the Persister of the in-flight messages of clientID
+func (s *File) Persister(clientID string) session.Persister {
+	return &filePersister{s: s, clientID: clientID}
+}
+
+type filePersister struct {
+	s        *File
+	clientID string
+}
+
+func (p *filePersister) StoreOutbound(cp packet.ControlPacket) error {
+	id, err := outboundID(cp)
+	if err != nil {
+		return err
+	}
+	b, err := encodePacket(cp)
+	if err != nil {
+		return err
+	}
+
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	fs := p.s.session(p.clientID)
+	// A PUBREL keeps the place of the PUBLISH it replaces
+	replaced := false
+	for i := range fs.Outbound {
+		if fs.Outbound[i].PacketID == id {
+			fs.Outbound[i].Packet = b
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		fs.Outbound = append(fs.Outbound, fileOutbound{PacketID: id, Packet: b})
+	}
+	return p.s.save()
+}
+
+func (p *filePersister) DeleteOutbound(packetID uint16) error {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	fs, ok := p.s.state.Sessions[p.clientID]
+	if !ok {
+		return nil
+	}
+	for i := range fs.Outbound {
+		if fs.Outbound[i].PacketID == packetID {
+			fs.Outbound = append(fs.Outbound[:i], fs.Outbound[i+1:]...)
+			return p.s.save()
+		}
+	}
+	return nil
+}
+
+func (p *filePersister) StoreInbound(packetID uint16) error {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	fs := p.s.session(p.clientID)
+	for _, id := range fs.Inbound {
+		if id == packetID {
+			return nil
+		}
+	}
+	fs.Inbound = append(fs.Inbound, packetID)
+	return p.s.save()
+}
+
+func (p *filePersister) DeleteInbound(packetID uint16) error {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	fs, ok := p.s.state.Sessions[p.clientID]
+	if !ok {
+		return nil
+	}
+	for i, id := range fs.Inbound {
+		if id == packetID {
+			fs.Inbound = append(fs.Inbound[:i], fs.Inbound[i+1:]...)
+			return p.s.save()
+		}
+	}
+	return nil
+}
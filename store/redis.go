@@ -0,0 +1,328 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+	"github.com/infinimesh/mqtt-go/topic"
+)
+
+// Redis is a Store in Redis. Several brokers can share one, so that a
+// client can resume its session on any of them; retained messages are
+// shared as well. So are delayed messages, which every broker restoring
+// them publishes: give brokers that hold delayed messages their own
+// prefix.
+type Redis struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewRedis returns a Store using client. All keys start with prefix, so
+// that several stores can share a database.
+func NewRedis(client redis.UniversalClient, prefix string) *Redis {
+	return &Redis{client: client, prefix: prefix}
+}
+
+// Close closes the client
+func (s *Redis) Close() error {
+	return s.client.Close()
+}
+
+func (s *Redis) retainedKey() string {
+	return s.prefix + "retained"
+}
+
+func (s *Redis) delayedKey() string {
+	return s.prefix + "delayed"
+}
+
+func (s *Redis) sessionsKey() string {
+	return s.prefix + "sessions"
+}
+
+func (s *Redis) sessionKey(clientID, name string) string {
+	return s.prefix + "session:" + clientID + ":" + name
+}
+
+// Retain stores p as the retained message of its topic, or deletes the
+// retained message if p has an empty payload
+func (s *Redis) Retain(p *packet.PublishControlPacket) error {
+	ctx := context.Background()
+	if len(p.Payload) == 0 {
+		return s.client.HDel(ctx, s.retainedKey(), p.VariableHeader.Topic).Err()
+	}
+	b, err := encodeRetained(p)
+	if err != nil {
+		return err
+	}
+	return s.client.HSet(ctx, s.retainedKey(), p.VariableHeader.Topic, b).Err()
+}
+
+// RetainAll stores ps in one pipeline
+func (s *Redis) RetainAll(ps []*packet.PublishControlPacket) error {
+	ctx := context.Background()
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, p := range ps {
+			if len(p.Payload) == 0 {
+				pipe.HDel(ctx, s.retainedKey(), p.VariableHeader.Topic)
+				continue
+			}
+			b, err := encodeRetained(p)
+			if err != nil {
+				return err
+			}
+			pipe.HSet(ctx, s.retainedKey(), p.VariableHeader.Topic, b)
+		}
+		return nil
+	})
+	return err
+}
+
+// Match returns the matching messages sorted by topic
+func (s *Redis) Match(filter string) ([]*packet.PublishControlPacket, error) {
+	all, err := s.client.HGetAll(context.Background(), s.retainedKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []*packet.PublishControlPacket
+	for name, b := range all {
+		if !topic.Matches(filter, name) {
+			continue
+		}
+		p, err := decodePublish([]byte(b))
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, p)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].VariableHeader.Topic < matches[j].VariableHeader.Topic
+	})
+	return matches, nil
+}
+
+// SaveSubscriptions replaces the stored subscriptions of clientID
+func (s *Redis) SaveSubscriptions(clientID string, subs []packet.Subscription) error {
+	b, err := json.Marshal(subs)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, s.sessionsKey(), clientID)
+		pipe.Set(ctx, s.sessionKey(clientID, "subscriptions"), b, 0)
+		return nil
+	})
+	return err
+}
+
+// DeleteSession removes the session of clientID with its in-flight
+// messages
+func (s *Redis) DeleteSession(clientID string) error {
+	ctx := context.Background()
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SRem(ctx, s.sessionsKey(), clientID)
+		pipe.Del(ctx,
+			s.sessionKey(clientID, "subscriptions"),
+			s.sessionKey(clientID, "outbound"),
+			s.sessionKey(clientID, "seq"),
+			s.sessionKey(clientID, "inbound"))
+		return nil
+	})
+	return err
+}
+
+// LoadSessions returns the stored sessions sorted by client identifier
+func (s *Redis) LoadSessions() ([]session.State, error) {
+	ctx := context.Background()
+	ids, err := s.client.SMembers(ctx, s.sessionsKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+
+	states := make([]session.State, 0, len(ids))
+	for _, id := range ids {
+		st, err := s.loadSession(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, st)
+	}
+	return states, nil
+}
+
+func (s *Redis) loadSession(ctx context.Context, clientID string) (session.State, error) {
+	st := session.State{ClientID: clientID}
+
+	b, err := s.client.Get(ctx, s.sessionKey(clientID, "subscriptions")).Bytes()
+	switch {
+	case err == redis.Nil:
+	case err != nil:
+		return st, err
+	default:
+		if err := json.Unmarshal(b, &st.Subscriptions); err != nil {
+			return st, err
+		}
+	}
+
+	// Values are the sequence number the packet was first stored with,
+	// followed by the packet
+	outbound, err := s.client.HGetAll(ctx, s.sessionKey(clientID, "outbound")).Result()
+	if err != nil {
+		return st, err
+	}
+	var seqs []uint64
+	for _, v := range outbound {
+		p, err := decodePacket([]byte(v[8:]))
+		if err != nil {
+			return st, err
+		}
+		seqs = append(seqs, binary.BigEndian.Uint64([]byte(v)))
+		st.Outbound = append(st.Outbound, p)
+	}
+	sort.Sort(bySeq{seqs, st.Outbound})
+
+	inbound, err := s.client.SMembers(ctx, s.sessionKey(clientID, "inbound")).Result()
+	if err != nil {
+		return st, err
+	}
+	for _, v := range inbound {
+		id, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return st, err
+		}
+		st.Inbound = append(st.Inbound, uint16(id))
+	}
+	sort.Slice(st.Inbound, func(i, j int) bool { return st.Inbound[i] < st.Inbound[j] })
+	return st, nil
+}
+
+// StoreDelayed stores the delayed message m
+func (s *Redis) StoreDelayed(m broker.DelayedMessage) error {
+	b, err := encodeDelayed(m)
+	if err != nil {
+		return err
+	}
+	return s.client.HSet(context.Background(), s.delayedKey(), strconv.FormatUint(m.ID, 10), b).Err()
+}
+
+// DeleteDelayed removes the delayed message id
+func (s *Redis) DeleteDelayed(id uint64) error {
+	return s.client.HDel(context.Background(), s.delayedKey(), strconv.FormatUint(id, 10)).Err()
+}
+
+// LoadDelayed returns the delayed messages sorted by when they are due
+func (s *Redis) LoadDelayed() ([]broker.DelayedMessage, error) {
+	all, err := s.client.HGetAll(context.Background(), s.delayedKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	ms := make([]broker.DelayedMessage, 0, len(all))
+	for field, b := range all {
+		id, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		m, err := decodeDelayed(id, []byte(b))
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	sortDelayed(ms)
+	return ms, nil
+}
+
+// Persister returns the Persister of the in-flight messages of clientID
+func (s *Redis) Persister(clientID string) session.Persister {
+	return &redisPersister{s: s, clientID: clientID}
+}
+
+type redisPersister struct {
+	s        *Redis
+	clientID string
+}
+
+func (p *redisPersister) StoreOutbound(cp packet.ControlPacket) error {
+	id, err := outboundID(cp)
+	if err != nil {
+		return err
+	}
+	b, err := encodePacket(cp)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	key := p.s.sessionKey(p.clientID, "outbound")
+	field := strconv.Itoa(int(id))
+	// A PUBREL keeps the place of the PUBLISH it replaces
+	var seq uint64
+	old, err := p.s.client.HGet(ctx, key, field).Bytes()
+	switch {
+	case err == nil && len(old) >= 8:
+		seq = binary.BigEndian.Uint64(old)
+	case err == nil || err == redis.Nil:
+		n, err := p.s.client.Incr(ctx, p.s.sessionKey(p.clientID, "seq")).Result()
+		if err != nil {
+			return err
+		}
+		seq = uint64(n)
+	default:
+		return err
+	}
+	v := make([]byte, 8, 8+len(b))
+	binary.BigEndian.PutUint64(v, seq)
+
+	_, err = p.s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, p.s.sessionsKey(), p.clientID)
+		pipe.HSet(ctx, key, field, append(v, b...))
+		return nil
+	})
+	return err
+}
+
+func (p *redisPersister) DeleteOutbound(packetID uint16) error {
+	return p.s.client.HDel(context.Background(), p.s.sessionKey(p.clientID, "outbound"), strconv.Itoa(int(packetID))).Err()
+}
+
+func (p *redisPersister) StoreInbound(packetID uint16) error {
+	ctx := context.Background()
+	_, err := p.s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, p.s.sessionsKey(), p.clientID)
+		pipe.SAdd(ctx, p.s.sessionKey(p.clientID, "inbound"), packetID)
+		return nil
+	})
+	return err
+}
+
+func (p *redisPersister) DeleteInbound(packetID uint16) error {
+	return p.s.client.SRem(context.Background(), p.s.sessionKey(p.clientID, "inbound"), packetID).Err()
+}
@@ -0,0 +1,149 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+// Package store keeps the state of a broker in durable storage, so that
+// persistent sessions and retained messages survive a restart.
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+)
+
+// Store keeps the broker state that has to survive a restart: the
+// persistent sessions with their in-flight messages, the retained
+// messages and the delayed ones. A Store is meant to be the Store of
+// Server.Sessions, the Server.RetainStore and the Server.DelayStore.
+type Store interface {
+	session.Store
+	broker.BulkRetainStore
+	broker.DelayStore
+	// Close releases the underlying storage
+	Close() error
+}
+
+// encodePacket returns the wire representation of p, prefixed with the
+// protocol version it has to be decoded with
+func encodePacket(p packet.ControlPacket) ([]byte, error) {
+	version := packet.ProtocolVersion311
+	switch p := p.(type) {
+	case *packet.PublishControlPacket:
+		if p.VariableHeader.Properties != nil {
+			version = packet.ProtocolVersion5
+		}
+	case *packet.PubrelControlPacket:
+		if p.VariableHeader.Properties != nil {
+			version = packet.ProtocolVersion5
+		}
+	}
+	b, err := p.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(version)}, b...), nil
+}
+
+func decodePacket(b []byte) (packet.ControlPacket, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("store: empty packet record")
+	}
+	return packet.ReadPacketVersion(bytes.NewReader(b[1:]), packet.ProtocolVersion(b[0]))
+}
+
+// encodeRetained encodes a retained message. Retained messages carry no
+// packet identifier, but QoS 1 and 2 PUBLISH packets require a non-zero
+// one on the wire [MQTT-2.3.1-1], so a placeholder is stored instead
+func encodeRetained(p *packet.PublishControlPacket) ([]byte, error) {
+	if p.FixedHeaderFlags.QoS > 0 && p.VariableHeader.PacketID == 0 {
+		cp := *p
+		cp.VariableHeader.PacketID = 1
+		p = &cp
+	}
+	return encodePacket(p)
+}
+
+func decodePublish(b []byte) (*packet.PublishControlPacket, error) {
+	p, err := decodePacket(b)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := p.(*packet.PublishControlPacket)
+	if !ok {
+		return nil, fmt.Errorf("store: retained message is a %T", p)
+	}
+	pub.VariableHeader.PacketID = 0
+	return pub, nil
+}
+
+// encodeDelayed encodes a delayed message: when it is due, in Unix
+// nanoseconds, followed by the message
+func encodeDelayed(m broker.DelayedMessage) ([]byte, error) {
+	b, err := encodeRetained(m.Message)
+	if err != nil {
+		return nil, err
+	}
+	v := make([]byte, 8, 8+len(b))
+	binary.BigEndian.PutUint64(v, uint64(m.At.UnixNano()))
+	return append(v, b...), nil
+}
+
+func decodeDelayed(id uint64, b []byte) (broker.DelayedMessage, error) {
+	if len(b) < 8 {
+		return broker.DelayedMessage{}, fmt.Errorf("store: short delayed message record")
+	}
+	p, err := decodePublish(b[8:])
+	if err != nil {
+		return broker.DelayedMessage{}, err
+	}
+	at := time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	return broker.DelayedMessage{ID: id, At: at, Message: p}, nil
+}
+
+// sortDelayed sorts ms by when they are due
+func sortDelayed(ms []broker.DelayedMessage) {
+	sort.Slice(ms, func(i, j int) bool {
+		if !ms[i].At.Equal(ms[j].At) {
+			return ms[i].At.Before(ms[j].At)
+		}
+		return ms[i].ID < ms[j].ID
+	})
+}
+
+// outboundID returns the packet identifier of an in-flight PUBLISH or
+// PUBREL
+func outboundID(p packet.ControlPacket) (uint16, error) {
+	switch p := p.(type) {
+	case *packet.PublishControlPacket:
+		return uint16(p.VariableHeader.PacketID), nil
+	case *packet.PubrelControlPacket:
+		return p.VariableHeader.PacketID, nil
+	}
+	return 0, fmt.Errorf("store: cannot store %T as in-flight message", p)
+}
+
+var (
+	_ Store = (*Bolt)(nil)
+	_ Store = (*File)(nil)
+	_ Store = (*Redis)(nil)
+)
@@ -0,0 +1,242 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/infinimesh/mqtt-go/broker"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/infinimesh/mqtt-go/session"
+)
+
+// backends returns a function per backend that opens a Store, and opens
+// the same one again after it was closed
+var backends = []struct {
+	name  string
+	store func(t testing.TB) func() (Store, error)
+}{
+	{"bolt", func(t testing.TB) func() (Store, error) {
+		path := filepath.Join(t.TempDir(), "state.db")
+		return func() (Store, error) { return OpenBolt(path) }
+	}},
+	{"file", func(t testing.TB) func() (Store, error) {
+		path := filepath.Join(t.TempDir(), "state.json")
+		return func() (Store, error) { return OpenFile(path) }
+	}},
+	{"redis", func(t testing.TB) func() (Store, error) {
+		mr := miniredis.RunT(t)
+		return func() (Store, error) {
+			return NewRedis(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "mqtt:"), nil
+		}
+	}},
+}
+
+func publish(topic string, id uint16, payload string) *packet.PublishControlPacket {
+	p := packet.NewPublish(topic, id, []byte(payload))
+	p.FixedHeaderFlags.QoS = packet.QoSLevelAtLeastOnce
+	return p
+}
+
+func TestStoreRetained(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			open := b.store(t)
+			s, err := open()
+			require.NoError(t, err)
+
+			require.NoError(t, s.Retain(publish("a/b", 0, "1")))
+			require.NoError(t, s.Retain(publish("a/c", 0, "2")))
+			require.NoError(t, s.Retain(publish("x", 0, "3")))
+			require.NoError(t, s.Retain(publish("x", 0, "")))
+			require.NoError(t, s.Close())
+
+			s, err = open()
+			require.NoError(t, err)
+			defer s.Close() // nolint: errcheck
+
+			matches, err := s.Match("a/+")
+			require.NoError(t, err)
+			require.Len(t, matches, 2)
+			assert.Equal(t, "a/b", matches[0].VariableHeader.Topic)
+			assert.Equal(t, []byte("2"), matches[1].Payload)
+
+			matches, err = s.Match("#")
+			require.NoError(t, err)
+			assert.Len(t, matches, 2)
+		})
+	}
+}
+
+func TestStoreRetainAll(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			open := b.store(t)
+			s, err := open()
+			require.NoError(t, err)
+			require.NoError(t, s.Retain(publish("x", 0, "1")))
+			require.NoError(t, s.RetainAll([]*packet.PublishControlPacket{
+				publish("a/b", 0, "2"), publish("x", 0, ""), publish("a/c", 0, "3"), publish("a/b", 0, "4"),
+			}))
+			require.NoError(t, s.Close())
+
+			s, err = open()
+			require.NoError(t, err)
+			defer s.Close() // nolint: errcheck
+			matches, err := s.Match("#")
+			require.NoError(t, err)
+			require.Len(t, matches, 2)
+			assert.Equal(t, []byte("4"), matches[0].Payload, "in order, the last message per topic wins")
+			assert.Equal(t, packet.QoSLevelAtLeastOnce, matches[1].FixedHeaderFlags.QoS)
+		})
+	}
+}
+
+func TestStoreSessions(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			open := b.store(t)
+			s, err := open()
+			require.NoError(t, err)
+
+			subs := []packet.Subscription{{Topic: "a/#", QoS: packet.QoSLevelExactlyOnce, NoLocal: true}}
+			require.NoError(t, s.SaveSubscriptions("c1", subs))
+			require.NoError(t, s.SaveSubscriptions("gone", nil))
+			require.NoError(t, s.DeleteSession("gone"))
+
+			p := s.Persister("c1")
+			require.NoError(t, p.StoreOutbound(publish("t", 7, "x")))
+			require.NoError(t, p.StoreOutbound(publish("t", 3, "y")))
+			require.NoError(t, p.StoreOutbound(publish("t", 9, "z")))
+			// The PUBREL keeps the place of its PUBLISH
+			require.NoError(t, p.StoreOutbound(packet.NewPubRelControlPacket(7)))
+			require.NoError(t, p.DeleteOutbound(9))
+			require.NoError(t, p.StoreInbound(4))
+			require.NoError(t, p.StoreInbound(5))
+			require.NoError(t, p.DeleteInbound(4))
+			require.NoError(t, s.Close())
+
+			s, err = open()
+			require.NoError(t, err)
+			defer s.Close() // nolint: errcheck
+
+			states, err := s.LoadSessions()
+			require.NoError(t, err)
+			require.Len(t, states, 1)
+			st := states[0]
+			assert.Equal(t, "c1", st.ClientID)
+			assert.Equal(t, subs, st.Subscriptions)
+			assert.Equal(t, []uint16{5}, st.Inbound)
+			require.Len(t, st.Outbound, 2)
+			assert.IsType(t, &packet.PubrelControlPacket{}, st.Outbound[0])
+			assert.Equal(t, 3, st.Outbound[1].(*packet.PublishControlPacket).VariableHeader.PacketID)
+		})
+	}
+}
+
+func TestManagerRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	s, err := OpenBolt(path)
+	require.NoError(t, err)
+
+	m := session.NewManager()
+	m.Store = s
+	sess, _, err := m.Open("c1", false)
+	require.NoError(t, err)
+	sess.Subscribe(packet.Subscription{Topic: "a", QoS: packet.QoSLevelAtLeastOnce})
+	require.NoError(t, m.SaveSubscriptions(sess))
+	sent, err := sess.Outbound.Push(publish("a", 0, "x"))
+	require.NoError(t, err)
+	require.NotNil(t, sent)
+	_, _, err = m.Open("clean", true)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s, err = OpenBolt(path)
+	require.NoError(t, err)
+	defer s.Close() // nolint: errcheck
+
+	m = session.NewManager()
+	m.Store = s
+	require.NoError(t, m.Restore())
+	_, ok := m.Get("clean")
+	assert.False(t, ok, "clean sessions must not be stored")
+
+	sess, present, err := m.Open("c1", false)
+	require.NoError(t, err)
+	assert.True(t, present)
+	assert.Equal(t, []packet.Subscription{{Topic: "a", QoS: packet.QoSLevelAtLeastOnce}}, sess.Subscriptions())
+	assert.Len(t, sess.Outbound.Resend(), 1)
+
+	// A clean session discards the stored one
+	_, _, err = m.Open("c1", true)
+	require.NoError(t, err)
+	states, err := s.LoadSessions()
+	require.NoError(t, err)
+	assert.Empty(t, states)
+}
+
+func TestManagerSaveAll(t *testing.T) {
+	s, err := OpenBolt(filepath.Join(t.TempDir(), "state.db"))
+	require.NoError(t, err)
+	defer s.Close() // nolint: errcheck
+
+	m := session.NewManager()
+	m.Store = s
+	for _, id := range []string{"c1", "c2"} {
+		sess, _, err := m.Open(id, false)
+		require.NoError(t, err)
+		sess.Subscribe(packet.Subscription{Topic: id})
+	}
+	clean, _, err := m.Open("clean", true)
+	require.NoError(t, err)
+	clean.Subscribe(packet.Subscription{Topic: "clean"})
+
+	require.NoError(t, m.SaveAll())
+	states, err := s.LoadSessions()
+	require.NoError(t, err)
+	subs := make(map[string][]packet.Subscription)
+	for _, st := range states {
+		subs[st.ClientID] = st.Subscriptions
+	}
+	assert.Equal(t, map[string][]packet.Subscription{
+		"c1": {{Topic: "c1"}},
+		"c2": {{Topic: "c2"}},
+	}, subs)
+}
+
+func TestStoreDelayed(t *testing.T) {
+	at := time.Unix(1700000000, 500)
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			open := b.store(t)
+			s, err := open()
+			require.NoError(t, err)
+			retained := publish("b", 0, "2")
+			retained.FixedHeaderFlags.Retain = true
+			require.NoError(t, s.StoreDelayed(broker.DelayedMessage{ID: 2, At: at.Add(time.Second), Message: publish("a", 0, "1")}))
+			require.NoError(t, s.StoreDelayed(broker.DelayedMessage{ID: 3, At: at, Message: retained}))
+			require.NoError(t, s.StoreDelayed(broker.DelayedMessage{ID: 1, At: at, Message: publish("c", 0, "3")}))
+			require.NoError(t, s.DeleteDelayed(1))
+			require.NoError(t, s.DeleteDelayed(4))
+			require.NoError(t, s.Close())
+
+			s, err = open()
+			require.NoError(t, err)
+			defer s.Close() // nolint: errcheck
+			ms, err := s.LoadDelayed()
+			require.NoError(t, err)
+			require.Len(t, ms, 2)
+			assert.Equal(t, uint64(3), ms[0].ID, "sorted by when they are due")
+			assert.True(t, at.Equal(ms[0].At))
+			assert.Equal(t, "b", ms[0].Message.VariableHeader.Topic)
+			assert.True(t, ms[0].Message.FixedHeaderFlags.Retain)
+			assert.Equal(t, []byte("1"), ms[1].Message.Payload)
+		})
+	}
+}
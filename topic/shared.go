@@ -0,0 +1,141 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package topic
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// SharePrefix starts the filter of an MQTT 5 shared subscription,
+// "$share/{ShareName}/{filter}"
+const SharePrefix = "$share/"
+
+// ParseShared splits the filter of a shared subscription into its share
+// name and the filter it applies to. ok is false for filters of ordinary
+// subscriptions and for malformed shared ones.
+func ParseShared(filter string) (shareName, topicFilter string, ok bool) {
+	if !strings.HasPrefix(filter, SharePrefix) {
+		return "", "", false
+	}
+	rest := filter[len(SharePrefix):]
+	i := strings.IndexByte(rest, '/')
+	if i <= 0 || i == len(rest)-1 {
+		return "", "", false
+	}
+	shareName, topicFilter = rest[:i], rest[i+1:]
+	if strings.ContainsAny(shareName, "+#") {
+		return "", "", false
+	}
+	return shareName, topicFilter, true
+}
+
+// ShareStrategy decides which member of a shared subscription receives a
+// message
+type ShareStrategy int
+
+const (
+	// ShareRoundRobin hands the messages to the members in turn
+	ShareRoundRobin ShareStrategy = iota
+	// ShareRandom picks a member at random for every message
+	ShareRandom
+	// ShareSticky delivers all messages of the shared subscription to the
+	// same member for as long as it stays subscribed
+	ShareSticky
+)
+
+// shareGroup holds the members of one shared subscription. members is
+// guarded by the lock of the shard of the Tree; the delivery state has
+// its own, as it changes while matching.
+type shareGroup struct {
+	filter  string // as subscribed, including the $share prefix
+	members map[string]packet.QosLevel
+	sorted  []string
+
+	next   uint64 // atomic, for ShareRoundRobin
+	mu     sync.Mutex
+	sticky string // client ID, for ShareSticky
+}
+
+func newShareGroup(filter string) *shareGroup {
+	return &shareGroup{
+		filter:  filter,
+		members: make(map[string]packet.QosLevel),
+	}
+}
+
+func (g *shareGroup) add(clientID string, qos packet.QosLevel) bool {
+	_, existed := g.members[clientID]
+	g.members[clientID] = qos
+	if !existed {
+		g.sort()
+	}
+	return existed
+}
+
+func (g *shareGroup) remove(clientID string) bool {
+	if _, ok := g.members[clientID]; !ok {
+		return false
+	}
+	delete(g.members, clientID)
+	g.sort()
+
+	g.mu.Lock()
+	if g.sticky == clientID {
+		g.sticky = ""
+	}
+	g.mu.Unlock()
+	return true
+}
+
+func (g *shareGroup) sort() {
+	g.sorted = g.sorted[:0]
+	for clientID := range g.members {
+		g.sorted = append(g.sorted, clientID)
+	}
+	sort.Strings(g.sorted)
+}
+
+// pick chooses the member that receives a message
+func (g *shareGroup) pick(strategy ShareStrategy) Subscriber {
+	var clientID string
+	switch strategy {
+	case ShareRandom:
+		clientID = g.sorted[rand.Intn(len(g.sorted))]
+	case ShareSticky:
+		g.mu.Lock()
+		if g.sticky == "" {
+			g.sticky = g.roundRobin()
+		}
+		clientID = g.sticky
+		g.mu.Unlock()
+	default:
+		clientID = g.roundRobin()
+	}
+	return Subscriber{ClientID: clientID, QoS: g.members[clientID], Share: g.filter}
+}
+
+func (g *shareGroup) roundRobin() string {
+	n := atomic.AddUint64(&g.next, 1) - 1
+	return g.sorted[n%uint64(len(g.sorted))]
+}
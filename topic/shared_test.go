@@ -0,0 +1,90 @@
+package topic
+
+import (
+	"testing"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseShared(t *testing.T) {
+	var testCases = []struct {
+		filter, shareName, topicFilter string
+		ok                             bool
+	}{
+		{"$share/group/a/+", "group", "a/+", true},
+		{"$share/group/#", "group", "#", true},
+		{"a/b", "", "", false},
+		{"$share/group", "", "", false},
+		{"$share//a", "", "", false},
+		{"$share/group/", "", "", false},
+		{"$share/gr+up/a", "", "", false},
+	}
+	for _, tc := range testCases {
+		shareName, topicFilter, ok := ParseShared(tc.filter)
+		assert.Equal(t, tc.ok, ok, tc.filter)
+		assert.Equal(t, tc.shareName, shareName, tc.filter)
+		assert.Equal(t, tc.topicFilter, topicFilter, tc.filter)
+	}
+}
+
+func receivers(tree *Tree, topic string, n int) []string {
+	var ids []string
+	for i := 0; i < n; i++ {
+		for _, s := range tree.Match(topic) {
+			if s.Share != "" {
+				ids = append(ids, s.ClientID)
+			}
+		}
+	}
+	return ids
+}
+
+func TestTreeShared(t *testing.T) {
+	tree := NewTree()
+	assert.False(t, tree.Subscribe("a", "$share/g/sensors/+", packet.QoSLevelAtLeastOnce))
+	assert.False(t, tree.Subscribe("b", "$share/g/sensors/+", packet.QoSLevelNone))
+	assert.True(t, tree.Subscribe("b", "$share/g/sensors/+", packet.QoSLevelNone))
+	tree.Subscribe("a", "sensors/#", packet.QoSLevelNone)
+
+	// The ordinary subscription of a gets a copy of its own
+	assert.Equal(t, []Subscriber{
+		{ClientID: "a", QoS: packet.QoSLevelNone},
+		{ClientID: "a", QoS: packet.QoSLevelAtLeastOnce, Share: "$share/g/sensors/+"},
+	}, tree.Match("sensors/1"))
+
+	assert.Equal(t, []string{"b", "a", "b", "a"}, receivers(tree, "sensors/1", 4))
+
+	assert.True(t, tree.Unsubscribe("a", "$share/g/sensors/+"))
+	assert.Equal(t, []string{"b", "b"}, receivers(tree, "sensors/1", 2))
+	assert.True(t, tree.Unsubscribe("b", "$share/g/sensors/+"))
+	assert.False(t, tree.Unsubscribe("b", "$share/g/sensors/+"))
+	assert.Empty(t, receivers(tree, "sensors/1", 1))
+}
+
+func TestTreeSharedSticky(t *testing.T) {
+	tree := NewTree()
+	tree.ShareStrategy = ShareSticky
+	tree.Subscribe("a", "$share/g/#", packet.QoSLevelNone)
+	tree.Subscribe("b", "$share/g/#", packet.QoSLevelNone)
+
+	first := receivers(tree, "x", 1)[0]
+	assert.Equal(t, []string{first, first, first}, receivers(tree, "x", 3))
+	assert.Equal(t, []string{first, first}, receivers(tree, "y", 2))
+
+	tree.Unsubscribe(first, "$share/g/#")
+	second := receivers(tree, "x", 1)[0]
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, []string{second, second}, receivers(tree, "y", 2))
+}
+
+func TestTreeSharedRandom(t *testing.T) {
+	tree := NewTree()
+	tree.ShareStrategy = ShareRandom
+	tree.Subscribe("a", "$share/g/x", packet.QoSLevelNone)
+	tree.Subscribe("b", "$share/g/x", packet.QoSLevelNone)
+
+	for _, id := range receivers(tree, "x", 20) {
+		assert.Contains(t, []string{"a", "b"}, id)
+	}
+}
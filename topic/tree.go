@@ -0,0 +1,360 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package topic
+
+import (
+	"hash/maphash"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+// Subscriber is a client that a message has to be delivered to
+type Subscriber struct {
+	ClientID string
+	// QoS is the maximum QoS of all of the client's subscriptions that
+	// matched
+	QoS packet.QosLevel
+	// Share is the filter of the shared subscription the message is
+	// delivered through, empty for ordinary subscriptions
+	Share string
+}
+
+// Tree stores subscriptions in a trie with one level per topic level. It
+// is safe for concurrent use.
+//
+// The trie is split into shards by the first level of the filters, each
+// with a lock of its own, so that clients working with different topics
+// don't contend. Filters starting with a wildcard have a shard of their
+// own, which every Match looks into.
+type Tree struct {
+	// ShareStrategy balances the messages of shared subscriptions across
+	// their members. Set it before the Tree is used.
+	ShareStrategy ShareStrategy
+
+	seed   maphash.Seed
+	shards []shard
+	wild   shard
+}
+
+// shard is a part of the trie, guarded by mu
+type shard struct {
+	mu   sync.RWMutex
+	root *node
+}
+
+type node struct {
+	children    map[string]*node
+	subscribers map[string]packet.QosLevel
+	shared      map[string]*shareGroup // by share name
+}
+
+func newNode() *node {
+	return &node{
+		children:    make(map[string]*node),
+		subscribers: make(map[string]packet.QosLevel),
+		shared:      make(map[string]*shareGroup),
+	}
+}
+
+func (n *node) empty() bool {
+	return len(n.subscribers) == 0 && len(n.children) == 0 && len(n.shared) == 0
+}
+
+// NewTree returns an empty subscription tree with a shard per CPU
+func NewTree() *Tree {
+	return NewShardedTree(runtime.GOMAXPROCS(0))
+}
+
+// NewShardedTree returns an empty subscription tree split into n shards,
+// at least one
+func NewShardedTree(n int) *Tree {
+	if n < 1 {
+		n = 1
+	}
+	t := &Tree{seed: maphash.MakeSeed(), shards: make([]shard, n)}
+	for i := range t.shards {
+		t.shards[i].root = newNode()
+	}
+	t.wild.root = newNode()
+	return t
+}
+
+// shard returns the shard holding the filters or topics starting with
+// level
+func (t *Tree) shard(level string) *shard {
+	if level == "+" || level == "#" {
+		return &t.wild
+	}
+	return &t.shards[maphash.String(t.seed, level)%uint64(len(t.shards))]
+}
+
+// firstLevel returns the first level of a topic or topic filter
+func firstLevel(s string) string {
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// Subscribe adds or replaces the subscription of clientID to filter. It
+// reports whether the subscription already existed. Filters starting with
+// SharePrefix add clientID to a shared subscription.
+func (t *Tree) Subscribe(clientID, filter string, qos packet.QosLevel) bool {
+	shareName, topicFilter, shared := ParseShared(filter)
+	if !shared {
+		topicFilter = filter
+	}
+	s := t.shard(firstLevel(topicFilter))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.root
+	for _, level := range strings.Split(topicFilter, "/") {
+		child, ok := n.children[level]
+		if !ok {
+			child = newNode()
+			n.children[level] = child
+		}
+		n = child
+	}
+
+	if shared {
+		g, ok := n.shared[shareName]
+		if !ok {
+			g = newShareGroup(filter)
+			n.shared[shareName] = g
+		}
+		return g.add(clientID, qos)
+	}
+
+	_, existed := n.subscribers[clientID]
+	n.subscribers[clientID] = qos
+	return existed
+}
+
+// Unsubscribe removes the subscription of clientID to filter and reports
+// whether it existed
+func (t *Tree) Unsubscribe(clientID, filter string) bool {
+	shareName, topicFilter, shared := ParseShared(filter)
+	if !shared {
+		topicFilter = filter
+	}
+	s := t.shard(firstLevel(topicFilter))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	levels := strings.Split(topicFilter, "/")
+	path := make([]*node, 0, len(levels)+1)
+	n := s.root
+	path = append(path, n)
+	for _, level := range levels {
+		child, ok := n.children[level]
+		if !ok {
+			return false
+		}
+		n = child
+		path = append(path, n)
+	}
+
+	if shared {
+		g, ok := n.shared[shareName]
+		if !ok || !g.remove(clientID) {
+			return false
+		}
+		if len(g.members) == 0 {
+			delete(n.shared, shareName)
+		}
+	} else {
+		if _, ok := n.subscribers[clientID]; !ok {
+			return false
+		}
+		delete(n.subscribers, clientID)
+	}
+
+	// Prune nodes that have become empty, leaf first
+	for i := len(levels); i > 0; i-- {
+		if !path[i].empty() {
+			break
+		}
+		delete(path[i-1].children, levels[i-1])
+	}
+	return true
+}
+
+// Match returns every client subscribed to a filter matching topic, once
+// per client, sorted by client ID. They are followed by one member of
+// every matching shared subscription, sorted by filter; a client may thus
+// appear twice [MQTT-4.8.2].
+func (t *Tree) Match(topic string) []Subscriber {
+	return t.AppendMatch(nil, topic)
+}
+
+// AppendMatch appends the subscribers of topic to dst in the order of
+// Match and returns the extended slice. It does not allocate if dst has
+// room for them.
+func (t *Tree) AppendMatch(dst []Subscriber, topic string) []Subscriber {
+	m := matchers.Get().(*matcher)
+	defer m.release()
+	m.strategy = t.ShareStrategy
+	for level := range strings.SplitSeq(topic, "/") {
+		m.levels = append(m.levels, level)
+	}
+	levels := m.levels
+	// Wildcards at the first level must not match topics starting with $
+	// [MQTT-4.7.2-1]
+	dollar := strings.HasPrefix(topic, "$")
+	s := t.shard(levels[0])
+	s.mu.RLock()
+	s.root.match(levels, dollar, m)
+	s.mu.RUnlock()
+	if !dollar {
+		t.wild.mu.RLock()
+		t.wild.root.match(levels, false, m)
+		t.wild.mu.RUnlock()
+	}
+
+	start := len(dst)
+	for clientID, qos := range m.found {
+		dst = append(dst, Subscriber{ClientID: clientID, QoS: qos})
+	}
+	slices.SortFunc(dst[start:], func(a, b Subscriber) int {
+		return strings.Compare(a.ClientID, b.ClientID)
+	})
+
+	slices.SortFunc(m.shared, func(a, b Subscriber) int {
+		return strings.Compare(a.Share, b.Share)
+	})
+	return append(dst, m.shared...)
+}
+
+// matcher gathers the subscriptions matching a topic. The members of
+// shared subscriptions are picked while the shard is locked. Matchers are
+// pooled, so that matching doesn't allocate once they have grown.
+type matcher struct {
+	levels   []string
+	found    map[string]packet.QosLevel
+	shared   []Subscriber
+	strategy ShareStrategy
+}
+
+var matchers = sync.Pool{New: func() any {
+	return &matcher{found: make(map[string]packet.QosLevel)}
+}}
+
+func (m *matcher) release() {
+	clear(m.levels)
+	m.levels = m.levels[:0]
+	clear(m.found)
+	clear(m.shared)
+	m.shared = m.shared[:0]
+	matchers.Put(m)
+}
+
+func (n *node) match(levels []string, noWildcards bool, m *matcher) {
+	if !noWildcards {
+		// # also matches the parent level, "a/#" matches "a"
+		if child, ok := n.children["#"]; ok {
+			child.collect(m)
+		}
+	}
+
+	if len(levels) == 0 {
+		n.collect(m)
+		return
+	}
+
+	if child, ok := n.children[levels[0]]; ok {
+		child.match(levels[1:], false, m)
+	}
+	if !noWildcards {
+		if child, ok := n.children["+"]; ok {
+			child.match(levels[1:], false, m)
+		}
+	}
+}
+
+func (n *node) collect(m *matcher) {
+	for clientID, qos := range n.subscribers {
+		if existing, ok := m.found[clientID]; !ok || qos > existing {
+			m.found[clientID] = qos
+		}
+	}
+	for _, g := range n.shared {
+		m.shared = append(m.shared, g.pick(m.strategy))
+	}
+}
+
+// Matches reports whether topic matches the subscription filter, which
+// may contain + and # wildcards
+func Matches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	// Wildcards must not match topics starting with $ [MQTT-4.7.2-1]
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// Covers reports whether every topic that sub matches is matched by
+// filter as well
+func Covers(filter, sub string) bool {
+	f, s := strings.Split(filter, "/"), strings.Split(sub, "/")
+	for i := range f {
+		if f[i] == "#" {
+			return true
+		}
+		if i == len(s) {
+			return false
+		}
+		if s[i] == "#" || (s[i] == "+" && f[i] != "+") || (f[i] != "+" && f[i] != s[i]) {
+			return false
+		}
+	}
+	return len(f) == len(s)
+}
+
+// ValidFilter reports whether filter is a valid topic filter, see
+// packet.ValidateTopicFilter. A shared subscription also needs a valid
+// share name.
+func ValidFilter(filter string) bool {
+	if strings.HasPrefix(filter, SharePrefix) {
+		var ok bool
+		if _, filter, ok = ParseShared(filter); !ok {
+			return false
+		}
+	}
+	return packet.ValidateTopicFilter(filter) == nil
+}
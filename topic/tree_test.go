@@ -0,0 +1,169 @@
+package topic
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/infinimesh/mqtt-go/packet"
+)
+
+func TestMatches(t *testing.T) {
+	var testCases = []struct {
+		filter, topic string
+		expected      bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+		{"a/b", "a", false},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			assert.Equal(t, tc.expected, Matches(tc.filter, tc.topic))
+		})
+	}
+}
+
+func TestCovers(t *testing.T) {
+	var testCases = []struct {
+		filter, sub string
+		expected    bool
+	}{
+		{"#", "a/b", true},
+		{"a/#", "a", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/+", true},
+		{"a/+", "a/#", false},
+		{"a/b", "a/+", false},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+		{"+/b", "x/b", true},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, Covers(tc.filter, tc.sub), "%v covers %v", tc.filter, tc.sub)
+	}
+}
+
+func TestTreeMatch(t *testing.T) {
+	tree := NewTree()
+	tree.Subscribe("exact", "a/b/c", packet.QoSLevelNone)
+	tree.Subscribe("plus", "a/+/c", packet.QoSLevelAtLeastOnce)
+	tree.Subscribe("hash", "a/#", packet.QoSLevelNone)
+	tree.Subscribe("all", "#", packet.QoSLevelNone)
+	tree.Subscribe("sys", "$SYS/#", packet.QoSLevelNone)
+	// Overlapping subscriptions are reported once with the highest QoS
+	tree.Subscribe("exact", "a/+/+", packet.QoSLevelExactlyOnce)
+
+	assert.Equal(t, []Subscriber{
+		{ClientID: "all", QoS: packet.QoSLevelNone},
+		{ClientID: "exact", QoS: packet.QoSLevelExactlyOnce},
+		{ClientID: "hash", QoS: packet.QoSLevelNone},
+		{ClientID: "plus", QoS: packet.QoSLevelAtLeastOnce},
+	}, tree.Match("a/b/c"))
+
+	assert.Equal(t, []Subscriber{
+		{ClientID: "all", QoS: packet.QoSLevelNone},
+		{ClientID: "hash", QoS: packet.QoSLevelNone},
+	}, tree.Match("a"))
+
+	assert.Equal(t, []Subscriber{
+		{ClientID: "sys", QoS: packet.QoSLevelNone},
+	}, tree.Match("$SYS/uptime"))
+
+	assert.Empty(t, NewTree().Match("a"))
+
+	prefix := []Subscriber{{ClientID: "prefix"}}
+	assert.Equal(t, append(prefix, tree.Match("a")...), tree.AppendMatch(prefix, "a"))
+}
+
+func TestTreeUnsubscribe(t *testing.T) {
+	tree := NewTree()
+	assert.False(t, tree.Subscribe("c1", "a/+/c", packet.QoSLevelNone))
+	assert.True(t, tree.Subscribe("c1", "a/+/c", packet.QoSLevelAtLeastOnce))
+	tree.Subscribe("c2", "a/b", packet.QoSLevelNone)
+
+	assert.False(t, tree.Unsubscribe("c1", "a/b"))
+	assert.False(t, tree.Unsubscribe("c2", "a/+/c"))
+	assert.True(t, tree.Unsubscribe("c1", "a/+/c"))
+	assert.False(t, tree.Unsubscribe("c1", "a/+/c"))
+	assert.Empty(t, tree.Match("a/b/c"))
+
+	// Empty branches are pruned, the one still in use is kept
+	root := tree.shard("a").root
+	assert.NotContains(t, root.children["a"].children, "+")
+	assert.True(t, tree.Unsubscribe("c2", "a/b"))
+	assert.Empty(t, root.children)
+}
+
+func TestTreeConcurrent(t *testing.T) {
+	tree := NewTree()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				tree.Subscribe(id, "a/+", packet.QoSLevelNone)
+				tree.Match("a/b")
+				tree.Unsubscribe(id, "a/+")
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+	assert.Empty(t, tree.shard("a").root.children)
+}
+
+func TestTreeShards(t *testing.T) {
+	subscriptions := []struct{ clientID, filter string }{
+		{"c1", "a/b"}, {"c2", "b/+"}, {"c3", "+/b"}, {"c4", "#"},
+		{"c5", "$SYS/#"}, {"c6", "$share/g/+/b"}, {"c7", "c"},
+	}
+	for _, n := range []int{1, 4, 64} {
+		tree := NewShardedTree(n)
+		for _, s := range subscriptions {
+			tree.Subscribe(s.clientID, s.filter, packet.QoSLevelNone)
+		}
+		assert.Equal(t, []Subscriber{{ClientID: "c1"}, {ClientID: "c3"}, {ClientID: "c4"}, {ClientID: "c6", Share: "$share/g/+/b"}},
+			tree.Match("a/b"), "%v shards", n)
+		assert.Equal(t, []Subscriber{{ClientID: "c2"}, {ClientID: "c3"}, {ClientID: "c4"}, {ClientID: "c6", Share: "$share/g/+/b"}},
+			tree.Match("b/b"), "%v shards", n)
+		assert.Equal(t, []Subscriber{{ClientID: "c5"}}, tree.Match("$SYS/uptime"), "%v shards", n)
+		assert.Equal(t, []Subscriber{{ClientID: "c4"}, {ClientID: "c7"}}, tree.Match("c"), "%v shards", n)
+	}
+}
+
+func BenchmarkTreeParallel(b *testing.B) {
+	tree := NewTree()
+	for i := 0; i < 1000; i++ {
+		tree.Subscribe(strconv.Itoa(i), "devices/"+strconv.Itoa(i)+"/#", packet.QoSLevelNone)
+		tree.Subscribe(strconv.Itoa(i), strconv.Itoa(i)+"/+/state", packet.QoSLevelNone)
+	}
+	var n atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		id := strconv.Itoa(int(n.Add(1)))
+		for pb.Next() {
+			tree.Subscribe(id, id+"/x", packet.QoSLevelNone)
+			tree.Match(id + "/x")
+			tree.Unsubscribe(id, id+"/x")
+		}
+	})
+}
+
+func TestValidFilter(t *testing.T) {
+	for _, filter := range []string{"a", "a/b", "+", "#", "a/+/b", "a/#", "/", "+/+", "$share/g/a/#", "$SYS/#"} {
+		assert.True(t, ValidFilter(filter), filter)
+	}
+	for _, filter := range []string{"", "a#", "a/#/b", "a+", "a/b+/c", "#/a", "$share/g", "$share/g+/a", "$share//a"} {
+		assert.False(t, ValidFilter(filter), filter)
+	}
+}
@@ -0,0 +1,202 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package transport
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Fault is a failure ChaosConn can inflict on an outgoing packet.
+type Fault int
+
+const (
+	FaultNone Fault = iota
+	// FaultDrop silently discards the packet
+	FaultDrop
+	// FaultDelay holds the packet back for ChaosConfig.DelayDuration
+	FaultDelay
+	// FaultDuplicate writes the packet twice
+	FaultDuplicate
+	// FaultTruncate writes the first half of the packet and resets the
+	// connection, like a link dying mid-packet
+	FaultTruncate
+)
+
+// ChaosConfig holds the probabilities (0..1) with which each fault hits a
+// packet. At most one fault is applied per packet.
+type ChaosConfig struct {
+	Drop      float64
+	Delay     float64
+	Duplicate float64
+	Truncate  float64
+
+	// DelayDuration is how long FaultDelay holds a packet
+	DelayDuration time.Duration
+	// Seed makes the fault sequence reproducible. 0 uses the current time.
+	Seed int64
+}
+
+// ChaosConn wraps a connection and injects faults into the MQTT packets
+// written to it. Writes are split into packets by their fixed header, so
+// callers may write a packet in as many pieces as they like. Reads are
+// passed through unchanged; wrap the other end as well to disturb both
+// directions.
+type ChaosConn struct {
+	net.Conn
+
+	// wmu keeps frames of concurrent writers from interleaving
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	cfg     ChaosConfig
+	rnd     *rand.Rand
+	next    []Fault
+	pending []byte
+}
+
+func NewChaosConn(c net.Conn, cfg ChaosConfig) *ChaosConn {
+	cc := &ChaosConn{Conn: c}
+	cc.SetConfig(cfg)
+	return cc
+}
+
+// SetConfig replaces the fault probabilities, e.g. to start a storm in
+// the middle of a test.
+func (c *ChaosConn) SetConfig(cfg ChaosConfig) {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg = cfg
+	c.rnd = rand.New(rand.NewSource(seed)) // nolint: gosec
+}
+
+// InjectNext forces f onto the next outgoing packet, regardless of the
+// configured probabilities. Calls queue up in order.
+func (c *ChaosConn) InjectNext(f Fault) {
+	c.mu.Lock()
+	c.next = append(c.next, f)
+	c.mu.Unlock()
+}
+
+// Reset closes the connection abruptly. TCP connections are closed with
+// a RST instead of a FIN.
+func (c *ChaosConn) Reset() error {
+	if tcp, ok := c.Conn.(*net.TCPConn); ok {
+		_ = tcp.SetLinger(0)
+	}
+	return c.Conn.Close()
+}
+
+func (c *ChaosConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.mu.Lock()
+	c.pending = append(c.pending, b...)
+	var frames [][]byte
+	for {
+		n := frameLength(c.pending)
+		if n == 0 || n > len(c.pending) {
+			break
+		}
+		frames = append(frames, c.pending[:n:n])
+		c.pending = c.pending[n:]
+	}
+	faults := make([]Fault, len(frames))
+	for i := range frames {
+		faults[i] = c.pickFault()
+	}
+	delay := c.cfg.DelayDuration
+	c.mu.Unlock()
+
+	for i, frame := range frames {
+		var err error
+		switch faults[i] {
+		case FaultDrop:
+		case FaultDelay:
+			time.Sleep(delay)
+			_, err = c.Conn.Write(frame)
+		case FaultDuplicate:
+			if _, err = c.Conn.Write(frame); err == nil {
+				_, err = c.Conn.Write(frame)
+			}
+		case FaultTruncate:
+			_, _ = c.Conn.Write(frame[:len(frame)/2])
+			_ = c.Reset()
+			return len(b), nil
+		default:
+			_, err = c.Conn.Write(frame)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// must be called with c.mu held
+func (c *ChaosConn) pickFault() Fault {
+	if len(c.next) > 0 {
+		f := c.next[0]
+		c.next = c.next[1:]
+		return f
+	}
+
+	r := c.rnd.Float64()
+	for _, candidate := range []struct {
+		p     float64
+		fault Fault
+	}{
+		{c.cfg.Drop, FaultDrop},
+		{c.cfg.Delay, FaultDelay},
+		{c.cfg.Duplicate, FaultDuplicate},
+		{c.cfg.Truncate, FaultTruncate},
+	} {
+		if r < candidate.p {
+			return candidate.fault
+		}
+		r -= candidate.p
+	}
+	return FaultNone
+}
+
+// frameLength returns the total size of the MQTT packet at the start of
+// b, or 0 if the fixed header is not complete yet. Malformed remaining
+// lengths are treated as a packet spanning everything buffered so far, so
+// garbage is passed through instead of stalling the connection.
+func frameLength(b []byte) int {
+	remaining, multiplier := 0, 1
+	for i := 1; i < len(b); i++ {
+		remaining += int(b[i]&127) * multiplier
+		if b[i]&128 == 0 {
+			return 1 + i + remaining
+		}
+		if i == 4 {
+			return len(b)
+		}
+		multiplier *= 128
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChaosConnFaults(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close() // nolint: errcheck
+
+	chaos := NewChaosConn(a, ChaosConfig{Seed: 1})
+	chaos.InjectNext(FaultDrop)
+	chaos.InjectNext(FaultDuplicate)
+
+	go func() {
+		// Three PINGRESPs and one SUBACK written in awkward pieces
+		_, _ = chaos.Write([]byte{packet.PINGRESP << 4})
+		_, _ = chaos.Write([]byte{0, packet.PINGRESP << 4, 0})
+		_, _ = packet.NewSubAck(7, []byte{0}).WriteTo(chaos)
+		_ = chaos.Reset()
+	}()
+
+	received, err := io.ReadAll(b)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{
+		packet.PINGRESP << 4, 0,
+		packet.PINGRESP << 4, 0,
+		packet.SUBACK << 4, 3, 0, 7, 0,
+	}, received)
+}
+
+func TestChaosConnTruncate(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close() // nolint: errcheck
+
+	chaos := NewChaosConn(a, ChaosConfig{Truncate: 1, Seed: 1})
+	go func() {
+		_, _ = packet.NewSubAck(7, []byte{0, 1, 2, 0x80}).WriteTo(chaos)
+	}()
+
+	received, err := io.ReadAll(b)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{packet.SUBACK << 4, 6, 0, 7}, received)
+}
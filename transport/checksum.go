@@ -0,0 +1,149 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync"
+)
+
+// maxChecksumFrame is the largest possible MQTT packet: one type byte,
+// four remaining length bytes and 268,435,455 bytes of content.
+const maxChecksumFrame = 1 + 4 + 268435455
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumError is returned by ChecksumConn.Read when a frame arrived
+// damaged. The connection is unusable afterwards because the framing can
+// no longer be trusted.
+type ChecksumError struct {
+	Length   int
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("corrupt frame of %v bytes: crc32 %08x, expected %08x", e.Length, e.Actual, e.Expected)
+}
+
+// FrameLengthError is returned by ChecksumConn.Read when a frame header
+// announces a length no MQTT packet can have.
+type FrameLengthError struct {
+	Length uint32
+}
+
+func (e *FrameLengthError) Error() string {
+	return fmt.Sprintf("corrupt frame header: invalid length %v", e.Length)
+}
+
+// ChecksumConn wraps every MQTT packet written to it in a frame of
+// 4 bytes length, 4 bytes CRC-32C and the packet itself, and verifies and
+// strips these frames on read. Both ends of the link must be wrapped.
+// It is meant for links that corrupt data silently, e.g. serial lines
+// behind TCP gateways, where a broken packet would otherwise show up as a
+// confusing decode error far downstream.
+type ChecksumConn struct {
+	net.Conn
+
+	wmu     sync.Mutex
+	pending []byte
+
+	rmu    sync.Mutex
+	unread []byte
+	rerr   error
+}
+
+func NewChecksumConn(c net.Conn) *ChecksumConn {
+	return &ChecksumConn{Conn: c}
+}
+
+func (c *ChecksumConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.pending = append(c.pending, b...)
+	for {
+		n := frameLength(c.pending)
+		if n == 0 || n > len(c.pending) {
+			break
+		}
+
+		frame := make([]byte, 8+n)
+		binary.BigEndian.PutUint32(frame[0:4], uint32(n))
+		binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(c.pending[:n], castagnoli))
+		copy(frame[8:], c.pending[:n])
+
+		if _, err := c.Conn.Write(frame); err != nil {
+			return 0, err
+		}
+		c.pending = c.pending[n:]
+	}
+	if len(c.pending) == 0 {
+		c.pending = nil
+	}
+	return len(b), nil
+}
+
+func (c *ChecksumConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if len(c.unread) == 0 {
+		if c.rerr != nil {
+			return 0, c.rerr
+		}
+		c.unread, c.rerr = c.readFrame()
+		if c.rerr != nil {
+			return 0, c.rerr
+		}
+	}
+
+	n := copy(b, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+func (c *ChecksumConn) readFrame() ([]byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(hdr[0:4])
+	if length < 2 || length > maxChecksumFrame {
+		return nil, &FrameLengthError{Length: length}
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	expected := binary.BigEndian.Uint32(hdr[4:8])
+	if actual := crc32.Checksum(buf, castagnoli); actual != expected {
+		return nil, &ChecksumError{Length: len(buf), Expected: expected, Actual: actual}
+	}
+	return buf, nil
+}
@@ -0,0 +1,48 @@
+package transport
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"testing"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksumConnRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	writer, reader := NewChecksumConn(a), NewChecksumConn(b)
+	defer writer.Close() // nolint: errcheck
+	defer reader.Close() // nolint: errcheck
+
+	go func() {
+		_, _ = packet.NewPublish("a/b", 0, []byte("hello")).WriteTo(writer)
+	}()
+
+	p, err := packet.ReadPacket(reader)
+	require.NoError(t, err)
+	publish, ok := p.(*packet.PublishControlPacket)
+	require.True(t, ok)
+	assert.Equal(t, "a/b", publish.VariableHeader.Topic)
+	assert.Equal(t, []byte("hello"), publish.Payload)
+}
+
+func TestChecksumConnDetectsCorruption(t *testing.T) {
+	a, b := net.Pipe()
+	reader := NewChecksumConn(b)
+	defer a.Close()      // nolint: errcheck
+	defer reader.Close() // nolint: errcheck
+
+	go func() {
+		// A PINGREQ frame whose content got a bit flipped on the way
+		pingreq := []byte{packet.PINGREQ << 4, 0}
+		frame := []byte{0, 0, 0, 2, 0, 0, 0, 0, pingreq[0], pingreq[1] ^ 1}
+		binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(pingreq, castagnoli))
+		_, _ = a.Write(frame)
+	}()
+
+	_, err := packet.ReadPacket(reader)
+	assert.IsType(t, &ChecksumError{}, err)
+}
@@ -0,0 +1,187 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package transport
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFlushInterval = time.Millisecond
+	defaultFlushSize     = 16 * 1024
+)
+
+// FlushStrategy decides when a FlushWriter writes out the packets it
+// buffered. Holding packets back a little trades latency for fewer
+// system calls when many go to the same connection.
+type FlushStrategy int
+
+const (
+	// FlushAdaptive writes the packets out whenever the writer has no
+	// more packets at hand, see FlushWriter.Idle
+	FlushAdaptive FlushStrategy = iota
+	// FlushImmediate writes every packet out on its own
+	FlushImmediate
+	// FlushTimed writes the packets out FlushConfig.Interval after the
+	// first of them was buffered
+	FlushTimed
+	// FlushSized writes the packets out once FlushConfig.Size bytes are
+	// buffered, or FlushConfig.Interval after the first of them was
+	// buffered at the latest
+	FlushSized
+)
+
+var flushStrategies = [...]string{"adaptive", "immediate", "timed", "sized"}
+
+func (s FlushStrategy) String() string {
+	if s >= 0 && int(s) < len(flushStrategies) {
+		return flushStrategies[s]
+	}
+	return fmt.Sprintf("FlushStrategy(%d)", int(s))
+}
+
+// MarshalText returns the name of s, like timed
+func (s FlushStrategy) MarshalText() ([]byte, error) {
+	if s < 0 || int(s) >= len(flushStrategies) {
+		return nil, fmt.Errorf("unknown flush strategy %d", int(s))
+	}
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText sets s to the strategy named text
+func (s *FlushStrategy) UnmarshalText(text []byte) error {
+	for i, name := range flushStrategies {
+		if string(text) == name {
+			*s = FlushStrategy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown flush strategy %q", text)
+}
+
+// FlushConfig configures a FlushWriter
+type FlushConfig struct {
+	Strategy FlushStrategy
+	// Interval bounds how long FlushTimed and FlushSized hold packets
+	// back. Defaults to 1 millisecond.
+	Interval time.Duration
+	// Size is how many bytes FlushSized buffers. Defaults to 16 KiB.
+	Size int
+}
+
+// FlushWriter buffers the packets written to an underlying writer and
+// writes them out as its FlushConfig says. Every Write must hold a whole
+// packet, as packet.WritePacket does. It is safe for concurrent use.
+type FlushWriter struct {
+	cfg FlushConfig
+
+	mu    sync.Mutex
+	w     *bufio.Writer
+	timer *time.Timer // running while packets wait for the interval
+	err   error       // of a flush by the timer, returned by the next call
+}
+
+// NewFlushWriter returns a FlushWriter writing to w
+func NewFlushWriter(w io.Writer, cfg FlushConfig) *FlushWriter {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultFlushInterval
+	}
+	if cfg.Size <= 0 {
+		cfg.Size = defaultFlushSize
+	}
+	size := 4096
+	if cfg.Strategy == FlushSized && cfg.Size > size {
+		size = cfg.Size
+	}
+	return &FlushWriter{cfg: cfg, w: bufio.NewWriterSize(w, size)}
+}
+
+// Write buffers the packet in p, writing it out right away with
+// FlushImmediate
+func (f *FlushWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return 0, f.err
+	}
+
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	switch f.cfg.Strategy {
+	case FlushImmediate:
+		err = f.flush()
+	case FlushSized:
+		if f.w.Buffered() >= f.cfg.Size {
+			err = f.flush()
+			break
+		}
+		fallthrough
+	case FlushTimed:
+		if f.timer == nil && f.w.Buffered() > 0 {
+			f.timer = time.AfterFunc(f.cfg.Interval, f.timeout)
+		}
+	}
+	return n, err
+}
+
+// Idle tells f that no more packets are at hand for now, which makes
+// FlushAdaptive write the buffered ones out
+func (f *FlushWriter) Idle() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	if f.cfg.Strategy != FlushAdaptive {
+		return nil
+	}
+	return f.flush()
+}
+
+// Flush writes the buffered packets out, whatever the strategy
+func (f *FlushWriter) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	return f.flush()
+}
+
+func (f *FlushWriter) timeout() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.timer = nil
+	if f.err == nil {
+		f.err = f.w.Flush()
+	}
+}
+
+func (f *FlushWriter) flush() error {
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	return f.w.Flush()
+}
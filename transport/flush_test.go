@@ -0,0 +1,91 @@
+package transport
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeRecorder records the writes that reach it
+type writeRecorder struct {
+	mu     sync.Mutex
+	writes []string
+}
+
+func (r *writeRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writes = append(r.writes, string(p))
+	return len(p), nil
+}
+
+func (r *writeRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.writes...)
+}
+
+func TestFlushWriter(t *testing.T) {
+	write := func(f *FlushWriter, packets ...string) {
+		for _, p := range packets {
+			_, err := f.Write([]byte(p))
+			require.NoError(t, err)
+		}
+	}
+
+	r := &writeRecorder{}
+	f := NewFlushWriter(r, FlushConfig{})
+	write(f, "a", "b")
+	assert.Empty(t, r.get())
+	require.NoError(t, f.Idle())
+	assert.Equal(t, []string{"ab"}, r.get(), "adaptive")
+
+	r = &writeRecorder{}
+	f = NewFlushWriter(r, FlushConfig{Strategy: FlushImmediate})
+	write(f, "a", "b")
+	assert.Equal(t, []string{"a", "b"}, r.get(), "immediate")
+
+	r = &writeRecorder{}
+	f = NewFlushWriter(r, FlushConfig{Strategy: FlushTimed, Interval: 20 * time.Millisecond})
+	write(f, "a", "b")
+	require.NoError(t, f.Idle())
+	assert.Empty(t, r.get(), "timed packets wait for the interval")
+	assert.Eventually(t, func() bool { return len(r.get()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"ab"}, r.get(), "timed")
+
+	r = &writeRecorder{}
+	f = NewFlushWriter(r, FlushConfig{Strategy: FlushSized, Size: 4, Interval: time.Hour})
+	write(f, "ab", "cd", "e")
+	assert.Equal(t, []string{"abcd"}, r.get(), "sized")
+	require.NoError(t, f.Flush())
+	assert.Equal(t, []string{"abcd", "e"}, r.get())
+}
+
+func TestFlushWriterLarge(t *testing.T) {
+	var buf bytes.Buffer
+	f := NewFlushWriter(&buf, FlushConfig{Strategy: FlushTimed, Interval: time.Hour})
+	large := bytes.Repeat([]byte("x"), 10000)
+	_, err := f.Write(large)
+	require.NoError(t, err)
+	require.NoError(t, f.Flush())
+	assert.Equal(t, large, buf.Bytes())
+}
+
+func TestFlushStrategyText(t *testing.T) {
+	for s := FlushAdaptive; s <= FlushSized; s++ {
+		text, err := s.MarshalText()
+		require.NoError(t, err)
+		var parsed FlushStrategy
+		require.NoError(t, parsed.UnmarshalText(text))
+		assert.Equal(t, s, parsed)
+	}
+	assert.Equal(t, "timed", FlushTimed.String())
+	var s FlushStrategy
+	assert.Error(t, s.UnmarshalText([]byte("never")))
+	_, err := (FlushSized + 1).MarshalText()
+	assert.Error(t, err)
+}
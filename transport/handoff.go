@@ -0,0 +1,28 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package transport
+
+import "errors"
+
+// ErrHandoffUnsupported is returned by SendListeners and ReceiveListeners
+// on systems without Unix domain sockets
+var ErrHandoffUnsupported = errors.New("listener handoff is not supported")
+
+// maxHandoffSockets is the most sockets a handoff passes, SCM_MAX_FD of
+// Linux
+const maxHandoffSockets = 253
@@ -0,0 +1,32 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+//go:build !unix
+
+package transport
+
+import "net"
+
+// SendListeners is only supported on Unix
+func SendListeners(conn *net.UnixConn, listeners map[string][]net.Listener) error {
+	return ErrHandoffUnsupported
+}
+
+// ReceiveListeners is only supported on Unix
+func ReceiveListeners(conn *net.UnixConn) (map[string][]net.Listener, error) {
+	return nil, ErrHandoffUnsupported
+}
@@ -0,0 +1,125 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+//go:build unix
+
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"syscall"
+)
+
+// SendListeners passes the sockets of listeners, keyed by a name of the
+// caller's choosing, to the process at the other end of conn, which takes
+// them with ReceiveListeners. Both processes then accept on the same
+// sockets, until the sender closes its listeners; connections waiting in
+// the backlog meanwhile are not refused. The listeners must have a file
+// descriptor, like those of net.Listen or ReceiveListeners.
+func SendListeners(conn *net.UnixConn, listeners map[string][]net.Listener) error {
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for _, name := range slices.Sorted(maps.Keys(listeners)) {
+		for _, l := range listeners[name] {
+			fl, ok := l.(interface{ File() (*os.File, error) })
+			if !ok {
+				return fmt.Errorf("listener %s: %T has no file descriptor", name, l)
+			}
+			f, err := fl.File()
+			if err != nil {
+				return fmt.Errorf("listener %s: %w", name, err)
+			}
+			names = append(names, name)
+			files = append(files, f)
+		}
+	}
+	if len(files) > maxHandoffSockets {
+		return fmt.Errorf("%d sockets, at most %d can be passed", len(files), maxHandoffSockets)
+	}
+
+	// Fd would put the sockets, shared with the listeners, in blocking
+	// mode
+	fds := make([]int, len(files))
+	for i, f := range files {
+		rc, err := f.SyscallConn()
+		if err != nil {
+			return err
+		}
+		if err := rc.Control(func(fd uintptr) { fds[i] = int(fd) }); err != nil {
+			return err
+		}
+	}
+	header, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	_, _, err = conn.WriteMsgUnix(header, syscall.UnixRights(fds...), nil)
+	return err
+}
+
+// ReceiveListeners takes the listeners another process passed with
+// SendListeners over conn
+func ReceiveListeners(conn *net.UnixConn) (map[string][]net.Listener, error) {
+	header := make([]byte, 64<<10)
+	oob := make([]byte, syscall.CmsgSpace(maxHandoffSockets*4))
+	n, oobn, flags, _, err := conn.ReadMsgUnix(header, oob)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	var files []*os.File
+	for _, msg := range msgs {
+		fds, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			continue // not SCM_RIGHTS
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "handoff"))
+		}
+	}
+
+	var names []string
+	switch {
+	case flags&(syscall.MSG_TRUNC|syscall.MSG_CTRUNC) != 0:
+		err = errors.New("handoff message truncated")
+	case json.Unmarshal(header[:n], &names) != nil:
+		err = errors.New("invalid handoff message")
+	case len(names) != len(files):
+		err = fmt.Errorf("handoff message names %d sockets, %d passed", len(names), len(files))
+	}
+	if err != nil {
+		for _, f := range files {
+			_ = f.Close()
+		}
+		return nil, err
+	}
+	return fileListeners(files, names, 0)
+}
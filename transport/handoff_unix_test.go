@@ -0,0 +1,82 @@
+//go:build unix
+
+package transport
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// socketPair returns both ends of a connected pair of Unix sockets
+func socketPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "pair")
+		c, err := net.FileConn(f)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		conns[i] = c.(*net.UnixConn)
+		t.Cleanup(func() { _ = c.Close() })
+	}
+	return conns[0], conns[1]
+}
+
+func TestHandoff(t *testing.T) {
+	listeners := make(map[string][]net.Listener)
+	for _, name := range []string{"127.0.0.1:0", "systemd:mqtt", "systemd:mqtt"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners[name] = append(listeners[name], l)
+	}
+	old, new := socketPair(t)
+	require.NoError(t, SendListeners(old, listeners))
+
+	taken, err := ReceiveListeners(new)
+	require.NoError(t, err)
+	require.Len(t, taken, 2)
+	for name, ls := range listeners {
+		require.Len(t, taken[name], len(ls), name)
+		for i, l := range ls {
+			assert.Equal(t, l.Addr(), taken[name][i].Addr(), name)
+			require.NoError(t, l.Close())
+
+			// The socket stays open after the sender closed its listener
+			c, err := net.Dial("tcp", l.Addr().String())
+			require.NoError(t, err)
+			accepted, err := taken[name][i].Accept()
+			require.NoError(t, err)
+			assert.NoError(t, accepted.Close())
+			assert.NoError(t, c.Close())
+			assert.NoError(t, taken[name][i].Close())
+		}
+	}
+}
+
+func TestHandoffErrors(t *testing.T) {
+	old, new := socketPair(t)
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close() // nolint: errcheck
+	defer w.Close() // nolint: errcheck
+	mem, err := ListenMem("handoff")
+	require.NoError(t, err)
+	defer mem.Close() // nolint: errcheck
+	assert.ErrorContains(t, SendListeners(old, map[string][]net.Listener{"mem": {mem}}), "has no file descriptor")
+
+	_, _, err = old.WriteMsgUnix([]byte(`["a","b"]`), syscall.UnixRights(int(r.Fd())), nil)
+	require.NoError(t, err)
+	_, err = ReceiveListeners(new)
+	assert.ErrorContains(t, err, "names 2 sockets, 1 passed")
+
+	_, _, err = old.WriteMsgUnix([]byte(`["pipe"]`), syscall.UnixRights(int(r.Fd())), nil)
+	require.NoError(t, err)
+	_, err = ReceiveListeners(new)
+	assert.ErrorContains(t, err, "socket 0 (pipe)")
+}
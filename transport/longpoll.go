@@ -0,0 +1,815 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The headers of the long-polling protocol, see LongPollListener
+const (
+	// LongPollSessionHeader names the session of a request. A load
+	// balancer in front of several brokers must route the requests on
+	// it, as a session lives in a single broker.
+	LongPollSessionHeader = "Mqtt-Session"
+	// LongPollOffsetHeader is the position in the byte stream of the
+	// first byte a POST carries, or of the first byte a GET asks for
+	LongPollOffsetHeader = "Mqtt-Offset"
+)
+
+var (
+	ErrLongPollClosed  = errors.New("long-polling listener closed")
+	ErrLongPollSession = errors.New("long-polling session unknown to the server")
+	ErrLongPollOffset  = errors.New("long-polling offset outside of the buffered stream")
+)
+
+const (
+	defaultLongPollTimeout     = 25 * time.Second
+	defaultLongPollIdleTimeout = time.Minute
+	defaultLongPollBuffer      = 1 << 20
+
+	// longPollChunk is the largest body a client POSTs
+	longPollChunk = 64 << 10
+	// longPollRetries is how many times a client sends a request that
+	// failed on the way
+	longPollRetries = 3
+)
+
+type longPollAddr string
+
+func (a longPollAddr) Network() string { return "http" }
+func (a longPollAddr) String() string  { return string(a) }
+
+// LongPollListener is a net.Listener for MQTT tunnelled over successive
+// HTTP requests, a fallback for the clients behind proxies that let
+// neither TCP nor WebSocket through. Like WebSocketListener it is an
+// http.Handler, and every session it opens is returned by Accept as a
+// net.Conn carrying the MQTT byte stream.
+//
+// A POST without LongPollSessionHeader opens a session, whose id the 201
+// response carries in that header. The client then sends its bytes in
+// the bodies of POST requests, answered with 204, and polls for those of
+// the server with GET requests. A GET waits up to PollTimeout for bytes
+// and answers 204 if there are none. Both carry LongPollOffsetHeader, so
+// that a request lost on the way can be sent again without losing or
+// repeating bytes: a GET acknowledges the bytes before its offset. DELETE
+// closes the session, as does IdleTimeout without any request. Requests
+// for a session that is gone are answered with 404.
+type LongPollListener struct {
+	// PollTimeout is how long a GET waits for bytes. Defaults to 25
+	// seconds, below the idle timeouts of most proxies.
+	PollTimeout time.Duration
+	// IdleTimeout closes the sessions without a request for that long.
+	// Defaults to a minute.
+	IdleTimeout time.Duration
+	// MaxBuffered is how many bytes each direction of a session buffers
+	// before the writer waits for the reader. Defaults to 1 MiB.
+	MaxBuffered int
+
+	addr      net.Addr
+	server    *http.Server // only set by ListenLongPoll
+	mu        sync.Mutex
+	sessions  map[string]*longPollConn
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewLongPollListener returns a listener that receives its sessions
+// through ServeHTTP. addr is what Addr reports.
+func NewLongPollListener(addr net.Addr) *LongPollListener {
+	return &LongPollListener{
+		addr:     addr,
+		sessions: make(map[string]*longPollConn),
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+}
+
+// ListenLongPoll listens for long-polling sessions on every path of
+// addr. Closing the listener also stops its HTTP server.
+func ListenLongPoll(addr string) (*LongPollListener, error) {
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := NewLongPollListener(tcp.Addr())
+	l.server = &http.Server{Handler: l, ReadHeaderTimeout: 10 * time.Second}
+	go l.server.Serve(tcp) // nolint: errcheck
+	return l, nil
+}
+
+func (l *LongPollListener) pollTimeout() time.Duration {
+	if l.PollTimeout > 0 {
+		return l.PollTimeout
+	}
+	return defaultLongPollTimeout
+}
+
+func (l *LongPollListener) idleTimeout() time.Duration {
+	if l.IdleTimeout > 0 {
+		return l.IdleTimeout
+	}
+	return defaultLongPollIdleTimeout
+}
+
+func (l *LongPollListener) maxBuffered() int {
+	if l.MaxBuffered > 0 {
+		return l.MaxBuffered
+	}
+	return defaultLongPollBuffer
+}
+
+func (l *LongPollListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	id := r.Header.Get(LongPollSessionHeader)
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "long-polling session required", http.StatusBadRequest)
+			return
+		}
+		l.open(w, r)
+		return
+	}
+
+	l.mu.Lock()
+	c := l.sessions[id]
+	l.mu.Unlock()
+	if c == nil {
+		http.Error(w, ErrLongPollSession.Error(), http.StatusNotFound)
+		return
+	}
+	c.begin()
+	defer c.end()
+
+	switch r.Method {
+	case http.MethodPost:
+		c.post(w, r)
+	case http.MethodGet:
+		c.poll(w, r)
+	case http.MethodDelete:
+		c.expire()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// open starts a session and hands it to Accept
+func (l *LongPollListener) open(w http.ResponseWriter, r *http.Request) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c := newLongPollConn(l, hex.EncodeToString(b[:]), longPollAddr(r.RemoteAddr))
+	l.mu.Lock()
+	l.sessions[c.id] = c
+	l.mu.Unlock()
+	w.Header().Set(LongPollSessionHeader, c.id)
+	w.WriteHeader(http.StatusCreated)
+
+	// Until Accept the session buffers the bytes of the client, like the
+	// backlog of a TCP listener, but expires after IdleTimeout
+	go func() {
+		select {
+		case l.conns <- c:
+		case <-c.closed:
+		case <-l.closed:
+			c.expire()
+		}
+	}()
+}
+
+// forget removes c from the sessions, later requests for it get 404
+func (l *LongPollListener) forget(c *longPollConn) {
+	l.mu.Lock()
+	if l.sessions[c.id] == c {
+		delete(l.sessions, c.id)
+	}
+	l.mu.Unlock()
+}
+
+func (l *LongPollListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, ErrLongPollClosed
+	}
+}
+
+// Close stops Accept and closes every session
+func (l *LongPollListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.mu.Lock()
+		sessions := make([]*longPollConn, 0, len(l.sessions))
+		for _, c := range l.sessions {
+			sessions = append(sessions, c)
+		}
+		l.mu.Unlock()
+		for _, c := range sessions {
+			c.expire()
+		}
+		if l.server != nil {
+			err = l.server.Close()
+		}
+	})
+	return err
+}
+
+func (l *LongPollListener) Addr() net.Addr {
+	return l.addr
+}
+
+// longPollOffset parses the LongPollOffsetHeader of r, or answers 400
+func longPollOffset(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	offset, err := strconv.ParseInt(r.Header.Get(LongPollOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "invalid "+LongPollOffsetHeader, http.StatusBadRequest)
+		return 0, false
+	}
+	return offset, true
+}
+
+// longPollConn is the server end of a long-polling session. Its bytes
+// are only forgotten once the client read them, so that the DISCONNECT
+// written before Close still reaches it.
+type longPollConn struct {
+	l       *LongPollListener
+	id      string
+	remote  net.Addr
+	in, out *pollBuffer // bytes from and to the client
+
+	mu        sync.Mutex
+	active    int // requests in progress
+	idle      *time.Timer
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newLongPollConn(l *LongPollListener, id string, remote net.Addr) *longPollConn {
+	c := &longPollConn{
+		l:      l,
+		id:     id,
+		remote: remote,
+		in:     newPollBuffer(l.maxBuffered()),
+		out:    newPollBuffer(l.maxBuffered()),
+		closed: make(chan struct{}),
+	}
+	c.idle = time.AfterFunc(l.idleTimeout(), c.expire)
+	return c
+}
+
+// begin and end bracket a request, IdleTimeout runs without any
+func (c *longPollConn) begin() {
+	c.mu.Lock()
+	c.active++
+	c.idle.Stop()
+	c.mu.Unlock()
+}
+
+func (c *longPollConn) end() {
+	c.mu.Lock()
+	c.active--
+	if c.active == 0 {
+		c.idle.Reset(c.l.idleTimeout())
+	}
+	c.mu.Unlock()
+}
+
+// expire closes c and forgets it, even with bytes the client didn't read
+func (c *longPollConn) expire() {
+	_ = c.Close()
+	c.l.forget(c)
+}
+
+func (c *longPollConn) post(w http.ResponseWriter, r *http.Request) {
+	offset, ok := longPollOffset(w, r)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(c.in.max)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := c.in.put(r.Context(), offset, body); err != nil {
+		longPollError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *longPollConn) poll(w http.ResponseWriter, r *http.Request) {
+	offset, ok := longPollOffset(w, r)
+	if !ok {
+		return
+	}
+	b, err := c.out.get(r.Context(), offset, c.l.pollTimeout())
+	if err == io.EOF {
+		// Everything was read up to the end of the session
+		c.l.forget(c)
+	}
+	if err != nil {
+		longPollError(w, err)
+		return
+	}
+	if len(b) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(b)
+}
+
+func longPollError(w http.ResponseWriter, err error) {
+	switch {
+	case err == ErrLongPollOffset:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err == io.EOF || errors.Is(err, net.ErrClosed):
+		http.Error(w, ErrLongPollSession.Error(), http.StatusNotFound)
+	default:
+		// The client went away
+	}
+}
+
+func (c *longPollConn) Read(b []byte) (int, error) {
+	return c.in.read(b)
+}
+
+func (c *longPollConn) Write(b []byte) (int, error) {
+	return c.out.write(b)
+}
+
+// Close ends the session. The client still gets the bytes written
+// before, until IdleTimeout.
+func (c *longPollConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	c.in.close(nil)
+	if c.out.close(nil) {
+		c.l.forget(c)
+	}
+	return nil
+}
+
+func (c *longPollConn) LocalAddr() net.Addr {
+	return c.l.Addr()
+}
+
+func (c *longPollConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *longPollConn) SetDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	c.out.setDeadline(t)
+	return nil
+}
+
+func (c *longPollConn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+func (c *longPollConn) SetWriteDeadline(t time.Time) error {
+	c.out.setDeadline(t)
+	return nil
+}
+
+// DialLongPoll opens a long-polling session with the LongPollListener at
+// an http:// or https:// URL
+func DialLongPoll(url string) (net.Conn, error) {
+	return DialLongPollWith(url, nil)
+}
+
+// DialLongPollWith is DialLongPoll sending the requests with client, e.g.
+// to go through a proxy, or with http.DefaultClient if nil. The Timeout
+// of client must be longer than the PollTimeout of the listener.
+func DialLongPollWith(url string, client *http.Client) (net.Conn, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if err := longPollStatus(resp, http.StatusCreated); err != nil {
+		return nil, err
+	}
+	id := resp.Header.Get(LongPollSessionHeader)
+	if id == "" {
+		return nil, ErrLongPollSession
+	}
+
+	c := &longPollClientConn{
+		url:    url,
+		id:     id,
+		client: client,
+		remote: longPollAddr(req.URL.Host),
+		in:     newPollBuffer(defaultLongPollBuffer),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	go c.pollLoop()
+	return c, nil
+}
+
+// longPollStatus checks that resp has the status want
+func longPollStatus(resp *http.Response, want int) error {
+	switch resp.StatusCode {
+	case want:
+		return nil
+	case http.StatusNotFound:
+		return ErrLongPollSession
+	default:
+		return fmt.Errorf("long-polling request failed: %v", resp.Status)
+	}
+}
+
+// longPollClientConn is the client end of a long-polling session. Its
+// Write sends a POST for every chunk of up to longPollChunk bytes, and
+// pollLoop keeps a GET waiting for the bytes of the server.
+type longPollClientConn struct {
+	url    string
+	id     string
+	client *http.Client
+	remote net.Addr
+	in     *pollBuffer
+
+	ctx       context.Context // cancelled by Close
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+
+	wmu           sync.Mutex
+	written       int64        // bytes the server acknowledged
+	writeDeadline atomic.Int64 // UnixNano, 0 if none
+}
+
+// do sends a request of the session, again if it failed on the way
+func (c *longPollClientConn) do(ctx context.Context, method string, offset int64, body []byte) (*http.Response, error) {
+	var err error
+	for attempt := 0; attempt < longPollRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, method, c.url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(LongPollSessionHeader, c.id)
+		req.Header.Set(LongPollOffsetHeader, strconv.FormatInt(offset, 10))
+		var resp *http.Response
+		if resp, err = c.client.Do(req); err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// pollLoop reads the bytes of the server into c.in until the session
+// ends
+func (c *longPollClientConn) pollLoop() {
+	for {
+		offset := c.in.end()
+		resp, err := c.do(c.ctx, http.MethodGet, offset, nil)
+		if err != nil {
+			c.in.close(err)
+			return
+		}
+		data, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			// Asked for again from the same offset
+			continue
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			if err := c.in.put(c.ctx, offset, data); err != nil {
+				return
+			}
+		case http.StatusNoContent:
+		default:
+			// The server ended the session on 404
+			c.in.close(longPollStatus(resp, http.StatusNotFound))
+			return
+		}
+	}
+}
+
+func (c *longPollClientConn) Read(b []byte) (int, error) {
+	return c.in.read(b)
+}
+
+func (c *longPollClientConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	ctx := c.ctx
+	if dl := c.writeDeadline.Load(); dl != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, time.Unix(0, dl))
+		defer cancel()
+	}
+	n := 0
+	for n < len(b) {
+		chunk := b[n:min(len(b), n+longPollChunk)]
+		resp, err := c.do(ctx, http.MethodPost, c.written, chunk)
+		if err != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				err = os.ErrDeadlineExceeded
+			}
+			return n, err
+		}
+		_ = resp.Body.Close()
+		if err := longPollStatus(resp, http.StatusNoContent); err != nil {
+			return n, err
+		}
+		c.written += int64(len(chunk))
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// Close ends the session, telling the server if it can still be reached
+func (c *longPollClientConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.in.close(net.ErrClosed)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.url, nil)
+		if err != nil {
+			return
+		}
+		req.Header.Set(LongPollSessionHeader, c.id)
+		if resp, err := c.client.Do(req); err == nil {
+			_ = resp.Body.Close()
+		}
+	})
+	return nil
+}
+
+func (c *longPollClientConn) LocalAddr() net.Addr {
+	return longPollAddr("")
+}
+
+func (c *longPollClientConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *longPollClientConn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *longPollClientConn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+func (c *longPollClientConn) SetWriteDeadline(t time.Time) error {
+	var dl int64
+	if !t.IsZero() {
+		dl = t.UnixNano()
+	}
+	c.writeDeadline.Store(dl)
+	return nil
+}
+
+// pollBuffer is one direction of the byte stream of a long-polling
+// session. Its offsets count the bytes since the session opened.
+type pollBuffer struct {
+	max int // bytes buffered before writers wait
+
+	mu       sync.Mutex
+	buf      []byte
+	start    int64         // offset of buf[0]
+	wake     chan struct{} // closed on every change
+	closed   bool
+	err      error // returned by read once closed, io.EOF if nil
+	deadline time.Time
+}
+
+func newPollBuffer(max int) *pollBuffer {
+	return &pollBuffer{max: max, wake: make(chan struct{})}
+}
+
+// changed wakes the waiters, b.mu must be held
+func (b *pollBuffer) changed() {
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
+
+// await waits until wake is closed, done is closed or t passed if it is
+// not zero
+func await(wake, done <-chan struct{}, t time.Time) error {
+	var timeout <-chan time.Time
+	if !t.IsZero() {
+		d := time.Until(t)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-wake:
+		return nil
+	case <-done:
+		return context.Canceled
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (b *pollBuffer) end() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.start + int64(len(b.buf))
+}
+
+func (b *pollBuffer) setDeadline(t time.Time) {
+	b.mu.Lock()
+	b.deadline = t
+	b.changed()
+	b.mu.Unlock()
+}
+
+// close ends the stream, read returns err after the buffered bytes. It
+// reports whether the buffer is empty.
+func (b *pollBuffer) close(err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed, b.err = true, err
+		b.changed()
+	}
+	return len(b.buf) == 0
+}
+
+// read takes the buffered bytes, waiting for some until the deadline
+func (b *pollBuffer) read(p []byte) (int, error) {
+	for {
+		b.mu.Lock()
+		if len(b.buf) > 0 {
+			n := copy(p, b.buf)
+			b.buf = b.buf[n:]
+			b.start += int64(n)
+			b.changed()
+			b.mu.Unlock()
+			return n, nil
+		}
+		if b.closed {
+			err := b.err
+			b.mu.Unlock()
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		wake, deadline := b.wake, b.deadline
+		b.mu.Unlock()
+		if err := await(wake, nil, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// write buffers p once there is room, waiting until the deadline
+func (b *pollBuffer) write(p []byte) (int, error) {
+	for {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if len(b.buf) < b.max {
+			b.buf = append(b.buf, p...)
+			b.changed()
+			b.mu.Unlock()
+			return len(p), nil
+		}
+		wake, deadline := b.wake, b.deadline
+		b.mu.Unlock()
+		if err := await(wake, nil, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// put buffers the bytes of data beyond those already buffered, data
+// starting at offset, once there is room
+func (b *pollBuffer) put(ctx context.Context, offset int64, data []byte) error {
+	for {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return net.ErrClosed
+		}
+		end := b.start + int64(len(b.buf))
+		if offset > end {
+			b.mu.Unlock()
+			return ErrLongPollOffset
+		}
+		if skip := end - offset; skip >= int64(len(data)) {
+			// Sent again after the response was lost
+			b.mu.Unlock()
+			return nil
+		}
+		if len(b.buf) < b.max {
+			b.buf = append(b.buf, data[end-offset:]...)
+			b.changed()
+			b.mu.Unlock()
+			return nil
+		}
+		wake := b.wake
+		b.mu.Unlock()
+		if err := await(wake, ctx.Done(), time.Time{}); err != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// get drops the bytes before offset, which the reader has, and returns
+// those after it. It waits up to timeout for some, returning none
+// afterwards, and io.EOF once all were read from the closed buffer.
+func (b *pollBuffer) get(ctx context.Context, offset int64, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		b.mu.Lock()
+		if offset < b.start || offset > b.start+int64(len(b.buf)) {
+			b.mu.Unlock()
+			return nil, ErrLongPollOffset
+		}
+		if acked := int(offset - b.start); acked > 0 {
+			b.buf = b.buf[acked:]
+			b.start = offset
+			b.changed()
+		}
+		if len(b.buf) > 0 {
+			p := bytes.Clone(b.buf)
+			b.mu.Unlock()
+			return p, nil
+		}
+		if b.closed {
+			b.mu.Unlock()
+			return nil, io.EOF
+		}
+		wake := b.wake
+		b.mu.Unlock()
+		switch err := await(wake, ctx.Done(), deadline); err {
+		case nil:
+		case os.ErrDeadlineExceeded:
+			return nil, nil
+		default:
+			return nil, ctx.Err()
+		}
+	}
+}
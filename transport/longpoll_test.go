@@ -0,0 +1,135 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLongPoll(t *testing.T) {
+	l, err := ListenLongPoll("127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+	l.PollTimeout = 50 * time.Millisecond
+	url := "http://" + l.Addr().String() + "/mqtt"
+
+	client, err := DialLongPoll(url)
+	require.NoError(t, err)
+	defer client.Close() // nolint: errcheck
+	server, err := l.Accept()
+	require.NoError(t, err)
+
+	// Beyond a chunk, and written after polls that timed out
+	time.Sleep(120 * time.Millisecond)
+	publish := packet.NewPublish("a/b", 0, bytes.Repeat([]byte("x"), 3*longPollChunk))
+	go func() { _ = packet.WritePacket(client, publish) }()
+	p, err := packet.ReadPacket(server)
+	require.NoError(t, err)
+	assert.Equal(t, publish, p)
+
+	require.NoError(t, packet.WritePacket(server, publish))
+	p, err = packet.ReadPacket(client)
+	require.NoError(t, err)
+	assert.Equal(t, publish, p)
+
+	// What the server wrote before closing is still read
+	require.NoError(t, packet.WritePacket(server, packet.NewPingRespControlPacket()))
+	require.NoError(t, server.Close())
+	p, err = packet.ReadPacket(client)
+	require.NoError(t, err)
+	assert.IsType(t, &packet.PingRespControlPacket{}, p)
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	// Deadlines
+	client, err = DialLongPoll(url)
+	require.NoError(t, err)
+	server, err = l.Accept()
+	require.NoError(t, err)
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+	_, err = server.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+	_, err = client.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// The server sees the client leave
+	require.NoError(t, server.SetReadDeadline(time.Time{}))
+	require.NoError(t, client.Close())
+	_, err = server.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestLongPollProtocol(t *testing.T) {
+	l, err := ListenLongPoll("127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+	l.PollTimeout = 20 * time.Millisecond
+	l.IdleTimeout = 100 * time.Millisecond
+	url := "http://" + l.Addr().String()
+
+	do := func(method, session, offset, body string) *http.Response {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		require.NoError(t, err)
+		if session != "" {
+			req.Header.Set(LongPollSessionHeader, session)
+		}
+		if offset != "" {
+			req.Header.Set(LongPollOffsetHeader, offset)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp
+	}
+	open := func() (string, *longPollConn) {
+		go func() {
+			resp := do(http.MethodPost, "", "", "")
+			assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		}()
+		c, err := l.Accept()
+		require.NoError(t, err)
+		return c.(*longPollConn).id, c.(*longPollConn)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "", "0", "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "nope", "0", "").StatusCode)
+
+	id, c := open()
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPost, id, "0", "ab").StatusCode)
+	// Sent again with more bytes, as by a client that lost the response
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPost, id, "0", "abc").StatusCode)
+	assert.Equal(t, http.StatusConflict, do(http.MethodPost, id, "9", "x").StatusCode)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, id, "", "x").StatusCode)
+	b := make([]byte, 8)
+	n, err := c.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(b[:n]))
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodGet, id, "0", "").StatusCode)
+	_, err = c.Write([]byte("xyz"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, id, "1", "").StatusCode)
+	// Acknowledged bytes can't be asked for again
+	assert.Equal(t, http.StatusConflict, do(http.MethodGet, id, "0", "").StatusCode)
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodPut, id, "", "").StatusCode)
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, id, "", "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, id, "3", "").StatusCode)
+	_, err = c.Read(b)
+	assert.Equal(t, io.EOF, err)
+
+	// Sessions without requests expire
+	id, c = open()
+	_, err = c.Read(b)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, id, "0", "").StatusCode)
+}
@@ -0,0 +1,188 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package transport
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemScheme is the address prefix of in-memory listeners.
+const MemScheme = "mem://"
+
+var (
+	ErrMemAddressInUse = errors.New("mem address already in use")
+	ErrMemNoListener   = errors.New("no mem listener at address")
+)
+
+var (
+	memListenersMu sync.Mutex
+	memListeners   = map[string]*MemListener{}
+)
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return MemScheme + string(a) }
+
+func memName(address string) string {
+	return strings.TrimPrefix(address, MemScheme)
+}
+
+// MemListener is a net.Listener whose connections are in-process pipes.
+// It is registered under its address until closed, so DialMem can reach
+// it from anywhere in the same process.
+type MemListener struct {
+	name      string
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// ListenMem registers an in-memory listener. The address may be given
+// with or without the mem:// prefix.
+func ListenMem(address string) (*MemListener, error) {
+	name := memName(address)
+
+	memListenersMu.Lock()
+	defer memListenersMu.Unlock()
+	if _, ok := memListeners[name]; ok {
+		return nil, ErrMemAddressInUse
+	}
+
+	l := &MemListener{
+		name:   name,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	memListeners[name] = l
+	return l, nil
+}
+
+func (l *MemListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("mem listener closed")
+	}
+}
+
+func (l *MemListener) Close() error {
+	l.closeOnce.Do(func() {
+		memListenersMu.Lock()
+		delete(memListeners, l.name)
+		memListenersMu.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *MemListener) Addr() net.Addr {
+	return memAddr(l.name)
+}
+
+// Impairment describes artificial network conditions applied to both
+// directions of an in-memory connection. The zero value is a perfect link.
+type Impairment struct {
+	// Latency is added to every write
+	Latency time.Duration
+	// Bandwidth limits throughput in bytes per second, 0 means unlimited
+	Bandwidth int
+	// CorruptProbability is the chance (0..1) that a single bit of a
+	// write gets flipped
+	CorruptProbability float64
+	// Seed makes corruption reproducible. 0 uses the current time.
+	Seed int64
+}
+
+// DialMem connects to the in-memory listener at address. imp may be nil.
+func DialMem(address string, imp *Impairment) (net.Conn, error) {
+	name := memName(address)
+
+	memListenersMu.Lock()
+	l, ok := memListeners[name]
+	memListenersMu.Unlock()
+	if !ok {
+		return nil, ErrMemNoListener
+	}
+
+	local, remote := net.Pipe()
+	if imp != nil {
+		local, remote = newImpairedConn(local, *imp), newImpairedConn(remote, *imp)
+	}
+
+	select {
+	case l.conns <- remote:
+		return local, nil
+	case <-l.closed:
+		_ = local.Close()
+		_ = remote.Close()
+		return nil, ErrMemNoListener
+	}
+}
+
+type impairedConn struct {
+	net.Conn
+	imp Impairment
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newImpairedConn(c net.Conn, imp Impairment) *impairedConn {
+	seed := imp.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &impairedConn{
+		Conn: c,
+		imp:  imp,
+		rnd:  rand.New(rand.NewSource(seed)), // nolint: gosec
+	}
+}
+
+func (c *impairedConn) Write(b []byte) (int, error) {
+	delay := c.imp.Latency
+	if c.imp.Bandwidth > 0 {
+		delay += time.Duration(len(b)) * time.Second / time.Duration(c.imp.Bandwidth)
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	if c.imp.CorruptProbability > 0 && len(b) > 0 {
+		c.mu.Lock()
+		corrupt := c.rnd.Float64() < c.imp.CorruptProbability
+		pos, bit := c.rnd.Intn(len(b)), uint(c.rnd.Intn(8))
+		c.mu.Unlock()
+
+		if corrupt {
+			// Never modify the caller's buffer
+			dup := make([]byte, len(b))
+			copy(dup, b)
+			dup[pos] ^= 1 << bit
+			b = dup
+		}
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,50 @@
+package transport
+
+import (
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemListenDial(t *testing.T) {
+	l, err := ListenMem("mem://test-listen-dial")
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+
+	_, err = ListenMem("test-listen-dial")
+	assert.Equal(t, ErrMemAddressInUse, err)
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = packet.NewPingRespControlPacket().WriteTo(c)
+	}()
+
+	start := time.Now()
+	c, err := DialMem("mem://test-listen-dial", &Impairment{Latency: 20 * time.Millisecond})
+	require.NoError(t, err)
+	defer c.Close() // nolint: errcheck
+
+	b := make([]byte, 2)
+	_, err = c.Read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{packet.PINGRESP << 4, 0}, b)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+}
+
+func TestMemDialWithoutListener(t *testing.T) {
+	_, err := DialMem("mem://nobody-here", nil)
+	assert.Equal(t, ErrMemNoListener, err)
+
+	l, err := ListenMem("closed-again")
+	require.NoError(t, err)
+	assert.NoError(t, l.Close())
+
+	_, err = DialMem("closed-again", nil)
+	assert.Equal(t, ErrMemNoListener, err)
+}
@@ -0,0 +1,112 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor systemd passes, after
+// stdin, stdout and stderr
+const listenFDsStart = 3
+
+// SystemdListeners returns the sockets systemd passed to the process by
+// socket activation, see sd_listen_fds(3), keyed by their name: the
+// FileDescriptorName= of the socket unit, or the name of the unit. A
+// unit with several ListenStream= passes as many sockets of the same
+// name. It returns nil if the process was not socket activated.
+//
+// The LISTEN_ variables are removed from the environment, so that child
+// processes don't take the sockets for theirs; the sockets can only be
+// taken once.
+func SystemdListeners() (map[string][]net.Listener, error) {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	names, err := listenFDs(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), os.Getpid())
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	files := make([]*os.File, len(names))
+	for i, name := range names {
+		files[i] = os.NewFile(uintptr(listenFDsStart+i), name)
+	}
+	return fileListeners(files, names, listenFDsStart)
+}
+
+// listenFDs returns the names of the sockets the LISTEN_ variables
+// announce, none if they are meant for another process
+func listenFDs(pid, fds, fdNames string, self int) ([]string, error) {
+	if fds == "" {
+		return nil, nil
+	}
+	if p, err := strconv.Atoi(pid); err != nil || p != self {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	names := make([]string, n)
+	if fdNames != "" {
+		split := strings.Split(fdNames, ":")
+		if len(split) != n {
+			return nil, fmt.Errorf("LISTEN_FDNAMES has %d names for %d sockets", len(split), n)
+		}
+		copy(names, split)
+	}
+	for i := range names {
+		if names[i] == "" {
+			names[i] = "unknown" // like sd_listen_fds_with_names(3)
+		}
+	}
+	return names, nil
+}
+
+// fileListeners returns the listeners of files and closes the files.
+// Either all of them are returned, or none. Errors number the files from
+// first.
+func fileListeners(files []*os.File, names []string, first int) (map[string][]net.Listener, error) {
+	listeners := make(map[string][]net.Listener)
+	var errs []error
+	for i, f := range files {
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("socket %d (%s): %w", first+i, names[i], err))
+			continue
+		}
+		listeners[names[i]] = append(listeners[names[i]], l)
+	}
+	if len(errs) > 0 {
+		for _, ls := range listeners {
+			for _, l := range ls {
+				_ = l.Close()
+			}
+		}
+		return nil, errors.Join(errs...)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,75 @@
+package transport
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenFDs(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	for _, test := range []struct {
+		pid, fds, names string
+		want            []string
+		err             bool
+	}{
+		{pid: pid},
+		{pid: "1", fds: "2"},
+		{pid: pid, fds: "2", want: []string{"unknown", "unknown"}},
+		{pid: pid, fds: "2", names: "mqtt:mqtt-tls", want: []string{"mqtt", "mqtt-tls"}},
+		{pid: pid, fds: "2", names: "mqtt", err: true},
+		{pid: pid, fds: "two", err: true},
+	} {
+		names, err := listenFDs(test.pid, test.fds, test.names, os.Getpid())
+		if test.err {
+			assert.Error(t, err, test)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.want, names, test)
+	}
+
+	listeners, err := SystemdListeners()
+	assert.NoError(t, err)
+	assert.Nil(t, listeners, "not socket activated")
+}
+
+func TestFileListeners(t *testing.T) {
+	var files []*os.File
+	for range 2 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		f, err := l.(*net.TCPListener).File()
+		require.NoError(t, err)
+		require.NoError(t, l.Close())
+		files = append(files, f)
+	}
+
+	listeners, err := fileListeners(files, []string{"mqtt", "mqtt"}, listenFDsStart)
+	require.NoError(t, err)
+	require.Len(t, listeners["mqtt"], 2)
+	for _, l := range listeners["mqtt"] {
+		c, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		assert.NoError(t, c.Close())
+		assert.NoError(t, l.Close())
+	}
+
+	// All or nothing
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f, err := l.(*net.TCPListener).File()
+	require.NoError(t, err)
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer w.Close() // nolint: errcheck
+	_, err = fileListeners([]*os.File{f, r}, []string{"mqtt", "pipe"}, listenFDsStart)
+	assert.ErrorContains(t, err, "socket 4 (pipe)")
+	require.NoError(t, l.Close())
+	_, err = net.Dial("tcp", l.Addr().String())
+	assert.Error(t, err, "the listener that worked is closed too")
+}
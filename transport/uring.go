@@ -0,0 +1,35 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package transport
+
+import "errors"
+
+// ErrURingUnsupported is returned by NewURingListener where io_uring is
+// not available, on other systems than Linux or if the kernel or a
+// sandbox forbids it
+var ErrURingUnsupported = errors.New("io_uring is not supported")
+
+// URingConfig tunes NewURingListener
+type URingConfig struct {
+	// Rings spreads the connections over this many rings, each with a
+	// goroutine submitting their operations. Defaults to 1.
+	Rings int
+	// Entries is the size of the submission queue of each ring, the most
+	// operations submitted with one system call. Defaults to 4096.
+	Entries int
+}
@@ -0,0 +1,658 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The parts of the io_uring ABI the transport uses, see
+// include/uapi/linux/io_uring.h
+const (
+	uringOpRead        = 22
+	uringOpSend        = 26
+	uringOpRecv        = 27
+	uringOpAsyncCancel = 14
+
+	uringEnterGetEvents = 1
+
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+)
+
+const defaultURingEntries = 4096
+
+var errURingClosed = errors.New("io_uring closed")
+
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFD         uint32
+	resv         [3]uint32
+	sqOff        uringSQOffsets
+	cqOff        uringCQOffsets
+}
+
+type uringSQOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringCQOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// uringSQE is a submission queue entry
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFDIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+// uringCQE is a completion queue entry
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uringOp is an operation waiting for its completion. buf stays
+// referenced until then, as the kernel writes to it or reads from it.
+type uringOp struct {
+	opcode uint8
+	fd     int32
+	buf    []byte
+	flags  uint32
+	target *uringOp // of uringOpAsyncCancel
+
+	id   uint64
+	res  int32
+	done chan struct{}
+}
+
+// uring is an io_uring instance. Operations are queued by the
+// connections and submitted by loop, all that were queued since the last
+// system call with the next one, which also reaps their completions.
+type uring struct {
+	fd                     int
+	sqRing, cqRing, sqeMem []byte
+	sqHead, sqTail         *uint32
+	sqMask, sqEntries      uint32
+	sqArray                []uint32
+	sqes                   []uringSQE
+	cqHead, cqTail         *uint32
+	cqMask                 uint32
+	cqes                   []uringCQE
+
+	// wakeFD is an eventfd loop always has a read of pending, so that
+	// queueing an operation interrupts waiting for completions
+	wakeFD  int
+	wakeBuf [8]byte
+	woken   atomic.Bool
+
+	mu          sync.Mutex
+	wakePending bool // the read of wakeFD was submitted and not completed
+	queue       []*uringOp
+	pending     map[uint64]*uringOp
+	nextID      uint64
+	refs        int   // of the listener and its connections
+	err         error // why the ring stopped
+}
+
+func newURing(entries int) (*uring, error) {
+	var p uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		if errno == unix.ENOSYS || errno == unix.EPERM {
+			return nil, fmt.Errorf("%w: %v", ErrURingUnsupported, errno)
+		}
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+	r := &uring{fd: int(fd), wakeFD: -1, pending: make(map[uint64]*uringOp), refs: 1}
+	if err := r.mmap(&p); err != nil {
+		r.unmap()
+		return nil, err
+	}
+	var err error
+	if r.wakeFD, err = unix.Eventfd(0, unix.EFD_CLOEXEC); err != nil {
+		r.unmap()
+		return nil, os.NewSyscallError("eventfd", err)
+	}
+	go r.loop()
+	return r, nil
+}
+
+func (r *uring) mmap(p *uringParams) error {
+	var err error
+	r.sqRing, err = unix.Mmap(r.fd, uringOffSQRing, int(p.sqOff.array+p.sqEntries*4), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+	r.cqRing, err = unix.Mmap(r.fd, uringOffCQRing, int(p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(uringCQE{}))), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+	r.sqeMem, err = unix.Mmap(r.fd, uringOffSQEs, int(p.sqEntries*uint32(unsafe.Sizeof(uringSQE{}))), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqEntries = p.sqEntries
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.array])), p.sqEntries)
+	r.sqes = unsafe.Slice((*uringSQE)(unsafe.Pointer(&r.sqeMem[0])), p.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*uringCQE)(unsafe.Pointer(&r.cqRing[p.cqOff.cqes])), p.cqEntries)
+	return nil
+}
+
+// unmap releases the ring once loop is done with it
+func (r *uring) unmap() {
+	for _, mem := range [][]byte{r.sqRing, r.cqRing, r.sqeMem} {
+		if mem != nil {
+			_ = unix.Munmap(mem)
+		}
+	}
+	if r.wakeFD >= 0 {
+		_ = unix.Close(r.wakeFD)
+	}
+	_ = unix.Close(r.fd)
+}
+
+// submit queues op. Its done channel is closed once it completed.
+func (r *uring) submit(op *uringOp) error {
+	r.mu.Lock()
+	if r.err != nil {
+		r.mu.Unlock()
+		return r.err
+	}
+	r.queue = append(r.queue, op)
+	r.mu.Unlock()
+	r.wake()
+	return nil
+}
+
+// wake interrupts loop waiting for completions, unless it was already
+func (r *uring) wake() {
+	if r.woken.CompareAndSwap(false, true) {
+		var one [8]byte
+		binary.NativeEndian.PutUint64(one[:], 1)
+		_, _ = unix.Write(r.wakeFD, one[:])
+	}
+}
+
+// retain adds a reference to r, it returns false if r was closed
+func (r *uring) retain() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.refs == 0 {
+		return false
+	}
+	r.refs++
+	return true
+}
+
+// release drops a reference to r, stopping it with the last one
+func (r *uring) release() {
+	r.mu.Lock()
+	if r.refs--; r.refs == 0 && r.err == nil {
+		r.err = errURingClosed
+	}
+	r.mu.Unlock()
+	r.wake()
+}
+
+func (r *uring) loop() {
+	for {
+		r.mu.Lock()
+		stopped := r.err != nil
+		submitted := r.fill()
+		// Without the read of wakeFD nothing would interrupt the wait,
+		// so only submit and try again
+		var wait uintptr
+		if r.wakePending {
+			wait = 1
+		}
+		r.mu.Unlock()
+		if stopped {
+			break
+		}
+
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(submitted), wait, uringEnterGetEvents, 0, 0)
+		if errno != 0 && errno != unix.EINTR && errno != unix.EAGAIN && errno != unix.EBUSY {
+			r.mu.Lock()
+			r.err = os.NewSyscallError("io_uring_enter", errno)
+			r.mu.Unlock()
+			break
+		}
+		r.reap()
+	}
+
+	// The connections are closed and their operations completed before
+	// the last reference is released, unless the ring failed. Closing it
+	// cancels whatever is left in the kernel.
+	r.unmap()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, op := range r.pending {
+		op.res = -int32(unix.ECANCELED)
+		close(op.done)
+	}
+	for _, op := range r.queue {
+		op.res = -int32(unix.ECANCELED)
+		close(op.done)
+	}
+	r.pending, r.queue = nil, nil
+}
+
+// fill moves queued operations to the submission queue, after a read of
+// wakeFD unless one is pending. It is called with r.mu held and returns
+// the number of entries added.
+func (r *uring) fill() int {
+	tail := *r.sqTail
+	free := r.sqEntries - (tail - atomic.LoadUint32(r.sqHead))
+	n := 0
+	if !r.wakePending && free > 0 {
+		r.put(tail, uringSQE{opcode: uringOpRead, fd: int32(r.wakeFD), addr: uint64(uintptr(unsafe.Pointer(&r.wakeBuf[0]))), len: uint32(len(r.wakeBuf))})
+		r.wakePending = true
+		tail++
+		n++
+	}
+	for len(r.queue) > 0 && uint32(n) < free {
+		op := r.queue[0]
+		r.queue[0] = nil
+		r.queue = r.queue[1:]
+		r.nextID++
+		op.id = r.nextID
+		r.pending[op.id] = op
+		sqe := uringSQE{opcode: op.opcode, fd: op.fd, opFlags: op.flags, userData: op.id}
+		if len(op.buf) > 0 {
+			sqe.addr, sqe.len = uint64(uintptr(unsafe.Pointer(&op.buf[0]))), uint32(len(op.buf))
+		}
+		if op.target != nil {
+			sqe.fd, sqe.addr = -1, op.target.id
+		}
+		r.put(tail, sqe)
+		tail++
+		n++
+	}
+	atomic.StoreUint32(r.sqTail, tail)
+	return n
+}
+
+func (r *uring) put(tail uint32, sqe uringSQE) {
+	i := tail & r.sqMask
+	r.sqes[i] = sqe
+	r.sqArray[i] = i
+}
+
+// reap completes the operations in the completion queue, and notes when
+// the read of wakeFD completed so that fill submits another
+func (r *uring) reap() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	head := *r.cqHead
+	for tail := atomic.LoadUint32(r.cqTail); head != tail; head++ {
+		cqe := r.cqes[head&r.cqMask]
+		if cqe.userData == 0 {
+			r.wakePending = false
+			r.woken.Store(false)
+			continue
+		}
+		if op, ok := r.pending[cqe.userData]; ok {
+			delete(r.pending, cqe.userData)
+			op.res = cqe.res
+			close(op.done)
+		}
+	}
+	atomic.StoreUint32(r.cqHead, head)
+}
+
+// uringListener accepts TCP connections whose reads and writes go through
+// rings
+type uringListener struct {
+	net.Listener
+	rings     []*uring
+	next      atomic.Uint32
+	closeOnce sync.Once
+}
+
+// NewURingListener returns a listener for the connections of the TCP
+// listener l whose reads and writes are submitted to io_uring, many at a
+// time, instead of with a system call each. This is experimental.
+//
+// The sockets are taken out of the network poller of the Go runtime. The
+// connections support deadlines, but are not *net.TCPConn. Connections
+// whose socket cannot be taken over are closed.
+func NewURingListener(l net.Listener, cfg URingConfig) (net.Listener, error) {
+	if _, ok := l.Addr().(*net.TCPAddr); !ok {
+		return nil, fmt.Errorf("io_uring needs a TCP listener, not %v", l.Addr().Network())
+	}
+	entries := cfg.Entries
+	if entries <= 0 {
+		entries = defaultURingEntries
+	}
+	ul := &uringListener{Listener: l}
+	for i := 0; i < max(1, cfg.Rings); i++ {
+		r, err := newURing(entries)
+		if err != nil {
+			for _, r := range ul.rings {
+				r.release()
+			}
+			return nil, err
+		}
+		ul.rings = append(ul.rings, r)
+	}
+	return ul, nil
+}
+
+func (l *uringListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		tcp, ok := c.(*net.TCPConn)
+		if !ok {
+			return c, nil
+		}
+		f, err := tcp.File()
+		_ = tcp.Close()
+		if err != nil {
+			continue
+		}
+		ring := l.rings[int(l.next.Add(1))%len(l.rings)]
+		if !ring.retain() {
+			_ = f.Close()
+			return nil, net.ErrClosed
+		}
+		return &uringConn{
+			ring:  ring,
+			file:  f,
+			fd:    int32(f.Fd()), // puts the socket in blocking mode
+			laddr: c.LocalAddr(),
+			raddr: c.RemoteAddr(),
+			rdl:   newDeadline(),
+			wdl:   newDeadline(),
+		}, nil
+	}
+}
+
+// Close closes the listener. The rings stop once their connections were
+// closed as well.
+func (l *uringListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() {
+		for _, r := range l.rings {
+			r.release()
+		}
+	})
+	return err
+}
+
+// uringConn is a connection of a uringListener
+type uringConn struct {
+	ring         *uring
+	file         *os.File
+	fd           int32
+	laddr, raddr net.Addr
+	rdl, wdl     *deadline
+	rmu, wmu     sync.Mutex // serialize reads and writes
+
+	mu     sync.Mutex
+	ops    int // in progress; the socket is closed after the last one
+	closed bool
+}
+
+func (c *uringConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	n, err := c.do(uringOpRecv, b, 0, c.rdl)
+	if err != nil {
+		return 0, c.opError("read", err)
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (c *uringConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	written := 0
+	for written < len(b) {
+		n, err := c.do(uringOpSend, b[written:], unix.MSG_NOSIGNAL, c.wdl)
+		if err != nil {
+			return written, c.opError("write", err)
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// do submits an operation on the socket and waits for its result, or
+// cancels it at the deadline d
+func (c *uringConn) do(opcode uint8, b []byte, flags uint32, d *deadline) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	c.ops++
+	c.mu.Unlock()
+	defer c.opDone()
+
+	for {
+		if d.passed() {
+			return 0, os.ErrDeadlineExceeded
+		}
+		op := &uringOp{opcode: opcode, fd: c.fd, buf: b, flags: flags, done: make(chan struct{})}
+		if err := c.ring.submit(op); err != nil {
+			return 0, err
+		}
+		if !d.wait(op.done) {
+			_ = c.ring.submit(&uringOp{opcode: uringOpAsyncCancel, target: op, done: make(chan struct{})})
+			<-op.done
+		}
+		switch {
+		case c.isClosed():
+			return 0, net.ErrClosed
+		case op.res == -int32(unix.EINTR):
+			continue
+		case op.res == -int32(unix.ECANCELED):
+			return 0, os.ErrDeadlineExceeded
+		case op.res < 0:
+			return 0, os.NewSyscallError(opName(opcode), syscall.Errno(-op.res))
+		}
+		return int(op.res), nil
+	}
+}
+
+func opName(opcode uint8) string {
+	if opcode == uringOpSend {
+		return "send"
+	}
+	return "recv"
+}
+
+func (c *uringConn) opDone() {
+	c.mu.Lock()
+	c.ops--
+	last := c.closed && c.ops == 0
+	c.mu.Unlock()
+	if last {
+		c.release()
+	}
+}
+
+func (c *uringConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *uringConn) opError(op string, err error) error {
+	if err == io.EOF {
+		return err
+	}
+	return &net.OpError{Op: op, Net: "tcp", Source: c.laddr, Addr: c.raddr, Err: err}
+}
+
+// Close shuts the socket down, which completes the operations in
+// progress. The socket is closed with the last of them.
+func (c *uringConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return c.opError("close", net.ErrClosed)
+	}
+	c.closed = true
+	last := c.ops == 0
+	c.mu.Unlock()
+
+	_ = unix.Shutdown(int(c.fd), unix.SHUT_RDWR)
+	if last {
+		return c.release()
+	}
+	return nil
+}
+
+func (c *uringConn) release() error {
+	err := c.file.Close()
+	c.ring.release()
+	return err
+}
+
+func (c *uringConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *uringConn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *uringConn) SetDeadline(t time.Time) error {
+	c.rdl.set(t)
+	c.wdl.set(t)
+	return nil
+}
+
+func (c *uringConn) SetReadDeadline(t time.Time) error {
+	c.rdl.set(t)
+	return nil
+}
+
+func (c *uringConn) SetWriteDeadline(t time.Time) error {
+	c.wdl.set(t)
+	return nil
+}
+
+// deadline is the read or write deadline of a uringConn. Waiting
+// operations notice when it changes.
+type deadline struct {
+	mu      sync.Mutex
+	t       time.Time
+	changed chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{changed: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	d.t = t
+	close(d.changed)
+	d.changed = make(chan struct{})
+	d.mu.Unlock()
+}
+
+func (d *deadline) get() (time.Time, <-chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.t, d.changed
+}
+
+func (d *deadline) passed() bool {
+	t, _ := d.get()
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+// wait waits until done is closed, it returns false if the deadline
+// passed first
+func (d *deadline) wait(done <-chan struct{}) bool {
+	for {
+		t, changed := d.get()
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !t.IsZero() {
+			timer = time.NewTimer(time.Until(t))
+			timeout = timer.C
+		}
+		select {
+		case <-done:
+			if timer != nil {
+				timer.Stop()
+			}
+			return true
+		case <-timeout:
+			select {
+			case <-done:
+				return true
+			default:
+				return false
+			}
+		case <-changed:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func listenURing(t *testing.T) net.Listener {
+	return listenURingWith(t, URingConfig{Rings: 2, Entries: 64})
+}
+
+func listenURingWith(t *testing.T, cfg URingConfig) net.Listener {
+	t.Helper()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l, err := NewURingListener(tcp, cfg)
+	if errors.Is(err, ErrURingUnsupported) {
+		_ = tcp.Close()
+		t.Skip(err)
+	}
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	return l
+}
+
+func acceptURing(t *testing.T, l net.Listener) (client, server net.Conn) {
+	t.Helper()
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	server, err = l.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = server.Close() })
+	return client, server
+}
+
+func TestURingPackets(t *testing.T) {
+	l := listenURing(t)
+	client, server := acceptURing(t, l)
+
+	publish := packet.NewPublish("a/b", 0, make([]byte, 256<<10))
+	encoded, err := publish.Encode()
+	require.NoError(t, err)
+	go func() { _, _ = client.Write(encoded) }()
+	p, err := packet.ReadPacket(server)
+	require.NoError(t, err)
+	assert.Equal(t, publish, p)
+
+	require.NoError(t, packet.WritePacket(server, publish))
+	p, err = packet.ReadPacket(client)
+	require.NoError(t, err)
+	assert.Equal(t, publish, p)
+
+	require.NoError(t, client.Close())
+	_, err = server.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestURingFullSubmissionQueue(t *testing.T) {
+	// More operations than entries: some wait in the queue of the ring,
+	// and the read of the wake eventfd must be submitted again later
+	l := listenURingWith(t, URingConfig{Rings: 1, Entries: 2})
+	const conns = 8
+	done := make(chan error, conns)
+	for i := 0; i < conns; i++ {
+		client, server := acceptURing(t, l)
+		go func() {
+			for j := 0; j < 20; j++ {
+				if _, err := server.Write([]byte{byte(j)}); err != nil {
+					done <- err
+					return
+				}
+				b := make([]byte, 1)
+				if _, err := io.ReadFull(server, b); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}()
+		go func() { _, _ = io.Copy(client, client) }()
+	}
+	for i := 0; i < conns; i++ {
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("operations stalled")
+		}
+	}
+}
+
+func TestURingDeadline(t *testing.T) {
+	l := listenURing(t)
+	_, server := acceptURing(t, l)
+
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err := server.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// A deadline in the past fails at once, clearing it blocks again
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(-time.Second)))
+	_, err = server.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	done := make(chan error, 1)
+	require.NoError(t, server.SetReadDeadline(time.Time{}))
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("read returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, server.SetReadDeadline(time.Now()))
+	assert.ErrorIs(t, <-done, os.ErrDeadlineExceeded)
+}
+
+func TestURingClose(t *testing.T) {
+	l := listenURing(t)
+	_, server := acceptURing(t, l)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, server.Close())
+	assert.ErrorIs(t, <-done, net.ErrClosed)
+
+	_, err := server.Write([]byte("x"))
+	assert.ErrorIs(t, err, net.ErrClosed)
+	assert.Error(t, server.Close())
+
+	require.NoError(t, l.Close())
+	_, err = l.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
@@ -0,0 +1,311 @@
+//--------------------------------------------------------------------------
+// Copyright 2018 infinimesh, INC
+// www.infinimesh.io
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+//--------------------------------------------------------------------------
+
+package transport
+
+import (
+	"compress/flate"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketSubprotocol is the WebSocket subprotocol MQTT is carried in
+// [MQTT-6.0.0-3]
+const WebSocketSubprotocol = "mqtt"
+
+// Older clients still ask for the MQTT 3.1 name of the subprotocol
+var webSocketSubprotocols = []string{WebSocketSubprotocol, "mqttv3.1"}
+
+var (
+	ErrWebSocketClosed      = errors.New("websocket listener closed")
+	ErrWebSocketSubprotocol = errors.New("websocket peer did not agree on the mqtt subprotocol")
+	ErrWebSocketTextMessage = errors.New("websocket text message received, MQTT requires binary messages")
+	ErrWebSocketTooLarge    = errors.New("websocket message exceeds the maximum size")
+)
+
+const defaultWebSocketMinCompressSize = 256
+
+// WebSocketCompression configures the permessage-deflate extension of
+// WebSocket (RFC 7692). Every message is compressed on its own, without
+// a compression context kept between messages: that costs some ratio, but
+// a connection holds no compressor memory while it is idle.
+type WebSocketCompression struct {
+	// Level is the flate compression level, from 1 (flate.BestSpeed) to
+	// 9 (flate.BestCompression). Higher levels take more memory and CPU
+	// per message. Defaults to 1.
+	Level int
+	// MinSize is the size of the smallest message worth compressing,
+	// smaller ones are sent as they are. Defaults to 256 bytes.
+	MinSize int
+	// MaxMessageSize limits the size of the messages read once
+	// decompressed, so that a small compressed message cannot take up a
+	// lot of memory. The connection is closed beyond it. 0 means no
+	// limit.
+	MaxMessageSize int64
+}
+
+func (c *WebSocketCompression) level() int {
+	if c.Level < flate.BestSpeed || c.Level > flate.BestCompression {
+		return flate.BestSpeed
+	}
+	return c.Level
+}
+
+func (c *WebSocketCompression) minSize() int {
+	if c.MinSize > 0 {
+		return c.MinSize
+	}
+	return defaultWebSocketMinCompressSize
+}
+
+// WebSocketListener is a net.Listener for MQTT over WebSocket. It is also
+// an http.Handler: mount it on an http.Server, and every request it
+// upgrades is returned by Accept as a net.Conn carrying the MQTT byte
+// stream.
+type WebSocketListener struct {
+	// CheckOrigin decides whether a browser may connect from another
+	// origin. Only same origin requests are accepted if nil.
+	CheckOrigin func(r *http.Request) bool
+	// Compression is offered to the clients that ask for it if not nil
+	Compression *WebSocketCompression
+	// Compress decides for each connection whether to offer Compression,
+	// e.g. only to clients known to send large payloads. Compression is
+	// offered to every client if nil.
+	Compress func(r *http.Request) bool
+
+	addr      net.Addr
+	server    *http.Server // only set by ListenWebSocket
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWebSocketListener returns a listener that receives its connections
+// through ServeHTTP. addr is what Addr reports.
+func NewWebSocketListener(addr net.Addr) *WebSocketListener {
+	return &WebSocketListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// ListenWebSocket listens for WebSocket upgrades on every path of addr.
+// Closing the listener also stops its HTTP server.
+func ListenWebSocket(addr string) (*WebSocketListener, error) {
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := NewWebSocketListener(tcp.Addr())
+	l.server = &http.Server{Handler: l, ReadHeaderTimeout: 10 * time.Second}
+	go l.server.Serve(tcp) // nolint: errcheck
+	return l, nil
+}
+
+func (l *WebSocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	compression := l.Compression
+	if compression != nil && l.Compress != nil && !l.Compress(r) {
+		compression = nil
+	}
+	upgrader := websocket.Upgrader{
+		Subprotocols:      webSocketSubprotocols,
+		CheckOrigin:       l.CheckOrigin,
+		EnableCompression: compression != nil,
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already replied with an HTTP error
+		return
+	}
+	if ws.Subprotocol() == "" {
+		_ = ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseProtocolError, ErrWebSocketSubprotocol.Error()),
+			time.Now().Add(time.Second))
+		_ = ws.Close()
+		return
+	}
+
+	select {
+	case l.conns <- newWebSocketConn(ws, compression):
+	case <-l.closed:
+		_ = ws.Close()
+	}
+}
+
+func (l *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, ErrWebSocketClosed
+	}
+}
+
+func (l *WebSocketListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		if l.server != nil {
+			err = l.server.Close()
+		}
+	})
+	return err
+}
+
+func (l *WebSocketListener) Addr() net.Addr {
+	return l.addr
+}
+
+// DialWebSocket connects to an MQTT server at a ws:// or wss:// URL
+func DialWebSocket(url string) (net.Conn, error) {
+	return DialWebSocketWith(url, nil)
+}
+
+// DialWebSocketWith is DialWebSocket asking the server for compression if
+// it is not nil. The connection is not compressed if the server declines.
+func DialWebSocketWith(url string, compression *WebSocketCompression) (net.Conn, error) {
+	dialer := websocket.Dialer{
+		Subprotocols:      webSocketSubprotocols,
+		HandshakeTimeout:  10 * time.Second,
+		EnableCompression: compression != nil,
+	}
+	ws, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Subprotocol() == "" {
+		_ = ws.Close()
+		return nil, ErrWebSocketSubprotocol
+	}
+	return newWebSocketConn(ws, compression), nil
+}
+
+// webSocketConn turns the binary messages of a WebSocket into a byte
+// stream. A message may hold several or only part of an MQTT packet
+// [MQTT-6.0.0-2]; every Write is sent as one message. As with the
+// underlying gorilla connection, a read that timed out leaves the
+// connection unusable.
+type webSocketConn struct {
+	ws          *websocket.Conn
+	minCompress int   // size of the smallest message compressed, 0 if none are
+	maxMessage  int64 // of a message read once decompressed, 0 if unlimited
+
+	rmu    sync.Mutex
+	reader io.Reader // current message, nil between messages
+	read   int64     // of the current message
+	wmu    sync.Mutex
+}
+
+// newWebSocketConn returns the connection of ws. compression applies if
+// the peer agreed to permessage-deflate.
+func newWebSocketConn(ws *websocket.Conn, compression *WebSocketCompression) *webSocketConn {
+	c := &webSocketConn{ws: ws}
+	if compression != nil {
+		_ = ws.SetCompressionLevel(compression.level())
+		c.minCompress = compression.minSize()
+		c.maxMessage = compression.MaxMessageSize
+	}
+	return c
+}
+
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for {
+		if c.reader == nil {
+			messageType, r, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				// [MQTT-6.0.0-1]
+				_ = c.ws.Close()
+				return 0, ErrWebSocketTextMessage
+			}
+			c.reader, c.read = r, 0
+		}
+
+		n, err := c.reader.Read(b)
+		c.read += int64(n)
+		if c.maxMessage > 0 && c.read > c.maxMessage {
+			_ = c.ws.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseMessageTooBig, ""),
+				time.Now().Add(time.Second))
+			_ = c.ws.Close()
+			return 0, ErrWebSocketTooLarge
+		}
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *webSocketConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.minCompress > 0 {
+		// Without effect unless the peer agreed to compression
+		c.ws.EnableWriteCompression(len(b) >= c.minCompress)
+	}
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *webSocketConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *webSocketConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *webSocketConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *webSocketConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
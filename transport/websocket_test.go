@@ -0,0 +1,113 @@
+package transport
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/infinimesh/mqtt-go/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSocket(t *testing.T) {
+	l, err := ListenWebSocket("127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+	url := "ws://" + l.Addr().String() + "/mqtt"
+
+	client, err := DialWebSocket(url)
+	require.NoError(t, err)
+	defer client.Close() // nolint: errcheck
+	server, err := l.Accept()
+	require.NoError(t, err)
+	defer server.Close() // nolint: errcheck
+
+	// A packet split across two messages is read like a stream
+	publish := packet.NewPublish("a/b", 0, []byte("over websocket"))
+	encoded, err := publish.Encode()
+	require.NoError(t, err)
+	go func() {
+		_, _ = client.Write(encoded[:3])
+		_, _ = client.Write(encoded[3:])
+	}()
+	p, err := packet.ReadPacket(server)
+	require.NoError(t, err)
+	assert.Equal(t, publish, p)
+
+	require.NoError(t, packet.WritePacket(server, packet.NewPingRespControlPacket()))
+	p, err = packet.ReadPacket(client)
+	require.NoError(t, err)
+	assert.IsType(t, &packet.PingRespControlPacket{}, p)
+}
+
+func TestWebSocketProtocolViolations(t *testing.T) {
+	l, err := ListenWebSocket("127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+	url := "ws://" + l.Addr().String()
+
+	// Without the mqtt subprotocol the server closes right away
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	_, _, err = ws.ReadMessage()
+	assert.Error(t, err)
+	require.NoError(t, ws.Close())
+
+	dialer := websocket.Dialer{Subprotocols: []string{WebSocketSubprotocol}}
+	ws, _, err = dialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close() // nolint: errcheck
+	server, err := l.Accept()
+	require.NoError(t, err)
+
+	require.NoError(t, ws.WriteMessage(websocket.TextMessage, []byte("hello")))
+	_, err = packet.ReadPacket(server)
+	assert.Equal(t, ErrWebSocketTextMessage, err)
+}
+
+func TestWebSocketCompression(t *testing.T) {
+	l, err := ListenWebSocket("127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+	l.Compression = &WebSocketCompression{Level: 9, MinSize: 64, MaxMessageSize: 4096}
+	l.Compress = func(r *http.Request) bool { return r.URL.Path != "/plain" }
+	url := "ws://" + l.Addr().String()
+
+	dialer := websocket.Dialer{Subprotocols: []string{WebSocketSubprotocol}, EnableCompression: true}
+	for path, want := range map[string]bool{"/mqtt": true, "/plain": false} {
+		ws, res, err := dialer.Dial(url+path, nil)
+		require.NoError(t, err)
+		assert.Equal(t, want, strings.Contains(res.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate"), path)
+		require.NoError(t, ws.Close())
+		server, err := l.Accept()
+		require.NoError(t, err)
+		require.NoError(t, server.Close())
+	}
+
+	client, err := DialWebSocketWith(url, &WebSocketCompression{})
+	require.NoError(t, err)
+	defer client.Close() // nolint: errcheck
+	server, err := l.Accept()
+	require.NoError(t, err)
+	defer server.Close() // nolint: errcheck
+
+	payload := bytes.Repeat([]byte(`{"temperature": 21.5}`), 100)
+	publish := packet.NewPublish("a/b", 0, payload)
+	go func() { _ = packet.WritePacket(client, publish) }()
+	p, err := packet.ReadPacket(server)
+	require.NoError(t, err)
+	assert.Equal(t, publish, p)
+
+	require.NoError(t, packet.WritePacket(server, publish))
+	p, err = packet.ReadPacket(client)
+	require.NoError(t, err)
+	assert.Equal(t, publish, p)
+
+	// Small on the wire, too large once decompressed
+	go func() { _ = packet.WritePacket(client, packet.NewPublish("a/b", 0, make([]byte, 5000))) }()
+	_, err = packet.ReadPacket(server)
+	assert.ErrorIs(t, err, ErrWebSocketTooLarge)
+}